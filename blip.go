@@ -13,6 +13,8 @@ import (
 	"os"
 	"path"
 	"runtime"
+	"sort"
+	"strconv"
 	"strings"
 	"time"
 
@@ -43,6 +45,7 @@ type Metrics struct {
 	Interval  uint                     // interval number
 	State     string                   // state of monitor
 	Values    map[string][]MetricValue // keyed on domain
+	Empty     []string                 // domains that returned ErrNoMetrics (sorted)
 }
 
 func (m *Metrics) String() string {
@@ -76,6 +79,55 @@ type MetricValue struct {
 	Meta map[string]string
 }
 
+// GroupByMeta groups metric values that have identical Meta so sinks can send
+// metrics that share the same labels in one batch. The map is keyed on a stable
+// fingerprint of Meta: sorted, quoted key-value pairs like "k1"="v1","k2"="v2".
+// Nil and empty Meta both have the empty fingerprint "". The order of metric
+// values in each group is the same as the input order.
+func GroupByMeta(values []MetricValue) map[string][]MetricValue {
+	groups := map[string][]MetricValue{}
+	for i := range values {
+		fp := metaFingerprint(values[i].Meta)
+		groups[fp] = append(groups[fp], values[i])
+	}
+	return groups
+}
+
+// MergeLabels adds the labels (Plan.LevelLabels) to the Meta of all metric
+// values. Labels do not override Meta keys set by the collector. Meta is copied
+// because collectors can share Meta maps between metric values.
+func MergeLabels(values []MetricValue, labels map[string]string) {
+	if len(labels) == 0 {
+		return
+	}
+	for i := range values {
+		meta := make(map[string]string, len(values[i].Meta)+len(labels))
+		for k, v := range labels {
+			meta[k] = v
+		}
+		for k, v := range values[i].Meta {
+			meta[k] = v // collector Meta takes precedence
+		}
+		values[i].Meta = meta
+	}
+}
+
+func metaFingerprint(meta map[string]string) string {
+	if len(meta) == 0 {
+		return ""
+	}
+	keys := make([]string, 0, len(meta))
+	for k := range meta {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	pairs := make([]string, len(keys))
+	for i, k := range keys {
+		pairs[i] = strconv.Quote(k) + "=" + strconv.Quote(meta[k])
+	}
+	return strings.Join(pairs, ",")
+}
+
 // Sink sends metrics to an external destination.
 type Sink interface {
 	// Send sends metrics to the sink. It must respect the context timeout, if any.
@@ -86,6 +138,43 @@ type Sink interface {
 	Name() string
 }
 
+// Units that sinks can prefer for time-based metrics (see SinkUnit).
+const (
+	UNIT_S  = "s"
+	UNIT_MS = "ms"
+)
+
+// SinkUnit is an optional Sink interface for sinks that prefer a unit for
+// time-based metrics, like seconds for Prometheus. Collectors that support it,
+// like repl.lag with option sink-unit=auto, report those metrics in the unit.
+type SinkUnit interface {
+	// PreferredUnit returns UNIT_S or UNIT_MS, or an empty string if no
+	// preference, like a wrapper sink whose sink doesn't implement SinkUnit.
+	PreferredUnit() string
+}
+
+// PreferredUnit returns the unit preferred by the sinks that implement SinkUnit,
+// or an empty string if none do or they prefer different units.
+func PreferredUnit(sinks []Sink) string {
+	unit := ""
+	for _, s := range sinks {
+		su, ok := s.(SinkUnit)
+		if !ok {
+			continue
+		}
+		u := su.PreferredUnit()
+		if u == "" {
+			continue
+		}
+		if unit != "" && u != unit {
+			Debug("sinks prefer different units: %s, %s", unit, u)
+			return ""
+		}
+		unit = u
+	}
+	return unit
+}
+
 // SinkFactory makes a Sink for a monitor.
 type SinkFactory interface {
 	Make(SinkFactoryArgs) (Sink, error)
@@ -209,6 +298,18 @@ func Bool(s string) bool {
 	return v == "true" || v == "yes" || v == "enable" || v == "enabled"
 }
 
+// BoolOpt returns the Bool value of option key in m, and whether the option is
+// set: the key exists and the value isn't empty (or only spaces). Unlike Bool,
+// which returns false for an unset option and for "no", it lets a collector
+// apply its default only when the option is unset. If not set, value is false.
+func BoolOpt(m map[string]string, key string) (value bool, set bool) {
+	s, ok := m[key]
+	if !ok || strings.TrimSpace(s) == "" {
+		return false, false
+	}
+	return Bool(strings.TrimSpace(s)), true
+}
+
 func MonitorId(cfg ConfigMonitor) string {
 	switch {
 	case cfg.MonitorId != "":
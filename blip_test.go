@@ -6,6 +6,8 @@ import (
 	"testing"
 	"time"
 
+	"github.com/go-test/deep"
+
 	"github.com/cashapp/blip"
 )
 
@@ -45,3 +47,118 @@ func TestTimeLimit(t *testing.T) {
 		}
 	}
 }
+
+func TestGroupByMeta(t *testing.T) {
+	values := []blip.MetricValue{
+		{Name: "a", Value: 1, Meta: map[string]string{"channel": "ch1", "source": "s1"}},
+		{Name: "b", Value: 2}, // nil Meta
+		{Name: "c", Value: 3, Meta: map[string]string{"source": "s1", "channel": "ch1"}},
+		{Name: "d", Value: 4, Meta: map[string]string{}}, // empty Meta
+		{Name: "e", Value: 5, Meta: map[string]string{"channel": "ch2", "source": "s1"}},
+		{Name: "f", Value: 6, Meta: map[string]string{"channel": "ch1,source=s1"}}, // not the same as a
+	}
+
+	got := blip.GroupByMeta(values)
+	if len(got) != 4 {
+		t.Fatalf("got %d groups, expected 4: %v", len(got), got)
+	}
+
+	expect := map[string][]string{
+		`"channel"="ch1","source"="s1"`: {"a", "c"},
+		``:                              {"b", "d"},
+		`"channel"="ch2","source"="s1"`: {"e"},
+		`"channel"="ch1,source=s1"`:     {"f"},
+	}
+	for fp, names := range expect {
+		group, ok := got[fp]
+		if !ok {
+			t.Errorf("no group %s", fp)
+			continue
+		}
+		if len(group) != len(names) {
+			t.Errorf("group %s has %d values, expected %d: %v", fp, len(group), len(names), group)
+			continue
+		}
+		for i := range names {
+			if group[i].Name != names[i] {
+				t.Errorf("group %s value %d = %s, expected %s", fp, i, group[i].Name, names[i])
+			}
+		}
+	}
+
+	if len(blip.GroupByMeta(nil)) != 0 {
+		t.Error("GroupByMeta(nil) returned groups, expected none")
+	}
+}
+
+func TestMergeLabels(t *testing.T) {
+	shared := map[string]string{"source": "s1"}
+	values := []blip.MetricValue{
+		{Name: "a", Value: 1, Meta: shared},
+		{Name: "b", Value: 2, Meta: shared},
+		{Name: "c", Value: 3}, // nil Meta
+		{Name: "d", Value: 4, Meta: map[string]string{"env": "collector"}},
+	}
+	blip.MergeLabels(values, map[string]string{"env": "prod", "team": "dba"})
+	expect := []blip.MetricValue{
+		{Name: "a", Value: 1, Meta: map[string]string{"source": "s1", "env": "prod", "team": "dba"}},
+		{Name: "b", Value: 2, Meta: map[string]string{"source": "s1", "env": "prod", "team": "dba"}},
+		{Name: "c", Value: 3, Meta: map[string]string{"env": "prod", "team": "dba"}},
+		{Name: "d", Value: 4, Meta: map[string]string{"env": "collector", "team": "dba"}}, // collector Meta not overridden
+	}
+	if diff := deep.Equal(values, expect); diff != nil {
+		t.Error(diff)
+	}
+	if len(shared) != 1 {
+		t.Errorf("shared Meta modified: %v", shared)
+	}
+
+	// No labels: no-op
+	values = []blip.MetricValue{{Name: "a", Value: 1}}
+	blip.MergeLabels(values, nil)
+	if values[0].Meta != nil {
+		t.Errorf("Meta = %v, expected nil", values[0].Meta)
+	}
+}
+
+func TestBoolOpt(t *testing.T) {
+	opts := map[string]string{
+		"yes":     "yes",
+		"no":      "no",
+		"true":    "TRUE",
+		"enabled": " enabled ",
+		"empty":   "",
+		"spaces":  "  ",
+		"other":   "maybe",
+	}
+	testCases := []struct {
+		key   string
+		value bool
+		set   bool
+	}{
+		{"yes", true, true},
+		{"no", false, true}, // explicit no: set
+		{"true", true, true},
+		{"enabled", true, true},
+		{"empty", false, false},
+		{"spaces", false, false},
+		{"other", false, true},
+		{"unset", false, false}, // not in map: unset, unlike no
+	}
+	for _, tc := range testCases {
+		value, set := blip.BoolOpt(opts, tc.key)
+		if value != tc.value || set != tc.set {
+			t.Errorf("%s: got (%t, %t), expected (%t, %t)", tc.key, value, set, tc.value, tc.set)
+		}
+	}
+
+	// Bool can't tell unset from no
+	if blip.Bool(opts["no"]) != blip.Bool(opts["unset"]) {
+		t.Errorf("Bool(no) != Bool(unset)")
+	}
+
+	// Nil map
+	if value, set := blip.BoolOpt(nil, "yes"); value || set {
+		t.Errorf("nil map: got (%t, %t), expected (false, false)", value, set)
+	}
+}
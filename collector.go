@@ -7,6 +7,11 @@ import (
 	"database/sql"
 	"errors"
 	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	ver "github.com/hashicorp/go-version"
 )
 
 // Collector collects metrics for a single metric domain.
@@ -31,6 +36,41 @@ type Collector interface {
 	Collect(ctx context.Context, levelName string) ([]MetricValue, error)
 }
 
+// Collector costs returned by CollectorCost, from least to most expensive.
+const (
+	COST_UNKNOWN   byte = iota
+	COST_CHEAP          // in-memory or single-row indexed query
+	COST_MODERATE       // small query, like a few rows from a system table
+	COST_EXPENSIVE      // joins or scans of many rows, like Performance Schema
+)
+
+// CollectorCost is an optional interface that a Collector can implement to
+// report the estimated query cost of Collect. The cost usually depends on how
+// the collector was prepared (which is why it's not in CollectorHelp), so Cost
+// is called only after Prepare returns nil. The scheduler can use the cost to
+// stagger expensive collectors.
+type CollectorCost interface {
+	// Cost returns the estimated cost of one call to Collect at the level:
+	// one of the COST_ constants. It returns COST_UNKNOWN if the level was
+	// not prepared.
+	Cost(levelName string) byte
+}
+
+// CollectorDynamicHelp is an optional interface that a Collector can implement
+// to return Help tailored to a server, like with Unsupported set to the Selector
+// values that don't work on the server version or flavor (MySQL or MariaDB).
+// Help is still required: it's the generic case, used when there's no server
+// (like in docs and plan validation without a monitor). Before calling Prepare,
+// the engine calls DynamicHelp and warns about options that don't apply to the
+// server (see Inapplicable), but plans are not invalid because of it.
+type CollectorDynamicHelp interface {
+	// DynamicHelp returns Help for the server connected to db. It should keep
+	// all options and values in Help, so plans valid against Help are valid
+	// against it. It returns an error if it cannot query the server; the caller
+	// should fall back to Help.
+	DynamicHelp(ctx context.Context, db *sql.DB) (CollectorHelp, error)
+}
+
 // Help represents information about a collector.
 type CollectorHelp struct {
 	Domain      string
@@ -40,6 +80,27 @@ type CollectorHelp struct {
 	Groups      []CollectorKeyValue
 	Meta        []CollectorKeyValue
 	Metrics     []CollectorMetric
+
+	// Selector is an optional option that selects how the collector works,
+	// like repl.lag option writer. Options with AppliesTo list the values of
+	// this option to which they apply. See Inapplicable.
+	Selector string
+
+	// Versions is an optional map of MySQL version requirements. The key is a
+	// value of the Selector option, like repl.lag writer pfs, or "" for the
+	// collector (all values). See VersionMismatch.
+	Versions map[string]CollectorVersion
+
+	// Unsupported is an optional list of Selector option values that don't
+	// work on the server, like repl.lag writer pfs on MariaDB. It's set by
+	// CollectorDynamicHelp, not Help. See Inapplicable.
+	Unsupported []string
+}
+
+// CollectorVersion is a MySQL version requirement in CollectorHelp.Versions.
+type CollectorVersion struct {
+	Min string // minimum version (inclusive), or "" for any
+	Max string // maximum version (exclusive), or "" for any
 }
 
 type CollectorHelpOption struct {
@@ -47,8 +108,32 @@ type CollectorHelpOption struct {
 	Desc    string            // describes Name
 	Default string            // key in Values
 	Values  map[string]string // value => description
+
+	// Required is true if the option must be set. If the option is in a Group,
+	// it means exactly one option in the group must be set.
+	Required bool
+
+	// Group is an optional name of mutually exclusive options: at most one
+	// option in the group can be set (exactly one if any option is Required).
+	Group string
+
+	// List is true if the value can be a comma-separated list of Values,
+	// like repl.lag writer fallback chain "pfs,blip".
+	List bool
+
+	// AppliesTo is an optional list of values of the CollectorHelp.Selector
+	// option to which this option applies. If empty, it applies to all values.
+	AppliesTo []string
+
+	// Sensitive is true if the value can contain a secret, like a DSN with a
+	// password, after interpolation. Sensitive values are redacted by Redact,
+	// which collectors must use to log or report options.
+	Sensitive bool
 }
 
+// REDACTED replaces sensitive option values. See CollectorHelp.Redact.
+const REDACTED = "<redacted>"
+
 type CollectorHelpError struct {
 	Name    string
 	Handles string
@@ -59,6 +144,7 @@ type CollectorMetric struct {
 	Name string
 	Desc string // describes Name
 	Type byte
+	Unit string // optional unit of value like "ms" (milliseconds) or "bytes"
 }
 
 type CollectorKeyValue struct {
@@ -68,9 +154,9 @@ type CollectorKeyValue struct {
 
 // Validate returns nil if all the given options are valid, else it an error.
 func (h CollectorHelp) Validate(opts map[string]string) error {
-	// No input? No error.
+	// No input? No error, unless an option is required.
 	if len(opts) == 0 {
-		return nil
+		return h.ValidateRequired(opts)
 	}
 
 	// At least 1 opt given, so error if the collector has no options
@@ -90,20 +176,221 @@ func (h CollectorHelp) Validate(opts map[string]string) error {
 		// If the collector option has a list of allowed values,
 		// error if the given value isn't one of the allowed values
 		if len(o.Values) > 0 {
-			allowed := false
-			for allowedVal := range o.Values {
-				if givenValue == allowedVal {
-					allowed = true
-					break
+			given := []string{givenValue}
+			if o.List {
+				given = strings.Split(givenValue, ",")
+			}
+			for _, v := range given {
+				if _, ok := o.Values[strings.TrimSpace(v)]; !ok {
+					return fmt.Errorf("invalid value for option %s: %s (run 'blip --print-domains' to list collectors and options)",
+						givenKey, givenValue)
+				}
+			}
+		}
+	}
+
+	return h.ValidateRequired(opts)
+}
+
+// Inapplicable returns a warning for each given option that does not apply to
+// the selected values of the Selector option: see CollectorHelpOption.AppliesTo.
+// If no values are given, they're the Selector option value (comma-separated
+// values, like a repl.lag writer fallback chain, are split), unless it's the
+// default, like writer=auto, which is resolved at runtime, so options are not
+// checked. An option applies if it applies to any selected value. An option set
+// to its default (like no for a bool option) is not ignored because it has no
+// effect anyway. Regardless of the selected values, an option does not apply if
+// it applies only to Unsupported values. Warnings are sorted by option name.
+// Unlike Validate, these are not errors because the collector ignores
+// inapplicable options.
+func (h CollectorHelp) Inapplicable(opts map[string]string, selected ...string) []string {
+	if h.Selector == "" {
+		return nil
+	}
+	if len(selected) == 0 {
+		selected = h.selected(opts)
+	}
+	if len(selected) == 0 && len(h.Unsupported) == 0 {
+		return nil
+	}
+	names := make([]string, 0, len(opts))
+	for name := range opts {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var warnings []string
+NAMES:
+	for _, name := range names {
+		o, ok := h.Options[name]
+		if !ok || len(o.AppliesTo) == 0 || opts[name] == "" || opts[name] == o.Default {
+			continue
+		}
+		if h.unsupported(o.AppliesTo) {
+			warnings = append(warnings, fmt.Sprintf("option %s ignored: applies only to %s %s, not supported on this server",
+				name, h.Selector, strings.Join(o.AppliesTo, ", ")))
+			continue
+		}
+		if len(selected) == 0 {
+			continue // default: resolved at runtime
+		}
+		for _, s := range selected {
+			for _, a := range o.AppliesTo {
+				if s == a {
+					continue NAMES
 				}
 			}
-			if !allowed {
-				return fmt.Errorf("invalid value for option %s: %s (run 'blip --print-domains' to list collectors and options)",
-					givenKey, givenValue)
+		}
+		warnings = append(warnings, fmt.Sprintf("option %s ignored: applies only to %s %s, not %s",
+			name, h.Selector, strings.Join(o.AppliesTo, ", "), strings.Join(selected, ", ")))
+	}
+	return warnings
+}
+
+// Redact returns a copy of the options with the values of Sensitive options
+// replaced by REDACTED. Empty values are not replaced. Use it to log options,
+// which are interpolated (see Plan.InterpolateEnvVars), so secrets in env vars
+// are not leaked in debug output.
+func (h CollectorHelp) Redact(opts map[string]string) map[string]string {
+	if opts == nil {
+		return nil
+	}
+	redacted := make(map[string]string, len(opts))
+	for k, v := range opts {
+		if v != "" && h.Options[k].Sensitive {
+			v = REDACTED
+		}
+		redacted[k] = v
+	}
+	return redacted
+}
+
+// VersionMismatch returns a warning for each version requirement in Versions
+// that the given MySQL version does not meet: the collector requirement (key
+// ""), and the requirement of each selected value of the Selector option. Like
+// Inapplicable, if no values are given, they're the Selector option value, and
+// the default (resolved at runtime) is not checked. The version can have a
+// suffix, like "8.0.36-log". An invalid version returns an error.
+func (h CollectorHelp) VersionMismatch(opts map[string]string, version string, selected ...string) ([]string, error) {
+	if len(h.Versions) == 0 {
+		return nil, nil
+	}
+	v, err := ver.NewVersion(strings.SplitN(version, "-", 2)[0])
+	if err != nil {
+		return nil, fmt.Errorf("invalid MySQL version: %s: %w", version, err)
+	}
+	if len(selected) == 0 && h.Selector != "" {
+		selected = h.selected(opts)
+	}
+	var warnings []string
+	for _, s := range append([]string{""}, selected...) {
+		c, ok := h.Versions[s]
+		if !ok {
+			continue
+		}
+		what := "collector " + h.Domain
+		if s != "" {
+			what = h.Selector + " " + s
+		}
+		if c.Min != "" {
+			min, err := ver.NewVersion(c.Min)
+			if err != nil {
+				return nil, fmt.Errorf("invalid minimum version for %s: %s: %w", what, c.Min, err)
+			}
+			if v.LessThan(min) {
+				warnings = append(warnings, fmt.Sprintf("%s requires MySQL %s or newer, not %s", what, c.Min, version))
+			}
+		}
+		if c.Max != "" {
+			max, err := ver.NewVersion(c.Max)
+			if err != nil {
+				return nil, fmt.Errorf("invalid maximum version for %s: %s: %w", what, c.Max, err)
+			}
+			if !v.LessThan(max) {
+				warnings = append(warnings, fmt.Sprintf("%s requires MySQL older than %s, not %s", what, c.Max, version))
 			}
 		}
 	}
+	return warnings, nil
+}
 
+// selected returns the Selector option value split on commas, or nil if not
+// set or the default.
+// unsupported returns true if all the values are Unsupported.
+func (h CollectorHelp) unsupported(values []string) bool {
+	if len(h.Unsupported) == 0 {
+		return false
+	}
+VALUES:
+	for _, v := range values {
+		for _, u := range h.Unsupported {
+			if v == u {
+				continue VALUES
+			}
+		}
+		return false
+	}
+	return true
+}
+
+func (h CollectorHelp) selected(opts map[string]string) []string {
+	v := opts[h.Selector]
+	if v == "" || v == h.Options[h.Selector].Default {
+		return nil
+	}
+	var selected []string
+	for _, s := range strings.Split(v, ",") {
+		selected = append(selected, strings.TrimSpace(s))
+	}
+	return selected
+}
+
+// ValidateRequired returns nil if the given options satisfy the Required and
+// Group constraints of the collector options, else it returns an error. Unlike
+// Validate, it does not check option values. An option is not set if its value
+// is an empty string (for example, from an unset environment variable).
+func (h CollectorHelp) ValidateRequired(opts map[string]string) error {
+	// Sort option names for deterministic errors
+	names := make([]string, 0, len(h.Options))
+	for name := range h.Options {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	groups := map[string][]string{} // group => option names
+	groupRequired := map[string]bool{}
+	for _, name := range names {
+		o := h.Options[name]
+		if o.Group != "" {
+			groups[o.Group] = append(groups[o.Group], name)
+			if o.Required {
+				groupRequired[o.Group] = true
+			}
+			continue
+		}
+		if o.Required && opts[name] == "" {
+			return fmt.Errorf("missing required option: %s", name)
+		}
+	}
+
+	groupNames := make([]string, 0, len(groups))
+	for g := range groups {
+		groupNames = append(groupNames, g)
+	}
+	sort.Strings(groupNames)
+	for _, g := range groupNames {
+		var set []string
+		for _, name := range groups[g] {
+			if opts[name] != "" {
+				set = append(set, name)
+			}
+		}
+		switch {
+		case len(set) > 1:
+			return fmt.Errorf("options are mutually exclusive: %s", strings.Join(set, ", "))
+		case len(set) == 0 && groupRequired[g]:
+			return fmt.Errorf("missing required option: one of %s", strings.Join(groups[g], ", "))
+		}
+	}
 	return nil
 }
 
@@ -137,3 +424,120 @@ type CollectorFactory interface {
 
 // ErrMore signals that a collector will return more values. See https://cashapp.github.io/blip/develop/collectors/#long-running.
 var ErrMore = errors.New("more metrics")
+
+// ErrNoMetrics signals that a collector intentionally collected no metrics,
+// like repl.lag when the instance is not a replica and option report-not-a-replica
+// is disabled. It's not an error: Blip does not report a collector error, and it
+// adds the domain to Metrics.Empty so sinks can tell a deliberate drop from a
+// collector that returned no values (nil error), which can be a misconfiguration.
+var ErrNoMetrics = errors.New("no metrics (intentional)")
+
+// traceIdKey is the context key for WithTraceId and TraceId.
+type traceIdKey struct{}
+
+// WithTraceId returns a copy of ctx with the trace ID (or exemplar ID) for a
+// collection. The caller of Collector.Collect, like the level collector or a
+// plugin, sets it; collectors that support it add it to metric Meta so that
+// sinks that support exemplars can link metric values to traces.
+func WithTraceId(ctx context.Context, traceId string) context.Context {
+	return context.WithValue(ctx, traceIdKey{}, traceId)
+}
+
+// TraceId returns the trace ID set by WithTraceId, or an empty string if not set
+// or ctx is nil (like the second and subsequent calls after ErrMore).
+func TraceId(ctx context.Context) string {
+	if ctx == nil {
+		return ""
+	}
+	traceId, _ := ctx.Value(traceIdKey{}).(string)
+	return traceId
+}
+
+// sinkUnitKey is the context key for WithSinkUnit and SinkUnitFrom.
+type sinkUnitKey struct{}
+
+// WithSinkUnit returns a copy of ctx with the unit preferred by the sinks of
+// the monitor (see PreferredUnit). The caller of Collector.Prepare, like the
+// level collector, sets it; collectors that support it report time-based
+// metrics in the unit.
+func WithSinkUnit(ctx context.Context, unit string) context.Context {
+	return context.WithValue(ctx, sinkUnitKey{}, unit)
+}
+
+// SinkUnitFrom returns the unit set by WithSinkUnit, or an empty string if not
+// set or ctx is nil.
+func SinkUnitFrom(ctx context.Context) string {
+	if ctx == nil {
+		return ""
+	}
+	unit, _ := ctx.Value(sinkUnitKey{}).(string)
+	return unit
+}
+
+// --------------------------------------------------------------------------
+
+// mockCollectors holds CollectorHelp registered by RegisterMockCollector,
+// keyed on domain.
+var mockCollectors = struct {
+	*sync.Mutex
+	help map[string]CollectorHelp
+}{
+	Mutex: &sync.Mutex{},
+	help:  map[string]CollectorHelp{},
+}
+
+// RegisterMockCollector registers a no-op collector for the domain that
+// declares the given help. Plan.Validate uses the help to validate options
+// and metrics for the domain, which lets tests check that a plan is
+// structurally valid without real collectors or a database. Registering the
+// same domain again replaces its help.
+func RegisterMockCollector(domain string, help CollectorHelp) {
+	mockCollectors.Lock()
+	defer mockCollectors.Unlock()
+	if help.Domain == "" {
+		help.Domain = domain
+	}
+	mockCollectors.help[domain] = help
+}
+
+// RemoveMockCollector removes a mock collector registered by RegisterMockCollector.
+func RemoveMockCollector(domain string) {
+	mockCollectors.Lock()
+	defer mockCollectors.Unlock()
+	delete(mockCollectors.help, domain)
+}
+
+// MockCollector returns the no-op collector registered for the domain by
+// RegisterMockCollector. It returns false if no mock collector is registered.
+func MockCollector(domain string) (Collector, bool) {
+	mockCollectors.Lock()
+	defer mockCollectors.Unlock()
+	help, ok := mockCollectors.help[domain]
+	if !ok {
+		return nil, false
+	}
+	return mockCollector{help: help}, true
+}
+
+// mockCollector is the no-op collector returned by MockCollector.
+type mockCollector struct {
+	help CollectorHelp
+}
+
+var _ Collector = mockCollector{}
+
+func (c mockCollector) Domain() string {
+	return c.help.Domain
+}
+
+func (c mockCollector) Help() CollectorHelp {
+	return c.help
+}
+
+func (c mockCollector) Prepare(ctx context.Context, plan Plan) (func(), error) {
+	return nil, nil
+}
+
+func (c mockCollector) Collect(ctx context.Context, levelName string) ([]MetricValue, error) {
+	return nil, nil
+}
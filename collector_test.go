@@ -0,0 +1,290 @@
+// Copyright 2024 Block, Inc.
+
+package blip_test
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/cashapp/blip"
+	"github.com/cashapp/blip/test/mock"
+)
+
+func TestValidateRequired(t *testing.T) {
+	help := blip.CollectorHelp{
+		Domain: "test",
+		Options: map[string]blip.CollectorHelpOption{
+			"table":       {Name: "table", Required: true},
+			"source-id":   {Name: "source-id", Group: "source", Required: true},
+			"source-role": {Name: "source-role", Group: "source"},
+			"opt-a":       {Name: "opt-a", Group: "optional"},
+			"opt-b":       {Name: "opt-b", Group: "optional"},
+			"other":       {Name: "other"},
+		},
+	}
+
+	var testCases = []struct {
+		opts  map[string]string
+		valid bool
+	}{
+		{map[string]string{"table": "t", "source-id": "s1"}, true},
+		{map[string]string{"table": "t", "source-role": "r1"}, true},
+		{map[string]string{"table": "t", "source-role": "r1", "opt-b": "b", "other": "o"}, true},
+		{map[string]string{"table": "t", "source-id": "s1", "source-role": ""}, true},    // empty = not set
+		{map[string]string{"source-id": "s1"}, false},                                    // missing required table
+		{map[string]string{"table": "", "source-id": "s1"}, false},                       // missing required table
+		{map[string]string{"table": "t"}, false},                                         // missing one of source group
+		{map[string]string{"table": "t", "source-id": "s1", "source-role": "r1"}, false}, // both set
+		{map[string]string{"table": "t", "source-id": "s1", "opt-a": "a", "opt-b": "b"}, false},
+		{nil, false},
+	}
+	for _, tc := range testCases {
+		err := help.ValidateRequired(tc.opts)
+		if tc.valid && err != nil {
+			t.Errorf("%v: got error '%s', expected nil", tc.opts, err)
+		} else if !tc.valid && err == nil {
+			t.Errorf("%v: no error, expected one", tc.opts)
+		}
+
+		// Validate does the same checks (and more)
+		err = help.Validate(tc.opts)
+		if tc.valid && err != nil {
+			t.Errorf("Validate %v: got error '%s', expected nil", tc.opts, err)
+		} else if !tc.valid && err == nil {
+			t.Errorf("Validate %v: no error, expected one", tc.opts)
+		}
+	}
+
+	// No required options and no options given: valid
+	if err := (blip.CollectorHelp{}).Validate(nil); err != nil {
+		t.Errorf("got error '%s' for no options, expected nil", err)
+	}
+}
+
+func TestValidateList(t *testing.T) {
+	help := blip.CollectorHelp{
+		Domain: "test",
+		Options: map[string]blip.CollectorHelpOption{
+			"writer": {Name: "writer", Values: map[string]string{"pfs": "", "blip": ""}, List: true},
+			"round":  {Name: "round", Values: map[string]string{"ceil": "", "floor": ""}},
+		},
+	}
+	var testCases = []struct {
+		opts  map[string]string
+		valid bool
+	}{
+		{map[string]string{"writer": "pfs"}, true},
+		{map[string]string{"writer": "pfs,blip"}, true},
+		{map[string]string{"writer": "blip, pfs"}, true},
+		{map[string]string{"writer": "pfs,pt"}, false},
+		{map[string]string{"round": "ceil"}, true},
+		{map[string]string{"round": "ceil,floor"}, false}, // not a List
+	}
+	for _, tc := range testCases {
+		err := help.Validate(tc.opts)
+		if tc.valid && err != nil {
+			t.Errorf("%v: got error '%s', expected nil", tc.opts, err)
+		} else if !tc.valid && err == nil {
+			t.Errorf("%v: no error, expected one", tc.opts)
+		}
+	}
+}
+
+func TestInapplicable(t *testing.T) {
+	help := blip.CollectorHelp{
+		Domain:   "test",
+		Selector: "writer",
+		Options: map[string]blip.CollectorHelpOption{
+			"writer":  {Name: "writer", Default: "auto"},
+			"table":   {Name: "table", AppliesTo: []string{"blip", "pt"}},
+			"latency": {Name: "latency", AppliesTo: []string{"blip"}},
+			"channel": {Name: "channel", AppliesTo: []string{"pfs"}},
+			"round":   {Name: "round"},
+			"alive":   {Name: "alive", AppliesTo: []string{"blip"}, Default: "no"},
+		},
+	}
+
+	var testCases = []struct {
+		opts     map[string]string
+		selected []string
+		warnings []string
+	}{
+		{map[string]string{"writer": "blip", "table": "t", "latency": "10", "round": "ceil"}, nil, nil},
+		{map[string]string{"writer": "pfs", "latency": "10", "round": "ceil"}, nil, []string{
+			"option latency ignored: applies only to writer blip, not pfs",
+		}},
+		{map[string]string{"writer": "pt", "latency": "10", "table": "t", "channel": "c"}, nil, []string{
+			"option channel ignored: applies only to writer pfs, not pt",
+			"option latency ignored: applies only to writer blip, not pt",
+		}},
+		{map[string]string{"writer": "pfs, blip", "latency": "10", "channel": "c"}, nil, nil}, // applies to any
+		{map[string]string{"writer": "pfs", "latency": ""}, nil, nil},                         // empty = not set
+		{map[string]string{"writer": "pfs", "alive": "no"}, nil, nil},                         // default = no effect
+		{map[string]string{"writer": "auto", "latency": "10"}, nil, nil},                      // default: resolved at runtime
+		{map[string]string{"latency": "10"}, nil, nil},
+		{map[string]string{"writer": "auto", "latency": "10"}, []string{"pfs"}, []string{ // resolved by caller
+			"option latency ignored: applies only to writer blip, not pfs",
+		}},
+	}
+	for _, tc := range testCases {
+		got := help.Inapplicable(tc.opts, tc.selected...)
+		if !reflect.DeepEqual(got, tc.warnings) {
+			t.Errorf("%v %v: got %q, expected %q", tc.opts, tc.selected, got, tc.warnings)
+		}
+	}
+
+	// Options that apply only to values unsupported on the server, regardless
+	// of the selected values
+	help.Unsupported = []string{"pfs", "pt"}
+	for _, opts := range []map[string]string{
+		{"writer": "blip", "channel": "c", "table": "t"},
+		{"writer": "auto", "channel": "c", "table": "t"},
+		{"channel": "c", "table": "t"},
+	} {
+		got := help.Inapplicable(opts)
+		expect := []string{"option channel ignored: applies only to writer pfs, not supported on this server"}
+		if !reflect.DeepEqual(got, expect) {
+			t.Errorf("%v: got %q, expected %q", opts, got, expect)
+		}
+	}
+	help.Unsupported = nil
+
+	// No selector: no warnings
+	help.Selector = ""
+	if got := help.Inapplicable(map[string]string{"writer": "pfs", "latency": "10"}); got != nil {
+		t.Errorf("got %q without selector, expected nil", got)
+	}
+}
+
+func TestTraceId(t *testing.T) {
+	ctx := context.Background()
+	if got := blip.TraceId(ctx); got != "" {
+		t.Errorf("got trace ID %q, expected empty string", got)
+	}
+	ctx = blip.WithTraceId(ctx, "4bf92f3577b34da6a3ce929d0e0e4736")
+	if got := blip.TraceId(ctx); got != "4bf92f3577b34da6a3ce929d0e0e4736" {
+		t.Errorf("got trace ID %q, expected 4bf92f3577b34da6a3ce929d0e0e4736", got)
+	}
+}
+
+func TestSinkUnit(t *testing.T) {
+	ctx := context.Background()
+	if got := blip.SinkUnitFrom(ctx); got != "" {
+		t.Errorf("got sink unit %q, expected empty string", got)
+	}
+	ctx = blip.WithSinkUnit(ctx, blip.UNIT_S)
+	if got := blip.SinkUnitFrom(ctx); got != blip.UNIT_S {
+		t.Errorf("got sink unit %q, expected s", got)
+	}
+
+	prom := mock.UnitSink{Unit: blip.UNIT_S}
+	datadog := mock.UnitSink{Unit: blip.UNIT_MS}
+	noPref := mock.UnitSink{} // like a wrapper sink whose sink doesn't prefer a unit
+	for _, tc := range []struct {
+		sinks []blip.Sink
+		unit  string
+	}{
+		{nil, ""},
+		{[]blip.Sink{mock.Sink{}}, ""},
+		{[]blip.Sink{prom}, blip.UNIT_S},
+		{[]blip.Sink{datadog}, blip.UNIT_MS},
+		{[]blip.Sink{mock.Sink{}, noPref, prom, prom}, blip.UNIT_S}, // sinks without a preference are ignored
+		{[]blip.Sink{prom, datadog}, ""},                            // different units
+	} {
+		if got := blip.PreferredUnit(tc.sinks); got != tc.unit {
+			t.Errorf("PreferredUnit(%v) = %q, expected %q", tc.sinks, got, tc.unit)
+		}
+	}
+}
+
+func TestVersionMismatch(t *testing.T) {
+	help := blip.CollectorHelp{
+		Domain:   "test",
+		Selector: "writer",
+		Options: map[string]blip.CollectorHelpOption{
+			"writer": {Name: "writer", Default: "auto"},
+		},
+		Versions: map[string]blip.CollectorVersion{
+			"":       {Min: "5.7"},
+			"pfs":    {Min: "8.0"},
+			"legacy": {Max: "8.4"},
+		},
+	}
+
+	var testCases = []struct {
+		opts     map[string]string
+		version  string
+		selected []string
+		warnings []string
+	}{
+		{map[string]string{"writer": "pfs"}, "8.0.36", nil, nil},
+		{map[string]string{"writer": "pfs"}, "5.7.44-log", nil, []string{
+			"writer pfs requires MySQL 8.0 or newer, not 5.7.44-log",
+		}},
+		{map[string]string{"writer": "pfs"}, "5.6.51", nil, []string{
+			"collector test requires MySQL 5.7 or newer, not 5.6.51",
+			"writer pfs requires MySQL 8.0 or newer, not 5.6.51",
+		}},
+		{map[string]string{"writer": "legacy"}, "8.4.0", nil, []string{
+			"writer legacy requires MySQL older than 8.4, not 8.4.0",
+		}},
+		{map[string]string{"writer": "legacy"}, "8.0.36", nil, nil},
+		{map[string]string{"writer": "pfs,blip"}, "5.7.44", nil, []string{
+			"writer pfs requires MySQL 8.0 or newer, not 5.7.44",
+		}},
+		{map[string]string{"writer": "auto"}, "5.7.44", nil, nil}, // default: resolved at runtime
+		{map[string]string{"writer": "auto"}, "5.7.44", []string{"pfs"}, []string{ // resolved by caller
+			"writer pfs requires MySQL 8.0 or newer, not 5.7.44",
+		}},
+		{nil, "5.7.44", nil, nil},
+	}
+	for _, tc := range testCases {
+		got, err := help.VersionMismatch(tc.opts, tc.version, tc.selected...)
+		if err != nil {
+			t.Errorf("%v %s: error: %s", tc.opts, tc.version, err)
+		}
+		if !reflect.DeepEqual(got, tc.warnings) {
+			t.Errorf("%v %s %v: got %q, expected %q", tc.opts, tc.version, tc.selected, got, tc.warnings)
+		}
+	}
+
+	if _, err := help.VersionMismatch(nil, "not-a-version"); err == nil {
+		t.Error("no error for invalid version")
+	}
+}
+
+func TestRedact(t *testing.T) {
+	help := blip.CollectorHelp{
+		Domain: "test",
+		Options: map[string]blip.CollectorHelpOption{
+			"dsn":  {Name: "dsn", Sensitive: true},
+			"freq": {Name: "freq"},
+		},
+	}
+	opts := map[string]string{
+		"dsn":     "blip:secret@tcp(db1:3306)/",
+		"freq":    "1s",
+		"unknown": "v",
+	}
+	got := help.Redact(opts)
+	expect := map[string]string{
+		"dsn":     blip.REDACTED,
+		"freq":    "1s",
+		"unknown": "v",
+	}
+	if !reflect.DeepEqual(got, expect) {
+		t.Errorf("got %v, expected %v", got, expect)
+	}
+	if opts["dsn"] != "blip:secret@tcp(db1:3306)/" {
+		t.Errorf("options modified: %v", opts)
+	}
+
+	// Empty value not redacted (not set), and nil options
+	if got := help.Redact(map[string]string{"dsn": ""}); got["dsn"] != "" {
+		t.Errorf("empty dsn = %q, expected empty", got["dsn"])
+	}
+	if got := help.Redact(nil); got != nil {
+		t.Errorf("got %v, expected nil", got)
+	}
+}
@@ -19,6 +19,7 @@ const (
 	MONITOR_LOADER_PANIC  = "monitor-loader-panic"
 	PLANS_LOAD_MONITOR    = "plans-load-monitor"
 	PLANS_LOAD_SHARED     = "plans-load-shared"
+	PLAN_OPTION_IGNORED   = "plan-option-ignored"
 	SERVER_API_PANIC      = "server-api-panic"
 	SERVER_API_ERROR      = "server-api-error"
 	SERVER_RUN            = "server-run"
@@ -0,0 +1,84 @@
+// Copyright 2024 Block, Inc.
+
+package heartbeat
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	// FreqSamples is the number of most recent intervals between heartbeat
+	// timestamp changes that FreqEstimator uses.
+	FreqSamples = 10
+
+	// FreqMinSamples is the minimum number of intervals before FreqEstimator
+	// returns an estimate.
+	FreqMinSamples = 3
+)
+
+// FreqEstimator estimates the heartbeat write frequency from heartbeat reads.
+// Each read observes the heartbeat timestamp (ts); when ts changes, the interval
+// between the old and new ts is one sample. The estimate is the minimum of the
+// last FreqSamples intervals: if the reader misses a heartbeat (reads slower
+// than writes), the interval is a multiple of the write frequency, and the
+// minimum ignores it. The minimum also errs low, which is the safe side for
+// subtracting the sawtooth floor: it hides less real lag, not more.
+//
+// Samples are reset when the source changes or ts moves backwards. It is safe
+// for concurrent use.
+type FreqEstimator struct {
+	mu        sync.Mutex
+	srcId     string
+	last      time.Time
+	intervals []time.Duration // ring buffer, up to FreqSamples
+	n         int             // next index in intervals
+}
+
+// Observe records the heartbeat ts read from source srcId.
+func (e *FreqEstimator) Observe(srcId string, ts time.Time) {
+	if ts.IsZero() {
+		return
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if srcId != e.srcId || ts.Before(e.last) {
+		e.srcId = srcId
+		e.last = ts
+		e.intervals = e.intervals[:0]
+		e.n = 0
+		return
+	}
+	if e.last.IsZero() {
+		e.last = ts
+		return
+	}
+	d := ts.Sub(e.last)
+	if d == 0 {
+		return // ts not changed: no new heartbeat
+	}
+	e.last = ts
+	if len(e.intervals) < FreqSamples {
+		e.intervals = append(e.intervals, d)
+	} else {
+		e.intervals[e.n] = d
+	}
+	e.n = (e.n + 1) % FreqSamples
+}
+
+// Freq returns the estimated heartbeat write frequency, or zero if fewer than
+// FreqMinSamples intervals have been observed.
+func (e *FreqEstimator) Freq() time.Duration {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if len(e.intervals) < FreqMinSamples {
+		return 0
+	}
+	min := e.intervals[0]
+	for _, d := range e.intervals[1:] {
+		if d < min {
+			min = d
+		}
+	}
+	return min
+}
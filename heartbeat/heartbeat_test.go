@@ -3,7 +3,12 @@
 package heartbeat_test
 
 import (
+	"context"
 	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
@@ -300,3 +305,870 @@ func TestReader(t *testing.T) {
 		t.Errorf("lag = %d ms, expected between 50 and 100 ms", lag2)
 	}
 }
+
+func TestReaderAlive(t *testing.T) {
+	// Reader isn't alive until started, and it's not alive after it crashes
+	m := mock.NewSQL(map[string]mock.SQLResult{
+		"heartbeat": {
+			Columns: []string{"NOW(3)", "ts", "freq", "src_id", "1"},
+			Rows:    [][]driver.Value{{time.Now(), time.Now(), int64(1000), "s1", int64(1)}},
+		},
+	})
+	hr := heartbeat.NewBlipReader(heartbeat.BlipReaderArgs{
+		MonitorId: "r1",
+		DB:        m.DB(),
+		Table:     blip_writer_table,
+		Waiter: mock.LagWaiter{
+			WaitFunc: func(now, then time.Time, f int, srcId string) (int64, time.Duration) {
+				panic("test panic")
+			},
+		},
+	})
+	if hr.Alive() {
+		t.Errorf("Alive=true before Start, expected false")
+	}
+	if err := hr.Start(); err != nil {
+		t.Fatal(err)
+	}
+	if err := hr.Start(); err == nil {
+		t.Errorf("no error on second Start, expected one")
+	}
+
+	timeout := time.After(2 * time.Second)
+	for hr.Alive() {
+		select {
+		case <-timeout:
+			t.Fatal("timeout waiting for reader to crash")
+		default:
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	if hr.Err() == nil {
+		t.Errorf("Err=nil after crash, expected error")
+	}
+	hr.Stop() // must not panic or block
+}
+
+func TestReaderStop(t *testing.T) {
+	// Stop waits for an in-flight read to complete, there are no reads after
+	// Stop returns, and Stop doesn't wait for the reader's sleep between reads
+	now := time.Now()
+	m := mock.NewSQL(map[string]mock.SQLResult{
+		"heartbeat": {
+			Columns: []string{"NOW(3)", "ts", "freq", "src_id", "1"},
+			Rows:    [][]driver.Value{{now, now.Add(-300 * time.Millisecond), int64(1000), "s1", int64(1)}},
+		},
+	})
+	var reading sync.WaitGroup
+	reading.Add(1)
+	var once sync.Once
+	m.QueryFunc = func(query string) (mock.SQLResult, bool) {
+		once.Do(func() {
+			reading.Done()
+			time.Sleep(200 * time.Millisecond) // slow first read
+		})
+		return mock.SQLResult{}, false
+	}
+	hr := heartbeat.NewBlipReader(heartbeat.BlipReaderArgs{
+		MonitorId: "r1",
+		DB:        m.DB(),
+		Table:     blip_writer_table,
+		Waiter: mock.LagWaiter{
+			WaitFunc: func(now, then time.Time, f int, srcId string) (int64, time.Duration) {
+				return 300, 10 * time.Second // long sleep between reads
+			},
+		},
+	})
+	if err := hr.Start(); err != nil {
+		t.Fatal(err)
+	}
+	reading.Wait() // first read in flight
+
+	t0 := time.Now()
+	hr.Stop()
+	d := time.Since(t0)
+	if d > heartbeat.StopTimeout {
+		t.Errorf("Stop took %s, expected less than StopTimeout %s", d, heartbeat.StopTimeout)
+	}
+	if hr.Alive() {
+		t.Errorf("Alive=true after Stop, expected false")
+	}
+
+	// The in-flight read completed before Stop returned
+	lag, err := hr.Lag(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lag.Milliseconds != 300 {
+		t.Errorf("got lag %d ms, expected 300 from the in-flight read", lag.Milliseconds)
+	}
+
+	n := m.Count("heartbeat")
+	time.Sleep(100 * time.Millisecond)
+	if m.Count("heartbeat") != n {
+		t.Errorf("got %d reads after Stop, expected 0", m.Count("heartbeat")-n)
+	}
+
+	hr.Stop() // second Stop must not block
+
+	// Stop before Start doesn't wait
+	hr = heartbeat.NewBlipReader(heartbeat.BlipReaderArgs{
+		MonitorId: "r2",
+		DB:        m.DB(),
+		Table:     blip_writer_table,
+		Waiter:    heartbeat.SlowFastWaiter{},
+	})
+	t0 = time.Now()
+	hr.Stop()
+	if d := time.Since(t0); d > 100*time.Millisecond {
+		t.Errorf("Stop before Start took %s, expected no wait", d)
+	}
+}
+
+func TestSlowFastWaiterSourceLatency(t *testing.T) {
+	// Two sources with different network latency, and an unknown source
+	// that uses the default NetworkLatency
+	w := heartbeat.SlowFastWaiter{
+		NetworkLatency: 50 * time.Millisecond,
+		SourceLatency: map[string]time.Duration{
+			"near": 10 * time.Millisecond,
+			"far":  200 * time.Millisecond,
+		},
+	}
+	last := time.Date(2024, 5, 28, 12, 0, 0, 0, time.UTC)
+	now := last.Add(500 * time.Millisecond) // next hb at +1s
+	tests := []struct {
+		srcId string
+		lag   int64
+		wait  time.Duration
+	}{
+		{"near", 490, 510 * time.Millisecond},
+		{"far", 300, 700 * time.Millisecond},
+		{"other", 450, 550 * time.Millisecond},
+	}
+	for _, tc := range tests {
+		lag, wait := w.Wait(now, last, 1000, tc.srcId)
+		if lag != tc.lag {
+			t.Errorf("%s: lag = %d, expected %d", tc.srcId, lag, tc.lag)
+		}
+		if wait != tc.wait {
+			t.Errorf("%s: wait = %s, expected %s", tc.srcId, wait, tc.wait)
+		}
+	}
+}
+
+func TestSlowFastWaiterHeartbeatFreq(t *testing.T) {
+	// Declared heartbeat freq subtracts up to that amount from on-time lag
+	// (sawtooth floor), never below zero, and doesn't change late lag
+	last := time.Date(2024, 5, 28, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		hbFreq time.Duration
+		now    time.Time
+		lag    int64
+	}{
+		{0, last.Add(500 * time.Millisecond), 500},                      // not set
+		{200 * time.Millisecond, last.Add(500 * time.Millisecond), 300}, // bounded by freq
+		{time.Second, last.Add(500 * time.Millisecond), 0},              // floor >= lag: zero
+		{5 * time.Second, last.Add(500 * time.Millisecond), 0},          // never negative
+		{time.Second, last.Add(-100 * time.Millisecond), 0},             // skew: clamped, not subtracted
+		{time.Second, last.Add(1300 * time.Millisecond), 300},           // late: not changed
+	}
+	for _, tc := range tests {
+		w := heartbeat.SlowFastWaiter{HeartbeatFreq: tc.hbFreq}
+		lag, _ := w.Wait(tc.now, last, 1000, "s1")
+		if lag != tc.lag {
+			t.Errorf("heartbeat freq %s, now %s: lag = %d, expected %d", tc.hbFreq, tc.now.Sub(last), lag, tc.lag)
+		}
+	}
+}
+
+func TestSlowFastWaiterMinInterval(t *testing.T) {
+	// MinInterval is a floor on the wait, whether the next heartbeat is due
+	// (on time) or late, and doesn't change lag
+	last := time.Date(2024, 5, 28, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		min  time.Duration
+		now  time.Time
+		lag  int64
+		wait time.Duration
+	}{
+		{0, last.Add(500 * time.Millisecond), 500, 500 * time.Millisecond},                      // not set
+		{2 * time.Second, last.Add(500 * time.Millisecond), 500, 2 * time.Second},               // on time
+		{100 * time.Millisecond, last.Add(500 * time.Millisecond), 500, 500 * time.Millisecond}, // wait > min
+		{2 * time.Second, last.Add(1100 * time.Millisecond), 100, 2 * time.Second},              // late
+	}
+	for _, tc := range tests {
+		w := heartbeat.SlowFastWaiter{MinInterval: tc.min}
+		lag, wait := w.Wait(tc.now, last, 1000, "s1")
+		if lag != tc.lag {
+			t.Errorf("min interval %s, now %s: lag = %d, expected %d", tc.min, tc.now.Sub(last), lag, tc.lag)
+		}
+		if wait != tc.wait {
+			t.Errorf("min interval %s, now %s: wait = %s, expected %s", tc.min, tc.now.Sub(last), wait, tc.wait)
+		}
+	}
+}
+
+func TestReaderMinInterval(t *testing.T) {
+	// Heartbeat is late, so the waiter would read again in 50ms, but
+	// MinInterval limits the reader to one read per 200ms
+	now := time.Now()
+	m := mock.NewSQL(map[string]mock.SQLResult{
+		"heartbeat": {
+			Columns: []string{"NOW(3)", "ts", "freq", "src_id", "1"},
+			Rows:    [][]driver.Value{{now, now.Add(-1100 * time.Millisecond), int64(1000), "s1", int64(1)}},
+		},
+	})
+	hr := heartbeat.NewBlipReader(heartbeat.BlipReaderArgs{
+		MonitorId: "r1",
+		DB:        m.DB(),
+		Table:     blip_writer_table,
+		Waiter:    heartbeat.SlowFastWaiter{MinInterval: 200 * time.Millisecond},
+	})
+	if err := hr.Start(); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(500 * time.Millisecond)
+	hr.Stop()
+
+	// Reads at 0, 200ms, 400ms; without MinInterval, about 10 reads
+	if n := m.Count("heartbeat"); n < 2 || n > 3 {
+		t.Errorf("got %d reads in 500ms, expected 2 or 3 (min interval 200ms)", n)
+	}
+
+	// Between reads, the reader returns the last lag
+	lag, err := hr.Lag(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lag.Milliseconds != 100 {
+		t.Errorf("got lag %d ms, expected 100", lag.Milliseconds)
+	}
+}
+
+func TestReaderReadOnce(t *testing.T) {
+	// ReadOnce reads the heartbeat without Start (no reader goroutine)
+	now := time.Now()
+	m := mock.NewSQL(map[string]mock.SQLResult{
+		"heartbeat": {
+			Columns: []string{"NOW(3)", "ts", "freq", "src_id", "1"},
+			Rows:    [][]driver.Value{{now, now.Add(-300 * time.Millisecond), int64(1000), "s1", int64(1)}},
+		},
+	})
+	hr := heartbeat.NewBlipReader(heartbeat.BlipReaderArgs{
+		MonitorId: "r1",
+		DB:        m.DB(),
+		Table:     blip_writer_table,
+		Waiter:    heartbeat.SlowFastWaiter{},
+	})
+	lag, err := hr.ReadOnce(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lag.Milliseconds != 300 || lag.SourceId != "s1" || !lag.Replica {
+		t.Errorf("got lag %+v, expected 300 ms from s1", lag)
+	}
+	if hr.Alive() {
+		t.Error("reader alive after ReadOnce, expected not started")
+	}
+
+	// Lag (from reader goroutine) not changed by ReadOnce
+	lag, _ = hr.Lag(context.Background())
+	if lag.Milliseconds != -1 {
+		t.Errorf("Lag = %d ms, expected -1 (not started)", lag.Milliseconds)
+	}
+}
+
+func TestReaderConsistentRead(t *testing.T) {
+	// consistent-read makes the heartbeat SELECT a locking read; default is
+	// a normal (snapshot) read
+	now := time.Now()
+	for _, consistent := range []bool{false, true} {
+		m := mock.NewSQL(map[string]mock.SQLResult{
+			"heartbeat": {
+				Columns: []string{"NOW(3)", "ts", "freq", "src_id", "1"},
+				Rows:    [][]driver.Value{{now, now.Add(-300 * time.Millisecond), int64(1000), "s1", int64(1)}},
+			},
+		})
+		hr := heartbeat.NewBlipReader(heartbeat.BlipReaderArgs{
+			MonitorId:      "r1",
+			DB:             m.DB(),
+			Table:          blip_writer_table,
+			Waiter:         heartbeat.SlowFastWaiter{},
+			ConsistentRead: consistent,
+		})
+		lag, err := hr.ReadOnce(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if lag.Milliseconds != 300 {
+			t.Errorf("got lag %+v, expected 300 ms", lag)
+		}
+		queries := m.Queries()
+		if len(queries) != 1 {
+			t.Fatalf("got %d queries, expected 1: %v", len(queries), queries)
+		}
+		if got := strings.HasSuffix(queries[0], " LOCK IN SHARE MODE"); got != consistent {
+			t.Errorf("consistent=%t: query %q", consistent, queries[0])
+		}
+	}
+}
+
+func TestReaderTag(t *testing.T) {
+	// Tag and source are query args, not SQL: a backslash (an escape in MySQL
+	// string literals) can't change the query
+	now := time.Now()
+	m := mock.NewSQL(map[string]mock.SQLResult{
+		"heartbeat": {
+			Columns: []string{"NOW(3)", "ts", "freq", "src_id", "1"},
+			Rows:    [][]driver.Value{{now, now.Add(-300 * time.Millisecond), int64(1000), "s1", int64(1)}},
+		},
+	})
+	tag := `etl\' OR 1=1 -- `
+	hr := heartbeat.NewBlipReader(heartbeat.BlipReaderArgs{
+		MonitorId: "r1",
+		DB:        m.DB(),
+		Table:     blip_writer_table,
+		SourceId:  "s1",
+		Tag:       tag,
+		Waiter:    heartbeat.SlowFastWaiter{},
+	})
+	if _, err := hr.ReadOnce(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	expect := "SELECT NOW(3), ts, freq, src_id, 1 FROM " + blip_writer_table + " WHERE src_id=? AND tag=?"
+	if q := m.Queries(); len(q) != 1 || q[0] != expect {
+		t.Errorf("got queries %v, expected [%s]", q, expect)
+	}
+	if a := m.Args(); len(a) != 1 || len(a[0]) != 2 || a[0][0] != "s1" || a[0][1] != tag {
+		t.Errorf("got query args %v, expected [[s1 %s]]", a, tag)
+	}
+}
+
+func TestReaderTsFormat(t *testing.T) {
+	// Same heartbeat (300 ms lag) stored in each ts format
+	now := time.Date(2024, 5, 28, 18, 50, 6, 500000000, time.UTC)
+	ts := now.Add(-300 * time.Millisecond)
+	tests := []struct {
+		format string
+		now    driver.Value
+		ts     driver.Value
+		nowCol string
+	}{
+		{"", now, ts, "NOW(3)"},
+		{heartbeat.TS_FORMAT_DATETIME, now, ts, "NOW(3)"},
+		{heartbeat.TS_FORMAT_EPOCH_MS, now.UnixMicro(), ts.UnixMilli(), "UNIX_TIMESTAMP(NOW(6))"},
+		{heartbeat.TS_FORMAT_EPOCH_US, now.UnixMicro(), ts.UnixMicro(), "UNIX_TIMESTAMP(NOW(6))"},
+	}
+	for _, tc := range tests {
+		m := mock.NewSQL(map[string]mock.SQLResult{
+			"heartbeat": {
+				Columns: []string{tc.nowCol, "ts", "freq", "src_id", "1"},
+				Rows:    [][]driver.Value{{tc.now, tc.ts, int64(1000), "s1", int64(1)}},
+			},
+		})
+		hr := heartbeat.NewBlipReader(heartbeat.BlipReaderArgs{
+			MonitorId: "r1",
+			DB:        m.DB(),
+			Table:     blip_writer_table,
+			Waiter:    heartbeat.SlowFastWaiter{},
+			TsFormat:  tc.format,
+		})
+		lag, err := hr.ReadOnce(context.Background())
+		if err != nil {
+			t.Fatalf("%s: %s", tc.format, err)
+		}
+		if lag.Milliseconds != 300 {
+			t.Errorf("%s: got lag %d ms, expected 300", tc.format, lag.Milliseconds)
+		}
+		if !lag.LastTs.Equal(ts) {
+			t.Errorf("%s: got LastTs %s, expected %s", tc.format, lag.LastTs, ts)
+		}
+		if m.Count(tc.nowCol) != 1 {
+			t.Errorf("%s: query does not select %s: %v", tc.format, tc.nowCol, m.Queries())
+		}
+	}
+}
+
+func TestReaderTsPrecision(t *testing.T) {
+	// NOW is read with the precision of column ts, so NOW(0) and DATETIME(0)
+	// are both whole seconds: 500ms after the heartbeat is 0 lag, not 500ms
+	// (NOW(3) minus truncated ts)
+	tests := []struct {
+		precision int32
+		nowCol    string
+		now       time.Time
+		ts        time.Time
+		lag       int64
+	}{
+		{0, "NOW(0)", time.Date(2024, 5, 28, 18, 50, 6, 0, time.UTC), time.Date(2024, 5, 28, 18, 50, 6, 0, time.UTC), 0},
+		{3, "NOW(3)", time.Date(2024, 5, 28, 18, 50, 6, 500000000, time.UTC), time.Date(2024, 5, 28, 18, 50, 6, 200000000, time.UTC), 300},
+		{6, "NOW(6)", time.Date(2024, 5, 28, 18, 50, 6, 500123000, time.UTC), time.Date(2024, 5, 28, 18, 50, 6, 200123000, time.UTC), 300},
+	}
+	for _, tc := range tests {
+		m := mock.NewSQL(map[string]mock.SQLResult{
+			"information_schema.COLUMNS": {
+				Columns: []string{"DATETIME_PRECISION"},
+				Rows:    [][]driver.Value{{int64(tc.precision)}},
+			},
+			"heartbeat": {
+				Columns: []string{tc.nowCol, "ts", "freq", "src_id", "1"},
+				Rows:    [][]driver.Value{{tc.now, tc.ts, int64(1000), "s1", int64(1)}},
+			},
+		})
+		precision, err := heartbeat.TsPrecision(context.Background(), m.DB(), "blip.heartbeat")
+		if err != nil {
+			t.Fatalf("DATETIME(%d): %s", tc.precision, err)
+		}
+		if !precision.Valid || precision.Int32 != tc.precision {
+			t.Errorf("DATETIME(%d): got precision %+v", tc.precision, precision)
+		}
+		hr := heartbeat.NewBlipReader(heartbeat.BlipReaderArgs{
+			MonitorId:   "r1",
+			DB:          m.DB(),
+			Table:       blip_writer_table,
+			Waiter:      heartbeat.SlowFastWaiter{},
+			TsPrecision: precision,
+		})
+		if !strings.HasPrefix(hr.Query(), "SELECT "+tc.nowCol+", ts") {
+			t.Errorf("DATETIME(%d): query does not select %s: %s", tc.precision, tc.nowCol, hr.Query())
+		}
+		lag, err := hr.ReadOnce(context.Background())
+		if err != nil {
+			t.Fatalf("DATETIME(%d): %s", tc.precision, err)
+		}
+		if lag.Milliseconds != tc.lag {
+			t.Errorf("DATETIME(%d): got lag %d ms, expected %d", tc.precision, lag.Milliseconds, tc.lag)
+		}
+		if lag.TsPrecision != precision {
+			t.Errorf("DATETIME(%d): got Lag.TsPrecision %+v", tc.precision, lag.TsPrecision)
+		}
+	}
+
+	// Not a temporal column (NULL) or no table: unknown, so NOW(3)
+	m := mock.NewSQL(map[string]mock.SQLResult{
+		"information_schema.COLUMNS": {Columns: []string{"DATETIME_PRECISION"}, Rows: [][]driver.Value{{nil}}},
+	})
+	precision, err := heartbeat.TsPrecision(context.Background(), m.DB(), "heartbeat")
+	if err != nil || precision.Valid {
+		t.Errorf("NULL: got precision %+v, error %v; expected not valid", precision, err)
+	}
+	m.Set("information_schema.COLUMNS", mock.SQLResult{Columns: []string{"DATETIME_PRECISION"}})
+	precision, err = heartbeat.TsPrecision(context.Background(), m.DB(), "heartbeat")
+	if err != nil || precision.Valid {
+		t.Errorf("no rows: got precision %+v, error %v; expected not valid", precision, err)
+	}
+	hr := heartbeat.NewBlipReader(heartbeat.BlipReaderArgs{MonitorId: "r1", DB: m.DB(), Table: blip_writer_table, TsPrecision: precision})
+	if !strings.HasPrefix(hr.Query(), "SELECT NOW(3), ts") {
+		t.Errorf("unknown precision: query %s", hr.Query())
+	}
+}
+
+func TestReaderRestart(t *testing.T) {
+	// After RestartAfterErrors consecutive read errors, the reader restarts
+	// (reconnects) and recovers when reads succeed again
+	heartbeat.ReadErrorWait = 10 * time.Millisecond
+	heartbeat.RestartAfterErrors = 3
+	heartbeat.RestartMaxWait = 20 * time.Millisecond
+	defer func() {
+		heartbeat.ReadErrorWait = 1 * time.Second
+		heartbeat.RestartAfterErrors = 5
+		heartbeat.RestartMaxWait = 30 * time.Second
+	}()
+
+	var mu sync.Mutex
+	fails := 7 // 2 restarts, then 1 more error before success
+	m := mock.NewSQL(nil)
+	m.QueryFunc = func(query string) (mock.SQLResult, bool) {
+		mu.Lock()
+		defer mu.Unlock()
+		if fails > 0 {
+			fails--
+			return mock.SQLResult{Err: fmt.Errorf("lost connection")}, true
+		}
+		now := time.Now()
+		return mock.SQLResult{
+			Columns: []string{"NOW(3)", "ts", "freq", "src_id", "1"},
+			Rows:    [][]driver.Value{{now, now.Add(-100 * time.Millisecond), int64(1000), "s1", int64(1)}},
+		}, true
+	}
+	hr := heartbeat.NewBlipReader(heartbeat.BlipReaderArgs{
+		MonitorId: "r1",
+		DB:        m.DB(),
+		Table:     blip_writer_table,
+		Waiter:    heartbeat.SlowFastWaiter{},
+	})
+	if err := hr.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer hr.Stop()
+
+	timeout := time.After(2 * time.Second)
+	for {
+		lag, _ := hr.Lag(context.Background())
+		if lag.Milliseconds >= 0 {
+			break
+		}
+		select {
+		case <-timeout:
+			t.Fatal("timeout waiting for reader to recover")
+		default:
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	if n := hr.Restarts(); n != 2 {
+		t.Errorf("Restarts = %d, expected 2", n)
+	}
+	if !hr.Alive() {
+		t.Errorf("reader not alive after restarts")
+	}
+}
+
+func TestReaderWriteLatency(t *testing.T) {
+	now := time.Now()
+	m := mock.NewSQL(map[string]mock.SQLResult{
+		"heartbeat": {
+			Columns: []string{"NOW(3)", "ts", "freq", "src_id", "1", "write_latency_ms"},
+			Rows:    [][]driver.Value{{now, now.Add(-300 * time.Millisecond), int64(1000), "s1", int64(1), 12.5}},
+		},
+	})
+	hr := heartbeat.NewBlipReader(heartbeat.BlipReaderArgs{
+		MonitorId:       "r1",
+		DB:              m.DB(),
+		Table:           blip_writer_table,
+		Waiter:          heartbeat.SlowFastWaiter{},
+		WriteLatencyCol: "`write_latency_ms`",
+	})
+	lag, err := hr.ReadOnce(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !lag.WriteLatency.Valid || lag.WriteLatency.Float64 != 12.5 {
+		t.Errorf("got write latency %+v, expected 12.5", lag.WriteLatency)
+	}
+	if m.Count("`write_latency_ms`") != 1 {
+		t.Errorf("query does not select write_latency_ms: %v", m.Queries())
+	}
+
+	// NULL: not valid
+	m.Set("heartbeat", mock.SQLResult{
+		Columns: []string{"NOW(3)", "ts", "freq", "src_id", "1", "write_latency_ms"},
+		Rows:    [][]driver.Value{{now, now.Add(-300 * time.Millisecond), int64(1000), "s1", int64(1), nil}},
+	})
+	lag, err = hr.ReadOnce(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lag.WriteLatency.Valid {
+		t.Errorf("got write latency %+v, expected not valid (NULL)", lag.WriteLatency)
+	}
+
+	// Without WriteLatencyCol (default): not selected
+	m = mock.NewSQL(map[string]mock.SQLResult{
+		"heartbeat": {
+			Columns: []string{"NOW(3)", "ts", "freq", "src_id", "1"},
+			Rows:    [][]driver.Value{{now, now.Add(-300 * time.Millisecond), int64(1000), "s1", int64(1)}},
+		},
+	})
+	hr = heartbeat.NewBlipReader(heartbeat.BlipReaderArgs{
+		MonitorId: "r1",
+		DB:        m.DB(),
+		Table:     blip_writer_table,
+		Waiter:    heartbeat.SlowFastWaiter{},
+	})
+	lag, err = hr.ReadOnce(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lag.WriteLatency.Valid {
+		t.Errorf("got write latency %+v, expected not valid (no column)", lag.WriteLatency)
+	}
+}
+func TestReaderAppliedTs(t *testing.T) {
+	// ts 1.5s ago, so the next heartbeat (1s freq) is 500ms late: lag from ts
+	// is 500ms. But the heartbeat was applied 300ms ago, so apply lag is 300ms.
+	now := time.Now()
+	m := mock.NewSQL(map[string]mock.SQLResult{
+		"heartbeat": {
+			Columns: []string{"NOW(3)", "ts", "freq", "src_id", "1", "applied_ts"},
+			Rows:    [][]driver.Value{{now, now.Add(-1500 * time.Millisecond), int64(1000), "s1", int64(1), now.Add(-300 * time.Millisecond)}},
+		},
+	})
+	hr := heartbeat.NewBlipReader(heartbeat.BlipReaderArgs{
+		MonitorId:    "r1",
+		DB:           m.DB(),
+		Table:        blip_writer_table,
+		Waiter:       heartbeat.SlowFastWaiter{},
+		AppliedTsCol: "`applied_ts`",
+	})
+	lag, err := hr.ReadOnce(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lag.Milliseconds != 300 {
+		t.Errorf("got lag %d ms from applied ts, expected 300", lag.Milliseconds)
+	}
+	if m.Count("`applied_ts`") != 1 {
+		t.Errorf("query does not select applied_ts: %v", m.Queries())
+	}
+
+	// NULL: lag from ts
+	m.Set("heartbeat", mock.SQLResult{
+		Columns: []string{"NOW(3)", "ts", "freq", "src_id", "1", "applied_ts"},
+		Rows:    [][]driver.Value{{now, now.Add(-1500 * time.Millisecond), int64(1000), "s1", int64(1), nil}},
+	})
+	lag, err = hr.ReadOnce(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lag.Milliseconds != 500 {
+		t.Errorf("got lag %d ms from ts, expected 500", lag.Milliseconds)
+	}
+
+	// Epoch ts format: applied ts in same format
+	nowUs := now.UnixMicro()
+	m = mock.NewSQL(map[string]mock.SQLResult{
+		"heartbeat": {
+			Columns: []string{"NOW", "ts", "freq", "src_id", "1", "applied_ts"},
+			Rows:    [][]driver.Value{{nowUs, (nowUs - 1500000) / 1000, int64(1000), "s1", int64(1), (nowUs - 300000) / 1000}},
+		},
+	})
+	hr = heartbeat.NewBlipReader(heartbeat.BlipReaderArgs{
+		MonitorId:    "r1",
+		DB:           m.DB(),
+		Table:        blip_writer_table,
+		Waiter:       heartbeat.SlowFastWaiter{},
+		TsFormat:     heartbeat.TS_FORMAT_EPOCH_MS,
+		AppliedTsCol: "`applied_ts`",
+	})
+	lag, err = hr.ReadOnce(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lag.Milliseconds < 299 || lag.Milliseconds > 300 { // ms truncation
+		t.Errorf("got lag %d ms from applied epoch ts, expected 300", lag.Milliseconds)
+	}
+}
+
+func TestSeqLag(t *testing.T) {
+	tests := []struct {
+		source, replica int64
+		freq            int
+		lag             int64
+	}{
+		{100, 100, 1000, 0}, // caught up
+		{105, 100, 1000, 5000},
+		{105, 100, 250, 1250},
+		{100, 105, 1000, 0}, // seq reset on source: never negative
+	}
+	for _, tc := range tests {
+		if lag := heartbeat.SeqLag(tc.source, tc.replica, tc.freq); lag != tc.lag {
+			t.Errorf("SeqLag(%d, %d, %d) = %d, expected %d", tc.source, tc.replica, tc.freq, lag, tc.lag)
+		}
+	}
+}
+
+func TestReaderSeq(t *testing.T) {
+	// Replica clock is 10s ahead, so ts lag (about 10s) is wrong. The replica
+	// applied seq 100 and the source wrote seq 103: 3 heartbeats (1s freq)
+	// behind, so lag is 3s.
+	now := time.Now()
+	replica := mock.NewSQL(map[string]mock.SQLResult{
+		"heartbeat": {
+			Columns: []string{"NOW(3)", "ts", "freq", "src_id", "1", "seq"},
+			Rows:    [][]driver.Value{{now.Add(10 * time.Second), now.Add(-300 * time.Millisecond), int64(1000), "s1", int64(1), int64(100)}},
+		},
+	})
+	source := mock.NewSQL(map[string]mock.SQLResult{
+		"src_id='s1'": {Columns: []string{"seq"}, Rows: [][]driver.Value{{int64(103)}}},
+	})
+	hr := heartbeat.NewBlipReader(heartbeat.BlipReaderArgs{
+		MonitorId: "r1",
+		DB:        replica.DB(),
+		Table:     blip_writer_table,
+		Tag:       "t1",
+		Waiter:    heartbeat.SlowFastWaiter{},
+		SeqCol:    "`seq`",
+		SeqDB:     source.DB(),
+	})
+	lag, err := hr.ReadOnce(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lag.Milliseconds != 3000 || !lag.Seq {
+		t.Errorf("got lag %d ms (seq %t), expected 3000 from seq", lag.Milliseconds, lag.Seq)
+	}
+	expect := "SELECT `seq` FROM " + blip_writer_table + " WHERE tag=? AND src_id=?"
+	if q := source.Queries(); len(q) != 1 || q[0] != expect {
+		t.Errorf("got source queries %v, expected [%s]", q, expect)
+	}
+	if a := source.Args(); len(a) != 1 || fmt.Sprint(a[0]) != "[t1 s1]" {
+		t.Errorf("got source query args %v, expected [[t1 s1]]", a)
+	}
+
+	// Source seq unavailable: lag from ts
+	source.Set("src_id='s1'", mock.SQLResult{Err: fmt.Errorf("connection refused")})
+	lag, err = hr.ReadOnce(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lag.Milliseconds != 9300 || lag.Seq {
+		t.Errorf("got lag %d ms (seq %t), expected 9300 from ts (late)", lag.Milliseconds, lag.Seq)
+	}
+
+	// Replica seq NULL: lag from ts, source not read
+	source.Set("src_id='s1'", mock.SQLResult{Columns: []string{"seq"}, Rows: [][]driver.Value{{int64(103)}}})
+	replica.Set("heartbeat", mock.SQLResult{
+		Columns: []string{"NOW(3)", "ts", "freq", "src_id", "1", "seq"},
+		Rows:    [][]driver.Value{{now.Add(10 * time.Second), now.Add(-300 * time.Millisecond), int64(1000), "s1", int64(1), nil}},
+	})
+	n := len(source.Queries())
+	lag, err = hr.ReadOnce(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lag.Milliseconds != 9300 || lag.Seq {
+		t.Errorf("got lag %d ms (seq %t), expected 9300 from ts (late)", lag.Milliseconds, lag.Seq)
+	}
+	if len(source.Queries()) != n {
+		t.Errorf("source read when replica seq is NULL")
+	}
+}
+
+func TestReaderKey(t *testing.T) {
+	// Composite primary key (src_id, shard): key selects the shard row
+	now := time.Now()
+	row := func(lag time.Duration) mock.SQLResult {
+		return mock.SQLResult{
+			Columns: []string{"NOW(3)", "ts", "freq", "src_id", "1"},
+			Rows:    [][]driver.Value{{now, now.Add(-lag), int64(1000), "s1", int64(1)}},
+		}
+	}
+	m := mock.NewSQL(map[string]mock.SQLResult{
+		"heartbeat":   row(100 * time.Millisecond),
+		"`shard`='3'": row(300 * time.Millisecond),
+		"`shard`='4'": row(400 * time.Millisecond),
+	})
+	for shard, expect := range map[string]int64{"3": 300, "4": 400} {
+		hr := heartbeat.NewBlipReader(heartbeat.BlipReaderArgs{
+			MonitorId: "r1",
+			DB:        m.DB(),
+			Table:     blip_writer_table,
+			SourceId:  "s1",
+			Waiter:    heartbeat.SlowFastWaiter{},
+			Key:       map[string]string{"shard": shard, "region": "us"},
+		})
+		lag, err := hr.ReadOnce(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if lag.Milliseconds != expect {
+			t.Errorf("shard %s: got lag %d ms, expected %d", shard, lag.Milliseconds, expect)
+		}
+	}
+
+	// Key predicates sorted by column, after src_id, and values are args
+	hr := heartbeat.NewBlipReader(heartbeat.BlipReaderArgs{
+		MonitorId: "r1",
+		DB:        m.DB(),
+		Table:     blip_writer_table,
+		SourceId:  "s1",
+		Waiter:    heartbeat.SlowFastWaiter{},
+		Key:       map[string]string{"shard": "3", "region": `o'us\`},
+	})
+	hr.ReadOnce(context.Background())
+	q := m.Queries()
+	expect := "WHERE src_id=? AND `region`=? AND `shard`=?"
+	if !strings.Contains(q[len(q)-1], expect) {
+		t.Errorf("query %q does not contain %q", q[len(q)-1], expect)
+	}
+	a := m.Args()
+	want := `["s1" "o'us\\" "3"]`
+	if args := fmt.Sprintf("%q", a[len(a)-1]); args != want {
+		t.Errorf("got query args %s, expected %s", args, want)
+	}
+}
+
+func TestFreqEstimator(t *testing.T) {
+	// Heartbeats written every 250ms, read more often than written (same ts
+	// read again), and one missed heartbeat (500ms interval)
+	start := time.Date(2024, 5, 28, 12, 0, 0, 0, time.UTC)
+	ts := func(ms int) time.Time { return start.Add(time.Duration(ms) * time.Millisecond) }
+	e := &heartbeat.FreqEstimator{}
+	if f := e.Freq(); f != 0 {
+		t.Errorf("Freq = %s before observations, expected 0", f)
+	}
+	for _, ms := range []int{0, 0, 250, 250, 500, 1000} {
+		e.Observe("s1", ts(ms))
+	}
+	if f := e.Freq(); f != 250*time.Millisecond {
+		t.Errorf("Freq = %s, expected 250ms", f)
+	}
+
+	// Not enough intervals yet
+	e = &heartbeat.FreqEstimator{}
+	for _, ms := range []int{0, 250, 500} {
+		e.Observe("s1", ts(ms))
+	}
+	if f := e.Freq(); f != 0 {
+		t.Errorf("Freq = %s after 2 intervals, expected 0", f)
+	}
+
+	// New source resets samples
+	e.Observe("s1", ts(750))
+	e.Observe("s2", ts(1000))
+	if f := e.Freq(); f != 0 {
+		t.Errorf("Freq = %s after source change, expected 0", f)
+	}
+	for _, ms := range []int{2000, 3000, 4000} {
+		e.Observe("s2", ts(ms))
+	}
+	if f := e.Freq(); f != time.Second {
+		t.Errorf("Freq = %s from new source, expected 1s", f)
+	}
+
+	// Only the last FreqSamples intervals count: write freq changed to 2s
+	ms := 4000
+	for i := 0; i < heartbeat.FreqSamples; i++ {
+		ms += 2000
+		e.Observe("s2", ts(ms))
+	}
+	if f := e.Freq(); f != 2*time.Second {
+		t.Errorf("Freq = %s after freq change, expected 2s", f)
+	}
+}
+
+func TestReaderEstimatedFreq(t *testing.T) {
+	// Heartbeats written every 250ms: once the reader has estimated the write
+	// frequency, AutoFreq subtracts it like a declared HeartbeatFreq
+	now := time.Now()
+	m := mock.NewSQL(nil)
+	hr := heartbeat.NewBlipReader(heartbeat.BlipReaderArgs{
+		MonitorId: "r1",
+		DB:        m.DB(),
+		Table:     blip_writer_table,
+		Waiter:    heartbeat.SlowFastWaiter{AutoFreq: true},
+	})
+	var lag heartbeat.Lag
+	for i := 0; i < 4; i++ {
+		ts := now.Add(time.Duration(i*250) * time.Millisecond)
+		m.Set("heartbeat", mock.SQLResult{
+			Columns: []string{"NOW(3)", "ts", "freq", "src_id", "1"},
+			Rows:    [][]driver.Value{{ts.Add(200 * time.Millisecond), ts, int64(250), "s1", int64(1)}},
+		})
+		var err error
+		lag, err = hr.ReadOnce(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if i < heartbeat.FreqMinSamples && lag.Milliseconds != 200 {
+			t.Errorf("read %d: lag %d ms, expected 200 (no estimate yet)", i, lag.Milliseconds)
+		}
+	}
+	if f := hr.EstimatedFreq(); f != 250*time.Millisecond {
+		t.Errorf("EstimatedFreq = %s, expected 250ms", f)
+	}
+	if lag.Milliseconds != 0 {
+		t.Errorf("lag %d ms, expected 0 (200 ms minus estimated freq 250ms)", lag.Milliseconds)
+	}
+}
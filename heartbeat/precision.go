@@ -0,0 +1,39 @@
+// Copyright 2024 Block, Inc.
+
+package heartbeat
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/cashapp/blip/sqlutil"
+)
+
+// tsPrecisionQuery returns the fractional-second precision of column ts, which
+// is NULL if the column is not a temporal type, like BIGINT for epoch formats.
+const tsPrecisionQuery = `SELECT DATETIME_PRECISION
+FROM information_schema.COLUMNS
+WHERE TABLE_SCHEMA = COALESCE(?, DATABASE()) AND TABLE_NAME = ? AND COLUMN_NAME = 'ts'`
+
+// TsPrecision returns the fractional-second precision (0-6) of column ts in
+// the heartbeat table, like 3 for DATETIME(3), for BlipReaderArgs.TsPrecision.
+// The table is not quoted, and it can be qualified, like "blip.heartbeat".
+// The precision is not valid if the column is not a DATETIME or TIMESTAMP, or
+// the table does not exist. Call it once when preparing the reader, not on
+// each read.
+func TsPrecision(ctx context.Context, db *sql.DB, table string) (sql.NullInt32, error) {
+	var schema sql.NullString
+	parts := sqlutil.SplitQualifiedName(table)
+	if len(parts) > 1 {
+		schema = sql.NullString{String: parts[0], Valid: true}
+	}
+	var p sql.NullInt32
+	err := db.QueryRowContext(ctx, tsPrecisionQuery, schema, parts[len(parts)-1]).Scan(&p)
+	if err == sql.ErrNoRows {
+		return sql.NullInt32{}, nil
+	}
+	if err != nil {
+		return sql.NullInt32{}, err
+	}
+	return p, nil
+}
@@ -5,13 +5,16 @@ package heartbeat
 import (
 	"context"
 	"database/sql"
+	"database/sql/driver"
 	"fmt"
+	"sort"
 	"strings"
 	"sync"
 	"time"
 
 	"github.com/cashapp/blip"
 	"github.com/cashapp/blip/event"
+	"github.com/cashapp/blip/sqlutil"
 	"github.com/cashapp/blip/status"
 )
 
@@ -21,8 +24,23 @@ import (
 // but an implementation for pt-table-heartbeat is an idea.
 type Reader interface {
 	Start() error
+
+	// Stop stops the reader goroutine and waits for it to exit, up to
+	// StopTimeout, so there are no more reads after Stop returns (unless
+	// it timed out).
 	Stop()
 	Lag(context.Context) (Lag, error)
+
+	// Alive returns true if the reader goroutine is running.
+	Alive() bool
+
+	// Err returns the reason the reader goroutine exited, like a panic, or nil
+	// if it's running or was stopped.
+	Err() error
+
+	// ReadOnce reads the heartbeat once and returns the lag. It does not require
+	// Start, and it does not change the lag returned by Lag.
+	ReadOnce(context.Context) (Lag, error)
 }
 
 type Lag struct {
@@ -31,6 +49,9 @@ type Lag struct {
 	SourceId     string
 	SourceRole   string
 	Replica      bool
+	WriteLatency sql.NullFloat64 // milliseconds, if BlipReaderArgs.WriteLatencyCol and not NULL
+	Seq          bool            // lag from sequence numbers (BlipReaderArgs.SeqCol), else from timestamps
+	TsPrecision  sql.NullInt32   // fractional-second precision of ts, if BlipReaderArgs.TsPrecision
 }
 
 var ReadTimeout = 2 * time.Second
@@ -38,6 +59,26 @@ var ReadErrorWait = 1 * time.Second
 var NoHeartbeatWait = 3 * time.Second
 var ReplCheckWait = 3 * time.Second
 
+// StopTimeout is how long Stop waits for the reader goroutine to exit. It's
+// longer than ReadTimeout so an in-flight read can complete.
+var StopTimeout = 3 * time.Second
+
+// RestartAfterErrors is the number of consecutive read errors after which
+// BlipReader restarts: it discards its connection and reconnects. Zero
+// disables restarts.
+var RestartAfterErrors = 5
+
+// RestartMaxWait caps the exponential backoff between restarts, which starts
+// at ReadErrorWait and doubles on each restart until a read succeeds.
+var RestartMaxWait = 30 * time.Second
+
+// Heartbeat ts column formats for BlipReaderArgs.TsFormat.
+const (
+	TS_FORMAT_DATETIME = "datetime" // DATETIME or TIMESTAMP (default)
+	TS_FORMAT_EPOCH_MS = "epoch-ms" // BIGINT Unix epoch milliseconds
+	TS_FORMAT_EPOCH_US = "epoch-us" // BIGINT Unix epoch microseconds
+)
+
 // BlipReader reads heartbeats from BlipWriter.
 type BlipReader struct {
 	monitorId string
@@ -46,16 +87,32 @@ type BlipReader struct {
 	srcId     string
 	srcRole   string
 	replCheck string
+	tag       string
+	tsFormat  string
+	writeLat  string // write latency column, else ""
+	appliedTs string // applied timestamp column, else ""
+	seqCol    string // sequence column, else ""
+	seqDB     *sql.DB
+	seqQuery  string        // source sequence query without src_id value
+	seqArgs   []interface{} // seqQuery args, src_id appended by seqLag
+	precision sql.NullInt32
 	// --
 	waiter LagWaiter
 	*sync.Mutex
 	lag      int64
 	last     time.Time
+	wlat     sql.NullFloat64
 	stopChan chan struct{}
 	doneChan chan struct{}
+	started  bool
+	err      error // why run exited, if not stopped
 	isRepl   bool
 	event    event.MonitorReceiver
 	query    string
+	args     []interface{} // query args
+	restarts uint
+	freqEst  FreqEstimator
+	seq      bool // last lag from sequence numbers
 }
 
 type BlipReaderArgs struct {
@@ -66,6 +123,55 @@ type BlipReaderArgs struct {
 	SourceRole string
 	ReplCheck  string
 	Waiter     LagWaiter
+
+	// Tag filters heartbeat rows on column tag, which lets multiple logical
+	// heartbeats (like different writer roles) share one table. Optional.
+	Tag string
+
+	// Key filters heartbeat rows on additional columns: column => value, for
+	// heartbeat tables with a composite primary key like (src_id, shard).
+	// Columns are quoted and values are query args. Optional.
+	Key map[string]string
+
+	// ConsistentRead makes the heartbeat read a locking read (LOCK IN SHARE MODE,
+	// which is FOR SHARE in MySQL 8.0 but also works in 5.7) that reads the latest
+	// committed row instead of an MVCC snapshot that might be stale. Optional.
+	ConsistentRead bool
+
+	// TsFormat is the format of column ts: a TS_FORMAT_ const. For epoch formats,
+	// NOW is also read as epoch microseconds, so lag does not depend on the time
+	// zone. Default (empty) is TS_FORMAT_DATETIME.
+	TsFormat string
+
+	// WriteLatencyCol is a heartbeat table column with the source write latency
+	// in milliseconds (like how long the heartbeat write took to flush), which
+	// is returned as Lag.WriteLatency. The column must exist. Optional.
+	WriteLatencyCol string
+
+	// AppliedTsCol is a heartbeat table column with the time the heartbeat row
+	// was applied on the replica, in the same format as column ts (TsFormat).
+	// If set and not NULL, lag is measured from the applied time instead of ts,
+	// which excludes source write and transport time. If NULL, lag is measured
+	// from ts. The column must exist. Optional.
+	AppliedTsCol string
+
+	// SeqCol is a heartbeat table column with a monotonic sequence number that
+	// the writer increments by 1 on each heartbeat write. If set with SeqDB,
+	// lag is (source seq - replica seq) * freq, which doesn't depend on clocks.
+	// If the column is NULL or reading the source fails, lag is measured from
+	// timestamps. The column must exist. Optional.
+	SeqCol string
+
+	// SeqDB is the source (the instance where heartbeats are written) from
+	// which to read the latest sequence number. Required with SeqCol.
+	SeqDB *sql.DB
+
+	// TsPrecision is the fractional-second precision (0-6) of column ts, like
+	// 6 for DATETIME(6), which is returned as Lag.TsPrecision. For the datetime
+	// format, NOW is read with the same precision, so lag is not biased by the
+	// difference: with DATETIME(0), NOW(3) is up to 1s ahead of the truncated
+	// ts. If not valid (unknown), NOW(3) is read. Optional. See TsPrecision.
+	TsPrecision sql.NullInt32
 }
 
 func NewBlipReader(args BlipReaderArgs) *BlipReader {
@@ -76,6 +182,13 @@ func NewBlipReader(args BlipReaderArgs) *BlipReader {
 		srcId:     args.SourceId,
 		srcRole:   args.SourceRole,
 		replCheck: args.ReplCheck,
+		tag:       args.Tag,
+		tsFormat:  args.TsFormat,
+		writeLat:  args.WriteLatencyCol,
+		appliedTs: args.AppliedTsCol,
+		seqCol:    args.SeqCol,
+		seqDB:     args.SeqDB,
+		precision: args.TsPrecision,
 		// --
 		waiter:   args.Waiter,
 		Mutex:    &sync.Mutex{},
@@ -89,31 +202,93 @@ func NewBlipReader(args BlipReaderArgs) *BlipReader {
 	// Create heartbeat read query
 	cols := []string{"NOW(3)", "ts", "freq", "src_id", "1"}
 	var where string
+	filter := ""                  // tag and key predicates
+	filterArgs := []interface{}{} // filter values
+	if r.tag != "" {
+		blip.Debug("%s: heartbeat tag %s", r.monitorId, r.tag)
+		filter = " AND tag=?"
+		filterArgs = append(filterArgs, r.tag)
+	}
+	if len(args.Key) > 0 {
+		blip.Debug("%s: heartbeat key %v", r.monitorId, args.Key)
+		keyCols := make([]string, 0, len(args.Key))
+		for col := range args.Key {
+			keyCols = append(keyCols, col)
+		}
+		sort.Strings(keyCols) // deterministic query
+		for _, col := range keyCols {
+			filter += " AND " + sqlutil.QuoteIdentifier(col) + "=?"
+			filterArgs = append(filterArgs, args.Key[col])
+		}
+	}
 	if r.srcId != "" {
 		blip.Debug("%s: heartbeat from source %s", r.monitorId, r.srcId)
-		where = "WHERE src_id='" + r.srcId + "'" // default
+		where = "WHERE src_id=?" + filter // default
+		r.args = append([]interface{}{r.srcId}, filterArgs...)
 	} else if r.srcRole != "" {
 		blip.Debug("%s: heartbeat from role %s", r.monitorId, r.srcRole)
-		where = "WHERE src_role='" + r.srcRole + "' ORDER BY ts DESC LIMIT 1"
+		where = "WHERE src_role=?" + filter + " ORDER BY ts DESC LIMIT 1"
+		r.args = append([]interface{}{r.srcRole}, filterArgs...)
 	} else {
 		blip.Debug("%s: heartbeat from latest (max ts)", r.monitorId)
-		where = "WHERE src_id != '" + args.MonitorId + "' ORDER BY ts DESC LIMIT 1"
+		where = "WHERE src_id != ?" + filter + " ORDER BY ts DESC LIMIT 1"
+		r.args = append([]interface{}{args.MonitorId}, filterArgs...)
 	}
 	if r.replCheck != "" {
-		cols[4] = "@@" + r.replCheck
+		cols[4] = sqlutil.AndVars(r.replCheck)
+	}
+	if r.epoch() {
+		cols[0] = "ROUND(UNIX_TIMESTAMP(NOW(6)) * 1000000)"
+	} else if r.precision.Valid && r.precision.Int32 >= 0 && r.precision.Int32 <= 6 {
+		cols[0] = fmt.Sprintf("NOW(%d)", r.precision.Int32)
+	}
+	if r.writeLat != "" {
+		cols = append(cols, r.writeLat)
+	}
+	if r.appliedTs != "" {
+		cols = append(cols, r.appliedTs)
+	}
+	if r.seqCol != "" && r.seqDB != nil {
+		cols = append(cols, r.seqCol)
+		// Source seq query: same tag and key, src_id arg appended by seqLag
+		where := "WHERE "
+		if filter != "" {
+			where += strings.TrimPrefix(filter, " AND ") + " AND "
+		}
+		r.seqQuery = fmt.Sprintf("SELECT %s FROM %s %ssrc_id=?", r.seqCol, r.table, where)
+		r.seqArgs = filterArgs
 	}
 	r.query = fmt.Sprintf("SELECT %s FROM %s %s", strings.Join(cols, ", "), r.table, where)
+	if args.ConsistentRead {
+		r.query += " LOCK IN SHARE MODE"
+	}
 
 	return r
 }
 
 func (r *BlipReader) Start() error {
+	r.Lock()
+	defer r.Unlock()
+	if r.started {
+		return fmt.Errorf("heartbeat reader already started")
+	}
+	r.started = true
 	go r.run()
 	return nil
 }
 
 func (r *BlipReader) run() {
-	defer close(r.doneChan)
+	defer func() {
+		if v := recover(); v != nil {
+			err := fmt.Errorf("heartbeat reader crashed: %v", v)
+			blip.Debug("%s: %s", r.monitorId, err)
+			status.Monitor(r.monitorId, "error:"+status.HEARTBEAT_READER, err.Error())
+			r.Lock()
+			r.err = err
+			r.Unlock()
+		}
+		close(r.doneChan)
+	}()
 	blip.Debug("%s: heartbeat reader: %s", r.monitorId, r.query)
 
 	var (
@@ -127,17 +302,51 @@ func (r *BlipReader) run() {
 		err    error
 		ctx    context.Context
 		cancel context.CancelFunc
+		conn   *sql.Conn // dedicated conn, discarded on restart
+		errs   int       // consecutive read errors
 	)
+	var wlat sql.NullFloat64 // write latency (WriteLatencyCol)
+	var seq sql.NullInt64    // sequence number (SeqCol)
+	var seqLag int64         // lag from sequence numbers, -1 if not
+	backoff := ReadErrorWait // between restarts
 	for {
 		select {
 		case <-r.stopChan:
+			if conn != nil {
+				conn.Close()
+			}
 			return
 		default:
 		}
 
 		ctx, cancel = context.WithTimeout(context.Background(), ReadTimeout)
-		err = r.db.QueryRowContext(ctx, r.query).Scan(&now, &last, &freq, &srcId, &isRepl)
+		if conn == nil {
+			conn, err = r.db.Conn(ctx)
+		}
+		if conn != nil {
+			now, last, freq, srcId, isRepl, wlat, seq, err = r.read(ctx, conn)
+		}
+		seqLag = -1
+		if err == nil && isRepl != 0 {
+			seqLag = r.seqLag(ctx, seq, freq, srcId)
+		}
 		cancel()
+		if err != nil && err != sql.ErrNoRows {
+			errs++
+			if RestartAfterErrors > 0 && errs >= RestartAfterErrors {
+				r.restart(conn, errs, err, backoff)
+				conn = nil
+				errs = 0
+				r.sleep(backoff)
+				if backoff *= 2; backoff > RestartMaxWait {
+					backoff = RestartMaxWait
+				}
+				continue
+			}
+		} else {
+			errs = 0
+			backoff = ReadErrorWait
+		}
 		if err != nil {
 			blip.Debug("%s: %v", r.monitorId, err)
 			switch {
@@ -146,10 +355,10 @@ func (r *BlipReader) run() {
 				r.lag = -1 // no heartbeat
 				r.Unlock()
 				status.Monitor(r.monitorId, "error:"+status.HEARTBEAT_READER, "no heartbeat for %s (retry in %s)", r.srcId, NoHeartbeatWait)
-				time.Sleep(NoHeartbeatWait)
+				r.sleep(NoHeartbeatWait)
 			default:
 				status.Monitor(r.monitorId, "error:"+status.HEARTBEAT_READER, "error: %s (retry in %s)", err.Error(), ReadErrorWait)
-				time.Sleep(ReadErrorWait)
+				r.sleep(ReadErrorWait)
 			}
 			continue
 		}
@@ -162,29 +371,156 @@ func (r *BlipReader) run() {
 			msg := fmt.Sprintf("not a replica: %s=%d (retry in %s)", r.replCheck, isRepl, ReplCheckWait)
 			blip.Debug("%s: %s", r.monitorId, msg)
 			status.Monitor(r.monitorId, status.HEARTBEAT_READER, msg)
-			time.Sleep(ReplCheckWait)
+			r.sleep(ReplCheckWait)
 			continue
 		}
 
-		// Repl source channge?
+		// Repl source channge? Only run writes srcId, so it reads it unlocked,
+		// but Lag reads it concurrently
 		if r.srcId != srcId {
 			r.event.Sendf(event.REPL_SOURCE_CHANGE, "%s to %s", r.srcId, srcId)
+			r.Lock()
 			r.srcId = srcId
+			r.Unlock()
 		}
 
-		lag, wait = r.waiter.Wait(now, last.Time, freq, srcId)
+		r.freqEst.Observe(srcId, last.Time)
+		lag, wait = r.lagWaiter().Wait(now, last.Time, freq, srcId)
+		if seqLag >= 0 {
+			lag = seqLag
+		}
 
 		r.Lock()
 		r.isRepl = true
+		r.seq = seqLag >= 0
 		r.lag = lag
 		r.last = last.Time
+		r.wlat = wlat
 		r.Unlock()
 
-		status.Monitor(r.monitorId, status.HEARTBEAT_READER, "%d ms lag from %s (%s), next in %s", lag, srcId, r.srcRole, wait)
-		time.Sleep(wait)
+		status.Monitor(r.monitorId, status.HEARTBEAT_READER, "%d ms lag from %s (%s), next in %s, est. freq %s", lag, srcId, r.srcRole, wait, r.freqEst.Freq())
+		r.sleep(wait)
 	}
 }
 
+// sleep sleeps for d or until Stop is called, whichever is first. The run loop
+// checks for stop before the next read.
+func (r *BlipReader) sleep(d time.Duration) {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+	case <-r.stopChan:
+	}
+}
+
+// restart discards the connection (if any) so the next read reconnects, which
+// also re-establishes any server-side state, like prepared statements.
+func (r *BlipReader) restart(conn *sql.Conn, errs int, err error, wait time.Duration) {
+	if conn != nil {
+		// Returning driver.ErrBadConn makes database/sql close the connection
+		// instead of returning it to the pool
+		conn.Raw(func(interface{}) error { return driver.ErrBadConn })
+		conn.Close()
+	}
+	r.Lock()
+	r.restarts++
+	n := r.restarts
+	r.Unlock()
+	msg := fmt.Sprintf("restart %d after %d consecutive read errors, last: %s (retry in %s)", n, errs, err, wait)
+	blip.Debug("%s: heartbeat reader %s", r.monitorId, msg)
+	status.Monitor(r.monitorId, "error:"+status.HEARTBEAT_READER, msg)
+}
+
+// queryRower is a *sql.DB or *sql.Conn.
+type queryRower interface {
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
+
+// read reads the heartbeat: the read path used by run and ReadOnce. If the
+// applied timestamp (AppliedTsCol) is not NULL, it's returned as last.
+func (r *BlipReader) read(ctx context.Context, q queryRower) (now time.Time, last sql.NullTime, freq int, srcId string, isRepl int, wlat sql.NullFloat64, seq sql.NullInt64, err error) {
+	if !r.epoch() {
+		var applied sql.NullTime
+		dest := []interface{}{&now, &last, &freq, &srcId, &isRepl}
+		if r.writeLat != "" {
+			dest = append(dest, &wlat)
+		}
+		if r.appliedTs != "" {
+			dest = append(dest, &applied)
+		}
+		if r.seqQuery != "" {
+			dest = append(dest, &seq)
+		}
+		if err = q.QueryRowContext(ctx, r.query, r.args...).Scan(dest...); err != nil {
+			return
+		}
+		if applied.Valid {
+			last = applied
+		}
+		return
+	}
+	var nowUs int64
+	var ts, applied sql.NullInt64
+	dest := []interface{}{&nowUs, &ts, &freq, &srcId, &isRepl}
+	if r.writeLat != "" {
+		dest = append(dest, &wlat)
+	}
+	if r.appliedTs != "" {
+		dest = append(dest, &applied)
+	}
+	if r.seqQuery != "" {
+		dest = append(dest, &seq)
+	}
+	if err = q.QueryRowContext(ctx, r.query, r.args...).Scan(dest...); err != nil {
+		return
+	}
+	now = time.UnixMicro(nowUs)
+	if applied.Valid {
+		ts = applied
+	}
+	if ts.Valid {
+		last.Valid = true
+		if r.tsFormat == TS_FORMAT_EPOCH_MS {
+			last.Time = time.UnixMilli(ts.Int64)
+		} else {
+			last.Time = time.UnixMicro(ts.Int64)
+		}
+	}
+	return
+}
+
+// epoch returns true if column ts is a Unix epoch (BIGINT), not a datetime.
+func (r *BlipReader) epoch() bool {
+	return r.tsFormat == TS_FORMAT_EPOCH_MS || r.tsFormat == TS_FORMAT_EPOCH_US
+}
+
+func (r *BlipReader) ReadOnce(ctx context.Context) (Lag, error) {
+	ctx, cancel := context.WithTimeout(ctx, ReadTimeout)
+	defer cancel()
+	now, last, freq, srcId, isRepl, wlat, seq, err := r.read(ctx, r.db)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return Lag{Milliseconds: -1, SourceRole: r.srcRole, Replica: true}, nil // no heartbeat
+		}
+		return Lag{}, err
+	}
+	if isRepl == 0 {
+		return Lag{Replica: false, Milliseconds: -1}, nil
+	}
+	r.freqEst.Observe(srcId, last.Time)
+	lag, _ := r.lagWaiter().Wait(now, last.Time, freq, srcId)
+	seqLag := r.seqLag(ctx, seq, freq, srcId)
+	if seqLag >= 0 {
+		lag = seqLag
+	}
+	return Lag{Milliseconds: lag, LastTs: last.Time, SourceId: srcId, SourceRole: r.srcRole, Replica: true, WriteLatency: wlat, Seq: seqLag >= 0, TsPrecision: r.precision}, nil
+}
+
+// Stop stops the reader goroutine and waits for it to exit, up to StopTimeout.
+// An in-flight read completes (or times out after ReadTimeout) before the
+// goroutine exits, and there are no more reads after that. It's safe to call
+// more than once, and it doesn't wait if the reader was not started.
 func (r *BlipReader) Stop() {
 	r.Lock()
 	select {
@@ -193,7 +529,77 @@ func (r *BlipReader) Stop() {
 	default:
 		close(r.stopChan)
 	}
+	started := r.started
 	r.Unlock()
+	if !started {
+		return
+	}
+	t := time.NewTimer(StopTimeout)
+	defer t.Stop()
+	select {
+	case <-r.doneChan:
+	case <-t.C:
+		blip.Debug("%s: heartbeat reader did not stop in %s", r.monitorId, StopTimeout)
+	}
+}
+
+func (r *BlipReader) Alive() bool {
+	r.Lock()
+	defer r.Unlock()
+	if !r.started {
+		return false
+	}
+	select {
+	case <-r.doneChan:
+		return false
+	default:
+		return true
+	}
+}
+
+func (r *BlipReader) Err() error {
+	r.Lock()
+	defer r.Unlock()
+	return r.err
+}
+
+// Restarts returns the number of times the reader restarted after
+// RestartAfterErrors consecutive read errors.
+func (r *BlipReader) Restarts() uint {
+	r.Lock()
+	defer r.Unlock()
+	return r.restarts
+}
+
+// Query returns the heartbeat query, which is final after NewBlipReader. Values
+// are ? placeholders: see Args.
+func (r *BlipReader) Query() string {
+	return r.query
+}
+
+// Args returns the heartbeat query args: the values of its ? placeholders.
+func (r *BlipReader) Args() []interface{} {
+	return r.args
+}
+
+// EstimatedFreq returns the heartbeat write frequency estimated from how often
+// the heartbeat timestamp changes, or zero if not enough heartbeats have been
+// read. See FreqEstimator.
+func (r *BlipReader) EstimatedFreq() time.Duration {
+	return r.freqEst.Freq()
+}
+
+// lagWaiter returns the waiter. If the waiter is a SlowFastWaiter with AutoFreq
+// and no HeartbeatFreq, it returns a copy with HeartbeatFreq set to the
+// estimated write frequency.
+func (r *BlipReader) lagWaiter() LagWaiter {
+	w, ok := r.waiter.(SlowFastWaiter)
+	if !ok || !w.AutoFreq || w.HeartbeatFreq > 0 {
+		return r.waiter
+	}
+	w.HeartbeatFreq = r.freqEst.Freq()
+	blip.Debug("%s: estimated heartbeat freq: %s", r.monitorId, w.HeartbeatFreq)
+	return w
 }
 
 func (r *BlipReader) Lag(_ context.Context) (Lag, error) {
@@ -202,7 +608,7 @@ func (r *BlipReader) Lag(_ context.Context) (Lag, error) {
 	if !r.isRepl {
 		return Lag{Replica: false, Milliseconds: -1}, nil
 	}
-	return Lag{Milliseconds: r.lag, LastTs: r.last, SourceId: r.srcId, SourceRole: r.srcRole, Replica: true}, nil
+	return Lag{Milliseconds: r.lag, LastTs: r.last, SourceId: r.srcId, SourceRole: r.srcRole, Replica: true, WriteLatency: r.wlat, Seq: r.seq, TsPrecision: r.precision}, nil
 }
 
 // --------------------------------------------------------------------------
@@ -214,6 +620,27 @@ type LagWaiter interface {
 type SlowFastWaiter struct {
 	MonitorId      string
 	NetworkLatency time.Duration
+
+	// SourceLatency is optional network latency per source ID. If the source
+	// ID is not set, NetworkLatency is used.
+	SourceLatency map[string]time.Duration
+
+	// HeartbeatFreq is the optional declared heartbeat write frequency. If set,
+	// up to this amount is subtracted from lag while the next heartbeat is not
+	// late, which removes the sawtooth floor (0 up to the write frequency) from
+	// lag. Lag is never less than zero.
+	HeartbeatFreq time.Duration
+
+	// AutoFreq uses the heartbeat write frequency estimated by the reader
+	// (BlipReader.EstimatedFreq) as HeartbeatFreq if HeartbeatFreq is not set.
+	// Until the reader has enough samples, nothing is subtracted.
+	AutoFreq bool
+
+	// MinInterval is the optional minimum wait between heartbeat reads. If set,
+	// the reader doesn't read the heartbeat table more often than this, even if
+	// the next heartbeat is due sooner or lagging. Between reads, the reader
+	// returns the last lag.
+	MinInterval time.Duration
 }
 
 var _ LagWaiter = SlowFastWaiter{}
@@ -222,16 +649,22 @@ func (w SlowFastWaiter) Wait(now, last time.Time, freq int, srcId string) (int64
 	next := last.Add(time.Duration(freq) * time.Millisecond)
 	blip.Debug("%s: last=%s  now=%s  next=%s  src=%s", w.MonitorId, last, now, next, srcId)
 
+	netLatency := w.NetworkLatency
+	if d, ok := w.SourceLatency[srcId]; ok {
+		netLatency = d
+	}
+
 	if now.Before(next) {
-		lag := now.Sub(last) - w.NetworkLatency
+		lag := now.Sub(last) - netLatency
 		if lag < 0 {
 			lag = 0
 		}
+		lag -= sawtoothFloor(lag, w.HeartbeatFreq)
 
 		// Wait until next hb
-		d := next.Sub(now) + w.NetworkLatency
+		d := next.Sub(now) + netLatency
 		blip.Debug("%s: lagged: %d ms; next hb in %d ms", w.MonitorId, lag.Milliseconds(), next.Sub(now).Milliseconds())
-		return lag.Milliseconds(), d
+		return lag.Milliseconds(), w.minWait(d)
 	}
 
 	// Next hb is late (lagging)
@@ -252,5 +685,25 @@ func (w SlowFastWaiter) Wait(now, last time.Time, freq int, srcId string) (int64
 	}
 
 	blip.Debug("%s: lagging: %s; wait %s", w.MonitorId, now.Sub(next), wait)
-	return lag, wait
+	return lag, w.minWait(wait)
+}
+
+// minWait returns the wait, or MinInterval if the wait is less.
+func (w SlowFastWaiter) minWait(wait time.Duration) time.Duration {
+	if wait < w.MinInterval {
+		return w.MinInterval
+	}
+	return wait
+}
+
+// sawtoothFloor returns how much to subtract from lag for the declared heartbeat
+// freq: lag up to freq, or zero if lag is negative (clock skew) or freq is not set.
+func sawtoothFloor(lag, freq time.Duration) time.Duration {
+	if lag <= 0 || freq <= 0 {
+		return 0
+	}
+	if lag < freq {
+		return lag
+	}
+	return freq
 }
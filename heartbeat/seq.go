@@ -0,0 +1,49 @@
+// Copyright 2024 Block, Inc.
+
+package heartbeat
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/cashapp/blip"
+)
+
+// This file handles lag from a heartbeat sequence column (BlipReaderArgs.SeqCol).
+// Timestamp lag (NOW - ts) is wrong if the source and replica clocks are skewed.
+// A sequence number that the writer increments on each heartbeat doesn't depend
+// on clocks: the difference between the latest seq on the source and the seq
+// applied on the replica is the number of heartbeats the replica is behind, and
+// at a known write rate (freq), that's lag: (source seq - replica seq) * freq.
+
+// SeqLag returns lag in milliseconds from sequence numbers: the number of
+// heartbeats the replica is behind the source times the write frequency freq
+// (milliseconds). It's never negative.
+func SeqLag(sourceSeq, replicaSeq int64, freq int) int64 {
+	d := sourceSeq - replicaSeq
+	if d < 0 {
+		return 0 // seq reset on source, or read from wrong source
+	}
+	return d * int64(freq)
+}
+
+// seqLag reads the latest seq for srcId on the source (SeqDB) and returns lag
+// from sequence numbers. It returns -1 if not enabled or the seq is unavailable:
+// replica seq is NULL, or reading the source fails or returns NULL, in which
+// case the caller uses timestamp lag.
+func (r *BlipReader) seqLag(ctx context.Context, replicaSeq sql.NullInt64, freq int, srcId string) int64 {
+	if r.seqQuery == "" {
+		return -1
+	}
+	if !replicaSeq.Valid {
+		blip.Debug("%s: heartbeat seq is NULL, lag from ts", r.monitorId)
+		return -1
+	}
+	var sourceSeq sql.NullInt64
+	args := append(append([]interface{}{}, r.seqArgs...), srcId)
+	if err := r.seqDB.QueryRowContext(ctx, r.seqQuery, args...).Scan(&sourceSeq); err != nil || !sourceSeq.Valid {
+		blip.Debug("%s: cannot read source heartbeat seq, lag from ts: %v", r.monitorId, err)
+		return -1
+	}
+	return SeqLag(sourceSeq.Int64, replicaSeq.Int64, freq)
+}
@@ -116,6 +116,9 @@ func PrintDomains() string {
 			for _, optName := range opts {
 				optHelp := help.Options[optName]
 				out += "\t\t" + optName + ": " + optHelp.Desc
+				if optHelp.Required {
+					out += " (required)"
+				}
 				if len(optHelp.Values) > 0 {
 					out += "\n"
 					valWidth := 0
@@ -189,6 +192,9 @@ func PrintDomains() string {
 				default:
 					out += " (unknown type)"
 				}
+				if m.Unit != "" {
+					out += " [" + m.Unit + "]"
+				}
 				out += ": " + m.Desc + "\n"
 			}
 			out += "\n"
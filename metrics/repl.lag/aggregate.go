@@ -0,0 +1,88 @@
+// Copyright 2024 Block, Inc.
+
+package repllag
+
+import (
+	"fmt"
+
+	"github.com/cashapp/blip"
+)
+
+// This file handles option report-aggregate: one repl.lag.current that rolls
+// up all current series (channels, sources, or backends), like max lag across
+// channels, for top-level alerting alongside per-channel dashboards. Max is the
+// worst series, which is usual for alerting. Min is the best series, which is
+// meaningful for fan-in when any fresh source is good enough.
+
+const (
+	AGGREGATE_MAX = "max"
+	AGGREGATE_MIN = "min"
+	AGGREGATE_SUM = "sum"
+	AGGREGATE_AVG = "avg"
+
+	// AGGREGATE_CHANNEL is the channel of the aggregate series: meta channel
+	// and, if the series are grouped by channel, group key channel.
+	AGGREGATE_CHANNEL = "_all_"
+)
+
+// parseAggregate returns the report-aggregate reducer, or an empty string if
+// disabled. Value yes is max.
+func parseAggregate(v string) (string, error) {
+	switch v {
+	case "", "no":
+		return "", nil
+	case "yes", AGGREGATE_MAX:
+		return AGGREGATE_MAX, nil
+	case AGGREGATE_MIN, AGGREGATE_SUM, AGGREGATE_AVG:
+		return v, nil
+	}
+	return "", fmt.Errorf("invalid %s: %q; valid values: no, max, min, sum, avg", OPT_REPORT_AGGREGATE, v)
+}
+
+// aggregate returns the aggregate repl.lag.current: the reducer over all current
+// series, ignoring absent values. It returns false if there are no current
+// values.
+func aggregate(metrics []blip.MetricValue, reducer string) (blip.MetricValue, bool) {
+	var agg float64
+	n := 0
+	grouped := false
+	for _, m := range metrics {
+		if m.Name != "current" || absent(m.Value) {
+			continue
+		}
+		if _, ok := m.Group["channel"]; ok {
+			grouped = true
+		}
+		switch {
+		case n == 0:
+			agg = m.Value
+		case reducer == AGGREGATE_MAX:
+			if m.Value > agg {
+				agg = m.Value
+			}
+		case reducer == AGGREGATE_MIN:
+			if m.Value < agg {
+				agg = m.Value
+			}
+		default: // sum and avg
+			agg += m.Value
+		}
+		n++
+	}
+	if n == 0 {
+		return blip.MetricValue{}, false
+	}
+	if reducer == AGGREGATE_AVG {
+		agg /= float64(n)
+	}
+	m := blip.MetricValue{
+		Name:  "current",
+		Type:  blip.GAUGE,
+		Value: agg,
+		Meta:  map[string]string{"channel": AGGREGATE_CHANNEL, "aggregate": reducer},
+	}
+	if grouped {
+		m.Group = map[string]string{"channel": AGGREGATE_CHANNEL}
+	}
+	return m, true
+}
@@ -0,0 +1,38 @@
+// Copyright 2024 Block, Inc.
+
+package repllag
+
+import (
+	"github.com/cashapp/blip"
+	"github.com/cashapp/blip/heartbeat"
+)
+
+// This file reports repl.lag.writer_alive for option report-writer-alive.
+// When lag is zero, it can be because the replica is caught up or because the
+// source heartbeat writer stopped and the replica applied its last heartbeat.
+// The heartbeat timestamp tells the difference: if the writer is alive, the
+// timestamp changes between collections. It's the same comparison as
+// stale-behavior (staleLag), so it uses the same last fresh heartbeat.
+
+// writerAliveMetric returns repl.lag.writer_alive for the heartbeat: 1 if the
+// heartbeat is not stale (timestamp changed since the last collection), else 0.
+// It returns false if there's no heartbeat (LastTs is zero) or not a replica.
+// The caller must not call it on the first collection from the source, when
+// there's no previous timestamp to compare.
+func writerAliveMetric(lag heartbeat.Lag, stale bool) (blip.MetricValue, bool) {
+	if !lag.Replica || lag.LastTs.IsZero() {
+		return blip.MetricValue{}, false
+	}
+	m := blip.MetricValue{
+		Name:  "writer_alive",
+		Type:  blip.GAUGE,
+		Value: 1,
+	}
+	if stale {
+		m.Value = 0
+	}
+	if lag.SourceId != "" {
+		m.Meta = map[string]string{"source": lag.SourceId}
+	}
+	return m, true
+}
@@ -0,0 +1,28 @@
+// Copyright 2024 Block, Inc.
+
+package repllag
+
+import (
+	"context"
+	"database/sql"
+)
+
+// This file handles option heartbeat-applied-ts-col: a heartbeat table column
+// with the time the heartbeat row was applied on the replica. Lag measured from
+// the applied time (NOW() - applied_ts) is apply lag: it excludes the time the
+// heartbeat spent being written on the source and in transit to the replica.
+
+// appliedTsCol returns the quoted column for BlipReaderArgs.AppliedTsCol if it
+// exists in the heartbeat table, else "". If the column does not exist, lag is
+// measured from column ts (with a warning), same as when the column is NULL.
+func appliedTsCol(ctx context.Context, db *sql.DB, table, col string) string {
+	if col == "" {
+		return ""
+	}
+	quoted, ok := heartbeatCol(ctx, db, table, col)
+	if !ok {
+		Log.Warn("repl.lag: %s: column %s not in %s, measuring lag from ts", OPT_HEARTBEAT_APPLIED_TS, col, table)
+		return ""
+	}
+	return quoted
+}
@@ -0,0 +1,84 @@
+// Copyright 2024 Block, Inc.
+
+package repllag
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/cashapp/blip"
+)
+
+// collectCached returns the metrics from the writer at most once per refresh
+// interval (option refresh-interval). Between refreshes, it returns a copy of
+// the last metrics with Meta stale_ms on repl.lag.current: how long ago (in
+// milliseconds) the metrics were collected from the writer. This makes
+// sub-second level frequencies feasible with heavy writer queries, like pfs.
+// Errors are not cached: the next collection refreshes.
+func (c *Lag) collectCached(ctx context.Context, levelName string, now time.Time) ([]blip.MetricValue, error) {
+	l := c.atLevel[levelName]
+	if l.refresh == 0 {
+		return c.collectChain(ctx, levelName)
+	}
+	if l.cache != nil && now.Sub(l.cacheTime) < l.refresh {
+		l.notReplica = l.cacheNotRep
+		stale := strconv.FormatInt(now.Sub(l.cacheTime).Milliseconds(), 10)
+		metrics := copyMetrics(l.cache)
+		for i := range metrics {
+			if metrics[i].Name != "current" {
+				continue
+			}
+			if metrics[i].Meta == nil {
+				metrics[i].Meta = map[string]string{}
+			}
+			metrics[i].Meta["stale_ms"] = stale
+		}
+		return metrics, nil
+	}
+	metrics, err := c.collectChain(ctx, levelName)
+	if err != nil {
+		l.cache = nil
+		return nil, err
+	}
+	l.cache = copyMetrics(metrics)
+	l.cacheTime = now
+	l.cacheNotRep = l.notReplica
+	return metrics, nil
+}
+
+// copyMetrics returns a deep copy of the metrics because later stages in
+// collect modify Meta and values in place.
+func copyMetrics(metrics []blip.MetricValue) []blip.MetricValue {
+	cp := make([]blip.MetricValue, len(metrics))
+	for i, m := range metrics {
+		cp[i] = m
+		if m.Group != nil {
+			cp[i].Group = make(map[string]string, len(m.Group))
+			for k, v := range m.Group {
+				cp[i].Group[k] = v
+			}
+		}
+		if m.Meta != nil {
+			cp[i].Meta = make(map[string]string, len(m.Meta))
+			for k, v := range m.Meta {
+				cp[i].Meta[k] = v
+			}
+		}
+	}
+	return cp
+}
+
+// parseRefresh returns the refresh-interval option value, or 0 if not set.
+func parseRefresh(opts map[string]string) (time.Duration, error) {
+	refresh := opts[OPT_REFRESH_INTERVAL]
+	if refresh == "" {
+		return 0, nil
+	}
+	d, err := time.ParseDuration(refresh)
+	if err != nil || d <= 0 {
+		return 0, fmt.Errorf("invalid %s: %q: must be a positive Go duration like 1s", OPT_REFRESH_INTERVAL, refresh)
+	}
+	return d, nil
+}
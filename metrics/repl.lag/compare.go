@@ -0,0 +1,93 @@
+// Copyright 2024 Block, Inc.
+
+package repllag
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/cashapp/blip"
+)
+
+// prepareCompare prepares the secondary writer for option compare-writers.
+// It returns an error if the secondary writer is invalid or the same as the
+// primary writer. If the secondary writer is not available, compare-writers is
+// disabled with a warning (like cross-check). The returned cleanup func chains
+// the given cleanup func with the secondary Blip heartbeat readers, if any.
+func (c *Lag) prepareCompare(ctx context.Context, levelName, writer string, plan blip.Plan, opts map[string]string, cleanup func()) (func(), error) {
+	l := c.atLevel[levelName]
+	if writer == LAG_WRITER_NONE {
+		Log.Warn("repl.lag: %s: %s ignored: writer is none", levelName, OPT_COMPARE_WRITERS)
+		l.compare = ""
+		return cleanup, nil
+	}
+	if l.compare == writer {
+		return nil, fmt.Errorf("invalid %s: %s: same as writer", OPT_COMPARE_WRITERS, l.compare)
+	}
+	var err error
+	if cleanup, err = c.prepareSecondary(ctx, levelName, l.compare, plan, opts, cleanup); err != nil {
+		Log.Warn("repl.lag: %s: %s disabled: %s", levelName, OPT_COMPARE_WRITERS, err)
+		l.compare = ""
+	}
+	return cleanup, nil
+}
+
+// compareWriters collects lag from the secondary writer (option compare-writers)
+// and returns the primary metrics with repl.lag.secondary: the repl.lag.current
+// metrics from the secondary writer. Meta writer is set on current and secondary
+// metrics. Other secondary writer metrics (like backlog) are not reported. If
+// collecting from the secondary writer fails, only the primary metrics are
+// returned because the secondary writer is only for comparison.
+func (c *Lag) compareWriters(ctx context.Context, levelName string, metrics []blip.MetricValue) []blip.MetricValue {
+	l := c.atLevel[levelName]
+	var secondary []blip.MetricValue
+	var err error
+	notReplica := l.notReplica
+	switch l.compare {
+	case LAG_WRITER_PFS:
+		secondary, err = c.collectPFS(ctx, levelName)
+	case LAG_WRITER_PT:
+		secondary, err = c.collectPtHeartbeat(ctx, levelName)
+	case LAG_WRITER_BLIP:
+		secondary, err = c.collectBlip(ctx, levelName)
+	}
+	l.notReplica = notReplica // only the primary writer sets replica state
+	for i := range metrics {
+		if metrics[i].Name == "current" {
+			metrics[i].Meta = withWriter(metrics[i].Meta, l.used)
+		}
+	}
+	if err != nil {
+		Log.Debug("repl.lag: %s: %s: %s: %s", levelName, OPT_COMPARE_WRITERS, l.compare, err)
+		return metrics
+	}
+	for _, m := range secondary {
+		if m.Name != "current" {
+			continue
+		}
+		m.Name = "secondary"
+		m.Meta = withWriter(m.Meta, l.compare)
+		metrics = append(metrics, m)
+	}
+	return metrics
+}
+
+// withWriter returns meta with key writer set, allocating meta if nil.
+func withWriter(meta map[string]string, writer string) map[string]string {
+	if meta == nil {
+		meta = map[string]string{}
+	}
+	meta["writer"] = writer
+	return meta
+}
+
+// parseCompare returns the compare-writers option value: the secondary writer,
+// or an empty string if not set.
+func parseCompare(opts map[string]string) (string, error) {
+	switch w := opts[OPT_COMPARE_WRITERS]; w {
+	case "", LAG_WRITER_PFS, LAG_WRITER_BLIP, LAG_WRITER_PT:
+		return w, nil
+	default:
+		return "", fmt.Errorf("invalid %s: %q: valid values: pfs, blip, pt-heartbeat", OPT_COMPARE_WRITERS, w)
+	}
+}
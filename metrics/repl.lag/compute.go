@@ -0,0 +1,118 @@
+// Copyright 2024 Block, Inc.
+
+package repllag
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+)
+
+// rawLagInputs is the lag for one series (channel, source, or backend) as read
+// by a writer, before it's reported as repl.lag.current. Writers scan and
+// compute their own lag (for example, lagFor for PFS), then computeLag makes
+// the final value and meta the same way for all writers.
+type rawLagInputs struct {
+	ms         float64 // lag in milliseconds; ignored if !ok or !replica
+	ok         bool    // false if there's no lag value: no heartbeat, NULL, and so on
+	replica    bool    // false if not a replica
+	sourceHost string  // meta "source" (preferred)
+	sourceUuid string  // meta "source" if sourceHost is empty
+	backend    string  // meta "backend" (proxysql)
+}
+
+// lagOptions are the level options that computeLag applies.
+type lagOptions struct {
+	absentValue float64  // -1 or NaN, for no lag value or not a replica
+	clockOffset float64  // clock-offset-ms: subtracted from lag, recorded in meta
+	sourceValue *float64 // source-value: value if not a replica (meta role=source), else nil
+	clampNeg    bool     // clamp-negative: report negative lag as 0, raw lag in meta
+}
+
+// computeLag returns the repl.lag.current value and meta for the raw lag.
+// It's a pure function: no DB access and no collector state. Callers decide
+// whether to drop absent values (report-no-heartbeat, report-not-a-replica).
+func computeLag(raw rawLagInputs, opts lagOptions) (float64, map[string]string) {
+	meta := sourceMeta(raw.sourceHost, raw.sourceUuid)
+	if raw.backend != "" {
+		if meta == nil {
+			meta = map[string]string{}
+		}
+		meta["backend"] = raw.backend
+	}
+	if !raw.replica && opts.sourceValue != nil {
+		if meta == nil {
+			meta = map[string]string{}
+		}
+		meta["role"] = ROLE_SOURCE
+		return *opts.sourceValue, meta
+	}
+	if !raw.replica || !raw.ok {
+		return opts.absentValue, meta
+	}
+	lag := raw.ms
+	if opts.clockOffset != 0 {
+		if meta == nil {
+			meta = map[string]string{}
+		}
+		meta["clock_offset"] = strconv.FormatFloat(opts.clockOffset, 'f', -1, 64)
+		lag -= opts.clockOffset
+	}
+	if opts.clampNeg && lag < 0 { // clock skew
+		if meta == nil {
+			meta = map[string]string{}
+		}
+		meta["raw_lag_ms"] = strconv.FormatFloat(lag, 'f', -1, 64)
+		lag = 0
+	}
+	return lag, meta
+}
+
+// lagOptions returns the computeLag options for the level.
+func (c *Lag) lagOptions(levelName string) lagOptions {
+	return lagOptions{
+		absentValue: math.NaN(), // absent while collecting: see reportAbsent
+		clockOffset: c.atLevel[levelName].clockOffset,
+		sourceValue: c.atLevel[levelName].sourceValue,
+		clampNeg:    c.atLevel[levelName].clampNeg,
+	}
+}
+
+// parseAbsentValue returns the absent-value option value and the reported
+// absent value: NaN for absent-value=nan, else -1 (drop is handled by prepare).
+func parseAbsentValue(opts map[string]string) (string, float64, error) {
+	switch v := opts[OPT_ABSENT_VALUE]; v {
+	case "", ABSENT_VALUE_NEG_1, ABSENT_VALUE_DROP:
+		return v, -1, nil
+	case ABSENT_VALUE_NAN:
+		return v, math.NaN(), nil
+	default:
+		return "", 0, fmt.Errorf("invalid %s: %q; valid values: -1, nan, drop", OPT_ABSENT_VALUE, v)
+	}
+}
+
+// parseClockOffset returns the clock-offset-ms option value, or 0 if not set.
+func parseClockOffset(opts map[string]string) (float64, error) {
+	offset := opts[OPT_CLOCK_OFFSET]
+	if offset == "" {
+		return 0, nil
+	}
+	f, err := strconv.ParseFloat(offset, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s: %q: %s", OPT_CLOCK_OFFSET, offset, err)
+	}
+	return f, nil
+}
+
+// parseSourceValue returns the source-value option value, or nil if not set.
+func parseSourceValue(opts map[string]string) (*float64, error) {
+	v := opts[OPT_SOURCE_VALUE]
+	if v == "" {
+		return nil, nil
+	}
+	f, err := strconv.ParseFloat(v, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s: %q: %s", OPT_SOURCE_VALUE, v, err)
+	}
+	return &f, nil
+}
@@ -0,0 +1,143 @@
+// Copyright 2024 Block, Inc.
+
+package repllag
+
+import (
+	"math"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestComputeLag(t *testing.T) {
+	neg1 := lagOptions{absentValue: -1}
+	nan := lagOptions{absentValue: math.NaN()}
+	zero := 0.0
+	tests := []struct {
+		name   string
+		raw    rawLagInputs
+		opts   lagOptions
+		value  float64
+		meta   map[string]string
+		absent bool // expect NaN
+	}{
+		{"lag", rawLagInputs{ms: 1500, ok: true, replica: true}, neg1, 1500, nil, false},
+		{"zero lag", rawLagInputs{ms: 0, ok: true, replica: true}, neg1, 0, nil, false},
+		{"no heartbeat", rawLagInputs{ms: 1500, ok: false, replica: true}, neg1, -1, nil, false},
+		{"not a replica", rawLagInputs{ms: 1500, ok: true, replica: false}, neg1, -1, nil, false},
+		{"not a replica nan", rawLagInputs{replica: false}, nan, 0, nil, true},
+		{"source host", rawLagInputs{ms: 1, ok: true, replica: true, sourceHost: "db1", sourceUuid: "uuid"}, neg1, 1, map[string]string{"source": "db1"}, false},
+		{"source uuid", rawLagInputs{ms: 1, ok: true, replica: true, sourceUuid: "uuid"}, neg1, 1, map[string]string{"source": "uuid"}, false},
+		{"backend", rawLagInputs{ms: 2000, ok: true, replica: true, backend: "db1:3306"}, neg1, 2000, map[string]string{"backend": "db1:3306"}, false},
+		{"backend no lag", rawLagInputs{ok: false, replica: true, backend: "db1:3306"}, neg1, -1, map[string]string{"backend": "db1:3306"}, false},
+		{"clock offset", rawLagInputs{ms: 1500, ok: true, replica: true, sourceHost: "db1"}, lagOptions{absentValue: -1, clockOffset: 200}, 1300, map[string]string{"source": "db1", "clock_offset": "200"}, false},
+		{"clock offset negative", rawLagInputs{ms: 1500, ok: true, replica: true}, lagOptions{absentValue: -1, clockOffset: -2.5}, 1502.5, map[string]string{"clock_offset": "-2.5"}, false},
+		{"negative", rawLagInputs{ms: -20, ok: true, replica: true}, neg1, -20, nil, false},
+		{"clamp negative", rawLagInputs{ms: -20, ok: true, replica: true}, lagOptions{absentValue: -1, clampNeg: true}, 0, map[string]string{"raw_lag_ms": "-20"}, false},
+		{"clamp negative clock offset", rawLagInputs{ms: 100, ok: true, replica: true}, lagOptions{absentValue: -1, clockOffset: 150.5, clampNeg: true}, 0, map[string]string{"clock_offset": "150.5", "raw_lag_ms": "-50.5"}, false},
+		{"clamp positive", rawLagInputs{ms: 20, ok: true, replica: true}, lagOptions{absentValue: -1, clampNeg: true}, 20, nil, false},
+		{"clamp no heartbeat", rawLagInputs{ok: false, replica: true}, lagOptions{absentValue: -1, clampNeg: true}, -1, nil, false},
+		{"clock offset no heartbeat", rawLagInputs{ok: false, replica: true}, lagOptions{absentValue: -1, clockOffset: 200}, -1, nil, false},
+		{"source value", rawLagInputs{replica: false}, lagOptions{absentValue: -1, sourceValue: &zero}, 0, map[string]string{"role": "source"}, false},
+		{"source value nan", rawLagInputs{replica: false}, lagOptions{absentValue: math.NaN(), sourceValue: &zero}, 0, map[string]string{"role": "source"}, false},
+		{"source value replica", rawLagInputs{ms: 5, ok: true, replica: true}, lagOptions{absentValue: -1, sourceValue: &zero}, 5, nil, false},
+		{"source value no heartbeat", rawLagInputs{ok: false, replica: true}, lagOptions{absentValue: -1, sourceValue: &zero}, -1, nil, false},
+		{"source and backend", rawLagInputs{ms: 3, ok: true, replica: true, sourceHost: "db1", backend: "db2:3306"}, neg1, 3, map[string]string{"source": "db1", "backend": "db2:3306"}, false},
+	}
+	for _, tc := range tests {
+		value, meta := computeLag(tc.raw, tc.opts)
+		if tc.absent {
+			assert.True(t, math.IsNaN(value), "%s: got %f, expected NaN", tc.name, value)
+		} else {
+			assert.Equal(t, tc.value, value, tc.name)
+		}
+		assert.Equal(t, tc.meta, meta, tc.name)
+	}
+}
+
+func TestLagFor(t *testing.T) {
+	uuid := "3e11fa47-71ca-11e1-9e33-c80aa9429562"
+	w := func(id int, applied string, applyingTs float64) worker {
+		return worker{
+			channel:        "",
+			lastQueuedTrx:  uuid + ":10",
+			ioThd:          "ON",
+			sqlThd:         "ON",
+			id:             id,
+			lastAppliedTrx: applied,
+			now:            1716922210.0,
+			lastAppliedTs:  1716922205.0,
+			lastAppliedLag: 250000, // microseconds
+			applyingTs:     applyingTs,
+		}
+	}
+	tests := []struct {
+		name       string
+		workers    []worker
+		lastQueued string // from previous collection
+		current    float64
+		observed   string
+		backlog    int
+		usage      float64
+	}{
+		{"applying", []worker{w(1, uuid+":5", 1716922208.0), w(2, uuid+":6", 1716922209.0)}, uuid + ":10", 2000, O_APPLYING, 4, 100},
+		{"received", []worker{w(1, uuid+":10", 0)}, uuid + ":9", 250, O_RECEIVED, 0, 0},
+		{"idle", []worker{w(1, uuid+":10", 0)}, uuid + ":10", 0, O_IDLE, 0, 0},
+	}
+	for _, tc := range tests {
+		lastQueued := map[string]string{"": tc.lastQueued}
+		lag := lagFor(tc.workers, lastQueued, map[string]string{})
+		assert.Equal(t, tc.current, lag.current, tc.name)
+		assert.Equal(t, tc.observed, lag.observed, tc.name)
+		assert.Equal(t, tc.backlog, lag.backlog, tc.name)
+		assert.Equal(t, tc.usage, lag.workerUsage, tc.name)
+	}
+
+	// Stopped: no workers applying, nothing received, SQL thread not ON
+	stopped := w(1, uuid+":10", 0)
+	stopped.sqlThd = "OFF"
+	lag := lagFor([]worker{stopped}, map[string]string{"": uuid + ":10"}, map[string]string{})
+	assert.Equal(t, float64(5000), lag.current) // now - last applied ts
+	assert.Equal(t, O_STOPPED, lag.observed)
+}
+
+func TestFallbackLagFor(t *testing.T) {
+	tests := []struct {
+		name     string
+		ch       channelStatus
+		current  float64
+		observed string
+	}{
+		{"stopped", channelStatus{ioThd: "OFF", sqlThd: "ON", now: 10.5, lastQueuedTs: 8.5}, 2000, O_STOPPED},
+		{"stopped never queued", channelStatus{ioThd: "ON", sqlThd: "OFF", now: 10.5}, 0, O_STOPPED},
+		{"received", channelStatus{ioThd: "ON", sqlThd: "ON", lastQueuedLag: 250000}, 250, O_RECEIVED},
+		{"idle", channelStatus{ioThd: "ON", sqlThd: "ON"}, 0, O_IDLE},
+	}
+	for _, tc := range tests {
+		lag := fallbackLagFor(tc.ch)
+		assert.Equal(t, tc.current, lag.current, tc.name)
+		assert.Equal(t, tc.observed, lag.observed, tc.name)
+	}
+}
+
+func BenchmarkComputeLag(b *testing.B) {
+	raw := rawLagInputs{ms: 1500, ok: true, replica: true, sourceHost: "db1"}
+	opts := lagOptions{absentValue: -1}
+	for i := 0; i < b.N; i++ {
+		computeLag(raw, opts)
+	}
+}
+
+func BenchmarkLagFor(b *testing.B) {
+	uuid := "3e11fa47-71ca-11e1-9e33-c80aa9429562"
+	workers := make([]worker, 16)
+	for i := range workers {
+		workers[i] = worker{lastQueuedTrx: uuid + ":100", ioThd: "ON", sqlThd: "ON", id: i, lastAppliedTrx: uuid + ":90",
+			now: 1716922210.0, lastAppliedTs: 1716922205.0, applyingTs: 1716922208.0}
+	}
+	lastQueued := map[string]string{}
+	lastProc := map[string]string{}
+	for i := 0; i < b.N; i++ {
+		lagFor(workers, lastQueued, lastProc)
+	}
+}
@@ -0,0 +1,95 @@
+// Copyright 2024 Block, Inc.
+
+package repllag
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/cashapp/blip"
+)
+
+// This file implements the debounce-count and debounce-threshold options:
+// report repl.lag.current above the threshold only after it's been above
+// the threshold for N consecutive collections. Until then, the last confirmed
+// value is reported, which suppresses transient single-sample lag spikes.
+
+// debouncer is the debounce config and state for one level.
+type debouncer struct {
+	count     int                     // debounce-count
+	threshold float64                 // debounce-threshold (milliseconds)
+	series    map[string]*lagDebounce // keyed on seriesKey
+}
+
+// lagDebounce is the debounce state for one series.
+type lagDebounce struct {
+	confirmed float64 // last confirmed value, valid only if seen
+	seen      bool    // true after first confirmed value
+	above     int     // consecutive values above threshold
+}
+
+// newDebouncer parses the debounce-count and debounce-threshold options. It
+// returns nil if debounce-count is not set (debounce disabled).
+func newDebouncer(count, threshold string) (*debouncer, error) {
+	if count == "" {
+		if threshold != "" {
+			return nil, fmt.Errorf("%s is set but %s is not", OPT_DEBOUNCE_THRESHOLD, OPT_DEBOUNCE_COUNT)
+		}
+		return nil, nil
+	}
+	n, err := strconv.Atoi(count)
+	if err != nil || n < 1 {
+		return nil, fmt.Errorf("invalid %s: %s: must be an integer greater than 0", OPT_DEBOUNCE_COUNT, count)
+	}
+	if threshold == "" {
+		return nil, fmt.Errorf("%s is set but %s is not", OPT_DEBOUNCE_COUNT, OPT_DEBOUNCE_THRESHOLD)
+	}
+	t, err := strconv.ParseFloat(threshold, 64)
+	if err != nil || t < 0 {
+		return nil, fmt.Errorf("invalid %s: %s: must be milliseconds greater than or equal to 0", OPT_DEBOUNCE_THRESHOLD, threshold)
+	}
+	return &debouncer{count: n, threshold: t, series: map[string]*lagDebounce{}}, nil
+}
+
+// debounce holds each repl.lag.current value above the threshold until it's
+// confirmed: above the threshold for count consecutive collections. A held
+// value is replaced with the last confirmed value, and the held value is saved
+// in meta key "debounced". Values at or below the threshold, and the first value
+// of a series (nothing to hold), are reported as-is. Absent values are not
+// changed but reset the consecutive count.
+func (d *debouncer) debounce(metrics []blip.MetricValue) []blip.MetricValue {
+	for i := range metrics {
+		if metrics[i].Name != "current" {
+			continue
+		}
+		key := seriesKey(metrics[i])
+		s, ok := d.series[key]
+		if !ok {
+			s = &lagDebounce{}
+			d.series[key] = s
+		}
+		v := metrics[i].Value
+		if absent(v) {
+			s.above = 0
+			continue
+		}
+		if v > d.threshold {
+			s.above++
+			if s.above < d.count && s.seen {
+				meta := map[string]string{}
+				for k, v := range metrics[i].Meta {
+					meta[k] = v
+				}
+				meta["debounced"] = strconv.FormatFloat(v, 'f', -1, 64)
+				metrics[i].Meta = meta
+				metrics[i].Value = s.confirmed
+				continue
+			}
+		} else {
+			s.above = 0
+		}
+		s.confirmed = v
+		s.seen = true
+	}
+	return metrics
+}
@@ -0,0 +1,131 @@
+// Copyright 2024 Block, Inc.
+
+package repllag
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"math"
+	"strconv"
+
+	"github.com/cashapp/blip"
+	"github.com/cashapp/blip/sqlutil"
+)
+
+// This file subtracts intentional replica delay (SOURCE_DELAY) from lag for
+// option subtract-configured-delay. A delayed replica (for point-in-time
+// recovery, for example) lags by at least SQL_Delay seconds by design, which
+// pollutes lag alerts. Subtracting it reports only unintended lag.
+//
+// Writers blip and pt-heartbeat read SQL_Delay from SHOW REPLICA STATUS. Writer
+// pfs reads DESIRED_DELAY per channel from Performance Schema because its lag
+// (worker and queue latency) is per channel, too.
+
+// pfsDelayQuery returns the configured delay (SOURCE_DELAY, seconds) per channel.
+const pfsDelayQuery = "SELECT CHANNEL_NAME, DESIRED_DELAY FROM performance_schema.replication_applier_configuration"
+
+// replStatusQuery returns SHOW REPLICA STATUS as of MySQL 8.0.22, else
+// SHOW SLAVE STATUS (or if the version is unknown).
+func (c *Lag) replStatusQuery(ctx context.Context) string {
+	if ok, err := sqlutil.MySQLVersionGTE("8.0.22", c.db, ctx); err == nil && ok {
+		return "SHOW REPLICA STATUS"
+	}
+	return "SHOW SLAVE STATUS"
+}
+
+// configuredDelay returns SQL_Delay from SHOW REPLICA STATUS in milliseconds,
+// or zero if not a replica or not delayed.
+func (c *Lag) configuredDelay(ctx context.Context, query string) (float64, error) {
+	rows, err := sqlutil.ReplicaStatusRows(ctx, c.db, query)
+	if err != nil {
+		return 0, fmt.Errorf("cannot read SQL_Delay for %s: %s: %w", OPT_SUBTRACT_DELAY, query, err)
+	}
+	if len(rows) == 0 {
+		return 0, nil // not a replica
+	}
+	return float64(rows[len(rows)-1].SQLDelay.Int64) * 1000, nil // last row, like sqlutil.RowToMap
+}
+
+// pfsConfiguredDelay returns DESIRED_DELAY from Performance Schema in
+// milliseconds per channel, keyed on channel name as reported: the default
+// channel is default-channel-name, if set. Channels that are not delayed are
+// zero. It returns an empty map if not a replica (no channels).
+func (c *Lag) pfsConfiguredDelay(ctx context.Context, levelName string) (map[string]float64, error) {
+	rows, err := c.pfsDB(levelName).QueryContext(ctx, pfsDelayQuery)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read DESIRED_DELAY for %s: %s: %w", OPT_SUBTRACT_DELAY, pfsDelayQuery, err)
+	}
+	defer rows.Close()
+	delays := map[string]float64{}
+	for rows.Next() {
+		var channel string
+		var delay sql.NullString
+		if err := rows.Scan(&channel, &delay); err != nil {
+			return nil, err
+		}
+		if channel == "" && c.defaultChannelNameOverrides[levelName] != "" {
+			channel = c.defaultChannelNameOverrides[levelName]
+		}
+		delays[channel] = pfsFloat(delay) * 1000
+	}
+	return delays, rows.Err()
+}
+
+// prepareDelay sets the query for option subtract-configured-delay at the level
+// and checks that it works. The pfs writer reads the delay from Performance
+// Schema; the blip and pt-heartbeat writers read it from SHOW REPLICA STATUS.
+// Other writers ignore the option.
+func (c *Lag) prepareDelay(ctx context.Context, levelName, writer string) error {
+	l := c.atLevel[levelName]
+	switch writer {
+	case LAG_WRITER_PFS:
+		l.delayQuery = pfsDelayQuery
+		if _, err := c.pfsConfiguredDelay(ctx, levelName); err != nil {
+			return c.pfsGrantsError(ctx, levelName, err)
+		}
+	case LAG_WRITER_BLIP, LAG_WRITER_PT:
+		l.delayQuery = c.replStatusQuery(ctx)
+		if _, err := c.configuredDelay(ctx, l.delayQuery); err != nil {
+			return c.replStatusGrantError(ctx, err)
+		}
+	}
+	return nil
+}
+
+// subtractDelay subtracts the configured delay from repl.lag.current values,
+// but not from absent values (-1 or NaN), and records it in Meta key
+// "configured_delay" (seconds). Lag is not less than zero: lag less than the
+// configured delay means the replica isn't lagging more than intended. For
+// writer pfs, the delay is per channel (group key channel).
+func (c *Lag) subtractDelay(ctx context.Context, levelName string, metrics []blip.MetricValue) ([]blip.MetricValue, error) {
+	var delayOf func(m blip.MetricValue) float64
+	if c.atLevel[levelName].delayQuery == pfsDelayQuery {
+		delays, err := c.pfsConfiguredDelay(ctx, levelName)
+		if err != nil {
+			return metrics, err
+		}
+		delayOf = func(m blip.MetricValue) float64 { return delays[m.Group["channel"]] }
+	} else {
+		delay, err := c.configuredDelay(ctx, c.atLevel[levelName].delayQuery)
+		if err != nil {
+			return metrics, err
+		}
+		delayOf = func(blip.MetricValue) float64 { return delay }
+	}
+	for i := range metrics {
+		if metrics[i].Name != "current" || absent(metrics[i].Value) {
+			continue
+		}
+		delay := delayOf(metrics[i])
+		if delay == 0 {
+			continue
+		}
+		metrics[i].Value = math.Max(metrics[i].Value-delay, 0)
+		if metrics[i].Meta == nil {
+			metrics[i].Meta = map[string]string{}
+		}
+		metrics[i].Meta["configured_delay"] = strconv.FormatFloat(delay/1000, 'f', -1, 64)
+	}
+	return metrics, nil
+}
@@ -0,0 +1,153 @@
+// Copyright 2024 Block, Inc.
+
+package repllag
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"strconv"
+	"time"
+
+	"github.com/cashapp/blip"
+	"github.com/cashapp/blip/sqlutil"
+)
+
+// This file implements option diagnostic-dump: when repl.lag.current behaves
+// anomalously, like oscillating between 0 and huge values, capture replication
+// status once for postmortem. Lag that jumps by at least diagnostic-dump-threshold
+// between collections dumpJumps times in the last dumpSamples collections of a
+// series is an anomaly. On anomaly, the diagnostic queries are run and their
+// rows are logged and reported in repl.lag.diagnostic_dump meta. Dumps are rate
+// limited by diagnostic-dump-interval.
+
+const (
+	DEFAULT_DIAGNOSTIC_DUMP_THRESHOLD = "60000" // milliseconds
+	DEFAULT_DIAGNOSTIC_DUMP_INTERVAL  = "1h"
+
+	dumpSamples = 10 // last values per series checked for an anomaly
+	dumpJumps   = 3  // jumps in dumpSamples that are an anomaly
+)
+
+// diagnosticQueries are the queries run for a dump, keyed on repl.lag.diagnostic_dump
+// meta key. The rows are from the monitored instance (replica).
+var diagnosticQueries = []struct {
+	key   string
+	query string
+}{
+	{"connection_status", "SELECT * FROM performance_schema.replication_connection_status"},
+	{"applier_workers", "SELECT * FROM performance_schema.replication_applier_status_by_worker"},
+}
+
+// dumper is the diagnostic-dump config and state for one level.
+type dumper struct {
+	threshold float64              // diagnostic-dump-threshold (milliseconds)
+	interval  time.Duration        // diagnostic-dump-interval
+	last      time.Time            // last dump, zero if none
+	series    map[string][]float64 // last dumpSamples values, keyed on seriesKey
+}
+
+// newDumper parses the diagnostic-dump options. It returns nil if diagnostic-dump
+// is not enabled.
+func newDumper(enable, threshold, interval string) (*dumper, error) {
+	if !blip.Bool(enable) {
+		return nil, nil
+	}
+	if threshold == "" {
+		threshold = DEFAULT_DIAGNOSTIC_DUMP_THRESHOLD
+	}
+	t, err := strconv.ParseFloat(threshold, 64)
+	if err != nil || t <= 0 {
+		return nil, fmt.Errorf("invalid %s: %s: must be milliseconds greater than 0", OPT_DIAG_DUMP_THRESHOLD, threshold)
+	}
+	if interval == "" {
+		interval = DEFAULT_DIAGNOSTIC_DUMP_INTERVAL
+	}
+	d, err := time.ParseDuration(interval)
+	if err != nil || d <= 0 {
+		return nil, fmt.Errorf("invalid %s: %q: must be a positive Go duration like 1h", OPT_DIAG_DUMP_INTERVAL, interval)
+	}
+	return &dumper{threshold: t, interval: d, series: map[string][]float64{}}, nil
+}
+
+// anomaly saves the repl.lag.current values and returns the first series with
+// an anomaly: the metric and the number of jumps. Absent values are ignored.
+func (d *dumper) anomaly(metrics []blip.MetricValue) (blip.MetricValue, int, bool) {
+	var found blip.MetricValue
+	jumps := 0
+	for _, m := range metrics {
+		if m.Name != "current" || absent(m.Value) {
+			continue
+		}
+		key := seriesKey(m)
+		values := append(d.series[key], m.Value)
+		if len(values) > dumpSamples {
+			values = values[len(values)-dumpSamples:]
+		}
+		d.series[key] = values
+		if jumps > 0 {
+			continue // already found, but save values of other series
+		}
+		n := 0
+		for i := 1; i < len(values); i++ {
+			if math.Abs(values[i]-values[i-1]) >= d.threshold {
+				n++
+			}
+		}
+		if n >= dumpJumps {
+			found, jumps = m, n
+		}
+	}
+	return found, jumps, jumps > 0
+}
+
+// diagnosticDump returns metrics with repl.lag.diagnostic_dump appended if there's
+// an anomaly and a dump wasn't done in the last diagnostic-dump-interval. The
+// value is the number of rows dumped; meta has the rows of each diagnostic
+// query as JSON (or <key>_error if the query failed), and the channel of the
+// anomalous series. Rows are also logged as warnings. After a dump, values are
+// cleared so the next dump requires a new anomaly, but values are kept while
+// rate limited, so an anomaly that lasts longer than the interval is dumped again.
+func (c *Lag) diagnosticDump(ctx context.Context, levelName string, metrics []blip.MetricValue, now time.Time) []blip.MetricValue {
+	d := c.atLevel[levelName].dump
+	m, jumps, ok := d.anomaly(metrics)
+	if !ok {
+		return metrics
+	}
+	if !d.last.IsZero() && now.Sub(d.last) < d.interval {
+		Log.Debug("repl.lag: %s: lag anomaly, but last diagnostic dump was %s ago", levelName, now.Sub(d.last))
+		return metrics
+	}
+	d.last = now
+	d.series = map[string][]float64{}
+
+	meta := map[string]string{
+		"anomaly": fmt.Sprintf("%d jumps >= %s ms in last %d collections", jumps, strconv.FormatFloat(d.threshold, 'f', -1, 64), dumpSamples),
+	}
+	if channel, ok := m.Group["channel"]; ok {
+		meta["channel"] = channel
+	}
+	Log.Warn("repl.lag: %s: lag anomaly (%s), diagnostic dump:", levelName, meta["anomaly"])
+	n := 0
+	for _, q := range diagnosticQueries {
+		rows, err := sqlutil.RowsToMaps(ctx, c.db, q.query)
+		if err != nil {
+			Log.Warn("repl.lag: %s: diagnostic dump: %s: %s", levelName, q.query, err)
+			meta[q.key+"_error"] = err.Error()
+			continue
+		}
+		for i, row := range rows {
+			Log.Warn("repl.lag: %s: diagnostic dump: %s[%d]: %v", levelName, q.key, i, row)
+		}
+		b, _ := json.Marshal(rows)
+		meta[q.key] = string(b)
+		n += len(rows)
+	}
+	return append(metrics, blip.MetricValue{
+		Name:  "diagnostic_dump",
+		Type:  blip.GAUGE,
+		Value: float64(n),
+		Meta:  meta,
+	})
+}
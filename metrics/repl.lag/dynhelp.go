@@ -0,0 +1,45 @@
+// Copyright 2024 Block, Inc.
+
+package repllag
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/cashapp/blip"
+)
+
+// DynamicHelp returns Help for the server connected to db: Unsupported lists
+// the writers that don't work on the server. On MariaDB, that's pfs and
+// group-replication; on MySQL, it's mariadb and writers with a Versions
+// requirement that the server version doesn't meet, like pfs on MySQL 5.7.
+// All options and values are kept, so a plan valid against Help is valid on
+// any server; options that apply only to unsupported writers are reported by
+// Inapplicable. Help is the generic case: no unsupported writers.
+func (c *Lag) DynamicHelp(ctx context.Context, db *sql.DB) (blip.CollectorHelp, error) {
+	var version, comment string
+	if err := db.QueryRowContext(ctx, mariadbProbeQuery).Scan(&version, &comment); err != nil {
+		return blip.CollectorHelp{}, fmt.Errorf("%s: %w", mariadbProbeQuery, err)
+	}
+	help := c.Help()
+
+	if strings.Contains(strings.ToLower(version), "mariadb") || strings.Contains(strings.ToLower(comment), "mariadb") {
+		help.Unsupported = []string{LAG_WRITER_PFS, LAG_WRITER_GROUP}
+	} else {
+		help.Unsupported = []string{LAG_WRITER_MARIADB}
+		for writer := range help.Versions {
+			warnings, err := help.VersionMismatch(nil, version, writer)
+			if err != nil {
+				return blip.CollectorHelp{}, err
+			}
+			if len(warnings) > 0 {
+				help.Unsupported = append(help.Unsupported, writer)
+			}
+		}
+	}
+	sort.Strings(help.Unsupported)
+	return help, nil
+}
@@ -0,0 +1,153 @@
+// Copyright 2024 Block, Inc.
+
+package repllag
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/cashapp/blip"
+)
+
+// writerChain parses option writer. A comma-separated list like "pfs,blip"
+// is a fallback chain: the first writer is the primary writer, and the others
+// are tried in order if collecting from the primary writer fails. Unlike auto,
+// which chooses one writer in Prepare, a chain chooses a writer on every
+// collection. Writers auto and none are not valid in a chain, but custom
+// writers (RegisterWriter) are.
+func writerChain(writer string) (string, []string, error) {
+	if !strings.Contains(writer, ",") {
+		return writer, nil, nil
+	}
+	chain := strings.Split(writer, ",")
+	seen := map[string]bool{}
+	for i := range chain {
+		chain[i] = strings.TrimSpace(chain[i])
+		if _, ok := lookupWriter(chain[i]); !ok {
+			return "", nil, fmt.Errorf("invalid lag writer in %s list %q: %q; valid values: %s", OPT_WRITER, writer, chain[i], strings.Join(Writers(), ", "))
+		}
+		if seen[chain[i]] {
+			return "", nil, fmt.Errorf("invalid %s list %q: %s listed more than once", OPT_WRITER, writer, chain[i])
+		}
+		seen[chain[i]] = true
+	}
+	return chain[0], chain[1:], nil
+}
+
+// prepareFallback prepares the fallback writers. A fallback writer that is not
+// available is removed from the chain with a warning (like compare-writers)
+// because the primary writer is available. The returned cleanup func chains
+// the given cleanup func with the fallback Blip heartbeat readers, if any.
+func (c *Lag) prepareFallback(ctx context.Context, levelName string, plan blip.Plan, opts map[string]string, cleanup func()) func() {
+	l := c.atLevel[levelName]
+	var fallback []string
+	for _, writer := range l.fallback {
+		var err error
+		if cleanup, err = c.prepareSecondary(ctx, levelName, writer, plan, opts, cleanup); err != nil {
+			Log.Warn("repl.lag: %s: fallback writer %s disabled: %s", levelName, writer, err)
+			continue
+		}
+		fallback = append(fallback, writer)
+	}
+	l.fallback = fallback
+	return cleanup
+}
+
+// prepareSecondary prepares a writer that is not the primary writer: a
+// fallback writer or the compare-writers writer. It returns an error if the
+// writer is not available. The returned cleanup func chains the given cleanup
+// func with the Blip heartbeat readers, if any. On error, the given cleanup func
+// is returned.
+func (c *Lag) prepareSecondary(ctx context.Context, levelName, writer string, plan blip.Plan, opts map[string]string, cleanup func()) (func(), error) {
+	l := c.atLevel[levelName]
+	var err error
+	switch writer {
+	case LAG_WRITER_PT, LAG_WRITER_PROXYSQL, LAG_WRITER_GROUP, LAG_WRITER_PROC, LAG_WRITER_MARIADB:
+		c.dropNoHeartbeat[levelName] = !reportNoHeartbeat(opts)
+	}
+	switch writer {
+	case LAG_WRITER_PFS:
+		err = c.preparePFS(ctx, levelName)
+	case LAG_WRITER_PT:
+		l.ptQuery = ptHeartbeatQuery(opts)
+		_, err = c.collectPtHeartbeat(ctx, levelName)
+	case LAG_WRITER_PROXYSQL:
+		_, err = c.collectProxySQL(ctx, levelName)
+	case LAG_WRITER_GROUP:
+		_, err = c.collectGroupRepl(ctx, levelName)
+	case LAG_WRITER_MARIADB:
+		_, err = c.collectMariaDB(ctx, levelName)
+	case LAG_WRITER_PROC:
+		if l.proc, err = parseLagProc(opts); err == nil {
+			_, err = c.collectProc(ctx, levelName)
+		}
+	case LAG_WRITER_BLIP:
+		// prepareBlip sets the level writer and db for a primary writer
+		primary, db := c.lagWriterIn[levelName], l.db
+		var readerCleanup func()
+		readerCleanup, err = c.prepareBlip(ctx, levelName, plan.MonitorId, plan.Name, opts)
+		c.lagWriterIn[levelName], l.db = primary, db
+		if err == nil {
+			prevCleanup := cleanup
+			cleanup = func() {
+				if prevCleanup != nil {
+					prevCleanup()
+				}
+				readerCleanup()
+			}
+		}
+	default: // custom writer (RegisterWriter)
+		w, _ := lookupWriter(writer)
+		var writerCleanup func()
+		if writerCleanup, err = w.Prepare(ctx, c, levelName, plan, opts); err == nil && writerCleanup != nil {
+			prevCleanup := cleanup
+			cleanup = func() {
+				if prevCleanup != nil {
+					prevCleanup()
+				}
+				writerCleanup()
+			}
+		}
+	}
+	if err != nil {
+		return cleanup, fmt.Errorf("cannot collect from %s: %s", writer, err)
+	}
+	return cleanup, nil
+}
+
+// collectChain returns the metrics from the primary writer or, if that fails,
+// the first fallback writer that does not fail. The writer used is saved in
+// lagLevel.used. If all writers fail, the primary writer error is returned.
+func (c *Lag) collectChain(ctx context.Context, levelName string) ([]blip.MetricValue, error) {
+	l := c.atLevel[levelName]
+	primary := c.lagWriterIn[levelName]
+	metrics, err := c.collectRetry(ctx, levelName, primary)
+	if err == nil || len(l.fallback) == 0 {
+		l.used = primary
+		return metrics, err
+	}
+	for _, writer := range l.fallback {
+		l.notReplica = false // only the writer used sets replica state
+		fbMetrics, fbErr := c.collectRetry(ctx, levelName, writer)
+		if fbErr != nil {
+			Log.Debug("repl.lag: %s: fallback writer %s: %s", levelName, writer, fbErr)
+			continue
+		}
+		Log.Warn("repl.lag: %s: using fallback writer %s: error from writer %s: %s", levelName, writer, primary, err)
+		l.used = writer
+		return fbMetrics, nil
+	}
+	l.used = primary
+	return metrics, err
+}
+
+// hasWriter returns true if writer is in writers.
+func hasWriter(writers []string, writer string) bool {
+	for _, w := range writers {
+		if w == writer {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,105 @@
+// Copyright 2024 Block, Inc.
+
+package repllag
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/cashapp/blip"
+	"github.com/cashapp/blip/sqlutil"
+)
+
+// This file reports repl.lag.file_backlog for option report-file-backlog: the
+// number of source binary log files the SQL thread is behind the IO thread,
+// from SHOW REPLICA STATUS. It's a coarse catch-up indicator that complements
+// pos_backlog, which can't be computed when the threads are on different files.
+
+// fileBacklog returns metrics with repl.lag.file_backlog appended for each
+// replication channel. If the file number difference cannot be computed (see
+// binlogFileBacklog), it's the absent value (or dropped if absent-value=drop).
+// Not a replica (no rows) reports nothing. An error is logged and ignored
+// because file_backlog is in addition to lag.
+func (c *Lag) fileBacklog(ctx context.Context, levelName string, metrics []blip.MetricValue) []blip.MetricValue {
+	l := c.atLevel[levelName]
+	rows, err := sqlutil.ReplicaStatusRows(ctx, c.db, l.fileQuery)
+	if err != nil {
+		Log.Debug("repl.lag: %s: %s: %s", levelName, OPT_REPORT_FILE_BACKLOG, err)
+		return metrics
+	}
+	for _, status := range rows {
+		channel := status.Channel
+		if channel == "" && c.defaultChannelNameOverrides[levelName] != "" {
+			channel = c.defaultChannelNameOverrides[levelName]
+		}
+		value, ok := binlogFileBacklog(status)
+		if !ok {
+			if l.absent == ABSENT_VALUE_DROP {
+				continue
+			}
+			value = math.NaN() // absent: see reportAbsent
+		}
+		metrics = append(metrics, blip.MetricValue{
+			Name:  "file_backlog",
+			Type:  blip.GAUGE,
+			Value: value,
+			Group: map[string]string{"channel": channel},
+		})
+	}
+	return metrics
+}
+
+// binlogFileBacklog returns the file number of Source_Log_File (IO thread)
+// minus the file number of Relay_Source_Log_File (SQL thread), or the Master
+// terms prior to MySQL 8.0.22. It returns false if either file name is not
+// a binary log file name (see binlogFileNum) or they are not the same series
+// (base name), like after log_bin_basename changed on the source. It's never
+// negative.
+func binlogFileBacklog(status sqlutil.ReplicaStatus) (float64, bool) {
+	readBase, readNum, readOk := binlogFileNum(status.SourceLogFile)
+	execBase, execNum, execOk := binlogFileNum(status.RelaySourceLogFile)
+	if !readOk || !execOk || readBase != execBase {
+		return 0, false
+	}
+	if readNum < execNum {
+		return 0, true // file number wrapped or reset (RESET MASTER)
+	}
+	return float64(readNum - execNum), true
+}
+
+// binlogFileNum splits a binary log file name, like mysql-bin.000123, into base
+// name (mysql-bin) and file number (123). It returns false if the name has no
+// extension or the extension is not all digits, like an empty name (no source
+// log file yet) or a relay log index file.
+func binlogFileNum(name string) (string, uint64, bool) {
+	name = strings.TrimSpace(name)
+	i := strings.LastIndex(name, ".")
+	if i < 1 || i == len(name)-1 {
+		return "", 0, false
+	}
+	ext := name[i+1:]
+	for _, r := range ext {
+		if r < '0' || r > '9' {
+			return "", 0, false
+		}
+	}
+	n, err := strconv.ParseUint(ext, 10, 64)
+	if err != nil {
+		return "", 0, false // too many digits
+	}
+	return name[:i], n, true
+}
+
+// prepareFileBacklog sets the SHOW REPLICA STATUS query for option
+// report-file-backlog and checks that it works.
+func (c *Lag) prepareFileBacklog(ctx context.Context, levelName string) error {
+	l := c.atLevel[levelName]
+	l.fileQuery = c.replStatusQuery(ctx)
+	if _, err := sqlutil.ReplicaStatusRows(ctx, c.db, l.fileQuery); err != nil {
+		return c.replStatusGrantError(ctx, fmt.Errorf("%s: %s: %w", OPT_REPORT_FILE_BACKLOG, l.fileQuery, err))
+	}
+	return nil
+}
@@ -0,0 +1,91 @@
+// Copyright 2024 Block, Inc.
+
+package repllag
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/cashapp/blip"
+	"github.com/cashapp/blip/sqlutil"
+)
+
+// This file reports repl.lag.filters_present for option report-filters: 1 if
+// the replication channel has replication filters, else 0, from SHOW REPLICA
+// STATUS. Filters change what lag means because filtered transactions are not
+// applied, and they're a common silent misconfiguration, so this flags replicas
+// where lag might be misleading.
+
+// replFilterCols are the SHOW REPLICA STATUS replication filter columns, in
+// output order. Replicate_Rewrite_DB is MySQL 8.0 only. The same columns are in
+// SHOW SLAVE STATUS and MariaDB SHOW ALL SLAVES STATUS.
+var replFilterCols = []string{
+	"Replicate_Do_DB",
+	"Replicate_Ignore_DB",
+	"Replicate_Do_Table",
+	"Replicate_Ignore_Table",
+	"Replicate_Wild_Do_Table",
+	"Replicate_Wild_Ignore_Table",
+	"Replicate_Rewrite_DB",
+}
+
+// replFilters returns metrics with repl.lag.filters_present appended for each
+// replication channel. Meta has the filter columns that are set, lowercase, like
+// replicate_do_db=app. Not a replica (no rows) reports nothing. An error is
+// logged and ignored because filters_present is in addition to lag.
+func (c *Lag) replFilters(ctx context.Context, levelName string, metrics []blip.MetricValue) []blip.MetricValue {
+	l := c.atLevel[levelName]
+	rows, err := sqlutil.ReplicaStatusRows(ctx, c.db, l.filterQuery)
+	if err != nil {
+		Log.Debug("repl.lag: %s: %s: %s", levelName, OPT_REPORT_FILTERS, err)
+		return metrics
+	}
+	for _, status := range rows {
+		channel := status.Channel
+		if channel == "" && c.defaultChannelNameOverrides[levelName] != "" {
+			channel = c.defaultChannelNameOverrides[levelName]
+		}
+		meta := replFilters(status)
+		value := 0.0
+		if len(meta) > 0 {
+			value = 1
+		}
+		metrics = append(metrics, blip.MetricValue{
+			Name:  "filters_present",
+			Type:  blip.GAUGE,
+			Value: value,
+			Group: map[string]string{"channel": channel},
+			Meta:  meta,
+		})
+	}
+	return metrics
+}
+
+// replFilters returns the replication filter columns that are set in status,
+// keyed on lowercase column name, or nil if none.
+func replFilters(status sqlutil.ReplicaStatus) map[string]string {
+	var filters map[string]string
+	for _, col := range replFilterCols {
+		v, _ := status.Column(col)
+		if v = strings.TrimSpace(v); v == "" {
+			continue
+		}
+		if filters == nil {
+			filters = map[string]string{}
+		}
+		filters[strings.ToLower(col)] = v
+	}
+	return filters
+}
+
+// prepareFilters sets the SHOW REPLICA STATUS query for option report-filters
+// and checks that it works.
+func (c *Lag) prepareFilters(ctx context.Context, levelName string) error {
+	l := c.atLevel[levelName]
+	l.filterQuery = c.replStatusQuery(ctx)
+	if _, err := sqlutil.ReplicaStatusRows(ctx, c.db, l.filterQuery); err != nil {
+		return c.replStatusGrantError(ctx, fmt.Errorf("%s: %s: %w", OPT_REPORT_FILTERS, l.filterQuery, err))
+	}
+	return nil
+}
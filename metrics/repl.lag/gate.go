@@ -0,0 +1,55 @@
+// Copyright 2024 Block, Inc.
+
+package repllag
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// This file handles option collect-when: a MySQL variable that gates lag
+// collection. A DBA sets the variable false to pause lag metrics (and lag
+// alerts) during maintenance without changing the plan.
+
+// collectWhenVar matches a valid collect-when variable: a global variable with
+// or without @@ (like @@global.var or var), or a user variable (@var).
+var collectWhenVar = regexp.MustCompile(`^@{0,2}[a-zA-Z_][a-zA-Z0-9_.$]*$`)
+
+// parseCollectWhen validates the collect-when option and returns the query to
+// read the variable, or an empty string if not set.
+func parseCollectWhen(s string) (string, error) {
+	v := strings.TrimSpace(s)
+	if v == "" {
+		return "", nil
+	}
+	if !collectWhenVar.MatchString(v) || strings.HasPrefix(v, "@@@") {
+		return "", fmt.Errorf("invalid %s: %q: must be a MySQL global variable (@@var or var) or user variable (@var)", OPT_COLLECT_WHEN, s)
+	}
+	if !strings.HasPrefix(v, "@") {
+		v = "@@" + v
+	}
+	return "SELECT " + v, nil
+}
+
+// collectOpen returns true if the collect-when variable is truthy: ON, TRUE,
+// YES, or a nonzero number (case-insensitive). NULL (like an unset user
+// variable) and all other values are false.
+func (c *Lag) collectOpen(ctx context.Context, query string) (bool, error) {
+	var v sql.NullString
+	if err := c.db.QueryRowContext(ctx, query).Scan(&v); err != nil {
+		return false, fmt.Errorf("%s: %s: %w", OPT_COLLECT_WHEN, query, err)
+	}
+	if !v.Valid {
+		return false, nil
+	}
+	switch strings.ToLower(strings.TrimSpace(v.String)) {
+	case "on", "true", "yes":
+		return true, nil
+	}
+	f, err := strconv.ParseFloat(strings.TrimSpace(v.String), 64)
+	return err == nil && f != 0, nil
+}
@@ -0,0 +1,94 @@
+// Copyright 2024 Block, Inc.
+
+package repllag
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+
+	"github.com/cashapp/blip"
+)
+
+// This file reports replication lag of a Group Replication (or InnoDB Cluster)
+// member. Group Replication doesn't have a source, so there's no time-based
+// lag. Instead, lag is the number of transactions that the member has received
+// but not applied: transactions waiting for certification (conflict detection)
+// plus remote transactions waiting in the applier queue. The query returns
+// stats for the monitored member only because other members report their own
+// lag (stats for other members are delayed).
+const groupReplLagQuery = `SELECT
+  s.MEMBER_ID,
+  COALESCE(m.MEMBER_HOST, ''),
+  COALESCE(m.MEMBER_PORT, 0),
+  COALESCE(m.MEMBER_STATE, ''),
+  s.COUNT_TRANSACTIONS_IN_QUEUE,
+  s.COUNT_TRANSACTIONS_REMOTE_IN_APPLIER_QUEUE
+FROM
+  performance_schema.replication_group_member_stats s
+  LEFT JOIN performance_schema.replication_group_members m USING (MEMBER_ID)
+WHERE
+  s.MEMBER_ID = @@server_uuid
+`
+
+// groupReplProbeQuery is used by writer=auto to detect a Group Replication
+// member. The tables exist in MySQL 8.0 even if Group Replication isn't used,
+// so the member must be in a running group (online or recovering).
+const groupReplProbeQuery = "SELECT COUNT(*) FROM performance_schema.replication_group_members WHERE MEMBER_ID = @@server_uuid AND MEMBER_STATE IN ('ONLINE', 'RECOVERING')"
+
+// isGroupReplMember returns true if the monitored instance is a member of a
+// running Group Replication group.
+func (c *Lag) isGroupReplMember(ctx context.Context) bool {
+	var n int
+	if err := c.db.QueryRowContext(ctx, groupReplProbeQuery).Scan(&n); err != nil {
+		Log.Debug("repl.lag: not Group Replication: %s", err)
+		return false
+	}
+	return n > 0
+}
+
+// collectGroupRepl reports repl.lag.current for the monitored member with Meta
+// key "member" = "host:port" (or member ID if host is unknown). If the member
+// is not online or recovering (for example, it's in error state), it's reported
+// like no heartbeat: absent value or dropped. If the member isn't in a group,
+// it's not a replica.
+func (c *Lag) collectGroupRepl(ctx context.Context, levelName string) ([]blip.MetricValue, error) {
+	var (
+		memberId   string
+		host       string
+		port       int
+		state      string
+		certQueue  int64
+		applyQueue int64
+	)
+	err := c.db.QueryRowContext(ctx, groupReplLagQuery).Scan(&memberId, &host, &port, &state, &certQueue, &applyQueue)
+	if err == sql.ErrNoRows {
+		return c.notAReplica(levelName), nil // not in a group
+	}
+	if err != nil {
+		return nil, fmt.Errorf("could not check replication lag, check that the host is a Group Replication member, and that performance_schema is enabled. Err: %w", err)
+	}
+
+	member := memberId
+	if host != "" {
+		member = fmt.Sprintf("%s:%d", host, port)
+	}
+	ok := state == "ONLINE" || state == "RECOVERING"
+	if !ok && c.dropNoHeartbeat[levelName] {
+		Log.Debug("(repl.lag from Group Replication): member %s: state %s, dropped", member, state)
+		return nil, nil
+	}
+	opts := c.lagOptions(levelName)
+	opts.clockOffset = 0 // lag is transactions, not timestamps
+	value, meta := computeLag(rawLagInputs{
+		ms:      float64(certQueue + applyQueue),
+		ok:      ok,
+		replica: true,
+	}, opts)
+	if meta == nil {
+		meta = map[string]string{}
+	}
+	meta["member"] = member
+	Log.Debug("(repl.lag from Group Replication): member %s: state %s, certification queue %d, applier queue %d", member, state, certQueue, applyQueue)
+	return []blip.MetricValue{{Name: "current", Type: blip.GAUGE, Value: value, Meta: meta}}, nil
+}
@@ -0,0 +1,91 @@
+// Copyright 2024 Block, Inc.
+
+package repllag
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/cashapp/blip/heartbeat"
+	"github.com/cashapp/blip/sqlutil"
+)
+
+// This file handles option heartbeat-key for heartbeat tables with a composite
+// primary key, like (src_id, shard): the other key columns must be given so the
+// reader selects the row for the shard, not the latest row of any shard.
+
+// hbKeyCol matches a valid heartbeat-key column name.
+var hbKeyCol = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_$]*$`)
+
+// parseHeartbeatKey parses option heartbeat-key: comma-separated column=value
+// pairs, like "shard=3, region=us". It returns nil if the value is empty.
+// Column names are validated because they're in the query; values are not
+// because the heartbeat reader binds them as query args.
+func parseHeartbeatKey(s string) (map[string]string, error) {
+	if strings.TrimSpace(s) == "" {
+		return nil, nil
+	}
+	key := map[string]string{}
+	for _, kv := range strings.Split(s, ",") {
+		if kv = strings.TrimSpace(kv); kv == "" {
+			continue
+		}
+		col, val, ok := strings.Cut(kv, "=")
+		col = strings.TrimSpace(col)
+		if !ok || !hbKeyCol.MatchString(col) {
+			return nil, fmt.Errorf("invalid %s: %q: must be column=value", OPT_HEARTBEAT_KEY, kv)
+		}
+		if _, ok := key[col]; ok {
+			return nil, fmt.Errorf("invalid %s: column %s set more than once", OPT_HEARTBEAT_KEY, col)
+		}
+		key[col] = strings.TrimSpace(val)
+	}
+	return key, nil
+}
+
+// pkColsQuery returns the primary key columns of a table, in key order.
+const pkColsQuery = `SELECT COLUMN_NAME
+FROM information_schema.KEY_COLUMN_USAGE
+WHERE TABLE_SCHEMA = COALESCE(?, DATABASE()) AND TABLE_NAME = ? AND CONSTRAINT_NAME = 'PRIMARY'
+ORDER BY ORDINAL_POSITION`
+
+// checkHeartbeatKey returns an error if the primary key of the heartbeat table
+// has columns, other than src_id, that are not in the heartbeat-key. It does
+// not check tables without a primary key. The query times out after
+// heartbeat.ReadTimeout or when ctx (from Prepare) is done.
+func checkHeartbeatKey(ctx context.Context, db *sql.DB, table string, key map[string]string) error {
+	var schema sql.NullString
+	parts := sqlutil.SplitQualifiedName(table)
+	if len(parts) > 1 {
+		schema = sql.NullString{String: parts[0], Valid: true}
+	}
+	ctx, cancel := context.WithTimeout(ctx, heartbeat.ReadTimeout)
+	defer cancel()
+	rows, err := db.QueryContext(ctx, pkColsQuery, schema, parts[len(parts)-1])
+	if err != nil {
+		return fmt.Errorf("%s: cannot read primary key of %s: %w", OPT_HEARTBEAT_KEY, table, err)
+	}
+	defer rows.Close()
+	var missing []string
+	for rows.Next() {
+		var col string
+		if err := rows.Scan(&col); err != nil {
+			return fmt.Errorf("%s: cannot read primary key of %s: %w", OPT_HEARTBEAT_KEY, table, err)
+		}
+		if _, ok := key[col]; !ok && !strings.EqualFold(col, "src_id") {
+			missing = append(missing, col)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("%s: cannot read primary key of %s: %w", OPT_HEARTBEAT_KEY, table, err)
+	}
+	if len(missing) > 0 {
+		sort.Strings(missing)
+		return fmt.Errorf("%s: primary key columns of %s not set: %s", OPT_HEARTBEAT_KEY, table, strings.Join(missing, ", "))
+	}
+	return nil
+}
@@ -5,8 +5,13 @@ package repllag
 import (
 	"context"
 	"database/sql"
+	"errors"
 	"fmt"
+	"math"
+	"regexp"
 	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/cashapp/blip"
@@ -26,37 +31,322 @@ const (
 	OPT_REPORT_NOT_A_REPLICA  = "report-not-a-replica"
 	OPT_DEFAULT_CHANNEL_NAME  = "default-channel-name"
 	OPT_NETWORK_LATENCY       = "network-latency"
+	OPT_SOURCE_LATENCY        = "network-latency-by-source"
+	OPT_REPORT_TREND          = "report-trend"
+	OPT_SOURCE_DSN            = "source-dsn"
+	OPT_ABSENT_VALUE          = "absent-value"
+	OPT_ROUND                 = "round"
+	OPT_PT_TS_COLUMN          = "pt-ts-column"
+	OPT_PT_SERVER_ID_COLUMN   = "pt-server-id-column"
+	OPT_PT_UTC                = "pt-utc"
+	OPT_SKIP_ZERO             = "skip-zero"
+	OPT_ROLE                  = "role"
+	OPT_CROSS_CHECK           = "cross-check"
+	OPT_WINDOW                = "window"
+	OPT_PERCENTILE            = "percentile"
+	OPT_INCLUDE_IDENTITY      = "include-identity"
+	OPT_INCLUDE_LEVEL         = "include-level"
+	OPT_CHANNEL               = "channel"
+	OPT_REPORT_DB_STATS       = "report-db-stats"
+	OPT_REPORT_COLLECT_AGE    = "report-collect-age"
+	OPT_CLOCK_OFFSET          = "clock-offset-ms"
+	OPT_REPORT_WRITER         = "report-writer"
+	OPT_EMIT_TIMESTAMP        = "emit-timestamp"
+	OPT_PFS_DSN               = "pfs-dsn"
+	OPT_DEBOUNCE_COUNT        = "debounce-count"
+	OPT_DEBOUNCE_THRESHOLD    = "debounce-threshold"
+	OPT_HEARTBEAT_TAG         = "heartbeat-tag"
+	OPT_HEARTBEAT_TS_FORMAT   = "heartbeat-ts-format"
+	OPT_REPORT_RESTARTS       = "report-reader-restarts"
+	OPT_DEBUG_COMPONENTS      = "debug-components"
+	OPT_REPORT_OLDEST         = "report-oldest-unapplied"
+	OPT_HEARTBEAT_FREQ        = "heartbeat-freq"
+	OPT_SUBTRACT_DELAY        = "subtract-configured-delay"
+	OPT_CONSISTENT_READ       = "consistent-read"
+	OPT_REPORT_PARALLELISM    = "report-parallelism"
+	OPT_MAX_SERIES            = "max-series"
+	OPT_COMPARE_WRITERS       = "compare-writers"
+	OPT_RETRIES               = "retries"
+	OPT_REFRESH_INTERVAL      = "refresh-interval"
+	OPT_CHANNEL_RENAME        = "channel-rename"
+	OPT_NOW_PRECISION         = "now-precision"
+	OPT_META_ALLOWLIST        = "meta-allowlist"
+	OPT_WARMUP                = "warmup"
+	OPT_UNIT                  = "unit"
+	OPT_SOURCE_VALUE          = "source-value"
+	OPT_REPORT_POS_BACKLOG    = "report-pos-backlog"
+	OPT_REPORT_WORKER_DIST    = "report-worker-distribution"
+	OPT_REPORT_APPLY_RATE     = "report-apply-rate"
+	OPT_STALE_BEHAVIOR        = "stale-behavior"
+	OPT_INCLUDE_VERSION       = "include-version"
+	OPT_HEARTBEAT_WRITE_LAT   = "heartbeat-write-latency-col"
+	OPT_AUTO_WRITERS          = "auto-writers"
+	OPT_REPORT_QUERY_DURATION = "report-query-duration"
+	OPT_HEARTBEAT_APPLIED_TS  = "heartbeat-applied-ts-col"
+	OPT_COLLECT_WHEN          = "collect-when"
+	OPT_HEARTBEAT_KEY         = "heartbeat-key"
+	OPT_LAG_PROC              = "lag-proc"
+	OPT_LAG_PROC_COLUMN       = "lag-proc-column"
+	OPT_LAG_PROC_UNIT         = "lag-proc-unit"
+	OPT_READ_INTERVAL         = "read-interval"
+	OPT_CLAMP_NEGATIVE        = "clamp-negative"
+	OPT_REPORT_AGGREGATE      = "report-aggregate"
+	OPT_DIAG_DUMP             = "diagnostic-dump"
+	OPT_DIAG_DUMP_THRESHOLD   = "diagnostic-dump-threshold"
+	OPT_DIAG_DUMP_INTERVAL    = "diagnostic-dump-interval"
+	OPT_SINK_UNIT             = "sink-unit"
+	OPT_REQUIRE_HEARTBEAT     = "require-heartbeat"
+	OPT_SLA_MS                = "sla-ms"
+	OPT_MAX_CONCURRENT        = "max-concurrent-queries"
+	OPT_REPORT_FILTERS        = "report-filters"
+	OPT_LOG_SCALE             = "log-scale"
+	OPT_HEARTBEAT_SEQ_COL     = "heartbeat-seq-col"
+	OPT_HEARTBEAT_SEQ_DSN     = "heartbeat-seq-dsn"
+	OPT_ON_DETECT_FAIL        = "on-detect-fail"
+	OPT_REPORT_FILE_BACKLOG   = "report-file-backlog"
+	OPT_REPORT_WRITER_ALIVE   = "report-writer-alive"
+	OPT_REPORT_UP             = "report-up"
+	OPT_INCLUDE_TRACE_ID      = "include-trace-id"
 
-	LAG_WRITER_BLIP = "blip"
-	LAG_WRITER_PFS  = "pfs"
+	LAG_WRITER_BLIP     = "blip"
+	LAG_WRITER_PFS      = "pfs"
+	LAG_WRITER_PROXYSQL = "proxysql"
+	LAG_WRITER_PT       = "pt-heartbeat"
+	LAG_WRITER_GROUP    = "group-replication"
+	LAG_WRITER_PROC     = "proc"
+	LAG_WRITER_MARIADB  = "mariadb"
+	LAG_WRITER_NONE     = "none" // role=source with writer=auto
+
+	ROLE_REPLICA      = "replica"
+	ROLE_INTERMEDIATE = "intermediate"
+	ROLE_SOURCE       = "source"
+
+	ABSENT_VALUE_NEG_1 = "-1"
+	ABSENT_VALUE_NAN   = "nan"
+	ABSENT_VALUE_DROP  = "drop"
+
+	ROUND_NONE    = "none"
+	ROUND_FLOOR   = "floor"
+	ROUND_CEIL    = "ceil"
+	ROUND_NEAREST = "nearest"
+
+	UNIT_MS = "ms"
+	UNIT_S  = "s"
+
+	HEARTBEAT_FREQ_AUTO = "auto"
+
+	DETECT_FAIL_ERROR   = "error"
+	DETECT_FAIL_DISABLE = "disable"
 )
 
+// ErrorBackoffAfter is the number of consecutive Collect errors at a level
+// after which Collect backs off: it skips collecting (and returns the last error)
+// for 1, 2, 4, and so on up to ErrorBackoffMax collections before trying again.
+// A successful collection resets the backoff.
+var ErrorBackoffAfter = 3
+
+// ErrorBackoffMax is the maximum number of collections skipped by error backoff.
+var ErrorBackoffMax = 32
+
+// ErrNoDB is returned by Prepare and Collect if the database is nil or closed,
+// like after a monitor DB reset.
+var ErrNoDB = errors.New("database not available")
+
+// ErrLevelNotPrepared is returned by Collect and State for a level that isn't
+// in the prepared plan (or doesn't collect repl.lag).
+var ErrLevelNotPrepared = errors.New("level not prepared")
+
+// Lag collects repl.lag. It's safe for concurrent use: Prepare, PrepareAll,
+// Activate, Collect, State, and ReadOnce are serialized (they read and write
+// the level state), and ActiveConfig and Cost can run concurrently with each
+// other. So re-preparing on plan reload while a level is being collected
+// waits for Collect to return, and vice versa. A custom LagWriter is called
+// with the lock held, so it must not call these methods.
 type Lag struct {
+	// Now is the clock for time-dependent features: warmup, trend, stale-behavior,
+	// refresh-interval, report-collect-age, report-query-duration, and
+	// diagnostic-dump. It defaults to time.Now. Set it only after NewLag and
+	// before Prepare, like a fake clock in tests. Lag from MySQL (like NOW() in
+	// heartbeat queries) does not use it.
+	Now func() time.Time
+
+	mu                          sync.RWMutex // guards all fields except those set only by the constructor: db, openDB, Now, reader, and limiter. Not held while collecting: see view
 	db                          *sql.DB
-	lagReader                   heartbeat.Reader
+	openDB                      func(dsn string) (*sql.DB, error) // for source-dsn and pfs-dsn
+	lagReaders                  []heartbeat.Reader                // one per heartbeat table
+	lagWriterIn                 map[string]string
+	dropNoHeartbeat             map[string]bool
+	dropNotAReplica             map[string]bool
+	defaultChannelNameOverrides map[string]string
+	replCheck                   string
+	atLevel                     map[string]*lagLevel
+	readers                     map[string]*readerSet    // keyed on readerKey, shared by plans
+	prepared                    map[string]*preparedPlan // keyed on plan name (PrepareAll)
+	monitorId                   string                   // from last plan prepared
+	planName                    string                   // from last plan prepared
+	reader                      heartbeat.Reader         // from NewLagWithReader, else nil
+	limiter                     *sqlutil.Limiter         // from NewLagWithLimiter, else nil
+	gen                         uint64                   // incremented by each prepare (see releaseReaders)
+}
+
+// readerSet is the Blip heartbeat readers for one reader configuration
+// (see readerKey) and the func to stop them.
+type readerSet struct {
+	readers []heartbeat.Reader
+	cleanup func()  // safe to call more than once
+	db      *sql.DB // from which readers read heartbeats
+	gen     uint64  // last prepare that uses the readers
+}
+
+// preparedPlan is the level state for one plan prepared by PrepareAll.
+// Activate swaps it into the Lag collector.
+type preparedPlan struct {
+	atLevel                     map[string]*lagLevel
 	lagWriterIn                 map[string]string
 	dropNoHeartbeat             map[string]bool
 	dropNotAReplica             map[string]bool
 	defaultChannelNameOverrides map[string]string
 	replCheck                   string
-	pfsLagLastQueued            map[string]string
-	pfsLagLastProc              map[string]string
+	lagReaders                  []heartbeat.Reader
+}
+
+// lagLevel is the config and state for one level that collects repl.lag.
+// Config is set by Prepare and not changed after. State (like last, skip, and
+// cache) is changed by collection, which mu serializes.
+type lagLevel struct {
+	mu          sync.Mutex // serializes collection at the level
+	absent      string     // absent-value option
+	absentValue float64    // -1 or NaN: reported absent value (NaN while collecting)
+	reportTrend bool
+	round       string // round option
+	ptQuery     string // pt-heartbeat writer
+	skipZero    bool
+	logScale    bool
+	disabled    bool                  // on-detect-fail=disable and auto-detect failed: not collecting
+	crossCheck  bool                  // blip writer: also collect pfs, report disagreement
+	proc        *lagProc              // proc writer: lag-proc options, else nil
+	windowSize  int                   // window option: number of samples, 0 if not set
+	percentile  float64               // percentile option
+	windows     map[string]*lagWindow // keyed on seriesKey
+	identity    map[string]string     // include-identity and include-level: monitor_id, plan, and level meta, else nil
+	channel     string                // pfs writer: only collect this channel
+	multiRole   bool                  // blip writer: source-role is a list, report meta source_role
+	db          *sql.DB               // from which lag is read: heartbeat reader DB (blip) or monitor DB
+	dbStats     bool                  // report-db-stats
+	collectAge  bool                  // report-collect-age
+	up          bool                  // report-up
+	queryDur    bool                  // report-query-duration
+	lastCollect time.Time             // last successful Collect (or Prepare)
+	clockOffset float64               // clock-offset-ms
+	clampNeg    bool                  // clamp-negative
+	writer      bool                  // report-writer
+	emitTs      bool                  // emit-timestamp: pfs writer only
+	pfsDB       *sql.DB               // pfs-dsn pool, else nil (use monitor DB)
+	debounce    *debouncer            // debounce-count and debounce-threshold, else nil
+	dump        *dumper               // diagnostic-dump, else nil
+	restarts    bool                  // report-reader-restarts: blip writer only
+	components  bool                  // debug-components: pfs writer only
+	oldest      bool                  // report-oldest-unapplied: pfs writer only
+	parallel    time.Duration         // report-parallelism: window (level freq), 0 if disabled
+	workerDist  bool                  // report-worker-distribution: pfs writer only
+	applyRate   bool                  // report-apply-rate: pfs writer only
+	applied     map[string]trxSample  // report-apply-rate: last applied trx per channel, keyed on PFS channel name
+	maxSeries   int                   // max-series, 0 if not set
+	aggregate   string                // report-aggregate: reducer, else ""
+	compare     string                // compare-writers: secondary writer, else ""
+	retries     int                   // retries, 0 if not set
+	fallback    []string              // writer list after the primary writer, else nil
+	used        string                // writer used for last collection: primary or fallback writer
+	notReplica  bool                  // set by writer during collection if not a replica (for State)
+	refresh     time.Duration         // refresh-interval, 0 if not set
+	cache       []blip.MetricValue    // refresh-interval: last writer metrics, else nil
+	cacheTime   time.Time             // refresh-interval: when cache was collected
+	cacheNotRep bool                  // refresh-interval: notReplica when cache was collected
+	rename      []channelRename       // channel-rename rules, else nil
+	selfIds     map[string]bool       // blip and pt-heartbeat: local source IDs (self heartbeat), else nil
+	pfsQuery    string                // pfs: mySQL8LagQuery with now-precision
+	pfsFbQuery  string                // pfs: mySQL8LagFallbackQuery with now-precision
+	metaKeys    map[string]bool       // meta-allowlist, else nil (all keys)
+	metrics     map[string]bool       // Domain.Metrics, else nil (all metrics)
+	labels      map[string]string     // plan and level labels, else nil
+	whenQuery   string                // collect-when: SELECT var, else ""
+	warmupEnd   time.Time             // warmup: end of warmup (blip), zero if not set or reader warmed up
+	seconds     bool                  // unit=s
+	sourceValue *float64              // source-value, else nil
+	slaMs       float64               // sla-ms, 0 if not set
+	limiter     *sqlutil.Limiter      // max-concurrent-queries or NewLagWithLimiter, else nil
+	limitKey    string                // max-concurrent-queries: sqlutil.SharedLimiter key, else ""
+	sources     map[string]pfsSource  // pfs: last source per channel (source_changed), keyed on PFS channel name
+	lastQueued  map[string]string     // pfs: last queued trx per channel, keyed on PFS channel name
+	lastProc    map[string]string     // pfs: last processed trx per channel, keyed on PFS channel name
+	hbFreq      time.Duration         // heartbeat-freq: blip and pt-heartbeat writers only
+	hbAutoFreq  bool                  // heartbeat-freq=auto: blip writer only
+	readIntvl   time.Duration         // read-interval: blip writer only, 0 if not set
+	stale       string                // stale-behavior: blip writer only
+	fresh       map[string]freshRead  // stale-behavior: last fresh heartbeat, keyed on source ID
+	version     string                // include-version: @@version, else ""
+	traceId     bool                  // include-trace-id
+	writeLat    bool                  // heartbeat-write-latency-col: blip writer only
+	writerAlive bool                  // report-writer-alive: blip writer only
+	delayQuery  string                // subtract-configured-delay: SHOW REPLICA|SLAVE STATUS, else ""
+	posQuery    string                // report-pos-backlog: SHOW REPLICA|SLAVE STATUS, else ""
+	filterQuery string                // report-filters: SHOW REPLICA|SLAVE STATUS, else ""
+	fileQuery   string                // report-file-backlog: SHOW REPLICA|SLAVE STATUS, else ""
+	options     map[string]string     // domain options (interpolated) for ActiveConfig
+	last        map[string]lagSample  // keyed on seriesKey
+	errCount    int                   // consecutive Collect errors
+	lastErr     error                 // last Collect error
+	skip        int                   // collections to skip (error backoff)
+}
+
+// lagSample is the last repl.lag.current value reported at a level.
+type lagSample struct {
+	lag float64
+	ts  time.Time
 }
 
 var _ blip.Collector = &Lag{}
+var _ blip.CollectorCost = &Lag{}
+var _ blip.CollectorDynamicHelp = &Lag{}
 
 func NewLag(db *sql.DB) *Lag {
 	return &Lag{
 		db:                          db,
+		openDB:                      openMySQL,
+		Now:                         time.Now,
 		lagWriterIn:                 map[string]string{},
 		dropNoHeartbeat:             map[string]bool{},
 		dropNotAReplica:             map[string]bool{},
 		defaultChannelNameOverrides: map[string]string{},
-		pfsLagLastQueued:            make(map[string]string),
-		pfsLagLastProc:              make(map[string]string),
+		atLevel:                     map[string]*lagLevel{},
+		readers:                     map[string]*readerSet{},
+		prepared:                    map[string]*preparedPlan{},
 	}
 }
 
+// NewLagWithReader returns a Lag collector that uses the given heartbeat reader
+// for the blip writer instead of making a Blip heartbeat reader. The reader is
+// owned by the caller: Lag does not start or stop it, so the caller must start
+// it before Collect and stop it when done. Heartbeat reader options (table,
+// source-id, source-dsn, and so on) are ignored because the reader is already
+// configured. The db is used for everything else, like other writers.
+func NewLagWithReader(db *sql.DB, reader heartbeat.Reader) *Lag {
+	c := NewLag(db)
+	c.reader = reader
+	return c
+}
+
+// NewLagWithLimiter returns a Lag collector that acquires a slot from the given
+// limiter before querying lag (all writers except blip, which reads heartbeats
+// in the background). Share the limiter with other collectors that query the
+// same instance to bound concurrent heavy queries. Option max-concurrent-queries
+// is ignored because the limiter is already configured.
+func NewLagWithLimiter(db *sql.DB, limiter *sqlutil.Limiter) *Lag {
+	c := NewLag(db)
+	c.limiter = limiter
+	return c
+}
+
 func (c *Lag) Domain() string {
 	return DOMAIN
 }
@@ -65,39 +355,229 @@ func (c *Lag) Help() blip.CollectorHelp {
 	return blip.CollectorHelp{
 		Domain:      DOMAIN,
 		Description: "Replication lag",
+		Selector:    OPT_WRITER,
+		Versions: map[string]blip.CollectorVersion{
+			LAG_WRITER_PFS:   {Min: "8.0"}, // replication_applier_status_by_worker.LAST_APPLIED_TRANSACTION_*
+			LAG_WRITER_GROUP: {Min: "8.0"}, // replication_group_member_stats.COUNT_TRANSACTIONS_REMOTE_IN_APPLIER_QUEUE
+		},
 		Options: map[string]blip.CollectorHelpOption{
 			OPT_WRITER: {
 				Name:    OPT_WRITER,
-				Desc:    "How to collect Lag",
+				Desc:    "How to collect Lag; a comma-separated list like pfs,blip uses the first writer and falls back to the next writers, in order, on error",
 				Default: "auto",
+				Values:  writerHelpValues(),
+				List:    true,
+			},
+			OPT_AUTO_WRITERS: {
+				Name:      OPT_AUTO_WRITERS,
+				AppliesTo: []string{"auto"},
+				Desc:      "Comma-separated list of writers that " + OPT_WRITER + "=auto can choose; auto fails if none are available (default: all)",
+				Values: map[string]string{
+					LAG_WRITER_GROUP:    "Group Replication",
+					LAG_WRITER_MARIADB:  "MariaDB",
+					LAG_WRITER_PFS:      "Performance Schema",
+					LAG_WRITER_PROXYSQL: "ProxySQL admin interface",
+					LAG_WRITER_BLIP:     "Blip heartbeat",
+				},
+				List: true,
+			},
+			OPT_ON_DETECT_FAIL: {
+				Name:      OPT_ON_DETECT_FAIL,
+				AppliesTo: []string{"auto"},
+				Desc:      "What to do if " + OPT_WRITER + "=auto cannot detect a writer",
+				Default:   DETECT_FAIL_ERROR,
+				Values: map[string]string{
+					DETECT_FAIL_ERROR:   "Prepare fails, so the monitor doesn't start",
+					DETECT_FAIL_DISABLE: "Log a warning and don't collect repl.lag at the level; other domains are collected",
+				},
+			},
+			OPT_ROLE: {
+				Name:    OPT_ROLE,
+				Desc:    "Replication role of the instance; steers " + OPT_WRITER + "=auto",
+				Default: ROLE_REPLICA,
 				Values: map[string]string{
-					"auto": "Auto-determine best lag writer",
-					"blip": "Native Blip heartbeat replication lag",
-					"pfs":  "Performance Schema",
-					///"legacy": "Second_Behind_Slave|Replica from SHOW SHOW|REPLICA STATUS",
+					ROLE_REPLICA:      "Replica: auto prefers group-replication (if a group member), then pfs, then proxysql, then blip",
+					ROLE_INTERMEDIATE: "Replica that is also a source (relay): auto prefers blip (upstream heartbeat), then pfs",
+					ROLE_SOURCE:       "Source: auto does not detect a writer; reports not a replica",
 				},
 			},
 			OPT_HEARTBEAT_TABLE: {
-				Name:    OPT_HEARTBEAT_TABLE,
-				Desc:    "Heartbeat table",
-				Default: blip.DEFAULT_HEARTBEAT_TABLE,
+				Name:      OPT_HEARTBEAT_TABLE,
+				AppliesTo: []string{LAG_WRITER_BLIP, LAG_WRITER_PT},
+				Desc:      "Heartbeat table",
+				Default:   blip.DEFAULT_HEARTBEAT_TABLE,
 			},
 			OPT_HEARTBEAT_SOURCE_ID: {
-				Name: OPT_HEARTBEAT_SOURCE_ID,
-				Desc: "Source ID as reported by heartbeat writer; mutually exclusive with " + OPT_HEARTBEAT_SOURCE_ROLE,
+				Name:      OPT_HEARTBEAT_SOURCE_ID,
+				AppliesTo: []string{LAG_WRITER_BLIP, LAG_WRITER_PT},
+				Desc:      "Source ID as reported by heartbeat writer; mutually exclusive with " + OPT_HEARTBEAT_SOURCE_ROLE,
+				Group:     "source",
 			},
 			OPT_HEARTBEAT_SOURCE_ROLE: {
-				Name: OPT_HEARTBEAT_SOURCE_ROLE,
-				Desc: "Source role as reported by heartbeat writer; mutually exclusive with " + OPT_HEARTBEAT_SOURCE_ID,
+				Name:      OPT_HEARTBEAT_SOURCE_ROLE,
+				AppliesTo: []string{LAG_WRITER_BLIP},
+				Desc:      "Source role as reported by heartbeat writer, or a comma-separated list of roles to report lag per role with meta source_role; mutually exclusive with " + OPT_HEARTBEAT_SOURCE_ID,
+				Group:     "source",
+			},
+			OPT_HEARTBEAT_TAG: {
+				Name:      OPT_HEARTBEAT_TAG,
+				AppliesTo: []string{LAG_WRITER_BLIP},
+				Desc:      "Read only heartbeats with this value in column tag (for multiple logical heartbeats in one table)",
+			},
+			OPT_HEARTBEAT_KEY: {
+				Name:      OPT_HEARTBEAT_KEY,
+				AppliesTo: []string{LAG_WRITER_BLIP},
+				Desc:      "Comma-separated column=value pairs to select the heartbeat row in tables with a composite primary key, like shard=3",
+			},
+			OPT_HEARTBEAT_TS_FORMAT: {
+				Name:      OPT_HEARTBEAT_TS_FORMAT,
+				AppliesTo: []string{LAG_WRITER_BLIP},
+				Desc:      "Format of heartbeat column ts",
+				Default:   heartbeat.TS_FORMAT_DATETIME,
+				Values: map[string]string{
+					heartbeat.TS_FORMAT_DATETIME: "DATETIME or TIMESTAMP",
+					heartbeat.TS_FORMAT_EPOCH_MS: "BIGINT Unix epoch milliseconds",
+					heartbeat.TS_FORMAT_EPOCH_US: "BIGINT Unix epoch microseconds",
+				},
+			},
+			OPT_HEARTBEAT_WRITE_LAT: {
+				Name:      OPT_HEARTBEAT_WRITE_LAT,
+				AppliesTo: []string{LAG_WRITER_BLIP},
+				Desc:      "Heartbeat table column with source write latency (milliseconds) to report as repl.lag.source_write_latency",
+			},
+			OPT_HEARTBEAT_APPLIED_TS: {
+				Name:      OPT_HEARTBEAT_APPLIED_TS,
+				AppliesTo: []string{LAG_WRITER_BLIP},
+				Desc:      "Heartbeat table column with the time the heartbeat was applied on the replica (same format as ts) to measure lag from instead of ts",
+			},
+			OPT_HEARTBEAT_SEQ_COL: {
+				Name:      OPT_HEARTBEAT_SEQ_COL,
+				AppliesTo: []string{LAG_WRITER_BLIP},
+				Desc:      "Heartbeat table column with a sequence number incremented on each heartbeat write; lag is (source seq - replica seq) * freq, which doesn't depend on clocks (requires " + OPT_HEARTBEAT_SEQ_DSN + ")",
+			},
+			OPT_HEARTBEAT_SEQ_DSN: {
+				Name:      OPT_HEARTBEAT_SEQ_DSN,
+				AppliesTo: []string{LAG_WRITER_BLIP},
+				Desc:      "DSN of the source MySQL instance from which to read the latest heartbeat sequence number (" + OPT_HEARTBEAT_SEQ_COL + ")",
+				Sensitive: true,
+			},
+			OPT_REPORT_RESTARTS: {
+				Name:      OPT_REPORT_RESTARTS,
+				AppliesTo: []string{LAG_WRITER_BLIP},
+				Desc:      "Report how many times the Blip heartbeat reader restarted after consecutive read errors",
+				Default:   "no",
+				Values: map[string]string{
+					"yes": "Enabled: report repl.lag.reader_restarts",
+					"no":  "Disabled: do not report repl.lag.reader_restarts",
+				},
+			},
+			OPT_REQUIRE_HEARTBEAT: {
+				Name:      OPT_REQUIRE_HEARTBEAT,
+				AppliesTo: []string{LAG_WRITER_BLIP},
+				Desc:      "Fail Prepare if there is no heartbeat or it is not advancing (writer=blip)",
+				Default:   "no",
+				Values: map[string]string{
+					"yes": "Enabled: Prepare reads the heartbeat and fails unless it exists and advances",
+					"no":  "Disabled: no heartbeat is dropped or reported at runtime (report-no-heartbeat)",
+				},
+			},
+			OPT_SUBTRACT_DELAY: {
+				Name:      OPT_SUBTRACT_DELAY,
+				AppliesTo: []string{LAG_WRITER_BLIP, LAG_WRITER_PT, LAG_WRITER_PFS},
+				Desc:      "Subtract intentional replica delay (SQL_Delay) from lag so that lag is only unintended lag (writer=blip, pt-heartbeat, or pfs)",
+				Default:   "no",
+				Values: map[string]string{
+					"yes": "Enabled: subtract SQL_Delay from repl.lag.current",
+					"no":  "Disabled: report lag including SQL_Delay",
+				},
+			},
+			OPT_CONSISTENT_READ: {
+				Name:      OPT_CONSISTENT_READ,
+				AppliesTo: []string{LAG_WRITER_BLIP},
+				Desc:      "Read the Blip heartbeat with a locking read (LOCK IN SHARE MODE) to read the latest committed row, not a stale snapshot",
+				Default:   "no",
+				Values: map[string]string{
+					"yes": "Enabled: locking read",
+					"no":  "Disabled: consistent (snapshot) read",
+				},
+			},
+			OPT_HEARTBEAT_FREQ: {
+				Name:      OPT_HEARTBEAT_FREQ,
+				AppliesTo: []string{LAG_WRITER_BLIP, LAG_WRITER_PT},
+				Desc:      "Heartbeat write frequency (Go duration, or auto to estimate it from heartbeat reads); up to this amount is subtracted from lag to remove the sawtooth floor (writer=blip or pt-heartbeat; auto: writer=blip)",
+			},
+			OPT_READ_INTERVAL: {
+				Name:      OPT_READ_INTERVAL,
+				AppliesTo: []string{LAG_WRITER_BLIP},
+				Desc:      "Minimum interval (Go duration) between heartbeat table reads; between reads, the last lag is reported (writer=blip)",
+			},
+			OPT_STALE_BEHAVIOR: {
+				Name:      OPT_STALE_BEHAVIOR,
+				AppliesTo: []string{LAG_WRITER_BLIP},
+				Desc:      "How to report lag when no new heartbeat was read since the last collection (writer=blip)",
+				Default:   STALE_HOLD,
+				Values: map[string]string{
+					STALE_HOLD:   "Report the last lag with meta stale=true",
+					STALE_GROW:   "Report the last lag plus time since the heartbeat was read, with meta stale=true",
+					STALE_ABSENT: "Report no heartbeat (absent value or dropped)",
+				},
+			},
+			OPT_PT_TS_COLUMN: {
+				Name:      OPT_PT_TS_COLUMN,
+				AppliesTo: []string{LAG_WRITER_PT},
+				Desc:      "pt-heartbeat timestamp column",
+				Default:   DEFAULT_PT_TS_COLUMN,
+			},
+			OPT_PT_SERVER_ID_COLUMN: {
+				Name:      OPT_PT_SERVER_ID_COLUMN,
+				AppliesTo: []string{LAG_WRITER_PT},
+				Desc:      "pt-heartbeat server ID column (" + OPT_HEARTBEAT_SOURCE_ID + " is matched against this column)",
+				Default:   DEFAULT_PT_SERVER_ID_COL,
+			},
+			OPT_PT_UTC: {
+				Name:      OPT_PT_UTC,
+				AppliesTo: []string{LAG_WRITER_PT},
+				Desc:      "pt-heartbeat writes UTC timestamps (pt-heartbeat --utc)",
+				Default:   "no",
+				Values: map[string]string{
+					"yes": "Enabled: lag = UTC_TIMESTAMP() - ts",
+					"no":  "Disabled: lag = NOW() - ts",
+				},
+			},
+			OPT_LAG_PROC: {
+				Name:      OPT_LAG_PROC,
+				AppliesTo: []string{LAG_WRITER_PROC},
+				Desc:      "Stored procedure (proc or db.proc) to CALL to read lag; required for " + OPT_WRITER + "=" + LAG_WRITER_PROC,
+			},
+			OPT_LAG_PROC_COLUMN: {
+				Name:      OPT_LAG_PROC_COLUMN,
+				AppliesTo: []string{LAG_WRITER_PROC},
+				Desc:      "Comma-separated list of lag columns in the " + OPT_LAG_PROC + " result sets; the first column found is used (case-insensitive)",
+				Default:   DEFAULT_LAG_PROC_COLUMN,
+			},
+			OPT_LAG_PROC_UNIT: {
+				Name:      OPT_LAG_PROC_UNIT,
+				AppliesTo: []string{LAG_WRITER_PROC},
+				Desc:      "Unit of the " + OPT_LAG_PROC + " lag column",
+				Default:   UNIT_S,
+				Values: map[string]string{
+					UNIT_S:  "Seconds (like Seconds_Behind_Source)",
+					UNIT_MS: "Milliseconds",
+				},
 			},
 			OPT_REPL_CHECK: {
 				Name: OPT_REPL_CHECK,
-				Desc: "MySQL global variable (without @@) to check if instance is a replica",
+				Desc: "Comma-separated MySQL global variables (without @@) to check if instance is a replica (all must be true)",
+			},
+			OPT_COLLECT_WHEN: {
+				Name: OPT_COLLECT_WHEN,
+				Desc: "MySQL global variable (@@var or var) or user variable (@var) that must be true (ON, TRUE, YES, or nonzero) to collect lag",
 			},
 			OPT_REPORT_NO_HEARTBEAT: {
-				Name:    OPT_REPORT_NO_HEARTBEAT,
-				Desc:    "Report no heartbeat as -1",
-				Default: "no",
+				Name:      OPT_REPORT_NO_HEARTBEAT,
+				AppliesTo: []string{LAG_WRITER_BLIP, LAG_WRITER_PT, LAG_WRITER_PROXYSQL, LAG_WRITER_GROUP, LAG_WRITER_PROC, LAG_WRITER_MARIADB},
+				Desc:      "Report no heartbeat as -1",
+				Default:   "no",
 				Values: map[string]string{
 					"yes": "Enabled: report no heartbeat as repl.lag.current = -1",
 					"no":  "Disabled: drop repl.lag.current if no heartbeat",
@@ -112,21 +592,415 @@ func (c *Lag) Help() blip.CollectorHelp {
 					"no":  "Disabled: drop repl.lag.current if not a replica",
 				},
 			},
+			OPT_CHANNEL: {
+				Name:      OPT_CHANNEL,
+				AppliesTo: []string{LAG_WRITER_PFS, LAG_WRITER_MARIADB},
+				Desc:      "Collect lag only for this replication channel (pfs and mariadb writers only; default: all channels)",
+			},
 			OPT_DEFAULT_CHANNEL_NAME: {
-				Name: OPT_DEFAULT_CHANNEL_NAME,
-				Desc: "Rename default replication channel name (MySQL is default an empty string)",
+				Name:      OPT_DEFAULT_CHANNEL_NAME,
+				AppliesTo: []string{LAG_WRITER_PFS, LAG_WRITER_MARIADB},
+				Desc:      "Rename default replication channel name (MySQL is default an empty string)",
+			},
+			OPT_CHANNEL_RENAME: {
+				Name:      OPT_CHANNEL_RENAME,
+				AppliesTo: []string{LAG_WRITER_PFS},
+				Desc:      "Rename replication channels: semicolon-separated pattern=>replacement rules (Go regex; replacement can use $1), first match wins",
+			},
+			OPT_NOW_PRECISION: {
+				Name:      OPT_NOW_PRECISION,
+				AppliesTo: []string{LAG_WRITER_PFS},
+				Desc:      "Fractional-second precision (0-6) of NOW() in Performance Schema lag queries",
+				Default:   "6",
+			},
+			OPT_META_ALLOWLIST: {
+				Name: OPT_META_ALLOWLIST,
+				Desc: "Comma-separated list of Meta keys to report; other keys are removed (default: all keys)",
+			},
+			OPT_WARMUP: {
+				Name:      OPT_WARMUP,
+				AppliesTo: []string{LAG_WRITER_BLIP},
+				Desc:      "Maximum time (Go duration) after Prepare to not report lag from a Blip heartbeat reader until it has read a heartbeat",
+			},
+			OPT_UNIT: {
+				Name:    OPT_UNIT,
+				Desc:    "Unit of repl.lag.current; absent values (-1 and NaN) are not converted",
+				Default: UNIT_MS,
+				Values: map[string]string{
+					UNIT_MS: "Milliseconds",
+					UNIT_S:  "Seconds (float), with meta unit=s",
+				},
+			},
+			OPT_SINK_UNIT: {
+				Name:    OPT_SINK_UNIT,
+				Desc:    "Use the unit preferred by the monitor sinks (like seconds for Prometheus) instead of " + OPT_UNIT,
+				Default: "no",
+				Values: map[string]string{
+					"auto": "Use the sink unit; if the sinks don't prefer a unit (or prefer different units), use " + OPT_UNIT,
+					"no":   "Use " + OPT_UNIT,
+				},
+			},
+			OPT_REPORT_FILTERS: {
+				Name:    OPT_REPORT_FILTERS,
+				Desc:    "Report whether replication filters (like Replicate_Do_DB) are configured, from SHOW REPLICA STATUS, because filters change what lag means",
+				Default: "no",
+				Values: map[string]string{
+					"yes": "Enabled: report repl.lag.filters_present",
+					"no":  "Disabled: do not report repl.lag.filters_present",
+				},
+			},
+			OPT_REPORT_FILE_BACKLOG: {
+				Name:    OPT_REPORT_FILE_BACKLOG,
+				Desc:    "Report number of source binary log files received but not executed, from SHOW REPLICA STATUS (coarse catch-up indicator)",
+				Default: "no",
+				Values: map[string]string{
+					"yes": "Enabled: report repl.lag.file_backlog",
+					"no":  "Disabled: do not report repl.lag.file_backlog",
+				},
+			},
+			OPT_REPORT_WRITER_ALIVE: {
+				Name:      OPT_REPORT_WRITER_ALIVE,
+				AppliesTo: []string{LAG_WRITER_BLIP},
+				Desc:      "Report whether the source heartbeat writer is alive: the heartbeat timestamp changed since the last collection",
+				Default:   "no",
+				Values: map[string]string{
+					"yes": "Enabled: report repl.lag.writer_alive",
+					"no":  "Disabled: do not report repl.lag.writer_alive",
+				},
+			},
+			OPT_REPORT_POS_BACKLOG: {
+				Name:    OPT_REPORT_POS_BACKLOG,
+				Desc:    "Report bytes of source binary log received but not executed, from SHOW REPLICA STATUS (for replicas without GTIDs or a heartbeat)",
+				Default: "no",
+				Values: map[string]string{
+					"yes": "Enabled: report repl.lag.pos_backlog",
+					"no":  "Disabled: do not report repl.lag.pos_backlog",
+				},
+			},
+			OPT_SOURCE_VALUE: {
+				Name: OPT_SOURCE_VALUE,
+				Desc: "Value of repl.lag.current (with meta role=source) if not a replica, instead of dropping it or the absent value; overrides " + OPT_REPORT_NOT_A_REPLICA + " and " + OPT_ABSENT_VALUE,
 			},
 			OPT_NETWORK_LATENCY: {
-				Name:    OPT_NETWORK_LATENCY,
-				Desc:    "Network latency (milliseconds)",
-				Default: "50",
+				Name:      OPT_NETWORK_LATENCY,
+				AppliesTo: []string{LAG_WRITER_BLIP},
+				Desc:      "Network latency (milliseconds)",
+				Default:   "50",
+			},
+			OPT_SOURCE_LATENCY: {
+				Name:      OPT_SOURCE_LATENCY,
+				AppliesTo: []string{LAG_WRITER_BLIP},
+				Desc:      "Network latency (milliseconds) per source ID: comma-separated source-id:ms (default: " + OPT_NETWORK_LATENCY + ")",
+			},
+			OPT_SOURCE_DSN: {
+				Name:      OPT_SOURCE_DSN,
+				AppliesTo: []string{LAG_WRITER_BLIP},
+				Desc:      "DSN of MySQL instance from which to read heartbeats (default: monitor connection)",
+				Sensitive: true,
+			},
+			OPT_PFS_DSN: {
+				Name:      OPT_PFS_DSN,
+				Desc:      "DSN for a separate connection pool (1 connection) for Performance Schema queries (default: monitor connection)",
+				Sensitive: true,
+			},
+			OPT_ABSENT_VALUE: {
+				Name: OPT_ABSENT_VALUE,
+				Desc: "Value of repl.lag.current if no heartbeat or not a replica; overrides " + OPT_REPORT_NO_HEARTBEAT + " and " + OPT_REPORT_NOT_A_REPLICA,
+				Values: map[string]string{
+					ABSENT_VALUE_NEG_1: "Report -1",
+					ABSENT_VALUE_NAN:   "Report NaN",
+					ABSENT_VALUE_DROP:  "Drop repl.lag.current",
+				},
+			},
+			OPT_ROUND: {
+				Name:    OPT_ROUND,
+				Desc:    "How to round repl.lag.current",
+				Default: ROUND_NONE,
+				Values: map[string]string{
+					ROUND_NONE:    "Do not round",
+					ROUND_FLOOR:   "Round down",
+					ROUND_CEIL:    "Round up",
+					ROUND_NEAREST: "Round to nearest, half away from zero",
+				},
+			},
+			OPT_SKIP_ZERO: {
+				Name:    OPT_SKIP_ZERO,
+				Desc:    "Drop repl.lag.current if zero",
+				Default: "no",
+				Values: map[string]string{
+					"yes": "Enabled: drop repl.lag.current = 0 (gaps in series)",
+					"no":  "Disabled: report repl.lag.current = 0",
+				},
+			},
+			OPT_CROSS_CHECK: {
+				Name:      OPT_CROSS_CHECK,
+				AppliesTo: []string{LAG_WRITER_BLIP},
+				Desc:      "Cross-check Blip heartbeat lag with Performance Schema lag (writer=blip only)",
+				Default:   "no",
+				Values: map[string]string{
+					"yes": "Enabled: report repl.lag.disagreement",
+					"no":  "Disabled: do not report repl.lag.disagreement",
+				},
+			},
+			OPT_REPORT_OLDEST: {
+				Name:      OPT_REPORT_OLDEST,
+				AppliesTo: []string{LAG_WRITER_PFS},
+				Desc:      "Report age of the oldest transaction not yet applied, which shows head-of-line blocking (writer=pfs only)",
+				Default:   "no",
+				Values: map[string]string{
+					"yes": "Enabled: report repl.lag.oldest_unapplied",
+					"no":  "Disabled: do not report repl.lag.oldest_unapplied",
+				},
+			},
+			OPT_REPORT_PARALLELISM: {
+				Name:      OPT_REPORT_PARALLELISM,
+				AppliesTo: []string{LAG_WRITER_PFS},
+				Desc:      "Report number of workers applying or that applied a transaction since the last collection (writer=pfs only)",
+				Default:   "no",
+				Values: map[string]string{
+					"yes": "Enabled: report repl.lag.parallel_workers_active",
+					"no":  "Disabled: do not report repl.lag.parallel_workers_active",
+				},
+			},
+			OPT_REPORT_APPLY_RATE: {
+				Name:      OPT_REPORT_APPLY_RATE,
+				AppliesTo: []string{LAG_WRITER_PFS},
+				Desc:      "Report transactions applied per second since the last collection (writer=pfs only)",
+				Default:   "no",
+				Values: map[string]string{
+					"yes": "Enabled: report repl.lag.apply_rate",
+					"no":  "Disabled: do not report repl.lag.apply_rate",
+				},
+			},
+			OPT_REPORT_WORKER_DIST: {
+				Name:      OPT_REPORT_WORKER_DIST,
+				AppliesTo: []string{LAG_WRITER_PFS},
+				Desc:      "Report min, median, and max last applied latency across workers (writer=pfs only)",
+				Default:   "no",
+				Values: map[string]string{
+					"yes": "Enabled: report repl.lag.worker_min, worker_p50, and worker_max",
+					"no":  "Disabled: do not report worker latency distribution",
+				},
+			},
+			OPT_EMIT_TIMESTAMP: {
+				Name:      OPT_EMIT_TIMESTAMP,
+				AppliesTo: []string{LAG_WRITER_PFS},
+				Desc:      "Report when the last transaction was applied (writer=pfs only)",
+				Default:   "no",
+				Values: map[string]string{
+					"yes": "Enabled: report repl.lag.applied_at",
+					"no":  "Disabled: do not report repl.lag.applied_at",
+				},
+			},
+			OPT_DEBUG_COMPONENTS: {
+				Name:      OPT_DEBUG_COMPONENTS,
+				AppliesTo: []string{LAG_WRITER_PFS},
+				Desc:      "Report lag components in repl.lag.current Meta for debugging (writer=pfs only)",
+				Default:   "no",
+				Values: map[string]string{
+					"yes": "Enabled: Meta applier_latency_ms, queue_latency_ms, and queue_status",
+					"no":  "Disabled: no lag components in Meta",
+				},
+			},
+			OPT_COMPARE_WRITERS: {
+				Name: OPT_COMPARE_WRITERS,
+				Desc: "Also collect lag from this writer and report it as repl.lag.secondary, with meta writer on current and secondary, to compare writers",
+				Values: map[string]string{
+					LAG_WRITER_PFS:  "Performance Schema",
+					LAG_WRITER_BLIP: "Blip heartbeat",
+					LAG_WRITER_PT:   "pt-heartbeat",
+				},
+			},
+			OPT_RETRIES: {
+				Name:    OPT_RETRIES,
+				Desc:    "Number of times to retry transient errors (like deadlock or lost connection) in one collection",
+				Default: "0",
+			},
+			OPT_REFRESH_INTERVAL: {
+				Name: OPT_REFRESH_INTERVAL,
+				Desc: "Minimum interval (Go duration) between lag queries; between queries, the last lag is reported with meta stale_ms (for sub-second level frequencies)",
+			},
+			OPT_MAX_SERIES: {
+				Name: OPT_MAX_SERIES,
+				Desc: "Maximum number of repl.lag.current series (channels or sources) to report, keeping the greatest lag; the number dropped is reported as repl.lag.series_overflow",
+			},
+			OPT_DEBOUNCE_COUNT: {
+				Name: OPT_DEBOUNCE_COUNT,
+				Desc: "Report repl.lag.current above " + OPT_DEBOUNCE_THRESHOLD + " only after this many consecutive collections above it",
+			},
+			OPT_DEBOUNCE_THRESHOLD: {
+				Name: OPT_DEBOUNCE_THRESHOLD,
+				Desc: "Lag (milliseconds) above which values are debounced (required with " + OPT_DEBOUNCE_COUNT + ")",
+			},
+			OPT_MAX_CONCURRENT: {
+				Name: OPT_MAX_CONCURRENT,
+				Desc: "Maximum number of concurrent lag queries on the monitored instance, shared with other collectors that use the monitor limiter (sqlutil.SharedLimiter); blip writer not limited",
+			},
+			OPT_LOG_SCALE: {
+				Name:    OPT_LOG_SCALE,
+				Desc:    "Also report lag on a log scale for wide lag ranges (milliseconds to hours), to alert on order-of-magnitude changes",
+				Default: "no",
+				Values: map[string]string{
+					"yes": "Enabled: report repl.lag.log2 = log2(current+1)",
+					"no":  "Disabled: do not report repl.lag.log2",
+				},
+			},
+			OPT_SLA_MS: {
+				Name: OPT_SLA_MS,
+				Desc: "Lag freshness SLA (milliseconds); if set, report repl.lag.sla_remaining and repl.lag.sla_breached",
+			},
+			OPT_DIAG_DUMP: {
+				Name:    OPT_DIAG_DUMP,
+				Desc:    "Dump replication status once (rate-limited) when lag jumps repeatedly, like oscillating between 0 and huge values",
+				Default: "no",
+				Values: map[string]string{
+					"yes": "Enabled: log status rows and report repl.lag.diagnostic_dump on anomaly",
+					"no":  "Disabled",
+				},
+			},
+			OPT_DIAG_DUMP_THRESHOLD: {
+				Name:    OPT_DIAG_DUMP_THRESHOLD,
+				Desc:    "Lag change (milliseconds) between collections that is a jump for " + OPT_DIAG_DUMP,
+				Default: DEFAULT_DIAGNOSTIC_DUMP_THRESHOLD,
+			},
+			OPT_DIAG_DUMP_INTERVAL: {
+				Name:    OPT_DIAG_DUMP_INTERVAL,
+				Desc:    "Minimum interval (Go duration) between diagnostic dumps",
+				Default: DEFAULT_DIAGNOSTIC_DUMP_INTERVAL,
+			},
+			OPT_WINDOW: {
+				Name: OPT_WINDOW,
+				Desc: "Report repl.lag.current as a percentile over a rolling window (duration string like 1m)",
+			},
+			OPT_PERCENTILE: {
+				Name:    OPT_PERCENTILE,
+				Desc:    "Percentile of lag over " + OPT_WINDOW + " (greater than 0 and less than or equal to 100)",
+				Default: "95",
+			},
+			OPT_INCLUDE_IDENTITY: {
+				Name:    OPT_INCLUDE_IDENTITY,
+				Desc:    "Include monitor ID and plan name in meta",
+				Default: "no",
+				Values: map[string]string{
+					"yes": "Enabled: add meta monitor_id and plan to all metrics",
+					"no":  "Disabled: do not add identity meta",
+				},
+			},
+			OPT_INCLUDE_LEVEL: {
+				Name:    OPT_INCLUDE_LEVEL,
+				Desc:    "Include plan and level name in meta, to know which level reported a metric when the domain is collected at several levels",
+				Default: "no",
+				Values: map[string]string{
+					"yes": "Enabled: add meta plan and level to all metrics",
+					"no":  "Disabled: do not add level meta",
+				},
+			},
+			OPT_INCLUDE_VERSION: {
+				Name:    OPT_INCLUDE_VERSION,
+				Desc:    "Include MySQL version (@@version, queried once when the plan is prepared) in meta on current",
+				Default: "no",
+				Values: map[string]string{
+					"yes": "Enabled: add meta mysql_version to repl.lag.current",
+					"no":  "Disabled: do not add version meta",
+				},
+			},
+			OPT_INCLUDE_TRACE_ID: {
+				Name:    OPT_INCLUDE_TRACE_ID,
+				Desc:    "Include the trace ID from the Collect context (blip.WithTraceId), if set, in meta on current; high cardinality: exclude it from sink tags",
+				Default: "no",
+				Values: map[string]string{
+					"yes": "Enabled: add meta trace_id to repl.lag.current",
+					"no":  "Disabled: do not add trace ID meta",
+				},
+			},
+			OPT_REPORT_DB_STATS: {
+				Name:    OPT_REPORT_DB_STATS,
+				Desc:    "Report connection pool stats of the DB from which lag is read",
+				Default: "no",
+				Values: map[string]string{
+					"yes": "Enabled: report repl.lag.db_open_connections, db_in_use, and db_wait_count",
+					"no":  "Disabled: do not report DB stats",
+				},
+			},
+			OPT_REPORT_COLLECT_AGE: {
+				Name:    OPT_REPORT_COLLECT_AGE,
+				Desc:    "Report time since last successful collection",
+				Default: "no",
+				Values: map[string]string{
+					"yes": "Enabled: report repl.lag.last_collect_age",
+					"no":  "Disabled: do not report repl.lag.last_collect_age",
+				},
+			},
+			OPT_REPORT_UP: {
+				Name:    OPT_REPORT_UP,
+				Desc:    "Report repl.lag.up = 1 every collection, even if no other metrics are reported",
+				Default: "no",
+				Values: map[string]string{
+					"yes": "Enabled: report repl.lag.up",
+					"no":  "Disabled: do not report repl.lag.up",
+				},
+			},
+			OPT_REPORT_QUERY_DURATION: {
+				Name:    OPT_REPORT_QUERY_DURATION,
+				Desc:    "Report how long it took to read lag from the writer",
+				Default: "no",
+				Values: map[string]string{
+					"yes": "Enabled: report repl.lag.query_duration_ms",
+					"no":  "Disabled: do not report repl.lag.query_duration_ms",
+				},
+			},
+			OPT_CLOCK_OFFSET: {
+				Name:    OPT_CLOCK_OFFSET,
+				Desc:    "Milliseconds the replica clock is ahead of the source clock (negative if behind); subtracted from lag (not applied to writer=proxysql)",
+				Default: "0",
+			},
+			OPT_REPORT_AGGREGATE: {
+				Name:    OPT_REPORT_AGGREGATE,
+				Desc:    "Also report repl.lag.current aggregated across all series (channels, sources, or backends) with meta channel=" + AGGREGATE_CHANNEL,
+				Default: "no",
+				Values: map[string]string{
+					"no":          "Disabled: report only per-series repl.lag.current",
+					"yes":         "Same as max",
+					AGGREGATE_MAX: "Maximum lag across series: the worst series, for alerting when any series lags",
+					AGGREGATE_MIN: "Minimum lag across series: the best series, for fan-in when any fresh series is good enough",
+					AGGREGATE_SUM: "Sum of lag across series: total lag, for capacity trends",
+					AGGREGATE_AVG: "Average lag across series: typical lag, for dashboards",
+				},
+			},
+			OPT_CLAMP_NEGATIVE: {
+				Name:    OPT_CLAMP_NEGATIVE,
+				Desc:    "Report negative lag (clock skew) as zero",
+				Default: "no",
+				Values: map[string]string{
+					"yes": "Enabled: report negative lag as 0 with meta raw_lag_ms",
+					"no":  "Disabled: report negative lag as-is",
+				},
+			},
+			OPT_REPORT_WRITER: {
+				Name:    OPT_REPORT_WRITER,
+				Desc:    "Report which writer is used, especially for " + OPT_WRITER + "=auto",
+				Default: "no",
+				Values: map[string]string{
+					"yes": "Enabled: report repl.lag.writer",
+					"no":  "Disabled: do not report repl.lag.writer",
+				},
+			},
+			OPT_REPORT_TREND: {
+				Name:    OPT_REPORT_TREND,
+				Desc:    "Report lag trend",
+				Default: "no",
+				Values: map[string]string{
+					"yes": "Enabled: report repl.lag.trend",
+					"no":  "Disabled: do not report repl.lag.trend",
+				},
 			},
 		},
 		Metrics: []blip.CollectorMetric{
 			{
 				Name: "current",
 				Type: blip.GAUGE,
-				Desc: "Current replication lag (milliseconds)",
+				Desc: "Current replication lag (milliseconds, or seconds if unit=s)",
+				Unit: "ms",
 			},
 			{
 				Name: "backlog",
@@ -138,157 +1012,2120 @@ func (c *Lag) Help() blip.CollectorHelp {
 				Type: blip.GAUGE,
 				Desc: "Replication worker usage (percentage)",
 			},
-		},
-	}
-}
-
-// Prepare prepares one lag collector for all levels in the plan. Lag can
-// (and probably will be) collected at multiple levels, but this domain can
-// be configured at only one level. For example, it's not possible to collect
-// lag from a Blip heartbeat and from Performance Schema. And since this
-// domain collects only one metric (repl.lag.current), there's no need to
-// collect different metrics at different frequencies.
-func (c *Lag) Prepare(ctx context.Context, plan blip.Plan) (func(), error) {
-	configured := ""   // set after first level to its writer value
-	var cleanup func() // Blip heartbeat reader func, else nil
-	var err error
-
-LEVEL:
-	for levelName, level := range plan.Levels {
-		dom, ok := level.Collect[DOMAIN]
-		if !ok {
-			continue LEVEL // not collected in this level
-		}
-
-		writer := dom.Options[OPT_WRITER]
-
-		// Already configured? If yes and same writer, that's ok and expected
-		// (lag collected at multiple levels). But if writer is different, that's
-		// and error.
-		if configured != "" {
-			if configured != writer {
-				return nil, fmt.Errorf("different writer configuration: %s != %s", configured, writer)
-			}
-			c.lagWriterIn[levelName] = writer // collect at this level
-			continue LEVEL
-		}
-
-		blip.Debug("repl.lag: config from level %s", levelName)
-		switch writer {
-		case LAG_WRITER_PFS:
-			// Try collecting, discard metrics
-			if _, err = c.collectPFS(ctx, levelName); err != nil {
-				return nil, err
-			}
-		case LAG_WRITER_BLIP:
-			cleanup, err = c.prepareBlip(levelName, plan.MonitorId, plan.Name, dom.Options)
-			if err != nil {
-				return nil, err
-			}
-		case "auto", "": // default
-			// Try PFS first
-			if _, err = c.collectPFS(ctx, levelName); err == nil {
-				blip.Debug("repl.lag auto-detected PFS")
-				writer = LAG_WRITER_PFS
-			} else {
-				// then Blip HeartBeat
-				if cleanup, err = c.prepareBlip(levelName, plan.MonitorId, plan.Name, dom.Options); err == nil {
-					blip.Debug("repl.lag auto-detected Blip heartbeat")
-					writer = LAG_WRITER_BLIP
-				} else {
-					return nil, fmt.Errorf("failed to auto-detect source, set %s manually", OPT_WRITER)
-				}
-			}
-		default:
-			return nil, fmt.Errorf("invalid lag writer: %q; valid values: auto, pfs, blip", writer)
-		}
-
-		c.lagWriterIn[levelName] = writer // collect at this level
-
-		c.dropNotAReplica[levelName] = !blip.Bool(dom.Options[OPT_REPORT_NOT_A_REPLICA])
-		c.defaultChannelNameOverrides[levelName] = dom.Options[OPT_DEFAULT_CHANNEL_NAME]
-		c.replCheck = sqlutil.CleanObjectName(dom.Options[OPT_REPL_CHECK]) // @todo sanitize better
-	}
-
-	return cleanup, nil
+			{
+				Name: "trend",
+				Type: blip.GAUGE,
+				Desc: "Change in replication lag since last collection (milliseconds per second); positive is falling behind",
+				Unit: "ms/s",
+			},
+			{
+				Name: "disagreement",
+				Type: blip.GAUGE,
+				Desc: "Absolute difference between Blip heartbeat and Performance Schema lag (milliseconds)",
+				Unit: "ms",
+			},
+			{
+				Name: "applied_at",
+				Type: blip.GAUGE,
+				Desc: "Unix timestamp (milliseconds) when the last transaction was applied (option " + OPT_EMIT_TIMESTAMP + ")",
+				Unit: "ms",
+			},
+			{
+				Name: "oldest_unapplied",
+				Type: blip.GAUGE,
+				Desc: "Age of the oldest transaction being applied or scheduled, or zero if none (option " + OPT_REPORT_OLDEST + ")",
+				Unit: "ms",
+			},
+			{
+				Name: "source_changed",
+				Type: blip.GAUGE,
+				Desc: "1 if the replication source of the channel changed since the last collection (pfs writer only); reported only on change",
+			},
+			{
+				Name: "source_write_latency",
+				Type: blip.GAUGE,
+				Desc: "Source write latency from the heartbeat row (option " + OPT_HEARTBEAT_WRITE_LAT + ")",
+				Unit: "ms",
+			},
+			{
+				Name: "self_heartbeat",
+				Type: blip.GAUGE,
+				Desc: "1 if reading own heartbeat (source ID is the local server_id or monitor ID); current is reported as absent",
+			},
+			{
+				Name: "secondary",
+				Type: blip.GAUGE,
+				Desc: "Current replication lag from the secondary writer (option " + OPT_COMPARE_WRITERS + ")",
+				Unit: "ms",
+			},
+			{
+				Name: "series_overflow",
+				Type: blip.GAUGE,
+				Desc: "Number of repl.lag.current series not reported because of option " + OPT_MAX_SERIES,
+			},
+			{
+				Name: "parallel_workers_active",
+				Type: blip.GAUGE,
+				Desc: "Number of workers applying or that applied a transaction since the last collection (option " + OPT_REPORT_PARALLELISM + ")",
+			},
+			{
+				Name: "pos_backlog",
+				Type: blip.GAUGE,
+				Desc: "Bytes of source binary log received but not executed, or absent if the IO and SQL threads are on different files (option " + OPT_REPORT_POS_BACKLOG + ")",
+				Unit: "bytes",
+			},
+			{
+				Name: "writer_alive",
+				Type: blip.GAUGE,
+				Desc: "1 if the source heartbeat writer is alive (heartbeat timestamp changed since the last collection), else 0 (option " + OPT_REPORT_WRITER_ALIVE + ")",
+			},
+			{
+				Name: "file_backlog",
+				Type: blip.GAUGE,
+				Desc: "Number of source binary log files received but not executed: IO thread file number minus SQL thread file number (option " + OPT_REPORT_FILE_BACKLOG + ")",
+				Unit: "files",
+			},
+			{
+				Name: "filters_present",
+				Type: blip.GAUGE,
+				Desc: "1 if replication filters (like Replicate_Do_DB) are configured on the channel, else 0; the filters are in meta (option " + OPT_REPORT_FILTERS + ")",
+			},
+			{
+				Name: "apply_rate",
+				Type: blip.GAUGE,
+				Desc: "Transactions applied per second since the last collection (option " + OPT_REPORT_APPLY_RATE + ")",
+				Unit: "trx/s",
+			},
+			{
+				Name: "worker_min",
+				Type: blip.GAUGE,
+				Desc: "Minimum last applied latency across workers (option " + OPT_REPORT_WORKER_DIST + ")",
+				Unit: "ms",
+			},
+			{
+				Name: "worker_p50",
+				Type: blip.GAUGE,
+				Desc: "Median last applied latency across workers (option " + OPT_REPORT_WORKER_DIST + ")",
+				Unit: "ms",
+			},
+			{
+				Name: "worker_max",
+				Type: blip.GAUGE,
+				Desc: "Maximum last applied latency across workers (option " + OPT_REPORT_WORKER_DIST + ")",
+				Unit: "ms",
+			},
+			{
+				Name: "query_duration_ms",
+				Type: blip.GAUGE,
+				Desc: "Time to read lag from the writer, including fallback writers and retries (option " + OPT_REPORT_QUERY_DURATION + ")",
+				Unit: "ms",
+			},
+			{
+				Name: "last_collect_age",
+				Type: blip.GAUGE,
+				Desc: "Time since last successful collection at the level, not counting the current one (option " + OPT_REPORT_COLLECT_AGE + ")",
+				Unit: "ms",
+			},
+			{
+				Name: "up",
+				Type: blip.GAUGE,
+				Desc: "Always 1: the collector ran at the level, reported even if lag is dropped, not a replica, or collecting fails (option " + OPT_REPORT_UP + ")",
+			},
+			{
+				Name: "log2",
+				Type: blip.GAUGE,
+				Desc: "log2(current+1) with current in milliseconds: each +1 is double the lag (option " + OPT_LOG_SCALE + ")",
+			},
+			{
+				Name: "sla_remaining",
+				Type: blip.GAUGE,
+				Desc: "Lag SLA budget remaining: sla-ms minus current; negative when the SLA is breached (option " + OPT_SLA_MS + ")",
+				Unit: "ms",
+			},
+			{
+				Name: "sla_breached",
+				Type: blip.GAUGE,
+				Desc: "1 if current is greater than sla-ms, else 0 (option " + OPT_SLA_MS + ")",
+			},
+			{
+				Name: "db_open_connections",
+				Type: blip.GAUGE,
+				Desc: "Open connections in the pool from which lag is read (option " + OPT_REPORT_DB_STATS + ")",
+			},
+			{
+				Name: "db_in_use",
+				Type: blip.GAUGE,
+				Desc: "Connections in use in the pool from which lag is read (option " + OPT_REPORT_DB_STATS + ")",
+			},
+			{
+				Name: "db_wait_count",
+				Type: blip.CUMULATIVE_COUNTER,
+				Desc: "Total number of connections waited for in the pool from which lag is read (option " + OPT_REPORT_DB_STATS + ")",
+			},
+			{
+				Name: "writer",
+				Type: blip.GAUGE,
+				Desc: "Lag writer used: 0=none, 1=pfs, 2=blip, 3=proxysql, 4=pt-heartbeat, 5=group-replication, 6=proc, 7=mariadb, -1=custom (option " + OPT_REPORT_WRITER + ")",
+			},
+			{
+				Name: "reader_restarts",
+				Type: blip.CUMULATIVE_COUNTER,
+				Desc: "Total number of Blip heartbeat reader restarts after consecutive read errors (option " + OPT_REPORT_RESTARTS + ")",
+			},
+			{
+				Name: "diagnostic_dump",
+				Type: blip.GAUGE,
+				Desc: "Number of replication status rows dumped on a lag anomaly (option " + OPT_DIAG_DUMP + ")",
+			},
+		},
+	}
+}
+
+// Prepare prepares one lag collector for all levels in the plan. Lag can
+// (and probably will be) collected at multiple levels, but this domain can
+// be configured at only one level. For example, it's not possible to collect
+// lag from a Blip heartbeat and from Performance Schema. The metrics reported
+// can differ by level: Domain.Metrics selects the metrics at each level (all
+// metrics if empty), like only current at 1s but current and trend at 30s.
+//
+// Prepare is idempotent: it can be called again with the same or a different
+// plan, like on plan reload. The new plan replaces the previous plan, Blip
+// heartbeat readers with the same config are reused, and readers not used by
+// the new plan are stopped. If Prepare fails, the previous plan is kept. The
+// returned cleanup func is never nil on success, and it's safe to call more
+// than once. The cleanup func of a previous plan doesn't stop readers reused
+// by a later plan; the cleanup func of the later plan stops them.
+func (c *Lag) Prepare(ctx context.Context, plan blip.Plan) (func(), error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	prev, monitorId, planName, gen := c.current(), c.monitorId, c.planName, c.gen
+	cleanup, err := c.prepare(ctx, plan)
+	if err != nil {
+		c.activatePlan(prev)
+		c.monitorId, c.planName, c.gen = monitorId, planName, gen
+	}
+	c.stopUnusedReaders()
+	if err != nil {
+		return nil, noDB(err)
+	}
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			c.mu.Lock()
+			defer c.mu.Unlock()
+			if cleanup != nil {
+				cleanup()
+			}
+		})
+	}, nil
+}
+
+// prepare is Prepare with the lock held by the caller: Prepare or PrepareAll.
+func (c *Lag) prepare(ctx context.Context, plan blip.Plan) (func(), error) {
+	configured := ""   // set after first level to its writer value
+	var cleanup func() // Blip heartbeat reader func, else nil
+	version := ""      // include-version: queried once for all levels
+	var err error
+
+	if err = checkDB(c.db); err != nil {
+		return nil, err
+	}
+	// Writers blip and auto might not query MySQL until Collect, so ping to
+	// fail on a closed db now. Other errors (like MySQL is down) are left to
+	// the writer.
+	if err = noDB(c.db.PingContext(ctx)); errors.Is(err, ErrNoDB) {
+		return nil, err
+	}
+
+	// Reset state from previous plan, if any
+	c.atLevel = map[string]*lagLevel{}
+	c.lagWriterIn = map[string]string{}
+	c.dropNoHeartbeat = map[string]bool{}
+	c.dropNotAReplica = map[string]bool{}
+	c.defaultChannelNameOverrides = map[string]string{}
+	c.replCheck = ""
+	c.lagReaders = nil
+	c.gen++
+	c.monitorId = plan.MonitorId
+	c.planName = plan.Name
+
+	// Close pfs-dsn pools opened and release monitor limiters acquired for
+	// this plan if Prepare fails
+	help := c.Help()
+	atLevel := c.atLevel
+	prepared := false
+	defer func() {
+		if !prepared {
+			closePFSDB(atLevel)
+			releaseLimiters(atLevel)
+		}
+	}()
+
+LEVEL:
+	for levelName, level := range plan.Levels {
+		dom, ok := level.Collect[DOMAIN]
+		if !ok {
+			continue LEVEL // not collected in this level
+		}
+		Log.Debug("repl.lag: %s: options: %v", levelName, help.Redact(dom.Options))
+
+		var writer string
+		var fallback []string
+		if writer, fallback, err = writerChain(dom.Options[OPT_WRITER]); err != nil {
+			return nil, err
+		}
+		var onDetectFail string
+		if onDetectFail, err = parseOnDetectFail(dom.Options); err != nil {
+			return nil, err
+		}
+		var l *lagLevel
+		if l, err = c.newLagLevel(ctx, plan, help, levelName, level, dom); err != nil {
+			return nil, err
+		}
+		l.fallback = fallback
+		if blip.Bool(dom.Options[OPT_INCLUDE_VERSION]) {
+			if version == "" {
+				if err = c.db.QueryRowContext(ctx, "SELECT @@version").Scan(&version); err != nil {
+					return nil, fmt.Errorf("%s: cannot query @@version: %w", OPT_INCLUDE_VERSION, err)
+				}
+			}
+			l.version = version
+		}
+		c.atLevel[levelName] = l
+		c.defaultChannelNameOverrides[levelName] = dom.Options[OPT_DEFAULT_CHANNEL_NAME]
+		if c.replCheck, err = parseReplCheck(dom.Options[OPT_REPL_CHECK]); err != nil {
+			return nil, err
+		}
+		if dsn := dom.Options[OPT_PFS_DSN]; dsn != "" {
+			if l.pfsDB, err = c.openDB(dsn); err != nil {
+				return nil, fmt.Errorf("cannot open %s: %s", OPT_PFS_DSN, err)
+			}
+			l.db = l.pfsDB
+			Log.Debug("repl.lag: %s: Performance Schema queries use %s", levelName, OPT_PFS_DSN)
+		}
+
+		// Already configured? If yes and same writer, that's ok and expected
+		// (lag collected at multiple levels). But if writer is different, that's
+		// and error.
+		if configured != "" {
+			if configured != writer {
+				return nil, fmt.Errorf("different writer configuration: %s != %s", configured, writer)
+			}
+			c.lagWriterIn[levelName] = writer // collect at this level
+			l.used = writer
+			continue LEVEL
+		}
+
+		Log.Debug("repl.lag: config from level %s", levelName)
+		auto := writer == "auto" || writer == "" // resolved by autoDetect
+		switch writer {
+		case "auto", "": // default
+			writer, cleanup, err = c.autoDetect(ctx, levelName, plan, dom.Options)
+			if err != nil {
+				if onDetectFail != DETECT_FAIL_DISABLE {
+					return nil, err
+				}
+				Log.Warn("repl.lag: %s: not collecting: %s (%s=%s)", levelName, err, OPT_ON_DETECT_FAIL, DETECT_FAIL_DISABLE)
+				l.disabled = true
+				c.lagWriterIn[levelName] = LAG_WRITER_NONE
+				l.used = LAG_WRITER_NONE
+				continue LEVEL
+			}
+		default:
+			w, ok := lookupWriter(writer)
+			if !ok {
+				return nil, fmt.Errorf("invalid lag writer: %q; valid values: auto, %s", writer, strings.Join(Writers(), ", "))
+			}
+			if cleanup, err = w.Prepare(ctx, c, levelName, plan, dom.Options); err != nil {
+				return nil, err
+			}
+		}
+
+		c.lagWriterIn[levelName] = writer // collect at this level
+		l.used = writer
+
+		if len(l.fallback) > 0 {
+			cleanup = c.prepareFallback(ctx, levelName, plan, dom.Options, cleanup)
+		}
+		c.prepareSelfIds(ctx, levelName, append([]string{writer}, l.fallback...))
+
+		// Options that don't apply to the writers used (writer chain and
+		// compare-writers) are ignored. writer=auto is not checked because
+		// auto tries several writers, which use different options.
+		if !auto {
+			used := append([]string{writer}, l.fallback...)
+			if l.compare != "" {
+				used = append(used, l.compare)
+			}
+			for _, msg := range help.Inapplicable(dom.Options, used...) {
+				Log.Warn("repl.lag: %s: %s", levelName, msg)
+			}
+		}
+
+		if l.crossCheck {
+			if writer != LAG_WRITER_BLIP {
+				l.crossCheck = false
+			} else if err := c.preparePFS(ctx, levelName); err != nil {
+				Log.Warn("repl.lag: %s: %s disabled: cannot collect from Performance Schema: %s", levelName, OPT_CROSS_CHECK, err)
+				l.crossCheck = false
+			}
+		}
+
+		if l.compare != "" {
+			if cleanup, err = c.prepareCompare(ctx, levelName, writer, plan, dom.Options, cleanup); err != nil {
+				return nil, err
+			}
+		}
+
+		if l.pfsDB != nil && writer != LAG_WRITER_PFS && !l.crossCheck && l.compare != LAG_WRITER_PFS {
+			Log.Warn("repl.lag: %s: %s ignored: writer is %s, not pfs", levelName, OPT_PFS_DSN, writer)
+			if l.db == l.pfsDB {
+				l.db = c.db
+			}
+			l.pfsDB.Close()
+			l.pfsDB = nil
+		}
+
+		if l.hbAutoFreq && writer != LAG_WRITER_BLIP {
+			Log.Warn("repl.lag: %s: %s=%s ignored: writer is %s, not blip", levelName, OPT_HEARTBEAT_FREQ, HEARTBEAT_FREQ_AUTO, writer)
+			l.hbAutoFreq = false
+		}
+
+		if blip.Bool(dom.Options[OPT_SUBTRACT_DELAY]) {
+			if err = c.prepareDelay(ctx, levelName, writer); err != nil {
+				return nil, err
+			}
+		}
+
+		if blip.Bool(dom.Options[OPT_REPORT_POS_BACKLOG]) {
+			if err = c.preparePosBacklog(ctx, levelName); err != nil {
+				return nil, err
+			}
+		}
+		if blip.Bool(dom.Options[OPT_REPORT_FILTERS]) {
+			if err = c.prepareFilters(ctx, levelName); err != nil {
+				return nil, err
+			}
+		}
+		if blip.Bool(dom.Options[OPT_REPORT_FILE_BACKLOG]) {
+			if err = c.prepareFileBacklog(ctx, levelName); err != nil {
+				return nil, err
+			}
+		}
+
+		if writer != LAG_WRITER_PFS && !hasWriter(l.fallback, LAG_WRITER_PFS) {
+			// pfs-only options don't apply to pfs collected for cross-check
+			// or compare-writers, which use only current
+			l.emitTs, l.oldest, l.applyRate, l.workerDist, l.components = false, false, false, false, false
+			l.parallel = 0
+		}
+
+		c.dropNotAReplica[levelName] = !reportNotAReplica(dom.Options)
+		if l.absent != "" {
+			// absent-value overrides report-not-a-replica and report-no-heartbeat
+			c.dropNotAReplica[levelName] = l.absent == ABSENT_VALUE_DROP
+			c.dropNoHeartbeat[levelName] = l.absent == ABSENT_VALUE_DROP
+		}
+		if l.sourceValue != nil {
+			c.dropNotAReplica[levelName] = false // source-value overrides both
+		}
+	}
+
+	prepared = true
+	if hasPFSDB(atLevel) || hasLimitKey(atLevel) {
+		readerCleanup := cleanup
+		cleanup = func() {
+			if readerCleanup != nil {
+				readerCleanup()
+			}
+			closePFSDB(atLevel)
+			releaseLimiters(atLevel)
+		}
+	}
+	return cleanup, nil
+}
+
+// newLagLevel returns the config for a level from its options and metrics. It
+// doesn't query MySQL or set up the writer: that's done by prepare. Options
+// that depend on the writer or other levels (like pfs-dsn, repl-check, and
+// include-version) are set by prepare, too.
+func (c *Lag) newLagLevel(ctx context.Context, plan blip.Plan, help blip.CollectorHelp, levelName string, level blip.Level, dom blip.Domain) (*lagLevel, error) {
+	opts := dom.Options
+	l := &lagLevel{
+		lastQueued:  map[string]string{},
+		lastProc:    map[string]string{},
+		reportTrend: blip.Bool(opts[OPT_REPORT_TREND]),
+		skipZero:    blip.Bool(opts[OPT_SKIP_ZERO]),
+		logScale:    blip.Bool(opts[OPT_LOG_SCALE]),
+		clampNeg:    blip.Bool(opts[OPT_CLAMP_NEGATIVE]),
+		crossCheck:  blip.Bool(opts[OPT_CROSS_CHECK]),
+		channel:     opts[OPT_CHANNEL],
+		multiRole:   len(sourceRoles(opts[OPT_HEARTBEAT_SOURCE_ROLE])) > 1,
+		labels:      plan.LevelLabels(levelName),
+		db:          c.db,
+		dbStats:     blip.Bool(opts[OPT_REPORT_DB_STATS]),
+		collectAge:  blip.Bool(opts[OPT_REPORT_COLLECT_AGE]),
+		up:          blip.Bool(opts[OPT_REPORT_UP]),
+		queryDur:    blip.Bool(opts[OPT_REPORT_QUERY_DURATION]),
+		writer:      blip.Bool(opts[OPT_REPORT_WRITER]),
+		emitTs:      blip.Bool(opts[OPT_EMIT_TIMESTAMP]),
+		restarts:    blip.Bool(opts[OPT_REPORT_RESTARTS]),
+		components:  blip.Bool(opts[OPT_DEBUG_COMPONENTS]),
+		oldest:      blip.Bool(opts[OPT_REPORT_OLDEST]),
+		workerDist:  blip.Bool(opts[OPT_REPORT_WORKER_DIST]),
+		applyRate:   blip.Bool(opts[OPT_REPORT_APPLY_RATE]),
+		applied:     map[string]trxSample{},
+		writeLat:    opts[OPT_HEARTBEAT_WRITE_LAT] != "",
+		writerAlive: blip.Bool(opts[OPT_REPORT_WRITER_ALIVE]),
+		fresh:       map[string]freshRead{},
+		metaKeys:    parseMetaAllowlist(opts),
+		metrics:     parseMetrics(help, levelName, dom.Metrics),
+		identity:    levelIdentity(opts, c.monitorId, c.planName, levelName),
+		traceId:     blip.Bool(opts[OPT_INCLUDE_TRACE_ID]),
+		lastCollect: c.Now(),
+		last:        map[string]lagSample{},
+		options:     opts,
+	}
+
+	var err error
+	if _, err = parseRole(opts); err != nil {
+		return nil, err
+	}
+	if l.windowSize, l.percentile, err = parseWindow(opts, level.Freq); err != nil {
+		return nil, err
+	}
+	if l.windowSize > 0 {
+		l.windows = map[string]*lagWindow{}
+	}
+	if l.debounce, err = newDebouncer(opts[OPT_DEBOUNCE_COUNT], opts[OPT_DEBOUNCE_THRESHOLD]); err != nil {
+		return nil, err
+	}
+	if l.dump, err = newDumper(opts[OPT_DIAG_DUMP], opts[OPT_DIAG_DUMP_THRESHOLD], opts[OPT_DIAG_DUMP_INTERVAL]); err != nil {
+		return nil, err
+	}
+	if l.limiter, l.limitKey, err = c.queryLimiter(plan.MonitorId, opts[OPT_MAX_CONCURRENT]); err != nil {
+		return nil, err
+	}
+	if l.slaMs, err = parseSLA(opts[OPT_SLA_MS]); err != nil {
+		return nil, err
+	}
+	if l.retries, err = parseRetries(opts); err != nil {
+		return nil, err
+	}
+	warmup, err := parseWarmup(opts)
+	if err != nil {
+		return nil, err
+	}
+	if warmup > 0 {
+		l.warmupEnd = c.Now().Add(warmup)
+	}
+	if l.refresh, err = parseRefresh(opts); err != nil {
+		return nil, err
+	}
+	precision, err := parseNowPrecision(opts)
+	if err != nil {
+		return nil, err
+	}
+	l.pfsQuery, l.pfsFbQuery = pfsQueries(precision)
+	if l.sourceValue, err = parseSourceValue(opts); err != nil {
+		return nil, err
+	}
+	if l.seconds, err = parseUnit(ctx, levelName, opts); err != nil {
+		return nil, err
+	}
+	if l.rename, err = parseChannelRename(opts[OPT_CHANNEL_RENAME]); err != nil {
+		return nil, err
+	}
+	if l.aggregate, err = parseAggregate(opts[OPT_REPORT_AGGREGATE]); err != nil {
+		return nil, err
+	}
+	if l.maxSeries, err = parseMaxSeries(opts); err != nil {
+		return nil, err
+	}
+	if l.parallel, err = parseParallelism(opts, level.Freq); err != nil {
+		return nil, err
+	}
+	if l.compare, err = parseCompare(opts); err != nil {
+		return nil, err
+	}
+	if _, err = parseTsFormat(opts); err != nil {
+		return nil, err
+	}
+	if l.stale, err = parseStaleBehavior(opts); err != nil {
+		return nil, err
+	}
+	if l.hbFreq, l.hbAutoFreq, err = parseHeartbeatFreq(opts); err != nil {
+		return nil, err
+	}
+	if l.readIntvl, err = parseReadInterval(opts); err != nil {
+		return nil, err
+	}
+	if l.clockOffset, err = parseClockOffset(opts); err != nil {
+		return nil, err
+	}
+	if l.round, err = parseRound(opts); err != nil {
+		return nil, err
+	}
+	if l.absent, l.absentValue, err = parseAbsentValue(opts); err != nil {
+		return nil, err
+	}
+	if l.whenQuery, err = parseCollectWhen(opts[OPT_COLLECT_WHEN]); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// hasPFSDB returns true if any level has a pfs-dsn pool.
+func hasPFSDB(atLevel map[string]*lagLevel) bool {
+	for _, l := range atLevel {
+		if l.pfsDB != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// PrepareAll prepares the collector for several plans up front, then activates
+// the first plan. Use Activate to switch plans without re-preparing. Plans with
+// the same Blip heartbeat reader configuration share the same readers, so
+// switching between them doesn't restart the readers (which causes a gap in lag).
+// The returned cleanup func stops all readers for all plans.
+func (c *Lag) PrepareAll(ctx context.Context, plans ...blip.Plan) (func(), error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	cleanup := func() {
+		for _, rs := range c.readers {
+			rs.cleanup()
+		}
+		c.readers = map[string]*readerSet{}
+		for _, p := range c.prepared {
+			closePFSDB(p.atLevel)
+			releaseLimiters(p.atLevel)
+		}
+	}
+	for _, plan := range plans {
+		if _, err := c.prepare(ctx, plan); err != nil {
+			cleanup()
+			return nil, fmt.Errorf("%s: %s", plan.Name, err)
+		}
+		c.prepared[plan.Name] = c.current()
+	}
+	if len(plans) > 0 {
+		c.activate(plans[0].Name)
+	}
+	return func() {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		cleanup()
+	}, nil
+}
+
+// Activate switches to a plan prepared by PrepareAll. Subsequent calls to
+// Collect use the levels of the plan.
+func (c *Lag) Activate(planName string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.activate(planName)
+}
+
+// activate is Activate with the lock held by the caller: Activate or PrepareAll.
+func (c *Lag) activate(planName string) error {
+	p, ok := c.prepared[planName]
+	if !ok {
+		return fmt.Errorf("plan %s not prepared", planName)
+	}
+	c.activatePlan(p)
+	Log.Debug("repl.lag: activated plan %s", planName)
+	return nil
+}
+
+// current returns the level state of the current plan.
+func (c *Lag) current() *preparedPlan {
+	return &preparedPlan{
+		atLevel:                     c.atLevel,
+		lagWriterIn:                 c.lagWriterIn,
+		dropNoHeartbeat:             c.dropNoHeartbeat,
+		dropNotAReplica:             c.dropNotAReplica,
+		defaultChannelNameOverrides: c.defaultChannelNameOverrides,
+		replCheck:                   c.replCheck,
+		lagReaders:                  c.lagReaders,
+	}
+}
+
+// activatePlan makes the plan level state current.
+func (c *Lag) activatePlan(p *preparedPlan) {
+	c.atLevel = p.atLevel
+	c.lagWriterIn = p.lagWriterIn
+	c.dropNoHeartbeat = p.dropNoHeartbeat
+	c.dropNotAReplica = p.dropNotAReplica
+	c.defaultChannelNameOverrides = p.defaultChannelNameOverrides
+	c.replCheck = p.replCheck
+	c.lagReaders = p.lagReaders
+}
+
+// stopUnusedReaders stops and removes the Blip heartbeat readers that aren't
+// used by the current plan or a plan prepared by PrepareAll, like readers of
+// the previous plan when Prepare is called again with a different heartbeat
+// config. Readers in use are marked as used by the current plan, so only its
+// cleanup func stops them. The caller must hold the lock.
+func (c *Lag) stopUnusedReaders() {
+	used := map[heartbeat.Reader]bool{}
+	for _, r := range c.lagReaders {
+		used[r] = true
+	}
+	for _, p := range c.prepared {
+		for _, r := range p.lagReaders {
+			used[r] = true
+		}
+	}
+	for key, rs := range c.readers {
+		if used[rs.readers[0]] {
+			rs.gen = c.gen
+			continue
+		}
+		Log.Debug("repl.lag: stopping unused readers: %s", key)
+		rs.cleanup()
+		delete(c.readers, key)
+	}
+}
+
+// releaseReaders returns the cleanup func for readers used by the plan
+// prepared in generation gen. It stops the readers unless a later plan reuses
+// them, in which case the cleanup func of that plan stops them. The caller
+// must hold the lock.
+func (c *Lag) releaseReaders(key string, rs *readerSet, gen uint64) func() {
+	return func() {
+		if rs.gen != gen {
+			Log.Debug("repl.lag: not stopping readers reused by a later plan: %s", key)
+			return
+		}
+		rs.cleanup()
+		if c.readers[key] == rs {
+			delete(c.readers, key)
+		}
+	}
+}
+
+// Collect returns the metrics from State: ReplState.MetricValues, and
+// repl.lag.up if option report-up is enabled.
+func (c *Lag) Collect(ctx context.Context, levelName string) ([]blip.MetricValue, error) {
+	s, err := c.State(ctx, levelName)
+	if errors.Is(err, ErrLevelNotPrepared) {
+		return nil, err
+	}
+	metrics := c.selectMetrics(levelName, s.MetricValues())
+	if up := c.upMetric(levelName); up != nil {
+		if err == blip.ErrNoMetrics {
+			err = nil // up is reported, so not intentionally no metrics
+		}
+		return append(metrics, up...), err
+	}
+	if err == nil && len(metrics) == 0 && !s.Replica {
+		return nil, blip.ErrNoMetrics // not a replica: dropped (report-not-a-replica=no)
+	}
+	return metrics, err
+}
+
+// State collects lag at the level and returns the replication state. Collect
+// returns the same state as metrics.
+func (c *Lag) State(ctx context.Context, levelName string) (ReplState, error) {
+	v, l, ok := c.view(levelName)
+	if !ok {
+		return ReplState{}, fmt.Errorf("repl.lag: %w: %s", ErrLevelNotPrepared, levelName)
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.notReplica = false
+	metrics, err := v.collect(ctx, levelName)
+	return newReplState(l.used, !l.notReplica, metrics), err
+}
+
+// view returns a copy of the collector with the current plan state, and the
+// level, for collecting without holding the lock during queries, which would
+// block Prepare, ActiveConfig, cleanup, and so on. The plan state is not
+// changed after prepare (a new prepare makes new state), and the level mu
+// serializes collection at the level. It returns false if the level is not
+// prepared.
+func (c *Lag) view(levelName string) (*Lag, *lagLevel, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	l, ok := c.atLevel[levelName]
+	if !ok {
+		return nil, nil, false
+	}
+	v := &Lag{
+		Now:       c.Now,
+		db:        c.db,
+		openDB:    c.openDB,
+		monitorId: c.monitorId,
+		planName:  c.planName,
+		reader:    c.reader,
+		limiter:   c.limiter,
+		gen:       c.gen,
+	}
+	v.activatePlan(c.current())
+	return v, l, true
+}
+
+// collect collects lag from the writer and applies the level options.
+func (c *Lag) collect(ctx context.Context, levelName string) ([]blip.MetricValue, error) {
+	l := c.atLevel[levelName]
+	now := c.Now()
+	if l.disabled {
+		return nil, blip.ErrNoMetrics // on-detect-fail=disable
+	}
+	if l.skip > 0 {
+		l.skip--
+		return l.collectAgeMetric(now), fmt.Errorf("%w (backoff after %d consecutive errors)", l.lastErr, l.errCount)
+	}
+
+	var metrics []blip.MetricValue
+	var queryTime time.Duration
+	err := checkDB(c.db)
+	if err == nil && l.whenQuery != "" {
+		var open bool
+		if open, err = c.collectOpen(ctx, l.whenQuery); err == nil && !open {
+			Log.Debug("repl.lag: %s: %s is false, not collecting", levelName, l.whenQuery)
+			l.errCount = 0
+			return nil, blip.ErrNoMetrics
+		}
+	}
+	if err == nil {
+		start := c.Now()
+		metrics, err = c.collectCached(ctx, levelName, now)
+		queryTime = c.Now().Sub(start)
+	}
+	if err == nil && l.selfIds != nil {
+		metrics = c.selfHeartbeat(levelName, metrics)
+	}
+	if err == nil && l.delayQuery != "" {
+		metrics, err = c.subtractDelay(ctx, levelName, metrics)
+	}
+	if err == nil && l.compare != "" {
+		metrics = c.compareWriters(ctx, levelName, metrics)
+	}
+	if err == nil && l.posQuery != "" {
+		metrics = c.posBacklog(ctx, levelName, metrics)
+	}
+	if err == nil && l.filterQuery != "" {
+		metrics = c.replFilters(ctx, levelName, metrics)
+	}
+	if err == nil && l.fileQuery != "" {
+		metrics = c.fileBacklog(ctx, levelName, metrics)
+	}
+	if err != nil {
+		err = noDB(err)
+		l.backoff(err)
+		Log.Error("repl.lag: %s: %d consecutive errors, skipping next %d collections: %s", levelName, l.errCount, l.skip, err)
+		return l.collectAgeMetric(now), err
+	}
+	l.errCount = 0
+	setMetricTypes(metrics) // custom writers might not set Type
+
+	if l.queryDur {
+		metrics = append(metrics, blip.MetricValue{
+			Name:  "query_duration_ms",
+			Type:  blip.GAUGE,
+			Value: float64(queryTime.Microseconds()) / 1000,
+		})
+	}
+	if l.rename != nil {
+		renameChannels(metrics, l.rename)
+	}
+	var agg blip.MetricValue
+	var aggOk bool
+	if l.aggregate != "" { // before max-series: aggregate all series
+		agg, aggOk = aggregate(metrics, l.aggregate)
+	}
+	if l.maxSeries > 0 {
+		var dropped int
+		metrics, dropped = capSeries(metrics, l.maxSeries)
+		metrics = append(metrics, blip.MetricValue{Name: "series_overflow", Type: blip.GAUGE, Value: float64(dropped)})
+	}
+	if aggOk {
+		metrics = append(metrics, agg)
+	}
+	if l.dump != nil { // before debounce and window: raw lag
+		metrics = c.diagnosticDump(ctx, levelName, metrics, now)
+	}
+	if l.debounce != nil {
+		metrics = l.debounce.debounce(metrics)
+	}
+	if l.windowSize > 0 {
+		metrics = l.window(metrics)
+	}
+	if l.round != "" && l.round != ROUND_NONE {
+		for i := range metrics {
+			if metrics[i].Name == "current" {
+				metrics[i].Value = roundLag(l.round, metrics[i].Value)
+			}
+		}
+	}
+	if l.reportTrend {
+		metrics = l.trend(metrics, now)
+	}
+	if l.slaMs > 0 { // before unit=s: sla-ms and current in milliseconds
+		metrics = slaMetrics(metrics, l.slaMs)
+	}
+	if l.logScale { // before unit=s: log2 of milliseconds
+		metrics = log2Metrics(metrics)
+	}
+	if l.seconds {
+		toSeconds(metrics)
+	}
+	if l.skipZero {
+		metrics = skipZero(metrics)
+	}
+	reportAbsent(metrics, l.absentValue)
+	if l.dbStats {
+		metrics = append(metrics, dbStats(l.db)...)
+	}
+	if l.writer {
+		metrics = append(metrics, writerMetric(l.used))
+	}
+	if l.restarts && l.used == LAG_WRITER_BLIP {
+		metrics = append(metrics, c.restartsMetric())
+	}
+	if l.identity != nil {
+		includeIdentity(metrics, l.identity)
+	}
+	if l.version != "" {
+		includeVersion(metrics, l.version)
+	}
+	if traceId := blip.TraceId(ctx); l.traceId && traceId != "" {
+		includeTraceId(metrics, traceId)
+	}
+	if l.metaKeys != nil {
+		allowMeta(metrics, l.metaKeys)
+	}
+	blip.MergeLabels(metrics, l.labels)
+	metrics = append(metrics, l.collectAgeMetric(now)...)
+	l.lastCollect = now
+	return metrics, nil
+}
+
+// collectWriter returns the metrics from the writer at the level: the primary
+// writer or a fallback writer. It returns an error if the writer is no longer
+// registered, like a custom writer removed (RemoveWriter) after Prepare.
+func (c *Lag) collectWriter(ctx context.Context, levelName, writer string) ([]blip.MetricValue, error) {
+	if writer == LAG_WRITER_NONE {
+		return c.notAReplica(levelName), nil
+	}
+	if w, ok := lookupWriter(writer); ok {
+		if lim := c.atLevel[levelName].limiter; lim != nil && writer != LAG_WRITER_BLIP {
+			if err := lim.Acquire(ctx); err != nil {
+				return nil, fmt.Errorf("waiting for %s slot (limit %d): %w", OPT_MAX_CONCURRENT, lim.Limit(), err)
+			}
+			defer lim.Release()
+		}
+		return w.Collect(ctx, c, levelName)
+	}
+	return nil, fmt.Errorf("lag writer %s not registered: removed after Prepare", writer)
+}
+
+// autoDetect returns the lag writer for writer=auto. The role option steers
+// the order in which writers are tried: a replica prefers pfs, an intermediate
+// (replica that's also a source) prefers blip because it's both writing and
+// reading heartbeats, and a source doesn't try any writer: it's not a replica.
+// Option auto-writers restricts the writers tried, so auto fails instead of
+// using an unexpected writer, like blip without a heartbeat writer.
+func (c *Lag) autoDetect(ctx context.Context, levelName string, plan blip.Plan, opts map[string]string) (string, func(), error) {
+	var cleanup func()
+	var err error
+	allow, err := autoWriters(opts[OPT_AUTO_WRITERS])
+	if err != nil {
+		return "", nil, err
+	}
+	failed := fmt.Errorf("failed to auto-detect source, set %s manually", OPT_WRITER)
+	if opts[OPT_AUTO_WRITERS] != "" {
+		failed = fmt.Errorf("failed to auto-detect source from %s %s, set %s manually", OPT_AUTO_WRITERS, opts[OPT_AUTO_WRITERS], OPT_WRITER)
+	}
+	role, err := parseRole(opts)
+	if err != nil {
+		return "", nil, err
+	}
+	switch role {
+	case ROLE_SOURCE:
+		Log.Debug("repl.lag role=source, not detecting writer")
+		return LAG_WRITER_NONE, nil, nil
+	case ROLE_INTERMEDIATE:
+		// Upstream Blip heartbeat first, then PFS
+		blipErr := fmt.Errorf("not in %s", OPT_AUTO_WRITERS)
+		if allow(LAG_WRITER_BLIP) {
+			if cleanup, err = c.prepareBlip(ctx, levelName, plan.MonitorId, plan.Name, opts); err == nil {
+				Log.Debug("repl.lag auto-detected Blip heartbeat (role=intermediate)")
+				return LAG_WRITER_BLIP, cleanup, nil
+			}
+			blipErr = err
+		}
+		if allow(LAG_WRITER_PFS) {
+			if err = c.preparePFS(ctx, levelName); err == nil {
+				Log.Warn("repl.lag: %s: writer=auto (role=intermediate): blip not available (%s), using pfs", levelName, blipErr)
+				return LAG_WRITER_PFS, nil, nil
+			}
+		}
+		return "", nil, failed
+	}
+
+	// Group Replication first because a group member also has PFS replication
+	// tables (channel group_replication_applier), so PFS would work but report
+	// the wrong lag
+	if allow(LAG_WRITER_GROUP) && c.isGroupReplMember(ctx) {
+		Log.Debug("repl.lag auto-detected Group Replication")
+		c.dropNoHeartbeat[levelName] = !reportNoHeartbeat(opts)
+		return LAG_WRITER_GROUP, nil, nil
+	}
+
+	// MariaDB next because it doesn't have the PFS replication tables, so PFS
+	// would fail and auto would fall back to blip
+	if allow(LAG_WRITER_MARIADB) && c.isMariaDB(ctx) {
+		Log.Debug("repl.lag auto-detected MariaDB")
+		c.dropNoHeartbeat[levelName] = !reportNoHeartbeat(opts)
+		return LAG_WRITER_MARIADB, nil, nil
+	}
+
+	// then PFS
+	pfsErr := fmt.Errorf("not in %s", OPT_AUTO_WRITERS)
+	if allow(LAG_WRITER_PFS) {
+		if err = c.preparePFS(ctx, levelName); err == nil {
+			Log.Debug("repl.lag auto-detected PFS")
+			return LAG_WRITER_PFS, nil, nil
+		}
+		pfsErr = err
+	}
+
+	// then ProxySQL, only if admin interface detected
+	if allow(LAG_WRITER_PROXYSQL) && c.isProxySQL(ctx) {
+		Log.Debug("repl.lag auto-detected ProxySQL")
+		c.dropNoHeartbeat[levelName] = !reportNoHeartbeat(opts)
+		return LAG_WRITER_PROXYSQL, nil, nil
+	}
+
+	// then Blip HeartBeat
+	if allow(LAG_WRITER_BLIP) {
+		if cleanup, err = c.prepareBlip(ctx, levelName, plan.MonitorId, plan.Name, opts); err == nil {
+			Log.Warn("repl.lag: %s: writer=auto: pfs not available (%s), using blip", levelName, pfsErr)
+			return LAG_WRITER_BLIP, cleanup, nil
+		}
+	}
+	if opts[OPT_AUTO_WRITERS] != "" && allow(LAG_WRITER_PFS) {
+		return "", nil, fmt.Errorf("%s: pfs not available: %w", failed, pfsErr)
+	}
+	return "", nil, failed
+}
+
+// autoWriters returns a func that returns true if writer=auto can choose the
+// writer, given option auto-writers: a comma-separated list of writers. If the
+// option is not set, all writers are allowed.
+func autoWriters(list string) (func(string) bool, error) {
+	if list == "" {
+		return func(string) bool { return true }, nil
+	}
+	allowed := map[string]bool{}
+	for _, w := range strings.Split(list, ",") {
+		switch w = strings.TrimSpace(w); w {
+		case LAG_WRITER_GROUP, LAG_WRITER_MARIADB, LAG_WRITER_PFS, LAG_WRITER_PROXYSQL, LAG_WRITER_BLIP:
+			allowed[w] = true
+		default:
+			return nil, fmt.Errorf("invalid %s: %q: valid values: %s, %s, %s, %s, %s", OPT_AUTO_WRITERS, w,
+				LAG_WRITER_GROUP, LAG_WRITER_MARIADB, LAG_WRITER_PFS, LAG_WRITER_PROXYSQL, LAG_WRITER_BLIP)
+		}
+	}
+	return func(w string) bool { return allowed[w] }, nil
+}
+
+// parseRole returns the role option value, or an error if it's invalid. It's
+// an empty string (replica) if not set.
+func parseRole(opts map[string]string) (string, error) {
+	switch role := opts[OPT_ROLE]; role {
+	case "", ROLE_REPLICA, ROLE_INTERMEDIATE, ROLE_SOURCE:
+		return role, nil
+	default:
+		return "", fmt.Errorf("invalid %s: %q; valid values: replica, intermediate, source", OPT_ROLE, role)
+	}
+}
+
+// parseOnDetectFail returns the on-detect-fail option value, or an error if it's
+// invalid. It's an empty string (error) if not set.
+func parseOnDetectFail(opts map[string]string) (string, error) {
+	switch v := opts[OPT_ON_DETECT_FAIL]; v {
+	case "", DETECT_FAIL_ERROR, DETECT_FAIL_DISABLE:
+		return v, nil
+	default:
+		return "", fmt.Errorf("invalid %s: %q; valid values: error, disable", OPT_ON_DETECT_FAIL, v)
+	}
+}
+
+// ActiveConfig returns the options in effect at each prepared level: option
+// defaults from Help overridden by the plan options, which are interpolated
+// before Prepare. Writer is the writer used, which is auto-detected for
+// writer=auto. Sensitive options, like source-dsn, are redacted. The returned
+// maps are copies, safe to modify. This is for debugging and admin tools; it's
+// not used to collect metrics.
+func (c *Lag) ActiveConfig() map[string]map[string]string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	help := c.Help()
+	cfg := make(map[string]map[string]string, len(c.atLevel))
+	for levelName, l := range c.atLevel {
+		opts := map[string]string{}
+		for name, o := range help.Options {
+			if o.Default != "" {
+				opts[name] = o.Default
+			}
+		}
+		for k, v := range help.Redact(l.options) {
+			opts[k] = v
+		}
+		if writer := c.lagWriterIn[levelName]; writer != "" {
+			opts[OPT_WRITER] = writer
+		}
+		cfg[levelName] = opts
+	}
+	return cfg
+}
+
+// Cost returns the estimated cost of Collect at the level, which depends on the
+// writer. The blip writer is cheap because heartbeats are read in the background
+// (Collect returns the last lag from the readers), unless cross-check also
+// collects from Performance Schema.
+func (c *Lag) Cost(levelName string) byte {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	l, ok := c.atLevel[levelName]
+	if !ok {
+		return blip.COST_UNKNOWN
+	}
+	switch c.lagWriterIn[levelName] {
+	case LAG_WRITER_PFS:
+		return blip.COST_EXPENSIVE
+	case LAG_WRITER_BLIP:
+		if l.crossCheck {
+			return blip.COST_EXPENSIVE
+		}
+		return blip.COST_CHEAP
+	case LAG_WRITER_PROXYSQL, LAG_WRITER_GROUP, LAG_WRITER_PROC, LAG_WRITER_MARIADB:
+		return blip.COST_MODERATE
+	case LAG_WRITER_PT, LAG_WRITER_NONE:
+		return blip.COST_CHEAP
+	}
+	return blip.COST_UNKNOWN
+}
+
+// writerValues are the values of repl.lag.writer.
+var writerValues = map[string]float64{
+	LAG_WRITER_NONE:     0,
+	LAG_WRITER_PFS:      1,
+	LAG_WRITER_BLIP:     2,
+	LAG_WRITER_PROXYSQL: 3,
+	LAG_WRITER_PT:       4,
+	LAG_WRITER_GROUP:    5,
+	LAG_WRITER_PROC:     6,
+	LAG_WRITER_MARIADB:  7,
+}
+
+// writerMetric returns the repl.lag.writer metric for the writer.
+func writerMetric(writer string) blip.MetricValue {
+	value, ok := writerValues[writer]
+	if !ok {
+		value = -1 // custom writer (RegisterWriter)
+	}
+	return blip.MetricValue{
+		Name:  "writer",
+		Type:  blip.GAUGE,
+		Value: value,
+		Meta:  map[string]string{"writer": writer},
+	}
+}
+
+// restarter is a heartbeat.Reader that restarts on persistent read errors,
+// like heartbeat.BlipReader.
+type restarter interface {
+	Restarts() uint
+}
+
+// restartsMetric returns the repl.lag.reader_restarts metric: total restarts
+// of all heartbeat readers (one per heartbeat table).
+func (c *Lag) restartsMetric() blip.MetricValue {
+	var n uint
+	for _, r := range c.lagReaders {
+		if rr, ok := r.(restarter); ok {
+			n += rr.Restarts()
+		}
+	}
+	return blip.MetricValue{Name: "reader_restarts", Type: blip.CUMULATIVE_COUNTER, Value: float64(n)}
+}
+
+// notAReplica returns the repl.lag.current metric for not a replica: absent
+// value or nil (dropped).
+func (c *Lag) notAReplica(levelName string) []blip.MetricValue {
+	if l, ok := c.atLevel[levelName]; ok {
+		l.notReplica = true // for State
+	}
+	if c.dropNotAReplica[levelName] {
+		return nil
+	}
+	value, meta := computeLag(rawLagInputs{replica: false}, c.lagOptions(levelName))
+	return []blip.MetricValue{{Name: "current", Type: blip.GAUGE, Value: value, Meta: meta}}
+}
+
+// ReadOnce collects lag once at the level, which must be prepared. For the
+// blip writer, it reads the heartbeat directly (once per heartbeat table)
+// instead of returning the last lag from the reader goroutine, so it works
+// if the readers are not running. For other writers, it's the same as Collect.
+// Unlike Collect, it does not round, compute trend, skip zero, or back off on
+// errors: it returns the lag metrics from the writer.
+func (c *Lag) ReadOnce(ctx context.Context, levelName string) ([]blip.MetricValue, error) {
+	v, l, ok := c.view(levelName)
+	if !ok {
+		return nil, fmt.Errorf("level %s not prepared", levelName)
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	metrics, err := v.readOnce(ctx, levelName)
+	reportAbsent(metrics, l.absentValue)
+	return metrics, err
+}
+
+// readOnce is ReadOnce on a view of the collector.
+func (c *Lag) readOnce(ctx context.Context, levelName string) ([]blip.MetricValue, error) {
+	switch c.lagWriterIn[levelName] {
+	case LAG_WRITER_BLIP:
+		var metrics []blip.MetricValue
+		for _, r := range c.lagReaders {
+			lag, err := r.ReadOnce(ctx)
+			if err != nil {
+				return nil, err
+			}
+			if m, ok := c.blipMetric(levelName, lag); ok {
+				metrics = append(metrics, m)
+			}
+		}
+		return metrics, nil
+	case LAG_WRITER_NONE:
+		return c.notAReplica(levelName), nil
+	case "":
+		return nil, fmt.Errorf("level %s not prepared", levelName)
+	}
+	return c.collectWriter(ctx, levelName, c.lagWriterIn[levelName])
 }
 
-func (c *Lag) Collect(ctx context.Context, levelName string) ([]blip.MetricValue, error) {
-	switch c.lagWriterIn[levelName] {
-	case LAG_WRITER_BLIP:
-		return c.collectBlip(ctx, levelName)
-	case LAG_WRITER_PFS:
-		return c.collectPFS(ctx, levelName)
+// RunOnce prepares the plan, collects the level once, and stops the Blip
+// heartbeat readers (if any). Cleanup always runs, even if Collect returns an
+// error or the level is not in the plan. It's for testing sinks and
+// integrations without a level collector. For the blip writer, Collect
+// returns the last lag read by the readers, which might not have read a
+// heartbeat yet: current is -1 (or no heartbeat).
+func RunOnce(ctx context.Context, c *Lag, plan blip.Plan, levelName string) ([]blip.MetricValue, error) {
+	cleanup, err := c.Prepare(ctx, plan)
+	if cleanup != nil {
+		defer cleanup()
 	}
-
-	panic(fmt.Sprintf("invalid lag writer in Collect %q in level %q. All levels: %v", c.lagWriterIn[levelName], levelName, c.lagWriterIn))
+	if err != nil {
+		return nil, err
+	}
+	c.mu.RLock()
+	_, ok := c.atLevel[levelName]
+	c.mu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("level %s not prepared: not in plan or does not collect %s", levelName, DOMAIN)
+	}
+	return c.Collect(ctx, levelName)
 }
 
 // //////////////////////////////////////////////////////////////////////////
 // Internal methods
 // //////////////////////////////////////////////////////////////////////////
 
-func (c *Lag) prepareBlip(levelName string, monitorID string, planName string, options map[string]string) (func(), error) {
-	if c.lagReader != nil {
+// reportNoHeartbeat returns the value of option report-no-heartbeat, or the
+// default (no: drop) only if it's not set. Option absent-value, if set,
+// overrides it.
+func reportNoHeartbeat(opts map[string]string) bool {
+	if v, set := blip.BoolOpt(opts, OPT_REPORT_NO_HEARTBEAT); set {
+		return v
+	}
+	return false
+}
+
+// reportNotAReplica returns the value of option report-not-a-replica, or the
+// default (no: drop) only if it's not set. Options absent-value and
+// source-value, if set, override it.
+func reportNotAReplica(opts map[string]string) bool {
+	if v, set := blip.BoolOpt(opts, OPT_REPORT_NOT_A_REPLICA); set {
+		return v
+	}
+	return false
+}
+
+// prepareBlip prepares the Blip heartbeat readers at the level and, with option
+// require-heartbeat, checks that they read an advancing heartbeat.
+func (c *Lag) prepareBlip(ctx context.Context, levelName string, monitorID string, planName string, options map[string]string) (func(), error) {
+	cleanup, err := c.prepareBlipReaders(ctx, levelName, monitorID, planName, options)
+	if err != nil || !blip.Bool(options[OPT_REQUIRE_HEARTBEAT]) {
+		return cleanup, err
+	}
+	if err := c.requireHeartbeat(ctx); err != nil {
+		// Not cleanup: the readers might be reused from the active plan.
+		// Prepare stops them if unused.
+		c.lagReaders = nil
+		return nil, err
+	}
+	return cleanup, nil
+}
+
+func (c *Lag) prepareBlipReaders(ctx context.Context, levelName string, monitorID string, planName string, options map[string]string) (func(), error) {
+	c.dropNoHeartbeat[levelName] = !reportNoHeartbeat(options)
+
+	// Reader from NewLagWithReader: owned by caller, so not started or stopped here
+	if c.reader != nil {
+		c.lagReaders = []heartbeat.Reader{c.reader}
+		c.atLevel[levelName].db = c.db
+		c.lagWriterIn[levelName] = LAG_WRITER_BLIP
 		return nil, nil
 	}
 
-	c.dropNoHeartbeat[levelName] = !blip.Bool(options[OPT_REPORT_NO_HEARTBEAT])
+	if options[OPT_HEARTBEAT_SOURCE_ID] != "" && options[OPT_HEARTBEAT_SOURCE_ROLE] != "" {
+		return nil, fmt.Errorf("%s and %s are mutually exclusive; set only one", OPT_HEARTBEAT_SOURCE_ID, OPT_HEARTBEAT_SOURCE_ROLE)
+	}
+
+	// Reuse readers with the same config: from a previous level or plan
+	key := readerKey(options)
+	if rs, ok := c.readers[key]; ok {
+		c.lagReaders = rs.readers
+		c.atLevel[levelName].db = rs.db
+		c.lagWriterIn[levelName] = LAG_WRITER_BLIP
+		rs.gen = c.gen
+		return c.releaseReaders(key, rs, c.gen), nil
+	}
 
-	table := options[OPT_HEARTBEAT_TABLE]
-	if table == "" {
-		table = blip.DEFAULT_HEARTBEAT_TABLE
+	// Comma-separated list of heartbeat tables, one per source (fan-in)
+	var tables []string
+	for _, table := range strings.Split(options[OPT_HEARTBEAT_TABLE], ",") {
+		if table = strings.TrimSpace(table); table != "" {
+			tables = append(tables, table)
+		}
+	}
+	if len(tables) == 0 {
+		tables = []string{blip.DEFAULT_HEARTBEAT_TABLE}
+	}
+	hbKey, err := parseHeartbeatKey(options[OPT_HEARTBEAT_KEY])
+	if err != nil {
+		return nil, err
 	}
 	netLatency := 50 * time.Millisecond
 	if s, ok := options[OPT_NETWORK_LATENCY]; ok {
 		n, err := strconv.Atoi(s)
 		if err != nil {
-			blip.Debug("%s: invalid network-latency: %s: %s (ignoring; using default 50 ms)", monitorID, s, err)
+			Log.Warn("%s: invalid network-latency: %s: %s (ignoring; using default 50 ms)", monitorID, s, err)
 		} else {
 			netLatency = time.Duration(n) * time.Millisecond
 		}
 	}
-	// Only 1 reader per plan
-	c.lagReader = heartbeat.NewBlipReader(heartbeat.BlipReaderArgs{
-		MonitorId:  monitorID,
-		DB:         c.db,
-		Table:      table,
-		SourceId:   options[OPT_HEARTBEAT_SOURCE_ID],
-		SourceRole: options[OPT_HEARTBEAT_SOURCE_ROLE],
-		ReplCheck:  c.replCheck,
-		Waiter: heartbeat.SlowFastWaiter{
-			MonitorId:      monitorID,
-			NetworkLatency: netLatency,
-		},
-	})
-	go c.lagReader.Start()
-	blip.Debug("%s: started reader: %s/%s (network latency: %s)", monitorID, planName, levelName, netLatency)
-	c.lagWriterIn[levelName] = LAG_WRITER_BLIP
-	var cleanup func()
-	cleanup = func() {
-		blip.Debug("%s: stopping reader", monitorID)
-		c.lagReader.Stop()
+
+	srcLatency, err := parseSourceLatency(options[OPT_SOURCE_LATENCY])
+	if err != nil {
+		return nil, err
 	}
-	return cleanup, nil
-}
 
-func (c *Lag) collectBlip(ctx context.Context, levelName string) ([]blip.MetricValue, error) {
-	lag, err := c.lagReader.Lag(ctx)
+	// Read heartbeats from another instance, else the monitored instance
+	db := c.db
+	var srcDB *sql.DB
+	if dsn := options[OPT_SOURCE_DSN]; dsn != "" {
+		var err error
+		srcDB, err = c.openDB(dsn)
+		if err != nil {
+			return nil, fmt.Errorf("cannot open %s: %s", OPT_SOURCE_DSN, err)
+		}
+		db = srcDB
+		Log.Debug("%s: reading heartbeat from %s", monitorID, OPT_SOURCE_DSN)
+	}
+
+	// Composite primary key: all key columns must be set to read the right row
+	if hbKey != nil {
+		for _, table := range tables {
+			if err := checkHeartbeatKey(ctx, db, table, hbKey); err != nil {
+				if srcDB != nil {
+					srcDB.Close()
+				}
+				return nil, err
+			}
+		}
+	}
+
+	// Source from which to read the latest heartbeat sequence number
+	seqDB, err := c.openSeqDB(options)
 	if err != nil {
+		if srcDB != nil {
+			srcDB.Close()
+		}
 		return nil, err
 	}
+
+	// Only 1 reader per heartbeat table and source role per reader config
+	roles := sourceRoles(options[OPT_HEARTBEAT_SOURCE_ROLE])
+	var readers []heartbeat.Reader
+	cleanup := func() {
+		// Stop is synchronous, so stop readers in parallel: cleanup waits at
+		// most heartbeat.StopTimeout, and no reader reads after it returns
+		Log.Debug("%s: stopping %d readers", monitorID, len(readers))
+		var wg sync.WaitGroup
+		for _, r := range readers {
+			wg.Add(1)
+			go func(r heartbeat.Reader) {
+				defer wg.Done()
+				r.Stop()
+			}(r)
+		}
+		wg.Wait()
+		if srcDB != nil {
+			srcDB.Close()
+		}
+		if seqDB != nil {
+			seqDB.Close()
+		}
+	}
+	for _, table := range tables {
+		for _, role := range roles {
+			r := heartbeat.NewBlipReader(heartbeat.BlipReaderArgs{
+				MonitorId:  monitorID,
+				DB:         db,
+				Table:      sqlutil.QuoteQualifiedName(table, ""),
+				SourceId:   options[OPT_HEARTBEAT_SOURCE_ID],
+				SourceRole: role,
+				ReplCheck:  c.replCheck,
+				Tag:        options[OPT_HEARTBEAT_TAG],
+				Key:        hbKey,
+				TsFormat:   options[OPT_HEARTBEAT_TS_FORMAT],
+
+				TsPrecision: tsPrecision(ctx, db, table, options[OPT_HEARTBEAT_TS_FORMAT]),
+
+				WriteLatencyCol: writeLatencyCol(ctx, db, sqlutil.QuoteQualifiedName(table, ""), options[OPT_HEARTBEAT_WRITE_LAT]),
+				AppliedTsCol:    appliedTsCol(ctx, db, sqlutil.QuoteQualifiedName(table, ""), options[OPT_HEARTBEAT_APPLIED_TS]),
+				SeqCol:          seqCol(ctx, db, sqlutil.QuoteQualifiedName(table, ""), options[OPT_HEARTBEAT_SEQ_COL]),
+				SeqDB:           seqDB,
+
+				ConsistentRead: blip.Bool(options[OPT_CONSISTENT_READ]),
+				Waiter: heartbeat.SlowFastWaiter{
+					MonitorId:      monitorID,
+					NetworkLatency: netLatency,
+					SourceLatency:  srcLatency,
+					HeartbeatFreq:  c.atLevel[levelName].hbFreq,
+					AutoFreq:       c.atLevel[levelName].hbAutoFreq,
+					MinInterval:    c.atLevel[levelName].readIntvl,
+				},
+			})
+			if err := r.Start(); err != nil {
+				cleanup() // stop readers already started
+				return nil, err
+			}
+			readers = append(readers, r)
+			Log.Debug("%s: started reader: %s/%s: %s %s (network latency: %s)", monitorID, planName, levelName, table, role, netLatency)
+		}
+	}
+	var once sync.Once
+	rs := &readerSet{readers: readers, cleanup: func() { once.Do(cleanup) }, db: db, gen: c.gen}
+	c.lagReaders = readers
+	c.readers[key] = rs
+	c.atLevel[levelName].db = db
+	c.lagWriterIn[levelName] = LAG_WRITER_BLIP
+	return c.releaseReaders(key, rs, c.gen), nil
+}
+
+// readerKey returns a key for the Blip heartbeat reader config in options.
+// Levels and plans with the same key share the same readers.
+func readerKey(options map[string]string) string {
+	return strings.Join([]string{
+		options[OPT_HEARTBEAT_TABLE],
+		options[OPT_HEARTBEAT_SOURCE_ID],
+		options[OPT_HEARTBEAT_SOURCE_ROLE],
+		options[OPT_HEARTBEAT_TAG],
+		options[OPT_HEARTBEAT_KEY],
+		options[OPT_HEARTBEAT_TS_FORMAT],
+		options[OPT_HEARTBEAT_WRITE_LAT],
+		options[OPT_HEARTBEAT_APPLIED_TS],
+		options[OPT_HEARTBEAT_SEQ_COL],
+		options[OPT_HEARTBEAT_SEQ_DSN],
+		options[OPT_NETWORK_LATENCY],
+		options[OPT_SOURCE_LATENCY],
+		options[OPT_HEARTBEAT_FREQ],
+		options[OPT_READ_INTERVAL],
+		options[OPT_CONSISTENT_READ],
+		options[OPT_SOURCE_DSN],
+		options[OPT_REPL_CHECK],
+	}, "|")
+}
+
+func (c *Lag) collectBlip(ctx context.Context, levelName string) ([]blip.MetricValue, error) {
+	// During warmup, don't report lag from a reader until it has read a
+	// heartbeat (or determined not a replica): the first lag can be stale
+	l := c.atLevel[levelName]
+	warming := !l.warmupEnd.IsZero() && c.Now().Before(l.warmupEnd)
+	warm := true
+	var metrics []blip.MetricValue
+	for _, r := range c.lagReaders {
+		// Don't report stale lag if the reader goroutine died
+		if !r.Alive() {
+			if err := r.Err(); err != nil {
+				return nil, fmt.Errorf("heartbeat reader not running: %s", err)
+			}
+			return nil, fmt.Errorf("heartbeat reader not running")
+		}
+		lag, err := r.Lag(ctx)
+		if err != nil {
+			return nil, err
+		}
+		if warming && lag.Replica && lag.LastTs.IsZero() {
+			warm = false
+			continue
+		}
+		_, seen := l.fresh[lag.SourceId]
+		lag, stale := c.staleLag(levelName, lag)
+		if m, ok := c.blipMetric(levelName, lag); ok {
+			if stale && lag.Milliseconds != -1 {
+				if m.Meta == nil {
+					m.Meta = map[string]string{}
+				}
+				m.Meta["stale"] = "true"
+			}
+			metrics = append(metrics, m)
+		}
+		if l.writeLat {
+			if m, ok := writeLatencyMetric(lag); ok {
+				metrics = append(metrics, m)
+			}
+		}
+		if l.writerAlive && seen {
+			if m, ok := writerAliveMetric(lag, stale); ok {
+				metrics = append(metrics, m)
+			}
+		}
+	}
+	if warm {
+		l.warmupEnd = time.Time{} // warmup done
+	}
+	return metrics, nil
+}
+
+// blipMetric returns repl.lag.current for the lag from a heartbeat reader.
+// It returns false if the metric is dropped: no heartbeat or not a replica.
+func (c *Lag) blipMetric(levelName string, lag heartbeat.Lag) (blip.MetricValue, bool) {
 	if !lag.Replica {
+		c.atLevel[levelName].notReplica = true // for State
 		if c.dropNotAReplica[levelName] {
-			return nil, nil
+			return blip.MetricValue{}, false
 		}
 	} else if lag.Milliseconds == -1 && c.dropNoHeartbeat[levelName] {
-		return nil, nil
+		return blip.MetricValue{}, false
+	}
+	value, meta := computeLag(rawLagInputs{
+		ms:         float64(lag.Milliseconds),
+		ok:         lag.Milliseconds != -1,
+		replica:    lag.Replica,
+		sourceHost: lag.SourceId,
+	}, c.lagOptions(levelName))
+	if c.atLevel[levelName].multiRole && lag.SourceRole != "" {
+		if meta == nil {
+			meta = map[string]string{}
+		}
+		meta["source_role"] = lag.SourceRole
+	}
+	if lag.Seq && lag.Milliseconds != -1 {
+		if meta == nil {
+			meta = map[string]string{}
+		}
+		meta["lag_from"] = "seq" // heartbeat-seq-col
+	}
+	if lag.TsPrecision.Valid && lag.Milliseconds != -1 {
+		if meta == nil {
+			meta = map[string]string{}
+		}
+		meta["heartbeat_precision"] = strconv.Itoa(int(lag.TsPrecision.Int32))
 	}
-	m := blip.MetricValue{
+	return blip.MetricValue{
 		Name:  "current",
 		Type:  blip.GAUGE,
-		Value: float64(lag.Milliseconds),
-		Meta:  map[string]string{"source": lag.SourceId},
+		Value: value,
+		Meta:  meta,
+	}, true
+}
+
+// crossCheck collects lag from Performance Schema and appends repl.lag.disagreement
+// to the Blip heartbeat metrics: the absolute difference between the max lag
+// reported by each. Disagreement is reported only when both have a real lag value
+// (not absent); a Performance Schema error doesn't fail the collection because
+// the Blip heartbeat is the lag writer.
+func (c *Lag) crossCheck(ctx context.Context, levelName string, blipMetrics []blip.MetricValue) []blip.MetricValue {
+	notReplica := c.atLevel[levelName].notReplica
+	pfsMetrics, err := c.collectPFS(ctx, levelName)
+	c.atLevel[levelName].notReplica = notReplica // only the writer sets replica state
+	if err != nil {
+		Log.Debug("repl.lag: %s: %s: %s", levelName, OPT_CROSS_CHECK, err)
+		return blipMetrics
+	}
+	blipLag, ok1 := maxCurrent(blipMetrics)
+	pfsLag, ok2 := maxCurrent(pfsMetrics)
+	if !ok1 || !ok2 {
+		return blipMetrics
+	}
+	return append(blipMetrics, blip.MetricValue{
+		Name:  "disagreement",
+		Type:  blip.GAUGE,
+		Value: math.Abs(blipLag - pfsLag),
+	})
+}
+
+// maxCurrent returns the max repl.lag.current value in metrics, ignoring absent
+// values. It returns false if there are no such values.
+func maxCurrent(metrics []blip.MetricValue) (float64, bool) {
+	max := 0.0
+	found := false
+	for _, m := range metrics {
+		if m.Name != "current" || absent(m.Value) {
+			continue
+		}
+		if !found || m.Value > max {
+			max = m.Value
+		}
+		found = true
+	}
+	return max, found
+}
+
+// collectAgeMetric returns repl.lag.last_collect_age: milliseconds since the last
+// successful Collect, or since Prepare if none. It returns nil if the option
+// report-collect-age is not enabled. It's returned with Collect errors, too,
+// so it keeps increasing while collecting fails.
+func (l *lagLevel) collectAgeMetric(now time.Time) []blip.MetricValue {
+	if !l.collectAge {
+		return nil
+	}
+	metrics := []blip.MetricValue{{
+		Name:  "last_collect_age",
+		Type:  blip.GAUGE,
+		Value: float64(now.Sub(l.lastCollect).Milliseconds()),
+	}}
+	if l.identity != nil {
+		includeIdentity(metrics, l.identity)
+	}
+	if l.metaKeys != nil {
+		allowMeta(metrics, l.metaKeys)
+	}
+	blip.MergeLabels(metrics, l.labels)
+	return metrics
+}
+
+// upMetric returns repl.lag.up: always 1 to prove that the collector ran at the
+// level, unlike lag values that can be dropped (no heartbeat, not a replica,
+// collect-when, and so on). It returns nil if option report-up is not enabled.
+// Like repl.lag.last_collect_age, it's returned with Collect errors, too.
+func (c *Lag) upMetric(levelName string) []blip.MetricValue {
+	c.mu.RLock()
+	l, ok := c.atLevel[levelName]
+	c.mu.RUnlock()
+	if !ok || !l.up {
+		return nil
+	}
+	metrics := []blip.MetricValue{{
+		Name:  "up",
+		Type:  blip.GAUGE,
+		Value: 1,
+	}}
+	if l.identity != nil {
+		includeIdentity(metrics, l.identity)
+	}
+	if l.metaKeys != nil {
+		allowMeta(metrics, l.metaKeys)
+	}
+	blip.MergeLabels(metrics, l.labels)
+	return metrics
+}
+
+// backoff records a Collect error and sets the number of collections to skip
+// if there have been ErrorBackoffAfter or more consecutive errors.
+func (l *lagLevel) backoff(err error) {
+	l.errCount++
+	l.lastErr = err
+	if l.errCount < ErrorBackoffAfter {
+		return
+	}
+	n := l.errCount - ErrorBackoffAfter // 0, 1, 2, ...
+	if n > 5 {
+		n = 5 // avoid overflow; 1<<5 = 32 = default max
+	}
+	l.skip = 1 << n
+	if l.skip > ErrorBackoffMax {
+		l.skip = ErrorBackoffMax
+	}
+}
+
+// trend appends a repl.lag.trend metric for each repl.lag.current metric: the
+// change in lag (milliseconds) per second since the last collection at the
+// level, per series (channel, source, or backend). Positive means the replica
+// is falling behind; negative means it's catching up. Nothing is reported for
+// the first sample (or after absent value = no heartbeat or not a replica)
+// because there's no previous value.
+func (l *lagLevel) trend(metrics []blip.MetricValue, now time.Time) []blip.MetricValue {
+	n := len(metrics)
+	for i := 0; i < n; i++ {
+		m := metrics[i]
+		if m.Name != "current" {
+			continue
+		}
+		key := seriesKey(m)
+		if absent(m.Value) {
+			delete(l.last, key) // restart trend when lag is reported again
+			continue
+		}
+		prev, ok := l.last[key]
+		l.last[key] = lagSample{lag: m.Value, ts: now}
+		if !ok {
+			continue // first sample
+		}
+		elapsed := now.Sub(prev.ts).Seconds()
+		if elapsed <= 0 {
+			continue // guard against divide by zero
+		}
+		metrics = append(metrics, blip.MetricValue{
+			Name:  "trend",
+			Type:  blip.GAUGE,
+			Value: (m.Value - prev.lag) / elapsed,
+			Group: m.Group,
+			Meta:  m.Meta,
+		})
+	}
+	return metrics
+}
+
+// replCheckVar matches a valid repl-check MySQL global variable name.
+var replCheckVar = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_.]*$`)
+
+// parseReplCheck validates the repl-check option: a comma-separated list of
+// MySQL global variables (without @@). It returns the list as "var1,var2"
+// without spaces, or an empty string if not set.
+func parseReplCheck(s string) (string, error) {
+	var vars []string
+	for _, v := range strings.Split(s, ",") {
+		v = strings.TrimSpace(v)
+		if v == "" {
+			continue
+		}
+		if !replCheckVar.MatchString(v) {
+			return "", fmt.Errorf("invalid %s variable: %q: must be a MySQL global variable name without @@", OPT_REPL_CHECK, v)
+		}
+		vars = append(vars, v)
+	}
+	return strings.Join(vars, ","), nil
+}
+
+// sourceRoles returns the source-role option value as a list of roles. It
+// returns [""] (no role) if the value is empty, so there's always one reader
+// per heartbeat table.
+func sourceRoles(s string) []string {
+	var roles []string
+	for _, role := range strings.Split(s, ",") {
+		if role = strings.TrimSpace(role); role != "" {
+			roles = append(roles, role)
+		}
+	}
+	if len(roles) == 0 {
+		return []string{""}
+	}
+	return roles
+}
+
+// parseSourceLatency parses the network-latency-by-source option value like
+// "source1:20, source2:100": source ID to network latency in milliseconds.
+// It returns nil if the value is empty.
+func parseSourceLatency(s string) (map[string]time.Duration, error) {
+	if strings.TrimSpace(s) == "" {
+		return nil, nil
+	}
+	m := map[string]time.Duration{}
+	for _, kv := range strings.Split(s, ",") {
+		// Split on last colon so source IDs can contain colons (host:port)
+		i := strings.LastIndex(kv, ":")
+		if i < 0 {
+			return nil, fmt.Errorf("invalid %s: %s: missing ':' (format: source-id:ms)", OPT_SOURCE_LATENCY, kv)
+		}
+		srcId := strings.TrimSpace(kv[:i])
+		n, err := strconv.Atoi(strings.TrimSpace(kv[i+1:]))
+		if err != nil || n < 0 || srcId == "" {
+			return nil, fmt.Errorf("invalid %s: %s (format: source-id:ms)", OPT_SOURCE_LATENCY, kv)
+		}
+		m[srcId] = time.Duration(n) * time.Millisecond
+	}
+	return m, nil
+}
+
+// parseWarmup returns the warmup option value, or 0 if not set.
+func parseWarmup(opts map[string]string) (time.Duration, error) {
+	warmup := opts[OPT_WARMUP]
+	if warmup == "" {
+		return 0, nil
+	}
+	d, err := time.ParseDuration(warmup)
+	if err != nil || d < 0 {
+		return 0, fmt.Errorf("invalid %s: %q: must be a positive Go duration like 10s", OPT_WARMUP, warmup)
+	}
+	return d, nil
+}
+
+// parseHeartbeatFreq returns the heartbeat-freq option value, or 0 if not set.
+// It returns true if the value is auto, which only the blip writer supports.
+func parseHeartbeatFreq(opts map[string]string) (time.Duration, bool, error) {
+	freq := opts[OPT_HEARTBEAT_FREQ]
+	switch freq {
+	case "":
+		return 0, false, nil
+	case HEARTBEAT_FREQ_AUTO:
+		return 0, true, nil
+	}
+	d, err := time.ParseDuration(freq)
+	if err != nil || d < 0 {
+		return 0, false, fmt.Errorf("invalid %s: %q: must be auto or a positive Go duration like 1s", OPT_HEARTBEAT_FREQ, freq)
+	}
+	return d, false, nil
+}
+
+// parseReadInterval returns the read-interval option value, or 0 if not set.
+func parseReadInterval(opts map[string]string) (time.Duration, error) {
+	intvl := opts[OPT_READ_INTERVAL]
+	if intvl == "" {
+		return 0, nil
+	}
+	d, err := time.ParseDuration(intvl)
+	if err != nil || d <= 0 {
+		return 0, fmt.Errorf("invalid %s: %q: must be a positive Go duration like 1s", OPT_READ_INTERVAL, intvl)
+	}
+	return d, nil
+}
+
+// parseTsFormat returns the heartbeat-ts-format option value, or an error if
+// it's invalid. It's an empty string (datetime) if not set.
+func parseTsFormat(opts map[string]string) (string, error) {
+	switch f := opts[OPT_HEARTBEAT_TS_FORMAT]; f {
+	case "", heartbeat.TS_FORMAT_DATETIME, heartbeat.TS_FORMAT_EPOCH_MS, heartbeat.TS_FORMAT_EPOCH_US:
+		return f, nil
+	default:
+		return "", fmt.Errorf("invalid %s: %q: valid values: %s, %s, %s", OPT_HEARTBEAT_TS_FORMAT, f,
+			heartbeat.TS_FORMAT_DATETIME, heartbeat.TS_FORMAT_EPOCH_MS, heartbeat.TS_FORMAT_EPOCH_US)
+	}
+}
+
+// skipZero drops repl.lag.current metrics with value 0. It's done after trend
+// so that trend is computed from all values. Absent values (-1, NaN) are kept.
+func skipZero(metrics []blip.MetricValue) []blip.MetricValue {
+	n := 0
+	for _, m := range metrics {
+		if m.Name == "current" && m.Value == 0 && m.Meta["role"] != ROLE_SOURCE {
+			continue
+		}
+		metrics[n] = m
+		n++
+	}
+	return metrics[:n]
+}
+
+// checkDB returns ErrNoDB if db is nil. A closed db is detected by the error
+// from the first query: see noDB.
+func checkDB(db *sql.DB) error {
+	if db == nil {
+		return ErrNoDB
+	}
+	return nil
+}
+
+// noDB returns err wrapped with ErrNoDB if the database is closed (sql.ErrConnDone
+// or "sql: database is closed", which database/sql does not export), else err.
+func noDB(err error) error {
+	if err == nil || errors.Is(err, ErrNoDB) {
+		return err
+	}
+	if errors.Is(err, sql.ErrConnDone) || strings.Contains(err.Error(), "sql: database is closed") {
+		return fmt.Errorf("%w: %s", ErrNoDB, err)
+	}
+	return err
+}
+
+// dbStats returns connection pool stats from db.Stats() for option report-db-stats.
+func dbStats(db *sql.DB) []blip.MetricValue {
+	stats := db.Stats()
+	return []blip.MetricValue{
+		{Name: "db_open_connections", Type: blip.GAUGE, Value: float64(stats.OpenConnections)},
+		{Name: "db_in_use", Type: blip.GAUGE, Value: float64(stats.InUse)},
+		{Name: "db_wait_count", Type: blip.CUMULATIVE_COUNTER, Value: float64(stats.WaitCount)},
+	}
+}
+
+// parseMetaAllowlist returns the meta-allowlist option value as a set of meta
+// keys, or nil if not set (all keys are allowed).
+func parseMetaAllowlist(opts map[string]string) map[string]bool {
+	allow := opts[OPT_META_ALLOWLIST]
+	if allow == "" {
+		return nil
+	}
+	keys := map[string]bool{}
+	for _, key := range strings.Split(allow, ",") {
+		if key = strings.TrimSpace(key); key != "" {
+			keys[key] = true
+		}
+	}
+	return keys
+}
+
+// parseMetrics returns the metrics selected at the level (Domain.Metrics) as
+// a set of metric names without the domain prefix, or nil if none are selected
+// (all metrics). It warns about metrics not in Help because only a custom
+// writer can report them.
+func parseMetrics(help blip.CollectorHelp, levelName string, metrics []string) map[string]bool {
+	if len(metrics) == 0 {
+		return nil
+	}
+	selected := map[string]bool{}
+	for _, name := range metrics {
+		name = strings.TrimPrefix(strings.TrimSpace(name), DOMAIN+".")
+		if !helpMetric(help, name) {
+			Log.Warn("repl.lag: %s: metric %s is not a built-in metric; only a custom writer can report it", levelName, name)
+		}
+		selected[name] = true
+	}
+	return selected
+}
+
+// levelIdentity returns the identity meta for options include-identity
+// (monitor_id and plan) and include-level (plan and level), or nil if neither
+// is enabled.
+func levelIdentity(opts map[string]string, monitorId, planName, levelName string) map[string]string {
+	var identity map[string]string
+	if blip.Bool(opts[OPT_INCLUDE_IDENTITY]) {
+		identity = map[string]string{"monitor_id": monitorId, "plan": planName}
+	}
+	if blip.Bool(opts[OPT_INCLUDE_LEVEL]) {
+		if identity == nil {
+			identity = map[string]string{}
+		}
+		identity["plan"] = planName
+		identity["level"] = levelName
+	}
+	return identity
+}
+
+// includeIdentity adds the identity meta (monitor_id, plan, and level) to all
+// metrics.
+// Meta is copied because some metrics share meta (trend and current).
+func includeIdentity(metrics []blip.MetricValue, identity map[string]string) {
+	for i := range metrics {
+		meta := make(map[string]string, len(metrics[i].Meta)+len(identity))
+		for k, v := range metrics[i].Meta {
+			meta[k] = v
+		}
+		for k, v := range identity {
+			meta[k] = v
+		}
+		metrics[i].Meta = meta
+	}
+}
+
+// includeVersion adds meta mysql_version to repl.lag.current (option
+// include-version). Meta is copied like includeIdentity.
+func includeVersion(metrics []blip.MetricValue, version string) {
+	for i := range metrics {
+		if metrics[i].Name != "current" {
+			continue
+		}
+		meta := make(map[string]string, len(metrics[i].Meta)+1)
+		for k, v := range metrics[i].Meta {
+			meta[k] = v
+		}
+		meta["mysql_version"] = version
+		metrics[i].Meta = meta
+	}
+}
+
+// helpMetric returns true if the metric is in Help.
+func helpMetric(help blip.CollectorHelp, name string) bool {
+	for _, m := range help.Metrics {
+		if m.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// selectMetrics returns the metrics selected at the level (Domain.Metrics),
+// or all metrics if none are selected. It filters in place.
+func (c *Lag) selectMetrics(levelName string, metrics []blip.MetricValue) []blip.MetricValue {
+	c.mu.RLock()
+	l, ok := c.atLevel[levelName]
+	c.mu.RUnlock()
+	if !ok || l.metrics == nil {
+		return metrics
+	}
+	n := 0
+	for _, m := range metrics {
+		if l.metrics[m.Name] {
+			metrics[n] = m
+			n++
+		}
+	}
+	return metrics[:n]
+}
+
+// allowMeta removes Meta keys not in the allowlist (option meta-allowlist) from
+// all metrics. Meta is copied like includeIdentity, and it's nil if no keys
+// are allowed.
+func allowMeta(metrics []blip.MetricValue, allow map[string]bool) {
+	for i := range metrics {
+		var meta map[string]string
+		for k, v := range metrics[i].Meta {
+			if !allow[k] {
+				continue
+			}
+			if meta == nil {
+				meta = map[string]string{}
+			}
+			meta[k] = v
+		}
+		metrics[i].Meta = meta
+	}
+}
+
+// includeTraceId adds Meta trace_id to repl.lag.current metrics (option
+// include-trace-id): the trace ID from the Collect context (blip.WithTraceId),
+// for sinks that link lag spikes to traces (exemplars). Meta is copied like
+// includeIdentity.
+func includeTraceId(metrics []blip.MetricValue, traceId string) {
+	for i := range metrics {
+		if metrics[i].Name != "current" {
+			continue
+		}
+		meta := make(map[string]string, len(metrics[i].Meta)+1)
+		for k, v := range metrics[i].Meta {
+			meta[k] = v
+		}
+		meta["trace_id"] = traceId
+		metrics[i].Meta = meta
+	}
+}
+
+// parseUnit returns true if lag is reported in seconds: option unit=s, or
+// sink-unit=auto and the sinks prefer seconds (blip.SinkUnitFrom).
+func parseUnit(ctx context.Context, levelName string, opts map[string]string) (bool, error) {
+	unit := opts[OPT_UNIT]
+	switch opts[OPT_SINK_UNIT] {
+	case "", "no":
+	case "auto":
+		switch sinkUnit := blip.SinkUnitFrom(ctx); sinkUnit {
+		case "":
+			Log.Debug("repl.lag: %s: %s=auto: no sink unit, using %s %q", levelName, OPT_SINK_UNIT, OPT_UNIT, unit)
+		case blip.UNIT_S, blip.UNIT_MS:
+			Log.Debug("repl.lag: %s: %s=auto: sink unit %s", levelName, OPT_SINK_UNIT, sinkUnit)
+			unit = sinkUnit
+		default:
+			Log.Warn("repl.lag: %s: %s=auto: invalid sink unit %q ignored, using %s %q", levelName, OPT_SINK_UNIT, sinkUnit, OPT_UNIT, unit)
+		}
+	default:
+		return false, fmt.Errorf("invalid %s: %q; valid values: auto, no", OPT_SINK_UNIT, opts[OPT_SINK_UNIT])
+	}
+	switch unit {
+	case "", UNIT_MS:
+		return false, nil
+	case UNIT_S:
+		return true, nil
+	default:
+		return false, fmt.Errorf("invalid %s: %q; valid values: ms, s", OPT_UNIT, unit)
+	}
+}
+
+// parseRound returns the round option value, or an error if it's invalid. It's
+// an empty string (none) if not set.
+func parseRound(opts map[string]string) (string, error) {
+	switch round := opts[OPT_ROUND]; round {
+	case "", ROUND_NONE, ROUND_FLOOR, ROUND_CEIL, ROUND_NEAREST:
+		return round, nil
+	default:
+		return "", fmt.Errorf("invalid %s: %q; valid values: none, floor, ceil, nearest", OPT_ROUND, round)
+	}
+}
+
+// toSeconds converts repl.lag.current from milliseconds to seconds and adds
+// meta unit=s. Absent values (-1 and NaN) are not converted. It's done after
+// trend, which is always milliseconds per second.
+func toSeconds(metrics []blip.MetricValue) {
+	for i := range metrics {
+		if metrics[i].Name != "current" {
+			continue
+		}
+		if !absent(metrics[i].Value) {
+			metrics[i].Value /= 1000
+		}
+		meta := make(map[string]string, len(metrics[i].Meta)+1)
+		for k, v := range metrics[i].Meta {
+			meta[k] = v
+		}
+		meta["unit"] = UNIT_S
+		metrics[i].Meta = meta
+	}
+}
+
+// seriesKey returns a key that identifies the lag series of m: channel (pfs),
+// source (blip with multiple heartbeat tables), backend (proxysql), or source
+// role (blip with multiple source roles).
+func seriesKey(m blip.MetricValue) string {
+	return m.Group["channel"] + "|" + m.Meta["source"] + "|" + m.Meta["backend"] + "|" + m.Meta["source_role"]
+}
+
+// roundLag rounds v by the round option mode. Absent values (-1 and NaN) are
+// not changed.
+func roundLag(mode string, v float64) float64 {
+	if absent(v) {
+		return v
+	}
+	switch mode {
+	case ROUND_FLOOR:
+		return math.Floor(v)
+	case ROUND_CEIL:
+		return math.Ceil(v)
+	case ROUND_NEAREST:
+		return math.Round(v)
+	}
+	return v
+}
+
+// openMySQL opens a connection pool to the MySQL instance. It's the default
+// Lag.openDB func for source-dsn.
+func openMySQL(dsn string) (*sql.DB, error) {
+	db, err := sql.Open("mysql", dsn)
+	if err != nil {
+		return nil, err
+	}
+	db.SetMaxOpenConns(1)
+	return db, nil
+}
+
+// absent returns true if v is an absent value. While collecting, absent values
+// are NaN, so a real lag of -1 (like from clock-offset-ms) is not absent, and
+// reportAbsent reports them as the absent-value.
+func absent(v float64) bool {
+	return math.IsNaN(v)
+}
+
+// absentMetrics are the metrics that have absent values (see reportAbsent).
+var absentMetrics = map[string]bool{
+	"current":      true,
+	"pos_backlog":  true,
+	"file_backlog": true,
+}
+
+// reportAbsent sets absent values (NaN while collecting) to the absent-value:
+// -1 or NaN. It's the last step before returning metrics from collection.
+func reportAbsent(metrics []blip.MetricValue, absentValue float64) {
+	if math.IsNaN(absentValue) {
+		return
+	}
+	for i := range metrics {
+		if absentMetrics[metrics[i].Name] && absent(metrics[i].Value) {
+			metrics[i].Value = absentValue
+		}
 	}
-	return []blip.MetricValue{m}, nil
 }
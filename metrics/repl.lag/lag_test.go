@@ -4,11 +4,25 @@ package repllag
 
 import (
 	"context"
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
+	"github.com/go-sql-driver/mysql"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 
+	"github.com/cashapp/blip"
+	"github.com/cashapp/blip/heartbeat"
+	"github.com/cashapp/blip/sqlutil"
 	"github.com/cashapp/blip/test"
+	"github.com/cashapp/blip/test/mock"
 )
 
 func TestPrepareForSingleLevelAndNoSourceOnMySQL57(t *testing.T) {
@@ -132,3 +146,5960 @@ func TestCollectWithAllSources(t *testing.T) {
 		assert.Equal(t, 0, len(metrics))
 	}
 }
+
+func TestTrend(t *testing.T) {
+	// Lag decreases (catching up) then increases (falling behind). Trend is
+	// change in lag (ms) per second, so positive = falling behind.
+	l := &lagLevel{reportTrend: true, last: map[string]lagSample{}}
+	t0 := time.Now()
+	lags := []float64{5000, 3000, 1000, 2000, 6000}
+	expect := [][]float64{
+		nil,     // first sample: no trend
+		{-1000}, // -2000 ms in 2s
+		{-1000},
+		{500},
+		{2000},
+	}
+	for i := range lags {
+		metrics := []blip.MetricValue{{Name: "current", Type: blip.GAUGE, Value: lags[i]}}
+		got := l.trend(metrics, t0.Add(time.Duration(i*2)*time.Second))
+		var trend []float64
+		for _, m := range got {
+			if m.Name == "trend" {
+				trend = append(trend, m.Value)
+			}
+		}
+		assert.Equal(t, expect[i], trend, "sample %d", i)
+	}
+
+	// Same timestamp: no divide by zero, no trend
+	ts := t0.Add(time.Minute)
+	l.trend([]blip.MetricValue{{Name: "current", Value: 1}}, ts)
+	got := l.trend([]blip.MetricValue{{Name: "current", Value: 2}}, ts)
+	assert.Len(t, got, 1)
+
+	// Trend is per channel
+	l = &lagLevel{reportTrend: true, last: map[string]lagSample{}}
+	ch1 := map[string]string{"channel": "ch1"}
+	ch2 := map[string]string{"channel": "ch2"}
+	l.trend([]blip.MetricValue{{Name: "current", Value: 100, Group: ch1}, {Name: "current", Value: 100, Group: ch2}}, t0)
+	got = l.trend([]blip.MetricValue{{Name: "current", Value: 200, Group: ch1}, {Name: "current", Value: 50, Group: ch2}}, t0.Add(time.Second))
+	assert.Len(t, got, 4)
+	assert.Equal(t, blip.MetricValue{Name: "trend", Type: blip.GAUGE, Value: 100, Group: ch1}, got[2])
+	assert.Equal(t, blip.MetricValue{Name: "trend", Type: blip.GAUGE, Value: -50, Group: ch2}, got[3])
+
+	// Absent (no heartbeat or not a replica) restarts the trend
+	got = l.trend([]blip.MetricValue{{Name: "current", Value: math.NaN(), Group: ch1}}, t0.Add(2*time.Second))
+	assert.Len(t, got, 1)
+	got = l.trend([]blip.MetricValue{{Name: "current", Value: 300, Group: ch1}}, t0.Add(3*time.Second))
+	assert.Len(t, got, 1)
+}
+
+// --------------------------------------------------------------------------
+
+// lagPlan returns a plan with one level, kpi, that collects repl.lag with
+// the given options.
+func lagPlan(opts map[string]string) blip.Plan {
+	return blip.Plan{
+		Name:      "test",
+		MonitorId: "m1",
+		Levels: map[string]blip.Level{
+			"kpi": {
+				Name: "kpi",
+				Freq: "1s",
+				Collect: map[string]blip.Domain{
+					DOMAIN: {Name: DOMAIN, Options: opts},
+				},
+			},
+		},
+	}
+}
+
+// heartbeatResult returns a mock heartbeat read result: one row with lag
+// milliseconds between NOW(3) and ts.
+func heartbeatResult(srcId string, lag time.Duration) mock.SQLResult {
+	now := time.Now()
+	return mock.SQLResult{
+		Columns: []string{"NOW(3)", "ts", "freq", "src_id", "1"},
+		Rows:    [][]driver.Value{{now, now.Add(-lag), int64(1000), srcId, int64(1)}},
+	}
+}
+
+// waitFor waits up to 2s for f to return true.
+func waitFor(t *testing.T, f func() bool) {
+	t.Helper()
+	for i := 0; i < 200; i++ {
+		if f() {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("timeout waiting for condition")
+}
+
+func TestSourceDSN(t *testing.T) {
+	// With source-dsn, the heartbeat is read from a separate connection pool
+	// that's closed by the cleanup func
+	local := mock.NewSQL(nil)
+	src := mock.NewSQL(map[string]mock.SQLResult{
+		"heartbeat": heartbeatResult("source1", 0),
+	})
+
+	var gotDSN string
+	var srcDB *sql.DB
+	c := NewLag(local.DB())
+	c.openDB = func(dsn string) (*sql.DB, error) {
+		gotDSN = dsn
+		srcDB = src.DB()
+		return srcDB, nil
+	}
+
+	plan := lagPlan(map[string]string{
+		OPT_WRITER:     LAG_WRITER_BLIP,
+		OPT_SOURCE_DSN: "blip@tcp(source1:3306)/",
+	})
+	cleanup, err := c.Prepare(context.Background(), plan)
+	require.NoError(t, err)
+	require.NotNil(t, cleanup)
+	assert.Equal(t, "blip@tcp(source1:3306)/", gotDSN)
+
+	waitFor(t, func() bool { return src.Count("heartbeat") > 0 })
+	assert.Equal(t, 0, local.Count("heartbeat"), "heartbeat read from local DB, expected source DB")
+
+	require.NoError(t, srcDB.Ping())
+	cleanup()
+	assert.Error(t, srcDB.Ping(), "source DB not closed by cleanup")
+}
+
+// pfsResult returns a mock PFS lag query result with the given rows.
+func pfsResult(rows ...[]driver.Value) mock.SQLResult {
+	columns := []string{"CHANNEL_NAME", "LAST_QUEUED_TRANSACTION", "io_thd", "sql_thd", "LAST_PROCESSED_TRANSACTION",
+		"WORKER_ID", "LAST_APPLIED_TRANSACTION", "now", "last_applied_ts", "last_applied_lag", "applying_ts", "source_host", "source_uuid",
+		"last_applied_end_ts", "last_queued_lag", "processing_ts"}
+	for i := range rows {
+		for len(rows[i]) < len(columns) {
+			rows[i] = append(rows[i], nil) // NULL optional columns
+		}
+	}
+	return mock.SQLResult{Columns: columns, Rows: rows}
+}
+
+func TestErrorBackoff(t *testing.T) {
+	// After ErrorBackoffAfter consecutive errors, Collect skips querying for
+	// 1, 2, 4, ... collections, then resets on success
+	m := mock.NewSQL(map[string]mock.SQLResult{
+		"replication_applier_status_by_worker": pfsResult(), // not a replica
+		"replication_connection_status":        {},
+	})
+	c := NewLag(m.DB())
+	_, err := c.Prepare(context.Background(), lagPlan(map[string]string{OPT_WRITER: LAG_WRITER_PFS}))
+	require.NoError(t, err)
+
+	m.Set("replication_applier_status_by_worker", mock.SQLResult{Err: fmt.Errorf("replica broken")})
+	queries := func() int { return m.Count("replication_applier_status_by_worker") }
+	q0 := queries() // from Prepare
+
+	// Collect: 1  2  3  4  5  6  7  8  9  ...
+	// Query:   y  y  y  n  y  n  n  y  n n n n
+	expect := []bool{true, true, true, false, true, false, false, true, false, false, false, false}
+	for i, queried := range expect {
+		before := queries()
+		_, err := c.Collect(context.Background(), "kpi")
+		assert.Error(t, err, "collect %d", i+1)
+		assert.Equal(t, queried, queries() > before, "collect %d queried", i+1)
+	}
+	assert.Equal(t, 5, queries()-q0, "total queries")
+
+	// Success resets backoff after the current backoff (4 skips) is done.
+	// No workers is not a replica: no metrics, intentionally (not an error).
+	m.Set("replication_applier_status_by_worker", pfsResult())
+	_, err = c.Collect(context.Background(), "kpi")
+	require.ErrorIs(t, err, blip.ErrNoMetrics)
+	assert.Equal(t, 0, c.atLevel["kpi"].errCount)
+	before := queries()
+	_, err = c.Collect(context.Background(), "kpi")
+	require.ErrorIs(t, err, blip.ErrNoMetrics)
+	assert.Equal(t, before+1, queries())
+}
+
+func TestPFSFallbackNoWorkers(t *testing.T) {
+	// If replication_applier_status_by_worker is empty, lag is estimated from
+	// replication_connection_status and replication_applier_status
+	fallback := mock.SQLResult{
+		Columns: []string{"CHANNEL_NAME", "io_thd", "sql_thd", "now", "last_queued_ts", "last_queued_lag", "source_host", "source_uuid"},
+		Rows: [][]driver.Value{
+			{"", "ON", "ON", 1716922205.5, 1716922205.0, 250000.0, "", ""},   // 250 ms queue lag
+			{"ch2", "OFF", "ON", 1716922205.5, 1716922203.5, 1000.0, "", ""}, // stopped: 2000 ms since last queued
+		},
+	}
+	for _, replCheck := range []string{"", "read_only"} {
+		m := mock.NewSQL(map[string]mock.SQLResult{
+			"replication_applier_status_by_worker": pfsResult(), // no workers
+			"LAST_QUEUED_TRANSACTION_END_QUEUE":    fallback,
+			"SELECT @@`read_only`":                 {Columns: []string{"@@read_only"}, Rows: [][]driver.Value{{int64(1)}}},
+		})
+		c := NewLag(m.DB())
+		plan := lagPlan(map[string]string{
+			OPT_WRITER:               LAG_WRITER_PFS,
+			OPT_REPL_CHECK:           replCheck,
+			OPT_DEFAULT_CHANNEL_NAME: "default",
+		})
+		_, err := c.Prepare(context.Background(), plan)
+		require.NoError(t, err, "repl-check=%s", replCheck)
+
+		metrics, err := c.Collect(context.Background(), "kpi")
+		require.NoError(t, err, "repl-check=%s", replCheck)
+		expect := []blip.MetricValue{
+			{Name: "current", Type: blip.GAUGE, Value: 250, Group: map[string]string{"channel": "default"}, Meta: map[string]string{"source_table": SOURCE_TABLE_CONNECTION}},
+			{Name: "current", Type: blip.GAUGE, Value: 2000, Group: map[string]string{"channel": "ch2"}, Meta: map[string]string{"source_table": SOURCE_TABLE_CONNECTION}},
+		}
+		assert.Equal(t, expect, metrics, "repl-check=%s", replCheck)
+		if replCheck != "" {
+			assert.True(t, m.Count("SELECT @@`read_only`") > 0, "repl-check=%s not queried", replCheck)
+		}
+	}
+
+	// No rows in the fallback tables either: not a replica
+	m := mock.NewSQL(map[string]mock.SQLResult{
+		"replication_applier_status_by_worker": pfsResult(),
+		"LAST_QUEUED_TRANSACTION_END_QUEUE":    {Columns: fallback.Columns},
+	})
+	c := NewLag(m.DB())
+	plan := lagPlan(map[string]string{OPT_WRITER: LAG_WRITER_PFS, OPT_REPORT_NOT_A_REPLICA: "yes"})
+	_, err := c.Prepare(context.Background(), plan)
+	require.NoError(t, err)
+	metrics, err := c.Collect(context.Background(), "kpi")
+	require.NoError(t, err)
+	assert.Equal(t, []blip.MetricValue{{Name: "current", Type: blip.GAUGE, Value: -1}}, metrics)
+
+	// NULL timestamps (nothing queued yet) are zero: idle, not an error
+	m = mock.NewSQL(map[string]mock.SQLResult{
+		"replication_applier_status_by_worker": pfsResult(),
+		"LAST_QUEUED_TRANSACTION_END_QUEUE": {
+			Columns: fallback.Columns,
+			Rows:    [][]driver.Value{{"", "ON", "ON", 1716922205.5, nil, nil, "", ""}},
+		},
+	})
+	c = NewLag(m.DB())
+	_, err = c.Prepare(context.Background(), plan)
+	require.NoError(t, err)
+	metrics, err = c.Collect(context.Background(), "kpi")
+	require.NoError(t, err)
+	assert.Equal(t, []blip.MetricValue{{Name: "current", Type: blip.GAUGE, Value: 0, Group: map[string]string{"channel": ""}, Meta: map[string]string{"source_table": SOURCE_TABLE_CONNECTION}}}, metrics)
+}
+
+func TestReportOptsUnset(t *testing.T) {
+	// Defaults (no) apply only if the options are unset: not in the map or
+	// empty, like an env var that interpolates to "". Explicit values are used.
+	tests := []struct {
+		opts    map[string]string
+		noHB    bool
+		notRepl bool
+	}{
+		{map[string]string{}, false, false},
+		{map[string]string{OPT_REPORT_NO_HEARTBEAT: "", OPT_REPORT_NOT_A_REPLICA: " "}, false, false},
+		{map[string]string{OPT_REPORT_NO_HEARTBEAT: "no", OPT_REPORT_NOT_A_REPLICA: "no"}, false, false},
+		{map[string]string{OPT_REPORT_NO_HEARTBEAT: "yes", OPT_REPORT_NOT_A_REPLICA: "no"}, true, false},
+		{map[string]string{OPT_REPORT_NO_HEARTBEAT: "no", OPT_REPORT_NOT_A_REPLICA: "yes"}, false, true},
+	}
+	for _, tc := range tests {
+		assert.Equal(t, tc.noHB, reportNoHeartbeat(tc.opts), "%v", tc.opts)
+		assert.Equal(t, tc.notRepl, reportNotAReplica(tc.opts), "%v", tc.opts)
+	}
+
+	// Unset and explicit no are different to BoolOpt, but both drop
+	_, set := blip.BoolOpt(map[string]string{}, OPT_REPORT_NO_HEARTBEAT)
+	assert.False(t, set)
+	_, set = blip.BoolOpt(map[string]string{OPT_REPORT_NO_HEARTBEAT: "no"}, OPT_REPORT_NO_HEARTBEAT)
+	assert.True(t, set)
+}
+
+func TestAbsentValue(t *testing.T) {
+	// absent-value controls repl.lag.current when no heartbeat (blip writer)
+	// or not a replica (pfs writer), and it overrides report-no-heartbeat and
+	// report-not-a-replica. Without absent-value, those options work as before.
+	tests := []struct {
+		opts   map[string]string
+		expect string // -1, nan, or drop
+	}{
+		{map[string]string{OPT_ABSENT_VALUE: "-1"}, "-1"},
+		{map[string]string{OPT_ABSENT_VALUE: "nan"}, "nan"},
+		{map[string]string{OPT_ABSENT_VALUE: "drop"}, "drop"},
+		{map[string]string{OPT_ABSENT_VALUE: "drop", OPT_REPORT_NO_HEARTBEAT: "yes", OPT_REPORT_NOT_A_REPLICA: "yes"}, "drop"},
+		{map[string]string{OPT_REPORT_NO_HEARTBEAT: "yes", OPT_REPORT_NOT_A_REPLICA: "yes"}, "-1"},
+		{map[string]string{}, "drop"},
+		{map[string]string{OPT_REPORT_NO_HEARTBEAT: "no", OPT_REPORT_NOT_A_REPLICA: "no"}, "drop"},
+		{map[string]string{OPT_REPORT_NO_HEARTBEAT: "", OPT_REPORT_NOT_A_REPLICA: ""}, "drop"}, // unset: default
+	}
+	for _, writer := range []string{LAG_WRITER_BLIP, LAG_WRITER_PFS} {
+		for _, tc := range tests {
+			m := mock.NewSQL(map[string]mock.SQLResult{
+				"heartbeat":                            {Columns: []string{"NOW(3)", "ts", "freq", "src_id", "1"}}, // no heartbeat
+				"replication_applier_status_by_worker": pfsResult(),                                                // not a replica
+				"replication_connection_status":        {},
+			})
+			c := NewLag(m.DB())
+			opts := map[string]string{OPT_WRITER: writer}
+			for k, v := range tc.opts {
+				opts[k] = v
+			}
+			cleanup, err := c.Prepare(context.Background(), lagPlan(opts))
+			require.NoError(t, err)
+
+			metrics, err := c.Collect(context.Background(), "kpi")
+			if tc.expect == "drop" && writer == LAG_WRITER_PFS {
+				require.ErrorIs(t, err, blip.ErrNoMetrics) // not a replica: intentional
+			} else {
+				require.NoError(t, err) // no heartbeat: no data
+			}
+			switch tc.expect {
+			case "drop":
+				assert.Empty(t, metrics, "%s %v", writer, tc.opts)
+			case "nan":
+				require.Len(t, metrics, 1, "%s %v", writer, tc.opts)
+				assert.True(t, math.IsNaN(metrics[0].Value), "%s %v: got %f, expected NaN", writer, tc.opts, metrics[0].Value)
+			default:
+				require.Len(t, metrics, 1, "%s %v", writer, tc.opts)
+				assert.Equal(t, float64(-1), metrics[0].Value, "%s %v", writer, tc.opts)
+			}
+			if cleanup != nil {
+				cleanup()
+			}
+		}
+	}
+
+	// Invalid value
+	c := NewLag(mock.NewSQL(nil).DB())
+	_, err := c.Prepare(context.Background(), lagPlan(map[string]string{OPT_ABSENT_VALUE: "zero"}))
+	assert.Error(t, err)
+}
+
+func TestAbsentValueRealNeg1(t *testing.T) {
+	// A real lag of -1 ms (clock-offset-ms 1 with 0 lag) is not absent: it's
+	// converted to seconds, and absent-value=nan doesn't change it
+	for _, absent := range []string{"-1", "nan"} {
+		r := &fakeReader{lag: heartbeat.Lag{Milliseconds: 0, SourceId: "source1", Replica: true}}
+		c := NewLagWithReader(mock.NewSQL(nil).DB(), r)
+		_, err := c.Prepare(context.Background(), lagPlan(map[string]string{
+			OPT_WRITER:       LAG_WRITER_BLIP,
+			OPT_CLOCK_OFFSET: "1",
+			OPT_UNIT:         UNIT_S,
+			OPT_ABSENT_VALUE: absent,
+		}))
+		require.NoError(t, err)
+		metrics, err := c.Collect(context.Background(), "kpi")
+		require.NoError(t, err)
+		require.Len(t, metrics, 1, absent)
+		assert.Equal(t, -0.001, metrics[0].Value, absent)
+	}
+
+	// Absent is still reported as -1, not converted to seconds
+	r := &fakeReader{lag: heartbeat.Lag{Milliseconds: -1, Replica: true}} // no heartbeat
+	c := NewLagWithReader(mock.NewSQL(nil).DB(), r)
+	_, err := c.Prepare(context.Background(), lagPlan(map[string]string{
+		OPT_WRITER:       LAG_WRITER_BLIP,
+		OPT_UNIT:         UNIT_S,
+		OPT_ABSENT_VALUE: "-1",
+	}))
+	require.NoError(t, err)
+	metrics, err := c.Collect(context.Background(), "kpi")
+	require.NoError(t, err)
+	require.Len(t, metrics, 1)
+	assert.Equal(t, float64(-1), metrics[0].Value)
+}
+
+func TestReaderNotRunning(t *testing.T) {
+	// If the heartbeat reader goroutine exits, Collect returns an error
+	// instead of the last (stale) lag. First, reader crashes (panic).
+	m := mock.NewSQL(nil)
+	m.QueryFunc = func(query string) (mock.SQLResult, bool) {
+		if strings.Contains(query, "heartbeat") { // reader query, not Prepare
+			panic("test panic")
+		}
+		return mock.SQLResult{}, false
+	}
+	c := NewLag(m.DB())
+	cleanup, err := c.Prepare(context.Background(), lagPlan(map[string]string{OPT_WRITER: LAG_WRITER_BLIP}))
+	require.NoError(t, err)
+	defer cleanup()
+
+	waitFor(t, func() bool { return !c.lagReaders[0].Alive() })
+	_, err = c.Collect(context.Background(), "kpi")
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "test panic")
+
+	// Second, reader stopped
+	m = mock.NewSQL(map[string]mock.SQLResult{
+		"heartbeat": heartbeatResult("source1", 0),
+	})
+	c = NewLag(m.DB())
+	cleanup, err = c.Prepare(context.Background(), lagPlan(map[string]string{OPT_WRITER: LAG_WRITER_BLIP}))
+	require.NoError(t, err)
+	_, err = c.Collect(context.Background(), "kpi")
+	require.NoError(t, err)
+
+	cleanup()
+	waitFor(t, func() bool { return !c.lagReaders[0].Alive() })
+	_, err = c.Collect(context.Background(), "kpi")
+	assert.Error(t, err)
+}
+
+func TestProxySQL(t *testing.T) {
+	// ProxySQL reports lag per backend (Meta "backend") from the latest monitor
+	// check. repl_lag is seconds; NULL if the check failed, which is dropped by
+	// default like no heartbeat.
+	m := mock.NewSQL(map[string]mock.SQLResult{
+		"COUNT(*) FROM monitor.mysql_server_replication_lag_log": {
+			Columns: []string{"COUNT(*)"},
+			Rows:    [][]driver.Value{{int64(3)}},
+		},
+		"mysql_server_replication_lag_log": {
+			Columns: []string{"hostname", "port", "repl_lag"},
+			Rows: [][]driver.Value{
+				{"db1", int64(3306), float64(0)},
+				{"db2", int64(3306), float64(2)},
+				{"db3", int64(3307), nil},
+			},
+		},
+	})
+	// Auto-detect: PFS query fails (no result in mock), ProxySQL probe works
+	c := NewLag(m.DB())
+	_, err := c.Prepare(context.Background(), lagPlan(map[string]string{}))
+	require.NoError(t, err)
+	assert.Equal(t, LAG_WRITER_PROXYSQL, c.lagWriterIn["kpi"])
+
+	metrics, err := c.Collect(context.Background(), "kpi")
+	require.NoError(t, err)
+	expect := []blip.MetricValue{
+		{Name: "current", Type: blip.GAUGE, Value: 0, Meta: map[string]string{"backend": "db1:3306"}},
+		{Name: "current", Type: blip.GAUGE, Value: 2000, Meta: map[string]string{"backend": "db2:3306"}},
+	}
+	assert.Equal(t, expect, metrics)
+
+	// report-no-heartbeat=yes reports failed check as -1
+	c = NewLag(m.DB())
+	_, err = c.Prepare(context.Background(), lagPlan(map[string]string{
+		OPT_WRITER:              LAG_WRITER_PROXYSQL,
+		OPT_REPORT_NO_HEARTBEAT: "yes",
+	}))
+	require.NoError(t, err)
+	metrics, err = c.Collect(context.Background(), "kpi")
+	require.NoError(t, err)
+	require.Len(t, metrics, 3)
+	assert.Equal(t, float64(-1), metrics[2].Value)
+	assert.Equal(t, "db3:3307", metrics[2].Meta["backend"])
+
+	// Not ProxySQL: auto doesn't choose proxysql
+	m = mock.NewSQL(map[string]mock.SQLResult{
+		"heartbeat": heartbeatResult("source1", 0),
+	})
+	c = NewLag(m.DB())
+	cleanup, err := c.Prepare(context.Background(), lagPlan(map[string]string{}))
+	require.NoError(t, err)
+	defer cleanup()
+	assert.Equal(t, LAG_WRITER_BLIP, c.lagWriterIn["kpi"])
+}
+
+func groupReplResult(state string, certQueue, applyQueue int64) mock.SQLResult {
+	return mock.SQLResult{
+		Columns: []string{"MEMBER_ID", "MEMBER_HOST", "MEMBER_PORT", "MEMBER_STATE", "COUNT_TRANSACTIONS_IN_QUEUE", "COUNT_TRANSACTIONS_REMOTE_IN_APPLIER_QUEUE"},
+		Rows:    [][]driver.Value{{"3e11fa47-71ca-11e1-9e33-c80aa9429562", "db2", int64(3306), state, certQueue, applyQueue}},
+	}
+}
+
+func TestGroupReplication(t *testing.T) {
+	// Lag is transactions in the certification and applier queues of the
+	// monitored member, with Meta "member"
+	m := mock.NewSQL(map[string]mock.SQLResult{
+		"COUNT(*) FROM performance_schema.replication_group_members": {
+			Columns: []string{"COUNT(*)"},
+			Rows:    [][]driver.Value{{int64(1)}},
+		},
+		"replication_group_member_stats": groupReplResult("ONLINE", 2, 40),
+	})
+	// Auto-detect: group member, before PFS
+	c := NewLag(m.DB())
+	_, err := c.Prepare(context.Background(), lagPlan(map[string]string{}))
+	require.NoError(t, err)
+	assert.Equal(t, LAG_WRITER_GROUP, c.lagWriterIn["kpi"])
+	assert.Equal(t, 0, m.Count("replication_applier_status_by_worker"))
+
+	metrics, err := c.Collect(context.Background(), "kpi")
+	require.NoError(t, err)
+	expect := []blip.MetricValue{{Name: "current", Type: blip.GAUGE, Value: 42, Meta: map[string]string{"member": "db2:3306"}}}
+	assert.Equal(t, expect, metrics)
+
+	// Member in error state: dropped by default, like no heartbeat
+	m.Set("replication_group_member_stats", groupReplResult("ERROR", 0, 0))
+	metrics, err = c.Collect(context.Background(), "kpi")
+	require.NoError(t, err)
+	assert.Empty(t, metrics)
+
+	// report-no-heartbeat=yes reports -1
+	c = NewLag(m.DB())
+	_, err = c.Prepare(context.Background(), lagPlan(map[string]string{
+		OPT_WRITER:              LAG_WRITER_GROUP,
+		OPT_REPORT_NO_HEARTBEAT: "yes",
+	}))
+	require.NoError(t, err)
+	metrics, err = c.Collect(context.Background(), "kpi")
+	require.NoError(t, err)
+	expect = []blip.MetricValue{{Name: "current", Type: blip.GAUGE, Value: -1, Meta: map[string]string{"member": "db2:3306"}}}
+	assert.Equal(t, expect, metrics)
+
+	// Not in a group (no rows): not a replica
+	m.Set("replication_group_member_stats", mock.SQLResult{Columns: groupReplResult("", 0, 0).Columns})
+	c = NewLag(m.DB())
+	_, err = c.Prepare(context.Background(), lagPlan(map[string]string{
+		OPT_WRITER:               LAG_WRITER_GROUP,
+		OPT_REPORT_NOT_A_REPLICA: "yes",
+	}))
+	require.NoError(t, err)
+	metrics, err = c.Collect(context.Background(), "kpi")
+	require.NoError(t, err)
+	assert.Equal(t, []blip.MetricValue{{Name: "current", Type: blip.GAUGE, Value: -1}}, metrics)
+
+	// Not a group member: auto doesn't choose group-replication
+	m = mock.NewSQL(map[string]mock.SQLResult{
+		"COUNT(*) FROM performance_schema.replication_group_members": {
+			Columns: []string{"COUNT(*)"},
+			Rows:    [][]driver.Value{{int64(0)}},
+		},
+		"heartbeat": heartbeatResult("source1", 0),
+	})
+	c = NewLag(m.DB())
+	cleanup, err := c.Prepare(context.Background(), lagPlan(map[string]string{}))
+	require.NoError(t, err)
+	defer cleanup()
+	assert.Equal(t, LAG_WRITER_BLIP, c.lagWriterIn["kpi"])
+}
+
+// mariadbResult returns SHOW ALL SLAVES STATUS rows: connection name, source
+// host, and Seconds_Behind_Master (nil for NULL).
+func mariadbResult(rows ...[]driver.Value) mock.SQLResult {
+	return mock.SQLResult{
+		Columns: []string{"Connection_name", "Slave_SQL_State", "Slave_IO_State", "Master_Host", "Master_Port", "Slave_IO_Running", "Slave_SQL_Running", "Seconds_Behind_Master", "Gtid_Slave_Pos"},
+		Rows:    rows,
+	}
+}
+
+func TestMariaDB(t *testing.T) {
+	// Multi-source: one row per connection; default connection is ""
+	m := mock.NewSQL(map[string]mock.SQLResult{
+		"SELECT @@version, @@version_comment": {
+			Columns: []string{"@@version", "@@version_comment"},
+			Rows:    [][]driver.Value{{"10.11.6-MariaDB-log", "MariaDB Server"}},
+		},
+		"SHOW ALL SLAVES STATUS": mariadbResult(
+			[]driver.Value{"", "Slave has read all relay log", "Waiting for master", "db1", "3306", "Yes", "Yes", "0", "0-1-100"},
+			[]driver.Value{"east", "Slave has read all relay log", "Waiting for master", "db2", "3306", "Yes", "Yes", "5", "1-2-200"},
+			[]driver.Value{"west", "", "", "db3", "3306", "Yes", "No", nil, "2-3-300"},
+		),
+	})
+
+	// Auto-detect: MariaDB, before PFS
+	c := NewLag(m.DB())
+	_, err := c.Prepare(context.Background(), lagPlan(map[string]string{
+		OPT_DEFAULT_CHANNEL_NAME: "main",
+	}))
+	require.NoError(t, err)
+	assert.Equal(t, LAG_WRITER_MARIADB, c.lagWriterIn["kpi"])
+	assert.Equal(t, 0, m.Count("replication_applier_status_by_worker"))
+
+	// NULL Seconds_Behind_Master (west) dropped by default, like no heartbeat
+	metrics, err := c.Collect(context.Background(), "kpi")
+	require.NoError(t, err)
+	expect := []blip.MetricValue{
+		{Name: "current", Type: blip.GAUGE, Value: 0, Group: map[string]string{"channel": "main"}, Meta: map[string]string{"source": "db1"}},
+		{Name: "current", Type: blip.GAUGE, Value: 5000, Group: map[string]string{"channel": "east"}, Meta: map[string]string{"source": "db2"}},
+	}
+	assert.Equal(t, expect, metrics)
+
+	// report-no-heartbeat=yes reports -1, and channel collects one connection
+	c = NewLag(m.DB())
+	_, err = c.Prepare(context.Background(), lagPlan(map[string]string{
+		OPT_WRITER:              LAG_WRITER_MARIADB,
+		OPT_REPORT_NO_HEARTBEAT: "yes",
+		OPT_CHANNEL:             "west",
+	}))
+	require.NoError(t, err)
+	metrics, err = c.Collect(context.Background(), "kpi")
+	require.NoError(t, err)
+	expect = []blip.MetricValue{
+		{Name: "current", Type: blip.GAUGE, Value: -1, Group: map[string]string{"channel": "west"}, Meta: map[string]string{"source": "db3"}},
+	}
+	assert.Equal(t, expect, metrics)
+
+	// Not a replica (no rows)
+	m.Set("SHOW ALL SLAVES STATUS", mariadbResult())
+	c = NewLag(m.DB())
+	_, err = c.Prepare(context.Background(), lagPlan(map[string]string{
+		OPT_WRITER:               LAG_WRITER_MARIADB,
+		OPT_REPORT_NOT_A_REPLICA: "yes",
+	}))
+	require.NoError(t, err)
+	metrics, err = c.Collect(context.Background(), "kpi")
+	require.NoError(t, err)
+	assert.Equal(t, []blip.MetricValue{{Name: "current", Type: blip.GAUGE, Value: -1}}, metrics)
+
+	// MySQL: auto doesn't choose mariadb
+	m = mock.NewSQL(map[string]mock.SQLResult{
+		"SELECT @@version, @@version_comment": {
+			Columns: []string{"@@version", "@@version_comment"},
+			Rows:    [][]driver.Value{{"8.0.36", "MySQL Community Server - GPL"}},
+		},
+		"heartbeat": heartbeatResult("source1", 0),
+	})
+	c = NewLag(m.DB())
+	cleanup, err := c.Prepare(context.Background(), lagPlan(map[string]string{}))
+	require.NoError(t, err)
+	defer cleanup()
+	assert.Equal(t, LAG_WRITER_BLIP, c.lagWriterIn["kpi"])
+	assert.Equal(t, 0, m.Count("SHOW ALL SLAVES STATUS"))
+}
+
+func TestRoundLag(t *testing.T) {
+	tests := []struct {
+		mode   string
+		in     float64
+		expect float64
+	}{
+		{ROUND_NONE, 1.4, 1.4},
+		{ROUND_NONE, 1.5, 1.5},
+		{ROUND_FLOOR, 1.4, 1},
+		{ROUND_FLOOR, 1.9, 1},
+		{ROUND_CEIL, 1.1, 2},
+		{ROUND_CEIL, 1.0, 1},
+		{ROUND_NEAREST, 1.4, 1},
+		{ROUND_NEAREST, 1.5, 2},
+		{ROUND_NEAREST, 0.5, 1},
+		{ROUND_NEAREST, -1, -1}, // absent value not changed
+		{ROUND_CEIL, -1, -1},
+	}
+	for _, tc := range tests {
+		got := roundLag(tc.mode, tc.in)
+		assert.Equal(t, tc.expect, got, "%s(%f)", tc.mode, tc.in)
+	}
+	assert.True(t, math.IsNaN(roundLag(ROUND_FLOOR, math.NaN())))
+
+	// Invalid value
+	c := NewLag(mock.NewSQL(nil).DB())
+	_, err := c.Prepare(context.Background(), lagPlan(map[string]string{OPT_ROUND: "up"}))
+	assert.Error(t, err)
+}
+
+func TestSourceMeta(t *testing.T) {
+	// All writers report Meta "source" the same way: the source host (or
+	// ID/UUID), and omit the key if unknown
+	uuid := "3e11fa47-71ca-11e1-9e33-c80aa9429562"
+	pfs := func(host string) mock.SQLResult {
+		return pfsResult([]driver.Value{"", uuid + ":10", "ON", "ON", uuid + ":10", int64(1), uuid + ":10",
+			1716922205.5, 1716922205.0, 0.0, 0.0, host, uuid})
+	}
+	tests := []struct {
+		writer string
+		result map[string]mock.SQLResult
+		expect map[string]string
+	}{
+		{LAG_WRITER_BLIP, map[string]mock.SQLResult{"heartbeat": heartbeatResult("db1", 0)}, map[string]string{"source": "db1"}},
+		{LAG_WRITER_BLIP, map[string]mock.SQLResult{"heartbeat": heartbeatResult("", 0)}, nil},
+		{LAG_WRITER_PFS, map[string]mock.SQLResult{"replication_applier_status_by_worker": pfs("db1")}, map[string]string{"source": "db1", "source_table": SOURCE_TABLE_WORKER}},
+		{LAG_WRITER_PFS, map[string]mock.SQLResult{"replication_applier_status_by_worker": pfs("")}, map[string]string{"source": uuid, "source_table": SOURCE_TABLE_WORKER}},
+	}
+	for _, tc := range tests {
+		m := mock.NewSQL(tc.result)
+		c := NewLag(m.DB())
+		cleanup, err := c.Prepare(context.Background(), lagPlan(map[string]string{OPT_WRITER: tc.writer}))
+		require.NoError(t, err)
+		if tc.writer == LAG_WRITER_BLIP {
+			// Wait for reader to read first heartbeat
+			waitFor(t, func() bool { lag, _ := c.lagReaders[0].Lag(context.Background()); return lag.Milliseconds >= 0 })
+		}
+		metrics, err := c.Collect(context.Background(), "kpi")
+		require.NoError(t, err)
+		require.NotEmpty(t, metrics)
+		assert.Equal(t, tc.expect, metrics[0].Meta, "%s: %+v", tc.writer, metrics[0])
+		if cleanup != nil {
+			cleanup()
+		}
+	}
+}
+
+func TestPtHeartbeat(t *testing.T) {
+	// pt-heartbeat writes ts as a string; lag = NOW() - ts
+	m := mock.NewSQL(map[string]mock.SQLResult{
+		"percona": {
+			Columns: []string{"CAST(NOW(6) AS CHAR)", "CAST(`ts` AS CHAR)", "CAST(`server_id` AS CHAR)"},
+			Rows:    [][]driver.Value{{"2024-05-28 18:50:06.500000", "2024-05-28T18:50:05.001230", "101"}},
+		},
+	})
+	c := NewLag(m.DB())
+	_, err := c.Prepare(context.Background(), lagPlan(map[string]string{
+		OPT_WRITER:              LAG_WRITER_PT,
+		OPT_HEARTBEAT_SOURCE_ID: "101",
+	}))
+	require.NoError(t, err)
+	metrics, err := c.Collect(context.Background(), "kpi")
+	require.NoError(t, err)
+	expect := []blip.MetricValue{{Name: "current", Type: blip.GAUGE, Value: 1498, Meta: map[string]string{"source": "101"}}}
+	assert.Equal(t, expect, metrics)
+	assert.Equal(t, "SELECT CAST(NOW(6) AS CHAR), CAST(`ts` AS CHAR), CAST(`server_id` AS CHAR) FROM `percona`.`heartbeat` WHERE `server_id` = '101' ORDER BY `ts` DESC LIMIT 1",
+		c.atLevel["kpi"].ptQuery)
+
+	// Custom columns, table, and UTC
+	q := ptHeartbeatQuery(map[string]string{
+		OPT_HEARTBEAT_TABLE:     "hb.heartbeat",
+		OPT_PT_TS_COLUMN:        "ts2",
+		OPT_PT_SERVER_ID_COLUMN: "sid",
+		OPT_PT_UTC:              "yes",
+	})
+	assert.Equal(t, "SELECT CAST(UTC_TIMESTAMP(6) AS CHAR), CAST(`ts2` AS CHAR), CAST(`sid` AS CHAR) FROM `hb`.`heartbeat` ORDER BY `ts2` DESC LIMIT 1", q)
+
+	// Reserved words, dots, and backticks are quoted
+	q = ptHeartbeatQuery(map[string]string{
+		OPT_HEARTBEAT_TABLE:     "`my.db`.order",
+		OPT_PT_TS_COLUMN:        "time`stamp",
+		OPT_PT_SERVER_ID_COLUMN: "key",
+	})
+	assert.Equal(t, "SELECT CAST(NOW(6) AS CHAR), CAST(`time``stamp` AS CHAR), CAST(`key` AS CHAR) FROM `my.db`.`order` ORDER BY `time``stamp` DESC LIMIT 1", q)
+
+	// No heartbeat
+	m = mock.NewSQL(map[string]mock.SQLResult{"percona": {Columns: []string{"now", "ts", "server_id"}}})
+	c = NewLag(m.DB())
+	_, err = c.Prepare(context.Background(), lagPlan(map[string]string{OPT_WRITER: LAG_WRITER_PT, OPT_REPORT_NO_HEARTBEAT: "yes"}))
+	require.NoError(t, err)
+	metrics, err = c.Collect(context.Background(), "kpi")
+	require.NoError(t, err)
+	assert.Equal(t, []blip.MetricValue{{Name: "current", Type: blip.GAUGE, Value: -1}}, metrics)
+
+	// Bad ts
+	_, err = ptLag("2024-05-28 18:50:06", "not a time")
+	assert.Error(t, err)
+	lag, err := ptLag("2024-05-28 18:50:06", "2024-05-28T18:50:07") // clock skew
+	require.NoError(t, err)
+	assert.Equal(t, float64(0), lag)
+}
+
+func TestMultipleHeartbeatTables(t *testing.T) {
+	// One reader per heartbeat table, one repl.lag.current per source
+	m := mock.NewSQL(map[string]mock.SQLResult{
+		"FROM `hb`.`source1`": heartbeatResult("source1", 0),
+		"FROM `hb`.`source2`": heartbeatResult("source2", 0),
+	})
+	c := NewLag(m.DB())
+	cleanup, err := c.Prepare(context.Background(), lagPlan(map[string]string{
+		OPT_WRITER:          LAG_WRITER_BLIP,
+		OPT_HEARTBEAT_TABLE: "hb.source1, hb.source2",
+	}))
+	require.NoError(t, err)
+	require.NotNil(t, cleanup)
+	require.Len(t, c.lagReaders, 2)
+
+	waitFor(t, func() bool {
+		for _, r := range c.lagReaders {
+			if lag, _ := r.Lag(context.Background()); lag.Milliseconds < 0 {
+				return false
+			}
+		}
+		return true
+	})
+	metrics, err := c.Collect(context.Background(), "kpi")
+	require.NoError(t, err)
+	require.Len(t, metrics, 2)
+	sources := []string{metrics[0].Meta["source"], metrics[1].Meta["source"]}
+	assert.ElementsMatch(t, []string{"source1", "source2"}, sources)
+
+	// Cleanup stops all readers
+	cleanup()
+	for i, r := range c.lagReaders {
+		waitFor(t, func() bool { return !r.Alive() })
+		assert.False(t, r.Alive(), "reader %d alive after cleanup", i)
+	}
+}
+
+func TestCleanupStopsReads(t *testing.T) {
+	// Cleanup waits for readers to exit, including an in-flight read, so there
+	// are no heartbeat reads after cleanup returns
+	m := mock.NewSQL(map[string]mock.SQLResult{
+		"FROM `hb`.`source1`": heartbeatResult("source1", 1200*time.Millisecond), // late: frequent reads
+		"FROM `hb`.`source2`": heartbeatResult("source2", 1200*time.Millisecond),
+	})
+	m.QueryFunc = func(query string) (mock.SQLResult, bool) {
+		time.Sleep(20 * time.Millisecond) // every read is in flight for a while
+		return mock.SQLResult{}, false
+	}
+	c := NewLag(m.DB())
+	cleanup, err := c.Prepare(context.Background(), lagPlan(map[string]string{
+		OPT_WRITER:          LAG_WRITER_BLIP,
+		OPT_HEARTBEAT_TABLE: "hb.source1, hb.source2",
+	}))
+	require.NoError(t, err)
+	waitFor(t, func() bool { return m.Count("FROM `hb`") >= 4 })
+
+	cleanup()
+	for i, r := range c.lagReaders {
+		assert.False(t, r.Alive(), "reader %d alive after cleanup", i)
+	}
+	n := m.Count("FROM `hb`")
+	time.Sleep(200 * time.Millisecond)
+	assert.Equal(t, n, m.Count("FROM `hb`"), "reads after cleanup")
+}
+
+func TestSkipZero(t *testing.T) {
+	// ProxySQL is easiest to mock lag = 0, lag > 0, and no lag (absent)
+	m := mock.NewSQL(map[string]mock.SQLResult{
+		"mysql_server_replication_lag_log": {
+			Columns: []string{"hostname", "port", "repl_lag"},
+			Rows: [][]driver.Value{
+				{"db1", int64(3306), float64(0)},
+				{"db2", int64(3306), float64(2)},
+				{"db3", int64(3306), nil},
+			},
+		},
+	})
+	for _, skip := range []string{"yes", "no"} {
+		c := NewLag(m.DB())
+		_, err := c.Prepare(context.Background(), lagPlan(map[string]string{
+			OPT_WRITER:       LAG_WRITER_PROXYSQL,
+			OPT_SKIP_ZERO:    skip,
+			OPT_ABSENT_VALUE: ABSENT_VALUE_NEG_1,
+		}))
+		require.NoError(t, err)
+		metrics, err := c.Collect(context.Background(), "kpi")
+		require.NoError(t, err)
+		var values []float64
+		for _, m := range metrics {
+			values = append(values, m.Value)
+		}
+		if skip == "yes" {
+			assert.Equal(t, []float64{2000, -1}, values, "skip-zero=yes")
+		} else {
+			assert.Equal(t, []float64{0, 2000, -1}, values, "skip-zero=no")
+		}
+	}
+}
+
+func TestParseSourceLatency(t *testing.T) {
+	got, err := parseSourceLatency("source1:20, db2:3306:100")
+	require.NoError(t, err)
+	expect := map[string]time.Duration{
+		"source1":  20 * time.Millisecond,
+		"db2:3306": 100 * time.Millisecond,
+	}
+	assert.Equal(t, expect, got)
+
+	got, err = parseSourceLatency("")
+	require.NoError(t, err)
+	assert.Nil(t, got)
+
+	for _, bad := range []string{"source1", "source1:x", ":20", "source1:-5"} {
+		_, err := parseSourceLatency(bad)
+		assert.Error(t, err, bad)
+	}
+
+	// Invalid value is a Prepare error
+	c := NewLag(mock.NewSQL(nil).DB())
+	_, err = c.Prepare(context.Background(), lagPlan(map[string]string{
+		OPT_WRITER:         LAG_WRITER_BLIP,
+		OPT_SOURCE_LATENCY: "source1",
+	}))
+	assert.Error(t, err)
+}
+
+func TestReadOnce(t *testing.T) {
+	// ReadOnce reads the heartbeat directly, so it works when the reader
+	// goroutine is not running (stopped by cleanup)
+	m := mock.NewSQL(map[string]mock.SQLResult{
+		"heartbeat": heartbeatResult("source1", 0),
+	})
+	c := NewLag(m.DB())
+	cleanup, err := c.Prepare(context.Background(), lagPlan(map[string]string{OPT_WRITER: LAG_WRITER_BLIP}))
+	require.NoError(t, err)
+	cleanup()
+	waitFor(t, func() bool { return !c.lagReaders[0].Alive() })
+
+	n := m.Count("heartbeat")
+	metrics, err := c.ReadOnce(context.Background(), "kpi")
+	require.NoError(t, err)
+	require.Len(t, metrics, 1)
+	assert.Equal(t, "source1", metrics[0].Meta["source"])
+	assert.Equal(t, n+1, m.Count("heartbeat"))
+
+	// Level not prepared
+	_, err = c.ReadOnce(context.Background(), "other")
+	assert.Error(t, err)
+}
+
+func TestNoDB(t *testing.T) {
+	// Nil DB: Prepare returns an error instead of panicking
+	_, err := NewLag(nil).Prepare(context.Background(), lagPlan(map[string]string{OPT_WRITER: LAG_WRITER_PFS}))
+	assert.ErrorIs(t, err, ErrNoDB)
+
+	// Closed DB: Prepare fails for any writer, including auto-detect
+	m := mock.NewSQL(map[string]mock.SQLResult{
+		"heartbeat": heartbeatResult("source1", 0),
+	})
+	db := m.DB()
+	db.Close()
+	for _, writer := range []string{"", LAG_WRITER_PFS, LAG_WRITER_BLIP} {
+		_, err := NewLag(db).Prepare(context.Background(), lagPlan(map[string]string{OPT_WRITER: writer}))
+		assert.ErrorIs(t, err, ErrNoDB, writer)
+	}
+
+	// DB closed after Prepare: Collect returns an error
+	uuid := "3e11fa47-71ca-11e1-9e33-c80aa9429562"
+	m = mock.NewSQL(map[string]mock.SQLResult{
+		"replication_applier_status_by_worker": pfsResult([]driver.Value{"", uuid + ":10", "ON", "ON", uuid + ":10", int64(1), uuid + ":10",
+			1716922205.5, 1716922205.0, 0.0, 0.0, "db1", uuid}),
+	})
+	db = m.DB()
+	c := NewLag(db)
+	_, err = c.Prepare(context.Background(), lagPlan(map[string]string{OPT_WRITER: LAG_WRITER_PFS}))
+	require.NoError(t, err)
+	_, err = c.Collect(context.Background(), "kpi")
+	require.NoError(t, err)
+	db.Close()
+	_, err = c.Collect(context.Background(), "kpi")
+	assert.ErrorIs(t, err, ErrNoDB)
+
+	// Open DB is not queried by the check
+	m = mock.NewSQL(nil)
+	assert.NoError(t, checkDB(m.DB()))
+	assert.Empty(t, m.Queries())
+
+	// Only closed db errors from queries are ErrNoDB
+	assert.ErrorIs(t, noDB(sql.ErrConnDone), ErrNoDB)
+	assert.ErrorIs(t, noDB(fmt.Errorf("cannot query lag: %s", "sql: database is closed")), ErrNoDB)
+	assert.NotErrorIs(t, noDB(assert.AnError), ErrNoDB)
+	assert.NoError(t, noDB(nil))
+}
+
+func TestRetries(t *testing.T) {
+	defer func(wait time.Duration) { RetryWait = wait }(RetryWait)
+	RetryWait = time.Millisecond
+
+	// First attempt fails with a deadlock (transient), then succeeds
+	uuid := "3e11fa47-71ca-11e1-9e33-c80aa9429562"
+	m := mock.NewSQL(map[string]mock.SQLResult{
+		"replication_applier_status_by_worker": pfsResult([]driver.Value{"", uuid + ":10", "ON", "ON", uuid + ":10", int64(1), uuid + ":10",
+			1716922205.5, 1716922205.0, 0.0, 0.0, "db1", uuid}),
+	})
+	c := NewLag(m.DB())
+	_, err := c.Prepare(context.Background(), lagPlan(map[string]string{
+		OPT_WRITER:  LAG_WRITER_PFS,
+		OPT_RETRIES: "2",
+	}))
+	require.NoError(t, err)
+	fail := 0
+	m.QueryFunc = func(query string) (mock.SQLResult, bool) {
+		if fail > 0 && strings.Contains(query, "replication_applier_status_by_worker") {
+			fail--
+			return mock.SQLResult{Err: &mysql.MySQLError{Number: 1213, Message: "Deadlock found"}}, true
+		}
+		return mock.SQLResult{}, false
+	}
+	fail = 1
+	n := m.Count("replication_applier_status_by_worker")
+	metrics, err := c.Collect(context.Background(), "kpi")
+	require.NoError(t, err)
+	require.NotEmpty(t, metrics)
+	assert.Equal(t, "current", metrics[0].Name)
+	assert.Equal(t, n+2, m.Count("replication_applier_status_by_worker"))
+
+	// More transient errors than retries: error
+	fail = 3
+	_, err = c.Collect(context.Background(), "kpi")
+	assert.Error(t, err)
+	assert.Equal(t, 0, fail) // 1 try + 2 retries
+
+	// Structural error (unknown table) is not retried
+	m.QueryFunc = func(query string) (mock.SQLResult, bool) {
+		if strings.Contains(query, "replication_applier_status_by_worker") {
+			return mock.SQLResult{Err: &mysql.MySQLError{Number: 1146, Message: "Table doesn't exist"}}, true
+		}
+		return mock.SQLResult{}, false
+	}
+	n = m.Count("replication_applier_status_by_worker")
+	c.atLevel["kpi"].skip = 0 // error backoff
+	_, err = c.Collect(context.Background(), "kpi")
+	assert.Error(t, err)
+	assert.Equal(t, n+1, m.Count("replication_applier_status_by_worker"))
+
+	// Invalid
+	_, err = NewLag(m.DB()).Prepare(context.Background(), lagPlan(map[string]string{
+		OPT_WRITER:  LAG_WRITER_PFS,
+		OPT_RETRIES: "-1",
+	}))
+	assert.Error(t, err)
+}
+
+func TestState(t *testing.T) {
+	// Two channels: ch1 applying (lag 2s, backlog 10), ch2 idle
+	uuid := "3e11fa47-71ca-11e1-9e33-c80aa9429562"
+	now := 1716922230.0
+	results := map[string]mock.SQLResult{
+		"replication_applier_status_by_worker": pfsResult(
+			[]driver.Value{"ch1", uuid + ":20", "ON", "ON", uuid + ":20", int64(1), uuid + ":10", now, now - 3, 1000.0, now - 2, "db1", uuid},
+			[]driver.Value{"ch2", uuid + ":10", "ON", "ON", uuid + ":10", int64(1), uuid + ":10", now, now - 3, 0.0, 0.0, "db2", uuid},
+		),
+	}
+	plan := lagPlan(map[string]string{OPT_WRITER: LAG_WRITER_PFS})
+
+	c := NewLag(mock.NewSQL(results).DB())
+	_, err := c.Prepare(context.Background(), plan)
+	require.NoError(t, err)
+	s, err := c.State(context.Background(), "kpi")
+	require.NoError(t, err)
+	assert.Equal(t, LAG_WRITER_PFS, s.Writer)
+	assert.True(t, s.Replica)
+	expect := []ChannelState{
+		{Channel: "ch1", Source: "db1", Lag: 2000, Backlog: 10, Meta: map[string]string{"source": "db1", "source_table": SOURCE_TABLE_WORKER}},
+		{Channel: "ch2", Source: "db2", Lag: 0, Backlog: 0, Meta: map[string]string{"source": "db2", "source_table": SOURCE_TABLE_WORKER}},
+	}
+	assert.ElementsMatch(t, expect, s.Channels) // pfs channel order is not fixed
+
+	// Collect returns the same state as metrics
+	c2 := NewLag(mock.NewSQL(results).DB())
+	_, err = c2.Prepare(context.Background(), plan)
+	require.NoError(t, err)
+	metrics, err := c2.Collect(context.Background(), "kpi")
+	require.NoError(t, err)
+	assert.ElementsMatch(t, s.MetricValues(), metrics)
+	for _, ch := range s.Channels {
+		var found bool
+		for _, m := range metrics {
+			if m.Name == "current" && m.Group["channel"] == ch.Channel {
+				assert.Equal(t, ch.Lag, m.Value, ch.Channel)
+				found = true
+			}
+		}
+		assert.True(t, found, ch.Channel)
+	}
+
+	// Not a replica
+	m := mock.NewSQL(map[string]mock.SQLResult{
+		"COUNT(*) FROM performance_schema.replication_connection_status": {
+			Columns: []string{"COUNT(*)"},
+			Rows:    [][]driver.Value{{int64(0)}},
+		},
+		"replication_applier_status_by_worker": results["replication_applier_status_by_worker"],
+	})
+	c = NewLag(m.DB())
+	_, err = c.Prepare(context.Background(), plan)
+	require.NoError(t, err)
+	s, err = c.State(context.Background(), "kpi")
+	require.NoError(t, err)
+	assert.False(t, s.Replica)
+	assert.Empty(t, s.Channels) // report-not-a-replica=no (default)
+	metrics, err = c.Collect(context.Background(), "kpi")
+	require.ErrorIs(t, err, blip.ErrNoMetrics)
+	assert.Equal(t, s.MetricValues(), metrics)
+
+	// Level not prepared: error, not a panic
+	_, err = c.State(context.Background(), "other")
+	assert.ErrorIs(t, err, ErrLevelNotPrepared)
+	metrics, err = c.Collect(context.Background(), "other")
+	assert.ErrorIs(t, err, ErrLevelNotPrepared)
+	assert.Nil(t, metrics)
+}
+
+func TestCollectDoesNotBlock(t *testing.T) {
+	// Collect does not hold the lock while querying, so a slow lag query does
+	// not block ActiveConfig, Cost, or Prepare
+	uuid := "3e11fa47-71ca-11e1-9e33-c80aa9429562"
+	now := 1716922230.0
+	m := mock.NewSQL(map[string]mock.SQLResult{
+		"replication_applier_status_by_worker": pfsResult(
+			[]driver.Value{"", uuid + ":20", "ON", "ON", uuid + ":20", int64(1), uuid + ":10", now, now - 3, 1000.0, now - 2, "db1", uuid},
+		),
+	})
+	c := NewLag(m.DB())
+	plan := lagPlan(map[string]string{OPT_WRITER: LAG_WRITER_PFS})
+	_, err := c.Prepare(context.Background(), plan)
+	require.NoError(t, err)
+
+	querying := make(chan struct{})
+	release := make(chan struct{})
+	first := make(chan struct{}, 1)
+	first <- struct{}{}
+	m.QueryFunc = func(query string) (mock.SQLResult, bool) {
+		if !strings.Contains(query, "replication_applier_status_by_worker") {
+			return mock.SQLResult{}, false
+		}
+		select {
+		case <-first: // first query (Collect) blocks
+			close(querying)
+			<-release
+		default:
+		}
+		return mock.SQLResult{}, false
+	}
+	collected := make(chan error)
+	go func() {
+		_, err := c.Collect(context.Background(), "kpi")
+		collected <- err
+	}()
+	<-querying
+
+	done := make(chan error)
+	go func() {
+		c.ActiveConfig()
+		c.Cost("kpi")
+		_, err := c.Prepare(context.Background(), plan)
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		assert.NoError(t, err)
+	case <-time.After(2 * time.Second):
+		t.Error("blocked by Collect")
+	}
+	close(release)
+	assert.NoError(t, <-collected)
+}
+
+func TestRunOnce(t *testing.T) {
+	// Prepare, Collect, and cleanup in one call
+	uuid := "3e11fa47-71ca-11e1-9e33-c80aa9429562"
+	m := mock.NewSQL(map[string]mock.SQLResult{
+		"replication_applier_status_by_worker": pfsResult([]driver.Value{"", uuid + ":10", "ON", "ON", uuid + ":10", int64(1), uuid + ":10",
+			1716922205.5, 1716922205.0, 0.0, 0.0, "db1", uuid}),
+	})
+	metrics, err := RunOnce(context.Background(), NewLag(m.DB()), lagPlan(map[string]string{OPT_WRITER: LAG_WRITER_PFS}), "kpi")
+	require.NoError(t, err)
+	require.NotEmpty(t, metrics)
+	assert.Equal(t, "current", metrics[0].Name)
+	assert.Equal(t, map[string]string{"source": "db1", "source_table": SOURCE_TABLE_WORKER}, metrics[0].Meta)
+
+	// Blip heartbeat readers are stopped after collecting
+	m = mock.NewSQL(map[string]mock.SQLResult{
+		"heartbeat": heartbeatResult("source1", 0),
+	})
+	c := NewLag(m.DB())
+	_, err = RunOnce(context.Background(), c, lagPlan(map[string]string{OPT_WRITER: LAG_WRITER_BLIP}), "kpi")
+	require.NoError(t, err)
+	require.Len(t, c.lagReaders, 1)
+	waitFor(t, func() bool { return !c.lagReaders[0].Alive() })
+
+	// Cleanup runs even if the level is not in the plan
+	c = NewLag(m.DB())
+	_, err = RunOnce(context.Background(), c, lagPlan(map[string]string{OPT_WRITER: LAG_WRITER_BLIP}), "other")
+	require.Error(t, err)
+	waitFor(t, func() bool { return !c.lagReaders[0].Alive() })
+
+	// Prepare error
+	_, err = RunOnce(context.Background(), NewLag(m.DB()), lagPlan(map[string]string{OPT_WRITER: "bogus"}), "kpi")
+	assert.Error(t, err)
+}
+
+func TestRole(t *testing.T) {
+	// Both PFS and Blip heartbeat are available, like an intermediate
+	uuid := "3e11fa47-71ca-11e1-9e33-c80aa9429562"
+	results := map[string]mock.SQLResult{
+		"replication_applier_status_by_worker": pfsResult([]driver.Value{"", uuid + ":10", "ON", "ON", uuid + ":10", int64(1), uuid + ":10",
+			1716922205.5, 1716922205.0, 0.0, 0.0, "db1", uuid}),
+		"heartbeat": heartbeatResult("source1", 0),
+	}
+	tests := []struct {
+		role   string
+		writer string
+	}{
+		{"", LAG_WRITER_PFS},
+		{ROLE_REPLICA, LAG_WRITER_PFS},
+		{ROLE_INTERMEDIATE, LAG_WRITER_BLIP},
+		{ROLE_SOURCE, LAG_WRITER_NONE},
+	}
+	for _, tc := range tests {
+		c := NewLag(mock.NewSQL(results).DB())
+		cleanup, err := c.Prepare(context.Background(), lagPlan(map[string]string{
+			OPT_ROLE:                 tc.role,
+			OPT_REPORT_NOT_A_REPLICA: "yes",
+		}))
+		require.NoError(t, err, "role=%s", tc.role)
+		assert.Equal(t, tc.writer, c.lagWriterIn["kpi"], "role=%s", tc.role)
+		if cleanup != nil {
+			cleanup()
+		}
+	}
+
+	// role=source reports not a replica without querying
+	m := mock.NewSQL(nil)
+	c := NewLag(m.DB())
+	_, err := c.Prepare(context.Background(), lagPlan(map[string]string{OPT_ROLE: ROLE_SOURCE, OPT_REPORT_NOT_A_REPLICA: "yes"}))
+	require.NoError(t, err)
+	metrics, err := c.Collect(context.Background(), "kpi")
+	require.NoError(t, err)
+	assert.Equal(t, []blip.MetricValue{{Name: "current", Type: blip.GAUGE, Value: -1}}, metrics)
+	assert.Empty(t, m.Queries())
+
+	// Role doesn't override explicit writer
+	c = NewLag(mock.NewSQL(results).DB())
+	_, err = c.Prepare(context.Background(), lagPlan(map[string]string{OPT_ROLE: ROLE_SOURCE, OPT_WRITER: LAG_WRITER_PFS}))
+	require.NoError(t, err)
+	assert.Equal(t, LAG_WRITER_PFS, c.lagWriterIn["kpi"])
+
+	// Invalid role
+	_, err = NewLag(m.DB()).Prepare(context.Background(), lagPlan(map[string]string{OPT_ROLE: "primary"}))
+	assert.Error(t, err)
+}
+
+func TestHelpUnits(t *testing.T) {
+	units := map[string]string{}
+	for _, m := range NewLag(nil).Help().Metrics {
+		units[m.Name] = m.Unit
+	}
+	assert.Equal(t, "ms", units["current"])
+	assert.Equal(t, "ms/s", units["trend"])
+}
+
+func TestCrossCheck(t *testing.T) {
+	// With cross-check, the blip writer also collects lag from PFS and reports
+	// the absolute difference as repl.lag.disagreement. PFS lag is zero in this
+	// mock result: last trx applied and no workers applying.
+	uuid := "3e11fa47-71ca-11e1-9e33-c80aa9429562"
+	pfs := pfsResult([]driver.Value{"", uuid + ":10", "ON", "ON", uuid + ":10", int64(1), uuid + ":10",
+		1716922205.5, 1716922205.0, 0.0, 0.0, "db1", uuid})
+
+	tests := []struct {
+		name   string
+		lag    time.Duration // heartbeat lag
+		expect float64       // disagreement
+	}{
+		{"agree", 0, 0},
+		{"diverge", 5 * time.Second, 4000}, // heartbeat lag = 5s - 1s freq
+	}
+	for _, tc := range tests {
+		m := mock.NewSQL(map[string]mock.SQLResult{
+			"heartbeat":                            heartbeatResult("db1", tc.lag),
+			"replication_applier_status_by_worker": pfs,
+		})
+		c := NewLag(m.DB())
+		cleanup, err := c.Prepare(context.Background(), lagPlan(map[string]string{
+			OPT_WRITER:      LAG_WRITER_BLIP,
+			OPT_CROSS_CHECK: "yes",
+		}))
+		require.NoError(t, err, tc.name)
+		waitFor(t, func() bool { lag, _ := c.lagReaders[0].Lag(context.Background()); return lag.Milliseconds >= 0 })
+
+		metrics, err := c.Collect(context.Background(), "kpi")
+		require.NoError(t, err, tc.name)
+		require.Len(t, metrics, 2, tc.name)
+		assert.Equal(t, "current", metrics[0].Name, tc.name)
+		assert.Equal(t, "disagreement", metrics[1].Name, tc.name)
+		assert.InDelta(t, tc.expect, metrics[1].Value, 100, tc.name)
+		cleanup()
+	}
+
+	// Cross-check disabled if PFS doesn't work: only repl.lag.current reported
+	// (mock returns an error for the PFS query because there's no result for it)
+	m := mock.NewSQL(map[string]mock.SQLResult{
+		"heartbeat": heartbeatResult("db1", 0),
+	})
+	c := NewLag(m.DB())
+	cleanup, err := c.Prepare(context.Background(), lagPlan(map[string]string{
+		OPT_WRITER:      LAG_WRITER_BLIP,
+		OPT_CROSS_CHECK: "yes",
+	}))
+	require.NoError(t, err)
+	defer cleanup()
+	assert.False(t, c.atLevel["kpi"].crossCheck)
+	waitFor(t, func() bool { lag, _ := c.lagReaders[0].Lag(context.Background()); return lag.Milliseconds >= 0 })
+	metrics, err := c.Collect(context.Background(), "kpi")
+	require.NoError(t, err)
+	require.Len(t, metrics, 1)
+	assert.Equal(t, "current", metrics[0].Name)
+}
+
+// testLogger records log messages by level.
+type testLogger struct {
+	sync.Mutex
+	msgs map[string][]string
+}
+
+func (l *testLogger) log(level, msg string, v ...interface{}) {
+	l.Lock()
+	defer l.Unlock()
+	l.msgs[level] = append(l.msgs[level], fmt.Sprintf(msg, v...))
+}
+
+func (l *testLogger) Debug(msg string, v ...interface{}) { l.log("debug", msg, v...) }
+func (l *testLogger) Warn(msg string, v ...interface{})  { l.log("warn", msg, v...) }
+func (l *testLogger) Error(msg string, v ...interface{}) { l.log("error", msg, v...) }
+
+func TestLogger(t *testing.T) {
+	tl := &testLogger{msgs: map[string][]string{}}
+	Log = tl
+	defer func() { Log = DebugLogger{} }()
+
+	m := mock.NewSQL(map[string]mock.SQLResult{
+		"heartbeat": heartbeatResult("db1", 0),
+	})
+	c := NewLag(m.DB())
+	cleanup, err := c.Prepare(context.Background(), lagPlan(map[string]string{
+		OPT_WRITER:          LAG_WRITER_BLIP,
+		OPT_NETWORK_LATENCY: "fast",
+	}))
+	require.NoError(t, err)
+	cleanup()
+
+	tl.Lock()
+	defer tl.Unlock()
+	require.Len(t, tl.msgs["warn"], 1)
+	assert.Contains(t, tl.msgs["warn"][0], "invalid network-latency: fast")
+	assert.NotEmpty(t, tl.msgs["debug"])
+	assert.Empty(t, tl.msgs["error"])
+}
+
+func TestPrepareAll(t *testing.T) {
+	// Two plans (like active and read-only) with the same blip writer config
+	// share the same reader, so switching plans doesn't restart it
+	m := mock.NewSQL(map[string]mock.SQLResult{
+		"heartbeat": heartbeatResult("db1", 0),
+	})
+	active := lagPlan(map[string]string{OPT_WRITER: LAG_WRITER_BLIP})
+	active.Name = "active"
+	readOnly := lagPlan(map[string]string{OPT_WRITER: LAG_WRITER_BLIP, OPT_REPORT_TREND: "yes"})
+	readOnly.Name = "read-only"
+	readOnly.Levels["ro"] = readOnly.Levels["kpi"]
+	delete(readOnly.Levels, "kpi")
+
+	c := NewLag(m.DB())
+	cleanup, err := c.PrepareAll(context.Background(), active, readOnly)
+	require.NoError(t, err)
+	require.NotNil(t, cleanup)
+	require.Len(t, c.readers, 1, "expected 1 shared reader set")
+	require.Len(t, c.lagReaders, 1)
+	reader := c.lagReaders[0]
+	waitFor(t, func() bool { lag, _ := reader.Lag(context.Background()); return lag.Milliseconds >= 0 })
+
+	// First plan is active
+	metrics, err := c.Collect(context.Background(), "kpi")
+	require.NoError(t, err)
+	require.Len(t, metrics, 1)
+
+	// Switch plans: same reader, still running, new levels
+	require.NoError(t, c.Activate("read-only"))
+	require.Len(t, c.lagReaders, 1)
+	assert.True(t, reader == c.lagReaders[0], "reader changed after Activate")
+	assert.True(t, reader.Alive())
+	assert.Contains(t, c.atLevel, "ro")
+	assert.NotContains(t, c.atLevel, "kpi")
+	metrics, err = c.Collect(context.Background(), "ro")
+	require.NoError(t, err)
+	require.Len(t, metrics, 1)
+
+	// And back
+	require.NoError(t, c.Activate("active"))
+	assert.True(t, reader == c.lagReaders[0], "reader changed after Activate")
+	assert.Contains(t, c.atLevel, "kpi")
+
+	assert.Error(t, c.Activate("other"))
+
+	cleanup()
+	waitFor(t, func() bool { return !reader.Alive() })
+}
+
+func TestPrepareTwice(t *testing.T) {
+	// Prepare is idempotent: re-preparing (like plan reload) reuses readers
+	// with the same config, stops readers no longer used, and always returns
+	// a valid cleanup func
+	m := mock.NewSQL(map[string]mock.SQLResult{
+		"heartbeat":  heartbeatResult("db1", 0),
+		"heartbeat2": heartbeatResult("db1", 0),
+	})
+	c := NewLag(m.DB())
+	plan := lagPlan(map[string]string{OPT_WRITER: LAG_WRITER_BLIP})
+
+	// Same plan twice: same reader, both cleanup funcs valid
+	cleanup1, err := c.Prepare(context.Background(), plan)
+	require.NoError(t, err)
+	require.NotNil(t, cleanup1)
+	require.Len(t, c.lagReaders, 1)
+	reader := c.lagReaders[0]
+	waitFor(t, func() bool { lag, _ := reader.Lag(context.Background()); return lag.Milliseconds >= 0 })
+
+	cleanup2, err := c.Prepare(context.Background(), plan)
+	require.NoError(t, err)
+	require.NotNil(t, cleanup2)
+	require.Len(t, c.readers, 1)
+	assert.True(t, reader == c.lagReaders[0], "reader changed after Prepare with same plan")
+
+	// Cleanup of the previous plan doesn't stop the reader reused by the current plan
+	cleanup1()
+	assert.True(t, reader.Alive())
+	metrics, err := c.Collect(context.Background(), "kpi")
+	require.NoError(t, err)
+	require.Len(t, metrics, 1)
+
+	// Changed plan: new reader for the new heartbeat table, old reader stopped,
+	// level maps reconciled (old level removed)
+	changed := lagPlan(map[string]string{OPT_WRITER: LAG_WRITER_BLIP, OPT_HEARTBEAT_TABLE: "blip.heartbeat2"})
+	changed.Levels["slow"] = changed.Levels["kpi"]
+	delete(changed.Levels, "kpi")
+	cleanup3, err := c.Prepare(context.Background(), changed)
+	require.NoError(t, err)
+	require.NotNil(t, cleanup3)
+	require.Len(t, c.readers, 1)
+	require.Len(t, c.lagReaders, 1)
+	newReader := c.lagReaders[0]
+	assert.False(t, reader == newReader, "reader not changed after Prepare with changed plan")
+	waitFor(t, func() bool { return !reader.Alive() })
+	assert.True(t, newReader.Alive())
+	waitFor(t, func() bool { lag, _ := newReader.Lag(context.Background()); return lag.Milliseconds >= 0 })
+	assert.Equal(t, map[string]string{"slow": LAG_WRITER_BLIP}, c.lagWriterIn)
+	assert.NotContains(t, c.dropNoHeartbeat, "kpi")
+	assert.NotContains(t, c.atLevel, "kpi")
+
+	// Old cleanup funcs are safe to call (again): they don't stop the new reader
+	cleanup1()
+	cleanup2()
+	assert.True(t, newReader.Alive())
+
+	// Failed Prepare keeps the current plan and readers
+	_, err = c.Prepare(context.Background(), lagPlan(map[string]string{OPT_WRITER: "invalid"}))
+	require.Error(t, err)
+	assert.Contains(t, c.atLevel, "slow")
+	assert.True(t, newReader == c.lagReaders[0])
+	assert.True(t, newReader.Alive())
+	metrics, err = c.Collect(context.Background(), "slow")
+	require.NoError(t, err)
+	require.Len(t, metrics, 1)
+
+	// Cleanup of the current plan stops its reader; calling it twice is safe
+	cleanup3()
+	cleanup3()
+	waitFor(t, func() bool { return !newReader.Alive() })
+	assert.Empty(t, c.readers)
+
+	// Non-blip writer: cleanup is still valid
+	m.Set("replication_group_member_stats", groupReplResult("ONLINE", 2, 40))
+	cleanup, err := c.Prepare(context.Background(), lagPlan(map[string]string{OPT_WRITER: LAG_WRITER_GROUP}))
+	require.NoError(t, err)
+	require.NotNil(t, cleanup)
+	cleanup()
+}
+
+func TestWindowPercentile(t *testing.T) {
+	// Level freq 1s and window 10s = 10 samples. Feed lag 1..20 seconds
+	// (ProxySQL) and check the percentile over the last 10 samples.
+	m := mock.NewSQL(nil)
+	setLag := func(s int) {
+		m.Set("mysql_server_replication_lag_log", mock.SQLResult{
+			Columns: []string{"hostname", "port", "repl_lag"},
+			Rows:    [][]driver.Value{{"db1", int64(3306), float64(s)}},
+		})
+	}
+	setLag(0)
+
+	tests := []struct {
+		percentile string
+		expect     []float64 // after 1, 5, 10, 20 samples
+	}{
+		{"", []float64{1000, 5000, 10000, 20000}}, // default p95
+		{"50", []float64{1000, 3000, 5000, 15000}},
+		{"10", []float64{1000, 1000, 1000, 11000}},
+	}
+	for _, tc := range tests {
+		c := NewLag(m.DB())
+		_, err := c.Prepare(context.Background(), lagPlan(map[string]string{
+			OPT_WRITER:     LAG_WRITER_PROXYSQL,
+			OPT_WINDOW:     "10s",
+			OPT_PERCENTILE: tc.percentile,
+		}))
+		require.NoError(t, err)
+		assert.Equal(t, 10, c.atLevel["kpi"].windowSize)
+
+		var got []float64
+		for s := 1; s <= 20; s++ {
+			setLag(s)
+			metrics, err := c.Collect(context.Background(), "kpi")
+			require.NoError(t, err)
+			require.Len(t, metrics, 1)
+			assert.Equal(t, fmt.Sprintf("%d", s*1000), metrics[0].Meta["instant"])
+			if s == 1 || s == 5 || s == 10 || s == 20 {
+				got = append(got, metrics[0].Value)
+			}
+		}
+		assert.Equal(t, tc.expect, got, "percentile %q", tc.percentile)
+	}
+
+	// Invalid options
+	for _, opts := range []map[string]string{
+		{OPT_WINDOW: "ten"},
+		{OPT_WINDOW: "10s", OPT_PERCENTILE: "0"},
+		{OPT_WINDOW: "10s", OPT_PERCENTILE: "101"},
+	} {
+		opts[OPT_WRITER] = LAG_WRITER_PROXYSQL
+		_, err := NewLag(m.DB()).Prepare(context.Background(), lagPlan(opts))
+		assert.Error(t, err, "%v", opts)
+	}
+}
+
+func TestIncludeIdentity(t *testing.T) {
+	m := mock.NewSQL(map[string]mock.SQLResult{
+		"mysql_server_replication_lag_log": {
+			Columns: []string{"hostname", "port", "repl_lag"},
+			Rows:    [][]driver.Value{{"db1", int64(3306), float64(1)}},
+		},
+	})
+	for _, include := range []string{"yes", "no"} {
+		c := NewLag(m.DB())
+		_, err := c.Prepare(context.Background(), lagPlan(map[string]string{
+			OPT_WRITER:           LAG_WRITER_PROXYSQL,
+			OPT_INCLUDE_IDENTITY: include,
+		}))
+		require.NoError(t, err)
+		metrics, err := c.Collect(context.Background(), "kpi")
+		require.NoError(t, err)
+		require.Len(t, metrics, 1)
+		expect := map[string]string{"backend": "db1:3306"}
+		if include == "yes" {
+			expect["monitor_id"] = "m1"
+			expect["plan"] = "test"
+		}
+		assert.Equal(t, expect, metrics[0].Meta, "include-identity=%s", include)
+	}
+}
+
+func TestIncludeLevel(t *testing.T) {
+	// Same domain at two levels: each metric has the level that collected it
+	r := &fakeReader{lag: heartbeat.Lag{Milliseconds: 250, SourceId: "source1", Replica: true}}
+	c := NewLagWithReader(mock.NewSQL(nil).DB(), r)
+	plan := lagPlan(map[string]string{
+		OPT_WRITER:        LAG_WRITER_BLIP,
+		OPT_INCLUDE_LEVEL: "yes",
+		OPT_REPORT_WRITER: "yes",
+	})
+	plan.Levels["slow"] = blip.Level{
+		Name: "slow",
+		Freq: "10s",
+		Collect: map[string]blip.Domain{
+			DOMAIN: {Name: DOMAIN, Options: map[string]string{
+				OPT_WRITER:           LAG_WRITER_BLIP,
+				OPT_INCLUDE_LEVEL:    "yes",
+				OPT_INCLUDE_IDENTITY: "yes",
+			}},
+		},
+	}
+	_, err := c.Prepare(context.Background(), plan)
+	require.NoError(t, err)
+
+	metrics, err := c.Collect(context.Background(), "kpi")
+	require.NoError(t, err)
+	require.Len(t, metrics, 2)
+	assert.Equal(t, map[string]string{"source": "source1", "plan": "test", "level": "kpi"}, metrics[0].Meta)
+	assert.Equal(t, map[string]string{"writer": LAG_WRITER_BLIP, "plan": "test", "level": "kpi"}, metrics[1].Meta)
+
+	metrics, err = c.Collect(context.Background(), "slow")
+	require.NoError(t, err)
+	require.Len(t, metrics, 1)
+	assert.Equal(t, map[string]string{"source": "source1", "monitor_id": "m1", "plan": "test", "level": "slow"}, metrics[0].Meta)
+
+	// Disabled (default)
+	c = NewLagWithReader(mock.NewSQL(nil).DB(), r)
+	_, err = c.Prepare(context.Background(), lagPlan(map[string]string{OPT_WRITER: LAG_WRITER_BLIP}))
+	require.NoError(t, err)
+	metrics, err = c.Collect(context.Background(), "kpi")
+	require.NoError(t, err)
+	require.Len(t, metrics, 1)
+	assert.Equal(t, map[string]string{"source": "source1"}, metrics[0].Meta)
+}
+
+func TestPFSReplicaProbe(t *testing.T) {
+	// Without repl-check, a cheap probe of replication_connection_status runs
+	// first: zero connections = not a replica, so the lag query is not run
+	uuid := "3e11fa47-71ca-11e1-9e33-c80aa9429562"
+	probe := func(n int64) mock.SQLResult {
+		return mock.SQLResult{Columns: []string{"COUNT(*)"}, Rows: [][]driver.Value{{n}}}
+	}
+
+	// Source: no connections
+	m := mock.NewSQL(map[string]mock.SQLResult{
+		pfsReplicaProbeQuery:                   probe(0),
+		"replication_applier_status_by_worker": {Err: fmt.Errorf("lag query should not run")},
+	})
+	c := NewLag(m.DB())
+	_, err := c.Prepare(context.Background(), lagPlan(map[string]string{
+		OPT_WRITER:               LAG_WRITER_PFS,
+		OPT_REPORT_NOT_A_REPLICA: "yes",
+	}))
+	require.NoError(t, err)
+	metrics, err := c.Collect(context.Background(), "kpi")
+	require.NoError(t, err)
+	require.Len(t, metrics, 1)
+	assert.Equal(t, float64(-1), metrics[0].Value)
+	assert.Equal(t, 0, m.Count("replication_applier_status_by_worker"))
+
+	// Replica: one connection, lag query runs
+	m = mock.NewSQL(map[string]mock.SQLResult{
+		pfsReplicaProbeQuery: probe(1),
+		"replication_applier_status_by_worker": pfsResult([]driver.Value{"", uuid + ":10", "ON", "ON", uuid + ":10", int64(1), uuid + ":10",
+			1716922205.5, 1716922205.0, 0.0, 0.0, "db1", uuid}),
+	})
+	c = NewLag(m.DB())
+	_, err = c.Prepare(context.Background(), lagPlan(map[string]string{OPT_WRITER: LAG_WRITER_PFS}))
+	require.NoError(t, err)
+	metrics, err = c.Collect(context.Background(), "kpi")
+	require.NoError(t, err)
+	require.NotEmpty(t, metrics)
+	assert.Equal(t, "current", metrics[0].Name)
+	assert.Equal(t, float64(0), metrics[0].Value)
+	assert.Equal(t, 2, m.Count("replication_applier_status_by_worker")) // Prepare and Collect
+}
+
+func TestChannel(t *testing.T) {
+	// Multi-source replica with 2 channels; channel option collects only one
+	uuid := "3e11fa47-71ca-11e1-9e33-c80aa9429562"
+	m := mock.NewSQL(map[string]mock.SQLResult{
+		"replication_applier_status_by_worker": pfsResult(
+			[]driver.Value{"", uuid + ":10", "ON", "ON", uuid + ":10", int64(1), uuid + ":10", 1716922205.5, 1716922205.0, 0.0, 0.0, "db1", uuid},
+			[]driver.Value{"ch2", uuid + ":20", "ON", "ON", uuid + ":20", int64(1), uuid + ":20", 1716922205.5, 1716922205.0, 0.0, 0.0, "db2", uuid},
+		),
+	})
+	channels := func(metrics []blip.MetricValue) []string {
+		var ch []string
+		for _, m := range metrics {
+			if m.Name == "current" {
+				ch = append(ch, m.Group["channel"])
+			}
+		}
+		return ch
+	}
+
+	tests := []struct {
+		opts   map[string]string
+		expect []string
+	}{
+		{map[string]string{}, []string{"", "ch2"}},
+		{map[string]string{OPT_CHANNEL: "ch2"}, []string{"ch2"}},
+		{map[string]string{OPT_CHANNEL: "main", OPT_DEFAULT_CHANNEL_NAME: "main"}, []string{"main"}},
+	}
+	for _, tc := range tests {
+		tc.opts[OPT_WRITER] = LAG_WRITER_PFS
+		c := NewLag(m.DB())
+		_, err := c.Prepare(context.Background(), lagPlan(tc.opts))
+		require.NoError(t, err)
+		metrics, err := c.Collect(context.Background(), "kpi")
+		require.NoError(t, err)
+		assert.ElementsMatch(t, tc.expect, channels(metrics), "%v", tc.opts)
+	}
+}
+
+func TestReportDBStats(t *testing.T) {
+	m := mock.NewSQL(map[string]mock.SQLResult{
+		"mysql_server_replication_lag_log": {
+			Columns: []string{"hostname", "port", "repl_lag"},
+			Rows:    [][]driver.Value{{"db1", int64(3306), float64(1)}},
+		},
+	})
+	db := m.DB()
+	c := NewLag(db)
+	_, err := c.Prepare(context.Background(), lagPlan(map[string]string{
+		OPT_WRITER:          LAG_WRITER_PROXYSQL,
+		OPT_REPORT_DB_STATS: "yes",
+	}))
+	require.NoError(t, err)
+
+	// Hold a connection so one is in use
+	conn, err := db.Conn(context.Background())
+	require.NoError(t, err)
+	defer conn.Close()
+
+	metrics, err := c.Collect(context.Background(), "kpi")
+	require.NoError(t, err)
+	stats := map[string]float64{}
+	for _, m := range metrics {
+		stats[m.Name] = m.Value
+	}
+	assert.Equal(t, float64(1000), stats["current"])
+	assert.GreaterOrEqual(t, stats["db_open_connections"], float64(1))
+	assert.Equal(t, float64(1), stats["db_in_use"])
+	assert.Equal(t, float64(0), stats["db_wait_count"])
+
+	// With source-dsn, stats are from the heartbeat reader DB
+	src := mock.NewSQL(map[string]mock.SQLResult{"heartbeat": heartbeatResult("source1", 0)})
+	srcDB := src.DB()
+	c = NewLag(db)
+	c.openDB = func(dsn string) (*sql.DB, error) { return srcDB, nil }
+	cleanup, err := c.Prepare(context.Background(), lagPlan(map[string]string{
+		OPT_WRITER:          LAG_WRITER_BLIP,
+		OPT_SOURCE_DSN:      "blip@tcp(source1:3306)/",
+		OPT_REPORT_DB_STATS: "yes",
+	}))
+	require.NoError(t, err)
+	defer cleanup()
+	assert.True(t, c.atLevel["kpi"].db == srcDB, "db stats not from source DB")
+}
+
+func TestPFSConsumers(t *testing.T) {
+	uuid := "3e11fa47-71ca-11e1-9e33-c80aa9429562"
+	consumers := func(thread string) mock.SQLResult {
+		return mock.SQLResult{
+			Columns: []string{"NAME", "ENABLED"},
+			Rows: [][]driver.Value{
+				{"global_instrumentation", "YES"},
+				{"thread_instrumentation", thread},
+			},
+		}
+	}
+	results := map[string]mock.SQLResult{
+		"setup_consumers": consumers("NO"),
+		"replication_applier_status_by_worker": pfsResult([]driver.Value{"", uuid + ":10", "ON", "ON", uuid + ":10", int64(1), uuid + ":10",
+			1716922205.5, 1716922205.0, 0.0, 0.0, "db1", uuid}),
+	}
+
+	// Disabled consumer: Prepare returns an error that names it
+	m := mock.NewSQL(results)
+	c := NewLag(m.DB())
+	_, err := c.Prepare(context.Background(), lagPlan(map[string]string{OPT_WRITER: LAG_WRITER_PFS}))
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "consumer thread_instrumentation is disabled")
+
+	// Enabled: ok
+	m.Set("setup_consumers", consumers("YES"))
+	c = NewLag(m.DB())
+	_, err = c.Prepare(context.Background(), lagPlan(map[string]string{OPT_WRITER: LAG_WRITER_PFS}))
+	require.NoError(t, err)
+}
+
+func TestCollectAge(t *testing.T) {
+	m := mock.NewSQL(map[string]mock.SQLResult{
+		"mysql_server_replication_lag_log": {
+			Columns: []string{"hostname", "port", "repl_lag"},
+			Rows:    [][]driver.Value{{"db1", int64(3306), float64(1)}},
+		},
+	})
+	now := time.Date(2024, 5, 28, 12, 0, 0, 0, time.UTC)
+	c := NewLag(m.DB())
+	c.Now = func() time.Time { return now }
+	_, err := c.Prepare(context.Background(), lagPlan(map[string]string{
+		OPT_WRITER:             LAG_WRITER_PROXYSQL,
+		OPT_REPORT_COLLECT_AGE: "yes",
+	}))
+	require.NoError(t, err)
+
+	age := func(metrics []blip.MetricValue) float64 {
+		for _, m := range metrics {
+			if m.Name == "last_collect_age" {
+				return m.Value
+			}
+		}
+		t.Fatalf("last_collect_age not reported: %+v", metrics)
+		return 0
+	}
+
+	// First collect: age since Prepare
+	now = now.Add(1 * time.Second)
+	metrics, err := c.Collect(context.Background(), "kpi")
+	require.NoError(t, err)
+	assert.Equal(t, float64(1000), age(metrics))
+
+	// Next collect: age since previous successful collect
+	now = now.Add(2 * time.Second)
+	metrics, err = c.Collect(context.Background(), "kpi")
+	require.NoError(t, err)
+	assert.Equal(t, float64(2000), age(metrics))
+
+	// Collect errors: age keeps increasing and is returned with the error
+	m.Set("mysql_server_replication_lag_log", mock.SQLResult{Err: fmt.Errorf("proxysql down")})
+	now = now.Add(5 * time.Second)
+	metrics, err = c.Collect(context.Background(), "kpi")
+	require.Error(t, err)
+	assert.Equal(t, float64(5000), age(metrics))
+	now = now.Add(5 * time.Second)
+	metrics, err = c.Collect(context.Background(), "kpi")
+	require.Error(t, err)
+	assert.Equal(t, float64(10000), age(metrics))
+}
+
+func TestReportUp(t *testing.T) {
+	up := blip.MetricValue{Name: "up", Type: blip.GAUGE, Value: 1}
+	r := &fakeReader{lag: heartbeat.Lag{Milliseconds: 250, SourceId: "source1", Replica: true}}
+	c := NewLagWithReader(mock.NewSQL(nil).DB(), r)
+	_, err := c.Prepare(context.Background(), lagPlan(map[string]string{
+		OPT_WRITER:    LAG_WRITER_BLIP,
+		OPT_REPORT_UP: "yes",
+	}))
+	require.NoError(t, err)
+
+	// Lag reported: up with lag
+	metrics, err := c.Collect(context.Background(), "kpi")
+	require.NoError(t, err)
+	expect := []blip.MetricValue{
+		{Name: "current", Type: blip.GAUGE, Value: 250, Meta: map[string]string{"source": "source1"}},
+		up,
+	}
+	assert.Equal(t, expect, metrics)
+
+	// No heartbeat: current dropped (report-no-heartbeat=no), up reported
+	r.lag = heartbeat.Lag{Milliseconds: -1, Replica: true}
+	metrics, err = c.Collect(context.Background(), "kpi")
+	require.NoError(t, err)
+	assert.Equal(t, []blip.MetricValue{up}, metrics)
+
+	// Not a replica: current dropped (report-not-a-replica=no), up reported
+	// and not ErrNoMetrics
+	r.lag = heartbeat.Lag{Milliseconds: -1}
+	metrics, err = c.Collect(context.Background(), "kpi")
+	require.NoError(t, err)
+	assert.Equal(t, []blip.MetricValue{up}, metrics)
+
+	// Disabled (default): not a replica is no metrics
+	c = NewLagWithReader(mock.NewSQL(nil).DB(), r)
+	_, err = c.Prepare(context.Background(), lagPlan(map[string]string{OPT_WRITER: LAG_WRITER_BLIP}))
+	require.NoError(t, err)
+	metrics, err = c.Collect(context.Background(), "kpi")
+	assert.ErrorIs(t, err, blip.ErrNoMetrics)
+	assert.Empty(t, metrics)
+
+	// Collect error: up reported with the error
+	m := mock.NewSQL(map[string]mock.SQLResult{
+		"mysql_server_replication_lag_log": {
+			Columns: []string{"hostname", "port", "repl_lag"},
+			Rows:    [][]driver.Value{{"db1", int64(3306), float64(1)}},
+		},
+	})
+	c = NewLag(m.DB())
+	_, err = c.Prepare(context.Background(), lagPlan(map[string]string{
+		OPT_WRITER:    LAG_WRITER_PROXYSQL,
+		OPT_REPORT_UP: "yes",
+	}))
+	require.NoError(t, err)
+	m.Set("mysql_server_replication_lag_log", mock.SQLResult{Err: fmt.Errorf("proxysql down")})
+	metrics, err = c.Collect(context.Background(), "kpi")
+	require.Error(t, err)
+	assert.Equal(t, []blip.MetricValue{up}, metrics)
+}
+
+func TestMultipleReplCheck(t *testing.T) {
+	// repl-check=read_only,is_replica: replica only if both are true, checked
+	// with one query. The mock returns 0 as if read_only=1 but is_replica=0.
+	m := mock.NewSQL(map[string]mock.SQLResult{
+		"SELECT @@`read_only` AND @@`is_replica`": {Columns: []string{"isRepl"}, Rows: [][]driver.Value{{int64(0)}}},
+		"replication_applier_status_by_worker":    {Err: fmt.Errorf("lag query should not run")},
+	})
+	c := NewLag(m.DB())
+	_, err := c.Prepare(context.Background(), lagPlan(map[string]string{
+		OPT_WRITER:               LAG_WRITER_PFS,
+		OPT_REPL_CHECK:           "read_only, is_replica",
+		OPT_REPORT_NOT_A_REPLICA: "yes",
+	}))
+	require.NoError(t, err)
+	assert.Equal(t, "read_only,is_replica", c.replCheck)
+	metrics, err := c.Collect(context.Background(), "kpi")
+	require.NoError(t, err)
+	assert.Equal(t, []blip.MetricValue{{Name: "current", Type: blip.GAUGE, Value: -1}}, metrics)
+	assert.Equal(t, 0, m.Count("replication_applier_status_by_worker"))
+
+	// Invalid variable names
+	for _, replCheck := range []string{"read_only,@@foo", "read_only; DROP TABLE t", "`x`"} {
+		_, err := NewLag(m.DB()).Prepare(context.Background(), lagPlan(map[string]string{
+			OPT_WRITER:     LAG_WRITER_PFS,
+			OPT_REPL_CHECK: replCheck,
+		}))
+		assert.Error(t, err, replCheck)
+	}
+}
+
+func TestClockOffset(t *testing.T) {
+	// Replica clock 500 ms ahead of source: lag 1498 ms is really 998 ms
+	m := mock.NewSQL(map[string]mock.SQLResult{
+		"percona": {
+			Columns: []string{"CAST(NOW(6) AS CHAR)", "CAST(`ts` AS CHAR)", "CAST(`server_id` AS CHAR)"},
+			Rows:    [][]driver.Value{{"2024-05-28 18:50:06.500000", "2024-05-28T18:50:05.001230", "101"}},
+		},
+	})
+	c := NewLag(m.DB())
+	_, err := c.Prepare(context.Background(), lagPlan(map[string]string{
+		OPT_WRITER:              LAG_WRITER_PT,
+		OPT_HEARTBEAT_SOURCE_ID: "101",
+		OPT_CLOCK_OFFSET:        "500",
+	}))
+	require.NoError(t, err)
+	metrics, err := c.Collect(context.Background(), "kpi")
+	require.NoError(t, err)
+	expect := []blip.MetricValue{{Name: "current", Type: blip.GAUGE, Value: 998, Meta: map[string]string{"source": "101", "clock_offset": "500"}}}
+	assert.Equal(t, expect, metrics)
+
+	// Not applied to ProxySQL
+	m = mock.NewSQL(map[string]mock.SQLResult{
+		"mysql_server_replication_lag_log": {
+			Columns: []string{"hostname", "port", "repl_lag"},
+			Rows:    [][]driver.Value{{"db1", int64(3306), float64(1)}},
+		},
+	})
+	c = NewLag(m.DB())
+	_, err = c.Prepare(context.Background(), lagPlan(map[string]string{OPT_WRITER: LAG_WRITER_PROXYSQL, OPT_CLOCK_OFFSET: "500"}))
+	require.NoError(t, err)
+	metrics, err = c.Collect(context.Background(), "kpi")
+	require.NoError(t, err)
+	expect = []blip.MetricValue{{Name: "current", Type: blip.GAUGE, Value: 1000, Meta: map[string]string{"backend": "db1:3306"}}}
+	assert.Equal(t, expect, metrics)
+
+	// Invalid
+	c = NewLag(m.DB())
+	_, err = c.Prepare(context.Background(), lagPlan(map[string]string{OPT_WRITER: LAG_WRITER_PROXYSQL, OPT_CLOCK_OFFSET: "5ms"}))
+	assert.Error(t, err)
+}
+
+func TestReportWriter(t *testing.T) {
+	tl := &testLogger{msgs: map[string][]string{}}
+	Log = tl
+	defer func() { Log = DebugLogger{} }()
+
+	writerMetric := func(metrics []blip.MetricValue) blip.MetricValue {
+		for _, m := range metrics {
+			if m.Name == "writer" {
+				return m
+			}
+		}
+		t.Fatalf("writer not reported: %+v", metrics)
+		return blip.MetricValue{}
+	}
+
+	// Auto-detect PFS: expected, no warning
+	uuid := "3e11fa47-71ca-11e1-9e33-c80aa9429562"
+	m := mock.NewSQL(map[string]mock.SQLResult{
+		"replication_applier_status_by_worker": pfsResult([]driver.Value{"", uuid + ":10", "ON", "ON", uuid + ":10", int64(1), uuid + ":10",
+			1716922205.5, 1716922205.0, 0.0, 0.0, "db1", uuid}),
+	})
+	c := NewLag(m.DB())
+	_, err := c.Prepare(context.Background(), lagPlan(map[string]string{OPT_REPORT_WRITER: "yes"}))
+	require.NoError(t, err)
+	metrics, err := c.Collect(context.Background(), "kpi")
+	require.NoError(t, err)
+	assert.Equal(t, blip.MetricValue{Name: "writer", Type: blip.GAUGE, Value: 1, Meta: map[string]string{"writer": LAG_WRITER_PFS}}, writerMetric(metrics))
+	tl.Lock()
+	assert.Empty(t, tl.msgs["warn"])
+	tl.Unlock()
+
+	// Auto-detect falls back to blip: warning and writer=2
+	m = mock.NewSQL(map[string]mock.SQLResult{
+		"heartbeat": heartbeatResult("source1", 0),
+	})
+	c = NewLag(m.DB())
+	cleanup, err := c.Prepare(context.Background(), lagPlan(map[string]string{OPT_REPORT_WRITER: "yes"}))
+	require.NoError(t, err)
+	defer cleanup()
+	metrics, err = c.Collect(context.Background(), "kpi")
+	require.NoError(t, err)
+	assert.Equal(t, blip.MetricValue{Name: "writer", Type: blip.GAUGE, Value: 2, Meta: map[string]string{"writer": LAG_WRITER_BLIP}}, writerMetric(metrics))
+	tl.Lock()
+	require.Len(t, tl.msgs["warn"], 1)
+	assert.Contains(t, tl.msgs["warn"][0], "pfs not available")
+	assert.Contains(t, tl.msgs["warn"][0], "using blip")
+	tl.Unlock()
+
+	// Not reported by default
+	c = NewLag(m.DB())
+	cleanup2, err := c.Prepare(context.Background(), lagPlan(map[string]string{OPT_WRITER: LAG_WRITER_BLIP}))
+	require.NoError(t, err)
+	defer cleanup2()
+	metrics, err = c.Collect(context.Background(), "kpi")
+	require.NoError(t, err)
+	for _, m := range metrics {
+		assert.NotEqual(t, "writer", m.Name)
+	}
+}
+
+func TestEmitTimestamp(t *testing.T) {
+	uuid := "3e11fa47-71ca-11e1-9e33-c80aa9429562"
+	row := func(id int64, endTs interface{}) []driver.Value {
+		return []driver.Value{"", uuid + ":10", "ON", "ON", uuid + ":10", id, uuid + ":10",
+			1716922206.0, 1716922205.0, 0.0, 0.0, "db1", uuid, endTs}
+	}
+	m := mock.NewSQL(map[string]mock.SQLResult{
+		"replication_applier_status_by_worker": pfsResult(row(1, 1716922205.25), row(2, 1716922205.5)),
+	})
+	c := NewLag(m.DB())
+	_, err := c.Prepare(context.Background(), lagPlan(map[string]string{
+		OPT_WRITER:         LAG_WRITER_PFS,
+		OPT_EMIT_TIMESTAMP: "yes",
+	}))
+	require.NoError(t, err)
+	metrics, err := c.Collect(context.Background(), "kpi")
+	require.NoError(t, err)
+	var appliedAt []blip.MetricValue
+	for _, m := range metrics {
+		if m.Name == "applied_at" {
+			appliedAt = append(appliedAt, m)
+		}
+	}
+	// Latest of all workers, in milliseconds, not after "now" from MySQL
+	expect := []blip.MetricValue{{Name: "applied_at", Type: blip.GAUGE, Value: 1716922205500, Group: map[string]string{"channel": ""}}}
+	assert.Equal(t, expect, appliedAt)
+	assert.LessOrEqual(t, appliedAt[0].Value, 1716922206.0*1000)
+
+	// Nothing applied yet (NULL): not reported
+	m.Set("replication_applier_status_by_worker", pfsResult(row(1, nil)))
+	metrics, err = c.Collect(context.Background(), "kpi")
+	require.NoError(t, err)
+	for _, m := range metrics {
+		assert.NotEqual(t, "applied_at", m.Name)
+	}
+
+	// Ignored for other writers
+	m = mock.NewSQL(map[string]mock.SQLResult{"heartbeat": heartbeatResult("source1", 0)})
+	c = NewLag(m.DB())
+	cleanup, err := c.Prepare(context.Background(), lagPlan(map[string]string{
+		OPT_WRITER:         LAG_WRITER_BLIP,
+		OPT_EMIT_TIMESTAMP: "yes",
+	}))
+	require.NoError(t, err)
+	defer cleanup()
+	assert.False(t, c.atLevel["kpi"].emitTs)
+}
+
+func TestCost(t *testing.T) {
+	uuid := "3e11fa47-71ca-11e1-9e33-c80aa9429562"
+	results := map[string]mock.SQLResult{
+		"replication_applier_status_by_worker": pfsResult([]driver.Value{"", uuid + ":10", "ON", "ON", uuid + ":10", int64(1), uuid + ":10",
+			1716922205.5, 1716922205.0, 0.0, 0.0, "db1", uuid}),
+		"heartbeat":                      heartbeatResult("source1", 0),
+		"replication_group_member_stats": groupReplResult("ONLINE", 0, 0),
+		"mysql_server_replication_lag_log": {
+			Columns: []string{"hostname", "port", "repl_lag"},
+			Rows:    [][]driver.Value{{"db1", int64(3306), float64(1)}},
+		},
+		"`percona`.`heartbeat`": {
+			Columns: []string{"CAST(NOW(6) AS CHAR)", "CAST(`ts` AS CHAR)", "CAST(`server_id` AS CHAR)"},
+			Rows:    [][]driver.Value{{"2024-05-28 18:50:06.500000", "2024-05-28T18:50:05.001230", "101"}},
+		},
+	}
+	tests := []struct {
+		opts map[string]string
+		cost byte
+	}{
+		{map[string]string{OPT_WRITER: LAG_WRITER_PFS}, blip.COST_EXPENSIVE},
+		{map[string]string{OPT_WRITER: LAG_WRITER_BLIP}, blip.COST_CHEAP},
+		{map[string]string{OPT_WRITER: LAG_WRITER_BLIP, OPT_CROSS_CHECK: "yes"}, blip.COST_EXPENSIVE},
+		{map[string]string{OPT_WRITER: LAG_WRITER_PROXYSQL}, blip.COST_MODERATE},
+		{map[string]string{OPT_WRITER: LAG_WRITER_PT}, blip.COST_CHEAP},
+		{map[string]string{OPT_WRITER: LAG_WRITER_GROUP}, blip.COST_MODERATE},
+		{map[string]string{OPT_ROLE: ROLE_SOURCE}, blip.COST_CHEAP},
+		{map[string]string{}, blip.COST_EXPENSIVE}, // auto: pfs
+	}
+	for _, tc := range tests {
+		c := NewLag(mock.NewSQL(results).DB())
+		cleanup, err := c.Prepare(context.Background(), lagPlan(tc.opts))
+		require.NoError(t, err, "%v", tc.opts)
+		assert.Equal(t, tc.cost, c.Cost("kpi"), "%v", tc.opts)
+		assert.Equal(t, blip.COST_UNKNOWN, c.Cost("not-prepared"))
+		if cleanup != nil {
+			cleanup()
+		}
+	}
+}
+
+func TestPFSDSN(t *testing.T) {
+	// With pfs-dsn, Performance Schema queries use a separate connection pool
+	// that's closed by the cleanup func
+	uuid := "3e11fa47-71ca-11e1-9e33-c80aa9429562"
+	local := mock.NewSQL(nil)
+	pfs := mock.NewSQL(map[string]mock.SQLResult{
+		"replication_applier_status_by_worker": pfsResult([]driver.Value{"", uuid + ":10", "ON", "ON", uuid + ":10", int64(1), uuid + ":10",
+			1716922205.5, 1716922205.0, 0.0, 0.0, "db1", uuid}),
+	})
+
+	var gotDSN string
+	var pfsDB *sql.DB
+	c := NewLag(local.DB())
+	c.openDB = func(dsn string) (*sql.DB, error) {
+		gotDSN = dsn
+		pfsDB = pfs.DB()
+		return pfsDB, nil
+	}
+	cleanup, err := c.Prepare(context.Background(), lagPlan(map[string]string{
+		OPT_WRITER:          LAG_WRITER_PFS,
+		OPT_PFS_DSN:         "blip@unix(/tmp/mysql.sock)/",
+		OPT_REPORT_DB_STATS: "yes",
+	}))
+	require.NoError(t, err)
+	require.NotNil(t, cleanup)
+	assert.Equal(t, "blip@unix(/tmp/mysql.sock)/", gotDSN)
+
+	metrics, err := c.Collect(context.Background(), "kpi")
+	require.NoError(t, err)
+	assert.Equal(t, float64(0), metrics[0].Value)
+	assert.True(t, pfs.Count("replication_applier_status_by_worker") > 0)
+	assert.Empty(t, local.Queries(), "PFS queried on monitor DB, expected pfs-dsn DB")
+	assert.Equal(t, pfsDB, c.atLevel["kpi"].db) // report-db-stats
+
+	require.NoError(t, pfsDB.Ping())
+	cleanup()
+	assert.Error(t, pfsDB.Ping(), "pfs-dsn DB not closed by cleanup")
+
+	// Prepare error closes the pool
+	pfs = mock.NewSQL(map[string]mock.SQLResult{"replication_applier_status_by_worker": {Err: fmt.Errorf("no pfs")}})
+	c = NewLag(local.DB())
+	c.openDB = func(dsn string) (*sql.DB, error) {
+		pfsDB = pfs.DB()
+		return pfsDB, nil
+	}
+	_, err = c.Prepare(context.Background(), lagPlan(map[string]string{
+		OPT_WRITER:  LAG_WRITER_PFS,
+		OPT_PFS_DSN: "blip@unix(/tmp/mysql.sock)/",
+	}))
+	require.Error(t, err)
+	assert.Error(t, pfsDB.Ping(), "pfs-dsn DB not closed on Prepare error")
+}
+
+func TestDebounce(t *testing.T) {
+	// debounce-threshold=1000 and debounce-count=3: lag above 1s is reported
+	// only after 3 consecutive collections above 1s
+	m := mock.NewSQL(nil)
+	setLag := func(sec float64) {
+		m.Set("mysql_server_replication_lag_log", mock.SQLResult{
+			Columns: []string{"hostname", "port", "repl_lag"},
+			Rows:    [][]driver.Value{{"db1", int64(3306), sec}},
+		})
+	}
+	setLag(0.1)
+	c := NewLag(m.DB())
+	_, err := c.Prepare(context.Background(), lagPlan(map[string]string{
+		OPT_WRITER:             LAG_WRITER_PROXYSQL,
+		OPT_DEBOUNCE_COUNT:     "3",
+		OPT_DEBOUNCE_THRESHOLD: "1000",
+	}))
+	require.NoError(t, err)
+
+	tests := []struct {
+		lag       float64 // seconds
+		expect    float64 // milliseconds
+		debounced string  // meta
+	}{
+		{0.1, 100, ""},
+		{5, 100, "5000"}, // single spike: held
+		{0.2, 200, ""},   // back below threshold: spike suppressed
+		{5, 200, "5000"}, // sustained high lag: held 1...
+		{6, 200, "6000"}, // ...held 2...
+		{7, 7000, ""},    // ...confirmed on 3rd
+		{8, 8000, ""},    // still above: reported
+		{0.3, 300, ""},
+	}
+	for i, tc := range tests {
+		setLag(tc.lag)
+		metrics, err := c.Collect(context.Background(), "kpi")
+		require.NoError(t, err)
+		require.Len(t, metrics, 1)
+		assert.Equal(t, tc.expect, metrics[0].Value, "collect %d: lag %.1fs", i+1, tc.lag)
+		assert.Equal(t, tc.debounced, metrics[0].Meta["debounced"], "collect %d: lag %.1fs", i+1, tc.lag)
+	}
+
+	// First value of a series isn't held: nothing confirmed yet
+	c = NewLag(m.DB())
+	_, err = c.Prepare(context.Background(), lagPlan(map[string]string{
+		OPT_WRITER:             LAG_WRITER_PROXYSQL,
+		OPT_DEBOUNCE_COUNT:     "3",
+		OPT_DEBOUNCE_THRESHOLD: "1000",
+	}))
+	require.NoError(t, err)
+	setLag(5)
+	metrics, err := c.Collect(context.Background(), "kpi")
+	require.NoError(t, err)
+	assert.Equal(t, float64(5000), metrics[0].Value)
+
+	// Invalid options
+	for _, opts := range []map[string]string{
+		{OPT_DEBOUNCE_COUNT: "3"},
+		{OPT_DEBOUNCE_THRESHOLD: "1000"},
+		{OPT_DEBOUNCE_COUNT: "0", OPT_DEBOUNCE_THRESHOLD: "1000"},
+		{OPT_DEBOUNCE_COUNT: "3", OPT_DEBOUNCE_THRESHOLD: "1s"},
+	} {
+		opts[OPT_WRITER] = LAG_WRITER_PROXYSQL
+		_, err := NewLag(m.DB()).Prepare(context.Background(), lagPlan(opts))
+		assert.Error(t, err, "%v", opts)
+	}
+}
+
+// fakeReader is a heartbeat.Reader that returns a fixed lag.
+type fakeReader struct {
+	lag      heartbeat.Lag
+	started  bool
+	stopped  bool
+	restarts uint
+	advance  time.Duration // added to lag.LastTs on each ReadOnce
+}
+
+func (r *fakeReader) Start() error { r.started = true; return nil }
+func (r *fakeReader) Stop()        { r.stopped = true }
+func (r *fakeReader) Alive() bool  { return !r.stopped }
+func (r *fakeReader) Err() error   { return nil }
+func (r *fakeReader) Lag(context.Context) (heartbeat.Lag, error) {
+	return r.lag, nil
+}
+func (r *fakeReader) ReadOnce(context.Context) (heartbeat.Lag, error) {
+	r.lag.LastTs = r.lag.LastTs.Add(r.advance)
+	return r.lag, nil
+}
+func (r *fakeReader) Restarts() uint { return r.restarts }
+
+func TestNewLagWithReader(t *testing.T) {
+	// The injected reader is used instead of a Blip heartbeat reader, so no
+	// heartbeat queries, and it's not started or stopped by Lag
+	m := mock.NewSQL(nil)
+	r := &fakeReader{lag: heartbeat.Lag{Milliseconds: 1500, SourceId: "source1", Replica: true}}
+	c := NewLagWithReader(m.DB(), r)
+	cleanup, err := c.Prepare(context.Background(), lagPlan(map[string]string{
+		OPT_WRITER:          LAG_WRITER_BLIP,
+		OPT_HEARTBEAT_TABLE: "ignored.heartbeat",
+	}))
+	require.NoError(t, err)
+	require.NotNil(t, cleanup) // always valid, but doesn't stop the reader
+
+	metrics, err := c.Collect(context.Background(), "kpi")
+	require.NoError(t, err)
+	expect := []blip.MetricValue{{Name: "current", Type: blip.GAUGE, Value: 1500, Meta: map[string]string{"source": "source1"}}}
+	assert.Equal(t, expect, metrics)
+
+	metrics, err = c.ReadOnce(context.Background(), "kpi")
+	require.NoError(t, err)
+	assert.Equal(t, expect, metrics)
+
+	// Not a replica
+	r.lag = heartbeat.Lag{Replica: false}
+	metrics, err = c.Collect(context.Background(), "kpi")
+	require.ErrorIs(t, err, blip.ErrNoMetrics)
+	assert.Empty(t, metrics) // report-not-a-replica=no (default)
+
+	cleanup()
+	assert.False(t, r.started)
+	assert.False(t, r.stopped)
+	assert.Empty(t, m.Queries())
+
+	// Reader stopped by caller: Collect returns an error
+	r.Stop()
+	_, err = c.Collect(context.Background(), "kpi")
+	assert.Error(t, err)
+}
+
+func TestSourceIdAndRole(t *testing.T) {
+	m := mock.NewSQL(map[string]mock.SQLResult{
+		"heartbeat": heartbeatResult("source1", 0),
+	})
+
+	// Both: error
+	_, err := NewLag(m.DB()).Prepare(context.Background(), lagPlan(map[string]string{
+		OPT_WRITER:                LAG_WRITER_BLIP,
+		OPT_HEARTBEAT_SOURCE_ID:   "source1",
+		OPT_HEARTBEAT_SOURCE_ROLE: "primary",
+	}))
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "mutually exclusive")
+
+	// Only one: ok
+	for _, opt := range []string{OPT_HEARTBEAT_SOURCE_ID, OPT_HEARTBEAT_SOURCE_ROLE} {
+		cleanup, err := NewLag(m.DB()).Prepare(context.Background(), lagPlan(map[string]string{
+			OPT_WRITER: LAG_WRITER_BLIP,
+			opt:        "source1",
+		}))
+		require.NoError(t, err, opt)
+		cleanup()
+	}
+}
+
+func TestHeartbeatTag(t *testing.T) {
+	// Several logical heartbeats in one table, distinguished by column tag
+	m := mock.NewSQL(map[string]mock.SQLResult{
+		"heartbeat":        heartbeatResult("untagged", 0),
+		"AND tag='etl'":    heartbeatResult("etl-writer", 0),
+		"AND tag='app'":    heartbeatResult("app-writer", 0),
+		"AND tag='absent'": {Columns: []string{"NOW(3)", "ts", "freq", "src_id", "1"}}, // no rows
+	})
+	for tag, srcId := range map[string]string{"etl": "etl-writer", "app": "app-writer", "": "untagged"} {
+		c := NewLag(m.DB())
+		cleanup, err := c.Prepare(context.Background(), lagPlan(map[string]string{
+			OPT_WRITER:        LAG_WRITER_BLIP,
+			OPT_HEARTBEAT_TAG: tag,
+		}))
+		require.NoError(t, err, tag)
+		metrics, err := c.ReadOnce(context.Background(), "kpi")
+		require.NoError(t, err, tag)
+		require.Len(t, metrics, 1, tag)
+		assert.Equal(t, srcId, metrics[0].Meta["source"], tag)
+		cleanup()
+	}
+
+	// Tag matches no rows: no heartbeat
+	c := NewLag(m.DB())
+	cleanup, err := c.Prepare(context.Background(), lagPlan(map[string]string{
+		OPT_WRITER:              LAG_WRITER_BLIP,
+		OPT_HEARTBEAT_TAG:       "absent",
+		OPT_REPORT_NO_HEARTBEAT: "yes",
+	}))
+	require.NoError(t, err)
+	defer cleanup()
+	metrics, err := c.ReadOnce(context.Background(), "kpi")
+	require.NoError(t, err)
+	assert.Equal(t, []blip.MetricValue{{Name: "current", Type: blip.GAUGE, Value: -1}}, metrics)
+}
+
+func TestReportReaderRestarts(t *testing.T) {
+	r := &fakeReader{lag: heartbeat.Lag{Milliseconds: 100, SourceId: "source1", Replica: true}, restarts: 3}
+	c := NewLagWithReader(mock.NewSQL(nil).DB(), r)
+	_, err := c.Prepare(context.Background(), lagPlan(map[string]string{
+		OPT_WRITER:          LAG_WRITER_BLIP,
+		OPT_REPORT_RESTARTS: "yes",
+	}))
+	require.NoError(t, err)
+	metrics, err := c.Collect(context.Background(), "kpi")
+	require.NoError(t, err)
+	expect := []blip.MetricValue{
+		{Name: "current", Type: blip.GAUGE, Value: 100, Meta: map[string]string{"source": "source1"}},
+		{Name: "reader_restarts", Type: blip.CUMULATIVE_COUNTER, Value: 3},
+	}
+	assert.Equal(t, expect, metrics)
+}
+
+func TestRequireHeartbeat(t *testing.T) {
+	defer func(wait, poll time.Duration) {
+		RequireHeartbeatWait, RequireHeartbeatPoll = wait, poll
+	}(RequireHeartbeatWait, RequireHeartbeatPoll)
+	RequireHeartbeatWait = 100 * time.Millisecond
+	RequireHeartbeatPoll = 10 * time.Millisecond
+
+	ts := time.Date(2024, 5, 28, 12, 0, 0, 0, time.UTC)
+	prepare := func(r *fakeReader, require string) error {
+		c := NewLagWithReader(mock.NewSQL(nil).DB(), r)
+		_, err := c.Prepare(context.Background(), lagPlan(map[string]string{
+			OPT_WRITER:            LAG_WRITER_BLIP,
+			OPT_REQUIRE_HEARTBEAT: require,
+		}))
+		return err
+	}
+
+	// Present and advancing
+	r := &fakeReader{lag: heartbeat.Lag{Milliseconds: 100, LastTs: ts, SourceId: "source1", Replica: true}, advance: time.Second}
+	assert.NoError(t, prepare(r, "yes"))
+
+	// Present but not advancing (writer stopped)
+	r = &fakeReader{lag: heartbeat.Lag{Milliseconds: 100, LastTs: ts, SourceId: "source1", Replica: true}}
+	err := prepare(r, "yes")
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "not advancing")
+
+	// Absent: no heartbeat row
+	r = &fakeReader{lag: heartbeat.Lag{Milliseconds: -1, Replica: true}}
+	err = prepare(r, "yes")
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "no heartbeat")
+	assert.NoError(t, prepare(r, "no")) // default: dropped at runtime
+
+	// Not a replica: nothing to require
+	r = &fakeReader{lag: heartbeat.Lag{Milliseconds: -1, Replica: false}}
+	assert.NoError(t, prepare(r, "yes"))
+}
+
+func TestSLA(t *testing.T) {
+	tests := []struct {
+		lag       int64
+		remaining float64
+		breached  float64
+	}{
+		{100, 400, 0},  // within budget
+		{500, 0, 0},    // at budget: not breached
+		{800, -300, 1}, // breached
+	}
+	for _, tc := range tests {
+		r := &fakeReader{lag: heartbeat.Lag{Milliseconds: tc.lag, SourceId: "source1", Replica: true}}
+		c := NewLagWithReader(mock.NewSQL(nil).DB(), r)
+		_, err := c.Prepare(context.Background(), lagPlan(map[string]string{
+			OPT_WRITER: LAG_WRITER_BLIP,
+			OPT_SLA_MS: "500",
+		}))
+		require.NoError(t, err)
+		metrics, err := c.Collect(context.Background(), "kpi")
+		require.NoError(t, err)
+		meta := map[string]string{"source": "source1"}
+		expect := []blip.MetricValue{
+			{Name: "current", Type: blip.GAUGE, Value: float64(tc.lag), Meta: meta},
+			{Name: "sla_remaining", Type: blip.GAUGE, Value: tc.remaining, Meta: meta},
+			{Name: "sla_breached", Type: blip.GAUGE, Value: tc.breached, Meta: meta},
+		}
+		assert.Equal(t, expect, metrics, tc.lag)
+	}
+
+	// No heartbeat: SLA can't be measured
+	r := &fakeReader{lag: heartbeat.Lag{Milliseconds: -1, Replica: true}}
+	c := NewLagWithReader(mock.NewSQL(nil).DB(), r)
+	_, err := c.Prepare(context.Background(), lagPlan(map[string]string{
+		OPT_WRITER:              LAG_WRITER_BLIP,
+		OPT_SLA_MS:              "500",
+		OPT_REPORT_NO_HEARTBEAT: "yes",
+	}))
+	require.NoError(t, err)
+	metrics, err := c.Collect(context.Background(), "kpi")
+	require.NoError(t, err)
+	require.Len(t, metrics, 1)
+	assert.Equal(t, "current", metrics[0].Name)
+
+	// unit=s: current in seconds, sla_remaining still milliseconds
+	r = &fakeReader{lag: heartbeat.Lag{Milliseconds: 800, SourceId: "source1", Replica: true}}
+	c = NewLagWithReader(mock.NewSQL(nil).DB(), r)
+	_, err = c.Prepare(context.Background(), lagPlan(map[string]string{
+		OPT_WRITER: LAG_WRITER_BLIP,
+		OPT_SLA_MS: "500",
+		OPT_UNIT:   UNIT_S,
+	}))
+	require.NoError(t, err)
+	metrics, err = c.Collect(context.Background(), "kpi")
+	require.NoError(t, err)
+	require.Len(t, metrics, 3)
+	assert.Equal(t, 0.8, metrics[0].Value)
+	assert.Equal(t, float64(-300), metrics[1].Value)
+
+	// Invalid
+	for _, v := range []string{"0", "-1", "1s"} {
+		_, err := NewLag(mock.NewSQL(nil).DB()).Prepare(context.Background(), lagPlan(map[string]string{
+			OPT_WRITER: LAG_WRITER_BLIP,
+			OPT_SLA_MS: v,
+		}))
+		assert.Error(t, err, v)
+	}
+}
+
+func TestLogScale(t *testing.T) {
+	tests := []struct {
+		ms   float64
+		log2 float64
+	}{
+		{0, 0},
+		{1, 1},
+		{3, 2},
+		{1023, 10},
+		{65535, 16},
+		{3600000, 21.779565},
+		{-50, 0}, // clock skew: never negative
+	}
+	for _, tc := range tests {
+		assert.InDelta(t, tc.log2, log2Lag(tc.ms), 0.000001, tc.ms)
+	}
+
+	// Two channels, one absent: log2 only for the present channel
+	metrics := log2Metrics([]blip.MetricValue{
+		{Name: "current", Value: 7, Group: map[string]string{"channel": "ch1"}},
+		{Name: "current", Value: math.NaN(), Group: map[string]string{"channel": "ch2"}},
+		{Name: "backlog", Value: 10, Group: map[string]string{"channel": "ch1"}},
+	})
+	require.Len(t, metrics, 4)
+	assert.Equal(t, blip.MetricValue{Name: "log2", Type: blip.GAUGE, Value: 3, Group: map[string]string{"channel": "ch1"}}, metrics[3])
+
+	// Collect: current is still linear; unit=s doesn't change log2
+	for _, unit := range []string{"ms", "s"} {
+		r := &fakeReader{lag: heartbeat.Lag{Milliseconds: 1023, SourceId: "source1", Replica: true}}
+		c := NewLagWithReader(mock.NewSQL(nil).DB(), r)
+		_, err := c.Prepare(context.Background(), lagPlan(map[string]string{
+			OPT_WRITER:    LAG_WRITER_BLIP,
+			OPT_LOG_SCALE: "yes",
+			OPT_UNIT:      unit,
+		}))
+		require.NoError(t, err)
+		metrics, err = c.Collect(context.Background(), "kpi")
+		require.NoError(t, err)
+		require.Len(t, metrics, 2, unit)
+		assert.Equal(t, "current", metrics[0].Name)
+		assert.Equal(t, "log2", metrics[1].Name)
+		assert.Equal(t, float64(10), metrics[1].Value, unit)
+		if unit == "s" {
+			assert.Equal(t, 1.023, metrics[0].Value)
+		} else {
+			assert.Equal(t, float64(1023), metrics[0].Value)
+		}
+	}
+
+	// Disabled (default)
+	r := &fakeReader{lag: heartbeat.Lag{Milliseconds: 1023, SourceId: "source1", Replica: true}}
+	c := NewLagWithReader(mock.NewSQL(nil).DB(), r)
+	_, err := c.Prepare(context.Background(), lagPlan(map[string]string{
+		OPT_WRITER: LAG_WRITER_BLIP,
+	}))
+	require.NoError(t, err)
+	metrics, err = c.Collect(context.Background(), "kpi")
+	require.NoError(t, err)
+	require.Len(t, metrics, 1)
+}
+
+// slowWriter is a custom LagWriter that takes a while to collect and records
+// the maximum number of concurrent Collect calls.
+type slowWriter struct {
+	mu     sync.Mutex
+	active int
+	max    int
+}
+
+func (w *slowWriter) Prepare(ctx context.Context, c *Lag, levelName string, plan blip.Plan, opts map[string]string) (func(), error) {
+	return nil, nil
+}
+
+func (w *slowWriter) Collect(ctx context.Context, c *Lag, levelName string) ([]blip.MetricValue, error) {
+	w.mu.Lock()
+	w.active++
+	if w.active > w.max {
+		w.max = w.active
+	}
+	w.mu.Unlock()
+	time.Sleep(20 * time.Millisecond)
+	w.mu.Lock()
+	w.active--
+	w.mu.Unlock()
+	return []blip.MetricValue{{Name: "current", Type: blip.GAUGE, Value: 100}}, nil
+}
+
+func TestMaxConcurrentQueries(t *testing.T) {
+	w := &slowWriter{}
+	require.NoError(t, RegisterWriter("slow", w))
+	defer RemoveWriter("slow")
+
+	// collectAll collects from each collector concurrently, 3 times, and
+	// returns the max concurrent writer Collect calls
+	collectAll := func(collectors []*Lag) int {
+		w.max = 0
+		var wg sync.WaitGroup
+		for _, c := range collectors {
+			for i := 0; i < 3; i++ {
+				wg.Add(1)
+				go func(c *Lag) {
+					defer wg.Done()
+					_, err := c.Collect(context.Background(), "kpi")
+					assert.NoError(t, err)
+				}(c)
+			}
+		}
+		wg.Wait()
+		return w.max
+	}
+	prepare := func(c *Lag, opts map[string]string) *Lag {
+		opts[OPT_WRITER] = "slow"
+		_, err := c.Prepare(context.Background(), lagPlan(opts))
+		require.NoError(t, err)
+		return c
+	}
+
+	// Not limited: collectors query concurrently
+	db := mock.NewSQL(nil).DB()
+	assert.Equal(t, 3, collectAll([]*Lag{
+		prepare(NewLag(db), map[string]string{}),
+		prepare(NewLag(db), map[string]string{}),
+		prepare(NewLag(db), map[string]string{}),
+	}))
+
+	// Shared limiter from NewLagWithLimiter
+	lim := sqlutil.NewLimiter(2)
+	assert.Equal(t, 2, collectAll([]*Lag{
+		prepare(NewLagWithLimiter(db, lim), map[string]string{}),
+		prepare(NewLagWithLimiter(db, lim), map[string]string{}),
+		prepare(NewLagWithLimiter(db, lim), map[string]string{}),
+	}))
+
+	// Option: monitor limiter shared by collectors for the same monitor
+	assert.Equal(t, 1, collectAll([]*Lag{
+		prepare(NewLag(db), map[string]string{OPT_MAX_CONCURRENT: "1"}),
+		prepare(NewLag(db), map[string]string{OPT_MAX_CONCURRENT: "1"}),
+	}))
+	monLim, _ := sqlutil.SharedLimiter("m1", 1)
+	assert.Same(t, monLim, prepare(NewLag(db), map[string]string{OPT_MAX_CONCURRENT: "1"}).atLevel["kpi"].limiter)
+
+	// Different limit replaces the monitor limiter, and cleanup releases it
+	c := NewLag(db)
+	cleanup, err := c.Prepare(context.Background(), lagPlan(map[string]string{OPT_WRITER: "slow", OPT_MAX_CONCURRENT: "2"}))
+	require.NoError(t, err)
+	lim = c.atLevel["kpi"].limiter
+	assert.NotSame(t, monLim, lim)
+	assert.Equal(t, 2, lim.Limit())
+	cleanup()
+	monLim, replaced := sqlutil.SharedLimiter("m1", 2)
+	assert.False(t, replaced) // removed by cleanup, not replaced
+	assert.NotSame(t, lim, monLim)
+	sqlutil.ReleaseLimiter("m1", monLim)
+
+	// Collect yields: error if no slot before the collection times out
+	lim = sqlutil.NewLimiter(1)
+	require.NoError(t, lim.Acquire(context.Background()))
+	c = prepare(NewLagWithLimiter(db, lim), map[string]string{})
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, err = c.Collect(ctx, "kpi")
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+
+	// Invalid
+	for _, v := range []string{"0", "-1", "two"} {
+		_, err := NewLag(db).Prepare(context.Background(), lagPlan(map[string]string{OPT_WRITER: "slow", OPT_MAX_CONCURRENT: v}))
+		assert.Error(t, err, v)
+	}
+}
+
+func TestFakeClock(t *testing.T) {
+	// Time-dependent features use Lag.Now, so they're deterministic with a
+	// fake clock: warmup, trend, report-collect-age, and report-query-duration
+	now := time.Date(2024, 5, 28, 12, 0, 0, 0, time.UTC)
+	r := &fakeReader{lag: heartbeat.Lag{Milliseconds: 100, SourceId: "source1", Replica: true}} // no heartbeat read yet
+	c := NewLagWithReader(mock.NewSQL(nil).DB(), r)
+	c.Now = func() time.Time { return now }
+	_, err := c.Prepare(context.Background(), lagPlan(map[string]string{
+		OPT_WRITER:                LAG_WRITER_BLIP,
+		OPT_WARMUP:                "10s",
+		OPT_REPORT_TREND:          "yes",
+		OPT_REPORT_COLLECT_AGE:    "yes",
+		OPT_REPORT_QUERY_DURATION: "yes",
+	}))
+	require.NoError(t, err)
+
+	collect := func(d time.Duration) map[string]float64 {
+		now = now.Add(d)
+		metrics, err := c.Collect(context.Background(), "kpi")
+		require.NoError(t, err)
+		values := map[string]float64{}
+		for _, m := range metrics {
+			values[m.Name] = m.Value
+		}
+		return values
+	}
+
+	// Warming up: reader hasn't read a heartbeat, so no current
+	assert.Equal(t, map[string]float64{"query_duration_ms": 0, "last_collect_age": 1000}, collect(time.Second))
+
+	// Heartbeat read: current, but no trend until the second sample
+	r.lag.LastTs = now
+	assert.Equal(t, map[string]float64{"current": 100, "query_duration_ms": 0, "last_collect_age": 1000}, collect(time.Second))
+
+	// Lag 100 -> 300 in 2s: trend 100 ms/s
+	r.lag.Milliseconds = 300
+	assert.Equal(t, map[string]float64{"current": 300, "trend": 100, "query_duration_ms": 0, "last_collect_age": 2000}, collect(2*time.Second))
+
+	// Default clock
+	assert.NotNil(t, NewLag(nil).Now)
+}
+
+func TestMetricTypes(t *testing.T) {
+	// One Collect returns gauges and counters, each with the type declared in
+	// Help
+	declared := map[string]byte{}
+	for _, m := range NewLag(nil).Help().Metrics {
+		declared[m.Name] = m.Type
+	}
+	r := &fakeReader{lag: heartbeat.Lag{Milliseconds: 100, SourceId: "source1", Replica: true}, restarts: 3}
+	c := NewLagWithReader(mock.NewSQL(nil).DB(), r)
+	_, err := c.Prepare(context.Background(), lagPlan(map[string]string{
+		OPT_WRITER:                LAG_WRITER_BLIP,
+		OPT_REPORT_RESTARTS:       "yes",
+		OPT_REPORT_DB_STATS:       "yes",
+		OPT_REPORT_WRITER:         "yes",
+		OPT_REPORT_QUERY_DURATION: "yes",
+		OPT_REPORT_COLLECT_AGE:    "yes",
+		OPT_MAX_SERIES:            "5",
+	}))
+	require.NoError(t, err)
+	metrics, err := c.Collect(context.Background(), "kpi")
+	require.NoError(t, err)
+	types := map[byte]int{}
+	for _, m := range metrics {
+		expect, ok := declared[m.Name]
+		require.True(t, ok, "metric %s not declared in Help", m.Name)
+		assert.Equal(t, expect, m.Type, m.Name)
+		types[m.Type]++
+	}
+	assert.Equal(t, 2, types[blip.CUMULATIVE_COUNTER]) // reader_restarts, db_wait_count
+	assert.True(t, types[blip.GAUGE] > 0)
+
+	// Custom writer without Type: declared type set, other types not changed
+	w := &typelessWriter{}
+	require.NoError(t, RegisterWriter("typeless", w))
+	defer RemoveWriter("typeless")
+	c = NewLag(mock.NewSQL(nil).DB())
+	_, err = c.Prepare(context.Background(), lagPlan(map[string]string{OPT_WRITER: "typeless"}))
+	require.NoError(t, err)
+	metrics, err = c.Collect(context.Background(), "kpi")
+	require.NoError(t, err)
+	expect := []blip.MetricValue{
+		{Name: "current", Type: blip.GAUGE, Value: 250},
+		{Name: "backlog", Type: blip.GAUGE, Value: 2},
+		{Name: "applied_total", Type: blip.CUMULATIVE_COUNTER, Value: 10},
+		{Name: "not_declared", Type: blip.UNKNOWN, Value: 1},
+	}
+	assert.Equal(t, expect, metrics)
+}
+
+// typelessWriter is a custom LagWriter that doesn't set Type on some metrics.
+type typelessWriter struct{}
+
+func (w *typelessWriter) Prepare(ctx context.Context, c *Lag, levelName string, plan blip.Plan, opts map[string]string) (func(), error) {
+	return nil, nil
+}
+
+func (w *typelessWriter) Collect(ctx context.Context, c *Lag, levelName string) ([]blip.MetricValue, error) {
+	return []blip.MetricValue{
+		{Name: "current", Value: 250},
+		{Name: "backlog", Value: 2},
+		{Name: "applied_total", Type: blip.CUMULATIVE_COUNTER, Value: 10},
+		{Name: "not_declared", Value: 1},
+	}, nil
+}
+
+func TestDebugComponents(t *testing.T) {
+	// No workers applying, new trx received since Prepare: lag is last applied
+	// lag (250 ms)
+	uuid := "3e11fa47-71ca-11e1-9e33-c80aa9429562"
+	row := func(lastQueued string) []driver.Value {
+		return []driver.Value{"", uuid + lastQueued, "ON", "ON", uuid + ":10", int64(1), uuid + ":10",
+			1716922206.0, 1716922205.0, 250000.0, 0.0, "db1", uuid, 1716922205.25, 40000.0}
+	}
+	m := mock.NewSQL(map[string]mock.SQLResult{
+		"replication_applier_status_by_worker": pfsResult(row(":10")),
+	})
+	c := NewLag(m.DB())
+	_, err := c.Prepare(context.Background(), lagPlan(map[string]string{
+		OPT_WRITER:           LAG_WRITER_PFS,
+		OPT_DEBUG_COMPONENTS: "yes",
+	}))
+	require.NoError(t, err)
+	m.Set("replication_applier_status_by_worker", pfsResult(row(":11")))
+	metrics, err := c.Collect(context.Background(), "kpi")
+	require.NoError(t, err)
+	require.Equal(t, "current", metrics[0].Name)
+	assert.Equal(t, float64(250), metrics[0].Value)
+	expect := map[string]string{
+		"source":             "db1",
+		"applier_latency_ms": "250",
+		"queue_latency_ms":   "40",
+		"queue_status":       "received",
+		"source_table":       SOURCE_TABLE_WORKER,
+	}
+	assert.Equal(t, expect, metrics[0].Meta)
+
+	// Disabled (default): no components
+	m.Set("replication_applier_status_by_worker", pfsResult(row(":10")))
+	c = NewLag(m.DB())
+	_, err = c.Prepare(context.Background(), lagPlan(map[string]string{OPT_WRITER: LAG_WRITER_PFS}))
+	require.NoError(t, err)
+	metrics, err = c.Collect(context.Background(), "kpi")
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"source": "db1", "source_table": SOURCE_TABLE_WORKER}, metrics[0].Meta)
+
+	// No workers (fallback): no applier latency
+	m = mock.NewSQL(map[string]mock.SQLResult{
+		"replication_applier_status_by_worker": pfsResult(),
+		"LAST_QUEUED_TRANSACTION_END_QUEUE": {
+			Columns: []string{"CHANNEL_NAME", "io_thd", "sql_thd", "now", "last_queued_ts", "last_queued_lag", "source_host", "source_uuid"},
+			Rows:    [][]driver.Value{{"", "ON", "ON", 1716922205.5, 1716922205.0, 75000.0, "", ""}},
+		},
+	})
+	c = NewLag(m.DB())
+	_, err = c.Prepare(context.Background(), lagPlan(map[string]string{
+		OPT_WRITER:           LAG_WRITER_PFS,
+		OPT_DEBUG_COMPONENTS: "yes",
+	}))
+	require.NoError(t, err)
+	metrics, err = c.Collect(context.Background(), "kpi")
+	require.NoError(t, err)
+	require.Len(t, metrics, 1)
+	assert.Equal(t, map[string]string{"queue_latency_ms": "75", "queue_status": "received", "source_table": SOURCE_TABLE_CONNECTION}, metrics[0].Meta)
+
+	// Ignored for other writers
+	m = mock.NewSQL(map[string]mock.SQLResult{"heartbeat": heartbeatResult("source1", 0)})
+	c = NewLag(m.DB())
+	cleanup, err := c.Prepare(context.Background(), lagPlan(map[string]string{
+		OPT_WRITER:           LAG_WRITER_BLIP,
+		OPT_DEBUG_COMPONENTS: "yes",
+	}))
+	require.NoError(t, err)
+	defer cleanup()
+	assert.False(t, c.atLevel["kpi"].components)
+}
+
+func TestOldestUnapplied(t *testing.T) {
+	// Worker 1 is stuck applying a trx committed 30s ago while worker 2 applies
+	// new trx; the coordinator is scheduling a trx committed 0.5s ago
+	uuid := "3e11fa47-71ca-11e1-9e33-c80aa9429562"
+	now := 1716922230.0
+	row := func(id int64, applyingTs, processingTs float64) []driver.Value {
+		return []driver.Value{"", uuid + ":20", "ON", "ON", uuid + ":20", id, uuid + ":10",
+			now, 1716922199.0, 1000.0, applyingTs, "db1", uuid, 1716922199.0, 1000.0, processingTs}
+	}
+	m := mock.NewSQL(map[string]mock.SQLResult{
+		"replication_applier_status_by_worker": pfsResult(row(1, now-30, now-0.5), row(2, now-0.2, now-0.5)),
+	})
+	c := NewLag(m.DB())
+	_, err := c.Prepare(context.Background(), lagPlan(map[string]string{
+		OPT_WRITER:        LAG_WRITER_PFS,
+		OPT_REPORT_OLDEST: "yes",
+	}))
+	require.NoError(t, err)
+	oldest := func() []blip.MetricValue {
+		metrics, err := c.Collect(context.Background(), "kpi")
+		require.NoError(t, err)
+		var got []blip.MetricValue
+		for _, m := range metrics {
+			if m.Name == "oldest_unapplied" {
+				got = append(got, m)
+			}
+		}
+		return got
+	}
+	expect := []blip.MetricValue{{Name: "oldest_unapplied", Type: blip.GAUGE, Value: 30000, Group: map[string]string{"channel": ""}}}
+	assert.Equal(t, expect, oldest())
+
+	// No workers applying, but coordinator scheduling a trx
+	m.Set("replication_applier_status_by_worker", pfsResult(row(1, 0, now-2), row(2, 0, now-2)))
+	expect[0].Value = 2000
+	assert.Equal(t, expect, oldest())
+
+	// Nothing unapplied (NULL timestamps): zero
+	m.Set("replication_applier_status_by_worker", pfsResult(row(1, 0, 0)))
+	r := m.Results["replication_applier_status_by_worker"]
+	r.Rows[0][15] = nil
+	m.Set("replication_applier_status_by_worker", r)
+	expect[0].Value = 0
+	assert.Equal(t, expect, oldest())
+
+	// Not reported by default
+	c = NewLag(m.DB())
+	_, err = c.Prepare(context.Background(), lagPlan(map[string]string{OPT_WRITER: LAG_WRITER_PFS}))
+	require.NoError(t, err)
+	assert.Empty(t, oldest())
+}
+
+func TestApplyRate(t *testing.T) {
+	uuid := "3e11fa47-71ca-11e1-9e33-c80aa9429562"
+	row := func(id int64, applied int, now float64) []driver.Value {
+		return []driver.Value{"", uuid + ":100", "ON", "ON", uuid + ":100", id, fmt.Sprintf("%s:%d", uuid, applied),
+			now, now - 1, 1000.0, nil, "db1", uuid}
+	}
+	m := mock.NewSQL(map[string]mock.SQLResult{
+		"replication_applier_status_by_worker": pfsResult(row(1, 10, 1716922200.0), row(2, 8, 1716922200.0)),
+	})
+	c := NewLag(m.DB())
+	_, err := c.Prepare(context.Background(), lagPlan(map[string]string{
+		OPT_WRITER:            LAG_WRITER_PFS,
+		OPT_REPORT_APPLY_RATE: "yes",
+	}))
+	require.NoError(t, err)
+	rate := func() []blip.MetricValue {
+		metrics, err := c.Collect(context.Background(), "kpi")
+		require.NoError(t, err)
+		var got []blip.MetricValue
+		for _, m := range metrics {
+			if m.Name == "apply_rate" {
+				got = append(got, m)
+			}
+		}
+		return got
+	}
+
+	// Prepare sampled trx 10 (max of workers), so 5s later at trx 60: 10 trx/s
+	m.Set("replication_applier_status_by_worker", pfsResult(row(1, 58, 1716922205.0), row(2, 60, 1716922205.0)))
+	expect := []blip.MetricValue{{Name: "apply_rate", Type: blip.GAUGE, Value: 10, Group: map[string]string{"channel": ""}}}
+	assert.Equal(t, expect, rate())
+
+	// Nothing to do: zero, not absent
+	m.Set("replication_applier_status_by_worker", pfsResult(row(1, 58, 1716922210.0), row(2, 60, 1716922210.0)))
+	expect[0].Value = 0
+	assert.Equal(t, expect, rate())
+
+	// Transaction number decreased (new source): not reported, then rate from new sample
+	m.Set("replication_applier_status_by_worker", pfsResult(row(1, 5, 1716922215.0)))
+	assert.Empty(t, rate())
+	m.Set("replication_applier_status_by_worker", pfsResult(row(1, 15, 1716922217.0)))
+	expect[0].Value = 5
+	assert.Equal(t, expect, rate())
+
+	// Not reported by default
+	c = NewLag(m.DB())
+	_, err = c.Prepare(context.Background(), lagPlan(map[string]string{OPT_WRITER: LAG_WRITER_PFS}))
+	require.NoError(t, err)
+	m.Set("replication_applier_status_by_worker", pfsResult(row(1, 25, 1716922219.0)))
+	assert.Empty(t, rate())
+}
+
+func TestWorkerDistribution(t *testing.T) {
+	// Last applied lag (microseconds) of 5 workers: 2.5, 40, 8, 120 ms, and
+	// one that has never applied (NULL), which is ignored
+	uuid := "3e11fa47-71ca-11e1-9e33-c80aa9429562"
+	row := func(id int64, lag interface{}) []driver.Value {
+		return []driver.Value{"", uuid + ":20", "ON", "ON", uuid + ":20", id, uuid + ":10",
+			1716922230.0, 1716922199.0, lag, nil, "db1", uuid}
+	}
+	m := mock.NewSQL(map[string]mock.SQLResult{
+		"replication_applier_status_by_worker": pfsResult(row(1, 2500.0), row(2, 40000.0), row(3, 8000.0), row(4, 120000.0), row(5, nil)),
+	})
+	c := NewLag(m.DB())
+	_, err := c.Prepare(context.Background(), lagPlan(map[string]string{
+		OPT_WRITER:             LAG_WRITER_PFS,
+		OPT_REPORT_WORKER_DIST: "yes",
+	}))
+	require.NoError(t, err)
+	dist := func() map[string]float64 {
+		metrics, err := c.Collect(context.Background(), "kpi")
+		require.NoError(t, err)
+		got := map[string]float64{}
+		for _, m := range metrics {
+			if strings.HasPrefix(m.Name, "worker_") && m.Name != "worker_usage" {
+				assert.Equal(t, map[string]string{"channel": ""}, m.Group)
+				got[m.Name] = m.Value
+			}
+		}
+		return got
+	}
+	assert.Equal(t, map[string]float64{"worker_min": 2.5, "worker_p50": 24, "worker_max": 120}, dist())
+
+	// Odd number of workers: median is the middle value
+	m.Set("replication_applier_status_by_worker", pfsResult(row(1, 2500.0), row(2, 40000.0), row(3, 8000.0)))
+	assert.Equal(t, map[string]float64{"worker_min": 2.5, "worker_p50": 8, "worker_max": 40}, dist())
+
+	// No worker has applied a transaction: not reported
+	m.Set("replication_applier_status_by_worker", pfsResult(row(1, nil), row(2, nil)))
+	assert.Empty(t, dist())
+
+	// Not reported by default
+	m.Set("replication_applier_status_by_worker", pfsResult(row(1, 2500.0)))
+	c = NewLag(m.DB())
+	_, err = c.Prepare(context.Background(), lagPlan(map[string]string{OPT_WRITER: LAG_WRITER_PFS}))
+	require.NoError(t, err)
+	assert.Empty(t, dist())
+}
+
+func TestReportParallelism(t *testing.T) {
+	// Level freq 1s: worker 1 is applying, worker 2 applied 0.5s ago, worker 3
+	// applied 5s ago (idle), worker 4 has never applied (NULL): 2 active
+	uuid := "3e11fa47-71ca-11e1-9e33-c80aa9429562"
+	now := 1716922230.0
+	row := func(id int64, applyingTs, appliedEnd float64) []driver.Value {
+		r := []driver.Value{"", uuid + ":20", "ON", "ON", uuid + ":20", id, uuid + ":10",
+			now, 1716922199.0, 1000.0, applyingTs, "db1", uuid, appliedEnd}
+		if appliedEnd == 0 {
+			r[13] = nil
+		}
+		return r
+	}
+	m := mock.NewSQL(map[string]mock.SQLResult{
+		"replication_applier_status_by_worker": pfsResult(row(1, now-0.2, now-3), row(2, 0, now-0.5), row(3, 0, now-5), row(4, 0, 0)),
+	})
+	c := NewLag(m.DB())
+	_, err := c.Prepare(context.Background(), lagPlan(map[string]string{
+		OPT_WRITER:             LAG_WRITER_PFS,
+		OPT_REPORT_PARALLELISM: "yes",
+	}))
+	require.NoError(t, err)
+	active := func() []blip.MetricValue {
+		metrics, err := c.Collect(context.Background(), "kpi")
+		require.NoError(t, err)
+		var got []blip.MetricValue
+		for _, m := range metrics {
+			if m.Name == "parallel_workers_active" {
+				got = append(got, m)
+			}
+		}
+		return got
+	}
+	expect := []blip.MetricValue{{Name: "parallel_workers_active", Type: blip.GAUGE, Value: 2, Group: map[string]string{"channel": ""}}}
+	assert.Equal(t, expect, active())
+
+	// Serialized: only one worker used
+	m.Set("replication_applier_status_by_worker", pfsResult(row(1, now-0.2, now-0.4), row(2, 0, now-9), row(3, 0, 0), row(4, 0, 0)))
+	expect[0].Value = 1
+	assert.Equal(t, expect, active())
+
+	// All idle
+	m.Set("replication_applier_status_by_worker", pfsResult(row(1, 0, now-9), row(2, 0, now-9), row(3, 0, 0), row(4, 0, 0)))
+	expect[0].Value = 0
+	assert.Equal(t, expect, active())
+
+	// Not reported by default
+	c = NewLag(m.DB())
+	_, err = c.Prepare(context.Background(), lagPlan(map[string]string{OPT_WRITER: LAG_WRITER_PFS}))
+	require.NoError(t, err)
+	assert.Empty(t, active())
+
+	// Ignored for other writers
+	m = mock.NewSQL(map[string]mock.SQLResult{
+		"heartbeat": heartbeatResult("db1", 0),
+	})
+	c = NewLag(m.DB())
+	cleanup, err := c.Prepare(context.Background(), lagPlan(map[string]string{
+		OPT_WRITER:             LAG_WRITER_BLIP,
+		OPT_REPORT_PARALLELISM: "yes",
+	}))
+	require.NoError(t, err)
+	defer cleanup()
+	assert.Equal(t, time.Duration(0), c.atLevel["kpi"].parallel)
+}
+
+func TestCompareWriters(t *testing.T) {
+	// Primary pt-heartbeat, secondary pfs
+	uuid := "3e11fa47-71ca-11e1-9e33-c80aa9429562"
+	m := mock.NewSQL(map[string]mock.SQLResult{
+		"percona": {
+			Columns: []string{"CAST(NOW(6) AS CHAR)", "CAST(`ts` AS CHAR)", "CAST(`server_id` AS CHAR)"},
+			Rows:    [][]driver.Value{{"2024-05-28 18:50:06.500000", "2024-05-28T18:50:05.001230", "101"}},
+		},
+		"replication_applier_status_by_worker": pfsResult([]driver.Value{"", uuid + ":10", "ON", "ON", uuid + ":10", int64(1), uuid + ":10",
+			1716922205.5, 1716922205.0, 0.0, 0.0, "db1", uuid}),
+	})
+	c := NewLag(m.DB())
+	_, err := c.Prepare(context.Background(), lagPlan(map[string]string{
+		OPT_WRITER:          LAG_WRITER_PT,
+		OPT_COMPARE_WRITERS: LAG_WRITER_PFS,
+	}))
+	require.NoError(t, err)
+	metrics, err := c.Collect(context.Background(), "kpi")
+	require.NoError(t, err)
+	expect := []blip.MetricValue{
+		{Name: "current", Type: blip.GAUGE, Value: 1498, Meta: map[string]string{"source": "101", "writer": LAG_WRITER_PT}},
+		{Name: "secondary", Type: blip.GAUGE, Value: 0, Group: map[string]string{"channel": ""}, Meta: map[string]string{"source": "db1", "source_table": SOURCE_TABLE_WORKER, "writer": LAG_WRITER_PFS}},
+	}
+	assert.Equal(t, expect, metrics)
+
+	// Swap primary and secondary
+	c = NewLag(m.DB())
+	_, err = c.Prepare(context.Background(), lagPlan(map[string]string{
+		OPT_WRITER:          LAG_WRITER_PFS,
+		OPT_COMPARE_WRITERS: LAG_WRITER_PT,
+	}))
+	require.NoError(t, err)
+	metrics, err = c.Collect(context.Background(), "kpi")
+	require.NoError(t, err)
+	var got []string
+	for _, m := range metrics {
+		got = append(got, m.Name+"/"+m.Meta["writer"])
+	}
+	assert.Equal(t, []string{"current/pfs", "backlog/", "worker_usage/", "secondary/pt-heartbeat"}, got)
+
+	// Secondary error: only primary reported
+	m.Set("percona", mock.SQLResult{Err: fmt.Errorf("table gone")})
+	metrics, err = c.Collect(context.Background(), "kpi")
+	require.NoError(t, err)
+	for _, m := range metrics {
+		assert.NotEqual(t, "secondary", m.Name)
+	}
+
+	// Secondary not available: disabled
+	c = NewLag(m.DB())
+	_, err = c.Prepare(context.Background(), lagPlan(map[string]string{
+		OPT_WRITER:          LAG_WRITER_PFS,
+		OPT_COMPARE_WRITERS: LAG_WRITER_PT,
+	}))
+	require.NoError(t, err)
+	assert.Equal(t, "", c.atLevel["kpi"].compare)
+
+	// Invalid: same as writer or unknown
+	for _, writer := range []string{LAG_WRITER_PFS, "seconds-behind"} {
+		_, err = NewLag(m.DB()).Prepare(context.Background(), lagPlan(map[string]string{
+			OPT_WRITER:          LAG_WRITER_PFS,
+			OPT_COMPARE_WRITERS: writer,
+		}))
+		assert.Error(t, err, writer)
+	}
+}
+
+func TestMaxSeries(t *testing.T) {
+	// 5 channels, each with 1 worker applying a trx committed ch*1s ago, and
+	// ch4 with 3 workers: more workers than the cap
+	uuid := "3e11fa47-71ca-11e1-9e33-c80aa9429562"
+	now := 1716922230.0
+	row := func(channel string, id int64, lag float64) []driver.Value {
+		return []driver.Value{channel, uuid + ":20", "ON", "ON", uuid + ":20", id, uuid + ":10",
+			now, 1716922199.0, 1000.0, now - lag, "db1", uuid}
+	}
+	m := mock.NewSQL(map[string]mock.SQLResult{
+		"replication_applier_status_by_worker": pfsResult(
+			row("ch1", 1, 1), row("ch2", 1, 2), row("ch3", 1, 3),
+			row("ch4", 1, 4), row("ch4", 2, 4), row("ch4", 3, 4),
+			row("ch5", 1, 0.5),
+		),
+	})
+	c := NewLag(m.DB())
+	_, err := c.Prepare(context.Background(), lagPlan(map[string]string{
+		OPT_WRITER:     LAG_WRITER_PFS,
+		OPT_MAX_SERIES: "2",
+	}))
+	require.NoError(t, err)
+	metrics, err := c.Collect(context.Background(), "kpi")
+	require.NoError(t, err)
+
+	// Worst 2 channels (ch4, ch3) and their other metrics, plus overflow
+	got := map[string]float64{}
+	for _, m := range metrics {
+		got[m.Name+"/"+m.Group["channel"]] = m.Value
+	}
+	expect := map[string]float64{
+		"current/ch4":      4000,
+		"backlog/ch4":      10,
+		"worker_usage/ch4": 100,
+		"current/ch3":      3000,
+		"backlog/ch3":      10,
+		"worker_usage/ch3": 100,
+		"series_overflow/": 3,
+	}
+	assert.Equal(t, expect, got)
+
+	// Fewer series than the cap: all reported, zero overflow
+	m.Set("replication_applier_status_by_worker", pfsResult(row("ch1", 1, 1)))
+	metrics, err = c.Collect(context.Background(), "kpi")
+	require.NoError(t, err)
+	require.Len(t, metrics, 4)
+	assert.Equal(t, "series_overflow", metrics[3].Name)
+	assert.Equal(t, float64(0), metrics[3].Value)
+
+	// Absent values (unknown lag) are kept first
+	in := []blip.MetricValue{
+		{Name: "current", Value: 100, Group: map[string]string{"channel": "a"}},
+		{Name: "current", Value: math.NaN(), Group: map[string]string{"channel": "b"}},
+		{Name: "current", Value: 200, Group: map[string]string{"channel": "c"}},
+		{Name: "reader_restarts", Value: 1},
+	}
+	out, dropped := capSeries(in, 2)
+	assert.Equal(t, 1, dropped)
+	reportAbsent(out, -1)
+	assert.Equal(t, []blip.MetricValue{
+		{Name: "current", Value: -1, Group: map[string]string{"channel": "b"}},
+		{Name: "current", Value: 200, Group: map[string]string{"channel": "c"}},
+		{Name: "reader_restarts", Value: 1},
+	}, out)
+
+	// Invalid
+	for _, max := range []string{"0", "-1", "all"} {
+		_, err := NewLag(m.DB()).Prepare(context.Background(), lagPlan(map[string]string{
+			OPT_WRITER:     LAG_WRITER_PFS,
+			OPT_MAX_SERIES: max,
+		}))
+		assert.Error(t, err, max)
+	}
+}
+
+func TestHeartbeatFreq(t *testing.T) {
+	// pt-heartbeat: lag 1498 ms, minus up to heartbeat-freq
+	m := mock.NewSQL(map[string]mock.SQLResult{
+		"percona": {
+			Columns: []string{"CAST(NOW(6) AS CHAR)", "CAST(`ts` AS CHAR)", "CAST(`server_id` AS CHAR)"},
+			Rows:    [][]driver.Value{{"2024-05-28 18:50:06.500000", "2024-05-28T18:50:05.001230", "101"}},
+		},
+	})
+	for freq, expect := range map[string]float64{"1s": 498, "2s": 0, "0s": 1498} {
+		c := NewLag(m.DB())
+		_, err := c.Prepare(context.Background(), lagPlan(map[string]string{
+			OPT_WRITER:         LAG_WRITER_PT,
+			OPT_HEARTBEAT_FREQ: freq,
+		}))
+		require.NoError(t, err, freq)
+		metrics, err := c.Collect(context.Background(), "kpi")
+		require.NoError(t, err, freq)
+		require.Len(t, metrics, 1, freq)
+		assert.Equal(t, expect, metrics[0].Value, freq)
+	}
+
+	// Real skew (clock-offset-ms) can still make lag negative: the floor is
+	// subtracted first and never more than lag
+	c := NewLag(m.DB())
+	_, err := c.Prepare(context.Background(), lagPlan(map[string]string{
+		OPT_WRITER:         LAG_WRITER_PT,
+		OPT_HEARTBEAT_FREQ: "2s",
+		OPT_CLOCK_OFFSET:   "100",
+	}))
+	require.NoError(t, err)
+	metrics, err := c.Collect(context.Background(), "kpi")
+	require.NoError(t, err)
+	assert.Equal(t, float64(-100), metrics[0].Value)
+
+	// Invalid
+	for _, freq := range []string{"1", "-1s", "soon"} {
+		_, err := NewLag(m.DB()).Prepare(context.Background(), lagPlan(map[string]string{
+			OPT_WRITER:         LAG_WRITER_PT,
+			OPT_HEARTBEAT_FREQ: freq,
+		}))
+		assert.Error(t, err, freq)
+	}
+
+	// Ignored for pfs
+	uuid := "3e11fa47-71ca-11e1-9e33-c80aa9429562"
+	m = mock.NewSQL(map[string]mock.SQLResult{
+		"replication_applier_status_by_worker": pfsResult([]driver.Value{"", uuid + ":10", "ON", "ON", uuid + ":10", int64(1), uuid + ":10",
+			1716922205.5, 1716922205.0, 0.0, 0.0, "db1", uuid}),
+	})
+	tl := &testLogger{msgs: map[string][]string{}}
+	Log = tl
+	defer func() { Log = DebugLogger{} }()
+	c = NewLag(m.DB())
+	_, err = c.Prepare(context.Background(), lagPlan(map[string]string{
+		OPT_WRITER:         LAG_WRITER_PFS,
+		OPT_HEARTBEAT_FREQ: "1s",
+	}))
+	require.NoError(t, err)
+	assert.Equal(t, []string{"repl.lag: kpi: option heartbeat-freq ignored: applies only to writer blip, pt-heartbeat, not pfs"}, tl.msgs["warn"])
+
+	// auto: blip writer only, estimated by the heartbeat reader
+	c = NewLag(m.DB())
+	_, err = c.Prepare(context.Background(), lagPlan(map[string]string{
+		OPT_WRITER:         LAG_WRITER_PFS,
+		OPT_HEARTBEAT_FREQ: HEARTBEAT_FREQ_AUTO,
+	}))
+	require.NoError(t, err)
+	assert.False(t, c.atLevel["kpi"].hbAutoFreq)
+}
+
+func TestConsistentRead(t *testing.T) {
+	// consistent-read passed through to the Blip heartbeat reader
+	for opt, expect := range map[string]int{"": 0, "no": 0, "yes": 1} {
+		m := mock.NewSQL(map[string]mock.SQLResult{
+			"heartbeat": heartbeatResult("db1", 0),
+		})
+		c := NewLag(m.DB())
+		_, err := c.Prepare(context.Background(), lagPlan(map[string]string{
+			OPT_WRITER:          LAG_WRITER_BLIP,
+			OPT_CONSISTENT_READ: opt,
+		}))
+		require.NoError(t, err, opt)
+		_, err = c.ReadOnce(context.Background(), "kpi")
+		require.NoError(t, err, opt)
+		assert.Equal(t, expect, m.Count("LOCK IN SHARE MODE"), opt)
+	}
+}
+
+func TestHeartbeatTsFormat(t *testing.T) {
+	// Passed through to the Blip heartbeat reader
+	m := mock.NewSQL(map[string]mock.SQLResult{
+		"heartbeat": {
+			Columns: []string{"UNIX_TIMESTAMP(NOW(6))", "ts", "freq", "src_id", "1"},
+			Rows:    [][]driver.Value{{int64(1716922206500000), int64(1716922206000), int64(1000), "db1", int64(1)}},
+		},
+	})
+	c := NewLag(m.DB())
+	_, err := c.Prepare(context.Background(), lagPlan(map[string]string{
+		OPT_WRITER:              LAG_WRITER_BLIP,
+		OPT_HEARTBEAT_TS_FORMAT: heartbeat.TS_FORMAT_EPOCH_MS,
+	}))
+	require.NoError(t, err)
+	metrics, err := c.ReadOnce(context.Background(), "kpi")
+	require.NoError(t, err)
+	require.Len(t, metrics, 1)
+	assert.Equal(t, float64(450), metrics[0].Value) // 500 ms - 50 ms network-latency
+
+	// Invalid
+	_, err = NewLag(m.DB()).Prepare(context.Background(), lagPlan(map[string]string{
+		OPT_WRITER:              LAG_WRITER_BLIP,
+		OPT_HEARTBEAT_TS_FORMAT: "epoch-s",
+	}))
+	assert.Error(t, err)
+}
+
+func TestSubtractConfiguredDelay(t *testing.T) {
+	// Delayed replica: SQL_Delay = 3600s, actual lag 3600.25s
+	m := mock.NewSQL(map[string]mock.SQLResult{
+		"SHOW SLAVE STATUS": {
+			Columns: []string{"Slave_IO_Running", "Slave_SQL_Running", "SQL_Delay"},
+			Rows:    [][]driver.Value{{"Yes", "Yes", "3600"}},
+		},
+	})
+	r := &fakeReader{lag: heartbeat.Lag{Milliseconds: 3600250, SourceId: "source1", Replica: true}}
+	c := NewLagWithReader(m.DB(), r)
+	_, err := c.Prepare(context.Background(), lagPlan(map[string]string{
+		OPT_WRITER:         LAG_WRITER_BLIP,
+		OPT_SUBTRACT_DELAY: "yes",
+	}))
+	require.NoError(t, err)
+	metrics, err := c.Collect(context.Background(), "kpi")
+	require.NoError(t, err)
+	expect := []blip.MetricValue{{Name: "current", Type: blip.GAUGE, Value: 250, Meta: map[string]string{"source": "source1", "configured_delay": "3600"}}}
+	assert.Equal(t, expect, metrics)
+
+	// Lag less than delay (not lagging more than intended): zero
+	r.lag.Milliseconds = 3599000
+	metrics, err = c.Collect(context.Background(), "kpi")
+	require.NoError(t, err)
+	assert.Equal(t, float64(0), metrics[0].Value)
+
+	// No heartbeat (absent value): not changed
+	r.lag.Milliseconds = -1
+	c.dropNoHeartbeat["kpi"] = false
+	metrics, err = c.Collect(context.Background(), "kpi")
+	require.NoError(t, err)
+	assert.Equal(t, float64(-1), metrics[0].Value)
+
+	// Not delayed or not a replica: not changed
+	r.lag.Milliseconds = 250
+	m.Set("SHOW SLAVE STATUS", mock.SQLResult{Columns: []string{"Slave_IO_Running"}})
+	metrics, err = c.Collect(context.Background(), "kpi")
+	require.NoError(t, err)
+	assert.Equal(t, []blip.MetricValue{{Name: "current", Type: blip.GAUGE, Value: 250, Meta: map[string]string{"source": "source1"}}}, metrics)
+
+	// Disabled (default): lag includes delay
+	m.Set("SHOW SLAVE STATUS", mock.SQLResult{
+		Columns: []string{"Slave_IO_Running", "Slave_SQL_Running", "SQL_Delay"},
+		Rows:    [][]driver.Value{{"Yes", "Yes", "3600"}},
+	})
+	r.lag.Milliseconds = 3600250
+	c = NewLagWithReader(m.DB(), r)
+	_, err = c.Prepare(context.Background(), lagPlan(map[string]string{OPT_WRITER: LAG_WRITER_BLIP}))
+	require.NoError(t, err)
+	metrics, err = c.Collect(context.Background(), "kpi")
+	require.NoError(t, err)
+	assert.Equal(t, float64(3600250), metrics[0].Value)
+
+	// Cannot read SHOW SLAVE STATUS: Prepare error
+	m.Set("SHOW SLAVE STATUS", mock.SQLResult{Err: fmt.Errorf("access denied")})
+	c = NewLagWithReader(m.DB(), r)
+	_, err = c.Prepare(context.Background(), lagPlan(map[string]string{
+		OPT_WRITER:         LAG_WRITER_BLIP,
+		OPT_SUBTRACT_DELAY: "yes",
+	}))
+	assert.Error(t, err)
+
+	// SHOW REPLICA STATUS as of 8.0.22
+	m = mock.NewSQL(map[string]mock.SQLResult{
+		"SELECT @@version": {Columns: []string{"@@version"}, Rows: [][]driver.Value{{"8.0.36"}}},
+		"SHOW REPLICA STATUS": {
+			Columns: []string{"Replica_IO_Running", "Replica_SQL_Running", "SQL_Delay"},
+			Rows:    [][]driver.Value{{"Yes", "Yes", "60"}},
+		},
+	})
+	c = NewLagWithReader(m.DB(), &fakeReader{lag: heartbeat.Lag{Milliseconds: 60100, Replica: true}})
+	_, err = c.Prepare(context.Background(), lagPlan(map[string]string{
+		OPT_WRITER:         LAG_WRITER_BLIP,
+		OPT_SUBTRACT_DELAY: "yes",
+	}))
+	require.NoError(t, err)
+	metrics, err = c.Collect(context.Background(), "kpi")
+	require.NoError(t, err)
+	assert.Equal(t, float64(100), metrics[0].Value)
+}
+
+func TestSubtractConfiguredDelayPFS(t *testing.T) {
+	// Delayed replica: channel ch1 DESIRED_DELAY = 3600s, worker applying a trx
+	// committed 3600.25s ago (250ms real lag); channel ch2 not delayed, 500ms lag
+	uuid := "3e11fa47-71ca-11e1-9e33-c80aa9429562"
+	m := mock.NewSQL(map[string]mock.SQLResult{
+		"replication_applier_status_by_worker": pfsResult(
+			[]driver.Value{"ch1", uuid + ":10", "ON", "ON", uuid + ":10", int64(1), uuid + ":9",
+				1716922205.5, 1716918605.0, 0.0, 1716918605.25, "db1", uuid},
+			[]driver.Value{"ch2", uuid + ":10", "ON", "ON", uuid + ":10", int64(1), uuid + ":9",
+				1716922205.5, 1716922204.0, 0.0, 1716922205.0, "db2", uuid},
+		),
+		"replication_applier_configuration": {
+			Columns: []string{"CHANNEL_NAME", "DESIRED_DELAY"},
+			Rows:    [][]driver.Value{{"ch1", "3600"}, {"ch2", "0"}},
+		},
+	})
+	c := NewLag(m.DB())
+	_, err := c.Prepare(context.Background(), lagPlan(map[string]string{
+		OPT_WRITER:         LAG_WRITER_PFS,
+		OPT_SUBTRACT_DELAY: "yes",
+	}))
+	require.NoError(t, err)
+	assert.Equal(t, pfsDelayQuery, c.EffectiveQueries()["kpi/"+OPT_SUBTRACT_DELAY])
+	current := func() []blip.MetricValue {
+		metrics, err := c.Collect(context.Background(), "kpi")
+		require.NoError(t, err)
+		var lags []blip.MetricValue
+		for _, m := range metrics {
+			if m.Name == "current" {
+				lags = append(lags, m)
+			}
+		}
+		return lags
+	}
+	expect := []blip.MetricValue{
+		{Name: "current", Type: blip.GAUGE, Value: 250, Group: map[string]string{"channel": "ch1"},
+			Meta: map[string]string{"source": "db1", "source_table": SOURCE_TABLE_WORKER, "configured_delay": "3600"}},
+		{Name: "current", Type: blip.GAUGE, Value: 500, Group: map[string]string{"channel": "ch2"},
+			Meta: map[string]string{"source": "db2", "source_table": SOURCE_TABLE_WORKER}},
+	}
+	assert.Equal(t, expect, current())
+
+	// Delay removed (CHANGE REPLICATION SOURCE TO SOURCE_DELAY=0): lag includes
+	// the backlog of the delay
+	m.Set("replication_applier_configuration", mock.SQLResult{
+		Columns: []string{"CHANNEL_NAME", "DESIRED_DELAY"},
+		Rows:    [][]driver.Value{{"ch1", "0"}, {"ch2", "0"}},
+	})
+	assert.Equal(t, float64(3600250), current()[0].Value)
+
+	// Disabled (default): lag includes delay, and delay is not queried
+	m.Set("replication_applier_configuration", mock.SQLResult{
+		Columns: []string{"CHANNEL_NAME", "DESIRED_DELAY"},
+		Rows:    [][]driver.Value{{"ch1", "3600"}, {"ch2", "0"}},
+	})
+	n := m.Count("replication_applier_configuration")
+	c = NewLag(m.DB())
+	_, err = c.Prepare(context.Background(), lagPlan(map[string]string{OPT_WRITER: LAG_WRITER_PFS}))
+	require.NoError(t, err)
+	assert.Equal(t, float64(3600250), current()[0].Value)
+	assert.Equal(t, n, m.Count("replication_applier_configuration"))
+
+	// Cannot read replication_applier_configuration: Prepare error
+	m.Set("replication_applier_configuration", mock.SQLResult{Err: fmt.Errorf("access denied")})
+	c = NewLag(m.DB())
+	_, err = c.Prepare(context.Background(), lagPlan(map[string]string{
+		OPT_WRITER:         LAG_WRITER_PFS,
+		OPT_SUBTRACT_DELAY: "yes",
+	}))
+	assert.Error(t, err)
+}
+
+func TestActiveConfig(t *testing.T) {
+	t.Setenv("BLIP_TEST_PT_TABLE", "hb.pt")
+	m := mock.NewSQL(map[string]mock.SQLResult{
+		"`hb`.`pt`": {
+			Columns: []string{"CAST(NOW(6) AS CHAR)", "CAST(`ts` AS CHAR)", "CAST(`server_id` AS CHAR)"},
+			Rows:    [][]driver.Value{{"2024-05-28 18:50:06.500000", "2024-05-28T18:50:05.001230", "101"}},
+		},
+	})
+	plan := lagPlan(map[string]string{
+		OPT_WRITER:          LAG_WRITER_PT,
+		OPT_HEARTBEAT_TABLE: "${BLIP_TEST_PT_TABLE}",
+		OPT_ROUND:           ROUND_CEIL,
+	})
+	plan.InterpolateEnvVars()
+	c := NewLag(m.DB())
+	_, err := c.Prepare(context.Background(), plan)
+	require.NoError(t, err)
+
+	cfg := c.ActiveConfig()
+	require.Contains(t, cfg, "kpi")
+	assert.Equal(t, "hb.pt", cfg["kpi"][OPT_HEARTBEAT_TABLE]) // interpolated
+	assert.Equal(t, ROUND_CEIL, cfg["kpi"][OPT_ROUND])        // set in plan
+	assert.Equal(t, LAG_WRITER_PT, cfg["kpi"][OPT_WRITER])
+	assert.Equal(t, "no", cfg["kpi"][OPT_REPORT_TREND]) // default
+
+	// Copy: changing it doesn't change the collector
+	cfg["kpi"][OPT_ROUND] = ROUND_FLOOR
+	assert.Equal(t, ROUND_CEIL, c.ActiveConfig()["kpi"][OPT_ROUND])
+
+	// Auto-detected writer
+	m = mock.NewSQL(map[string]mock.SQLResult{"heartbeat": heartbeatResult("source1", 0)})
+	c = NewLag(m.DB())
+	cleanup, err := c.Prepare(context.Background(), lagPlan(nil))
+	require.NoError(t, err)
+	defer cleanup()
+	assert.Equal(t, LAG_WRITER_BLIP, c.ActiveConfig()["kpi"][OPT_WRITER])
+}
+
+func TestWriterChain(t *testing.T) {
+	// writer=pfs,blip: pfs fails at collect and blip takes over
+	uuid := "3e11fa47-71ca-11e1-9e33-c80aa9429562"
+	pfs := pfsResult([]driver.Value{"", uuid + ":10", "ON", "ON", uuid + ":10", int64(1), uuid + ":10",
+		1716922205.5, 1716922205.0, 0.0, 0.0, "db1", uuid})
+	m := mock.NewSQL(map[string]mock.SQLResult{
+		"replication_applier_status_by_worker": pfs,
+	})
+	r := &fakeReader{lag: heartbeat.Lag{Milliseconds: 750, SourceId: "source1", Replica: true}}
+	c := NewLagWithReader(m.DB(), r)
+	_, err := c.Prepare(context.Background(), lagPlan(map[string]string{
+		OPT_WRITER:        "pfs, blip",
+		OPT_REPORT_WRITER: "yes",
+	}))
+	require.NoError(t, err)
+	assert.Equal(t, LAG_WRITER_PFS, c.lagWriterIn["kpi"])
+	assert.Equal(t, []string{LAG_WRITER_BLIP}, c.atLevel["kpi"].fallback)
+	assert.NoError(t, c.Help().Validate(map[string]string{OPT_WRITER: "pfs, blip"})) // plan validation
+
+	s, err := c.State(context.Background(), "kpi")
+	require.NoError(t, err)
+	assert.Equal(t, LAG_WRITER_PFS, s.Writer)
+
+	m.Set("replication_applier_status_by_worker", mock.SQLResult{Err: fmt.Errorf("table gone")})
+	s, err = c.State(context.Background(), "kpi")
+	require.NoError(t, err)
+	assert.Equal(t, LAG_WRITER_BLIP, s.Writer)
+	expect := []blip.MetricValue{
+		{Name: "current", Type: blip.GAUGE, Value: 750, Meta: map[string]string{"source": "source1"}},
+		writerMetric(LAG_WRITER_BLIP),
+	}
+	assert.Equal(t, expect, s.MetricValues())
+
+	// Primary writer used again when it works
+	m.Set("replication_applier_status_by_worker", pfs)
+	s, err = c.State(context.Background(), "kpi")
+	require.NoError(t, err)
+	assert.Equal(t, LAG_WRITER_PFS, s.Writer)
+
+	// Fallback writer not available: removed from chain
+	c = NewLag(m.DB())
+	_, err = c.Prepare(context.Background(), lagPlan(map[string]string{
+		OPT_WRITER: "pfs,pt-heartbeat",
+	}))
+	require.NoError(t, err)
+	assert.Empty(t, c.atLevel["kpi"].fallback)
+
+	// All writers fail: primary writer error
+	m.Set("replication_applier_status_by_worker", mock.SQLResult{Err: fmt.Errorf("table gone")})
+	_, err = c.Collect(context.Background(), "kpi")
+	assert.ErrorContains(t, err, "table gone")
+
+	// Invalid: auto, none, unknown, or duplicate writer in chain
+	for _, writer := range []string{"pfs,auto", "none,pfs", "pfs,seconds-behind", "pfs,blip,pfs"} {
+		_, err = NewLag(m.DB()).Prepare(context.Background(), lagPlan(map[string]string{
+			OPT_WRITER: writer,
+		}))
+		assert.Error(t, err, writer)
+	}
+}
+
+func TestSourceTable(t *testing.T) {
+	// Meta source_table is the PFS table that lag is computed from
+	uuid := "3e11fa47-71ca-11e1-9e33-c80aa9429562"
+	m := mock.NewSQL(map[string]mock.SQLResult{
+		"replication_applier_status_by_worker": pfsResult([]driver.Value{"", uuid + ":10", "ON", "ON", uuid + ":10", int64(1), uuid + ":10",
+			1716922205.5, 1716922205.0, 0.0, 0.0, "db1", uuid}),
+		"LAST_QUEUED_TRANSACTION_END_QUEUE": {
+			Columns: []string{"CHANNEL_NAME", "io_thd", "sql_thd", "now", "last_queued_ts", "last_queued_lag", "source_host", "source_uuid"},
+			Rows:    [][]driver.Value{{"", "ON", "ON", 1716922205.5, 1716922205.0, 75000.0, "db1", uuid}},
+		},
+	})
+	c := NewLag(m.DB())
+	_, err := c.Prepare(context.Background(), lagPlan(map[string]string{OPT_WRITER: LAG_WRITER_PFS}))
+	require.NoError(t, err)
+	metrics, err := c.Collect(context.Background(), "kpi")
+	require.NoError(t, err)
+	require.Equal(t, "current", metrics[0].Name)
+	assert.Equal(t, SOURCE_TABLE_WORKER, metrics[0].Meta["source_table"])
+
+	// No workers: fallback
+	m.Set("replication_applier_status_by_worker", pfsResult())
+	metrics, err = c.Collect(context.Background(), "kpi")
+	require.NoError(t, err)
+	require.Equal(t, "current", metrics[0].Name)
+	assert.Equal(t, SOURCE_TABLE_CONNECTION, metrics[0].Meta["source_table"])
+
+	// Only pfs
+	m = mock.NewSQL(map[string]mock.SQLResult{"heartbeat": heartbeatResult("source1", 0)})
+	c = NewLag(m.DB())
+	cleanup, err := c.Prepare(context.Background(), lagPlan(map[string]string{OPT_WRITER: LAG_WRITER_BLIP}))
+	require.NoError(t, err)
+	defer cleanup()
+	metrics, err = c.ReadOnce(context.Background(), "kpi")
+	require.NoError(t, err)
+	require.NotEmpty(t, metrics)
+	assert.NotContains(t, metrics[0].Meta, "source_table")
+}
+
+func TestRefreshInterval(t *testing.T) {
+	// Level freq 200ms, refresh-interval 1s: the pfs lag query runs every
+	// 5th collection, and the last lag is reported with stale_ms in between
+	uuid := "3e11fa47-71ca-11e1-9e33-c80aa9429562"
+	pfs := pfsResult([]driver.Value{"", uuid + ":10", "ON", "ON", uuid + ":10", int64(1), uuid + ":10",
+		1716922205.5, 1716922205.0, 0.0, 0.0, "db1", uuid})
+	m := mock.NewSQL(map[string]mock.SQLResult{
+		"replication_applier_status_by_worker": pfs,
+	})
+	c := NewLag(m.DB())
+	now := time.Now()
+	c.Now = func() time.Time { return now }
+	_, err := c.Prepare(context.Background(), lagPlan(map[string]string{
+		OPT_WRITER:           LAG_WRITER_PFS,
+		OPT_REFRESH_INTERVAL: "1s",
+	}))
+	require.NoError(t, err)
+	prepared := m.Count(mySQL8LagQuery)
+
+	var stale []string
+	for i := 0; i < 6; i++ {
+		metrics, err := c.Collect(context.Background(), "kpi")
+		require.NoError(t, err)
+		require.Equal(t, "current", metrics[0].Name)
+		stale = append(stale, metrics[0].Meta["stale_ms"])
+		assert.Equal(t, "db1", metrics[0].Meta["source"])
+		now = now.Add(200 * time.Millisecond)
+	}
+	assert.Equal(t, 2, m.Count(mySQL8LagQuery)-prepared)
+	assert.Equal(t, []string{"", "200", "400", "600", "800", ""}, stale)
+
+	// Errors are not cached
+	m.Set("replication_applier_status_by_worker", mock.SQLResult{Err: fmt.Errorf("table gone")})
+	now = now.Add(time.Second)
+	_, err = c.Collect(context.Background(), "kpi")
+	assert.Error(t, err)
+	assert.Nil(t, c.atLevel["kpi"].cache)
+
+	// Invalid
+	m.Set("replication_applier_status_by_worker", pfs)
+	for _, refresh := range []string{"0s", "-1s", "1"} {
+		_, err = NewLag(m.DB()).Prepare(context.Background(), lagPlan(map[string]string{
+			OPT_WRITER:           LAG_WRITER_PFS,
+			OPT_REFRESH_INTERVAL: refresh,
+		}))
+		assert.Error(t, err, refresh)
+	}
+}
+
+func TestTraceId(t *testing.T) {
+	// Trace ID from the Collect context is not added by default: it's high
+	// cardinality (unique per collection)
+	r := &fakeReader{lag: heartbeat.Lag{Milliseconds: 750, SourceId: "source1", Replica: true}}
+	c := NewLagWithReader(mock.NewSQL(nil).DB(), r)
+	_, err := c.Prepare(context.Background(), lagPlan(map[string]string{
+		OPT_WRITER: LAG_WRITER_BLIP,
+	}))
+	require.NoError(t, err)
+	ctx := blip.WithTraceId(context.Background(), "4bf92f3577b34da6a3ce929d0e0e4736")
+	metrics, err := c.Collect(ctx, "kpi")
+	require.NoError(t, err)
+	require.Equal(t, "current", metrics[0].Name)
+	assert.Equal(t, map[string]string{"source": "source1"}, metrics[0].Meta)
+
+	// include-trace-id=yes: trace ID is added to current meta
+	c = NewLagWithReader(mock.NewSQL(nil).DB(), r)
+	_, err = c.Prepare(context.Background(), lagPlan(map[string]string{
+		OPT_WRITER:             LAG_WRITER_BLIP,
+		OPT_REPORT_TREND:       "yes",
+		OPT_REPORT_COLLECT_AGE: "yes",
+		OPT_INCLUDE_TRACE_ID:   "yes",
+	}))
+	require.NoError(t, err)
+	metrics, err = c.Collect(ctx, "kpi")
+	require.NoError(t, err)
+	require.NotEmpty(t, metrics)
+	for _, m := range metrics {
+		if m.Name == "current" {
+			assert.Equal(t, map[string]string{"source": "source1", "trace_id": "4bf92f3577b34da6a3ce929d0e0e4736"}, m.Meta)
+		} else {
+			assert.NotContains(t, m.Meta, "trace_id", m.Name)
+		}
+	}
+
+	// No-op if not set
+	metrics, err = c.Collect(context.Background(), "kpi")
+	require.NoError(t, err)
+	require.Equal(t, "current", metrics[0].Name)
+	assert.Equal(t, map[string]string{"source": "source1"}, metrics[0].Meta)
+}
+
+func TestChannelRename(t *testing.T) {
+	uuid := "3e11fa47-71ca-11e1-9e33-c80aa9429562"
+	row := func(channel string) []driver.Value {
+		return []driver.Value{channel, uuid + ":10", "ON", "ON", uuid + ":10", int64(1), uuid + ":10",
+			1716922205.5, 1716922205.0, 0.0, 0.0, "db1", uuid}
+	}
+	m := mock.NewSQL(map[string]mock.SQLResult{
+		"replication_applier_status_by_worker": pfsResult(row("db1_shard3_ch"), row("other"), row("")),
+	})
+	c := NewLag(m.DB())
+	_, err := c.Prepare(context.Background(), lagPlan(map[string]string{
+		OPT_WRITER:               LAG_WRITER_PFS,
+		OPT_DEFAULT_CHANNEL_NAME: "default",
+		OPT_CHANNEL_RENAME:       `^db(\d+)_shard(\d+)_ch$=>db$1-s$2; ^default$=>main`,
+	}))
+	require.NoError(t, err)
+	metrics, err := c.Collect(context.Background(), "kpi")
+	require.NoError(t, err)
+	var got []string
+	for _, m := range metrics {
+		assert.Contains(t, []string{"db1-s3", "other", "main"}, m.Group["channel"], m.Name)
+		if m.Name == "current" {
+			got = append(got, m.Group["channel"])
+		}
+	}
+	assert.ElementsMatch(t, []string{"db1-s3", "other", "main"}, got)
+
+	// Invalid
+	for _, rename := range []string{`^db(\d+$=>db$1`, `^db\d+$`} {
+		_, err = NewLag(m.DB()).Prepare(context.Background(), lagPlan(map[string]string{
+			OPT_WRITER:         LAG_WRITER_PFS,
+			OPT_CHANNEL_RENAME: rename,
+		}))
+		assert.Error(t, err, rename)
+	}
+}
+
+func TestPrivilegeCheck(t *testing.T) {
+	// No SELECT on the worker table: the error lists the missing grant
+	m := mock.NewSQL(map[string]mock.SQLResult{
+		"SELECT CURRENT_USER()":             {Columns: []string{"CURRENT_USER()"}, Rows: [][]driver.Value{{"blip@%"}}},
+		"SELECT 1 FROM performance_schema.": {Columns: []string{"1"}},
+	})
+	m.QueryFunc = func(query string) (mock.SQLResult, bool) {
+		if strings.Contains(query, "replication_applier_status_by_worker") {
+			return mock.SQLResult{Err: &mysql.MySQLError{Number: 1142, Message: "SELECT command denied to user 'blip'@'%' for table 'replication_applier_status_by_worker'"}}, true
+		}
+		return mock.SQLResult{}, false
+	}
+	_, err := NewLag(m.DB()).Prepare(context.Background(), lagPlan(map[string]string{OPT_WRITER: LAG_WRITER_PFS}))
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "GRANT SELECT ON performance_schema.replication_applier_status_by_worker TO 'blip'@'%'")
+	assert.NotContains(t, err.Error(), "replication_connection_status TO")
+	var myErr *mysql.MySQLError
+	assert.ErrorAs(t, err, &myErr)
+
+	// No REPLICATION CLIENT for subtract-configured-delay
+	m = mock.NewSQL(map[string]mock.SQLResult{
+		"SELECT CURRENT_USER()": {Columns: []string{"CURRENT_USER()"}, Rows: [][]driver.Value{{"blip@%"}}},
+		"SHOW SLAVE STATUS":     {Err: &mysql.MySQLError{Number: 1227, Message: "Access denied; you need (at least one of) the SUPER, REPLICATION CLIENT privilege(s) for this operation"}},
+	})
+	r := &fakeReader{lag: heartbeat.Lag{Milliseconds: 100, SourceId: "source1", Replica: true}}
+	_, err = NewLagWithReader(m.DB(), r).Prepare(context.Background(), lagPlan(map[string]string{
+		OPT_WRITER:         LAG_WRITER_BLIP,
+		OPT_SUBTRACT_DELAY: "yes",
+	}))
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "GRANT REPLICATION CLIENT ON *.* TO 'blip'@'%'")
+
+	// Other errors are not changed
+	m = mock.NewSQL(map[string]mock.SQLResult{
+		"replication_applier_status_by_worker": {Err: &mysql.MySQLError{Number: 1146, Message: "Table doesn't exist"}},
+	})
+	_, err = NewLag(m.DB()).Prepare(context.Background(), lagPlan(map[string]string{OPT_WRITER: LAG_WRITER_PFS}))
+	require.Error(t, err)
+	assert.NotContains(t, err.Error(), "GRANT")
+}
+
+func TestSelfHeartbeat(t *testing.T) {
+	// pt-heartbeat server_id 101 is the local server_id: reading own heartbeat
+	percona := mock.SQLResult{
+		Columns: []string{"CAST(NOW(6) AS CHAR)", "CAST(`ts` AS CHAR)", "CAST(`server_id` AS CHAR)"},
+		Rows:    [][]driver.Value{{"2024-05-28 18:50:06.500000", "2024-05-28T18:50:06.400000", "101"}},
+	}
+	serverId := func(id string) mock.SQLResult {
+		return mock.SQLResult{Columns: []string{"@@server_id"}, Rows: [][]driver.Value{{id}}}
+	}
+	m := mock.NewSQL(map[string]mock.SQLResult{
+		"percona":            percona,
+		"SELECT @@server_id": serverId("101"),
+	})
+	c := NewLag(m.DB())
+	_, err := c.Prepare(context.Background(), lagPlan(map[string]string{OPT_WRITER: LAG_WRITER_PT}))
+	require.NoError(t, err)
+	metrics, err := c.Collect(context.Background(), "kpi")
+	require.NoError(t, err)
+	expect := []blip.MetricValue{
+		{Name: "current", Type: blip.GAUGE, Value: -1, Meta: map[string]string{"source": "101"}},
+		{Name: "self_heartbeat", Type: blip.GAUGE, Value: 1, Meta: map[string]string{"source": "101"}},
+	}
+	assert.Equal(t, expect, metrics)
+
+	// absent-value=drop
+	c = NewLag(m.DB())
+	_, err = c.Prepare(context.Background(), lagPlan(map[string]string{
+		OPT_WRITER:       LAG_WRITER_PT,
+		OPT_ABSENT_VALUE: ABSENT_VALUE_DROP,
+	}))
+	require.NoError(t, err)
+	metrics, err = c.Collect(context.Background(), "kpi")
+	require.NoError(t, err)
+	assert.Equal(t, expect[1:], metrics)
+
+	// Different server_id: lag reported as usual
+	m.Set("SELECT @@server_id", serverId("102"))
+	c = NewLag(m.DB())
+	_, err = c.Prepare(context.Background(), lagPlan(map[string]string{OPT_WRITER: LAG_WRITER_PT}))
+	require.NoError(t, err)
+	metrics, err = c.Collect(context.Background(), "kpi")
+	require.NoError(t, err)
+	expect = []blip.MetricValue{
+		{Name: "current", Type: blip.GAUGE, Value: 100, Meta: map[string]string{"source": "101"}},
+	}
+	assert.Equal(t, expect, metrics)
+
+	// Blip heartbeat source ID is the monitor ID (m1)
+	r := &fakeReader{lag: heartbeat.Lag{Milliseconds: 5, SourceId: "m1", Replica: true}}
+	c = NewLagWithReader(mock.NewSQL(nil).DB(), r)
+	_, err = c.Prepare(context.Background(), lagPlan(map[string]string{OPT_WRITER: LAG_WRITER_BLIP}))
+	require.NoError(t, err)
+	metrics, err = c.Collect(context.Background(), "kpi")
+	require.NoError(t, err)
+	expect = []blip.MetricValue{
+		{Name: "current", Type: blip.GAUGE, Value: -1, Meta: map[string]string{"source": "m1"}},
+		{Name: "self_heartbeat", Type: blip.GAUGE, Value: 1, Meta: map[string]string{"source": "m1"}},
+	}
+	assert.Equal(t, expect, metrics)
+
+	r.lag.SourceId = "source1"
+	metrics, err = c.Collect(context.Background(), "kpi")
+	require.NoError(t, err)
+	expect = []blip.MetricValue{
+		{Name: "current", Type: blip.GAUGE, Value: 5, Meta: map[string]string{"source": "source1"}},
+	}
+	assert.Equal(t, expect, metrics)
+}
+
+func TestNowPrecision(t *testing.T) {
+	uuid := "3e11fa47-71ca-11e1-9e33-c80aa9429562"
+	m := mock.NewSQL(map[string]mock.SQLResult{
+		"replication_applier_status_by_worker": pfsResult([]driver.Value{"", uuid + ":10", "ON", "ON", uuid + ":10", int64(1), uuid + ":10",
+			1716922205.5, 1716922205.0, 0.0, 0.0, "db1", uuid}),
+	})
+	tests := []struct {
+		precision string
+		now       string
+	}{
+		{"", "UNIX_TIMESTAMP(NOW(6))"}, // default
+		{"3", "UNIX_TIMESTAMP(NOW(3))"},
+		{"0", "UNIX_TIMESTAMP(NOW())"},
+	}
+	for _, tc := range tests {
+		c := NewLag(m.DB())
+		_, err := c.Prepare(context.Background(), lagPlan(map[string]string{
+			OPT_WRITER:        LAG_WRITER_PFS,
+			OPT_NOW_PRECISION: tc.precision,
+		}))
+		require.NoError(t, err, tc.precision)
+		_, err = c.Collect(context.Background(), "kpi")
+		require.NoError(t, err, tc.precision)
+		queries := m.Queries()
+		last := queries[len(queries)-1]
+		assert.Contains(t, last, "replication_applier_status_by_worker", tc.precision)
+		assert.Contains(t, last, tc.now, tc.precision)
+		assert.Contains(t, c.atLevel["kpi"].pfsFbQuery, tc.now, tc.precision)
+	}
+
+	// Invalid
+	for _, precision := range []string{"-1", "7", "ms"} {
+		_, err := NewLag(m.DB()).Prepare(context.Background(), lagPlan(map[string]string{
+			OPT_WRITER:        LAG_WRITER_PFS,
+			OPT_NOW_PRECISION: precision,
+		}))
+		assert.Error(t, err, precision)
+	}
+}
+
+func TestEffectiveQueries(t *testing.T) {
+	// pfs with now-precision, and pt-heartbeat in a fallback chain
+	m := mock.NewSQL(map[string]mock.SQLResult{
+		"replication_applier_status_by_worker": pfsResult(), // not a replica
+		"replication_connection_status":        {},
+		"read_only":                            {Columns: []string{"1"}, Rows: [][]driver.Value{{int64(1)}}},
+		"percona": {
+			Columns: []string{"CAST(NOW(6) AS CHAR)", "CAST(`ts` AS CHAR)", "CAST(`server_id` AS CHAR)"},
+			Rows:    [][]driver.Value{{"2024-05-28 18:50:06.500000", "2024-05-28T18:50:05.001230", "101"}},
+		},
+	})
+	c := NewLag(m.DB())
+	_, err := c.Prepare(context.Background(), lagPlan(map[string]string{
+		OPT_WRITER:              LAG_WRITER_PFS + "," + LAG_WRITER_PT,
+		OPT_NOW_PRECISION:       "3",
+		OPT_HEARTBEAT_SOURCE_ID: "101",
+		OPT_REPL_CHECK:          "read_only",
+	}))
+	require.NoError(t, err)
+	queries := c.EffectiveQueries()
+	assert.Contains(t, queries["kpi/pfs"], "UNIX_TIMESTAMP(NOW(3))")
+	assert.Contains(t, queries["kpi/pfs"], "replication_applier_status_by_worker")
+	assert.Contains(t, queries["kpi/pfs/replication_connection_status"], "UNIX_TIMESTAMP(NOW(3))")
+	assert.Equal(t, "SELECT CAST(NOW(6) AS CHAR), CAST(`ts` AS CHAR), CAST(`server_id` AS CHAR) FROM `percona`.`heartbeat` WHERE `server_id` = '101' ORDER BY `ts` DESC LIMIT 1",
+		queries["kpi/pt-heartbeat"])
+	assert.Equal(t, "SELECT @@`read_only`", queries["kpi/repl-check"])
+	assert.Len(t, queries, 4)
+
+	// blip: heartbeat reader query with table, tag, and consistent read
+	m = mock.NewSQL(map[string]mock.SQLResult{
+		"heartbeat": heartbeatResult("etl-writer", 0),
+	})
+	c = NewLag(m.DB())
+	cleanup, err := c.Prepare(context.Background(), lagPlan(map[string]string{
+		OPT_WRITER:          LAG_WRITER_BLIP,
+		OPT_HEARTBEAT_TABLE: "hb.heartbeat",
+		OPT_HEARTBEAT_TAG:   "etl",
+		OPT_CONSISTENT_READ: "yes",
+	}))
+	require.NoError(t, err)
+	defer cleanup()
+	queries = c.EffectiveQueries()
+	assert.Equal(t, "SELECT NOW(3), ts, freq, src_id, 1 FROM `hb`.`heartbeat` WHERE src_id != ? AND tag=? ORDER BY ts DESC LIMIT 1 LOCK IN SHARE MODE -- args: [\"m1\" \"etl\"]",
+		queries["kpi/blip"])
+	assert.Len(t, queries, 1)
+}
+
+func TestMetaAllowlist(t *testing.T) {
+	// Keep only source and monitor_id: plan (include-identity) and
+	// configured_delay (subtract-configured-delay) are removed
+	m := mock.NewSQL(map[string]mock.SQLResult{
+		"SHOW SLAVE STATUS": {
+			Columns: []string{"Slave_IO_Running", "Slave_SQL_Running", "SQL_Delay"},
+			Rows:    [][]driver.Value{{"Yes", "Yes", "60"}},
+		},
+	})
+	r := &fakeReader{lag: heartbeat.Lag{Milliseconds: 61000, SourceId: "source1", Replica: true}}
+	c := NewLagWithReader(m.DB(), r)
+	_, err := c.Prepare(context.Background(), lagPlan(map[string]string{
+		OPT_WRITER:             LAG_WRITER_BLIP,
+		OPT_SUBTRACT_DELAY:     "yes",
+		OPT_INCLUDE_IDENTITY:   "yes",
+		OPT_REPORT_COLLECT_AGE: "yes",
+		OPT_META_ALLOWLIST:     "source, monitor_id",
+	}))
+	require.NoError(t, err)
+	metrics, err := c.Collect(context.Background(), "kpi")
+	require.NoError(t, err)
+	require.Len(t, metrics, 2)
+	assert.Equal(t, "current", metrics[0].Name)
+	assert.Equal(t, map[string]string{"source": "source1", "monitor_id": "m1"}, metrics[0].Meta)
+	assert.Equal(t, "last_collect_age", metrics[1].Name)
+	assert.Equal(t, map[string]string{"monitor_id": "m1"}, metrics[1].Meta)
+
+	// No allowed keys: no meta
+	c = NewLagWithReader(m.DB(), r)
+	_, err = c.Prepare(context.Background(), lagPlan(map[string]string{
+		OPT_WRITER:         LAG_WRITER_BLIP,
+		OPT_META_ALLOWLIST: "channel",
+	}))
+	require.NoError(t, err)
+	metrics, err = c.Collect(context.Background(), "kpi")
+	require.NoError(t, err)
+	require.Len(t, metrics, 1)
+	assert.Nil(t, metrics[0].Meta)
+
+	// Default: all keys
+	c = NewLagWithReader(m.DB(), r)
+	_, err = c.Prepare(context.Background(), lagPlan(map[string]string{
+		OPT_WRITER:           LAG_WRITER_BLIP,
+		OPT_INCLUDE_IDENTITY: "yes",
+	}))
+	require.NoError(t, err)
+	metrics, err = c.Collect(context.Background(), "kpi")
+	require.NoError(t, err)
+	require.Len(t, metrics, 1)
+	assert.Equal(t, map[string]string{"source": "source1", "monitor_id": "m1", "plan": "test"}, metrics[0].Meta)
+}
+
+func TestWarmup(t *testing.T) {
+	// No metrics until the reader has read a heartbeat (LastTs set)
+	r := &fakeReader{lag: heartbeat.Lag{Milliseconds: -1, SourceId: "source1", Replica: true}}
+	c := NewLagWithReader(mock.NewSQL(nil).DB(), r)
+	now := time.Now()
+	c.Now = func() time.Time { return now }
+	_, err := c.Prepare(context.Background(), lagPlan(map[string]string{
+		OPT_WRITER:              LAG_WRITER_BLIP,
+		OPT_WARMUP:              "10s",
+		OPT_REPORT_NO_HEARTBEAT: "yes",
+	}))
+	require.NoError(t, err)
+	metrics, err := c.Collect(context.Background(), "kpi")
+	require.NoError(t, err)
+	assert.Empty(t, metrics)
+
+	// First read
+	now = now.Add(time.Second)
+	r.lag = heartbeat.Lag{Milliseconds: 750, LastTs: now, SourceId: "source1", Replica: true}
+	metrics, err = c.Collect(context.Background(), "kpi")
+	require.NoError(t, err)
+	expect := []blip.MetricValue{{Name: "current", Type: blip.GAUGE, Value: 750, Meta: map[string]string{"source": "source1"}}}
+	assert.Equal(t, expect, metrics)
+	assert.True(t, c.atLevel["kpi"].warmupEnd.IsZero())
+
+	// Warmup expired without a read: reported as usual (no heartbeat = -1)
+	r.lag = heartbeat.Lag{Milliseconds: -1, SourceId: "source1", Replica: true}
+	c = NewLagWithReader(mock.NewSQL(nil).DB(), r)
+	c.Now = func() time.Time { return now }
+	_, err = c.Prepare(context.Background(), lagPlan(map[string]string{
+		OPT_WRITER:              LAG_WRITER_BLIP,
+		OPT_WARMUP:              "10s",
+		OPT_REPORT_NO_HEARTBEAT: "yes",
+	}))
+	require.NoError(t, err)
+	metrics, err = c.Collect(context.Background(), "kpi")
+	require.NoError(t, err)
+	assert.Empty(t, metrics)
+	now = now.Add(10 * time.Second)
+	metrics, err = c.Collect(context.Background(), "kpi")
+	require.NoError(t, err)
+	require.Len(t, metrics, 1)
+	assert.Equal(t, float64(-1), metrics[0].Value)
+
+	// Ignored for other writers
+	uuid := "3e11fa47-71ca-11e1-9e33-c80aa9429562"
+	m := mock.NewSQL(map[string]mock.SQLResult{
+		"replication_applier_status_by_worker": pfsResult([]driver.Value{"", uuid + ":10", "ON", "ON", uuid + ":10", int64(1), uuid + ":10",
+			1716922205.5, 1716922205.0, 0.0, 0.0, "db1", uuid}),
+	})
+	tl := &testLogger{msgs: map[string][]string{}}
+	Log = tl
+	defer func() { Log = DebugLogger{} }()
+	c = NewLag(m.DB())
+	_, err = c.Prepare(context.Background(), lagPlan(map[string]string{
+		OPT_WRITER: LAG_WRITER_PFS,
+		OPT_WARMUP: "10s",
+	}))
+	require.NoError(t, err)
+	assert.Equal(t, []string{"repl.lag: kpi: option warmup ignored: applies only to writer blip, not pfs"}, tl.msgs["warn"])
+
+	// Invalid
+	_, err = NewLag(m.DB()).Prepare(context.Background(), lagPlan(map[string]string{
+		OPT_WRITER: LAG_WRITER_BLIP,
+		OPT_WARMUP: "10",
+	}))
+	assert.Error(t, err)
+}
+
+func TestUnitSeconds(t *testing.T) {
+	r := &fakeReader{lag: heartbeat.Lag{Milliseconds: 1250, SourceId: "source1", Replica: true}}
+	c := NewLagWithReader(mock.NewSQL(nil).DB(), r)
+	_, err := c.Prepare(context.Background(), lagPlan(map[string]string{
+		OPT_WRITER:               LAG_WRITER_BLIP,
+		OPT_UNIT:                 UNIT_S,
+		OPT_REPORT_NOT_A_REPLICA: "yes",
+		OPT_REPORT_TREND:         "yes",
+	}))
+	require.NoError(t, err)
+	metrics, err := c.Collect(context.Background(), "kpi")
+	require.NoError(t, err)
+	expect := []blip.MetricValue{{Name: "current", Type: blip.GAUGE, Value: 1.25, Meta: map[string]string{"source": "source1", "unit": "s"}}}
+	assert.Equal(t, expect, metrics)
+
+	// Absent value is still -1, not -0.001
+	r.lag = heartbeat.Lag{Replica: false}
+	metrics, err = c.Collect(context.Background(), "kpi")
+	require.NoError(t, err)
+	require.NotEmpty(t, metrics)
+	assert.Equal(t, "current", metrics[0].Name)
+	assert.Equal(t, float64(-1), metrics[0].Value)
+	assert.Equal(t, "s", metrics[0].Meta["unit"])
+
+	// NaN is still NaN
+	assert.True(t, math.IsNaN(toSecondsValue(math.NaN())))
+
+	// Default and unit=ms: milliseconds without unit meta
+	r.lag = heartbeat.Lag{Milliseconds: 1250, SourceId: "source1", Replica: true}
+	for _, unit := range []string{"", UNIT_MS} {
+		c = NewLagWithReader(mock.NewSQL(nil).DB(), r)
+		_, err = c.Prepare(context.Background(), lagPlan(map[string]string{OPT_WRITER: LAG_WRITER_BLIP, OPT_UNIT: unit}))
+		require.NoError(t, err)
+		metrics, err = c.Collect(context.Background(), "kpi")
+		require.NoError(t, err)
+		assert.Equal(t, []blip.MetricValue{{Name: "current", Type: blip.GAUGE, Value: 1250, Meta: map[string]string{"source": "source1"}}}, metrics, unit)
+	}
+
+	// Invalid
+	_, err = NewLagWithReader(mock.NewSQL(nil).DB(), r).Prepare(context.Background(), lagPlan(map[string]string{OPT_WRITER: LAG_WRITER_BLIP, OPT_UNIT: "us"}))
+	assert.Error(t, err)
+}
+
+func TestSinkUnit(t *testing.T) {
+	// sink-unit=auto uses the unit preferred by the monitor sinks, which the
+	// level collector sets in the Prepare context
+	r := &fakeReader{lag: heartbeat.Lag{Milliseconds: 1250, SourceId: "source1", Replica: true}}
+	prom := mock.UnitSink{Unit: blip.UNIT_S}
+	datadog := mock.UnitSink{Unit: blip.UNIT_MS}
+	collect := func(sinks []blip.Sink, opts map[string]string) blip.MetricValue {
+		t.Helper()
+		ctx := context.Background()
+		if unit := blip.PreferredUnit(sinks); unit != "" {
+			ctx = blip.WithSinkUnit(ctx, unit)
+		}
+		opts[OPT_WRITER] = LAG_WRITER_BLIP
+		c := NewLagWithReader(mock.NewSQL(nil).DB(), r)
+		_, err := c.Prepare(ctx, lagPlan(opts))
+		require.NoError(t, err)
+		metrics, err := c.Collect(context.Background(), "kpi")
+		require.NoError(t, err)
+		require.Len(t, metrics, 1)
+		return metrics[0]
+	}
+
+	// Prometheus sink prefers seconds
+	m := collect([]blip.Sink{prom}, map[string]string{OPT_SINK_UNIT: "auto"})
+	assert.Equal(t, 1.25, m.Value)
+	assert.Equal(t, "s", m.Meta["unit"])
+
+	// Datadog sink prefers milliseconds, overriding unit
+	m = collect([]blip.Sink{datadog}, map[string]string{OPT_SINK_UNIT: "auto", OPT_UNIT: UNIT_S})
+	assert.Equal(t, float64(1250), m.Value)
+	assert.NotContains(t, m.Meta, "unit")
+
+	// Sinks prefer different units: fall back to unit
+	m = collect([]blip.Sink{prom, datadog}, map[string]string{OPT_SINK_UNIT: "auto", OPT_UNIT: UNIT_S})
+	assert.Equal(t, 1.25, m.Value)
+	m = collect([]blip.Sink{prom, datadog}, map[string]string{OPT_SINK_UNIT: "auto"})
+	assert.Equal(t, float64(1250), m.Value)
+
+	// No sink preference: fall back to unit
+	m = collect([]blip.Sink{mock.Sink{}}, map[string]string{OPT_SINK_UNIT: "auto", OPT_UNIT: UNIT_S})
+	assert.Equal(t, 1.25, m.Value)
+
+	// sink-unit=no (default) ignores the sinks
+	m = collect([]blip.Sink{prom}, map[string]string{})
+	assert.Equal(t, float64(1250), m.Value)
+	m = collect([]blip.Sink{datadog}, map[string]string{OPT_SINK_UNIT: "no", OPT_UNIT: UNIT_S})
+	assert.Equal(t, 1.25, m.Value)
+
+	// Invalid
+	_, err := NewLagWithReader(mock.NewSQL(nil).DB(), r).Prepare(context.Background(), lagPlan(map[string]string{OPT_WRITER: LAG_WRITER_BLIP, OPT_SINK_UNIT: "yes"}))
+	assert.Error(t, err)
+}
+
+// toSecondsValue returns v converted by toSeconds.
+func toSecondsValue(v float64) float64 {
+	metrics := []blip.MetricValue{{Name: "current", Value: v}}
+	toSeconds(metrics)
+	return metrics[0].Value
+}
+
+// customWriter is a LagWriter for testing RegisterWriter.
+type customWriter struct {
+	prepared []string // level names
+	err      error    // returned by Prepare
+	stopped  bool     // cleanup called
+}
+
+func (w *customWriter) Prepare(ctx context.Context, c *Lag, levelName string, plan blip.Plan, opts map[string]string) (func(), error) {
+	if w.err != nil {
+		return nil, w.err
+	}
+	w.prepared = append(w.prepared, levelName)
+	return func() { w.stopped = true }, nil
+}
+
+func (w *customWriter) Collect(ctx context.Context, c *Lag, levelName string) ([]blip.MetricValue, error) {
+	var v float64
+	if err := c.DB().QueryRowContext(ctx, "SELECT lag FROM custom_heartbeat").Scan(&v); err != nil {
+		return nil, err
+	}
+	return []blip.MetricValue{{Name: "current", Type: blip.GAUGE, Value: v, Meta: map[string]string{"source": "custom"}}}, nil
+}
+
+func TestRegisterWriter(t *testing.T) {
+	w := &customWriter{}
+	require.NoError(t, RegisterWriter("custom", w))
+	defer RemoveWriter("custom")
+	assert.Contains(t, Writers(), "custom")
+	assert.NoError(t, NewLag(nil).Help().Validate(map[string]string{OPT_WRITER: "custom"}))
+	assert.NoError(t, NewLag(nil).Help().Validate(map[string]string{OPT_WRITER: "pfs,custom"}))
+
+	// Already registered, and built-in and reserved names
+	assert.Error(t, RegisterWriter("custom", w))
+	assert.Error(t, RegisterWriter(LAG_WRITER_PFS, w))
+	assert.Error(t, RegisterWriter("auto", w))
+	assert.Error(t, RegisterWriter(LAG_WRITER_NONE, w))
+
+	m := mock.NewSQL(map[string]mock.SQLResult{
+		"custom_heartbeat": {Columns: []string{"lag"}, Rows: [][]driver.Value{{float64(250)}}},
+	})
+	c := NewLag(m.DB())
+	cleanup, err := c.Prepare(context.Background(), lagPlan(map[string]string{
+		OPT_WRITER:        "custom",
+		OPT_REPORT_WRITER: "yes",
+	}))
+	require.NoError(t, err)
+	require.NotNil(t, cleanup)
+	assert.Equal(t, []string{"kpi"}, w.prepared)
+
+	metrics, err := c.Collect(context.Background(), "kpi")
+	require.NoError(t, err)
+	expect := []blip.MetricValue{
+		{Name: "current", Type: blip.GAUGE, Value: 250, Meta: map[string]string{"source": "custom"}},
+		{Name: "writer", Type: blip.GAUGE, Value: -1, Meta: map[string]string{"writer": "custom"}},
+	}
+	assert.Equal(t, expect, metrics)
+	assert.Equal(t, "custom", c.ActiveConfig()["kpi"][OPT_WRITER])
+
+	metrics, err = c.ReadOnce(context.Background(), "kpi")
+	require.NoError(t, err)
+	assert.Equal(t, expect[:1], metrics)
+
+	cleanup()
+	assert.True(t, w.stopped)
+
+	// Custom writer as fallback: primary pfs fails at collect, so custom is used
+	uuid := "3e11fa47-71ca-11e1-9e33-c80aa9429562"
+	m.Set("replication_applier_status_by_worker", pfsResult([]driver.Value{"", uuid + ":10", "ON", "ON", uuid + ":10", int64(1), uuid + ":10",
+		1716922205.5, 1716922205.0, 0.0, 0.0, "db1", uuid}))
+	c = NewLag(m.DB())
+	_, err = c.Prepare(context.Background(), lagPlan(map[string]string{OPT_WRITER: "pfs,custom"}))
+	require.NoError(t, err)
+	assert.Equal(t, []string{"custom"}, c.atLevel["kpi"].fallback)
+	m.Set("replication_applier_status_by_worker", mock.SQLResult{Err: fmt.Errorf("table gone")})
+	metrics, err = c.Collect(context.Background(), "kpi")
+	require.NoError(t, err)
+	assert.Equal(t, expect[:1], metrics)
+	assert.Equal(t, "custom", c.atLevel["kpi"].used)
+
+	// Prepare error from custom writer
+	w.err = fmt.Errorf("not available")
+	_, err = NewLag(m.DB()).Prepare(context.Background(), lagPlan(map[string]string{OPT_WRITER: "custom"}))
+	assert.ErrorContains(t, err, "not available")
+
+	// Removed after Prepare: Collect returns an error, doesn't panic
+	w.err = nil
+	c = NewLag(m.DB())
+	_, err = c.Prepare(context.Background(), lagPlan(map[string]string{OPT_WRITER: "custom"}))
+	require.NoError(t, err)
+	RemoveWriter("custom")
+	_, err = c.Collect(context.Background(), "kpi")
+	assert.ErrorContains(t, err, "not registered")
+
+	// Removed: invalid writer
+	_, err = NewLag(m.DB()).Prepare(context.Background(), lagPlan(map[string]string{OPT_WRITER: "custom"}))
+	assert.ErrorContains(t, err, "invalid lag writer")
+}
+
+func TestSourceChanged(t *testing.T) {
+	uuid1 := "3e11fa47-71ca-11e1-9e33-c80aa9429562"
+	uuid2 := "8a94f357-aab4-11df-86ab-c80aa9429562"
+	row := func(host, uuid string) []driver.Value {
+		return []driver.Value{"", uuid + ":10", "ON", "ON", uuid + ":10", int64(1), uuid + ":10",
+			1716922205.5, 1716922205.0, 0.0, 0.0, host, uuid}
+	}
+	m := mock.NewSQL(map[string]mock.SQLResult{
+		"replication_applier_status_by_worker": pfsResult(row("db1", uuid1)),
+	})
+	c := NewLag(m.DB())
+	_, err := c.Prepare(context.Background(), lagPlan(map[string]string{
+		OPT_WRITER:               LAG_WRITER_PFS,
+		OPT_DEFAULT_CHANNEL_NAME: "main",
+	}))
+	require.NoError(t, err)
+
+	changes := func(metrics []blip.MetricValue) []blip.MetricValue {
+		var got []blip.MetricValue
+		for _, m := range metrics {
+			if m.Name == "source_changed" {
+				got = append(got, m)
+			}
+		}
+		return got
+	}
+
+	// Same source: no change
+	metrics, err := c.Collect(context.Background(), "kpi")
+	require.NoError(t, err)
+	assert.Empty(t, changes(metrics))
+
+	// Replica reconfigured to new source
+	m.Set("replication_applier_status_by_worker", pfsResult(row("db2", uuid2)))
+	metrics, err = c.Collect(context.Background(), "kpi")
+	require.NoError(t, err)
+	expect := []blip.MetricValue{{
+		Name:  "source_changed",
+		Type:  blip.GAUGE,
+		Value: 1,
+		Group: map[string]string{"channel": "main"},
+		Meta:  map[string]string{"source": "db2", "previous_source": "db1"},
+	}}
+	assert.Equal(t, expect, changes(metrics))
+	for _, m := range metrics {
+		if m.Name == "current" {
+			assert.Equal(t, "db2", m.Meta["source"])
+		}
+	}
+	// Cached GTIDs are from the new source, not the old one
+	assert.Equal(t, uuid2+":10", c.atLevel["kpi"].lastQueued[""])
+
+	// Reported only on the collection where the change is detected
+	metrics, err = c.Collect(context.Background(), "kpi")
+	require.NoError(t, err)
+	assert.Empty(t, changes(metrics))
+
+	// Unknown host is not a change, but a new UUID is
+	m.Set("replication_applier_status_by_worker", pfsResult(row("", uuid2)))
+	metrics, err = c.Collect(context.Background(), "kpi")
+	require.NoError(t, err)
+	assert.Empty(t, changes(metrics))
+	m.Set("replication_applier_status_by_worker", pfsResult(row("", uuid1)))
+	metrics, err = c.Collect(context.Background(), "kpi")
+	require.NoError(t, err)
+	got := changes(metrics)
+	require.Len(t, got, 1)
+	assert.Equal(t, map[string]string{"source": uuid1, "previous_source": uuid2}, got[0].Meta)
+}
+
+func TestPFSZeroTimestamps(t *testing.T) {
+	// Just-started replica: last applied trx has zero end-apply timestamp, so
+	// last_applied_lag is NULL (NULLIF in the query)
+	uuid := "3e11fa47-71ca-11e1-9e33-c80aa9429562"
+	row := func(lastAppliedLag interface{}) []driver.Value {
+		return []driver.Value{"", uuid + ":10", "ON", "ON", uuid + ":10", int64(1), uuid + ":10",
+			1716922205.5, 1716922205.0, lastAppliedLag, 0.0, "db1", uuid}
+	}
+	m := mock.NewSQL(map[string]mock.SQLResult{
+		"replication_applier_status_by_worker": pfsResult(row(nil)),
+	})
+	c := NewLag(m.DB())
+	_, err := c.Prepare(context.Background(), lagPlan(map[string]string{OPT_WRITER: LAG_WRITER_PFS}))
+	require.NoError(t, err)
+	c.atLevel["kpi"].lastQueued = map[string]string{} // Prepare collected once; simulate first collection
+
+	expect := blip.MetricValue{
+		Name:  "current",
+		Type:  blip.GAUGE,
+		Value: -1,
+		Group: map[string]string{"channel": ""},
+		Meta:  map[string]string{"source": "db1", "source_table": SOURCE_TABLE_WORKER},
+	}
+	metrics, err := c.Collect(context.Background(), "kpi")
+	require.NoError(t, err)
+	require.NotEmpty(t, metrics)
+	assert.Equal(t, expect, metrics[0])
+
+	// Epoch end-apply timestamp: negative lag is not data either
+	c.atLevel["kpi"].lastQueued = map[string]string{}
+	m.Set("replication_applier_status_by_worker", pfsResult(row(-1716922205000000.0)))
+	metrics, err = c.Collect(context.Background(), "kpi")
+	require.NoError(t, err)
+	assert.Equal(t, expect, metrics[0])
+
+	// Valid timestamps: last applied lag
+	c.atLevel["kpi"].lastQueued = map[string]string{}
+	m.Set("replication_applier_status_by_worker", pfsResult(row(120000.0)))
+	metrics, err = c.Collect(context.Background(), "kpi")
+	require.NoError(t, err)
+	assert.Equal(t, float64(120), metrics[0].Value)
+
+	// absent-value=drop: current dropped, other metrics reported
+	m.Set("replication_applier_status_by_worker", pfsResult(row(nil)))
+	c = NewLag(m.DB())
+	_, err = c.Prepare(context.Background(), lagPlan(map[string]string{OPT_WRITER: LAG_WRITER_PFS, OPT_ABSENT_VALUE: ABSENT_VALUE_DROP}))
+	require.NoError(t, err)
+	c.atLevel["kpi"].lastQueued = map[string]string{}
+	metrics, err = c.Collect(context.Background(), "kpi")
+	require.NoError(t, err)
+	require.NotEmpty(t, metrics)
+	for _, m := range metrics {
+		assert.NotEqual(t, "current", m.Name)
+	}
+}
+
+func TestHelpAppliesTo(t *testing.T) {
+	help := NewLag(nil).Help()
+	assert.Equal(t, OPT_WRITER, help.Selector)
+	assert.Equal(t, []string{LAG_WRITER_BLIP}, help.Options[OPT_NETWORK_LATENCY].AppliesTo)
+	assert.Equal(t, []string{LAG_WRITER_BLIP, LAG_WRITER_PT}, help.Options[OPT_HEARTBEAT_TABLE].AppliesTo)
+	assert.Equal(t, []string{LAG_WRITER_PFS, LAG_WRITER_MARIADB}, help.Options[OPT_CHANNEL].AppliesTo)
+	assert.Empty(t, help.Options[OPT_ROUND].AppliesTo) // all writers
+
+	// Every AppliesTo value is a writer
+	for name, o := range help.Options {
+		for _, w := range o.AppliesTo {
+			assert.Contains(t, help.Options[OPT_WRITER].Values, w, name)
+		}
+	}
+
+	opts := map[string]string{OPT_WRITER: LAG_WRITER_PFS, OPT_NETWORK_LATENCY: "100", OPT_ROUND: ROUND_CEIL}
+	require.NoError(t, help.Validate(opts))
+	assert.Equal(t, []string{"option network-latency ignored: applies only to writer blip, not pfs"}, help.Inapplicable(opts))
+
+	opts[OPT_WRITER] = LAG_WRITER_BLIP
+	assert.Empty(t, help.Inapplicable(opts))
+}
+
+func TestHelpVersions(t *testing.T) {
+	help := NewLag(nil).Help()
+	assert.Equal(t, map[string]blip.CollectorVersion{
+		LAG_WRITER_PFS:   {Min: "8.0"},
+		LAG_WRITER_GROUP: {Min: "8.0"},
+	}, help.Versions)
+
+	// Every Versions key is a writer
+	for w := range help.Versions {
+		assert.Contains(t, help.Options[OPT_WRITER].Values, w)
+	}
+
+	warnings, err := help.VersionMismatch(map[string]string{OPT_WRITER: LAG_WRITER_PFS}, "5.7.44-log")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"writer pfs requires MySQL 8.0 or newer, not 5.7.44-log"}, warnings)
+
+	warnings, err = help.VersionMismatch(map[string]string{OPT_WRITER: LAG_WRITER_PFS}, "8.0.36")
+	require.NoError(t, err)
+	assert.Empty(t, warnings)
+
+	warnings, err = help.VersionMismatch(map[string]string{OPT_WRITER: LAG_WRITER_BLIP}, "5.7.44")
+	require.NoError(t, err)
+	assert.Empty(t, warnings)
+}
+
+func TestDynamicHelp(t *testing.T) {
+	server := func(version, comment string) *sql.DB {
+		return mock.NewSQL(map[string]mock.SQLResult{
+			"SELECT @@version, @@version_comment": {
+				Columns: []string{"@@version", "@@version_comment"},
+				Rows:    [][]driver.Value{{version, comment}},
+			},
+		}).DB()
+	}
+	c := NewLag(nil)
+	static := c.Help()
+
+	// MySQL 8.0: all writers except mariadb
+	help, err := c.DynamicHelp(context.Background(), server("8.0.36", "MySQL Community Server - GPL"))
+	require.NoError(t, err)
+	assert.Equal(t, []string{LAG_WRITER_MARIADB}, help.Unsupported)
+	assert.Empty(t, help.Inapplicable(map[string]string{OPT_REPORT_OLDEST: "yes"}))
+
+	// MySQL 5.7: no pfs or group-replication, so pfs-only options are
+	// inapplicable, but all options and values are kept
+	help, err = c.DynamicHelp(context.Background(), server("5.7.44-log", "MySQL Community Server (GPL)"))
+	require.NoError(t, err)
+	assert.Equal(t, []string{LAG_WRITER_GROUP, LAG_WRITER_MARIADB, LAG_WRITER_PFS}, help.Unsupported)
+	assert.Equal(t, static.Options, help.Options)
+	assert.Equal(t, static.Versions, help.Versions)
+	assert.NoError(t, help.Validate(map[string]string{OPT_WRITER: "auto", OPT_AUTO_WRITERS: "pfs,blip", OPT_REPORT_OLDEST: "yes"}))
+	assert.Equal(t, []string{
+		"option " + OPT_REPORT_OLDEST + " ignored: applies only to writer pfs, not supported on this server",
+	}, help.Inapplicable(map[string]string{OPT_REPORT_OLDEST: "yes", OPT_HEARTBEAT_TABLE: "blip.hb"}))
+
+	// MariaDB: mariadb, but no pfs or group-replication
+	help, err = c.DynamicHelp(context.Background(), server("10.11.6-MariaDB-log", "MariaDB Server"))
+	require.NoError(t, err)
+	assert.Equal(t, []string{LAG_WRITER_GROUP, LAG_WRITER_PFS}, help.Unsupported)
+	assert.Equal(t, static.Options, help.Options)
+	assert.NotEmpty(t, help.Inapplicable(map[string]string{OPT_REPORT_OLDEST: "yes"}))
+
+	// Static Help is not modified
+	assert.Equal(t, static, c.Help())
+	assert.Empty(t, static.Unsupported)
+
+	// Query error
+	_, err = c.DynamicHelp(context.Background(), mock.NewSQL(nil).DB())
+	assert.Error(t, err)
+}
+
+func TestSourceValue(t *testing.T) {
+	// Source (not a replica): current = source-value with meta role=source,
+	// even with skip-zero, instead of dropped (report-not-a-replica=no)
+	r := &fakeReader{lag: heartbeat.Lag{Replica: false}}
+	c := NewLagWithReader(mock.NewSQL(nil).DB(), r)
+	_, err := c.Prepare(context.Background(), lagPlan(map[string]string{
+		OPT_WRITER:       LAG_WRITER_BLIP,
+		OPT_SOURCE_VALUE: "0",
+		OPT_SKIP_ZERO:    "yes",
+	}))
+	require.NoError(t, err)
+	metrics, err := c.Collect(context.Background(), "kpi")
+	require.NoError(t, err)
+	expect := []blip.MetricValue{{Name: "current", Type: blip.GAUGE, Value: 0, Meta: map[string]string{"role": "source"}}}
+	assert.Equal(t, expect, metrics)
+
+	// Replica: source-value not used
+	r.lag = heartbeat.Lag{Milliseconds: 0, SourceId: "source1", Replica: true}
+	metrics, err = c.Collect(context.Background(), "kpi")
+	require.NoError(t, err)
+	assert.Empty(t, metrics) // skip-zero
+
+	// role=source (writer none) with absent-value=drop: source-value overrides
+	c = NewLag(mock.NewSQL(nil).DB())
+	_, err = c.Prepare(context.Background(), lagPlan(map[string]string{
+		OPT_ROLE:         ROLE_SOURCE,
+		OPT_ABSENT_VALUE: ABSENT_VALUE_DROP,
+		OPT_SOURCE_VALUE: "-2",
+	}))
+	require.NoError(t, err)
+	metrics, err = c.Collect(context.Background(), "kpi")
+	require.NoError(t, err)
+	expect[0].Value = -2
+	assert.Equal(t, expect, metrics)
+
+	// Invalid
+	_, err = NewLag(mock.NewSQL(nil).DB()).Prepare(context.Background(), lagPlan(map[string]string{OPT_ROLE: ROLE_SOURCE, OPT_SOURCE_VALUE: "zero"}))
+	assert.Error(t, err)
+}
+
+func TestConcurrentPrepareCollect(t *testing.T) {
+	// Run with -race: re-Prepare (like plan reload) while collecting
+	uuid := "3e11fa47-71ca-11e1-9e33-c80aa9429562"
+	m := mock.NewSQL(map[string]mock.SQLResult{
+		"replication_applier_status_by_worker": pfsResult([]driver.Value{"", uuid + ":10", "ON", "ON", uuid + ":10", int64(1), uuid + ":10",
+			1716922205.5, 1716922205.0, 0.0, 0.0, "db1", uuid}),
+	})
+	c := NewLag(m.DB())
+	plan := lagPlan(map[string]string{OPT_WRITER: LAG_WRITER_PFS, OPT_REPORT_TREND: "yes"})
+	_, err := c.Prepare(context.Background(), plan)
+	require.NoError(t, err)
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 300)
+	wg.Add(3)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 100; i++ {
+			if _, err := c.Prepare(context.Background(), plan); err != nil {
+				errs <- err
+			}
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 100; i++ {
+			if _, err := c.Collect(context.Background(), "kpi"); err != nil {
+				errs <- err
+			}
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 100; i++ {
+			c.Cost("kpi")
+			c.ActiveConfig()
+		}
+	}()
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+}
+
+func TestReportFilters(t *testing.T) {
+	cols := []string{"Channel_Name", "Replicate_Do_DB", "Replicate_Ignore_DB", "Replicate_Do_Table", "Replicate_Ignore_Table",
+		"Replicate_Wild_Do_Table", "Replicate_Wild_Ignore_Table", "Replicate_Rewrite_DB"}
+	m := mock.NewSQL(map[string]mock.SQLResult{
+		"SELECT @@version": {Columns: []string{"@@version"}, Rows: [][]driver.Value{{"8.0.36"}}},
+		"SHOW REPLICA STATUS": {
+			Columns: cols,
+			Rows:    [][]driver.Value{{"", "", "", "", "", "", "", ""}},
+		},
+	})
+	r := &fakeReader{lag: heartbeat.Lag{Milliseconds: 250, SourceId: "source1", Replica: true}}
+	c := NewLagWithReader(m.DB(), r)
+	_, err := c.Prepare(context.Background(), lagPlan(map[string]string{
+		OPT_WRITER:               LAG_WRITER_BLIP,
+		OPT_REPORT_FILTERS:       "yes",
+		OPT_DEFAULT_CHANNEL_NAME: "main",
+	}))
+	require.NoError(t, err)
+	assert.Equal(t, "SHOW REPLICA STATUS", c.EffectiveQueries()["kpi/report-filters"])
+
+	filters := func(metrics []blip.MetricValue) []blip.MetricValue {
+		var got []blip.MetricValue
+		for _, m := range metrics {
+			if m.Name == "filters_present" {
+				got = append(got, m)
+			}
+		}
+		return got
+	}
+
+	// No filters
+	metrics, err := c.Collect(context.Background(), "kpi")
+	require.NoError(t, err)
+	expect := []blip.MetricValue{{Name: "filters_present", Type: blip.GAUGE, Value: 0, Group: map[string]string{"channel": "main"}}}
+	assert.Equal(t, expect, filters(metrics))
+
+	// Filters on one of two channels
+	m.Set("SHOW REPLICA STATUS", mock.SQLResult{
+		Columns: cols,
+		Rows: [][]driver.Value{
+			{"ch1", "app,billing", "", "", "app.audit", "", "", ""},
+			{"ch2", "", "", "", "", "", "", ""},
+		},
+	})
+	metrics, err = c.Collect(context.Background(), "kpi")
+	require.NoError(t, err)
+	expect = []blip.MetricValue{
+		{Name: "filters_present", Type: blip.GAUGE, Value: 1, Group: map[string]string{"channel": "ch1"},
+			Meta: map[string]string{"replicate_do_db": "app,billing", "replicate_ignore_table": "app.audit"}},
+		{Name: "filters_present", Type: blip.GAUGE, Value: 0, Group: map[string]string{"channel": "ch2"}},
+	}
+	assert.Equal(t, expect, filters(metrics))
+
+	// MySQL 5.7 (SHOW SLAVE STATUS, no Replicate_Rewrite_DB)
+	m = mock.NewSQL(map[string]mock.SQLResult{
+		"SELECT @@version": {Columns: []string{"@@version"}, Rows: [][]driver.Value{{"5.7.44"}}},
+		"SHOW SLAVE STATUS": {
+			Columns: []string{"Channel_Name", "Replicate_Do_DB", "Replicate_Wild_Ignore_Table"},
+			Rows:    [][]driver.Value{{"", "", "tmp.%"}},
+		},
+	})
+	c = NewLagWithReader(m.DB(), r)
+	_, err = c.Prepare(context.Background(), lagPlan(map[string]string{
+		OPT_WRITER:         LAG_WRITER_BLIP,
+		OPT_REPORT_FILTERS: "yes",
+	}))
+	require.NoError(t, err)
+	metrics, err = c.Collect(context.Background(), "kpi")
+	require.NoError(t, err)
+	expect = []blip.MetricValue{{Name: "filters_present", Type: blip.GAUGE, Value: 1, Group: map[string]string{"channel": ""},
+		Meta: map[string]string{"replicate_wild_ignore_table": "tmp.%"}}}
+	assert.Equal(t, expect, filters(metrics))
+
+	// Not a replica: nothing reported
+	m.Set("SHOW SLAVE STATUS", mock.SQLResult{Columns: []string{"Channel_Name"}})
+	metrics, err = c.Collect(context.Background(), "kpi")
+	require.NoError(t, err)
+	assert.Empty(t, filters(metrics))
+}
+
+func TestReportFileBacklog(t *testing.T) {
+	tests := []struct {
+		read, exec string
+		backlog    float64
+		ok         bool
+	}{
+		{"mysql-bin.000123", "mysql-bin.000123", 0, true}, // same file
+		{"mysql-bin.000125", "mysql-bin.000120", 5, true}, // known gap
+		{"binlog.1000000", "binlog.999998", 2, true},      // more digits after 999999
+		{"my.host-bin.000010", "my.host-bin.000007", 3, true},
+		{"mysql-bin.000001", "mysql-bin.000009", 0, true}, // reset on source: never negative
+		{"binlog.000010", "mysql-bin.000003", 0, false},   // different series (log_bin_basename changed)
+		{"", "", 0, false},                               // no source log file yet
+		{"mysql-bin", "mysql-bin", 0, false},             // no extension
+		{"mysql-bin.", "mysql-bin.", 0, false},           // empty extension
+		{".000010", ".000009", 0, false},                 // no base name
+		{"mysql-bin.index", "mysql-bin.index", 0, false}, // not a number
+		{"mysql-bin.00001a", "mysql-bin.000010", 0, false},
+		{"mysql-bin.99999999999999999999", "mysql-bin.000001", 0, false}, // overflow
+	}
+	for _, tc := range tests {
+		status := map[string]string{"Source_Log_File": tc.read, "Relay_Source_Log_File": tc.exec}
+		backlog, ok := binlogFileBacklog(sqlutil.ParseReplicaStatus(status))
+		assert.Equal(t, tc.ok, ok, "%s - %s", tc.read, tc.exec)
+		assert.Equal(t, tc.backlog, backlog, "%s - %s", tc.read, tc.exec)
+	}
+
+	// MySQL 5.7 (Master terms)
+	backlog, ok := binlogFileBacklog(sqlutil.ParseReplicaStatus(map[string]string{"Master_Log_File": "mysql-bin.000012", "Relay_Master_Log_File": "mysql-bin.000010"}))
+	assert.True(t, ok)
+	assert.Equal(t, float64(2), backlog)
+
+	// Collect: one metric per channel, absent if not computable
+	m := mock.NewSQL(map[string]mock.SQLResult{
+		"SELECT @@version": {Columns: []string{"@@version"}, Rows: [][]driver.Value{{"8.0.36"}}},
+		"SHOW REPLICA STATUS": {
+			Columns: []string{"Channel_Name", "Source_Log_File", "Relay_Source_Log_File"},
+			Rows: [][]driver.Value{
+				{"ch1", "mysql-bin.000042", "mysql-bin.000039"},
+				{"ch2", "", ""},
+			},
+		},
+	})
+	r := &fakeReader{lag: heartbeat.Lag{Milliseconds: 250, SourceId: "source1", Replica: true}}
+	for _, absentValue := range []string{"", ABSENT_VALUE_DROP} {
+		c := NewLagWithReader(m.DB(), r)
+		_, err := c.Prepare(context.Background(), lagPlan(map[string]string{
+			OPT_WRITER:              LAG_WRITER_BLIP,
+			OPT_REPORT_FILE_BACKLOG: "yes",
+			OPT_ABSENT_VALUE:        absentValue,
+		}))
+		require.NoError(t, err)
+		assert.Equal(t, "SHOW REPLICA STATUS", c.EffectiveQueries()["kpi/report-file-backlog"])
+		metrics, err := c.Collect(context.Background(), "kpi")
+		require.NoError(t, err)
+		var got []blip.MetricValue
+		for _, m := range metrics {
+			if m.Name == "file_backlog" {
+				got = append(got, m)
+			}
+		}
+		expect := []blip.MetricValue{{Name: "file_backlog", Type: blip.GAUGE, Value: 3, Group: map[string]string{"channel": "ch1"}}}
+		if absentValue == "" {
+			expect = append(expect, blip.MetricValue{Name: "file_backlog", Type: blip.GAUGE, Value: -1, Group: map[string]string{"channel": "ch2"}})
+		}
+		assert.Equal(t, expect, got, "absent-value=%s", absentValue)
+	}
+
+	// SHOW REPLICA STATUS fails: Prepare fails
+	m.Set("SHOW REPLICA STATUS", mock.SQLResult{Err: fmt.Errorf("access denied")})
+	_, err := NewLagWithReader(m.DB(), r).Prepare(context.Background(), lagPlan(map[string]string{
+		OPT_WRITER:              LAG_WRITER_BLIP,
+		OPT_REPORT_FILE_BACKLOG: "yes",
+	}))
+	assert.Error(t, err)
+}
+
+func TestPosBacklog(t *testing.T) {
+	cols := []string{"Channel_Name", "Source_Log_File", "Read_Source_Log_Pos", "Relay_Source_Log_File", "Exec_Source_Log_Pos"}
+	m := mock.NewSQL(map[string]mock.SQLResult{
+		"SELECT @@version": {Columns: []string{"@@version"}, Rows: [][]driver.Value{{"8.0.36"}}},
+		"SHOW REPLICA STATUS": {
+			Columns: cols,
+			Rows:    [][]driver.Value{{"", "binlog.000012", "5000", "binlog.000012", "1200"}},
+		},
+	})
+	r := &fakeReader{lag: heartbeat.Lag{Milliseconds: 250, SourceId: "source1", Replica: true}}
+	c := NewLagWithReader(m.DB(), r)
+	_, err := c.Prepare(context.Background(), lagPlan(map[string]string{
+		OPT_WRITER:               LAG_WRITER_BLIP,
+		OPT_REPORT_POS_BACKLOG:   "yes",
+		OPT_DEFAULT_CHANNEL_NAME: "main",
+	}))
+	require.NoError(t, err)
+
+	backlog := func(metrics []blip.MetricValue) []blip.MetricValue {
+		var got []blip.MetricValue
+		for _, m := range metrics {
+			if m.Name == "pos_backlog" {
+				got = append(got, m)
+			}
+		}
+		return got
+	}
+
+	// Same file: read pos - exec pos
+	metrics, err := c.Collect(context.Background(), "kpi")
+	require.NoError(t, err)
+	expect := []blip.MetricValue{{Name: "pos_backlog", Type: blip.GAUGE, Value: 3800, Group: map[string]string{"channel": "main"}}}
+	assert.Equal(t, expect, backlog(metrics))
+
+	// File rollover: IO thread on next file, SQL thread still on previous: absent
+	m.Set("SHOW REPLICA STATUS", mock.SQLResult{
+		Columns: cols,
+		Rows:    [][]driver.Value{{"", "binlog.000013", "400", "binlog.000012", "1200"}},
+	})
+	metrics, err = c.Collect(context.Background(), "kpi")
+	require.NoError(t, err)
+	expect = []blip.MetricValue{{Name: "pos_backlog", Type: blip.GAUGE, Value: -1, Group: map[string]string{"channel": "main"}}}
+	assert.Equal(t, expect, backlog(metrics))
+
+	// Not a replica: nothing
+	m.Set("SHOW REPLICA STATUS", mock.SQLResult{Columns: cols})
+	metrics, err = c.Collect(context.Background(), "kpi")
+	require.NoError(t, err)
+	assert.Empty(t, backlog(metrics))
+
+	// Master terms prior to 8.0.22, absent-value=drop drops file mismatch
+	m = mock.NewSQL(map[string]mock.SQLResult{
+		"SHOW SLAVE STATUS": {
+			Columns: []string{"Master_Log_File", "Read_Master_Log_Pos", "Relay_Master_Log_File", "Exec_Master_Log_Pos"},
+			Rows:    [][]driver.Value{{"binlog.000013", "400", "binlog.000012", "1200"}},
+		},
+	})
+	c = NewLagWithReader(m.DB(), r)
+	_, err = c.Prepare(context.Background(), lagPlan(map[string]string{
+		OPT_WRITER:             LAG_WRITER_BLIP,
+		OPT_REPORT_POS_BACKLOG: "yes",
+		OPT_ABSENT_VALUE:       ABSENT_VALUE_DROP,
+	}))
+	require.NoError(t, err)
+	metrics, err = c.Collect(context.Background(), "kpi")
+	require.NoError(t, err)
+	assert.Empty(t, backlog(metrics))
+
+	// Cannot read SHOW SLAVE STATUS: Prepare error
+	m.Set("SHOW SLAVE STATUS", mock.SQLResult{Err: fmt.Errorf("access denied")})
+	c = NewLagWithReader(m.DB(), r)
+	_, err = c.Prepare(context.Background(), lagPlan(map[string]string{
+		OPT_WRITER:             LAG_WRITER_BLIP,
+		OPT_REPORT_POS_BACKLOG: "yes",
+	}))
+	require.Error(t, err)
+}
+
+func TestReplStatusCol(t *testing.T) {
+	mysql80 := map[string]string{
+		"Channel_Name":          "ch1",
+		"Source_Log_File":       "binlog.000012",
+		"Read_Source_Log_Pos":   "5000",
+		"Relay_Source_Log_File": "binlog.000012",
+		"Exec_Source_Log_Pos":   "1200",
+		"Replica_IO_Running":    "Yes",
+		"Replicate_Do_DB":       "",
+		"SQL_Delay":             "60",
+	}
+	mysql57 := map[string]string{
+		"Channel_Name":          "ch1",
+		"Master_Log_File":       "binlog.000012",
+		"Read_Master_Log_Pos":   "5000",
+		"Relay_Master_Log_File": "binlog.000012",
+		"Exec_Master_Log_Pos":   "1200",
+		"Slave_IO_Running":      "Yes",
+		"Replicate_Do_DB":       "",
+		"SQL_Delay":             "60",
+	}
+	mariadb := map[string]string{
+		"Connection_name":       "ch1",
+		"Master_Log_File":       "binlog.000012",
+		"Read_Master_Log_Pos":   "5000",
+		"Relay_Master_Log_File": "binlog.000012",
+		"Exec_Master_Log_Pos":   "1200",
+		"Slave_IO_Running":      "Yes",
+		"Replicate_Do_DB":       "",
+		"SQL_Delay":             "60",
+	}
+	for name, cols := range map[string]map[string]string{"mysql80": mysql80, "mysql57": mysql57, "mariadb": mariadb} {
+		status := sqlutil.ParseReplicaStatus(cols)
+		// Current and old names find the column in both families
+		for _, col := range []string{"Channel_Name", "Read_Source_Log_Pos", "Read_Master_Log_Pos", "Replica_IO_Running", "Slave_IO_Running", "SQL_Delay"} {
+			_, ok := status.Column(col)
+			assert.True(t, ok, "%s: %s", name, col)
+		}
+		v, _ := status.Column("Channel_Name")
+		assert.Equal(t, "ch1", v, name)
+		v, _ = status.Column("Exec_Source_Log_Pos")
+		assert.Equal(t, "1200", v, name)
+
+		// Replicate isn't the term Replica
+		_, ok := status.Column("Replicate_Do_DB")
+		assert.True(t, ok, name)
+		_, ok = status.Column("Slavete_Do_DB")
+		assert.False(t, ok, name)
+
+		backlog, ok := binlogPosBacklog(status)
+		assert.True(t, ok, name)
+		assert.Equal(t, float64(3800), backlog, name)
+	}
+
+	// Case-insensitive
+	v, ok := sqlutil.ParseReplicaStatus(map[string]string{"sql_delay": "5"}).Column("SQL_Delay")
+	assert.True(t, ok)
+	assert.Equal(t, "5", v)
+
+	_, ok = sqlutil.ParseReplicaStatus(mysql80).Column("Seconds_Behind_Source")
+	assert.False(t, ok)
+}
+
+func TestStaleBehavior(t *testing.T) {
+	ts := time.Date(2024, 5, 28, 12, 0, 0, 0, time.UTC)
+	collect := func(behavior string) []blip.MetricValue {
+		r := &fakeReader{lag: heartbeat.Lag{Milliseconds: 500, LastTs: ts, SourceId: "source1", Replica: true}}
+		c := NewLagWithReader(mock.NewSQL(nil).DB(), r)
+		now := ts.Add(500 * time.Millisecond)
+		c.Now = func() time.Time { return now }
+		opts := map[string]string{OPT_WRITER: LAG_WRITER_BLIP}
+		if behavior != "" {
+			opts[OPT_STALE_BEHAVIOR] = behavior
+		}
+		_, err := c.Prepare(context.Background(), lagPlan(opts))
+		require.NoError(t, err)
+
+		// 1st collection: fresh heartbeat
+		var got []blip.MetricValue
+		metrics, err := c.Collect(context.Background(), "kpi")
+		require.NoError(t, err)
+		got = append(got, metrics...)
+
+		// 2nd collection 2s later: no new heartbeat (same LastTs)
+		now = now.Add(2 * time.Second)
+		metrics, err = c.Collect(context.Background(), "kpi")
+		require.NoError(t, err)
+		got = append(got, metrics...)
+
+		// 3rd collection: new heartbeat, no longer stale
+		r.lag = heartbeat.Lag{Milliseconds: 200, LastTs: ts.Add(3 * time.Second), SourceId: "source1", Replica: true}
+		now = now.Add(time.Second)
+		metrics, err = c.Collect(context.Background(), "kpi")
+		require.NoError(t, err)
+		got = append(got, metrics...)
+		return got
+	}
+	fresh := blip.MetricValue{Name: "current", Type: blip.GAUGE, Value: 500, Meta: map[string]string{"source": "source1"}}
+	next := blip.MetricValue{Name: "current", Type: blip.GAUGE, Value: 200, Meta: map[string]string{"source": "source1"}}
+
+	// hold (default): last lag with meta stale=true
+	held := blip.MetricValue{Name: "current", Type: blip.GAUGE, Value: 500, Meta: map[string]string{"source": "source1", "stale": "true"}}
+	assert.Equal(t, []blip.MetricValue{fresh, held, next}, collect(""))
+	assert.Equal(t, []blip.MetricValue{fresh, held, next}, collect(STALE_HOLD))
+
+	// grow: last lag + 2s since the fresh read
+	grown := blip.MetricValue{Name: "current", Type: blip.GAUGE, Value: 2500, Meta: map[string]string{"source": "source1", "stale": "true"}}
+	assert.Equal(t, []blip.MetricValue{fresh, grown, next}, collect(STALE_GROW))
+
+	// absent: no heartbeat, which is dropped by default (report-no-heartbeat=no)
+	assert.Equal(t, []blip.MetricValue{fresh, next}, collect(STALE_ABSENT))
+
+	c := NewLagWithReader(mock.NewSQL(nil).DB(), &fakeReader{})
+	_, err := c.Prepare(context.Background(), lagPlan(map[string]string{OPT_WRITER: LAG_WRITER_BLIP, OPT_STALE_BEHAVIOR: "freeze"}))
+	assert.Error(t, err)
+}
+
+func TestReportWriterAlive(t *testing.T) {
+	ts := time.Date(2024, 5, 28, 12, 0, 0, 0, time.UTC)
+	r := &fakeReader{lag: heartbeat.Lag{Milliseconds: 0, LastTs: ts, SourceId: "source1", Replica: true}}
+	c := NewLagWithReader(mock.NewSQL(nil).DB(), r)
+	_, err := c.Prepare(context.Background(), lagPlan(map[string]string{
+		OPT_WRITER:              LAG_WRITER_BLIP,
+		OPT_REPORT_WRITER_ALIVE: "yes",
+	}))
+	require.NoError(t, err)
+
+	writerAlive := func() []blip.MetricValue {
+		metrics, err := c.Collect(context.Background(), "kpi")
+		require.NoError(t, err)
+		var alive []blip.MetricValue
+		for _, m := range metrics {
+			if m.Name == "writer_alive" {
+				alive = append(alive, m)
+			}
+		}
+		return alive
+	}
+	alive := blip.MetricValue{Name: "writer_alive", Type: blip.GAUGE, Value: 1, Meta: map[string]string{"source": "source1"}}
+	dead := blip.MetricValue{Name: "writer_alive", Type: blip.GAUGE, Value: 0, Meta: map[string]string{"source": "source1"}}
+
+	// 1st collection: no previous heartbeat to compare, so not reported
+	assert.Empty(t, writerAlive())
+
+	// Advancing heartbeats with zero lag: caught up, writer alive
+	for i := 1; i <= 3; i++ {
+		r.lag.LastTs = ts.Add(time.Duration(i) * time.Second)
+		assert.Equal(t, []blip.MetricValue{alive}, writerAlive())
+	}
+
+	// Stalled heartbeat with zero lag: writer stopped
+	assert.Equal(t, []blip.MetricValue{dead}, writerAlive())
+	assert.Equal(t, []blip.MetricValue{dead}, writerAlive())
+
+	// Writer resumes
+	r.lag.LastTs = ts.Add(10 * time.Second)
+	assert.Equal(t, []blip.MetricValue{alive}, writerAlive())
+
+	// No heartbeat: not reported
+	r.lag = heartbeat.Lag{Milliseconds: -1, SourceId: "source1", Replica: true}
+	assert.Empty(t, writerAlive())
+
+	// Disabled by default
+	r = &fakeReader{lag: heartbeat.Lag{Milliseconds: 0, LastTs: ts, SourceId: "source1", Replica: true}}
+	c = NewLagWithReader(mock.NewSQL(nil).DB(), r)
+	_, err = c.Prepare(context.Background(), lagPlan(map[string]string{OPT_WRITER: LAG_WRITER_BLIP}))
+	require.NoError(t, err)
+	writerAlive()
+	assert.Empty(t, writerAlive())
+}
+
+func TestIncludeVersion(t *testing.T) {
+	m := mock.NewSQL(map[string]mock.SQLResult{
+		"SELECT @@version": {Columns: []string{"@@version"}, Rows: [][]driver.Value{{"8.0.36-log"}}},
+	})
+	r := &fakeReader{lag: heartbeat.Lag{Milliseconds: 250, SourceId: "source1", Replica: true}}
+	c := NewLagWithReader(m.DB(), r)
+	_, err := c.Prepare(context.Background(), lagPlan(map[string]string{
+		OPT_WRITER:          LAG_WRITER_BLIP,
+		OPT_INCLUDE_VERSION: "yes",
+		OPT_REPORT_WRITER:   "yes",
+	}))
+	require.NoError(t, err)
+	for i := 0; i < 3; i++ {
+		metrics, err := c.Collect(context.Background(), "kpi")
+		require.NoError(t, err)
+		require.Len(t, metrics, 2)
+		assert.Equal(t, map[string]string{"source": "source1", "mysql_version": "8.0.36-log"}, metrics[0].Meta)
+		assert.Equal(t, "writer", metrics[1].Name)
+		assert.Empty(t, metrics[1].Meta["mysql_version"]) // only current
+	}
+	assert.Equal(t, 1, m.Count("@@version")) // queried once in Prepare, not on Collect
+
+	// Disabled (default): not queried
+	m = mock.NewSQL(map[string]mock.SQLResult{
+		"SELECT @@version": {Columns: []string{"@@version"}, Rows: [][]driver.Value{{"8.0.36-log"}}},
+	})
+	c = NewLagWithReader(m.DB(), r)
+	_, err = c.Prepare(context.Background(), lagPlan(map[string]string{OPT_WRITER: LAG_WRITER_BLIP}))
+	require.NoError(t, err)
+	metrics, err := c.Collect(context.Background(), "kpi")
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"source": "source1"}, metrics[0].Meta)
+	assert.Equal(t, 0, m.Count("@@version"))
+}
+
+func TestSourceWriteLatency(t *testing.T) {
+	r := &fakeReader{lag: heartbeat.Lag{Milliseconds: 250, SourceId: "source1", Replica: true,
+		WriteLatency: sql.NullFloat64{Float64: 12.5, Valid: true}}}
+	c := NewLagWithReader(mock.NewSQL(nil).DB(), r)
+	_, err := c.Prepare(context.Background(), lagPlan(map[string]string{
+		OPT_WRITER:              LAG_WRITER_BLIP,
+		OPT_HEARTBEAT_WRITE_LAT: "write_latency_ms",
+	}))
+	require.NoError(t, err)
+	metrics, err := c.Collect(context.Background(), "kpi")
+	require.NoError(t, err)
+	expect := []blip.MetricValue{
+		{Name: "current", Type: blip.GAUGE, Value: 250, Meta: map[string]string{"source": "source1"}},
+		{Name: "source_write_latency", Type: blip.GAUGE, Value: 12.5, Meta: map[string]string{"source": "source1"}},
+	}
+	assert.Equal(t, expect, metrics)
+
+	// Column absent or NULL: not reported
+	r.lag.WriteLatency = sql.NullFloat64{}
+	metrics, err = c.Collect(context.Background(), "kpi")
+	require.NoError(t, err)
+	assert.Equal(t, expect[:1], metrics)
+
+	// Option not set: not reported
+	r.lag.WriteLatency = sql.NullFloat64{Float64: 12.5, Valid: true}
+	c = NewLagWithReader(mock.NewSQL(nil).DB(), r)
+	_, err = c.Prepare(context.Background(), lagPlan(map[string]string{OPT_WRITER: LAG_WRITER_BLIP}))
+	require.NoError(t, err)
+	metrics, err = c.Collect(context.Background(), "kpi")
+	require.NoError(t, err)
+	assert.Equal(t, expect[:1], metrics)
+
+	// Column in table: quoted for the reader; absent (unknown column): not read
+	m := mock.NewSQL(map[string]mock.SQLResult{
+		"LIMIT 0": {Columns: []string{"write_latency_ms"}},
+	})
+	assert.Equal(t, "`write_latency_ms`", writeLatencyCol(context.Background(), m.DB(), "`blip`.`heartbeat`", "write_latency_ms"))
+	m.Set("LIMIT 0", mock.SQLResult{Err: &mysql.MySQLError{Number: 1054, Message: "Unknown column 'write_latency_ms' in 'field list'"}})
+	assert.Equal(t, "", writeLatencyCol(context.Background(), m.DB(), "`blip`.`heartbeat`", "write_latency_ms"))
+	assert.Equal(t, "", writeLatencyCol(context.Background(), m.DB(), "`blip`.`heartbeat`", ""))
+}
+
+func TestOnDetectFail(t *testing.T) {
+	// auto-writers=pfs and PFS down: auto-detection fails
+	m := mock.NewSQL(map[string]mock.SQLResult{
+		"replication_applier_status_by_worker": {Err: fmt.Errorf("performance_schema disabled")},
+	})
+	opts := func(onFail string) map[string]string {
+		return map[string]string{OPT_AUTO_WRITERS: LAG_WRITER_PFS, OPT_ON_DETECT_FAIL: onFail}
+	}
+
+	// error (default): Prepare fails
+	for _, onFail := range []string{"", DETECT_FAIL_ERROR} {
+		_, err := NewLag(m.DB()).Prepare(context.Background(), lagPlan(opts(onFail)))
+		require.Error(t, err, onFail)
+		assert.Contains(t, err.Error(), "failed to auto-detect", onFail)
+	}
+
+	// disable: Prepare succeeds, Collect returns no metrics and doesn't query
+	c := NewLag(m.DB())
+	cleanup, err := c.Prepare(context.Background(), lagPlan(opts(DETECT_FAIL_DISABLE)))
+	require.NoError(t, err)
+	require.NotNil(t, cleanup)
+	defer cleanup()
+	assert.Equal(t, LAG_WRITER_NONE, c.lagWriterIn["kpi"])
+	n := len(m.Queries())
+	metrics, err := c.Collect(context.Background(), "kpi")
+	assert.ErrorIs(t, err, blip.ErrNoMetrics)
+	assert.Empty(t, metrics)
+	assert.Len(t, m.Queries(), n, "queries after disabled")
+	s, err := c.State(context.Background(), "kpi")
+	assert.ErrorIs(t, err, blip.ErrNoMetrics)
+	assert.False(t, s.Replica)
+
+	// disable, but auto-detection works: collects as usual
+	uuid := "3e11fa47-71ca-11e1-9e33-c80aa9429562"
+	m.Set("replication_applier_status_by_worker", pfsResult([]driver.Value{"", uuid + ":10", "ON", "ON", uuid + ":10", int64(1), uuid + ":10",
+		1716922205.5, 1716922205.0, 0.0, 0.0, "db1", uuid}))
+	c = NewLag(m.DB())
+	_, err = c.Prepare(context.Background(), lagPlan(opts(DETECT_FAIL_DISABLE)))
+	require.NoError(t, err)
+	assert.Equal(t, LAG_WRITER_PFS, c.lagWriterIn["kpi"])
+	metrics, err = c.Collect(context.Background(), "kpi")
+	require.NoError(t, err)
+	require.NotEmpty(t, metrics)
+	assert.Equal(t, "current", metrics[0].Name)
+
+	// Invalid
+	_, err = NewLag(m.DB()).Prepare(context.Background(), lagPlan(opts("ignore")))
+	assert.Error(t, err)
+}
+
+func TestAutoWriters(t *testing.T) {
+	// PFS down, Blip heartbeat available: auto falls back to blip by default
+	m := mock.NewSQL(map[string]mock.SQLResult{
+		"replication_applier_status_by_worker": {Err: fmt.Errorf("performance_schema disabled")},
+		"heartbeat":                            heartbeatResult("source1", 0),
+	})
+	c := NewLag(m.DB())
+	cleanup, err := c.Prepare(context.Background(), lagPlan(map[string]string{}))
+	require.NoError(t, err)
+	cleanup()
+	assert.Equal(t, LAG_WRITER_BLIP, c.lagWriterIn["kpi"])
+
+	// auto-writers=pfs: auto fails instead of using blip
+	c = NewLag(m.DB())
+	_, err = c.Prepare(context.Background(), lagPlan(map[string]string{OPT_AUTO_WRITERS: LAG_WRITER_PFS}))
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "auto-writers pfs")
+	assert.Contains(t, err.Error(), "performance_schema disabled")
+
+	// auto-writers=pfs and PFS up: pfs
+	uuid := "3e11fa47-71ca-11e1-9e33-c80aa9429562"
+	m.Set("replication_applier_status_by_worker", pfsResult([]driver.Value{"", uuid + ":10", "ON", "ON", uuid + ":10", int64(1), uuid + ":10",
+		1716922205.5, 1716922205.0, 0.0, 0.0, "db1", uuid}))
+	c = NewLag(m.DB())
+	_, err = c.Prepare(context.Background(), lagPlan(map[string]string{OPT_AUTO_WRITERS: LAG_WRITER_PFS}))
+	require.NoError(t, err)
+	assert.Equal(t, LAG_WRITER_PFS, c.lagWriterIn["kpi"])
+
+	// auto-writers=blip: PFS not tried even if available
+	c = NewLag(m.DB())
+	cleanup, err = c.Prepare(context.Background(), lagPlan(map[string]string{OPT_AUTO_WRITERS: LAG_WRITER_BLIP}))
+	require.NoError(t, err)
+	cleanup()
+	assert.Equal(t, LAG_WRITER_BLIP, c.lagWriterIn["kpi"])
+
+	// Invalid writer
+	c = NewLag(m.DB())
+	_, err = c.Prepare(context.Background(), lagPlan(map[string]string{OPT_AUTO_WRITERS: "pfs,auto"}))
+	assert.Error(t, err)
+
+	// Plan validation: list of writers, only for writer=auto
+	help := c.Help()
+	assert.NoError(t, help.Validate(map[string]string{OPT_AUTO_WRITERS: "pfs, group-replication"}))
+	assert.Error(t, help.Validate(map[string]string{OPT_AUTO_WRITERS: "pfs,pt-heartbeat"}))
+	assert.Len(t, help.Inapplicable(map[string]string{OPT_WRITER: LAG_WRITER_PFS, OPT_AUTO_WRITERS: "pfs"}), 1)
+}
+
+func TestQueryDuration(t *testing.T) {
+	duration := func(metrics []blip.MetricValue) (float64, bool) {
+		for _, m := range metrics {
+			if m.Name == "query_duration_ms" {
+				assert.Equal(t, blip.GAUGE, m.Type)
+				return m.Value, true
+			}
+		}
+		return 0, false
+	}
+
+	// Blip heartbeat
+	r := &fakeReader{lag: heartbeat.Lag{Milliseconds: 250, SourceId: "source1", Replica: true}}
+	c := NewLagWithReader(mock.NewSQL(nil).DB(), r)
+	_, err := c.Prepare(context.Background(), lagPlan(map[string]string{
+		OPT_WRITER:                LAG_WRITER_BLIP,
+		OPT_REPORT_QUERY_DURATION: "yes",
+	}))
+	require.NoError(t, err)
+	metrics, err := c.Collect(context.Background(), "kpi")
+	require.NoError(t, err)
+	ms, ok := duration(metrics)
+	assert.True(t, ok)
+	assert.GreaterOrEqual(t, ms, 0.0)
+
+	// Performance Schema
+	uuid := "3e11fa47-71ca-11e1-9e33-c80aa9429562"
+	m := mock.NewSQL(map[string]mock.SQLResult{
+		"replication_applier_status_by_worker": pfsResult([]driver.Value{"", uuid + ":100", "ON", "ON", uuid + ":100", int64(1), uuid + ":100",
+			1716922200.0, 1716922199.0, 1000.0, nil, "db1", uuid}),
+	})
+	c = NewLag(m.DB())
+	_, err = c.Prepare(context.Background(), lagPlan(map[string]string{
+		OPT_WRITER:                LAG_WRITER_PFS,
+		OPT_REPORT_QUERY_DURATION: "yes",
+	}))
+	require.NoError(t, err)
+	metrics, err = c.Collect(context.Background(), "kpi")
+	require.NoError(t, err)
+	ms, ok = duration(metrics)
+	assert.True(t, ok)
+	assert.GreaterOrEqual(t, ms, 0.0)
+
+	// Disabled (default): not reported
+	c = NewLagWithReader(mock.NewSQL(nil).DB(), r)
+	_, err = c.Prepare(context.Background(), lagPlan(map[string]string{OPT_WRITER: LAG_WRITER_BLIP}))
+	require.NoError(t, err)
+	metrics, err = c.Collect(context.Background(), "kpi")
+	require.NoError(t, err)
+	_, ok = duration(metrics)
+	assert.False(t, ok)
+}
+
+func TestHeartbeatAppliedTs(t *testing.T) {
+	// ts 1.5s ago, so the next heartbeat (1s freq) is 500ms late: lag from ts
+	// is 500ms. But the heartbeat was applied 300ms ago: apply lag is 300ms.
+	now := time.Now()
+	hb := func(applied interface{}) mock.SQLResult {
+		return mock.SQLResult{
+			Columns: []string{"NOW(3)", "ts", "freq", "src_id", "1", "applied_ts"},
+			Rows:    [][]driver.Value{{now, now.Add(-1500 * time.Millisecond), int64(1000), "source1", int64(1), applied}},
+		}
+	}
+	current := func(c *Lag, expect float64) {
+		t.Helper()
+		waitFor(t, func() bool {
+			metrics, err := c.Collect(context.Background(), "kpi")
+			require.NoError(t, err)
+			return len(metrics) > 0 && metrics[0].Name == "current" && metrics[0].Value == expect
+		})
+	}
+	opts := map[string]string{
+		OPT_WRITER:               LAG_WRITER_BLIP,
+		OPT_HEARTBEAT_APPLIED_TS: "applied_ts",
+		OPT_NETWORK_LATENCY:      "0",
+	}
+
+	m := mock.NewSQL(map[string]mock.SQLResult{
+		"heartbeat": hb(now.Add(-300 * time.Millisecond)),
+		"`applied_ts` FROM `blip`.`heartbeat` LIMIT 0": {Columns: []string{"applied_ts"}},
+	})
+	c := NewLag(m.DB())
+	cleanup, err := c.Prepare(context.Background(), lagPlan(opts))
+	require.NoError(t, err)
+	current(c, 300)
+	cleanup()
+
+	// NULL: lag from ts
+	m = mock.NewSQL(map[string]mock.SQLResult{
+		"heartbeat": hb(nil),
+		"`applied_ts` FROM `blip`.`heartbeat` LIMIT 0": {Columns: []string{"applied_ts"}},
+	})
+	c = NewLag(m.DB())
+	cleanup, err = c.Prepare(context.Background(), lagPlan(opts))
+	require.NoError(t, err)
+	current(c, 500)
+	cleanup()
+
+	// Column not in table: not read, lag from ts
+	m = mock.NewSQL(map[string]mock.SQLResult{
+		"heartbeat": heartbeatResult("source1", 1500*time.Millisecond),
+		"`applied_ts` FROM `blip`.`heartbeat` LIMIT 0": {Err: &mysql.MySQLError{Number: 1054, Message: "Unknown column 'applied_ts' in 'field list'"}},
+	})
+	c = NewLag(m.DB())
+	cleanup, err = c.Prepare(context.Background(), lagPlan(opts))
+	require.NoError(t, err)
+	current(c, 500)
+	cleanup()
+	assert.Equal(t, 1, m.Count("applied_ts")) // only the probe
+}
+
+func TestHeartbeatSeq(t *testing.T) {
+	// Replica applied seq 100, source wrote seq 102 (1s freq): lag 2s from seq,
+	// regardless of ts
+	hb := func(seq interface{}) mock.SQLResult {
+		now := time.Now()
+		return mock.SQLResult{
+			Columns: []string{"NOW(3)", "ts", "freq", "src_id", "1", "seq"},
+			Rows:    [][]driver.Value{{now, now.Add(-500 * time.Millisecond), int64(1000), "source1", int64(1), seq}},
+		}
+	}
+	opts := map[string]string{
+		OPT_WRITER:            LAG_WRITER_BLIP,
+		OPT_HEARTBEAT_SEQ_COL: "seq",
+		OPT_HEARTBEAT_SEQ_DSN: "blip@tcp(source1:3306)/",
+		OPT_NETWORK_LATENCY:   "0",
+	}
+	collect := func(c *Lag, expect float64) blip.MetricValue {
+		t.Helper()
+		var m blip.MetricValue
+		waitFor(t, func() bool {
+			metrics, err := c.Collect(context.Background(), "kpi")
+			require.NoError(t, err)
+			if len(metrics) == 0 {
+				return false
+			}
+			m = metrics[0]
+			return m.Value == expect
+		})
+		return m
+	}
+
+	replica := mock.NewSQL(map[string]mock.SQLResult{
+		"heartbeat":                             hb(int64(100)),
+		"`seq` FROM `blip`.`heartbeat` LIMIT 0": {Columns: []string{"seq"}},
+	})
+	source := mock.NewSQL(map[string]mock.SQLResult{
+		"src_id='source1'": {Columns: []string{"seq"}, Rows: [][]driver.Value{{int64(102)}}},
+	})
+	var gotDSN string
+	var srcDB *sql.DB
+	c := NewLag(replica.DB())
+	c.openDB = func(dsn string) (*sql.DB, error) {
+		gotDSN = dsn
+		srcDB = source.DB()
+		return srcDB, nil
+	}
+	cleanup, err := c.Prepare(context.Background(), lagPlan(opts))
+	require.NoError(t, err)
+	assert.Equal(t, "blip@tcp(source1:3306)/", gotDSN)
+	m := collect(c, 2000)
+	assert.Equal(t, map[string]string{"source": "source1", "lag_from": "seq"}, m.Meta)
+	cleanup()
+	assert.Error(t, srcDB.Ping(), "source DB not closed by cleanup")
+
+	// Replica seq NULL: lag from ts
+	replica.Set("heartbeat", hb(nil))
+	c = NewLag(replica.DB())
+	c.openDB = func(dsn string) (*sql.DB, error) { return source.DB(), nil }
+	cleanup, err = c.Prepare(context.Background(), lagPlan(opts))
+	require.NoError(t, err)
+	m = collect(c, 500)
+	assert.Equal(t, map[string]string{"source": "source1"}, m.Meta)
+	cleanup()
+
+	// heartbeat-seq-dsn required
+	_, err = NewLag(replica.DB()).Prepare(context.Background(), lagPlan(map[string]string{
+		OPT_WRITER:            LAG_WRITER_BLIP,
+		OPT_HEARTBEAT_SEQ_COL: "seq",
+	}))
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), OPT_HEARTBEAT_SEQ_DSN)
+}
+
+func TestPlanLabels(t *testing.T) {
+	r := &fakeReader{lag: heartbeat.Lag{Milliseconds: 250, SourceId: "source1", Replica: true}}
+	c := NewLagWithReader(mock.NewSQL(nil).DB(), r)
+	plan := lagPlan(map[string]string{
+		OPT_WRITER:             LAG_WRITER_BLIP,
+		OPT_REPORT_WRITER:      "yes",
+		OPT_REPORT_COLLECT_AGE: "yes",
+	})
+	plan.Labels = map[string]string{"env": "prod", "team": "dba", "source": "label"}
+	kpi := plan.Levels["kpi"]
+	kpi.Labels = map[string]string{"team": "repl"}
+	plan.Levels["kpi"] = kpi
+	_, err := c.Prepare(context.Background(), plan)
+	require.NoError(t, err)
+	metrics, err := c.Collect(context.Background(), "kpi")
+	require.NoError(t, err)
+	require.Len(t, metrics, 3)
+	assert.Equal(t, "current", metrics[0].Name)
+	assert.Equal(t, map[string]string{"source": "source1", "env": "prod", "team": "repl"}, metrics[0].Meta) // collector Meta not overridden
+	assert.Equal(t, "writer", metrics[1].Name)
+	assert.Equal(t, map[string]string{"writer": LAG_WRITER_BLIP, "env": "prod", "team": "repl", "source": "label"}, metrics[1].Meta)
+	assert.Equal(t, "last_collect_age", metrics[2].Name)
+	assert.Equal(t, map[string]string{"env": "prod", "team": "repl", "source": "label"}, metrics[2].Meta)
+
+	// No labels (default): Meta not changed
+	c = NewLagWithReader(mock.NewSQL(nil).DB(), r)
+	_, err = c.Prepare(context.Background(), lagPlan(map[string]string{OPT_WRITER: LAG_WRITER_BLIP}))
+	require.NoError(t, err)
+	metrics, err = c.Collect(context.Background(), "kpi")
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"source": "source1"}, metrics[0].Meta)
+}
+
+func TestCollectWhen(t *testing.T) {
+	gate := func(v driver.Value) mock.SQLResult {
+		return mock.SQLResult{Columns: []string{"@@blip_collect_lag"}, Rows: [][]driver.Value{{v}}}
+	}
+	m := mock.NewSQL(map[string]mock.SQLResult{
+		"SELECT @@blip_collect_lag": gate("ON"),
+	})
+	r := &fakeReader{lag: heartbeat.Lag{Milliseconds: 250, SourceId: "source1", Replica: true}}
+	c := NewLagWithReader(m.DB(), r)
+	_, err := c.Prepare(context.Background(), lagPlan(map[string]string{
+		OPT_WRITER:       LAG_WRITER_BLIP,
+		OPT_COLLECT_WHEN: "blip_collect_lag",
+	}))
+	require.NoError(t, err)
+	expect := []blip.MetricValue{{Name: "current", Type: blip.GAUGE, Value: 250, Meta: map[string]string{"source": "source1"}}}
+
+	// Gate true: collects
+	for _, v := range []driver.Value{"ON", "1", int64(1), "true", "YES"} {
+		m.Set("SELECT @@blip_collect_lag", gate(v))
+		metrics, err := c.Collect(context.Background(), "kpi")
+		require.NoError(t, err)
+		assert.Equal(t, expect, metrics, "gate %v", v)
+	}
+
+	// Gate false: drops (nothing collected, intentionally)
+	for _, v := range []driver.Value{"OFF", "0", int64(0), "", nil} {
+		m.Set("SELECT @@blip_collect_lag", gate(v))
+		metrics, err := c.Collect(context.Background(), "kpi")
+		require.ErrorIs(t, err, blip.ErrNoMetrics)
+		assert.Empty(t, metrics, "gate %v", v)
+	}
+	assert.Equal(t, 10, m.Count("@@blip_collect_lag"))
+
+	// Gate error: Collect error
+	m.Set("SELECT @@blip_collect_lag", mock.SQLResult{Err: fmt.Errorf("unknown system variable")})
+	_, err = c.Collect(context.Background(), "kpi")
+	assert.ErrorContains(t, err, OPT_COLLECT_WHEN)
+
+	// User variable
+	m = mock.NewSQL(map[string]mock.SQLResult{
+		"SELECT @collect": {Columns: []string{"@collect"}, Rows: [][]driver.Value{{int64(0)}}},
+	})
+	c = NewLagWithReader(m.DB(), r)
+	_, err = c.Prepare(context.Background(), lagPlan(map[string]string{
+		OPT_WRITER:       LAG_WRITER_BLIP,
+		OPT_COLLECT_WHEN: "@collect",
+	}))
+	require.NoError(t, err)
+	metrics, err := c.Collect(context.Background(), "kpi")
+	require.ErrorIs(t, err, blip.ErrNoMetrics)
+	assert.Empty(t, metrics)
+
+	// Invalid variable
+	c = NewLagWithReader(m.DB(), r)
+	_, err = c.Prepare(context.Background(), lagPlan(map[string]string{
+		OPT_WRITER:       LAG_WRITER_BLIP,
+		OPT_COLLECT_WHEN: "1; DROP TABLE t",
+	}))
+	assert.ErrorContains(t, err, "invalid "+OPT_COLLECT_WHEN)
+}
+
+func TestChannelOrder(t *testing.T) {
+	uuid := "3e11fa47-71ca-11e1-9e33-c80aa9429562"
+	row := func(channel string) []driver.Value {
+		return []driver.Value{channel, uuid + ":100", "ON", "ON", uuid + ":100", int64(1), uuid + ":100",
+			1716922200.0, 1716922199.0, 1000.0, nil, "db1", uuid}
+	}
+	m := mock.NewSQL(map[string]mock.SQLResult{
+		"replication_applier_status_by_worker": pfsResult(row("ch3"), row("ch1"), row("ch4"), row("ch2")),
+	})
+	c := NewLag(m.DB())
+	_, err := c.Prepare(context.Background(), lagPlan(map[string]string{OPT_WRITER: LAG_WRITER_PFS}))
+	require.NoError(t, err)
+
+	// Every collection: sorted by channel, and metrics per channel in the same order
+	var first []string
+	for i := 0; i < 20; i++ {
+		metrics, err := c.Collect(context.Background(), "kpi")
+		require.NoError(t, err)
+		var got []string
+		for _, m := range metrics {
+			got = append(got, m.Group["channel"]+"/"+m.Name)
+		}
+		if first == nil {
+			first = got
+			assert.Equal(t, []string{
+				"ch1/current", "ch1/backlog", "ch1/worker_usage",
+				"ch2/current", "ch2/backlog", "ch2/worker_usage",
+				"ch3/current", "ch3/backlog", "ch3/worker_usage",
+				"ch4/current", "ch4/backlog", "ch4/worker_usage",
+			}, got)
+			continue
+		}
+		require.Equal(t, first, got, "collection %d", i)
+	}
+}
+
+func TestHeartbeatKey(t *testing.T) {
+	pk := func(cols ...string) mock.SQLResult {
+		res := mock.SQLResult{Columns: []string{"COLUMN_NAME"}}
+		for _, col := range cols {
+			res.Rows = append(res.Rows, []driver.Value{col})
+		}
+		return res
+	}
+
+	// Composite primary key (src_id, shard): reads the shard row
+	m := mock.NewSQL(map[string]mock.SQLResult{
+		"KEY_COLUMN_USAGE": pk("src_id", "shard"),
+		"heartbeat":        heartbeatResult("source1", 100*time.Millisecond),
+		"`shard`='3'":      heartbeatResult("source1", 1300*time.Millisecond),
+	})
+	c := NewLag(m.DB())
+	cleanup, err := c.Prepare(context.Background(), lagPlan(map[string]string{
+		OPT_WRITER:          LAG_WRITER_BLIP,
+		OPT_HEARTBEAT_KEY:   "shard=3",
+		OPT_NETWORK_LATENCY: "0",
+	}))
+	require.NoError(t, err)
+	waitFor(t, func() bool {
+		metrics, err := c.Collect(context.Background(), "kpi")
+		require.NoError(t, err)
+		return len(metrics) > 0 && metrics[0].Value == 300 // 1.3s - 1s freq: late
+	})
+	cleanup()
+
+	// Key column not set: error
+	m = mock.NewSQL(map[string]mock.SQLResult{
+		"KEY_COLUMN_USAGE": pk("src_id", "shard", "region"),
+		"heartbeat":        heartbeatResult("source1", 0),
+	})
+	c = NewLag(m.DB())
+	_, err = c.Prepare(context.Background(), lagPlan(map[string]string{
+		OPT_WRITER:        LAG_WRITER_BLIP,
+		OPT_HEARTBEAT_KEY: "shard=3",
+	}))
+	assert.ErrorContains(t, err, "primary key columns of blip.heartbeat not set: region")
+
+	// Not set (default): primary key not checked
+	m = mock.NewSQL(map[string]mock.SQLResult{
+		"heartbeat": heartbeatResult("source1", 0),
+	})
+	c = NewLag(m.DB())
+	cleanup, err = c.Prepare(context.Background(), lagPlan(map[string]string{OPT_WRITER: LAG_WRITER_BLIP}))
+	require.NoError(t, err)
+	cleanup()
+	assert.Equal(t, 0, m.Count("KEY_COLUMN_USAGE"))
+
+	// Parse
+	key, err := parseHeartbeatKey(" shard = 3, region=us-east ")
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"shard": "3", "region": "us-east"}, key)
+	for _, bad := range []string{"shard", "=3", "shard=3,shard=4", "`s`=1"} {
+		_, err = parseHeartbeatKey(bad)
+		assert.Error(t, err, bad)
+	}
+}
+
+func TestRedactOptions(t *testing.T) {
+	tl := &testLogger{msgs: map[string][]string{}}
+	Log = tl
+	defer func() { Log = DebugLogger{} }()
+
+	// Secret interpolated into source-dsn, like from an env var
+	src := mock.NewSQL(map[string]mock.SQLResult{
+		"heartbeat": heartbeatResult("source1", 0),
+	})
+	c := NewLag(mock.NewSQL(nil).DB())
+	c.openDB = func(dsn string) (*sql.DB, error) { return src.DB(), nil }
+	cleanup, err := c.Prepare(context.Background(), lagPlan(map[string]string{
+		OPT_WRITER:          LAG_WRITER_BLIP,
+		OPT_SOURCE_DSN:      "blip:s3cr3t@tcp(source1:3306)/",
+		OPT_HEARTBEAT_TABLE: "hb.heartbeat",
+	}))
+	require.NoError(t, err)
+	defer cleanup()
+
+	tl.Lock()
+	var dump string
+	for _, msg := range tl.msgs["debug"] {
+		assert.NotContains(t, msg, "s3cr3t")
+		if strings.Contains(msg, "options:") {
+			dump = msg
+		}
+	}
+	tl.Unlock()
+	assert.Contains(t, dump, OPT_SOURCE_DSN+":"+blip.REDACTED)
+	assert.Contains(t, dump, OPT_HEARTBEAT_TABLE+":hb.heartbeat") // not sensitive
+
+	cfg := c.ActiveConfig()
+	assert.Equal(t, blip.REDACTED, cfg["kpi"][OPT_SOURCE_DSN])
+	assert.Equal(t, "hb.heartbeat", cfg["kpi"][OPT_HEARTBEAT_TABLE])
+
+	// Help marks DSN options sensitive
+	help := c.Help()
+	assert.True(t, help.Options[OPT_SOURCE_DSN].Sensitive)
+	assert.True(t, help.Options[OPT_PFS_DSN].Sensitive)
+}
+
+func TestLagProc(t *testing.T) {
+	// Fake procedure like mysql.rds_replica_status: a first result set without
+	// the lag column, then replica status with the lag column
+	procResult := func(lag driver.Value) mock.SQLResult {
+		return mock.SQLResult{
+			Columns: []string{"Message"},
+			Rows:    [][]driver.Value{{"replica status"}},
+			More: []mock.SQLResult{{
+				Columns: []string{"Replica_IO_State", "Source_Host", "Seconds_Behind_Source"},
+				Rows:    [][]driver.Value{{"Waiting for source", "db1", lag}},
+			}},
+		}
+	}
+	m := mock.NewSQL(map[string]mock.SQLResult{
+		"CALL `mysql`.`rds_replica_status`()": procResult(int64(3)),
+	})
+	c := NewLag(m.DB())
+	_, err := c.Prepare(context.Background(), lagPlan(map[string]string{
+		OPT_WRITER:   LAG_WRITER_PROC,
+		OPT_LAG_PROC: "mysql.rds_replica_status",
+	}))
+	require.NoError(t, err)
+	metrics, err := c.Collect(context.Background(), "kpi")
+	require.NoError(t, err)
+	assert.Equal(t, []blip.MetricValue{{Name: "current", Type: blip.GAUGE, Value: 3000}}, metrics)
+
+	// NULL lag (SQL thread not running): no heartbeat, dropped by default
+	m.Set("CALL `mysql`.`rds_replica_status`()", procResult(nil))
+	metrics, err = c.Collect(context.Background(), "kpi")
+	require.NoError(t, err)
+	assert.Empty(t, metrics)
+
+	// Custom column in milliseconds, matched case-insensitively
+	m.Set("CALL `lag_ms`()", mock.SQLResult{
+		Columns: []string{"LAG_MS"},
+		Rows:    [][]driver.Value{{"250"}},
+	})
+	c = NewLag(m.DB())
+	_, err = c.Prepare(context.Background(), lagPlan(map[string]string{
+		OPT_WRITER:          LAG_WRITER_PROC,
+		OPT_LAG_PROC:        "lag_ms",
+		OPT_LAG_PROC_COLUMN: "lag_ms",
+		OPT_LAG_PROC_UNIT:   UNIT_MS,
+	}))
+	require.NoError(t, err)
+	metrics, err = c.Collect(context.Background(), "kpi")
+	require.NoError(t, err)
+	assert.Equal(t, []blip.MetricValue{{Name: "current", Type: blip.GAUGE, Value: 250}}, metrics)
+
+	// No result set has the column: not a replica
+	m.Set("CALL `mysql`.`rds_replica_status`()", mock.SQLResult{
+		Columns: []string{"Message"},
+		Rows:    [][]driver.Value{{"not a replica"}},
+	})
+	c = NewLag(m.DB())
+	_, err = c.Prepare(context.Background(), lagPlan(map[string]string{
+		OPT_WRITER:               LAG_WRITER_PROC,
+		OPT_LAG_PROC:             "mysql.rds_replica_status",
+		OPT_REPORT_NOT_A_REPLICA: "yes",
+	}))
+	require.NoError(t, err)
+	metrics, err = c.Collect(context.Background(), "kpi")
+	require.NoError(t, err)
+	assert.Equal(t, []blip.MetricValue{{Name: "current", Type: blip.GAUGE, Value: -1}}, metrics)
+
+	// Invalid options
+	for _, opts := range []map[string]string{
+		{OPT_WRITER: LAG_WRITER_PROC},
+		{OPT_WRITER: LAG_WRITER_PROC, OPT_LAG_PROC: "mysql.rds_replica_status(); DROP TABLE t"},
+		{OPT_WRITER: LAG_WRITER_PROC, OPT_LAG_PROC: "a.b.c"},
+		{OPT_WRITER: LAG_WRITER_PROC, OPT_LAG_PROC: "lag_ms", OPT_LAG_PROC_UNIT: "us"},
+	} {
+		c = NewLag(m.DB())
+		_, err = c.Prepare(context.Background(), lagPlan(opts))
+		assert.Error(t, err, "%v", opts)
+	}
+}
+
+func TestReadInterval(t *testing.T) {
+	// Heartbeat is late, so the reader would read every 50ms, but read-interval
+	// limits it to one read per 200ms
+	m := mock.NewSQL(map[string]mock.SQLResult{
+		"heartbeat": heartbeatResult("source1", 1100*time.Millisecond),
+	})
+	c := NewLag(m.DB())
+	cleanup, err := c.Prepare(context.Background(), lagPlan(map[string]string{
+		OPT_WRITER:          LAG_WRITER_BLIP,
+		OPT_READ_INTERVAL:   "200ms",
+		OPT_NETWORK_LATENCY: "0",
+	}))
+	require.NoError(t, err)
+	time.Sleep(500 * time.Millisecond)
+	metrics, err := c.Collect(context.Background(), "kpi")
+	cleanup()
+	require.NoError(t, err)
+	require.Len(t, metrics, 1)
+	assert.Equal(t, float64(100), metrics[0].Value) // last lag between reads
+	n := m.Count("NOW(3)")
+	assert.True(t, n >= 2 && n <= 4, "got %d heartbeat reads in 500ms, expected 2-4", n)
+
+	// Different read-interval: different reader
+	assert.NotEqual(t,
+		readerKey(map[string]string{OPT_READ_INTERVAL: "200ms"}),
+		readerKey(map[string]string{OPT_READ_INTERVAL: "1s"}),
+	)
+
+	// Invalid
+	for _, v := range []string{"1", "0s", "-1s", "soon"} {
+		_, err := NewLag(m.DB()).Prepare(context.Background(), lagPlan(map[string]string{
+			OPT_WRITER:        LAG_WRITER_BLIP,
+			OPT_READ_INTERVAL: v,
+		}))
+		assert.Error(t, err, v)
+	}
+}
+
+func TestSourceRoles(t *testing.T) {
+	// Intermediate reads lag relative to two upstream roles: one reader per
+	// role, and current per role with meta source_role
+	m := mock.NewSQL(map[string]mock.SQLResult{
+		"src_role='primary'":  heartbeatResult("source1", 1200*time.Millisecond),
+		"src_role='regional'": heartbeatResult("source2", 1500*time.Millisecond),
+	})
+	c := NewLag(m.DB())
+	cleanup, err := c.Prepare(context.Background(), lagPlan(map[string]string{
+		OPT_WRITER:                LAG_WRITER_BLIP,
+		OPT_HEARTBEAT_SOURCE_ROLE: "primary, regional",
+		OPT_NETWORK_LATENCY:       "0",
+	}))
+	require.NoError(t, err)
+	defer cleanup()
+	require.Len(t, c.lagReaders, 2)
+
+	expect := []blip.MetricValue{
+		{Name: "current", Type: blip.GAUGE, Value: 200, Meta: map[string]string{"source": "source1", "source_role": "primary"}},
+		{Name: "current", Type: blip.GAUGE, Value: 500, Meta: map[string]string{"source": "source2", "source_role": "regional"}},
+	}
+	var metrics []blip.MetricValue
+	waitFor(t, func() bool {
+		metrics, err = c.Collect(context.Background(), "kpi")
+		require.NoError(t, err)
+		return len(metrics) == 2 && metrics[0].Value == 200 && metrics[1].Value == 500
+	})
+	assert.Equal(t, expect, metrics)
+
+	// One role: no meta source_role (unchanged)
+	c = NewLag(m.DB())
+	cleanup2, err := c.Prepare(context.Background(), lagPlan(map[string]string{
+		OPT_WRITER:                LAG_WRITER_BLIP,
+		OPT_HEARTBEAT_SOURCE_ROLE: "primary",
+		OPT_NETWORK_LATENCY:       "0",
+	}))
+	require.NoError(t, err)
+	defer cleanup2()
+	require.Len(t, c.lagReaders, 1)
+	waitFor(t, func() bool {
+		metrics, err = c.Collect(context.Background(), "kpi")
+		require.NoError(t, err)
+		return len(metrics) == 1 && metrics[0].Value == 200
+	})
+	assert.Equal(t, map[string]string{"source": "source1"}, metrics[0].Meta)
+}
+
+func TestClampNegative(t *testing.T) {
+	// Replica clock is ahead: 100ms lag minus 150ms clock offset is -50ms
+	for _, clamp := range []string{"yes", "no"} {
+		r := &fakeReader{lag: heartbeat.Lag{Milliseconds: 100, SourceId: "source1", Replica: true}}
+		c := NewLagWithReader(mock.NewSQL(nil).DB(), r)
+		_, err := c.Prepare(context.Background(), lagPlan(map[string]string{
+			OPT_WRITER:         LAG_WRITER_BLIP,
+			OPT_CLOCK_OFFSET:   "150",
+			OPT_CLAMP_NEGATIVE: clamp,
+		}))
+		require.NoError(t, err, clamp)
+		metrics, err := c.Collect(context.Background(), "kpi")
+		require.NoError(t, err, clamp)
+		require.Len(t, metrics, 1, clamp)
+		if clamp == "yes" {
+			assert.Equal(t, float64(0), metrics[0].Value)
+			assert.Equal(t, "-50", metrics[0].Meta["raw_lag_ms"])
+		} else {
+			assert.Equal(t, float64(-50), metrics[0].Value)
+			assert.NotContains(t, metrics[0].Meta, "raw_lag_ms")
+		}
+	}
+}
+
+func TestProbeWriters(t *testing.T) {
+	// PFS works (not a replica is not an error), but the Blip heartbeat table
+	// doesn't exist
+	m := mock.NewSQL(map[string]mock.SQLResult{
+		"replication_applier_status_by_worker": pfsResult(),
+		"replication_connection_status":        {},
+		"heartbeat":                            {Err: &mysql.MySQLError{Number: 1146, Message: "Table 'blip.heartbeat' doesn't exist"}},
+	})
+	c := NewLag(m.DB())
+	_, err := c.Prepare(context.Background(), lagPlan(map[string]string{OPT_WRITER: LAG_WRITER_PFS}))
+	require.NoError(t, err)
+
+	status := c.ProbeWriters(context.Background(), map[string]string{OPT_WRITER: LAG_WRITER_PFS})
+	assert.Len(t, status, len(Writers()))
+	assert.NoError(t, status[LAG_WRITER_PFS])
+	assert.ErrorContains(t, status[LAG_WRITER_BLIP], "1146")
+	assert.Error(t, status[LAG_WRITER_PROXYSQL])
+	assert.Error(t, status[LAG_WRITER_PROC]) // lag-proc not set
+
+	// Collector not changed
+	assert.Equal(t, LAG_WRITER_PFS, c.lagWriterIn["kpi"])
+	assert.NotContains(t, c.lagWriterIn, probeLevel)
+	assert.Empty(t, c.lagReaders)
+}
+
+func TestLevelMetrics(t *testing.T) {
+	// Only current at 1s, but current and trend at 30s, and all metrics at 60s
+	r := &fakeReader{lag: heartbeat.Lag{Milliseconds: 500, SourceId: "source1", Replica: true}}
+	c := NewLagWithReader(mock.NewSQL(nil).DB(), r)
+	opts := map[string]string{
+		OPT_WRITER:        LAG_WRITER_BLIP,
+		OPT_REPORT_TREND:  "yes",
+		OPT_REPORT_WRITER: "yes",
+	}
+	plan := blip.Plan{
+		Name:      "test",
+		MonitorId: "m1",
+		Levels: map[string]blip.Level{
+			"1s": {
+				Name:    "1s",
+				Freq:    "1s",
+				Collect: map[string]blip.Domain{DOMAIN: {Name: DOMAIN, Metrics: []string{"current"}, Options: opts}},
+			},
+			"30s": {
+				Name:    "30s",
+				Freq:    "30s",
+				Collect: map[string]blip.Domain{DOMAIN: {Name: DOMAIN, Metrics: []string{"current", "repl.lag.trend"}, Options: opts}},
+			},
+			"60s": {
+				Name:    "60s",
+				Freq:    "60s",
+				Collect: map[string]blip.Domain{DOMAIN: {Name: DOMAIN, Options: opts}},
+			},
+		},
+	}
+	now := time.Now()
+	c.Now = func() time.Time { return now }
+	_, err := c.Prepare(context.Background(), plan)
+	require.NoError(t, err)
+	for _, levelName := range []string{"1s", "30s", "60s"} {
+		_, err = c.Collect(context.Background(), levelName) // first sample for trend
+		require.NoError(t, err)
+	}
+	now = now.Add(time.Second)
+	r.lag.Milliseconds = 700
+
+	names := func(levelName string) []string {
+		metrics, err := c.Collect(context.Background(), levelName)
+		require.NoError(t, err, levelName)
+		var names []string
+		for _, m := range metrics {
+			names = append(names, m.Name)
+		}
+		return names
+	}
+	assert.Equal(t, []string{"current"}, names("1s"))
+	assert.Equal(t, []string{"current", "trend"}, names("30s"))
+	assert.Equal(t, []string{"current", "trend", "writer"}, names("60s"))
+
+	// State is not filtered: writer is reported, too
+	s, err := c.State(context.Background(), "1s")
+	require.NoError(t, err)
+	assert.Len(t, s.MetricValues(), 2)
+}
+
+func TestReportAggregate(t *testing.T) {
+	// Two channels lagging 1s and 3s: aggregate current with channel _all_
+	uuid := "3e11fa47-71ca-11e1-9e33-c80aa9429562"
+	row := func(channel string, lag float64) []driver.Value { // applying a trx for lag seconds
+		return []driver.Value{channel, uuid + ":100", "ON", "ON", uuid + ":100", int64(1), uuid + ":99",
+			1716922200.0, 1716922190.0, 0.0, 1716922200.0 - lag, "db1", uuid}
+	}
+	m := mock.NewSQL(map[string]mock.SQLResult{
+		"replication_applier_status_by_worker": pfsResult(row("ch1", 1), row("ch2", 3)),
+	})
+	tests := []struct {
+		reducer string
+		expect  float64
+	}{
+		{"yes", 3000},
+		{AGGREGATE_MAX, 3000},
+		{AGGREGATE_MIN, 1000},
+		{AGGREGATE_SUM, 4000},
+		{AGGREGATE_AVG, 2000},
+	}
+	for _, tc := range tests {
+		c := NewLag(m.DB())
+		_, err := c.Prepare(context.Background(), lagPlan(map[string]string{
+			OPT_WRITER:           LAG_WRITER_PFS,
+			OPT_REPORT_AGGREGATE: tc.reducer,
+		}))
+		require.NoError(t, err, tc.reducer)
+		metrics, err := c.Collect(context.Background(), "kpi")
+		require.NoError(t, err, tc.reducer)
+		current := map[string]float64{}
+		var agg blip.MetricValue
+		for _, m := range metrics {
+			if m.Name != "current" {
+				continue
+			}
+			current[m.Group["channel"]] = m.Value
+			if m.Meta["channel"] == AGGREGATE_CHANNEL {
+				agg = m
+			}
+		}
+		assert.Equal(t, map[string]float64{"ch1": 1000, "ch2": 3000, AGGREGATE_CHANNEL: tc.expect}, current, tc.reducer)
+		assert.Equal(t, map[string]string{"channel": AGGREGATE_CHANNEL}, agg.Group, tc.reducer)
+	}
+
+	// Disabled by default
+	c := NewLag(m.DB())
+	_, err := c.Prepare(context.Background(), lagPlan(map[string]string{OPT_WRITER: LAG_WRITER_PFS}))
+	require.NoError(t, err)
+	metrics, err := c.Collect(context.Background(), "kpi")
+	require.NoError(t, err)
+	for _, m := range metrics {
+		assert.NotEqual(t, AGGREGATE_CHANNEL, m.Group["channel"])
+	}
+
+	// min: best of three channels; absent value (ch3 not a replica) ignored
+	metrics = []blip.MetricValue{
+		{Name: "current", Value: 5000, Group: map[string]string{"channel": "ch1"}},
+		{Name: "current", Value: 250, Group: map[string]string{"channel": "ch2"}},
+		{Name: "current", Value: math.NaN(), Group: map[string]string{"channel": "ch3"}},
+		{Name: "backlog", Value: 10, Group: map[string]string{"channel": "ch2"}},
+		{Name: "current", Value: 1200, Group: map[string]string{"channel": "ch4"}},
+	}
+	agg, ok := aggregate(metrics, AGGREGATE_MIN)
+	require.True(t, ok)
+	assert.Equal(t, float64(250), agg.Value)
+	assert.Equal(t, AGGREGATE_MIN, agg.Meta["aggregate"])
+
+	// Invalid
+	for _, reducer := range []string{"median", "MIN", "p99"} {
+		_, err = NewLag(m.DB()).Prepare(context.Background(), lagPlan(map[string]string{
+			OPT_WRITER:           LAG_WRITER_PFS,
+			OPT_REPORT_AGGREGATE: reducer,
+		}))
+		assert.Error(t, err, reducer)
+	}
+}
+
+func TestDiagnosticDump(t *testing.T) {
+	m := mock.NewSQL(map[string]mock.SQLResult{
+		"replication_connection_status": {
+			Columns: []string{"CHANNEL_NAME", "SERVICE_STATE"},
+			Rows:    [][]driver.Value{{"", "ON"}},
+		},
+		"replication_applier_status_by_worker": {
+			Columns: []string{"CHANNEL_NAME", "WORKER_ID", "SERVICE_STATE"},
+			Rows:    [][]driver.Value{{"", "1", "ON"}, {"", "2", "ON"}},
+		},
+	})
+	r := &fakeReader{lag: heartbeat.Lag{Milliseconds: 0, SourceId: "source1", Replica: true}}
+	c := NewLagWithReader(m.DB(), r)
+	now := time.Date(2024, 5, 28, 12, 0, 0, 0, time.UTC)
+	c.Now = func() time.Time { return now }
+	_, err := c.Prepare(context.Background(), lagPlan(map[string]string{
+		OPT_WRITER:    LAG_WRITER_BLIP,
+		OPT_DIAG_DUMP: "yes",
+	}))
+	require.NoError(t, err)
+
+	// Collect lag, return diagnostic_dump metrics
+	collect := func(lag int64) []blip.MetricValue {
+		r.lag.Milliseconds = lag
+		now = now.Add(time.Second)
+		metrics, err := c.Collect(context.Background(), "kpi")
+		require.NoError(t, err)
+		var dumps []blip.MetricValue
+		for _, m := range metrics {
+			if m.Name == "diagnostic_dump" {
+				dumps = append(dumps, m)
+			}
+		}
+		return dumps
+	}
+
+	// Small changes are not jumps
+	for _, lag := range []int64{0, 500, 1000, 0, 2000} {
+		assert.Empty(t, collect(lag))
+	}
+	assert.Equal(t, 0, m.Count("replication_connection_status"))
+
+	// Oscillating between 0 and 100s: 3rd jump is an anomaly, dump fires once
+	assert.Empty(t, collect(100000)) // 1st jump
+	assert.Empty(t, collect(0))      // 2nd jump
+	dumps := collect(100000)         // 3rd jump
+	require.Len(t, dumps, 1)
+	assert.Equal(t, float64(3), dumps[0].Value) // 1 + 2 rows
+	assert.Equal(t, "3 jumps >= 60000 ms in last 10 collections", dumps[0].Meta["anomaly"])
+	assert.Equal(t, `[{"CHANNEL_NAME":"","SERVICE_STATE":"ON"}]`, dumps[0].Meta["connection_status"])
+	assert.Contains(t, dumps[0].Meta["applier_workers"], `"WORKER_ID":"2"`)
+	assert.Equal(t, 1, m.Count("replication_connection_status"))
+
+	// Still oscillating, but rate limited (diagnostic-dump-interval=1h)
+	for i := 0; i < 10; i++ {
+		assert.Empty(t, collect(int64(i%2)*100000))
+	}
+	assert.Equal(t, 1, m.Count("replication_connection_status"))
+
+	// After the interval, still oscillating: dump again; query error in meta
+	m.Set("replication_applier_status_by_worker", mock.SQLResult{Err: fmt.Errorf("access denied")})
+	now = now.Add(time.Hour)
+	dumps = collect(0)
+	require.Len(t, dumps, 1)
+	assert.Equal(t, float64(1), dumps[0].Value)
+	assert.Contains(t, dumps[0].Meta["applier_workers_error"], "access denied")
+	assert.Equal(t, 2, m.Count("replication_connection_status"))
+
+	// Values cleared after a dump: lag settles, no new anomaly
+	now = now.Add(time.Hour)
+	for _, lag := range []int64{100000, 0, 0, 0} {
+		assert.Empty(t, collect(lag))
+	}
+	assert.Equal(t, 2, m.Count("replication_connection_status"))
+
+	// Invalid options
+	for _, opts := range []map[string]string{
+		{OPT_DIAG_DUMP: "yes", OPT_DIAG_DUMP_THRESHOLD: "0"},
+		{OPT_DIAG_DUMP: "yes", OPT_DIAG_DUMP_INTERVAL: "often"},
+	} {
+		opts[OPT_WRITER] = LAG_WRITER_BLIP
+		_, err := NewLagWithReader(m.DB(), r).Prepare(context.Background(), lagPlan(opts))
+		assert.Error(t, err, opts)
+	}
+}
+
+func TestHeartbeatPrecision(t *testing.T) {
+	// Precision of column ts: NOW is read with the same precision and reported
+	// as meta heartbeat_precision
+	for _, precision := range []int{0, 3, 6} {
+		nowCol := fmt.Sprintf("NOW(%d)", precision)
+		now := time.Now()
+		m := mock.NewSQL(map[string]mock.SQLResult{
+			"information_schema.COLUMNS": {
+				Columns: []string{"DATETIME_PRECISION"},
+				Rows:    [][]driver.Value{{int64(precision)}},
+			},
+			"heartbeat": {
+				Columns: []string{nowCol, "ts", "freq", "src_id", "1"},
+				Rows:    [][]driver.Value{{now, now.Add(-500 * time.Millisecond), int64(1000), "source1", int64(1)}},
+			},
+		})
+		c := NewLag(m.DB())
+		cleanup, err := c.Prepare(context.Background(), lagPlan(map[string]string{
+			OPT_WRITER:          LAG_WRITER_BLIP,
+			OPT_NETWORK_LATENCY: "0",
+		}))
+		require.NoError(t, err)
+		var metrics []blip.MetricValue
+		waitFor(t, func() bool {
+			metrics, err = c.Collect(context.Background(), "kpi")
+			require.NoError(t, err)
+			return len(metrics) > 0 && metrics[0].Value == 500
+		})
+		cleanup()
+		require.NotEmpty(t, metrics)
+		assert.Equal(t, map[string]string{"source": "source1", "heartbeat_precision": strconv.Itoa(precision)}, metrics[0].Meta, "DATETIME(%d)", precision)
+		assert.True(t, strings.HasPrefix(c.EffectiveQueries()["kpi/blip"], "SELECT "+nowCol+", ts"), "DATETIME(%d): %s", precision, c.EffectiveQueries()["kpi/blip"])
+	}
+
+	// Epoch format: precision not read, no meta
+	m := mock.NewSQL(map[string]mock.SQLResult{
+		"heartbeat": {
+			Columns: []string{"UNIX_TIMESTAMP(NOW(6))", "ts", "freq", "src_id", "1"},
+			Rows:    [][]driver.Value{{time.Now().UnixMicro(), time.Now().Add(-2 * time.Second).UnixMilli(), int64(1000), "source1", int64(1)}},
+		},
+	})
+	c := NewLag(m.DB())
+	cleanup, err := c.Prepare(context.Background(), lagPlan(map[string]string{
+		OPT_WRITER:              LAG_WRITER_BLIP,
+		OPT_HEARTBEAT_TS_FORMAT: heartbeat.TS_FORMAT_EPOCH_MS,
+	}))
+	require.NoError(t, err)
+	defer cleanup()
+	assert.Equal(t, 0, m.Count("information_schema.COLUMNS"))
+}
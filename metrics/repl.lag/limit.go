@@ -0,0 +1,61 @@
+// Copyright 2024 Block, Inc.
+
+package repllag
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/cashapp/blip/sqlutil"
+)
+
+// This file handles option max-concurrent-queries. Heavy lag queries (like
+// Performance Schema) running at the same time as other heavy collectors (like
+// size.data) on the same instance can saturate the connection pool. A limiter
+// bounds concurrent queries: Collect waits for a slot (until the collection
+// times out) before querying, so lag collection yields under contention. The
+// limiter is shared per monitor (sqlutil.SharedLimiter keyed on monitor ID), so
+// other collectors can use the same limiter. The Prepare cleanup releases it
+// (releaseLimiters).
+
+// queryLimiter returns the limiter for the level: the NewLagWithLimiter limiter,
+// else the monitor limiter if option max-concurrent-queries is set, else nil.
+// It also returns the monitor limiter key, else "", to release the monitor
+// limiter on cleanup.
+func (c *Lag) queryLimiter(monitorId, max string) (*sqlutil.Limiter, string, error) {
+	if max == "" {
+		return c.limiter, "", nil
+	}
+	n, err := strconv.Atoi(max)
+	if err != nil || n < 1 {
+		return nil, "", fmt.Errorf("invalid %s: %q: must be an integer greater than 0", OPT_MAX_CONCURRENT, max)
+	}
+	if c.limiter != nil {
+		Log.Warn("repl.lag: %s ignored: limiter from NewLagWithLimiter", OPT_MAX_CONCURRENT)
+		return c.limiter, "", nil
+	}
+	lim, replaced := sqlutil.SharedLimiter(monitorId, n)
+	if replaced {
+		Log.Warn("repl.lag: %s=%d replaces monitor %s limiter with a different limit; collectors using the old limiter keep it until they prepare again", OPT_MAX_CONCURRENT, n, monitorId)
+	}
+	return lim, monitorId, nil
+}
+
+// hasLimitKey returns true if any level has a monitor limiter.
+func hasLimitKey(atLevel map[string]*lagLevel) bool {
+	for _, l := range atLevel {
+		if l.limitKey != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// releaseLimiters releases the monitor limiters of the levels, if any.
+func releaseLimiters(atLevel map[string]*lagLevel) {
+	for _, l := range atLevel {
+		if l.limitKey != "" {
+			sqlutil.ReleaseLimiter(l.limitKey, l.limiter)
+		}
+	}
+}
@@ -0,0 +1,37 @@
+// Copyright 2024 Block, Inc.
+
+package repllag
+
+import (
+	"github.com/cashapp/blip"
+)
+
+// Logger logs repl.lag messages. Set Log to route them to structured or leveled
+// logging. Messages and args are printf-style, like blip.Debug.
+type Logger interface {
+	Debug(msg string, v ...interface{})
+	Warn(msg string, v ...interface{})
+	Error(msg string, v ...interface{})
+}
+
+// Log is the package logger. The default, DebugLogger, prints all messages with
+// blip.Debug (only when debugging is enabled).
+var Log Logger = DebugLogger{}
+
+// DebugLogger is the default Logger that prints all messages with blip.Debug.
+// Warnings and errors are prefixed with their level.
+type DebugLogger struct{}
+
+var _ Logger = DebugLogger{}
+
+func (DebugLogger) Debug(msg string, v ...interface{}) {
+	blip.Debug(msg, v...)
+}
+
+func (DebugLogger) Warn(msg string, v ...interface{}) {
+	blip.Debug("WARN "+msg, v...)
+}
+
+func (DebugLogger) Error(msg string, v ...interface{}) {
+	blip.Debug("ERROR "+msg, v...)
+}
@@ -0,0 +1,37 @@
+// Copyright 2024 Block, Inc.
+
+package repllag
+
+import (
+	"math"
+
+	"github.com/cashapp/blip"
+)
+
+// This file handles option log-scale: for very wide lag ranges (milliseconds to
+// hours), also report repl.lag.log2 = log2(current+1) for each current series,
+// so alerts can be on order-of-magnitude changes: each +1 is double the lag.
+
+// log2Lag returns log2(ms+1). Negative lag (clock skew) is 0, so the result is
+// never negative.
+func log2Lag(ms float64) float64 {
+	if ms < 0 {
+		ms = 0
+	}
+	return math.Log2(ms + 1)
+}
+
+// log2Metrics returns metrics with log2 appended for each current series.
+// Absent current values (no heartbeat, not a replica) are skipped. Values must
+// be milliseconds.
+func log2Metrics(metrics []blip.MetricValue) []blip.MetricValue {
+	n := len(metrics)
+	for i := 0; i < n; i++ {
+		m := metrics[i]
+		if m.Name != "current" || absent(m.Value) {
+			continue
+		}
+		metrics = append(metrics, blip.MetricValue{Name: "log2", Type: blip.GAUGE, Value: log2Lag(m.Value), Group: m.Group, Meta: m.Meta})
+	}
+	return metrics
+}
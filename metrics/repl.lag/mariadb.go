@@ -0,0 +1,84 @@
+// Copyright 2024 Block, Inc.
+
+package repllag
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"strings"
+
+	"github.com/cashapp/blip"
+	"github.com/cashapp/blip/sqlutil"
+)
+
+// This file reports replication lag on MariaDB (writer=mariadb). MariaDB
+// doesn't have the MySQL 8.0 Performance Schema replication tables, so the
+// pfs writer doesn't work. Instead, SHOW ALL SLAVES STATUS returns one row per
+// replication connection (MariaDB multi-source replication), and lag is
+// Seconds_Behind_Master, which is NULL if the SQL thread isn't running. The
+// connection name (Connection_name) is the channel: the default connection is
+// an empty string, like the MySQL default channel.
+
+const mariadbLagQuery = "SHOW ALL SLAVES STATUS"
+
+// mariadbProbeQuery is used by writer=auto to detect MariaDB.
+const mariadbProbeQuery = "SELECT @@version, @@version_comment"
+
+// isMariaDB returns true if the monitored instance is MariaDB: "MariaDB" in
+// @@version (like 10.11.6-MariaDB) or @@version_comment.
+func (c *Lag) isMariaDB(ctx context.Context) bool {
+	var version, comment string
+	if err := c.db.QueryRowContext(ctx, mariadbProbeQuery).Scan(&version, &comment); err != nil {
+		Log.Debug("repl.lag: not MariaDB: %s", err)
+		return false
+	}
+	return strings.Contains(strings.ToLower(version), "mariadb") || strings.Contains(strings.ToLower(comment), "mariadb")
+}
+
+// collectMariaDB reports repl.lag.current for each replication connection,
+// grouped by channel = connection name, sorted by SHOW ALL SLAVES STATUS
+// (by connection name). No rows is not a replica.
+func (c *Lag) collectMariaDB(ctx context.Context, levelName string) ([]blip.MetricValue, error) {
+	rows, err := sqlutil.ReplicaStatusRows(ctx, c.db, mariadbLagQuery)
+	if err != nil {
+		return nil, c.replStatusGrantError(ctx, fmt.Errorf("%s: %w", mariadbLagQuery, err))
+	}
+	if len(rows) == 0 {
+		return c.notAReplica(levelName), nil
+	}
+	var lagMetrics []blip.MetricValue
+	for _, status := range rows {
+		channel := status.Channel
+		if !c.pfsChannel(levelName, channel) {
+			continue // channel option: not the channel to collect
+		}
+		if channel == "" && c.defaultChannelNameOverrides[levelName] != "" {
+			channel = c.defaultChannelNameOverrides[levelName]
+		}
+		ok := status.SecondsBehindSource.Valid // NULL: SQL thread not running
+		seconds := float64(status.SecondsBehindSource.Int64)
+		if !ok && c.dropNoHeartbeat[levelName] {
+			Log.Debug("(repl.lag from MariaDB): channel: %s: Seconds_Behind_Master is NULL, dropped", channel)
+			continue
+		}
+		host := status.SourceHost
+		opts := c.lagOptions(levelName)
+		opts.clockOffset = 0 // lag computed by MariaDB, not from timestamps
+		value, meta := computeLag(rawLagInputs{
+			ms:         math.Floor(seconds * 1000), // as milliseconds
+			ok:         ok,
+			replica:    true,
+			sourceHost: host,
+		}, opts)
+		lagMetrics = append(lagMetrics, blip.MetricValue{
+			Name:  "current",
+			Type:  blip.GAUGE,
+			Value: value,
+			Group: map[string]string{"channel": channel},
+			Meta:  meta,
+		})
+		Log.Debug("(repl.lag from MariaDB): channel: %s: lag=%d ms", channel, int(value))
+	}
+	return lagMetrics, nil
+}
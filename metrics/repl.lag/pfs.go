@@ -4,13 +4,17 @@ package repllag
 
 import (
 	"context"
+	"database/sql"
 	"fmt"
 	"log"
 	"math"
+	"sort"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/cashapp/blip"
+	"github.com/cashapp/blip/sqlutil"
 )
 
 // This file calculates Replica Lag from Performance Schema
@@ -25,14 +29,65 @@ const mySQL8LagQuery = `SELECT
   w.LAST_APPLIED_TRANSACTION,
   UNIX_TIMESTAMP(NOW(6)) 'now',
   UNIX_TIMESTAMP(LAST_APPLIED_TRANSACTION_IMMEDIATE_COMMIT_TIMESTAMP) 'last_applied_ts',
-  COALESCE(TIMESTAMPDIFF(MICROSECOND, LAST_APPLIED_TRANSACTION_IMMEDIATE_COMMIT_TIMESTAMP, LAST_APPLIED_TRANSACTION_END_APPLY_TIMESTAMP), 0) 'last_applied_lag',
-  UNIX_TIMESTAMP(APPLYING_TRANSACTION_IMMEDIATE_COMMIT_TIMESTAMP) 'applying_ts'
+  TIMESTAMPDIFF(MICROSECOND, NULLIF(LAST_APPLIED_TRANSACTION_IMMEDIATE_COMMIT_TIMESTAMP, 0), NULLIF(LAST_APPLIED_TRANSACTION_END_APPLY_TIMESTAMP, 0)) 'last_applied_lag',
+  UNIX_TIMESTAMP(APPLYING_TRANSACTION_IMMEDIATE_COMMIT_TIMESTAMP) 'applying_ts',
+  COALESCE(cc.HOST, '') 'source_host',
+  r.SOURCE_UUID 'source_uuid',
+  UNIX_TIMESTAMP(NULLIF(LAST_APPLIED_TRANSACTION_END_APPLY_TIMESTAMP, 0)) 'last_applied_end_ts',
+  TIMESTAMPDIFF(MICROSECOND, NULLIF(r.LAST_QUEUED_TRANSACTION_ORIGINAL_COMMIT_TIMESTAMP, 0), NULLIF(r.LAST_QUEUED_TRANSACTION_END_QUEUE_TIMESTAMP, 0)) 'last_queued_lag',
+  UNIX_TIMESTAMP(NULLIF(c.PROCESSING_TRANSACTION_IMMEDIATE_COMMIT_TIMESTAMP, 0)) 'processing_ts'
 FROM
   performance_schema.replication_connection_status r
   JOIN performance_schema.replication_applier_status_by_coordinator c USING (channel_name)
-  JOIN performance_schema.replication_applier_status_by_worker w USING (channel_name);
+  JOIN performance_schema.replication_applier_status_by_worker w USING (channel_name)
+  LEFT JOIN performance_schema.replication_connection_configuration cc USING (channel_name);
 `
 
+// mySQL8LagFallbackQuery is used when the query above returns no rows because
+// replication_applier_status_by_worker is empty, which happens on a replica
+// that just started, for example. Without workers, lag is estimated from the
+// last queued transaction. Timestamps are zero (0000-00-00) until the first
+// transaction is queued, hence NULLIF(..., 0): NULL values are scanned as zero
+// (see pfsFloat).
+const mySQL8LagFallbackQuery = `SELECT
+  r.CHANNEL_NAME,
+  r.SERVICE_STATE 'io_thd',
+  a.SERVICE_STATE 'sql_thd',
+  UNIX_TIMESTAMP(NOW(6)) 'now',
+  UNIX_TIMESTAMP(NULLIF(r.LAST_QUEUED_TRANSACTION_ORIGINAL_COMMIT_TIMESTAMP, 0)) 'last_queued_ts',
+  TIMESTAMPDIFF(MICROSECOND, NULLIF(r.LAST_QUEUED_TRANSACTION_ORIGINAL_COMMIT_TIMESTAMP, 0), NULLIF(r.LAST_QUEUED_TRANSACTION_END_QUEUE_TIMESTAMP, 0)) 'last_queued_lag',
+  COALESCE(cc.HOST, '') 'source_host',
+  r.SOURCE_UUID 'source_uuid'
+FROM
+  performance_schema.replication_connection_status r
+  JOIN performance_schema.replication_applier_status a USING (channel_name)
+  LEFT JOIN performance_schema.replication_connection_configuration cc USING (channel_name);
+`
+
+// pfsQueries returns mySQL8LagQuery and mySQL8LagFallbackQuery with NOW(6)
+// replaced by the fractional-second precision (option now-precision): NOW()
+// if 0, else NOW(precision). Both queries use NOW(6) by default.
+func pfsQueries(precision int) (string, string) {
+	now := "NOW()"
+	if precision > 0 {
+		now = fmt.Sprintf("NOW(%d)", precision)
+	}
+	return strings.Replace(mySQL8LagQuery, "NOW(6)", now, 1), strings.Replace(mySQL8LagFallbackQuery, "NOW(6)", now, 1)
+}
+
+// Meta source_table values on repl.lag.current from pfs: the Performance Schema
+// table that lag is computed from. SOURCE_TABLE_WORKER is mySQL8LagQuery;
+// SOURCE_TABLE_CONNECTION is mySQL8LagFallbackQuery, used when there are no
+// worker rows.
+const (
+	SOURCE_TABLE_WORKER     = "replication_applier_status_by_worker"
+	SOURCE_TABLE_CONNECTION = "replication_connection_status"
+)
+
+// pfsReplicaProbeQuery is a cheap check run before the lag query if repl-check
+// isn't set: zero rows in replication_connection_status means not a replica.
+const pfsReplicaProbeQuery = "SELECT COUNT(*) FROM performance_schema.replication_connection_status"
+
 // worker is one row from the query above. All timestamps are microseconds from MySQL.
 type worker struct {
 	channel        string // key
@@ -45,7 +100,20 @@ type worker struct {
 	now            float64 // from MySQL, microseconds
 	lastAppliedTs  float64
 	lastAppliedLag float64
+	noAppliedLag   bool // last_applied_lag is NULL: zero (0000-00-00) commit or end-apply timestamp
 	applyingTs     float64
+	sourceHost     string
+	sourceUuid     string
+	lastAppliedEnd float64 // seconds, 0 if nothing applied yet
+	lastQueuedLag  float64 // microseconds, 0 if nothing queued yet
+	processingTs   float64 // coordinator scheduling trx, 0 if none
+}
+
+// pfsFloat returns the value of a numeric column scanned as a string, or zero
+// if the value is NULL (or not a number).
+func pfsFloat(s sql.NullString) float64 {
+	f, _ := sqlutil.Float64(s.String)
+	return f
 }
 
 // pfsLag is computed from a []worker per channel.
@@ -56,6 +124,9 @@ type pfsLag struct {
 	trxId       string  // max applied trx ID (just for print, human observation)
 	backlog     int     // last queued - last applied
 	workerUsage float64 // applying workers / total workers * 100
+	applierMs   float64 // last applied trx: commit on source to applied (debug-components)
+	queueMs     float64 // last queued trx: commit on source to queued (debug-components)
+	noData      bool    // no lag yet: last applied trx has no valid timestamps (just-started replica)
 }
 
 const (
@@ -65,45 +136,142 @@ const (
 	O_IDLE     = " " // none of the above == true zero lag
 )
 
-func (c *Lag) collectPFS(ctx context.Context, levelName string) ([]blip.MetricValue, error) {
-	var defaultLag []blip.MetricValue
-	if c.dropNotAReplica[levelName] {
-		defaultLag = nil
-	} else {
-		// send -1 for lag
-		m := blip.MetricValue{
-			Name:  "current",
-			Type:  blip.GAUGE,
-			Value: float64(-1),
+// queueStatus maps O_ consts to Meta queue_status for option debug-components.
+var queueStatus = map[string]string{
+	O_APPLYING: "applying",
+	O_RECEIVED: "received",
+	O_STOPPED:  "stopped",
+	O_IDLE:     "idle",
+}
+
+// componentMeta adds the lag components to meta for option debug-components:
+// applier_latency_ms (if workers), queue_latency_ms, and queue_status.
+func componentMeta(meta map[string]string, lag pfsLag, workers bool) map[string]string {
+	if meta == nil {
+		meta = map[string]string{}
+	}
+	if workers {
+		meta["applier_latency_ms"] = strconv.FormatFloat(lag.applierMs, 'f', -1, 64)
+	}
+	meta["queue_latency_ms"] = strconv.FormatFloat(lag.queueMs, 'f', -1, 64)
+	meta["queue_status"] = queueStatus[lag.observed]
+	return meta
+}
+
+// withSourceTable returns meta with key source_table set, allocating meta if nil.
+func withSourceTable(meta map[string]string, table string) map[string]string {
+	if meta == nil {
+		meta = map[string]string{}
+	}
+	meta["source_table"] = table
+	return meta
+}
+
+// pfsConsumersQuery returns the Performance Schema consumers required to collect
+// lag from PFS. They're enabled by default but can be disabled by operators.
+const pfsConsumersQuery = "SELECT NAME, ENABLED FROM performance_schema.setup_consumers WHERE NAME IN ('global_instrumentation', 'thread_instrumentation')"
+
+// preparePFS checks that lag can be collected from PFS: required consumers are
+// enabled, and the lag query works (metrics are discarded). If the user lacks
+// privileges, the error lists the missing grants.
+func (c *Lag) preparePFS(ctx context.Context, levelName string) error {
+	if err := c.checkPFSConsumers(ctx, levelName); err != nil {
+		return err
+	}
+	if _, err := c.collectPFS(ctx, levelName); err != nil {
+		return c.pfsGrantsError(ctx, levelName, err)
+	}
+	return nil
+}
+
+// pfsDB returns the connection pool for Performance Schema queries at the level:
+// the pfs-dsn pool if set, else the monitor connection.
+func (c *Lag) pfsDB(levelName string) *sql.DB {
+	if l, ok := c.atLevel[levelName]; ok && l.pfsDB != nil {
+		return l.pfsDB
+	}
+	return c.db
+}
+
+// closePFSDB closes the pfs-dsn pools of the levels, if any.
+func closePFSDB(atLevel map[string]*lagLevel) {
+	for _, l := range atLevel {
+		if l.pfsDB != nil {
+			l.pfsDB.Close()
+		}
+	}
+}
+
+// checkPFSConsumers returns an error naming the first required consumer that's
+// disabled. If setup_consumers can't be queried, it returns nil and the error
+// (if any) is reported by the lag query.
+func (c *Lag) checkPFSConsumers(ctx context.Context, levelName string) error {
+	rows, err := c.pfsDB(levelName).QueryContext(ctx, pfsConsumersQuery)
+	if err != nil {
+		Log.Debug("repl.lag: cannot check performance_schema.setup_consumers, ignoring: %s", err)
+		return nil
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var name, enabled string
+		if err := rows.Scan(&name, &enabled); err != nil {
+			return err
+		}
+		if enabled != "YES" {
+			return fmt.Errorf("performance_schema consumer %s is disabled; enable it to collect lag from Performance Schema: UPDATE performance_schema.setup_consumers SET ENABLED='YES' WHERE NAME='%s'", name, name)
 		}
-		defaultLag = []blip.MetricValue{m}
 	}
+	return rows.Err()
+}
 
+func (c *Lag) collectPFS(ctx context.Context, levelName string) ([]blip.MetricValue, error) {
 	// if isReplCheck is supplied, check if it's a replica
 	isRepl := 1
 	if c.replCheck != "" {
-		query := "SELECT @@" + c.replCheck
-		if err := c.db.QueryRowContext(ctx, query).Scan(&isRepl); err != nil {
-			return nil, fmt.Errorf("checking if instance is replica failed, please check value of %s. Err: %s", OPT_REPL_CHECK, err.Error())
+		query := "SELECT " + sqlutil.AndVars(c.replCheck)
+		if err := c.pfsDB(levelName).QueryRowContext(ctx, query).Scan(&isRepl); err != nil {
+			return nil, fmt.Errorf("checking if instance is replica failed, please check value of %s. Err: %w", OPT_REPL_CHECK, err)
+		}
+	} else {
+		// Else fast-path probe: no replication connections = not a replica.
+		// If the probe fails, ignore it and run the lag query, which reports
+		// a real error if there's a problem.
+		var n int
+		if err := c.pfsDB(levelName).QueryRowContext(ctx, pfsReplicaProbeQuery).Scan(&n); err != nil {
+			Log.Debug("repl.lag: PFS replica probe failed, ignoring: %s", err)
+		} else if n == 0 {
+			isRepl = 0
 		}
 	}
 
 	if isRepl == 0 {
-		return defaultLag, nil
+		return c.notAReplica(levelName), nil // absent value (-1 or NaN) or dropped
 	}
 
-	rows, err := c.db.QueryContext(context.Background(), mySQL8LagQuery)
+	rows, err := c.pfsDB(levelName).QueryContext(context.Background(), c.atLevel[levelName].pfsQuery)
 	if err != nil {
-		return nil, fmt.Errorf("could not check replication lag, check that the host is a MySQL 8.0 replica, and that performance_schema is enabled. Err: %s", err.Error())
+		return nil, fmt.Errorf("could not check replication lag, check that the host is a MySQL 8.0 replica, and that performance_schema is enabled. Err: %w", err)
 	}
 
 	// Group workers by channel name
 	channels := map[string][]worker{}
 	for rows.Next() {
 		w := worker{}
-		if err := rows.Scan(&w.channel, &w.lastQueuedTrx, &w.ioThd, &w.sqlThd, &w.lastProcTrx, &w.id, &w.lastAppliedTrx, &w.now, &w.lastAppliedTs, &w.lastAppliedLag, &w.applyingTs); err != nil {
+		var now, lastAppliedTs, lastAppliedLag, applyingTs, lastAppliedEnd, lastQueuedLag, processingTs sql.NullString
+		if err := rows.Scan(&w.channel, &w.lastQueuedTrx, &w.ioThd, &w.sqlThd, &w.lastProcTrx, &w.id, &w.lastAppliedTrx, &now, &lastAppliedTs, &lastAppliedLag, &applyingTs, &w.sourceHost, &w.sourceUuid, &lastAppliedEnd, &lastQueuedLag, &processingTs); err != nil {
 			log.Fatal(err)
 		}
+		w.now = pfsFloat(now)
+		w.lastAppliedTs = pfsFloat(lastAppliedTs)
+		w.lastAppliedLag = pfsFloat(lastAppliedLag)
+		w.noAppliedLag = !lastAppliedLag.Valid
+		w.applyingTs = pfsFloat(applyingTs)
+		w.lastAppliedEnd = pfsFloat(lastAppliedEnd)
+		w.lastQueuedLag = pfsFloat(lastQueuedLag)
+		w.processingTs = pfsFloat(processingTs)
+		if !c.pfsChannel(levelName, w.channel) {
+			continue // channel option: not the channel to collect
+		}
 		if _, ok := channels[w.channel]; !ok { // new channel
 			channels[w.channel] = []worker{}
 		}
@@ -111,20 +279,52 @@ func (c *Lag) collectPFS(ctx context.Context, levelName string) ([]blip.MetricVa
 	}
 	rows.Close()
 
+	if len(channels) == 0 {
+		return c.collectPFSFallback(ctx, levelName)
+	}
+
+	// Collect lag per channel, sorted by channel name so metrics are reported
+	// in the same order every collection (not map order)
+	names := make([]string, 0, len(channels))
+	for channel := range channels {
+		names = append(names, channel)
+	}
+	sort.Strings(names)
+
 	var lagMetrics []blip.MetricValue
-	// collect lag per channel
-	for channel, workers := range channels {
+	l := c.atLevel[levelName]
+	for _, channel := range names {
+		workers := channels[channel]
 		// MySQL use "" as the default channel name, blip provides a way to override it
 		if channel == "" && c.defaultChannelNameOverrides[levelName] != "" {
 			channel = c.defaultChannelNameOverrides[levelName]
 		}
-		lag := lagFor(workers, c.pfsLagLastQueued, c.pfsLagLastProc)
-		lagMetrics = append(lagMetrics, blip.MetricValue{
-			Name:  "current",
-			Type:  blip.GAUGE,
-			Group: map[string]string{"channel": channel},
-			Value: lag.current,
-		})
+		if m, ok := c.sourceChanged(levelName, workers[0].channel, channel, pfsSource{host: workers[0].sourceHost, uuid: workers[0].sourceUuid}); ok {
+			lagMetrics = append(lagMetrics, m)
+		}
+		lag := lagFor(workers, l.lastQueued, l.lastProc)
+		value, meta := computeLag(rawLagInputs{
+			ms:         lag.current,
+			ok:         !lag.noData, // absent value, like no heartbeat
+			replica:    true,
+			sourceHost: workers[0].sourceHost,
+			sourceUuid: workers[0].sourceUuid,
+		}, c.lagOptions(levelName))
+		if c.atLevel[levelName].components {
+			meta = componentMeta(meta, lag, true)
+		}
+		meta = withSourceTable(meta, SOURCE_TABLE_WORKER)
+		if lag.noData && c.dropNoHeartbeat[levelName] {
+			Log.Debug("(repl.lag from PFS): channel: %s: no last applied lag yet, current dropped", channel)
+		} else {
+			lagMetrics = append(lagMetrics, blip.MetricValue{
+				Name:  "current",
+				Type:  blip.GAUGE,
+				Group: map[string]string{"channel": channel},
+				Value: value,
+				Meta:  meta,
+			})
+		}
 		lagMetrics = append(lagMetrics, blip.MetricValue{
 			Name:  "backlog",
 			Type:  blip.GAUGE,
@@ -137,11 +337,285 @@ func (c *Lag) collectPFS(ctx context.Context, levelName string) ([]blip.MetricVa
 			Value: lag.workerUsage,
 			Group: map[string]string{"channel": channel},
 		})
-		blip.Debug("(repl.lag from PFS): channel: %s txID: %s Observed State: %s Num of applying workers: %d | backlog: %3d worker Usage: %3.2f%% lag=%d ms", channel, lag.trxId, lag.observed, lag.applying, lag.backlog, lag.workerUsage, int(lag.current))
+		if c.atLevel[levelName].emitTs {
+			if ts := appliedAt(workers); ts > 0 {
+				lagMetrics = append(lagMetrics, blip.MetricValue{
+					Name:  "applied_at",
+					Type:  blip.GAUGE,
+					Value: ts,
+					Group: map[string]string{"channel": channel},
+				})
+			}
+		}
+		if c.atLevel[levelName].oldest {
+			lagMetrics = append(lagMetrics, blip.MetricValue{
+				Name:  "oldest_unapplied",
+				Type:  blip.GAUGE,
+				Value: oldestUnapplied(workers),
+				Group: map[string]string{"channel": channel},
+			})
+		}
+		if window := c.atLevel[levelName].parallel; window > 0 {
+			lagMetrics = append(lagMetrics, blip.MetricValue{
+				Name:  "parallel_workers_active",
+				Type:  blip.GAUGE,
+				Value: activeWorkers(workers, window),
+				Group: map[string]string{"channel": channel},
+			})
+		}
+		if c.atLevel[levelName].applyRate {
+			if rate, ok := c.applyRate(levelName, workers); ok {
+				lagMetrics = append(lagMetrics, blip.MetricValue{
+					Name:  "apply_rate",
+					Type:  blip.GAUGE,
+					Value: rate,
+					Group: map[string]string{"channel": channel},
+				})
+			}
+		}
+		if c.atLevel[levelName].workerDist {
+			if dist, ok := workerDistribution(workers); ok {
+				for i, name := range []string{"worker_min", "worker_p50", "worker_max"} {
+					lagMetrics = append(lagMetrics, blip.MetricValue{
+						Name:  name,
+						Type:  blip.GAUGE,
+						Value: dist[i],
+						Group: map[string]string{"channel": channel},
+					})
+				}
+			}
+		}
+		Log.Debug("(repl.lag from PFS): channel: %s txID: %s Observed State: %s Num of applying workers: %d | backlog: %3d worker Usage: %3.2f%% lag=%d ms", channel, lag.trxId, lag.observed, lag.applying, lag.backlog, lag.workerUsage, int(lag.current))
 	}
 	return lagMetrics, nil
 }
 
+// appliedAt returns the Unix timestamp (milliseconds) when the last transaction
+// was applied by any worker, or zero if no worker has applied a transaction.
+func appliedAt(workers []worker) float64 {
+	var max float64
+	for _, w := range workers {
+		if w.lastAppliedEnd > max {
+			max = w.lastAppliedEnd
+		}
+	}
+	return math.Floor(max * 1000)
+}
+
+// activeWorkers returns the number of workers applying a transaction or that
+// finished applying one within the window (the level freq, so since about the
+// last collection). Unlike worker_usage, which is a point-in-time sample, this
+// shows whether parallel replication is effective or workers are serialized:
+// a worker that applied and went idle between collections is still counted.
+func activeWorkers(workers []worker, window time.Duration) float64 {
+	var n float64
+	for _, w := range workers {
+		if w.applyingTs > 0 || (w.lastAppliedEnd > 0 && w.now-w.lastAppliedEnd <= window.Seconds()) {
+			n++
+		}
+	}
+	return n
+}
+
+// trxSample is the max applied transaction number (GTID) of a channel
+// and when it was sampled (MySQL NOW, seconds), for option report-apply-rate.
+type trxSample struct {
+	trxNo int
+	now   float64
+}
+
+// applyRate returns the number of transactions applied per second on the channel
+// of the workers since the last call: the change in the max applied transaction
+// number (GTID) divided by the change in MySQL NOW. It returns false on the first
+// call (no previous sample), if time didn't advance, or if the transaction number
+// decreased (the source changed, for example), which resets the sample.
+func (c *Lag) applyRate(levelName string, workers []worker) (float64, bool) {
+	l := c.atLevel[levelName]
+	cur := trxSample{now: workers[0].now}
+	for _, w := range workers {
+		if n := trxNo(w.lastAppliedTrx); n > cur.trxNo {
+			cur.trxNo = n
+		}
+	}
+	channel := workers[0].channel
+	prev, ok := l.applied[channel]
+	l.applied[channel] = cur
+	if !ok || cur.now <= prev.now || cur.trxNo < prev.trxNo {
+		return 0, false
+	}
+	return float64(cur.trxNo-prev.trxNo) / (cur.now - prev.now), true
+}
+
+// workerDistribution returns the min, median, and max last applied latency
+// (milliseconds) across workers: commit on source to end apply of the last
+// transaction applied by each worker. Workers that have not applied a
+// transaction (no last applied lag) are ignored; if none have, it returns
+// false. The median of an even number of workers is the mean of the middle two.
+func workerDistribution(workers []worker) ([3]float64, bool) {
+	ms := make([]float64, 0, len(workers))
+	for _, w := range workers {
+		if w.noAppliedLag || w.lastAppliedLag < 0 {
+			continue
+		}
+		ms = append(ms, w.lastAppliedLag/1000) // microseconds to milliseconds
+	}
+	if len(ms) == 0 {
+		return [3]float64{}, false
+	}
+	sort.Float64s(ms)
+	n := len(ms)
+	p50 := ms[n/2]
+	if n%2 == 0 {
+		p50 = (ms[n/2-1] + ms[n/2]) / 2
+	}
+	return [3]float64{ms[0], p50, ms[n-1]}, true
+}
+
+// oldestUnapplied returns the age (milliseconds) of the oldest transaction not
+// yet applied: the oldest transaction being applied by a worker or scheduled by
+// the coordinator, or zero if none. Unlike current, which reports the last
+// applied lag when no worker is applying, this shows a single stuck transaction
+// (head-of-line blocking) that holds up the queue.
+func oldestUnapplied(workers []worker) float64 {
+	oldest := workers[0].processingTs // same for all workers (coordinator)
+	for _, w := range workers {
+		if w.applyingTs > 0 && (w.applyingTs < oldest || oldest == 0) {
+			oldest = w.applyingTs
+		}
+	}
+	if oldest == 0 {
+		return 0
+	}
+	age := math.Floor((workers[0].now - oldest) * 1000.0) // as milliseconds
+	if age < 0 {
+		return 0
+	}
+	return age
+}
+
+// channelStatus is one row from mySQL8LagFallbackQuery.
+type channelStatus struct {
+	channel       string
+	ioThd         string
+	sqlThd        string
+	now           float64 // seconds
+	lastQueuedTs  float64 // seconds
+	lastQueuedLag float64 // microseconds
+	sourceHost    string
+	sourceUuid    string
+}
+
+// collectPFSFallback estimates lag from the non-worker tables when there are
+// no rows in replication_applier_status_by_worker. If there are no rows in
+// those tables either, the instance is not a replica. Only repl.lag.current
+// is reported because backlog and worker usage require worker rows.
+func (c *Lag) collectPFSFallback(ctx context.Context, levelName string) ([]blip.MetricValue, error) {
+	rows, err := c.pfsDB(levelName).QueryContext(ctx, c.atLevel[levelName].pfsFbQuery)
+	if err != nil {
+		return nil, fmt.Errorf("could not check replication lag (no workers), check that the host is a MySQL 8.0 replica, and that performance_schema is enabled. Err: %w", err)
+	}
+	defer rows.Close()
+
+	var lagMetrics []blip.MetricValue
+	for rows.Next() {
+		ch := channelStatus{}
+		var now, lastQueuedTs, lastQueuedLag sql.NullString
+		if err := rows.Scan(&ch.channel, &ch.ioThd, &ch.sqlThd, &now, &lastQueuedTs, &lastQueuedLag, &ch.sourceHost, &ch.sourceUuid); err != nil {
+			return nil, err
+		}
+		ch.now = pfsFloat(now)
+		ch.lastQueuedTs = pfsFloat(lastQueuedTs)
+		ch.lastQueuedLag = pfsFloat(lastQueuedLag)
+		if !c.pfsChannel(levelName, ch.channel) {
+			continue // channel option: not the channel to collect
+		}
+		channel := ch.channel
+		if channel == "" && c.defaultChannelNameOverrides[levelName] != "" {
+			channel = c.defaultChannelNameOverrides[levelName]
+		}
+		if m, ok := c.sourceChanged(levelName, ch.channel, channel, pfsSource{host: ch.sourceHost, uuid: ch.sourceUuid}); ok {
+			lagMetrics = append(lagMetrics, m)
+		}
+		lag := fallbackLagFor(ch)
+		value, meta := computeLag(rawLagInputs{
+			ms:         lag.current,
+			ok:         true,
+			replica:    true,
+			sourceHost: ch.sourceHost,
+			sourceUuid: ch.sourceUuid,
+		}, c.lagOptions(levelName))
+		if c.atLevel[levelName].components {
+			meta = componentMeta(meta, lag, false)
+		}
+		meta = withSourceTable(meta, SOURCE_TABLE_CONNECTION)
+		lagMetrics = append(lagMetrics, blip.MetricValue{
+			Name:  "current",
+			Type:  blip.GAUGE,
+			Group: map[string]string{"channel": channel},
+			Value: value,
+			Meta:  meta,
+		})
+		Log.Debug("(repl.lag from PFS, no workers): channel: %s Observed State: %s lag=%d ms", channel, lag.observed, int(lag.current))
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if len(lagMetrics) == 0 {
+		return c.notAReplica(levelName), nil
+	}
+	return lagMetrics, nil
+}
+
+// pfsChannel returns true if lag for the channel is collected at the level:
+// the channel option is not set, or it matches the channel name or, for the
+// default channel, the default-channel-name.
+func (c *Lag) pfsChannel(levelName, channel string) bool {
+	want := c.atLevel[levelName].channel
+	if want == "" {
+		return true
+	}
+	if channel == "" && c.defaultChannelNameOverrides[levelName] != "" {
+		channel = c.defaultChannelNameOverrides[levelName]
+	}
+	return channel == want
+}
+
+// sourceMeta returns Meta with key "source" = source host, or source UUID if
+// host is unknown. It returns nil if both are unknown (empty) so that the key
+// is omitted rather than reported as an empty string.
+func sourceMeta(host, uuid string) map[string]string {
+	switch {
+	case host != "":
+		return map[string]string{"source": host}
+	case uuid != "":
+		return map[string]string{"source": uuid}
+	}
+	return nil
+}
+
+// fallbackLagFor estimates lag for a channel without worker info. If both repl
+// threads are running, lag is the queue lag of the last queued transaction:
+// how long it took from commit on the source to queued on the replica. Else,
+// lag increases from the commit time of the last queued transaction (like a
+// stopped replica in lagFor).
+func fallbackLagFor(ch channelStatus) pfsLag {
+	lag := pfsLag{}
+	switch {
+	case ch.ioThd != "ON" || ch.sqlThd != "ON":
+		lag.observed = O_STOPPED
+		if ch.lastQueuedTs > 0 {
+			lag.current = math.Floor((ch.now - ch.lastQueuedTs) * 1000.0) // as milliseconds
+		}
+	case ch.lastQueuedLag > 0:
+		lag.observed = O_RECEIVED
+		lag.current = math.Floor(ch.lastQueuedLag / 1000.0) // as milliseconds
+	default:
+		lag.observed = O_IDLE
+	}
+	lag.queueMs = math.Floor(ch.lastQueuedLag / 1000.0) // as milliseconds
+	return lag
+}
+
 func lagFor(workers []worker, lastQueued, lastProc map[string]string) pfsLag {
 	lag := pfsLag{}               // return value
 	channel := workers[0].channel // for brevity
@@ -150,6 +624,7 @@ func lagFor(workers []worker, lastQueued, lastProc map[string]string) pfsLag {
 		oldestApplyingTs float64
 		lastAppliedTs    float64
 		lastAppliedLag   float64
+		noAppliedLag     bool
 	)
 
 	for _, w := range workers {
@@ -173,6 +648,7 @@ func lagFor(workers []worker, lastQueued, lastProc map[string]string) pfsLag {
 			maxTrxNo = n
 			lastAppliedTs = w.lastAppliedTs
 			lastAppliedLag = w.lastAppliedLag
+			noAppliedLag = w.noAppliedLag || w.lastAppliedLag < 0
 			lag.trxId = w.lastAppliedTrx
 		}
 
@@ -215,6 +691,13 @@ func lagFor(workers []worker, lastQueued, lastProc map[string]string) pfsLag {
 			// look back and see objective lag recorded by MySQL in these tables.
 			lag.current = math.Floor(lastAppliedLag / 1000.0) // as milliseconds
 			lag.observed = O_RECEIVED
+			// On a just-started replica, the end-apply timestamp can be zero
+			// (0000-00-00) or before the commit timestamp, so there's no last
+			// applied lag yet (NULL or negative), not a huge lag spike.
+			if noAppliedLag {
+				lag.current = 0
+				lag.noData = true
+			}
 
 		} else if workers[0].ioThd != "ON" || workers[0].sqlThd != "ON" {
 			// No workers applying and no trx received. If either repl thread is
@@ -242,6 +725,8 @@ func lagFor(workers []worker, lastQueued, lastProc map[string]string) pfsLag {
 
 	lag.backlog = trxNo(workers[0].lastQueuedTrx) - maxTrxNo
 	lag.workerUsage = float64(lag.applying) / float64(len(workers)) * 100
+	lag.applierMs = math.Floor(lastAppliedLag / 1000.0)         // as milliseconds
+	lag.queueMs = math.Floor(workers[0].lastQueuedLag / 1000.0) // as milliseconds
 
 	// Save observed trx for calculations in next call. All workers have
 	// same value (because they come from repl conn status and coordinator
@@ -263,3 +748,30 @@ func trxNo(gtid string) int {
 	}
 	return trxNo
 }
+
+// parseNowPrecision returns the now-precision option value: the fractional
+// seconds precision of NOW in the pfs queries (see pfsQueries), 6 if not set.
+func parseNowPrecision(opts map[string]string) (int, error) {
+	p := opts[OPT_NOW_PRECISION]
+	if p == "" {
+		return 6, nil
+	}
+	precision, err := strconv.Atoi(p)
+	if err != nil || precision < 0 || precision > 6 {
+		return 0, fmt.Errorf("invalid %s: %s: must be an integer from 0 to 6", OPT_NOW_PRECISION, p)
+	}
+	return precision, nil
+}
+
+// parseParallelism returns the report-parallelism window: the freq of the
+// level, or 0 if the option is not enabled.
+func parseParallelism(opts map[string]string, freq string) (time.Duration, error) {
+	if !blip.Bool(opts[OPT_REPORT_PARALLELISM]) {
+		return 0, nil
+	}
+	d, err := time.ParseDuration(freq)
+	if err != nil || d <= 0 {
+		return 0, fmt.Errorf("invalid level freq for %s: %q", OPT_REPORT_PARALLELISM, freq)
+	}
+	return d, nil
+}
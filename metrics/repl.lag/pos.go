@@ -0,0 +1,78 @@
+// Copyright 2024 Block, Inc.
+
+package repllag
+
+import (
+	"context"
+	"fmt"
+	"math"
+
+	"github.com/cashapp/blip"
+	"github.com/cashapp/blip/sqlutil"
+)
+
+// This file reports repl.lag.pos_backlog for option report-pos-backlog: bytes
+// of source binary log read (queued) by the IO thread but not yet executed by
+// the SQL thread, from SHOW REPLICA STATUS. It's a proxy for lag on replicas
+// without GTIDs or a heartbeat, and better than Seconds_Behind_Source, which
+// is zero while the IO thread is behind.
+
+// posBacklog returns metrics with repl.lag.pos_backlog appended for each
+// replication channel. If the IO and SQL threads are at different source log
+// files (file rollover), the backlog cannot be computed from positions because
+// source log file sizes are not known, so it's the absent value (or dropped if
+// absent-value=drop). Not a replica (no rows) reports nothing. An error is
+// logged and ignored because pos_backlog is in addition to lag.
+func (c *Lag) posBacklog(ctx context.Context, levelName string, metrics []blip.MetricValue) []blip.MetricValue {
+	l := c.atLevel[levelName]
+	rows, err := sqlutil.ReplicaStatusRows(ctx, c.db, l.posQuery)
+	if err != nil {
+		Log.Debug("repl.lag: %s: %s: %s", levelName, OPT_REPORT_POS_BACKLOG, err)
+		return metrics
+	}
+	for _, status := range rows {
+		channel := status.Channel
+		if channel == "" && c.defaultChannelNameOverrides[levelName] != "" {
+			channel = c.defaultChannelNameOverrides[levelName]
+		}
+		value, ok := binlogPosBacklog(status)
+		if !ok {
+			if l.absent == ABSENT_VALUE_DROP {
+				continue
+			}
+			value = math.NaN() // absent: see reportAbsent
+		}
+		metrics = append(metrics, blip.MetricValue{
+			Name:  "pos_backlog",
+			Type:  blip.GAUGE,
+			Value: value,
+			Group: map[string]string{"channel": channel},
+		})
+	}
+	return metrics
+}
+
+// binlogPosBacklog returns Read_Source_Log_Pos minus Exec_Source_Log_Pos (or
+// the Master terms prior to MySQL 8.0.22) if Source_Log_File and
+// Relay_Source_Log_File are the same file. It returns false if they are
+// different files or the values are invalid.
+func binlogPosBacklog(status sqlutil.ReplicaStatus) (float64, bool) {
+	if status.SourceLogFile == "" || status.SourceLogFile != status.RelaySourceLogFile {
+		return 0, false
+	}
+	if !status.ReadSourceLogPos.Valid || !status.ExecSourceLogPos.Valid {
+		return 0, false
+	}
+	return math.Max(float64(status.ReadSourceLogPos.Int64-status.ExecSourceLogPos.Int64), 0), true
+}
+
+// preparePosBacklog sets the SHOW REPLICA STATUS query for option
+// report-pos-backlog and checks that it works.
+func (c *Lag) preparePosBacklog(ctx context.Context, levelName string) error {
+	l := c.atLevel[levelName]
+	l.posQuery = c.replStatusQuery(ctx)
+	if _, err := sqlutil.ReplicaStatusRows(ctx, c.db, l.posQuery); err != nil {
+		return c.replStatusGrantError(ctx, fmt.Errorf("%s: %s: %w", OPT_REPORT_POS_BACKLOG, l.posQuery, err))
+	}
+	return nil
+}
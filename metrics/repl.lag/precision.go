@@ -0,0 +1,34 @@
+// Copyright 2024 Block, Inc.
+
+package repllag
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/cashapp/blip/heartbeat"
+)
+
+// This file reads the fractional-second precision of the heartbeat ts column
+// for the blip writer. The reader reads NOW with the same precision, and meta
+// heartbeat_precision reports it, so lag from a DATETIME(0) column (whole
+// seconds) isn't mistaken for sub-second lag.
+
+// tsPrecision returns the precision of column ts in the heartbeat table for
+// heartbeat.BlipReaderArgs.TsPrecision, or not valid (unknown) if the ts format
+// is an epoch or the precision cannot be read, in which case the reader reads
+// NOW(3) like before. The query times out after heartbeat.ReadTimeout or when
+// ctx (from Prepare) is done.
+func tsPrecision(ctx context.Context, db *sql.DB, table, tsFormat string) sql.NullInt32 {
+	if tsFormat != "" && tsFormat != heartbeat.TS_FORMAT_DATETIME {
+		return sql.NullInt32{}
+	}
+	ctx, cancel := context.WithTimeout(ctx, heartbeat.ReadTimeout)
+	defer cancel()
+	p, err := heartbeat.TsPrecision(ctx, db, table)
+	if err != nil {
+		Log.Debug("repl.lag: cannot read precision of %s.ts: %s", table, err)
+		return sql.NullInt32{}
+	}
+	return p
+}
@@ -0,0 +1,86 @@
+// Copyright 2024 Block, Inc.
+
+package repllag
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+// accessDeniedErrnos are MySQL errors caused by missing privileges: database
+// access denied (1044), table access denied (1142), and privilege required,
+// like REPLICATION CLIENT for SHOW REPLICA STATUS (1227).
+var accessDeniedErrnos = map[uint16]bool{
+	1044: true,
+	1142: true,
+	1227: true,
+}
+
+// pfsTables are the Performance Schema tables queried by writer pfs:
+// mySQL8LagQuery, mySQL8LagFallbackQuery, pfsReplicaProbeQuery, and
+// pfsDelayQuery (option subtract-configured-delay).
+var pfsTables = []string{
+	"replication_applier_configuration",
+	"replication_applier_status",
+	"replication_applier_status_by_coordinator",
+	"replication_applier_status_by_worker",
+	"replication_connection_configuration",
+	"replication_connection_status",
+}
+
+// accessDenied returns true if err is a MySQL access denied error.
+func accessDenied(err error) bool {
+	var myErr *mysql.MySQLError
+	return errors.As(err, &myErr) && accessDeniedErrnos[myErr.Number]
+}
+
+// currentUser returns the MySQL user as a quoted account name for GRANT,
+// like 'blip'@'%', or 'user'@'host' if it cannot be determined.
+func currentUser(ctx context.Context, db *sql.DB) string {
+	var user string
+	if err := db.QueryRowContext(ctx, "SELECT CURRENT_USER()").Scan(&user); err != nil {
+		return "'user'@'host'"
+	}
+	name, host, _ := strings.Cut(user, "@")
+	return "'" + name + "'@'" + host + "'"
+}
+
+// pfsGrantsError returns an actionable error for err from preparePFS if it's
+// access denied: it checks each table in pfsTables and lists the GRANT
+// statements for the tables the user cannot select. Else, it returns err.
+func (c *Lag) pfsGrantsError(ctx context.Context, levelName string, err error) error {
+	if !accessDenied(err) {
+		return err
+	}
+	db := c.pfsDB(levelName)
+	user := currentUser(ctx, db)
+	var grants []string
+	for _, table := range pfsTables {
+		rows, tableErr := db.QueryContext(ctx, "SELECT 1 FROM performance_schema."+table+" LIMIT 1")
+		if tableErr == nil {
+			rows.Close()
+			continue
+		}
+		if accessDenied(tableErr) {
+			grants = append(grants, "GRANT SELECT ON performance_schema."+table+" TO "+user)
+		}
+	}
+	if len(grants) == 0 {
+		grants = append(grants, "GRANT SELECT ON performance_schema.* TO "+user)
+	}
+	return fmt.Errorf("access denied collecting lag from Performance Schema: missing privileges: %s: %w", strings.Join(grants, "; "), err)
+}
+
+// replStatusGrantError returns an actionable error for err from SHOW REPLICA
+// STATUS if it's access denied, else err.
+func (c *Lag) replStatusGrantError(ctx context.Context, err error) error {
+	if !accessDenied(err) {
+		return err
+	}
+	return fmt.Errorf("access denied on SHOW REPLICA STATUS: missing privilege: GRANT REPLICATION CLIENT ON *.* TO %s: %w", currentUser(ctx, c.db), err)
+}
@@ -0,0 +1,66 @@
+// Copyright 2024 Block, Inc.
+
+package repllag
+
+import (
+	"context"
+
+	"github.com/cashapp/blip"
+)
+
+// probeLevel is the plan and level name that ProbeWriters prepares.
+const probeLevel = "probe"
+
+// ProbeWriters returns whether each registered writer works on the monitored
+// instance: nil if the writer can collect lag, else the error. It's for health
+// and diagnostics; it doesn't change the writer or state of the collector.
+//
+// Each writer is prepared with the options (option writer is ignored) in a
+// separate, temporary collector, which is cleaned up before returning. For the
+// blip writer, the heartbeat table is also read once because the readers don't
+// fail Prepare if the table can't be read.
+func (c *Lag) ProbeWriters(ctx context.Context, options map[string]string) map[string]error {
+	c.mu.RLock()
+	monitorId := c.monitorId
+	c.mu.RUnlock()
+
+	status := map[string]error{}
+	for _, writer := range Writers() {
+		opts := make(map[string]string, len(options)+1)
+		for k, v := range options {
+			opts[k] = v
+		}
+		opts[OPT_WRITER] = writer
+		delete(opts, OPT_COMPARE_WRITERS) // probe only this writer
+		delete(opts, OPT_CROSS_CHECK)
+
+		p := NewLag(c.db)
+		p.openDB = c.openDB
+		p.Now = c.Now
+		p.reader = c.reader
+		p.limiter = c.limiter
+		plan := blip.Plan{
+			Name:      probeLevel,
+			MonitorId: monitorId,
+			Levels: map[string]blip.Level{
+				probeLevel: {
+					Name: probeLevel,
+					Freq: "1s",
+					Collect: map[string]blip.Domain{
+						DOMAIN: {Name: DOMAIN, Options: opts},
+					},
+				},
+			},
+		}
+		cleanup, err := p.Prepare(ctx, plan)
+		if err == nil && writer == LAG_WRITER_BLIP {
+			_, err = p.ReadOnce(ctx, probeLevel)
+		}
+		if cleanup != nil {
+			cleanup()
+		}
+		Log.Debug("repl.lag: probe writer %s: %v", writer, err)
+		status[writer] = err
+	}
+	return status
+}
@@ -0,0 +1,155 @@
+// Copyright 2024 Block, Inc.
+
+package repllag
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/cashapp/blip"
+	"github.com/cashapp/blip/sqlutil"
+)
+
+// This file reads lag from a stored procedure (writer=proc). Some managed MySQL
+// providers don't grant SHOW REPLICA STATUS or Performance Schema; instead,
+// they provide a procedure like mysql.rds_replica_status that returns replica
+// status. The procedure is CALLed on each collection, and the lag column
+// (option lag-proc-column) of the first row that has it is the lag. A CALL
+// returns one result set per SELECT in the procedure, so all result sets are
+// scanned until the column is found.
+
+const (
+	DEFAULT_LAG_PROC_COLUMN = "Seconds_Behind_Source,Seconds_Behind_Master"
+)
+
+// procNamePart matches one part of a valid procedure name (db or procedure),
+// unquoted.
+var procNamePart = regexp.MustCompile(`^[a-zA-Z0-9_$]+$`)
+
+// lagProc is the prepared proc writer config at a level.
+type lagProc struct {
+	query   string   // CALL `db`.`proc`()
+	columns []string // lag-proc-column: candidate columns, in order
+	ms      bool     // lag-proc-unit=ms
+}
+
+// parseLagProc validates the proc writer options and returns the config.
+func parseLagProc(opts map[string]string) (*lagProc, error) {
+	name := strings.TrimSpace(opts[OPT_LAG_PROC])
+	if name == "" {
+		return nil, fmt.Errorf("%s is required for %s=%s", OPT_LAG_PROC, OPT_WRITER, LAG_WRITER_PROC)
+	}
+	parts := sqlutil.SplitQualifiedName(name)
+	if len(parts) > 2 {
+		return nil, fmt.Errorf("invalid %s: %q: must be a procedure name like proc or db.proc", OPT_LAG_PROC, name)
+	}
+	for _, p := range parts {
+		if !procNamePart.MatchString(p) {
+			return nil, fmt.Errorf("invalid %s: %q: must be a procedure name like proc or db.proc", OPT_LAG_PROC, name)
+		}
+	}
+	p := &lagProc{
+		query: "CALL " + sqlutil.QuoteQualifiedName(name, "") + "()",
+	}
+	cols := opts[OPT_LAG_PROC_COLUMN]
+	if cols == "" {
+		cols = DEFAULT_LAG_PROC_COLUMN
+	}
+	for _, col := range strings.Split(cols, ",") {
+		if col = strings.TrimSpace(col); col != "" {
+			p.columns = append(p.columns, col)
+		}
+	}
+	if len(p.columns) == 0 {
+		return nil, fmt.Errorf("invalid %s: %q: no columns", OPT_LAG_PROC_COLUMN, opts[OPT_LAG_PROC_COLUMN])
+	}
+	switch unit := opts[OPT_LAG_PROC_UNIT]; unit {
+	case "", UNIT_S:
+	case UNIT_MS:
+		p.ms = true
+	default:
+		return nil, fmt.Errorf("invalid %s: %q; valid values: s, ms", OPT_LAG_PROC_UNIT, unit)
+	}
+	return p, nil
+}
+
+// procColumn returns the index of the first candidate column in the result
+// set columns (case-insensitive), or -1 if none.
+func procColumn(cols []string, candidates []string) int {
+	for _, want := range candidates {
+		for i, col := range cols {
+			if strings.EqualFold(col, want) {
+				return i
+			}
+		}
+	}
+	return -1
+}
+
+// callLagProc calls the procedure and returns the lag column value of the first
+// row that has it. It returns found=false if no result set has the column or
+// no rows (not a replica). The value is invalid if the column is NULL (like
+// Seconds_Behind_Source when the SQL thread isn't running).
+func callLagProc(ctx context.Context, db *sql.DB, p *lagProc) (value sql.NullString, found bool, err error) {
+	rows, err := db.QueryContext(ctx, p.query)
+	if err != nil {
+		return value, false, err
+	}
+	defer rows.Close()
+	for {
+		cols, err := rows.Columns()
+		if err != nil {
+			return value, false, err
+		}
+		if i := procColumn(cols, p.columns); i >= 0 && rows.Next() {
+			vals := make([]sql.NullString, len(cols))
+			dest := make([]interface{}, len(cols))
+			for j := range vals {
+				dest[j] = &vals[j]
+			}
+			if err := rows.Scan(dest...); err != nil {
+				return value, false, err
+			}
+			return vals[i], true, nil
+		}
+		if !rows.NextResultSet() {
+			break
+		}
+	}
+	return value, false, rows.Err()
+}
+
+// collectProc reports repl.lag.current from the lag-proc procedure.
+func (c *Lag) collectProc(ctx context.Context, levelName string) ([]blip.MetricValue, error) {
+	l := c.atLevel[levelName]
+	value, found, err := callLagProc(ctx, c.db, l.proc)
+	if err != nil {
+		return nil, fmt.Errorf("cannot call %s: %w", l.proc.query, err)
+	}
+	if !found {
+		return c.notAReplica(levelName), nil
+	}
+	if !value.Valid {
+		if c.dropNoHeartbeat[levelName] {
+			Log.Debug("(repl.lag from proc): %s is NULL, dropped", l.proc.query)
+			return nil, nil
+		}
+		lag, meta := computeLag(rawLagInputs{ok: false, replica: true}, c.lagOptions(levelName))
+		return []blip.MetricValue{{Name: "current", Type: blip.GAUGE, Value: lag, Meta: meta}}, nil
+	}
+	ms, err := strconv.ParseFloat(strings.TrimSpace(value.String), 64)
+	if err != nil {
+		return nil, fmt.Errorf("%s: invalid lag value: %q: %s", l.proc.query, value.String, err)
+	}
+	if !l.proc.ms {
+		ms *= 1000
+	}
+	opts := c.lagOptions(levelName)
+	opts.clockOffset = 0 // lag computed by MySQL, not from timestamps
+	lag, meta := computeLag(rawLagInputs{ms: ms, ok: true, replica: true}, opts)
+	return []blip.MetricValue{{Name: "current", Type: blip.GAUGE, Value: lag, Meta: meta}}, nil
+}
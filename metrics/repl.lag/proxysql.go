@@ -0,0 +1,95 @@
+// Copyright 2024 Block, Inc.
+
+package repllag
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"math"
+
+	"github.com/cashapp/blip"
+)
+
+// This file reports replication lag of backends as seen by ProxySQL. The
+// monitored instance is the ProxySQL admin interface (port 6032, by default),
+// not MySQL. ProxySQL monitor checks replication lag of backends (in seconds)
+// and logs it in monitor.mysql_server_replication_lag_log. The query returns
+// the latest check for each backend, ordered by backend so metrics are reported
+// in the same order every collection. repl_lag is NULL if the check failed.
+const proxySQLLagQuery = `SELECT
+  hostname,
+  port,
+  repl_lag
+FROM
+  monitor.mysql_server_replication_lag_log l
+WHERE
+  time_start_us = (
+    SELECT MAX(time_start_us) FROM monitor.mysql_server_replication_lag_log
+    WHERE hostname = l.hostname AND port = l.port
+  )
+ORDER BY
+  hostname, port
+`
+
+// proxySQLProbeQuery is used by writer=auto to detect the ProxySQL admin
+// interface. The monitor schema exists only in ProxySQL.
+const proxySQLProbeQuery = "SELECT COUNT(*) FROM monitor.mysql_server_replication_lag_log"
+
+// isProxySQL returns true if the monitored instance is a ProxySQL admin interface.
+func (c *Lag) isProxySQL(ctx context.Context) bool {
+	var n int
+	if err := c.db.QueryRowContext(ctx, proxySQLProbeQuery).Scan(&n); err != nil {
+		Log.Debug("repl.lag: not ProxySQL: %s", err)
+		return false
+	}
+	return true
+}
+
+// collectProxySQL reports repl.lag.current for each backend with Meta key
+// "backend" = "hostname:port". If ProxySQL cannot check a backend (repl_lag
+// is NULL), the backend is reported like no heartbeat: absent value or dropped.
+func (c *Lag) collectProxySQL(ctx context.Context, levelName string) ([]blip.MetricValue, error) {
+	rows, err := c.db.QueryContext(ctx, proxySQLLagQuery)
+	if err != nil {
+		return nil, fmt.Errorf("could not check replication lag, check that the host is a ProxySQL admin interface and that monitor is enabled. Err: %w", err)
+	}
+	defer rows.Close()
+
+	var lagMetrics []blip.MetricValue
+	for rows.Next() {
+		var (
+			hostname string
+			port     int
+			replLag  sql.NullFloat64 // seconds
+		)
+		if err := rows.Scan(&hostname, &port, &replLag); err != nil {
+			return nil, err
+		}
+		backend := fmt.Sprintf("%s:%d", hostname, port)
+		ok := replLag.Valid && replLag.Float64 >= 0
+		if !ok && c.dropNoHeartbeat[levelName] {
+			Log.Debug("(repl.lag from ProxySQL): backend %s: no lag, dropped", backend)
+			continue
+		}
+		opts := c.lagOptions(levelName)
+		opts.clockOffset = 0 // ProxySQL reports lag, not timestamps
+		value, meta := computeLag(rawLagInputs{
+			ms:      math.Floor(replLag.Float64 * 1000), // as milliseconds
+			ok:      ok,
+			replica: true,
+			backend: backend,
+		}, opts)
+		lagMetrics = append(lagMetrics, blip.MetricValue{
+			Name:  "current",
+			Type:  blip.GAUGE,
+			Value: value,
+			Meta:  meta,
+		})
+		Log.Debug("(repl.lag from ProxySQL): backend %s: lag=%d ms", backend, int(value))
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return lagMetrics, nil
+}
@@ -0,0 +1,123 @@
+// Copyright 2024 Block, Inc.
+
+package repllag
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"math"
+	"strings"
+	"time"
+
+	"github.com/cashapp/blip"
+	"github.com/cashapp/blip/sqlutil"
+)
+
+// This file reads heartbeats written by Percona pt-heartbeat. Unlike the Blip
+// heartbeat, pt-heartbeat writes only the timestamp (column ts, a string like
+// 2024-05-28T18:50:05.001230) and server ID of the source, so lag is simply
+// NOW() - ts when collected. There's no reader goroutine: the heartbeat table
+// is queried on each collection. NOW() and ts are compared as strings from
+// MySQL to avoid time zone conversion: pt-heartbeat writes local time (the same
+// time zone as NOW) unless it runs with --utc (then use option pt-utc=yes).
+
+const (
+	DEFAULT_PT_HEARTBEAT_TABLE = "percona.heartbeat"
+	DEFAULT_PT_TS_COLUMN       = "ts"
+	DEFAULT_PT_SERVER_ID_COL   = "server_id"
+)
+
+// ptTimeFormat is the format of pt-heartbeat ts and NOW(6) as strings after
+// 'T' is replaced with a space.
+const ptTimeFormat = "2006-01-02 15:04:05.999999"
+
+// ptHeartbeatQuery returns the query to read the latest pt-heartbeat.
+func ptHeartbeatQuery(opts map[string]string) string {
+	table := opts[OPT_HEARTBEAT_TABLE]
+	if table == "" {
+		table = DEFAULT_PT_HEARTBEAT_TABLE
+	}
+	tsCol := strings.TrimSpace(opts[OPT_PT_TS_COLUMN])
+	if tsCol == "" {
+		tsCol = DEFAULT_PT_TS_COLUMN
+	}
+	tsCol = sqlutil.QuoteIdentifier(tsCol)
+	idCol := strings.TrimSpace(opts[OPT_PT_SERVER_ID_COLUMN])
+	if idCol == "" {
+		idCol = DEFAULT_PT_SERVER_ID_COL
+	}
+	idCol = sqlutil.QuoteIdentifier(idCol)
+	now := "NOW(6)"
+	if blip.Bool(opts[OPT_PT_UTC]) {
+		now = "UTC_TIMESTAMP(6)"
+	}
+	where := ""
+	if srcId := sqlutil.CleanObjectName(opts[OPT_HEARTBEAT_SOURCE_ID]); srcId != "" {
+		where = fmt.Sprintf(" WHERE %s = '%s'", idCol, strings.ReplaceAll(srcId, "'", ""))
+	}
+	return fmt.Sprintf("SELECT CAST(%s AS CHAR), CAST(%s AS CHAR), CAST(%s AS CHAR) FROM %s%s ORDER BY %s DESC LIMIT 1",
+		now, tsCol, idCol, sqlutil.QuoteQualifiedName(table, "percona"), where, tsCol)
+}
+
+// collectPtHeartbeat reads the latest pt-heartbeat and reports lag as NOW() - ts.
+func (c *Lag) collectPtHeartbeat(ctx context.Context, levelName string) ([]blip.MetricValue, error) {
+	l := c.atLevel[levelName]
+
+	// if isReplCheck is supplied, check if it's a replica
+	if c.replCheck != "" {
+		isRepl := 1
+		query := "SELECT " + sqlutil.AndVars(c.replCheck)
+		if err := c.db.QueryRowContext(ctx, query).Scan(&isRepl); err != nil {
+			return nil, fmt.Errorf("checking if instance is replica failed, please check value of %s. Err: %w", OPT_REPL_CHECK, err)
+		}
+		if isRepl == 0 {
+			return c.notAReplica(levelName), nil
+		}
+	}
+
+	var now, ts, srcId string
+	err := c.db.QueryRowContext(ctx, l.ptQuery).Scan(&now, &ts, &srcId)
+	if err != nil {
+		if err != sql.ErrNoRows {
+			return nil, fmt.Errorf("cannot read pt-heartbeat: %w", err)
+		}
+		if c.dropNoHeartbeat[levelName] {
+			return nil, nil
+		}
+		value, meta := computeLag(rawLagInputs{ok: false, replica: true}, c.lagOptions(levelName))
+		return []blip.MetricValue{{Name: "current", Type: blip.GAUGE, Value: value, Meta: meta}}, nil
+	}
+	lag, err := ptLag(now, ts)
+	if err != nil {
+		return nil, err
+	}
+	if l.hbFreq > 0 { // heartbeat-freq: remove sawtooth floor
+		lag -= math.Min(lag, float64(l.hbFreq.Milliseconds()))
+	}
+	value, meta := computeLag(rawLagInputs{ms: lag, ok: true, replica: true, sourceHost: srcId}, c.lagOptions(levelName))
+	return []blip.MetricValue{{
+		Name:  "current",
+		Type:  blip.GAUGE,
+		Value: value,
+		Meta:  meta,
+	}}, nil
+}
+
+// ptLag returns now - ts in milliseconds. Both are datetime strings from MySQL
+// in the same time zone. Negative lag (clock skew) is reported as zero.
+func ptLag(now, ts string) (float64, error) {
+	n, err := time.Parse(ptTimeFormat, strings.Replace(now, "T", " ", 1))
+	if err != nil {
+		return 0, fmt.Errorf("cannot parse NOW(): %s", err)
+	}
+	t, err := time.Parse(ptTimeFormat, strings.Replace(ts, "T", " ", 1))
+	if err != nil {
+		return 0, fmt.Errorf("cannot parse pt-heartbeat ts %q: %s", ts, err)
+	}
+	lag := math.Floor(float64(n.Sub(t).Microseconds()) / 1000.0) // as milliseconds
+	if lag < 0 {
+		lag = 0
+	}
+	return lag, nil
+}
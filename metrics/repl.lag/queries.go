@@ -0,0 +1,96 @@
+// Copyright 2024 Block, Inc.
+
+package repllag
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/cashapp/blip/sqlutil"
+)
+
+// querier is implemented by heartbeat readers that report their query and its
+// args, like heartbeat.BlipReader.
+type querier interface {
+	Query() string
+	Args() []interface{}
+}
+
+// EffectiveQueries returns the SQL queries that Collect runs, after all options
+// are applied (like now-precision, heartbeat table, tag, and key), for support
+// and debugging. The map is keyed on level and writer, like "kpi/pfs", or level
+// and option for queries run by an option, like "kpi/collect-when". Other keys:
+//
+//   - level/pfs/replication_connection_status: pfs query when there are no workers
+//   - level/repl-check: replica check run before the pt-heartbeat query
+//   - level/diagnostic-dump/key: diagnostic-dump queries, keyed on meta key
+//
+// If there are multiple heartbeat readers (blip), their queries are separated by
+// a newline. Heartbeat reader queries have ? placeholders, and their args follow
+// in a comment, like "... -- args: ["m1" "etl"]". Custom writers and injected readers (NewLagWithReader) have no
+// queries. Queries are plain SQL, so nothing is redacted.
+func (c *Lag) EffectiveQueries() map[string]string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	queries := map[string]string{}
+	for levelName, l := range c.atLevel {
+		writers := append([]string{c.lagWriterIn[levelName]}, l.fallback...)
+		if l.compare != "" {
+			writers = append(writers, l.compare)
+		}
+		for _, writer := range writers {
+			key := levelName + "/" + writer
+			switch writer {
+			case LAG_WRITER_PFS:
+				queries[key] = l.pfsQuery
+				queries[key+"/"+SOURCE_TABLE_CONNECTION] = l.pfsFbQuery
+			case LAG_WRITER_BLIP:
+				var q []string
+				for _, r := range c.lagReaders {
+					if qr, ok := r.(querier); ok {
+						q = append(q, fmt.Sprintf("%s -- args: %q", qr.Query(), qr.Args()))
+					}
+				}
+				if len(q) > 0 {
+					queries[key] = strings.Join(q, "\n")
+				}
+			case LAG_WRITER_PT:
+				queries[key] = l.ptQuery
+				if c.replCheck != "" {
+					queries[levelName+"/"+OPT_REPL_CHECK] = "SELECT " + sqlutil.AndVars(c.replCheck)
+				}
+			case LAG_WRITER_PROXYSQL:
+				queries[key] = proxySQLLagQuery
+			case LAG_WRITER_GROUP:
+				queries[key] = groupReplLagQuery
+			case LAG_WRITER_MARIADB:
+				queries[key] = mariadbLagQuery
+			case LAG_WRITER_PROC:
+				if l.proc != nil {
+					queries[key] = l.proc.query
+				}
+			}
+		}
+		if l.whenQuery != "" {
+			queries[levelName+"/"+OPT_COLLECT_WHEN] = l.whenQuery
+		}
+		if l.delayQuery != "" {
+			queries[levelName+"/"+OPT_SUBTRACT_DELAY] = l.delayQuery
+		}
+		if l.posQuery != "" {
+			queries[levelName+"/"+OPT_REPORT_POS_BACKLOG] = l.posQuery
+		}
+		if l.filterQuery != "" {
+			queries[levelName+"/"+OPT_REPORT_FILTERS] = l.filterQuery
+		}
+		if l.fileQuery != "" {
+			queries[levelName+"/"+OPT_REPORT_FILE_BACKLOG] = l.fileQuery
+		}
+		if l.dump != nil {
+			for _, q := range diagnosticQueries {
+				queries[levelName+"/"+OPT_DIAG_DUMP+"/"+q.key] = q.query
+			}
+		}
+	}
+	return queries
+}
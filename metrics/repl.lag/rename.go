@@ -0,0 +1,62 @@
+// Copyright 2024 Block, Inc.
+
+package repllag
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/cashapp/blip"
+)
+
+// channelRename is one channel-rename rule: channel names that match re are
+// replaced by repl, which can reference capturing groups like $1.
+type channelRename struct {
+	re   *regexp.Regexp
+	repl string
+}
+
+// parseChannelRename parses the channel-rename option value like
+// "^db(\d+)_shard(\d+)_ch$=>db$1-s$2; ^legacy$=>main": rules separated by
+// semicolons (not commas because regex can contain commas). It returns nil if
+// the value is empty.
+func parseChannelRename(s string) ([]channelRename, error) {
+	if strings.TrimSpace(s) == "" {
+		return nil, nil
+	}
+	var rules []channelRename
+	for _, rule := range strings.Split(s, ";") {
+		if strings.TrimSpace(rule) == "" {
+			continue // trailing semicolon
+		}
+		pattern, repl, ok := strings.Cut(rule, "=>")
+		if !ok {
+			return nil, fmt.Errorf("invalid %s: %s: missing '=>' (format: pattern=>replacement)", OPT_CHANNEL_RENAME, rule)
+		}
+		re, err := regexp.Compile(strings.TrimSpace(pattern))
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s: %s: %s", OPT_CHANNEL_RENAME, rule, err)
+		}
+		rules = append(rules, channelRename{re: re, repl: strings.TrimSpace(repl)})
+	}
+	return rules, nil
+}
+
+// renameChannels renames group key channel by the first matching rule. It's
+// done after default-channel-name, so the default channel is matched by that
+// name, not an empty string.
+func renameChannels(metrics []blip.MetricValue, rules []channelRename) {
+	for i := range metrics {
+		channel, ok := metrics[i].Group["channel"]
+		if !ok {
+			continue
+		}
+		for _, r := range rules {
+			if r.re.MatchString(channel) {
+				metrics[i].Group["channel"] = r.re.ReplaceAllString(channel, r.repl)
+				break
+			}
+		}
+	}
+}
@@ -0,0 +1,63 @@
+// Copyright 2024 Block, Inc.
+
+package repllag
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// This file handles option require-heartbeat (blip writer): Prepare fails if
+// there's no heartbeat or it's not advancing, instead of preparing and then
+// dropping (or reporting -1) at runtime. It's for strict deployments where a
+// missing heartbeat is a config error that should flag the monitor.
+
+// RequireHeartbeatWait is how long Prepare waits for the heartbeat to advance
+// with option require-heartbeat. It should be longer than the heartbeat write
+// frequency.
+var RequireHeartbeatWait = 3 * time.Second
+
+// RequireHeartbeatPoll is how often Prepare reads the heartbeat while waiting
+// for it to advance with option require-heartbeat.
+var RequireHeartbeatPoll = 100 * time.Millisecond
+
+// requireHeartbeat returns an error unless each heartbeat reader reads a
+// heartbeat that advances (ts changes) within RequireHeartbeatWait. A reader on
+// an instance that is not a replica passes: there's no heartbeat to require.
+// The caller must hold the lock.
+func (c *Lag) requireHeartbeat(ctx context.Context) error {
+	for _, r := range c.lagReaders {
+		first, err := r.ReadOnce(ctx)
+		if err != nil {
+			return fmt.Errorf("%s: cannot read heartbeat: %w", OPT_REQUIRE_HEARTBEAT, err)
+		}
+		if !first.Replica {
+			continue
+		}
+		if first.Milliseconds < 0 || first.LastTs.IsZero() {
+			return fmt.Errorf("%s: no heartbeat", OPT_REQUIRE_HEARTBEAT)
+		}
+		deadline := time.Now().Add(RequireHeartbeatWait)
+		for {
+			if time.Now().After(deadline) {
+				return fmt.Errorf("%s: heartbeat from %s not advancing: ts %s not changed in %s",
+					OPT_REQUIRE_HEARTBEAT, first.SourceId, first.LastTs, RequireHeartbeatWait)
+			}
+			select {
+			case <-ctx.Done():
+				return fmt.Errorf("%s: %w", OPT_REQUIRE_HEARTBEAT, ctx.Err())
+			case <-time.After(RequireHeartbeatPoll):
+			}
+			next, err := r.ReadOnce(ctx)
+			if err != nil {
+				return fmt.Errorf("%s: cannot read heartbeat: %w", OPT_REQUIRE_HEARTBEAT, err)
+			}
+			if next.LastTs.After(first.LastTs) {
+				Log.Debug("repl.lag: %s: heartbeat from %s advancing", OPT_REQUIRE_HEARTBEAT, next.SourceId)
+				break
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,80 @@
+// Copyright 2024 Block, Inc.
+
+package repllag
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+
+	"github.com/cashapp/blip"
+)
+
+// RetryWait is the wait before the first retry (option retries). It doubles
+// on each retry.
+var RetryWait = 50 * time.Millisecond
+
+// retryableErrnos are MySQL errors that are transient: the same query is
+// likely to succeed if retried.
+var retryableErrnos = map[uint16]bool{
+	1040: true, // ER_CON_COUNT_ERROR: too many connections
+	1053: true, // ER_SERVER_SHUTDOWN
+	1205: true, // ER_LOCK_WAIT_TIMEOUT
+	1213: true, // ER_LOCK_DEADLOCK
+	1317: true, // ER_QUERY_INTERRUPTED
+}
+
+// retryable returns true if err is transient: lost connection, network error,
+// or a MySQL error in retryableErrnos. Other errors are structural, like
+// Performance Schema disabled or unknown heartbeat table, and not retried.
+func retryable(err error) bool {
+	if errors.Is(err, driver.ErrBadConn) || errors.Is(err, mysql.ErrInvalidConn) {
+		return true
+	}
+	var netErr *net.OpError
+	if errors.As(err, &netErr) {
+		return true
+	}
+	var myErr *mysql.MySQLError
+	if errors.As(err, &myErr) {
+		return retryableErrnos[myErr.Number]
+	}
+	return false
+}
+
+// collectRetry returns the metrics from the writer, retrying transient
+// errors up to the number of times set by option retries.
+func (c *Lag) collectRetry(ctx context.Context, levelName, writer string) ([]blip.MetricValue, error) {
+	metrics, err := c.collectWriter(ctx, levelName, writer)
+	wait := RetryWait
+	for try := 1; try <= c.atLevel[levelName].retries && err != nil && retryable(err); try++ {
+		Log.Debug("repl.lag: %s: retry %d after %s: %s", levelName, try, wait, err)
+		select {
+		case <-ctx.Done():
+			return nil, err // last error, not context error
+		case <-time.After(wait):
+		}
+		metrics, err = c.collectWriter(ctx, levelName, writer)
+		wait *= 2
+	}
+	return metrics, err
+}
+
+// parseRetries returns the retries option value, or 0 if not set.
+func parseRetries(opts map[string]string) (int, error) {
+	retries := opts[OPT_RETRIES]
+	if retries == "" {
+		return 0, nil
+	}
+	n, err := strconv.Atoi(retries)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid %s: %s: must be an integer greater than or equal to 0", OPT_RETRIES, retries)
+	}
+	return n, nil
+}
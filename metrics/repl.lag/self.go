@@ -0,0 +1,83 @@
+// Copyright 2024 Block, Inc.
+
+package repllag
+
+import (
+	"context"
+	"math"
+
+	"github.com/cashapp/blip"
+)
+
+// prepareSelfIds sets the IDs that identify the local instance as a heartbeat
+// source: @@server_id (pt-heartbeat server_id, or Blip heartbeat source-id if
+// set to the server ID) and, for writer blip, the monitor ID (the default Blip
+// heartbeat source ID). A replica reading a heartbeat from one of these IDs is
+// reading its own heartbeat, which is a misconfiguration: lag is ~0 falsely.
+// If @@server_id cannot be read, it's not checked. It's not read for a reader
+// from NewLagWithReader because the reader is configured by the caller.
+func (c *Lag) prepareSelfIds(ctx context.Context, levelName string, writers []string) {
+	l := c.atLevel[levelName]
+	l.selfIds = nil
+	serverId := false
+	for _, writer := range writers {
+		switch writer {
+		case LAG_WRITER_BLIP:
+			if l.selfIds == nil {
+				l.selfIds = map[string]bool{}
+			}
+			if c.monitorId != "" {
+				l.selfIds[c.monitorId] = true
+			}
+			serverId = serverId || c.reader == nil
+		case LAG_WRITER_PT:
+			if l.selfIds == nil {
+				l.selfIds = map[string]bool{}
+			}
+			serverId = true
+		}
+	}
+	if !serverId {
+		return
+	}
+	var id string
+	if err := c.db.QueryRowContext(ctx, "SELECT @@server_id").Scan(&id); err != nil {
+		Log.Debug("repl.lag: %s: cannot read @@server_id for self heartbeat check, ignoring: %s", levelName, err)
+		return
+	}
+	l.selfIds[id] = true
+}
+
+// selfHeartbeat reports repl.lag.current from a self heartbeat (see
+// prepareSelfIds) as absent (absent-value: -1, NaN, or dropped) and, if any,
+// adds repl.lag.self_heartbeat = 1 with Meta source.
+func (c *Lag) selfHeartbeat(levelName string, metrics []blip.MetricValue) []blip.MetricValue {
+	l := c.atLevel[levelName]
+	if len(l.selfIds) == 0 || (l.used != LAG_WRITER_BLIP && l.used != LAG_WRITER_PT) {
+		return metrics
+	}
+	var self string
+	n := 0
+	for _, m := range metrics {
+		if m.Name == "current" && l.selfIds[m.Meta["source"]] {
+			self = m.Meta["source"]
+			if l.absent == ABSENT_VALUE_DROP {
+				continue
+			}
+			m.Value = math.NaN() // absent: see reportAbsent
+		}
+		metrics[n] = m
+		n++
+	}
+	metrics = metrics[:n]
+	if self == "" {
+		return metrics
+	}
+	Log.Warn("repl.lag: %s: reading own heartbeat from source %s: lag is not reported; check the heartbeat source ID", levelName, self)
+	return append(metrics, blip.MetricValue{
+		Name:  "self_heartbeat",
+		Type:  blip.GAUGE,
+		Value: 1,
+		Meta:  map[string]string{"source": self},
+	})
+}
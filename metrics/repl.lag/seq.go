@@ -0,0 +1,47 @@
+// Copyright 2024 Block, Inc.
+
+package repllag
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+)
+
+// This file handles options heartbeat-seq-col and heartbeat-seq-dsn: lag from a
+// heartbeat sequence number instead of timestamps, which is more robust to clock
+// skew between source and replica. The Blip heartbeat reader reads the seq applied
+// on the replica and the latest seq on the source (heartbeat-seq-dsn); lag is the
+// difference times the heartbeat write frequency. See heartbeat.SeqLag.
+
+// openSeqDB returns the source DB for heartbeat-seq-col, or nil if the option is
+// not set. The caller must close it.
+func (c *Lag) openSeqDB(options map[string]string) (*sql.DB, error) {
+	if options[OPT_HEARTBEAT_SEQ_COL] == "" {
+		return nil, nil
+	}
+	dsn := options[OPT_HEARTBEAT_SEQ_DSN]
+	if dsn == "" {
+		return nil, fmt.Errorf("%s requires %s: the source from which to read the latest sequence number", OPT_HEARTBEAT_SEQ_COL, OPT_HEARTBEAT_SEQ_DSN)
+	}
+	db, err := c.openDB(dsn)
+	if err != nil {
+		return nil, fmt.Errorf("cannot open %s: %s", OPT_HEARTBEAT_SEQ_DSN, err)
+	}
+	return db, nil
+}
+
+// seqCol returns the quoted column for BlipReaderArgs.SeqCol if it exists in
+// the heartbeat table, else "". If the column does not exist, lag is measured
+// from timestamps (with a warning), same as when the column is NULL.
+func seqCol(ctx context.Context, db *sql.DB, table, col string) string {
+	if col == "" {
+		return ""
+	}
+	quoted, ok := heartbeatCol(ctx, db, table, col)
+	if !ok {
+		Log.Warn("repl.lag: %s: column %s not in %s, measuring lag from ts", OPT_HEARTBEAT_SEQ_COL, col, table)
+		return ""
+	}
+	return quoted
+}
@@ -0,0 +1,74 @@
+// Copyright 2024 Block, Inc.
+
+package repllag
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+
+	"github.com/cashapp/blip"
+)
+
+// capSeries keeps at most max repl.lag.current series (option max-series),
+// keeping the series with the greatest lag. Absent values (-1, NaN) are kept
+// first because unknown lag might be the worst. Other metrics grouped by
+// channel (like backlog) are kept only if the channel of a kept current series
+// matches. It returns the metrics and the number of current series dropped.
+func capSeries(metrics []blip.MetricValue, max int) ([]blip.MetricValue, int) {
+	var current []int // indexes of current metrics
+	for i := range metrics {
+		if metrics[i].Name == "current" {
+			current = append(current, i)
+		}
+	}
+	if len(current) <= max {
+		return metrics, 0
+	}
+
+	// Sort by lag descending, absent first; stable to keep collection order on ties
+	sort.SliceStable(current, func(i, j int) bool {
+		return sortLag(metrics[current[i]].Value) > sortLag(metrics[current[j]].Value)
+	})
+	keep := map[int]bool{}
+	channels := map[string]bool{}
+	for _, i := range current[:max] {
+		keep[i] = true
+		channels[metrics[i].Group["channel"]] = true
+	}
+
+	n := 0
+	for i, m := range metrics {
+		if m.Name == "current" && !keep[i] {
+			continue
+		}
+		if channel, ok := m.Group["channel"]; ok && m.Name != "current" && !channels[channel] {
+			continue
+		}
+		metrics[n] = m
+		n++
+	}
+	return metrics[:n], len(current) - max
+}
+
+// sortLag returns v for sorting, or +Inf if v is absent.
+func sortLag(v float64) float64 {
+	if absent(v) {
+		return math.Inf(1)
+	}
+	return v
+}
+
+// parseMaxSeries returns the max-series option value, or 0 if not set.
+func parseMaxSeries(opts map[string]string) (int, error) {
+	max := opts[OPT_MAX_SERIES]
+	if max == "" {
+		return 0, nil
+	}
+	n, err := strconv.Atoi(max)
+	if err != nil || n < 1 {
+		return 0, fmt.Errorf("invalid %s: %s: must be an integer greater than 0", OPT_MAX_SERIES, max)
+	}
+	return n, nil
+}
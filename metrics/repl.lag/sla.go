@@ -0,0 +1,48 @@
+// Copyright 2024 Block, Inc.
+
+package repllag
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/cashapp/blip"
+)
+
+// This file handles option sla-ms: for teams with a lag freshness SLA, report
+// the remaining budget (repl.lag.sla_remaining) and whether it's breached
+// (repl.lag.sla_breached) for each current series, alongside current.
+
+// parseSLA returns the sla-ms value, or zero if not set.
+func parseSLA(v string) (float64, error) {
+	if v == "" {
+		return 0, nil
+	}
+	ms, err := strconv.ParseFloat(v, 64)
+	if err != nil || ms <= 0 {
+		return 0, fmt.Errorf("invalid %s: %q: must be a number of milliseconds greater than zero", OPT_SLA_MS, v)
+	}
+	return ms, nil
+}
+
+// slaMetrics returns metrics with sla_remaining and sla_breached appended for
+// each current series. Absent current values (no heartbeat, not a replica) are
+// skipped because the SLA can't be measured. Values must be milliseconds.
+func slaMetrics(metrics []blip.MetricValue, slaMs float64) []blip.MetricValue {
+	n := len(metrics)
+	for i := 0; i < n; i++ {
+		m := metrics[i]
+		if m.Name != "current" || absent(m.Value) {
+			continue
+		}
+		breached := 0.0
+		if m.Value > slaMs {
+			breached = 1
+		}
+		metrics = append(metrics,
+			blip.MetricValue{Name: "sla_remaining", Type: blip.GAUGE, Value: slaMs - m.Value, Group: m.Group, Meta: m.Meta},
+			blip.MetricValue{Name: "sla_breached", Type: blip.GAUGE, Value: breached, Group: m.Group, Meta: m.Meta},
+		)
+	}
+	return metrics
+}
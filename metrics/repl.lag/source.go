@@ -0,0 +1,61 @@
+// Copyright 2024 Block, Inc.
+
+package repllag
+
+import (
+	"github.com/cashapp/blip"
+)
+
+// pfsSource is the replication source of a channel from
+// replication_connection_status and replication_connection_configuration.
+type pfsSource struct {
+	host string
+	uuid string
+}
+
+// sourceChanged returns repl.lag.source_changed = 1 and true if the source of
+// the channel changed since the last collection at the level: the replica was
+// reconfigured (CHANGE REPLICATION SOURCE TO) while Blip is running. A change
+// is a different source UUID or host; an unknown (empty) value is not a change,
+// so a source that is first known (like after START REPLICA) is not reported.
+// On change, the last queued and processed transactions cached for the channel
+// are cleared because they're GTIDs from the old source, which would make the
+// first lag from the new source wrong.
+//
+// channel is the channel name from Performance Schema, and group is the channel
+// name reported (see default-channel-name).
+func (c *Lag) sourceChanged(levelName, channel, group string, src pfsSource) (blip.MetricValue, bool) {
+	l := c.atLevel[levelName]
+	if l.sources == nil {
+		l.sources = map[string]pfsSource{}
+	}
+	prev, ok := l.sources[channel]
+	l.sources[channel] = src
+	if !ok || !(changed(prev.uuid, src.uuid) || changed(prev.host, src.host)) {
+		return blip.MetricValue{}, false
+	}
+	Log.Warn("repl.lag: %s: channel %q: source changed from %s to %s", levelName, group, prev.name(), src.name())
+	delete(l.lastQueued, channel)
+	delete(l.lastProc, channel)
+	return blip.MetricValue{
+		Name:  "source_changed",
+		Type:  blip.GAUGE,
+		Value: 1,
+		Group: map[string]string{"channel": group},
+		Meta:  map[string]string{"source": src.name(), "previous_source": prev.name()},
+	}, true
+}
+
+// name returns the source host, or source UUID if host is unknown, like Meta
+// source on repl.lag.current (see sourceMeta).
+func (s pfsSource) name() string {
+	if s.host != "" {
+		return s.host
+	}
+	return s.uuid
+}
+
+// changed returns true if both values are known (not empty) and different.
+func changed(prev, cur string) bool {
+	return prev != "" && cur != "" && prev != cur
+}
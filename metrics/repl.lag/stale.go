@@ -0,0 +1,65 @@
+// Copyright 2024 Block, Inc.
+
+package repllag
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/cashapp/blip/heartbeat"
+)
+
+// This file handles stale Blip heartbeat lag for option stale-behavior. The
+// heartbeat reader reports the lag of the last heartbeat it read, so if the
+// writer is sparse (or stopped), consecutive collections can report the same
+// heartbeat. Whether to hold, grow, or drop that lag is an operator choice.
+
+const (
+	STALE_HOLD   = "hold"
+	STALE_GROW   = "grow"
+	STALE_ABSENT = "absent"
+)
+
+// freshRead is the last heartbeat timestamp from a source and when Blip
+// first collected it (the last fresh read).
+type freshRead struct {
+	lastTs time.Time // heartbeat.Lag.LastTs
+	at     time.Time // c.Now() when lastTs changed
+}
+
+// staleLag returns the lag and true if it's stale: the reader has not read a
+// new heartbeat from the source since the last collection. Stale lag is changed
+// by stale-behavior: hold returns the lag unchanged, grow adds the wall-clock
+// time since the last fresh read, and absent returns lag -1 (no heartbeat).
+// Lag without a heartbeat (LastTs is zero) or from a source is never stale.
+func (c *Lag) staleLag(levelName string, lag heartbeat.Lag) (heartbeat.Lag, bool) {
+	if !lag.Replica || lag.Milliseconds == -1 || lag.LastTs.IsZero() {
+		return lag, false
+	}
+	l := c.atLevel[levelName]
+	now := c.Now()
+	last, ok := l.fresh[lag.SourceId]
+	if !ok || !lag.LastTs.Equal(last.lastTs) {
+		l.fresh[lag.SourceId] = freshRead{lastTs: lag.LastTs, at: now}
+		return lag, false
+	}
+	switch l.stale {
+	case STALE_GROW:
+		lag.Milliseconds += now.Sub(last.at).Milliseconds()
+	case STALE_ABSENT:
+		lag.Milliseconds = -1
+	}
+	return lag, true
+}
+
+// parseStaleBehavior returns the stale-behavior option value, or hold if not set.
+func parseStaleBehavior(opts map[string]string) (string, error) {
+	switch stale := opts[OPT_STALE_BEHAVIOR]; stale {
+	case "":
+		return STALE_HOLD, nil
+	case STALE_HOLD, STALE_GROW, STALE_ABSENT:
+		return stale, nil
+	default:
+		return "", fmt.Errorf("invalid %s: %q: valid values: %s, %s, %s", OPT_STALE_BEHAVIOR, stale, STALE_HOLD, STALE_GROW, STALE_ABSENT)
+	}
+}
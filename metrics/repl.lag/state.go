@@ -0,0 +1,66 @@
+// Copyright 2024 Block, Inc.
+
+package repllag
+
+import "github.com/cashapp/blip"
+
+// ReplState is the replication state at a level from one collection: the
+// structured form of the metrics that Collect returns. It's valid only if
+// State returns no error.
+type ReplState struct {
+	Writer   string         // lag writer at the level: LAG_WRITER_ const
+	Replica  bool           // false if not a replica (or writer is none)
+	Channels []ChannelState // one per repl.lag.current series, in metric order
+
+	metrics []blip.MetricValue
+}
+
+// ChannelState is one repl.lag.current series: a replication channel (pfs),
+// source (blip and pt-heartbeat), backend (proxysql), or group member.
+type ChannelState struct {
+	Channel string            // group key channel, if any
+	Source  string            // meta source, if any
+	Backend string            // meta backend (proxysql), if any
+	Lag     float64           // repl.lag.current: milliseconds, or absent value
+	Backlog float64           // repl.lag.backlog (pfs), else 0
+	Meta    map[string]string // all meta, if any
+}
+
+// MetricValues returns the state as metrics, as returned by Collect but not
+// filtered by the metrics selected at the level (Domain.Metrics).
+func (s ReplState) MetricValues() []blip.MetricValue {
+	return s.metrics
+}
+
+// newReplState returns the state for the metrics collected by a writer.
+// Other metrics, like trend, are only in the metrics.
+func newReplState(writer string, replica bool, metrics []blip.MetricValue) ReplState {
+	s := ReplState{
+		Writer:  writer,
+		Replica: replica && writer != LAG_WRITER_NONE,
+		metrics: metrics,
+	}
+	for _, m := range metrics {
+		if m.Name != "current" {
+			continue
+		}
+		s.Channels = append(s.Channels, ChannelState{
+			Channel: m.Group["channel"],
+			Source:  m.Meta["source"],
+			Backend: m.Meta["backend"],
+			Lag:     m.Value,
+			Meta:    m.Meta,
+		})
+	}
+	for _, m := range metrics {
+		if m.Name != "backlog" {
+			continue
+		}
+		for i := range s.Channels {
+			if s.Channels[i].Channel == m.Group["channel"] {
+				s.Channels[i].Backlog = m.Value
+			}
+		}
+	}
+	return s
+}
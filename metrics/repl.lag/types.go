@@ -0,0 +1,43 @@
+// Copyright 2024 Block, Inc.
+
+package repllag
+
+import (
+	"sync"
+
+	"github.com/cashapp/blip"
+)
+
+// repl.lag metrics have different types: most are gauges, but some are
+// counters, like reader_restarts. Each metric is emitted with its declared type
+// (Help Metrics). Built-in writers and options set Type when they emit a metric,
+// but a custom writer (RegisterWriter) might not, so metrics with type UNKNOWN
+// are set to the declared type before the level options are applied.
+
+var (
+	metricTypesOnce sync.Once
+	metricTypes     map[string]byte // metric name => declared type
+)
+
+// declaredType returns the type of the metric name declared in Help, or
+// blip.UNKNOWN if the metric is not declared.
+func declaredType(name string) byte {
+	metricTypesOnce.Do(func() {
+		help := (&Lag{}).Help()
+		metricTypes = make(map[string]byte, len(help.Metrics))
+		for _, m := range help.Metrics {
+			metricTypes[m.Name] = m.Type
+		}
+	})
+	return metricTypes[name]
+}
+
+// setMetricTypes sets the declared type of metrics with type UNKNOWN. Metrics
+// with a type are not changed.
+func setMetricTypes(metrics []blip.MetricValue) {
+	for i := range metrics {
+		if metrics[i].Type == blip.UNKNOWN {
+			metrics[i].Type = declaredType(metrics[i].Name)
+		}
+	}
+}
@@ -0,0 +1,127 @@
+// Copyright 2024 Block, Inc.
+
+package repllag
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/cashapp/blip"
+)
+
+// This file implements the window and percentile options: report
+// repl.lag.current as a percentile of lag samples over a rolling window
+// instead of the instantaneous lag. The window is a ring buffer per series
+// with window / level freq samples because one sample is collected per
+// level interval.
+
+const DEFAULT_PERCENTILE = 95.0
+
+// lagWindow is a ring buffer of the last size lag samples for one series.
+type lagWindow struct {
+	samples []float64
+	next    int // index of next sample to overwrite when full
+	size    int
+}
+
+func (w *lagWindow) add(v float64) {
+	if len(w.samples) < w.size {
+		w.samples = append(w.samples, v)
+		return
+	}
+	w.samples[w.next] = v
+	w.next = (w.next + 1) % w.size
+}
+
+// percentile returns the p percentile (0 < p <= 100) of the samples using
+// the nearest-rank method.
+func (w *lagWindow) percentile(p float64) float64 {
+	sorted := make([]float64, len(w.samples))
+	copy(sorted, w.samples)
+	sort.Float64s(sorted)
+	rank := int(math.Ceil(p / 100 * float64(len(sorted))))
+	if rank < 1 {
+		rank = 1
+	}
+	return sorted[rank-1]
+}
+
+// windowSize returns the number of samples in the window at a level that
+// collects every freq. It's at least 1.
+func windowSize(window, freq string) (int, error) {
+	w, err := time.ParseDuration(window)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s: %s: %s", OPT_WINDOW, window, err)
+	}
+	f, err := time.ParseDuration(freq)
+	if err != nil || f <= 0 {
+		return 0, fmt.Errorf("invalid level freq for %s: %q", OPT_WINDOW, freq)
+	}
+	n := int(math.Ceil(float64(w) / float64(f)))
+	if n < 1 {
+		n = 1
+	}
+	return n, nil
+}
+
+// parsePercentile parses the percentile option, which defaults to 95.
+func parsePercentile(s string) (float64, error) {
+	if s == "" {
+		return DEFAULT_PERCENTILE, nil
+	}
+	p, err := strconv.ParseFloat(s, 64)
+	if err != nil || p <= 0 || p > 100 {
+		return 0, fmt.Errorf("invalid %s: %s: must be greater than 0 and less than or equal to 100", OPT_PERCENTILE, s)
+	}
+	return p, nil
+}
+
+// parseWindow returns the window size (number of samples) and percentile for
+// options window and percentile at a level that collects every freq. The size
+// is 0 if window is not set, in which case percentile is not parsed.
+func parseWindow(opts map[string]string, freq string) (int, float64, error) {
+	window := opts[OPT_WINDOW]
+	if window == "" {
+		return 0, 0, nil
+	}
+	size, err := windowSize(window, freq)
+	if err != nil {
+		return 0, 0, err
+	}
+	p, err := parsePercentile(opts[OPT_PERCENTILE])
+	if err != nil {
+		return 0, 0, err
+	}
+	return size, p, nil
+}
+
+// window adds each repl.lag.current value to its series window and replaces
+// the value with the percentile over the window. The instantaneous value is
+// saved in meta key "instant". Absent values are not added to the window and
+// not changed.
+func (l *lagLevel) window(metrics []blip.MetricValue) []blip.MetricValue {
+	for i := range metrics {
+		if metrics[i].Name != "current" || absent(metrics[i].Value) {
+			continue
+		}
+		key := seriesKey(metrics[i])
+		w, ok := l.windows[key]
+		if !ok {
+			w = &lagWindow{size: l.windowSize}
+			l.windows[key] = w
+		}
+		w.add(metrics[i].Value)
+
+		meta := map[string]string{}
+		for k, v := range metrics[i].Meta {
+			meta[k] = v
+		}
+		meta["instant"] = strconv.FormatFloat(metrics[i].Value, 'f', -1, 64)
+		metrics[i].Meta = meta
+		metrics[i].Value = w.percentile(l.percentile)
+	}
+	return metrics
+}
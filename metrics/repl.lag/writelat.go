@@ -0,0 +1,77 @@
+// Copyright 2024 Block, Inc.
+
+package repllag
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+
+	"github.com/go-sql-driver/mysql"
+
+	"github.com/cashapp/blip"
+	"github.com/cashapp/blip/heartbeat"
+	"github.com/cashapp/blip/sqlutil"
+)
+
+// This file reports repl.lag.source_write_latency for option
+// heartbeat-write-latency-col: the source write latency that the heartbeat
+// writer records in the heartbeat row, which separates time spent writing on
+// the source from replication (transport and apply) lag.
+
+// errUnknownColumn is MySQL error 1054: ER_BAD_FIELD_ERROR.
+const errUnknownColumn = 1054
+
+// writeLatencyCol returns the quoted column for BlipReaderArgs.WriteLatencyCol
+// if it exists in the heartbeat table, else "". If the column does not exist,
+// source_write_latency is not reported (with a warning) rather than breaking
+// the heartbeat read.
+func writeLatencyCol(ctx context.Context, db *sql.DB, table, col string) string {
+	if col == "" {
+		return ""
+	}
+	quoted, ok := heartbeatCol(ctx, db, table, col)
+	if !ok {
+		Log.Warn("repl.lag: %s: column %s not in %s, not reporting source_write_latency", OPT_HEARTBEAT_WRITE_LAT, col, table)
+		return ""
+	}
+	return quoted
+}
+
+// heartbeatCol returns the quoted column and true unless the column does not
+// exist in the heartbeat table. Other errors are ignored (true): the reader
+// reports them. The query times out after heartbeat.ReadTimeout or when ctx
+// (from Prepare) is done.
+func heartbeatCol(ctx context.Context, db *sql.DB, table, col string) (string, bool) {
+	quoted := sqlutil.QuoteIdentifier(col)
+	ctx, cancel := context.WithTimeout(ctx, heartbeat.ReadTimeout)
+	defer cancel()
+	rows, err := db.QueryContext(ctx, fmt.Sprintf("SELECT %s FROM %s LIMIT 0", quoted, table))
+	if err == nil {
+		rows.Close()
+		return quoted, true
+	}
+	var myErr *mysql.MySQLError
+	if errors.As(err, &myErr) && myErr.Number == errUnknownColumn {
+		return "", false
+	}
+	return quoted, true
+}
+
+// writeLatencyMetric returns repl.lag.source_write_latency for the heartbeat,
+// or false if the write latency was not read (column not set, absent, or NULL).
+func writeLatencyMetric(lag heartbeat.Lag) (blip.MetricValue, bool) {
+	if !lag.Replica || !lag.WriteLatency.Valid {
+		return blip.MetricValue{}, false
+	}
+	m := blip.MetricValue{
+		Name:  "source_write_latency",
+		Type:  blip.GAUGE,
+		Value: lag.WriteLatency.Float64,
+	}
+	if lag.SourceId != "" {
+		m.Meta = map[string]string{"source": lag.SourceId}
+	}
+	return m, true
+}
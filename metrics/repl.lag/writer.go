@@ -0,0 +1,226 @@
+// Copyright 2024 Block, Inc.
+
+package repllag
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/cashapp/blip"
+)
+
+// LagWriter is a source of replication lag selected by option writer. The
+// built-in writers (blip, pfs, proxysql, pt-heartbeat, group-replication,
+// proc, and mariadb) are registered by default. Register a custom writer with
+// RegisterWriter to collect lag from a source that Blip doesn't support, like
+// a proprietary heartbeat, without forking the collector.
+//
+// A LagWriter is shared by all Lag collectors (one per monitor), so it must
+// keep per-monitor state keyed on the Lag, or not keep state.
+type LagWriter interface {
+	// Prepare prepares the writer to collect at the level. It's called once
+	// per level when a plan is prepared. It returns an error if the writer is
+	// not available. The optional cleanup func is called when the plan is
+	// replaced or the monitor stops.
+	Prepare(ctx context.Context, c *Lag, levelName string, plan blip.Plan, opts map[string]string) (func(), error)
+
+	// Collect returns the lag metrics at the level. It must return
+	// repl.lag.current; it can return other repl.lag metrics, like backlog.
+	// If lag is unknown, current is NaN, which is reported as the absent value
+	// (option absent-value). Other values, like -1, are real lag.
+	Collect(ctx context.Context, c *Lag, levelName string) ([]blip.MetricValue, error)
+}
+
+// RegisterWriter registers a lag writer that can be used by name in option
+// writer. It returns an error if a writer with the name is already registered,
+// including the built-in writers. Names auto and none are reserved.
+func RegisterWriter(name string, w LagWriter) error {
+	if name == "" || name == "auto" || name == LAG_WRITER_NONE {
+		return fmt.Errorf("invalid lag writer name: %q: reserved", name)
+	}
+	wr.Lock()
+	defer wr.Unlock()
+	if _, ok := wr.writers[name]; ok {
+		return fmt.Errorf("lag writer %s already registered", name)
+	}
+	wr.writers[name] = w
+	blip.Debug("register lag writer %s", name)
+	return nil
+}
+
+// RemoveWriter removes the lag writer. This is used for testing, but it can
+// also be used to remove (or override) a built-in writer. Levels prepared with
+// the writer return an error from Collect until the plan is prepared again.
+func RemoveWriter(name string) {
+	wr.Lock()
+	defer wr.Unlock()
+	delete(wr.writers, name)
+	blip.Debug("removed lag writer %s", name)
+}
+
+// Writers returns the names of all registered lag writers, sorted.
+func Writers() []string {
+	wr.Lock()
+	defer wr.Unlock()
+	names := make([]string, 0, len(wr.writers))
+	for name := range wr.writers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// lookupWriter returns the registered lag writer, or false if not registered.
+func lookupWriter(name string) (LagWriter, bool) {
+	wr.Lock()
+	defer wr.Unlock()
+	w, ok := wr.writers[name]
+	return w, ok
+}
+
+// writerHelpValues returns the values of option writer in Help: auto, the
+// built-in writers, and registered custom writers.
+func writerHelpValues() map[string]string {
+	values := map[string]string{
+		"auto":              "Auto-determine best lag writer",
+		"blip":              "Native Blip heartbeat replication lag",
+		"pfs":               "Performance Schema (estimates lag from replication_connection_status if replication_applier_status_by_worker is empty)",
+		"proxysql":          "ProxySQL admin interface: backend lag from monitor.mysql_server_replication_lag_log",
+		"pt-heartbeat":      "Percona pt-heartbeat: lag = NOW() - ts",
+		"group-replication": "Group Replication: lag = transactions in certification and applier queues (not milliseconds)",
+		"proc":              "Stored procedure (option lag-proc): lag = column lag-proc-column",
+		"mariadb":           "MariaDB: Seconds_Behind_Master per connection from SHOW ALL SLAVES STATUS",
+		///"legacy": "Second_Behind_Slave|Replica from SHOW SHOW|REPLICA STATUS",
+	}
+	for _, name := range Writers() {
+		if _, ok := values[name]; !ok {
+			values[name] = "Custom writer (RegisterWriter)"
+		}
+	}
+	return values
+}
+
+// writerRepo holds registered lag writers. There's a single package instance.
+type writerRepo struct {
+	*sync.Mutex
+	writers map[string]LagWriter
+}
+
+var wr = &writerRepo{
+	Mutex: &sync.Mutex{},
+	writers: map[string]LagWriter{
+		LAG_WRITER_PFS:      pfsWriter{},
+		LAG_WRITER_BLIP:     blipWriter{},
+		LAG_WRITER_PROXYSQL: proxysqlWriter{},
+		LAG_WRITER_PT:       ptWriter{},
+		LAG_WRITER_GROUP:    groupWriter{},
+		LAG_WRITER_PROC:     procWriter{},
+		LAG_WRITER_MARIADB:  mariadbWriter{},
+	},
+}
+
+// DB returns the monitor database connection pool, from which custom writers
+// can collect lag.
+func (c *Lag) DB() *sql.DB {
+	return c.db
+}
+
+// --------------------------------------------------------------------------
+// Built-in writers
+// --------------------------------------------------------------------------
+
+type pfsWriter struct{}
+
+func (pfsWriter) Prepare(ctx context.Context, c *Lag, levelName string, plan blip.Plan, opts map[string]string) (func(), error) {
+	return nil, c.preparePFS(ctx, levelName)
+}
+
+func (pfsWriter) Collect(ctx context.Context, c *Lag, levelName string) ([]blip.MetricValue, error) {
+	return c.collectPFS(ctx, levelName)
+}
+
+type blipWriter struct{}
+
+func (blipWriter) Prepare(ctx context.Context, c *Lag, levelName string, plan blip.Plan, opts map[string]string) (func(), error) {
+	return c.prepareBlip(ctx, levelName, plan.MonitorId, plan.Name, opts)
+}
+
+func (blipWriter) Collect(ctx context.Context, c *Lag, levelName string) ([]blip.MetricValue, error) {
+	metrics, err := c.collectBlip(ctx, levelName)
+	if err == nil && c.atLevel[levelName].crossCheck {
+		metrics = c.crossCheck(ctx, levelName, metrics)
+	}
+	return metrics, err
+}
+
+type proxysqlWriter struct{}
+
+func (proxysqlWriter) Prepare(ctx context.Context, c *Lag, levelName string, plan blip.Plan, opts map[string]string) (func(), error) {
+	c.dropNoHeartbeat[levelName] = !reportNoHeartbeat(opts)
+	_, err := c.collectProxySQL(ctx, levelName)
+	return nil, err
+}
+
+func (proxysqlWriter) Collect(ctx context.Context, c *Lag, levelName string) ([]blip.MetricValue, error) {
+	return c.collectProxySQL(ctx, levelName)
+}
+
+type ptWriter struct{}
+
+func (ptWriter) Prepare(ctx context.Context, c *Lag, levelName string, plan blip.Plan, opts map[string]string) (func(), error) {
+	c.dropNoHeartbeat[levelName] = !reportNoHeartbeat(opts)
+	l := c.atLevel[levelName]
+	l.ptQuery = ptHeartbeatQuery(opts)
+	Log.Debug("repl.lag: pt-heartbeat: %s", l.ptQuery)
+	_, err := c.collectPtHeartbeat(ctx, levelName)
+	return nil, err
+}
+
+func (ptWriter) Collect(ctx context.Context, c *Lag, levelName string) ([]blip.MetricValue, error) {
+	return c.collectPtHeartbeat(ctx, levelName)
+}
+
+type groupWriter struct{}
+
+func (groupWriter) Prepare(ctx context.Context, c *Lag, levelName string, plan blip.Plan, opts map[string]string) (func(), error) {
+	c.dropNoHeartbeat[levelName] = !reportNoHeartbeat(opts)
+	_, err := c.collectGroupRepl(ctx, levelName)
+	return nil, err
+}
+
+func (groupWriter) Collect(ctx context.Context, c *Lag, levelName string) ([]blip.MetricValue, error) {
+	return c.collectGroupRepl(ctx, levelName)
+}
+
+type procWriter struct{}
+
+func (procWriter) Prepare(ctx context.Context, c *Lag, levelName string, plan blip.Plan, opts map[string]string) (func(), error) {
+	c.dropNoHeartbeat[levelName] = !reportNoHeartbeat(opts)
+	l := c.atLevel[levelName]
+	var err error
+	if l.proc, err = parseLagProc(opts); err != nil {
+		return nil, err
+	}
+	Log.Debug("repl.lag: proc: %s", l.proc.query)
+	_, err = c.collectProc(ctx, levelName)
+	return nil, err
+}
+
+func (procWriter) Collect(ctx context.Context, c *Lag, levelName string) ([]blip.MetricValue, error) {
+	return c.collectProc(ctx, levelName)
+}
+
+type mariadbWriter struct{}
+
+func (mariadbWriter) Prepare(ctx context.Context, c *Lag, levelName string, plan blip.Plan, opts map[string]string) (func(), error) {
+	c.dropNoHeartbeat[levelName] = !reportNoHeartbeat(opts)
+	_, err := c.collectMariaDB(ctx, levelName)
+	return nil, err
+}
+
+func (mariadbWriter) Collect(ctx context.Context, c *Lag, levelName string) ([]blip.MetricValue, error) {
+	return c.collectMariaDB(ctx, levelName)
+}
@@ -6,6 +6,9 @@ import (
 	"context"
 	"database/sql"
 	"fmt"
+	"strconv"
+	"strings"
+	"sync"
 
 	myerr "github.com/go-mysql/errors"
 
@@ -18,14 +21,44 @@ const (
 	DOMAIN = "repl"
 
 	NOT_A_REPLICA = -1
+	BROKEN        = -2 // repl.seconds_behind if NULL and null-behavior=broken
 
 	ERR_NO_ACCESS = "access-denied"
 
 	OPT_REPORT_NOT_A_REPLICA = "report-not-a-replica"
+	OPT_REPORT_READ_ONLY     = "report-read-only"
+	OPT_REPORT_RELAY         = "report-relay"
+	OPT_REPORT_BACKLOG       = "report-backlog"
+	OPT_REPORT_POSITION      = "report-position"
+	OPT_IGNORE_ERRNOS        = "ignore-errnos"
+	OPT_NULL_BEHAVIOR        = "null-behavior"
+
+	NULL_NOT_A_REPLICA = "not-a-replica"
+	NULL_BROKEN        = "broken"
+	NULL_ABSENT        = "absent"
 )
 
+// relayErrnos are Last_SQL_Errno values that indicate a relay log problem.
+// The SQL thread can be "running" but stuck on one of these errors.
+var relayErrnos = map[int64]bool{
+	1371: true, // ER_RELAY_LOG_FAIL: failed purging old relay logs
+	1380: true, // ER_RELAY_LOG_INIT: failed initializing relay log position
+	1594: true, // ER_SLAVE_RELAY_LOG_READ_FAILURE: relay log read failure (corrupt)
+	1595: true, // ER_SLAVE_RELAY_LOG_WRITE_FAILURE: relay log write failure
+}
+
 type replMetrics struct {
-	chedkRunning bool
+	chedkRunning   bool
+	reportReadOnly bool
+	reportRelay    bool
+	reportDelay    bool
+	reportStops    bool
+	reportBacklog  bool
+	reportPos      bool
+	reportErrno    bool
+	reportBehind   bool
+	nullBehavior   string         // repl.seconds_behind if NULL: NULL_* const
+	ignoreErrnos   map[int64]bool // Last_Errno values that don't affect running
 }
 
 type Repl struct {
@@ -35,7 +68,12 @@ type Repl struct {
 	stop            bool
 	dropNotAReplica map[string]bool
 	statusQuery     string
-	newTerms        bool
+
+	// stops_total: running -> not running transitions since Prepare, observed
+	// at any level. wasRunning is the last running value (-2 = unknown).
+	mu         sync.Mutex
+	stops      uint
+	wasRunning float64
 }
 
 var _ blip.Collector = &Repl{}
@@ -50,7 +88,7 @@ func NewRepl(db *sql.DB) *Repl {
 		},
 		dropNotAReplica: map[string]bool{},
 		statusQuery:     "SHOW SLAVE STATUS", // SHOW REPLICA STATUS as of 8.022
-		newTerms:        false,
+		wasRunning:      runningUnknown,
 	}
 }
 
@@ -72,6 +110,56 @@ func (c *Repl) Help() blip.CollectorHelp {
 					"no":  "Disabled: drop repl.running if not a replica",
 				},
 			},
+			OPT_REPORT_RELAY: {
+				Name:    OPT_REPORT_RELAY,
+				Desc:    "Report repl.relay_error and repl.relay_log_space",
+				Default: "no",
+				Values: map[string]string{
+					"yes": "Enabled: report repl.relay_error and repl.relay_log_space",
+					"no":  "Disabled: do not report relay log metrics",
+				},
+			},
+			OPT_REPORT_BACKLOG: {
+				Name:    OPT_REPORT_BACKLOG,
+				Desc:    "Report repl.backlog_bytes",
+				Default: "no",
+				Values: map[string]string{
+					"yes": "Enabled: report repl.backlog_bytes",
+					"no":  "Disabled: do not report repl.backlog_bytes",
+				},
+			},
+			OPT_REPORT_POSITION: {
+				Name:    OPT_REPORT_POSITION,
+				Desc:    "Report repl.gtid_executed and repl.exec_position",
+				Default: "no",
+				Values: map[string]string{
+					"yes": "Enabled: report repl.gtid_executed and repl.exec_position",
+					"no":  "Disabled: do not report replication coordinates",
+				},
+			},
+			OPT_IGNORE_ERRNOS: {
+				Name: OPT_IGNORE_ERRNOS,
+				Desc: "Comma-separated list of Last_Errno values that do not affect repl.running (replication is running if the only error is one of these)",
+			},
+			OPT_NULL_BEHAVIOR: {
+				Name:    OPT_NULL_BEHAVIOR,
+				Desc:    "How to report repl.seconds_behind if Seconds_Behind_Source is NULL (IO or SQL thread not running)",
+				Default: NULL_NOT_A_REPLICA,
+				Values: map[string]string{
+					NULL_NOT_A_REPLICA: "Report like not a replica: -1, or drop if " + OPT_REPORT_NOT_A_REPLICA + "=no",
+					NULL_BROKEN:        "Report -2: replica is configured but broken (not replicating)",
+					NULL_ABSENT:        "Drop repl.seconds_behind",
+				},
+			},
+			OPT_REPORT_READ_ONLY: {
+				Name:    OPT_REPORT_READ_ONLY,
+				Desc:    "Report repl.read_only",
+				Default: "no",
+				Values: map[string]string{
+					"yes": "Enabled: report repl.read_only",
+					"no":  "Disabled: do not report repl.read_only",
+				},
+			},
 		},
 		Metrics: []blip.CollectorMetric{
 			{
@@ -79,6 +167,60 @@ func (c *Repl) Help() blip.CollectorHelp {
 				Type: blip.GAUGE,
 				Desc: "1=running (no error), 0=not running, -1=not a replica",
 			},
+			{
+				Name: "read_only",
+				Type: blip.GAUGE,
+				Desc: "1=read_only or super_read_only ON, 0=both OFF (also reported if option " + OPT_REPORT_READ_ONLY + "=yes)",
+			},
+			{
+				Name: "relay_error",
+				Type: blip.GAUGE,
+				Desc: "1=Last_SQL_Errno is a relay log error, 0=no relay log error (also reported if option " + OPT_REPORT_RELAY + "=yes)",
+			},
+			{
+				Name: "relay_log_space",
+				Type: blip.GAUGE,
+				Desc: "Relay_Log_Space: total size of all relay logs (also reported if option " + OPT_REPORT_RELAY + "=yes)",
+				Unit: "bytes",
+			},
+			{
+				Name: "backlog_bytes",
+				Type: blip.GAUGE,
+				Desc: "Bytes received but not applied: read minus executed source log position, or Relay_Log_Space if the positions are in different log files (also reported if option " + OPT_REPORT_BACKLOG + "=yes)",
+				Unit: "bytes",
+			},
+			{
+				Name: "gtid_executed",
+				Type: blip.GAUGE,
+				Desc: "Always 1 with meta gtid_executed = Executed_Gtid_Set, if GTIDs are enabled (also reported if option " + OPT_REPORT_POSITION + "=yes)",
+			},
+			{
+				Name: "exec_position",
+				Type: blip.GAUGE,
+				Desc: "Exec_Source_Log_Pos with meta file = Relay_Source_Log_File: source binary log coordinate executed by the SQL thread (also reported if option " + OPT_REPORT_POSITION + "=yes)",
+			},
+			{
+				Name: "last_errno",
+				Type: blip.GAUGE,
+				Desc: "Last_Errno: last replication error number, 0 if no error (reported even if the error is in option " + OPT_IGNORE_ERRNOS + ")",
+			},
+			{
+				Name: "configured_delay",
+				Type: blip.GAUGE,
+				Desc: "SQL_Delay: intentional replica delay (SOURCE_DELAY), 0 if not delayed",
+				Unit: "s",
+			},
+			{
+				Name: "seconds_behind",
+				Type: blip.GAUGE,
+				Desc: "Seconds_Behind_Source, -1=not a replica; if NULL, see option " + OPT_NULL_BEHAVIOR,
+				Unit: "s",
+			},
+			{
+				Name: "stops_total",
+				Type: blip.CUMULATIVE_COUNTER,
+				Desc: "Number of times replication was observed to stop (running 1 -> 0) since the plan was prepared",
+			},
 		},
 		Errors: map[string]blip.CollectorHelpError{
 			ERR_NO_ACCESS: {
@@ -93,6 +235,11 @@ func (c *Repl) Help() blip.CollectorHelp {
 func (c *Repl) Prepare(ctx context.Context, plan blip.Plan) (func(), error) {
 	haveVersion := false
 
+	c.mu.Lock()
+	c.stops = 0
+	c.wasRunning = runningUnknown
+	c.mu.Unlock()
+
 LEVEL:
 	for _, level := range plan.Levels {
 		dom, ok := level.Collect[DOMAIN]
@@ -104,11 +251,46 @@ LEVEL:
 			return nil, fmt.Errorf("no metrics specified, expect at least one collector metric (run 'blip --print-domains' to list collector metrics)")
 		}
 
-		m := replMetrics{}
+		ignoreErrnos, err := parseErrnos(dom.Options[OPT_IGNORE_ERRNOS])
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s: %s", OPT_IGNORE_ERRNOS, err)
+		}
+
+		m := replMetrics{
+			reportReadOnly: blip.Bool(dom.Options[OPT_REPORT_READ_ONLY]),
+			reportRelay:    blip.Bool(dom.Options[OPT_REPORT_RELAY]),
+			reportBacklog:  blip.Bool(dom.Options[OPT_REPORT_BACKLOG]),
+			reportPos:      blip.Bool(dom.Options[OPT_REPORT_POSITION]),
+			nullBehavior:   NULL_NOT_A_REPLICA,
+			ignoreErrnos:   ignoreErrnos,
+		}
+		switch v := dom.Options[OPT_NULL_BEHAVIOR]; v {
+		case "":
+		case NULL_NOT_A_REPLICA, NULL_BROKEN, NULL_ABSENT:
+			m.nullBehavior = v
+		default:
+			return nil, fmt.Errorf("invalid %s: %s: valid values are %s, %s, %s", OPT_NULL_BEHAVIOR, v, NULL_NOT_A_REPLICA, NULL_BROKEN, NULL_ABSENT)
+		}
 		for i := range dom.Metrics {
 			switch dom.Metrics[i] {
 			case "running":
 				m.chedkRunning = true
+			case "read_only":
+				m.reportReadOnly = true
+			case "relay_error", "relay_log_space":
+				m.reportRelay = true
+			case "configured_delay":
+				m.reportDelay = true
+			case "last_errno":
+				m.reportErrno = true
+			case "seconds_behind":
+				m.reportBehind = true
+			case "stops_total":
+				m.reportStops = true
+			case "backlog_bytes":
+				m.reportBacklog = true
+			case "gtid_executed", "exec_position":
+				m.reportPos = true
 			default:
 				return nil, fmt.Errorf("invalid collector metric: %s (run 'blip --print-domains' to list collector metrics)", dom.Metrics[i])
 			}
@@ -136,7 +318,6 @@ LEVEL:
 		haveVersion = true
 		if major == 8 && patch >= 22 {
 			c.statusQuery = "SHOW REPLICA STATUS"
-			c.newTerms = true
 		}
 		blip.Debug("mysql %d.x.%d %s", major, patch, c.statusQuery)
 	}
@@ -154,34 +335,31 @@ func (c *Repl) Collect(ctx context.Context, levelName string) ([]blip.MetricValu
 		return nil, nil
 	}
 
-	// Return SHOW SLAVE|REPLICA STATUS as map[string]string, which can be nil
-	// if MySQL is not a replica
-	replStatus, err := sqlutil.RowToMap(ctx, c.db, c.statusQuery)
+	// Return SHOW SLAVE|REPLICA STATUS, one per channel, which can be nil if
+	// MySQL is not a replica. Except for backlog_bytes and exec_position,
+	// metrics are from the last row, like sqlutil.RowToMap.
+	channels, err := sqlutil.ReplicaStatusRows(ctx, c.db, c.statusQuery)
 	if err != nil {
 		return c.collectError(err)
 	}
+	var replStatus *sqlutil.ReplicaStatus
+	if len(channels) > 0 {
+		replStatus = &channels[len(channels)-1]
+	}
 
 	metrics := []blip.MetricValue{}
 
+	// Count running -> not running transitions for repl.stops_total at every
+	// level so a stop is counted once no matter which level observes it
+	running := replRunning(replStatus, rm.ignoreErrnos)
+	stops := c.observe(running)
+
 	// Report repl.running: 1=running, 0=not running, -1=not a replica
-	//
-	// NOTE: values are literal, not passed through sqlutil.Float64, so
-	//       we look for "Yes" not 1, which works in this specific case.
 	if rm.chedkRunning {
-		var running float64 // 0 = not running by default
-		if len(replStatus) == 0 {
-			// no SHOW SLAVE|REPLICA STATUS output = not a replica
-			running = float64(NOT_A_REPLICA)
-		} else if (replStatus["Slave_IO_Running"] == "Yes" || replStatus["Replica_IO_Running"] == "Yes") &&
-			(replStatus["Slave_SQL_Running"] == "Yes" || replStatus["Replica_SQL_Running"] == "Yes") && replStatus["Last_Errno"] == "0" {
-			// running if a replica and those ^ 3 conditions are true
-			running = 1
-		}
-
-		if running == NOT_A_REPLICA {
-			if c.dropNotAReplica[levelName] {
-				return nil, nil
-			}
+		if running == NOT_A_REPLICA && c.dropNotAReplica[levelName] {
+			// Drop repl.running (and the other replica metrics) but report
+			// repl.read_only, if enabled
+			return c.collectReadOnly(ctx, rm, nil)
 		}
 
 		m := blip.MetricValue{
@@ -191,21 +369,289 @@ func (c *Repl) Collect(ctx context.Context, levelName string) ([]blip.MetricValu
 			Meta:  map[string]string{"source": ""},
 		}
 		// Make sure we have results.
-		if len(replStatus) != 0 {
-			if c.newTerms {
-				m.Meta["source"] = replStatus["Source_Host"]
-			} else {
-				m.Meta["source"] = replStatus["Master_Host"]
-			}
+		if replStatus != nil {
+			m.Meta["source"] = replStatus.SourceHost
 		}
 		metrics = append(metrics, m)
 	}
 
+	// Report repl.relay_error and repl.relay_log_space, only if a replica
+	if rm.reportRelay && replStatus != nil {
+		metrics = append(metrics, relayMetrics(*replStatus)...)
+	}
+
+	// Report repl.backlog_bytes per channel, only if a replica
+	if rm.reportBacklog {
+		for _, status := range channels {
+			if m, ok := backlogBytes(status); ok {
+				metrics = append(metrics, m)
+			}
+		}
+	}
+
+	// Report repl.gtid_executed (once: it's global) and repl.exec_position per
+	// channel, only if a replica
+	if rm.reportPos && replStatus != nil {
+		if m, ok := gtidExecuted(*replStatus); ok {
+			metrics = append(metrics, m)
+		}
+		for _, status := range channels {
+			if m, ok := execPosition(status); ok {
+				metrics = append(metrics, m)
+			}
+		}
+	}
+
+	// Report repl.stops_total, only if a replica
+	if rm.reportStops && replStatus != nil {
+		metrics = append(metrics, blip.MetricValue{
+			Name:  "stops_total",
+			Type:  blip.CUMULATIVE_COUNTER,
+			Value: float64(stops),
+		})
+	}
+
+	// Report repl.last_errno, only if a replica. Ignored errnos are reported:
+	// option ignore-errnos affects only whether replication is running.
+	if rm.reportErrno && replStatus != nil && replStatus.LastErrno.Valid {
+		metrics = append(metrics, blip.MetricValue{
+			Name:  "last_errno",
+			Type:  blip.GAUGE,
+			Value: float64(replStatus.LastErrno.Int64),
+		})
+	}
+
+	// Report repl.configured_delay, only if a replica
+	if rm.reportDelay && replStatus != nil && replStatus.SQLDelay.Valid {
+		metrics = append(metrics, blip.MetricValue{
+			Name:  "configured_delay",
+			Type:  blip.GAUGE,
+			Value: float64(replStatus.SQLDelay.Int64),
+		})
+	}
+
+	// Report repl.seconds_behind: Seconds_Behind_Source, or -1 if not a
+	// replica, or per option null-behavior if NULL
+	if rm.reportBehind {
+		if m, ok := secondsBehind(replStatus, rm.nullBehavior, c.dropNotAReplica[levelName]); ok {
+			metrics = append(metrics, m)
+		}
+	}
+
 	// @todo collect other repl status metrics
 
+	return c.collectReadOnly(ctx, rm, metrics)
+}
+
+// collectReadOnly appends repl.read_only to metrics if enabled (metric read_only
+// or option report-read-only): 1=read_only or super_read_only, 0=neither. This
+// is reported whether or not MySQL is a replica.
+func (c *Repl) collectReadOnly(ctx context.Context, rm replMetrics, metrics []blip.MetricValue) ([]blip.MetricValue, error) {
+	if !rm.reportReadOnly {
+		return metrics, nil
+	}
+	readOnly, err := c.readOnly(ctx)
+	if err != nil {
+		return nil, err
+	}
+	metrics = append(metrics, blip.MetricValue{
+		Name:  "read_only",
+		Type:  blip.GAUGE,
+		Value: readOnly,
+	})
 	return metrics, nil
 }
 
+// runningUnknown is Repl.wasRunning before the first observation.
+const runningUnknown = -2
+
+// replRunning returns repl.running from SHOW REPLICA STATUS: 1=running, 0=not
+// running, -1=not a replica (no status). A Last_Errno in ignore is treated like
+// no error (Last_Errno=0).
+func replRunning(replStatus *sqlutil.ReplicaStatus, ignore map[int64]bool) float64 {
+	if replStatus == nil {
+		// no SHOW SLAVE|REPLICA STATUS output = not a replica
+		return float64(NOT_A_REPLICA)
+	}
+	if replStatus.IORunning == "Yes" && replStatus.SQLRunning == "Yes" &&
+		replStatus.LastErrno.Valid && (replStatus.LastErrno.Int64 == 0 || ignore[replStatus.LastErrno.Int64]) {
+		// running if a replica and those ^ 3 conditions are true
+		return 1
+	}
+	return 0 // not running
+}
+
+// secondsBehind returns repl.seconds_behind from SHOW REPLICA STATUS. If not a
+// replica (replStatus is nil), the value is -1, or it's dropped if dropNotAReplica.
+// Seconds_Behind_Source is NULL if the IO or SQL thread is not running, which
+// is different than not a replica: it's reported per nullBehavior (a NULL_*
+// const) as not a replica, broken (-2), or absent (dropped). It returns false
+// if the metric is dropped.
+func secondsBehind(replStatus *sqlutil.ReplicaStatus, nullBehavior string, dropNotAReplica bool) (blip.MetricValue, bool) {
+	m := blip.MetricValue{
+		Name: "seconds_behind",
+		Type: blip.GAUGE,
+	}
+	switch {
+	case replStatus != nil && replStatus.SecondsBehindSource.Valid:
+		m.Value = float64(replStatus.SecondsBehindSource.Int64)
+		return m, true
+	case replStatus != nil && nullBehavior == NULL_BROKEN:
+		m.Value = BROKEN
+		return m, true
+	case replStatus != nil && nullBehavior == NULL_ABSENT:
+		return m, false
+	}
+	// Not a replica, or NULL and null-behavior=not-a-replica
+	if dropNotAReplica {
+		return m, false
+	}
+	m.Value = NOT_A_REPLICA
+	return m, true
+}
+
+// parseErrnos parses option ignore-errnos: a comma-separated list of MySQL
+// error numbers, like "1062,1032". It returns nil if the value is empty.
+func parseErrnos(val string) (map[int64]bool, error) {
+	if strings.TrimSpace(val) == "" {
+		return nil, nil
+	}
+	errnos := map[int64]bool{}
+	for _, s := range strings.Split(val, ",") {
+		s = strings.TrimSpace(s)
+		n, err := strconv.ParseUint(s, 10, 16)
+		if err != nil || n == 0 {
+			return nil, fmt.Errorf("%q is not a MySQL error number", s)
+		}
+		errnos[int64(n)] = true
+	}
+	return errnos, nil
+}
+
+// observe saves the running value and returns the number of stops: running
+// 1 -> 0 transitions since Prepare.
+func (c *Repl) observe(running float64) uint {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.wasRunning == 1 && running == 0 {
+		c.stops++
+	}
+	c.wasRunning = running
+	return c.stops
+}
+
+// relayMetrics returns repl.relay_error and repl.relay_log_space from
+// SHOW REPLICA STATUS. relay_log_space is not reported if its value is invalid.
+func relayMetrics(replStatus sqlutil.ReplicaStatus) []blip.MetricValue {
+	relayError := 0.0
+	if replStatus.LastSQLErrno.Valid && relayErrnos[replStatus.LastSQLErrno.Int64] {
+		relayError = 1
+	}
+	metrics := []blip.MetricValue{{
+		Name:  "relay_error",
+		Type:  blip.GAUGE,
+		Value: relayError,
+	}}
+	if replStatus.RelayLogSpace.Valid {
+		metrics = append(metrics, blip.MetricValue{
+			Name:  "relay_log_space",
+			Type:  blip.GAUGE,
+			Value: float64(replStatus.RelayLogSpace.Int64),
+		})
+	}
+	return metrics
+}
+
+// backlogBytes returns repl.backlog_bytes for one channel (row) from
+// SHOW REPLICA STATUS: bytes received but not applied. If the IO and SQL
+// threads are at the same source log file, it's Read_Source_Log_Pos minus
+// Exec_Source_Log_Pos. Else, the difference cannot be computed from the status
+// (source log file sizes are not known), so it's Relay_Log_Space: an upper
+// bound. Meta channel is Channel_Name, if set. It returns false if the values
+// are invalid.
+func backlogBytes(status sqlutil.ReplicaStatus) (blip.MetricValue, bool) {
+	m := blip.MetricValue{
+		Name: "backlog_bytes",
+		Type: blip.GAUGE,
+	}
+	if status.Channel != "" {
+		m.Meta = map[string]string{"channel": status.Channel}
+	}
+	read, exec := status.ReadSourceLogPos, status.ExecSourceLogPos
+	if read.Valid && exec.Valid && status.SourceLogFile != "" && status.SourceLogFile == status.RelaySourceLogFile && read.Int64 >= exec.Int64 {
+		m.Value = float64(read.Int64 - exec.Int64)
+		return m, true
+	}
+	if !status.RelayLogSpace.Valid {
+		return m, false
+	}
+	m.Value = float64(status.RelayLogSpace.Int64)
+	return m, true
+}
+
+// gtidExecuted returns repl.gtid_executed from SHOW REPLICA STATUS: value 1
+// (an info metric) with meta gtid_executed = Executed_Gtid_Set, which is the
+// global gtid_executed of the replica, so it's the same for every channel.
+// It returns false if the set is empty: GTIDs are not enabled (file-pos mode).
+func gtidExecuted(status sqlutil.ReplicaStatus) (blip.MetricValue, bool) {
+	if status.ExecutedGtidSet == "" {
+		return blip.MetricValue{}, false
+	}
+	return blip.MetricValue{
+		Name:  "gtid_executed",
+		Type:  blip.GAUGE,
+		Value: 1,
+		Meta:  map[string]string{"gtid_executed": status.ExecutedGtidSet},
+	}, true
+}
+
+// execPosition returns repl.exec_position for one channel (row) from SHOW
+// REPLICA STATUS: the source binary log coordinate (file and position) executed
+// by the SQL thread. The value is Exec_Source_Log_Pos and meta file is
+// Relay_Source_Log_File. Meta mode is gtid if the channel replicates with GTID
+// auto-positioning (Auto_Position=1), where the coordinate is gtid_executed,
+// else file-pos. Meta channel is Channel_Name, if set. It returns false if the
+// values are invalid, like before the SQL thread executes anything.
+func execPosition(status sqlutil.ReplicaStatus) (blip.MetricValue, bool) {
+	if !status.ExecSourceLogPos.Valid || status.RelaySourceLogFile == "" {
+		return blip.MetricValue{}, false
+	}
+	m := blip.MetricValue{
+		Name:  "exec_position",
+		Type:  blip.GAUGE,
+		Value: float64(status.ExecSourceLogPos.Int64),
+		Meta: map[string]string{
+			"file": status.RelaySourceLogFile,
+			"mode": "file-pos",
+		},
+	}
+	if status.AutoPosition {
+		m.Meta["mode"] = "gtid"
+	}
+	if status.Channel != "" {
+		m.Meta["channel"] = status.Channel
+	}
+	return m, true
+}
+
+// readOnly returns 1 if read_only or super_read_only is ON, else 0. If
+// super_read_only doesn't exist (MariaDB, for example), only read_only is checked.
+func (c *Repl) readOnly(ctx context.Context) (float64, error) {
+	var ro, sro int
+	err := c.db.QueryRowContext(ctx, "SELECT @@read_only, @@super_read_only").Scan(&ro, &sro)
+	if err != nil {
+		blip.Debug("super_read_only: %s (checking only read_only)", err)
+		sro = 0
+		if err := c.db.QueryRowContext(ctx, "SELECT @@read_only").Scan(&ro); err != nil {
+			return 0, err
+		}
+	}
+	if ro == 1 || sro == 1 {
+		return 1, nil
+	}
+	return 0, nil
+}
+
 func (c *Repl) collectError(err error) ([]blip.MetricValue, error) {
 	var ep *errors.Policy
 	switch myerr.MySQLErrorCode(err) {
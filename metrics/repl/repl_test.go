@@ -0,0 +1,427 @@
+// Copyright 2024 Block, Inc.
+
+package repl_test
+
+import (
+	"context"
+	"database/sql/driver"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/cashapp/blip"
+	"github.com/cashapp/blip/metrics/repl"
+	"github.com/cashapp/blip/test/mock"
+)
+
+func replPlan(metrics []string, opts map[string]string) blip.Plan {
+	return blip.Plan{
+		Name: "test",
+		Levels: map[string]blip.Level{
+			"kpi": {
+				Name: "kpi",
+				Freq: "1s",
+				Collect: map[string]blip.Domain{
+					repl.DOMAIN: {Name: repl.DOMAIN, Metrics: metrics, Options: opts},
+				},
+			},
+		},
+	}
+}
+
+func TestReadOnly(t *testing.T) {
+	tests := []struct {
+		ro, sro int64
+		expect  float64
+	}{
+		{1, 0, 1},
+		{1, 1, 1}, // super_read_only sets read_only
+		{0, 0, 0},
+	}
+	for _, tc := range tests {
+		m := mock.NewSQL(map[string]mock.SQLResult{
+			"SHOW SLAVE STATUS": {Columns: []string{"Slave_IO_Running"}}, // not a replica
+			"SELECT @@read_only, @@super_read_only": {
+				Columns: []string{"@@read_only", "@@super_read_only"},
+				Rows:    [][]driver.Value{{tc.ro, tc.sro}},
+			},
+		})
+		c := repl.NewRepl(m.DB())
+
+		// Option report-read-only=yes; repl.running dropped because not a replica
+		plan := replPlan([]string{"running"}, map[string]string{
+			repl.OPT_REPORT_READ_ONLY:     "yes",
+			repl.OPT_REPORT_NOT_A_REPLICA: "no",
+		})
+		_, err := c.Prepare(context.Background(), plan)
+		require.NoError(t, err)
+		metrics, err := c.Collect(context.Background(), "kpi")
+		require.NoError(t, err)
+		expect := []blip.MetricValue{{Name: "read_only", Type: blip.GAUGE, Value: tc.expect}}
+		assert.Equal(t, expect, metrics, "read_only=%d super_read_only=%d", tc.ro, tc.sro)
+	}
+
+	// No super_read_only (MariaDB): only read_only
+	m := mock.NewSQL(map[string]mock.SQLResult{
+		"SHOW SLAVE STATUS": {Columns: []string{"Slave_IO_Running"}},
+		"SELECT @@read_only": {
+			Columns: []string{"@@read_only"},
+			Rows:    [][]driver.Value{{int64(0)}},
+		},
+	})
+	m.QueryFunc = func(query string) (mock.SQLResult, bool) {
+		if query == "SELECT @@read_only, @@super_read_only" {
+			return mock.SQLResult{Err: assert.AnError}, true
+		}
+		return mock.SQLResult{}, false
+	}
+	c := repl.NewRepl(m.DB())
+	_, err := c.Prepare(context.Background(), replPlan([]string{"running", "read_only"}, map[string]string{repl.OPT_REPORT_NOT_A_REPLICA: "yes"}))
+	require.NoError(t, err)
+	metrics, err := c.Collect(context.Background(), "kpi")
+	require.NoError(t, err)
+	expect := []blip.MetricValue{
+		{Name: "running", Type: blip.GAUGE, Value: -1, Meta: map[string]string{"source": ""}},
+		{Name: "read_only", Type: blip.GAUGE, Value: 0},
+	}
+	assert.Equal(t, expect, metrics)
+
+	// Not reported by default
+	c = repl.NewRepl(m.DB())
+	_, err = c.Prepare(context.Background(), replPlan([]string{"running"}, map[string]string{repl.OPT_REPORT_NOT_A_REPLICA: "yes"}))
+	require.NoError(t, err)
+	metrics, err = c.Collect(context.Background(), "kpi")
+	require.NoError(t, err)
+	assert.Len(t, metrics, 1)
+}
+
+func TestRelay(t *testing.T) {
+	status := func(sqlErrno string) mock.SQLResult {
+		return mock.SQLResult{
+			Columns: []string{"Slave_IO_Running", "Slave_SQL_Running", "Last_Errno", "Last_SQL_Errno", "Relay_Log_Space", "Master_Host"},
+			Rows:    [][]driver.Value{{"Yes", "Yes", "0", sqlErrno, "4096", "db1"}},
+		}
+	}
+	tests := []struct {
+		sqlErrno string
+		expect   float64
+	}{
+		{"0", 0},    // clean
+		{"1594", 1}, // relay log read failure
+		{"1062", 0}, // not a relay log error
+	}
+	for _, tc := range tests {
+		m := mock.NewSQL(map[string]mock.SQLResult{"SHOW SLAVE STATUS": status(tc.sqlErrno)})
+		c := repl.NewRepl(m.DB())
+		_, err := c.Prepare(context.Background(), replPlan([]string{"running"}, map[string]string{repl.OPT_REPORT_RELAY: "yes"}))
+		require.NoError(t, err)
+		metrics, err := c.Collect(context.Background(), "kpi")
+		require.NoError(t, err)
+		expect := []blip.MetricValue{
+			{Name: "running", Type: blip.GAUGE, Value: 1, Meta: map[string]string{"source": "db1"}},
+			{Name: "relay_error", Type: blip.GAUGE, Value: tc.expect},
+			{Name: "relay_log_space", Type: blip.GAUGE, Value: 4096},
+		}
+		assert.Equal(t, expect, metrics, "Last_SQL_Errno=%s", tc.sqlErrno)
+	}
+
+	// Not reported by default
+	m := mock.NewSQL(map[string]mock.SQLResult{"SHOW SLAVE STATUS": status("1594")})
+	c := repl.NewRepl(m.DB())
+	_, err := c.Prepare(context.Background(), replPlan([]string{"running"}, nil))
+	require.NoError(t, err)
+	metrics, err := c.Collect(context.Background(), "kpi")
+	require.NoError(t, err)
+	assert.Len(t, metrics, 1)
+}
+
+func TestConfiguredDelay(t *testing.T) {
+	m := mock.NewSQL(map[string]mock.SQLResult{
+		"SHOW SLAVE STATUS": {
+			Columns: []string{"Slave_IO_Running", "Slave_SQL_Running", "Last_Errno", "SQL_Delay", "Master_Host"},
+			Rows:    [][]driver.Value{{"Yes", "Yes", "0", "3600", "db1"}},
+		},
+	})
+	c := repl.NewRepl(m.DB())
+	_, err := c.Prepare(context.Background(), replPlan([]string{"running", "configured_delay"}, nil))
+	require.NoError(t, err)
+	metrics, err := c.Collect(context.Background(), "kpi")
+	require.NoError(t, err)
+	expect := []blip.MetricValue{
+		{Name: "running", Type: blip.GAUGE, Value: 1, Meta: map[string]string{"source": "db1"}},
+		{Name: "configured_delay", Type: blip.GAUGE, Value: 3600},
+	}
+	assert.Equal(t, expect, metrics)
+
+	// Not a replica: not reported
+	m.Set("SHOW SLAVE STATUS", mock.SQLResult{Columns: []string{"Slave_IO_Running"}})
+	c = repl.NewRepl(m.DB())
+	_, err = c.Prepare(context.Background(), replPlan([]string{"configured_delay"}, nil))
+	require.NoError(t, err)
+	metrics, err = c.Collect(context.Background(), "kpi")
+	require.NoError(t, err)
+	assert.Empty(t, metrics)
+}
+
+func TestStopsTotal(t *testing.T) {
+	status := func(sqlRunning string) mock.SQLResult {
+		return mock.SQLResult{
+			Columns: []string{"Slave_IO_Running", "Slave_SQL_Running", "Last_Errno", "Master_Host"},
+			Rows:    [][]driver.Value{{"Yes", sqlRunning, "0", "db1"}},
+		}
+	}
+	m := mock.NewSQL(map[string]mock.SQLResult{"SHOW SLAVE STATUS": status("Yes")})
+	c := repl.NewRepl(m.DB())
+	_, err := c.Prepare(context.Background(), replPlan([]string{"stops_total"}, nil))
+	require.NoError(t, err)
+	stops := func() float64 {
+		metrics, err := c.Collect(context.Background(), "kpi")
+		require.NoError(t, err)
+		require.Len(t, metrics, 1)
+		assert.Equal(t, "stops_total", metrics[0].Name)
+		assert.Equal(t, blip.CUMULATIVE_COUNTER, metrics[0].Type)
+		return metrics[0].Value
+	}
+
+	// Two stop/start transitions; stopped for two collections counts once
+	for _, tc := range []struct {
+		sqlRunning string
+		stops      float64
+	}{
+		{"Yes", 0},
+		{"No", 1},
+		{"No", 1},
+		{"Yes", 1},
+		{"No", 2},
+		{"Yes", 2},
+	} {
+		m.Set("SHOW SLAVE STATUS", status(tc.sqlRunning))
+		assert.Equal(t, tc.stops, stops(), tc)
+	}
+
+	// Not running at first collection is not a stop, and Prepare resets
+	m.Set("SHOW SLAVE STATUS", status("No"))
+	_, err = c.Prepare(context.Background(), replPlan([]string{"stops_total"}, nil))
+	require.NoError(t, err)
+	assert.Equal(t, float64(0), stops())
+}
+
+func TestBacklogBytes(t *testing.T) {
+	// Channel ch1: same source log file, read - exec = 1500 bytes. Channel ch2:
+	// IO thread in the next file, so Relay_Log_Space
+	m := mock.NewSQL(map[string]mock.SQLResult{
+		"SHOW SLAVE STATUS": {
+			Columns: []string{"Slave_IO_Running", "Slave_SQL_Running", "Last_Errno", "Master_Host", "Channel_Name",
+				"Master_Log_File", "Read_Master_Log_Pos", "Relay_Master_Log_File", "Exec_Master_Log_Pos", "Relay_Log_Space"},
+			Rows: [][]driver.Value{
+				{"Yes", "Yes", "0", "db1", "ch1", "binlog.000010", "5500", "binlog.000010", "4000", "8192"},
+				{"Yes", "Yes", "0", "db2", "ch2", "binlog.000021", "100", "binlog.000020", "9000", "65536"},
+			},
+		},
+	})
+	c := repl.NewRepl(m.DB())
+	_, err := c.Prepare(context.Background(), replPlan([]string{"running"}, map[string]string{repl.OPT_REPORT_BACKLOG: "yes"}))
+	require.NoError(t, err)
+	metrics, err := c.Collect(context.Background(), "kpi")
+	require.NoError(t, err)
+	expect := []blip.MetricValue{
+		{Name: "running", Type: blip.GAUGE, Value: 1, Meta: map[string]string{"source": "db2"}}, // last row
+		{Name: "backlog_bytes", Type: blip.GAUGE, Value: 1500, Meta: map[string]string{"channel": "ch1"}},
+		{Name: "backlog_bytes", Type: blip.GAUGE, Value: 65536, Meta: map[string]string{"channel": "ch2"}},
+	}
+	assert.Equal(t, expect, metrics)
+
+	// Collector metric without the option; default channel (no Channel_Name)
+	m = mock.NewSQL(map[string]mock.SQLResult{
+		"SHOW SLAVE STATUS": {
+			Columns: []string{"Slave_IO_Running", "Slave_SQL_Running", "Last_Errno", "Master_Log_File", "Read_Master_Log_Pos", "Relay_Master_Log_File", "Exec_Master_Log_Pos", "Relay_Log_Space"},
+			Rows:    [][]driver.Value{{"Yes", "Yes", "0", "binlog.000010", "4000", "binlog.000010", "4000", "8192"}},
+		},
+	})
+	c = repl.NewRepl(m.DB())
+	_, err = c.Prepare(context.Background(), replPlan([]string{"backlog_bytes"}, nil))
+	require.NoError(t, err)
+	metrics, err = c.Collect(context.Background(), "kpi")
+	require.NoError(t, err)
+	assert.Equal(t, []blip.MetricValue{{Name: "backlog_bytes", Type: blip.GAUGE, Value: 0}}, metrics)
+
+	// Not a replica: not reported
+	m = mock.NewSQL(map[string]mock.SQLResult{"SHOW SLAVE STATUS": {Columns: []string{"Slave_IO_Running"}}})
+	c = repl.NewRepl(m.DB())
+	_, err = c.Prepare(context.Background(), replPlan([]string{"backlog_bytes"}, nil))
+	require.NoError(t, err)
+	metrics, err = c.Collect(context.Background(), "kpi")
+	require.NoError(t, err)
+	assert.Empty(t, metrics)
+}
+
+func TestReportPosition(t *testing.T) {
+	// GTID mode: Executed_Gtid_Set (wrapped after commas, like MySQL) and
+	// Auto_Position=1. Channel ch2 hasn't executed anything: no exec_position
+	gtidSet := "3E11FA47-71CA-11E1-9E33-C80AA9429562:1-77,\n4D22FB58-82DB-22F2-AF44-D91BB0530673:1-5"
+	m := mock.NewSQL(map[string]mock.SQLResult{
+		"SHOW SLAVE STATUS": {
+			Columns: []string{"Slave_IO_Running", "Slave_SQL_Running", "Last_Errno", "Master_Host", "Channel_Name",
+				"Relay_Master_Log_File", "Exec_Master_Log_Pos", "Executed_Gtid_Set", "Auto_Position"},
+			Rows: [][]driver.Value{
+				{"Yes", "Yes", "0", "db1", "ch1", "binlog.000010", "4000", gtidSet, "1"},
+				{"Yes", "Yes", "0", "db2", "ch2", "", "0", gtidSet, "1"},
+			},
+		},
+	})
+	c := repl.NewRepl(m.DB())
+	_, err := c.Prepare(context.Background(), replPlan([]string{"running"}, map[string]string{repl.OPT_REPORT_POSITION: "yes"}))
+	require.NoError(t, err)
+	metrics, err := c.Collect(context.Background(), "kpi")
+	require.NoError(t, err)
+	expect := []blip.MetricValue{
+		{Name: "running", Type: blip.GAUGE, Value: 1, Meta: map[string]string{"source": "db2"}},
+		{Name: "gtid_executed", Type: blip.GAUGE, Value: 1, Meta: map[string]string{
+			"gtid_executed": "3E11FA47-71CA-11E1-9E33-C80AA9429562:1-77,4D22FB58-82DB-22F2-AF44-D91BB0530673:1-5",
+		}},
+		{Name: "exec_position", Type: blip.GAUGE, Value: 4000, Meta: map[string]string{"file": "binlog.000010", "mode": "gtid", "channel": "ch1"}},
+	}
+	assert.Equal(t, expect, metrics)
+
+	// File-pos mode: no GTIDs, so only exec_position (collector metric without
+	// the option; default channel)
+	m = mock.NewSQL(map[string]mock.SQLResult{
+		"SHOW SLAVE STATUS": {
+			Columns: []string{"Slave_IO_Running", "Slave_SQL_Running", "Last_Errno", "Relay_Master_Log_File", "Exec_Master_Log_Pos", "Executed_Gtid_Set", "Auto_Position"},
+			Rows:    [][]driver.Value{{"Yes", "Yes", "0", "mysql-bin.000123", "98765", "", "0"}},
+		},
+	})
+	c = repl.NewRepl(m.DB())
+	_, err = c.Prepare(context.Background(), replPlan([]string{"exec_position"}, nil))
+	require.NoError(t, err)
+	metrics, err = c.Collect(context.Background(), "kpi")
+	require.NoError(t, err)
+	assert.Equal(t, []blip.MetricValue{
+		{Name: "exec_position", Type: blip.GAUGE, Value: 98765, Meta: map[string]string{"file": "mysql-bin.000123", "mode": "file-pos"}},
+	}, metrics)
+
+	// Not a replica: not reported
+	m = mock.NewSQL(map[string]mock.SQLResult{"SHOW SLAVE STATUS": {Columns: []string{"Slave_IO_Running"}}})
+	c = repl.NewRepl(m.DB())
+	_, err = c.Prepare(context.Background(), replPlan([]string{"gtid_executed"}, nil))
+	require.NoError(t, err)
+	metrics, err = c.Collect(context.Background(), "kpi")
+	require.NoError(t, err)
+	assert.Empty(t, metrics)
+}
+
+func TestIgnoreErrnos(t *testing.T) {
+	status := func(errno string) mock.SQLResult {
+		return mock.SQLResult{
+			Columns: []string{"Slave_IO_Running", "Slave_SQL_Running", "Last_Errno", "Master_Host"},
+			Rows:    [][]driver.Value{{"Yes", "Yes", errno, "db1"}},
+		}
+	}
+	tests := []struct {
+		errno   string
+		running float64
+	}{
+		{"0", 1},    // no error
+		{"1062", 1}, // ignored: healthy
+		{"1032", 1}, // ignored: healthy
+		{"1146", 0}, // not ignored: broken
+	}
+	for _, tc := range tests {
+		m := mock.NewSQL(map[string]mock.SQLResult{"SHOW SLAVE STATUS": status(tc.errno)})
+		c := repl.NewRepl(m.DB())
+		_, err := c.Prepare(context.Background(), replPlan([]string{"running", "last_errno"}, map[string]string{repl.OPT_IGNORE_ERRNOS: "1062, 1032"}))
+		require.NoError(t, err)
+		metrics, err := c.Collect(context.Background(), "kpi")
+		require.NoError(t, err)
+		errno, _ := strconv.ParseFloat(tc.errno, 64)
+		expect := []blip.MetricValue{
+			{Name: "running", Type: blip.GAUGE, Value: tc.running, Meta: map[string]string{"source": "db1"}},
+			{Name: "last_errno", Type: blip.GAUGE, Value: errno}, // reported even if ignored
+		}
+		assert.Equal(t, expect, metrics, "Last_Errno=%s", tc.errno)
+	}
+
+	// Not ignored by default
+	m := mock.NewSQL(map[string]mock.SQLResult{"SHOW SLAVE STATUS": status("1062")})
+	c := repl.NewRepl(m.DB())
+	_, err := c.Prepare(context.Background(), replPlan([]string{"running"}, nil))
+	require.NoError(t, err)
+	metrics, err := c.Collect(context.Background(), "kpi")
+	require.NoError(t, err)
+	require.Len(t, metrics, 1)
+	assert.Equal(t, float64(0), metrics[0].Value)
+
+	// Ignored errno is not a stop
+	m.Set("SHOW SLAVE STATUS", status("0"))
+	_, err = c.Prepare(context.Background(), replPlan([]string{"stops_total"}, map[string]string{repl.OPT_IGNORE_ERRNOS: "1062"}))
+	require.NoError(t, err)
+	_, err = c.Collect(context.Background(), "kpi")
+	require.NoError(t, err)
+	m.Set("SHOW SLAVE STATUS", status("1062"))
+	metrics, err = c.Collect(context.Background(), "kpi")
+	require.NoError(t, err)
+	require.Len(t, metrics, 1)
+	assert.Equal(t, float64(0), metrics[0].Value)
+
+	// Invalid values
+	for _, val := range []string{"foo", "1062,", "0", "-1"} {
+		_, err = c.Prepare(context.Background(), replPlan([]string{"running"}, map[string]string{repl.OPT_IGNORE_ERRNOS: val}))
+		assert.Error(t, err, val)
+	}
+}
+
+func TestNullBehavior(t *testing.T) {
+	replica := func(behind driver.Value) mock.SQLResult {
+		return mock.SQLResult{
+			Columns: []string{"Slave_IO_Running", "Slave_SQL_Running", "Last_Errno", "Seconds_Behind_Master", "Master_Host"},
+			Rows:    [][]driver.Value{{"Yes", "No", "0", behind, "db1"}},
+		}
+	}
+	notAReplica := mock.SQLResult{Columns: []string{"Slave_IO_Running"}}
+
+	tests := []struct {
+		name   string
+		status mock.SQLResult
+		opts   map[string]string
+		expect []blip.MetricValue // nil = dropped
+	}{
+		// Seconds_Behind_Source is not NULL: reported as-is for every null-behavior
+		{"replicating", replica("5"), nil, []blip.MetricValue{{Name: "seconds_behind", Type: blip.GAUGE, Value: 5}}},
+		{"replicating broken", replica("5"), map[string]string{repl.OPT_NULL_BEHAVIOR: repl.NULL_BROKEN}, []blip.MetricValue{{Name: "seconds_behind", Type: blip.GAUGE, Value: 5}}},
+
+		// NULL: SQL thread stopped but still a replica
+		{"null default", replica(nil), map[string]string{repl.OPT_REPORT_NOT_A_REPLICA: "yes"}, []blip.MetricValue{{Name: "seconds_behind", Type: blip.GAUGE, Value: repl.NOT_A_REPLICA}}},
+		{"null not-a-replica", replica(nil), map[string]string{repl.OPT_NULL_BEHAVIOR: repl.NULL_NOT_A_REPLICA, repl.OPT_REPORT_NOT_A_REPLICA: "yes"}, []blip.MetricValue{{Name: "seconds_behind", Type: blip.GAUGE, Value: repl.NOT_A_REPLICA}}},
+		{"null not-a-replica dropped", replica(nil), map[string]string{repl.OPT_NULL_BEHAVIOR: repl.NULL_NOT_A_REPLICA, repl.OPT_REPORT_NOT_A_REPLICA: "no"}, nil},
+		{"null broken", replica(nil), map[string]string{repl.OPT_NULL_BEHAVIOR: repl.NULL_BROKEN}, []blip.MetricValue{{Name: "seconds_behind", Type: blip.GAUGE, Value: repl.BROKEN}}},
+		{"null broken report-not-a-replica=no", replica(nil), map[string]string{repl.OPT_NULL_BEHAVIOR: repl.NULL_BROKEN}, []blip.MetricValue{{Name: "seconds_behind", Type: blip.GAUGE, Value: repl.BROKEN}}},
+		{"null absent", replica(nil), map[string]string{repl.OPT_NULL_BEHAVIOR: repl.NULL_ABSENT}, nil},
+
+		// Not a replica: null-behavior doesn't apply
+		{"not a replica broken", notAReplica, map[string]string{repl.OPT_NULL_BEHAVIOR: repl.NULL_BROKEN, repl.OPT_REPORT_NOT_A_REPLICA: "yes"}, []blip.MetricValue{{Name: "seconds_behind", Type: blip.GAUGE, Value: repl.NOT_A_REPLICA}}},
+		{"not a replica absent", notAReplica, map[string]string{repl.OPT_NULL_BEHAVIOR: repl.NULL_ABSENT, repl.OPT_REPORT_NOT_A_REPLICA: "yes"}, []blip.MetricValue{{Name: "seconds_behind", Type: blip.GAUGE, Value: repl.NOT_A_REPLICA}}},
+		{"not a replica dropped", notAReplica, map[string]string{repl.OPT_NULL_BEHAVIOR: repl.NULL_BROKEN, repl.OPT_REPORT_NOT_A_REPLICA: "no"}, nil},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			m := mock.NewSQL(map[string]mock.SQLResult{"SHOW SLAVE STATUS": tc.status})
+			c := repl.NewRepl(m.DB())
+			_, err := c.Prepare(context.Background(), replPlan([]string{"seconds_behind"}, tc.opts))
+			require.NoError(t, err)
+			metrics, err := c.Collect(context.Background(), "kpi")
+			require.NoError(t, err)
+			if tc.expect == nil {
+				assert.Empty(t, metrics)
+			} else {
+				assert.Equal(t, tc.expect, metrics)
+			}
+		})
+	}
+
+	// Invalid value
+	c := repl.NewRepl(mock.NewSQL(nil).DB())
+	_, err := c.Prepare(context.Background(), replPlan([]string{"seconds_behind"}, map[string]string{repl.OPT_NULL_BEHAVIOR: "zero"}))
+	require.Error(t, err)
+}
@@ -156,6 +156,14 @@ func (e *Engine) Prepare(ctx context.Context, plan blip.Plan, before, after func
 				return lerr
 			}
 
+			// Plans were validated against Help, which is generic. If the collector
+			// has Help for this server, warn about options at each level that
+			// collects the domain that don't apply to the server (like MySQL vs.
+			// MariaDB). The collector ignores them, so it's not an error.
+			if dh, ok := c.(blip.CollectorDynamicHelp); ok {
+				e.warnDynamicHelp(ctx, dh, plan, domain)
+			}
+
 			status.Monitor(e.monitorId, status.ENGINE_PREPARE, "%s: prepare collector %s", plan.Name, domain)
 			cleanup, err := c.Prepare(ctx, plan)
 			if err != nil {
@@ -242,6 +250,28 @@ func (e *Engine) Prepare(ctx context.Context, plan blip.Plan, before, after func
 	return nil
 }
 
+// warnDynamicHelp sends an event.PLAN_OPTION_IGNORED for each domain option at
+// each level in the plan that does not apply to the server, according to the
+// collector Help for the server (see blip.CollectorHelp.Inapplicable). If
+// DynamicHelp returns an error, there are no warnings because the options were
+// already validated against Help (see plan.ValidatePlans).
+func (e *Engine) warnDynamicHelp(ctx context.Context, dh blip.CollectorDynamicHelp, plan blip.Plan, domain string) {
+	help, err := dh.DynamicHelp(ctx, e.db)
+	if err != nil {
+		blip.Debug("%s: %s: no dynamic help, using static help: %s", e.monitorId, domain, err)
+		return
+	}
+	for levelName, level := range plan.Levels {
+		dom, ok := level.Collect[domain]
+		if !ok {
+			continue
+		}
+		for _, msg := range help.Inapplicable(dom.Options) {
+			e.event.Sendf(event.PLAN_OPTION_IGNORED, "plan %s: at %s/%s: %s", plan.Name, levelName, domain, msg)
+		}
+	}
+}
+
 // Collect collects the metrics at the given level. There are 3 return guarantees
 // for the slice of metrics:
 //
@@ -291,11 +321,12 @@ func (e *Engine) Collect(emrCtx context.Context, interval uint, levelName string
 		Begin:     startTime,
 		// Don't set Values yet because these fields are copied in cl.collect
 	}
+	traceId := blip.TraceId(emrCtx) // set by the caller, if any, passed to collectors
 	running := map[string]bool{}
 	for _, cl := range domains {
 		select {
 		case <-sem:
-			go cl.collect(*m, sem)
+			go cl.collect(*m, traceId, sem)
 			running[cl.c.Domain()] = true
 		case <-emrCtx.Done():
 			blip.Debug("EMR timeout starting collectors")
@@ -369,6 +400,10 @@ SWEEP:
 		case blip.ErrMore:
 			status.RemoveComponent(e.monitorId, "error:"+domain)
 			status.Monitor(e.monitorId, "background:"+domain, "at %s for %s", metrics[0].Begin, coId)
+		case blip.ErrNoMetrics: // intentionally no values: not an error
+			status.RemoveComponent(e.monitorId, "error:"+domain)
+			status.RemoveComponent(e.monitorId, "background:"+domain)
+			metrics[0].Empty = append(metrics[0].Empty, domain)
 		case nil:
 			status.RemoveComponent(e.monitorId, "error:"+domain)
 			status.RemoveComponent(e.monitorId, "background:"+domain)
@@ -380,6 +415,8 @@ SWEEP:
 		}
 	}
 
+	sort.Strings(metrics[0].Empty) // errs is a map
+
 	status.Monitor(e.monitorId, status.ENGINE_COLLECT, "%s: done: %d started, %d domains %d values collected, %s runtime, %d error",
 		coId, len(domains), len(domains)-len(running), nValues, metrics[0].End.Sub(metrics[0].Begin), errCount)
 
@@ -485,7 +522,7 @@ type clutch struct {
 	fence     uint               // set on collect fault (see below)
 }
 
-func (cl *clutch) collect(m blip.Metrics, sem chan bool) {
+func (cl *clutch) collect(m blip.Metrics, traceId string, sem chan bool) {
 	cl.Lock() // ___LOCK___
 
 	// ----------------------------------------------------------------------
@@ -520,8 +557,14 @@ func (cl *clutch) collect(m blip.Metrics, sem chan bool) {
 
 	// Collector max runtime (CMR) is interval start time + cmr because this
 	// collector might have been started after some delay in Engine.Collect
-	// but it complete
-	cl.ctx, cl.cancel = context.WithDeadline(context.Background(), m.Begin.Add(cl.cmr))
+	// but it complete. The ctx is not derived from emrCtx (engine max runtime)
+	// because background collectors outlive Engine.Collect, so only the trace
+	// ID is copied.
+	ctx := context.Background()
+	if traceId != "" {
+		ctx = blip.WithTraceId(ctx, traceId)
+	}
+	cl.ctx, cl.cancel = context.WithDeadline(ctx, m.Begin.Add(cl.cmr))
 
 	// Local interval for this run/goroutine. If the collector has a bug such that
 	// it doesn't return within its CMR and Engine.Collect runs this domain again,
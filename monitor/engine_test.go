@@ -0,0 +1,213 @@
+// Copyright 2024 Block, Inc.
+
+package monitor_test
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/go-test/deep"
+
+	"github.com/cashapp/blip"
+	"github.com/cashapp/blip/event"
+	"github.com/cashapp/blip/metrics"
+	"github.com/cashapp/blip/monitor"
+	"github.com/cashapp/blip/test/mock"
+)
+
+func TestEngineNoMetrics(t *testing.T) {
+	// A collector that returns ErrNoMetrics intentionally collected nothing:
+	// not an error, and the domain is in Metrics.Empty. A collector that returns
+	// no values and no error is not in Metrics.Empty.
+	collectors := map[string]mock.MetricsCollector{
+		"test-intentional": {
+			DomainFunc: func() string { return "test-intentional" },
+			CollectFunc: func(ctx context.Context, levelName string) ([]blip.MetricValue, error) {
+				return nil, blip.ErrNoMetrics
+			},
+		},
+		"test-nodata": {
+			DomainFunc: func() string { return "test-nodata" },
+			CollectFunc: func(ctx context.Context, levelName string) ([]blip.MetricValue, error) {
+				return nil, nil
+			},
+		},
+		"test-values": {
+			DomainFunc: func() string { return "test-values" },
+			CollectFunc: func(ctx context.Context, levelName string) ([]blip.MetricValue, error) {
+				return []blip.MetricValue{{Name: "v", Type: blip.GAUGE, Value: 1}}, nil
+			},
+		},
+	}
+	plan := blip.Plan{
+		Name:   "test",
+		Levels: map[string]blip.Level{"kpi": {Name: "kpi", Freq: "1s", Collect: map[string]blip.Domain{}}},
+	}
+	for domain, mc := range collectors {
+		mc := mc
+		metrics.Register(domain, mock.MetricFactory{
+			MakeFunc: func(domain string, args blip.CollectorFactoryArgs) (blip.Collector, error) { return mc, nil },
+		})
+		defer metrics.Remove(domain)
+		plan.Levels["kpi"].Collect[domain] = blip.Domain{Name: domain}
+	}
+
+	e := monitor.NewEngine(blip.ConfigMonitor{MonitorId: "m1"}, mock.NewSQL(nil).DB())
+	if err := e.Prepare(context.Background(), plan, func() {}, func() {}); err != nil {
+		t.Fatal(err)
+	}
+	defer e.Stop()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	got, err := e.Collect(ctx, 1, "kpi", time.Now())
+	if err != nil {
+		t.Fatalf("got error %s, expected nil (ErrNoMetrics is not an error)", err)
+	}
+	if len(got) != 1 {
+		t.Fatalf("got %d metrics, expected 1", len(got))
+	}
+	if diff := deep.Equal(got[0].Empty, []string{"test-intentional"}); diff != nil {
+		t.Error(diff)
+	}
+	if _, ok := got[0].Values["test-intentional"]; ok {
+		t.Errorf("got values for test-intentional, expected none: %v", got[0].Values)
+	}
+	if len(got[0].Values["test-values"]) != 1 {
+		t.Errorf("got values %v, expected 1 value for test-values", got[0].Values)
+	}
+}
+
+func TestEngineTraceId(t *testing.T) {
+	// The trace ID set on emrCtx by the level collector is passed to collectors
+	// in the ctx given to Collect, which is not derived from emrCtx.
+	gotTraceId := make(chan string, 1)
+	mc := mock.MetricsCollector{
+		DomainFunc: func() string { return "test-traceid" },
+		CollectFunc: func(ctx context.Context, levelName string) ([]blip.MetricValue, error) {
+			gotTraceId <- blip.TraceId(ctx)
+			return []blip.MetricValue{{Name: "v", Type: blip.GAUGE, Value: 1}}, nil
+		},
+	}
+	metrics.Register("test-traceid", mock.MetricFactory{
+		MakeFunc: func(domain string, args blip.CollectorFactoryArgs) (blip.Collector, error) { return mc, nil },
+	})
+	defer metrics.Remove("test-traceid")
+	plan := blip.Plan{
+		Name: "test",
+		Levels: map[string]blip.Level{
+			"kpi": {Name: "kpi", Freq: "1s", Collect: map[string]blip.Domain{"test-traceid": {Name: "test-traceid"}}},
+		},
+	}
+
+	e := monitor.NewEngine(blip.ConfigMonitor{MonitorId: "m1"}, mock.NewSQL(nil).DB())
+	if err := e.Prepare(context.Background(), plan, func() {}, func() {}); err != nil {
+		t.Fatal(err)
+	}
+	defer e.Stop()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	if _, err := e.Collect(blip.WithTraceId(ctx, "4bf92f3577b34da6a3ce929d0e0e4736"), 1, "kpi", time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case traceId := <-gotTraceId:
+		if traceId != "4bf92f3577b34da6a3ce929d0e0e4736" {
+			t.Errorf("got trace ID %q, expected 4bf92f3577b34da6a3ce929d0e0e4736", traceId)
+		}
+	default:
+		t.Fatal("collector not called")
+	}
+}
+
+// dynamicHelpCollector is a mock collector that implements blip.CollectorDynamicHelp.
+type dynamicHelpCollector struct {
+	mock.MetricsCollector
+	help blip.CollectorHelp
+	err  error
+}
+
+func (c dynamicHelpCollector) DynamicHelp(ctx context.Context, db *sql.DB) (blip.CollectorHelp, error) {
+	return c.help, c.err
+}
+
+func TestEngineDynamicHelp(t *testing.T) {
+	// Before Prepare, the engine warns about plan options that don't apply to
+	// the server, if the collector implements blip.CollectorDynamicHelp. The
+	// collector ignores them, so it's prepared.
+	prepared := false
+	mc := dynamicHelpCollector{
+		MetricsCollector: mock.MetricsCollector{
+			DomainFunc: func() string { return "test-dynhelp" },
+			PrepareFunc: func(ctx context.Context, plan blip.Plan) (func(), error) {
+				prepared = true
+				return nil, nil
+			},
+		},
+		help: blip.CollectorHelp{
+			Domain:   "test-dynhelp",
+			Selector: "writer",
+			Options: map[string]blip.CollectorHelpOption{
+				"writer":  {Name: "writer", Values: map[string]string{"auto": "", "blip": "", "pfs": ""}},
+				"channel": {Name: "channel", AppliesTo: []string{"pfs"}},
+			},
+			Unsupported: []string{"pfs"}, // no pfs on this server
+		},
+	}
+	metrics.Register("test-dynhelp", mock.MetricFactory{
+		MakeFunc: func(domain string, args blip.CollectorFactoryArgs) (blip.Collector, error) { return mc, nil },
+	})
+	defer metrics.Remove("test-dynhelp")
+	plan := blip.Plan{
+		Name: "test",
+		Levels: map[string]blip.Level{
+			"kpi": {
+				Name:    "kpi",
+				Freq:    "1s",
+				Collect: map[string]blip.Domain{"test-dynhelp": {Name: "test-dynhelp", Options: map[string]string{"writer": "blip", "channel": "c"}}},
+			},
+		},
+	}
+
+	var ignored []string
+	event.Subscribe(mock.EventReceiver{
+		RecvFunc: func(e event.Event) {
+			if e.Event == event.PLAN_OPTION_IGNORED {
+				ignored = append(ignored, e.Message)
+			}
+		},
+	})
+	defer event.RemoveSubscribers()
+
+	e := monitor.NewEngine(blip.ConfigMonitor{MonitorId: "m1"}, mock.NewSQL(nil).DB())
+	if err := e.Prepare(context.Background(), plan, func() {}, func() {}); err != nil {
+		t.Fatalf("got error %s, expected nil for an option that doesn't apply to the server", err)
+	}
+	defer e.Stop()
+	if !prepared {
+		t.Error("collector not prepared, expected prepared with an inapplicable option")
+	}
+	expect := []string{"plan test: at kpi/test-dynhelp: option channel ignored: applies only to writer pfs, not supported on this server"}
+	if diff := deep.Equal(ignored, expect); diff != nil {
+		t.Error(diff)
+	}
+
+	// If DynamicHelp returns an error, the options were already validated
+	// against Help, so there are no warnings and Prepare is called
+	ignored = nil
+	prepared = false
+	mc.err = fmt.Errorf("cannot query server")
+	if err := e.Prepare(context.Background(), plan, func() {}, func() {}); err != nil {
+		t.Fatalf("got error %s, expected nil when DynamicHelp fails", err)
+	}
+	if !prepared {
+		t.Error("collector not prepared, expected prepared when DynamicHelp fails")
+	}
+	if len(ignored) != 0 {
+		t.Errorf("got warnings %q, expected none when DynamicHelp fails", ignored)
+	}
+}
@@ -365,6 +365,7 @@ func (c *lco) changePlan(ctx context.Context, doneChan chan struct{}, newState,
 
 	c.stateMux.Lock()
 	oldState := c.state
+	oldPlan := c.plan
 	oldPlanName := c.plan.Name
 	c.stateMux.Unlock()
 	change := fmt.Sprintf("state:%s plan:%s -> state:%s plan:%s", oldState, oldPlanName, newState, newPlanName)
@@ -393,8 +394,10 @@ func (c *lco) changePlan(ctx context.Context, doneChan chan struct{}, newState,
 	change = fmt.Sprintf("state:%s plan:%s -> state:%s plan:%s", oldState, oldPlanName, newState, newPlan.Name)
 
 	newPlan.MonitorId = c.monitorId
+	newPlan.Normalize()
 	newPlan.InterpolateEnvVars()
 	newPlan.InterpolateMonitor(&c.cfg)
+	blip.Debug("%s: %s: %s", c.monitorId, change, blip.DiffPlans(oldPlan, newPlan))
 
 	// Convert plan levels to sorted levels for efficient level calculation in Run;
 	// see code comments on sortedLevels.
@@ -452,6 +455,9 @@ func (c *lco) changePlan(ctx context.Context, doneChan chan struct{}, newState,
 		// run try "forever". If preparing takes too long, there's probably some
 		// issue, so we need to sleep and retry.
 		ctxPrep, cancelPrep := context.WithTimeout(ctx, 10*time.Second)
+		if unit := blip.PreferredUnit(c.sinks); unit != "" {
+			ctxPrep = blip.WithSinkUnit(ctxPrep, unit)
+		}
 		err := c.engine.Prepare(ctxPrep, newPlan, c.Pause, after)
 		cancelPrep()
 		if err == nil {
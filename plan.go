@@ -3,8 +3,11 @@
 package blip
 
 import (
+	"encoding/json"
 	"fmt"
 	"regexp"
+	"sort"
+	"strings"
 	"time"
 )
 
@@ -20,10 +23,10 @@ type Plan struct {
 	// the first plan is the default if config.plan.default is not specified.
 	//
 	// config.plan.adjust.readonly and .active refer to Name.
-	Name string
+	Name string `json:"name"`
 
 	// Levels are the collection frequencies that constitue the plan (required).
-	Levels map[string]Level
+	Levels map[string]Level `json:"levels"`
 
 	// MonitorId is the optional monitorId column from a plan table.
 	//
@@ -32,25 +35,55 @@ type Plan struct {
 	//
 	// When a monitor (M) loads plans from a table (config.monitors.plans.table),
 	// the table is filtered: WHERE monitorId = config.monitors.M.id.
-	MonitorId string `yaml:"-"`
+	MonitorId string `yaml:"-" json:"-"`
 
 	// Source of plan: file name, table name, "plugin", or "blip" (internal plans).
-	Source string `yaml:"-"`
+	Source string `yaml:"-" json:"-"`
+
+	// Labels are optional static key-value pairs, like team and environment,
+	// that collectors add to the Meta of all metrics from the plan. Level.Labels
+	// override plan labels with the same key. See LevelLabels.
+	Labels map[string]string `yaml:"-" json:"labels,omitempty"`
 }
 
 // Level is one collection frequency in a plan.
 type Level struct {
-	Name    string            `yaml:"-"`
-	Freq    string            `yaml:"freq"`
-	Collect map[string]Domain `yaml:"collect"`
+	Name    string            `yaml:"-" json:"-"`
+	Freq    string            `yaml:"freq" json:"freq"`
+	From    string            `yaml:"from,omitempty" json:"from,omitempty"` // see Plan.ResolveIncludes
+	Collect map[string]Domain `yaml:"collect" json:"collect"`
+
+	// Defaults are default domain options: domain name => option => value.
+	// See Plan.ApplyDefaults.
+	Defaults map[string]map[string]string `yaml:"defaults,omitempty" json:"defaults,omitempty"`
+
+	// Labels are static Meta for metrics collected at the level. See Plan.Labels.
+	Labels map[string]string `yaml:"labels,omitempty" json:"labels,omitempty"`
 }
 
 // Domain is one metric domain for collecting related metrics.
 type Domain struct {
-	Name    string            `yaml:"-"`
-	Metrics []string          `yaml:"metrics,omitempty"`
-	Options map[string]string `yaml:"options,omitempty"`
-	Errors  map[string]string `yaml:"errors,omitempty"`
+	Name    string            `yaml:"-" json:"-"`
+	Metrics []string          `yaml:"metrics,omitempty" json:"metrics,omitempty"`
+	Options map[string]string `yaml:"options,omitempty" json:"options,omitempty"`
+	Errors  map[string]string `yaml:"errors,omitempty" json:"errors,omitempty"`
+}
+
+// UnmarshalPlanJSON decodes a plan from JSON: an object with "name" and
+// "levels", where levels are keyed on level name and have the same fields as
+// YAML plans. Like plans loaded from YAML, Level.Name and Domain.Name are set
+// from their map keys, and level defaults and includes are applied.
+func UnmarshalPlanJSON(data []byte) (Plan, error) {
+	var plan Plan
+	if err := json.Unmarshal(data, &plan); err != nil {
+		return Plan{}, fmt.Errorf("cannot decode JSON: %s", err)
+	}
+	plan.Normalize()
+	plan.ApplyDefaults()
+	if err := plan.ResolveIncludes(); err != nil {
+		return Plan{}, fmt.Errorf("invalid plan: %s", err)
+	}
+	return plan, nil
 }
 
 const metricPattern = `^[a-zA-Z0-9_-]*$`
@@ -62,8 +95,15 @@ func (p Plan) Validate() error {
 
 	for levelName := range p.Levels {
 
-		// Validate freq: set, valid, and no duplicates
+		// Validate freq: set, valid, and no duplicates. Plans are validated
+		// when loaded, before InterpolateEnvVars, so validate the freq that
+		// an env var interpolates to.
 		freq := p.Levels[levelName].Freq
+		if strings.Contains(freq, "${") {
+			if v := interpolateEnv(freq); v != "" {
+				freq = v
+			}
+		}
 		if freq == "" {
 			return fmt.Errorf("at %s: freq not set (Go time duration string required)", levelName)
 		}
@@ -84,12 +124,41 @@ func (p Plan) Validate() error {
 						levelName, domainName, metricName, metricPattern)
 				}
 			}
+
+			// Validate options and metrics against mock collector help, if any
+			if mc, ok := MockCollector(domainName); ok {
+				if err := validateDomainHelp(mc.Help(), p.Levels[levelName].Collect[domainName]); err != nil {
+					return fmt.Errorf("at %s/%s: %s", levelName, domainName, err)
+				}
+			}
 		}
 	}
 
 	return nil
 }
 
+// validateDomainHelp returns an error if the domain options or metrics are
+// not declared by the collector help. Metrics are not checked if the help
+// does not declare any metrics.
+func validateDomainHelp(help CollectorHelp, dom Domain) error {
+	if err := help.Validate(dom.Options); err != nil {
+		return err
+	}
+	if len(help.Metrics) == 0 {
+		return nil
+	}
+METRICS:
+	for _, metricName := range dom.Metrics {
+		for _, m := range help.Metrics {
+			if m.Name == metricName {
+				continue METRICS
+			}
+		}
+		return fmt.Errorf("unknown metric: %s", metricName)
+	}
+	return nil
+}
+
 func (p Plan) Freq() (time.Duration, map[string]time.Duration) {
 	var min time.Duration
 	domain := map[string]time.Duration{}
@@ -110,12 +179,22 @@ func (p Plan) Freq() (time.Duration, map[string]time.Duration) {
 	return min, domain
 }
 
+// InterpolateEnvVars interpolates environment variables in level freq, domain
+// options, and domain metrics. If freq interpolates to an empty string (the env
+// var is not set and has no default like ${FREQ:-5s}), freq is not changed, so
+// Validate reports the literal, invalid freq.
 func (p *Plan) InterpolateEnvVars() {
 	for levelName := range p.Levels {
+		if freq := interpolateEnv(p.Levels[levelName].Freq); freq != "" {
+			level := p.Levels[levelName]
+			level.Freq = freq
+			p.Levels[levelName] = level
+		}
 		for domainName := range p.Levels[levelName].Collect {
 			for k, v := range p.Levels[levelName].Collect[domainName].Options {
 				p.Levels[levelName].Collect[domainName].Options[k] = interpolateEnv(v)
 			}
+			p.interpolateMetrics(levelName, domainName, interpolateEnv)
 		}
 	}
 }
@@ -126,6 +205,587 @@ func (p *Plan) InterpolateMonitor(mon *ConfigMonitor) {
 			for k, v := range p.Levels[levelName].Collect[domainName].Options {
 				p.Levels[levelName].Collect[domainName].Options[k] = mon.interpolateMon(v)
 			}
+			p.interpolateMetrics(levelName, domainName, mon.interpolateMon)
+		}
+	}
+}
+
+// interpolateMetrics interpolates the metrics list of a domain using f. If a
+// metric is interpolated (changed by f), the new value is split on commas so
+// a variable can expand to a list of metrics, like "threads_running,queries".
+// Empty values are removed. Metrics without variables are not changed.
+func (p *Plan) interpolateMetrics(levelName, domainName string, f func(string) string) {
+	dom := p.Levels[levelName].Collect[domainName]
+	if len(dom.Metrics) == 0 {
+		return
+	}
+	metrics := make([]string, 0, len(dom.Metrics))
+	for _, m := range dom.Metrics {
+		v := f(m)
+		if v == m {
+			metrics = append(metrics, m)
+			continue
+		}
+		for _, s := range strings.Split(v, ",") {
+			if s = strings.TrimSpace(s); s != "" {
+				metrics = append(metrics, s)
+			}
+		}
+	}
+	dom.Metrics = metrics
+	p.Levels[levelName].Collect[domainName] = dom
+}
+
+// Normalize sets Level.Name and Domain.Name from their map keys if empty.
+// Plans loaded from YAML or JSON have names, but plans built in Go (like plugin
+// and default plans) might not, and levels are collected by name.
+func (p *Plan) Normalize() {
+	for levelName, level := range p.Levels {
+		if level.Name == "" {
+			level.Name = levelName
+		}
+		for domainName, dom := range level.Collect {
+			if dom.Name == "" {
+				dom.Name = domainName
+				level.Collect[domainName] = dom
+			}
+		}
+		p.Levels[levelName] = level
+	}
+}
+
+// LevelLabels returns the labels for metrics collected at the level: Plan.Labels
+// merged with Level.Labels, which take precedence. It returns nil if there are
+// no labels. The returned map is a copy.
+func (p Plan) LevelLabels(levelName string) map[string]string {
+	level := p.Levels[levelName]
+	if len(p.Labels) == 0 && len(level.Labels) == 0 {
+		return nil
+	}
+	labels := make(map[string]string, len(p.Labels)+len(level.Labels))
+	for k, v := range p.Labels {
+		labels[k] = v
+	}
+	for k, v := range level.Labels {
+		labels[k] = v
+	}
+	return labels
+}
+
+// ApplyDefaults merges Level.Defaults into the options of domains collected
+// at the level. Options set in the domain override (take precedence over)
+// default options. Defaults for domains not collected at the level are
+// ignored; they do not add the domain. Call ApplyDefaults before ResolveIncludes
+// so that inherited domains are inherited with the defaults of their level.
+func (p *Plan) ApplyDefaults() {
+	for levelName, level := range p.Levels {
+		for domainName, defaults := range level.Defaults {
+			dom, ok := level.Collect[domainName]
+			if !ok {
+				continue // domain not collected at this level
+			}
+			opts := make(map[string]string, len(defaults)+len(dom.Options))
+			for k, v := range defaults {
+				opts[k] = v
+			}
+			for k, v := range dom.Options {
+				opts[k] = v // domain option overrides default
+			}
+			dom.Options = opts
+			level.Collect[domainName] = dom
+		}
+		p.Levels[levelName] = level
+	}
+}
+
+// ResolveIncludes expands levels that inherit the Collect map of another level
+// by setting Level.From to the other level name. Domains collected by the level
+// override (replace) inherited domains with the same name. It returns an error
+// if From references an unknown level or references form a cycle. After
+// resolving, From is empty for all levels, so calling it again is a no-op.
+func (p *Plan) ResolveIncludes() error {
+	levelNames := make([]string, 0, len(p.Levels))
+	for levelName := range p.Levels {
+		levelNames = append(levelNames, levelName)
+	}
+	sort.Strings(levelNames) // deterministic errors
+
+	for _, levelName := range levelNames {
+		if err := p.resolveInclude(levelName, nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (p *Plan) resolveInclude(levelName string, chain []string) error {
+	level := p.Levels[levelName]
+	if level.From == "" {
+		return nil // no include or already resolved
+	}
+
+	chain = append(chain, levelName)
+	for _, name := range chain {
+		if name == level.From {
+			return fmt.Errorf("at %s: from cycle: %s -> %s", levelName, strings.Join(chain, " -> "), level.From)
+		}
+	}
+	if _, ok := p.Levels[level.From]; !ok {
+		return fmt.Errorf("at %s: from unknown level: %s", levelName, level.From)
+	}
+
+	// Resolve the other level first in case it inherits from another level
+	if err := p.resolveInclude(level.From, chain); err != nil {
+		return err
+	}
+
+	collect := map[string]Domain{}
+	for domainName, dom := range p.Levels[level.From].Collect {
+		collect[domainName] = dom.copy()
+	}
+	for domainName, dom := range level.Collect {
+		collect[domainName] = dom // override
+	}
+	level.Collect = collect
+	level.From = ""
+	p.Levels[levelName] = level
+	return nil
+}
+
+// copy returns a deep copy of the domain so inherited domains do not share
+// (and later interpolate) the same slices and maps.
+func (d Domain) copy() Domain {
+	c := Domain{Name: d.Name}
+	if d.Metrics != nil {
+		c.Metrics = make([]string, len(d.Metrics))
+		copy(c.Metrics, d.Metrics)
+	}
+	if d.Options != nil {
+		c.Options = make(map[string]string, len(d.Options))
+		for k, v := range d.Options {
+			c.Options[k] = v
+		}
+	}
+	if d.Errors != nil {
+		c.Errors = make(map[string]string, len(d.Errors))
+		for k, v := range d.Errors {
+			c.Errors[k] = v
+		}
+	}
+	return c
+}
+
+// PlanDiff is what changed from one plan to another: see DiffPlans. Names and
+// option keys are sorted. Option values are not included because they can be
+// secrets, like a DSN.
+type PlanDiff struct {
+	AddedLevels   []string
+	RemovedLevels []string
+	ChangedLevels []LevelDiff
+}
+
+// LevelDiff is what changed in a level that's in both plans.
+type LevelDiff struct {
+	Name           string
+	OldFreq        string // set only if freq changed
+	NewFreq        string // set only if freq changed
+	AddedDomains   []string
+	RemovedDomains []string
+	ChangedDomains []DomainDiff
+}
+
+// DomainDiff is what changed in a domain that's collected at the same level
+// in both plans.
+type DomainDiff struct {
+	Name           string
+	AddedOptions   []string
+	RemovedOptions []string
+	ChangedOptions []string // value changed
+	AddedMetrics   []string
+	RemovedMetrics []string
+}
+
+// DiffPlans returns the levels, domains, options, and metrics that were added,
+// removed, or changed from old to new plan. Plan names and sources are not
+// compared. Call it after plans are fully loaded (ApplyDefaults, ResolveIncludes,
+// and interpolation) to diff what's collected.
+func DiffPlans(old, new Plan) PlanDiff {
+	var diff PlanDiff
+	names := map[string]bool{}
+	for levelName := range old.Levels {
+		names[levelName] = true
+	}
+	for levelName := range new.Levels {
+		names[levelName] = true
+	}
+	for _, levelName := range sortedNames(names) {
+		oldLevel, inOld := old.Levels[levelName]
+		newLevel, inNew := new.Levels[levelName]
+		switch {
+		case !inOld:
+			diff.AddedLevels = append(diff.AddedLevels, levelName)
+		case !inNew:
+			diff.RemovedLevels = append(diff.RemovedLevels, levelName)
+		default:
+			if ld := diffLevels(levelName, oldLevel, newLevel); !ld.empty() {
+				diff.ChangedLevels = append(diff.ChangedLevels, ld)
+			}
+		}
+	}
+	return diff
+}
+
+func diffLevels(levelName string, old, new Level) LevelDiff {
+	ld := LevelDiff{Name: levelName}
+	if old.Freq != new.Freq {
+		ld.OldFreq = old.Freq
+		ld.NewFreq = new.Freq
+	}
+	names := map[string]bool{}
+	for domainName := range old.Collect {
+		names[domainName] = true
+	}
+	for domainName := range new.Collect {
+		names[domainName] = true
+	}
+	for _, domainName := range sortedNames(names) {
+		oldDom, inOld := old.Collect[domainName]
+		newDom, inNew := new.Collect[domainName]
+		switch {
+		case !inOld:
+			ld.AddedDomains = append(ld.AddedDomains, domainName)
+		case !inNew:
+			ld.RemovedDomains = append(ld.RemovedDomains, domainName)
+		default:
+			if dd := diffDomains(domainName, oldDom, newDom); !dd.empty() {
+				ld.ChangedDomains = append(ld.ChangedDomains, dd)
+			}
+		}
+	}
+	return ld
+}
+
+func diffDomains(domainName string, old, new Domain) DomainDiff {
+	dd := DomainDiff{Name: domainName}
+	names := map[string]bool{}
+	for k := range old.Options {
+		names[k] = true
+	}
+	for k := range new.Options {
+		names[k] = true
+	}
+	for _, k := range sortedNames(names) {
+		oldVal, inOld := old.Options[k]
+		newVal, inNew := new.Options[k]
+		switch {
+		case !inOld:
+			dd.AddedOptions = append(dd.AddedOptions, k)
+		case !inNew:
+			dd.RemovedOptions = append(dd.RemovedOptions, k)
+		case oldVal != newVal:
+			dd.ChangedOptions = append(dd.ChangedOptions, k)
+		}
+	}
+	oldMetrics := map[string]bool{}
+	newMetrics := map[string]bool{}
+	names = map[string]bool{}
+	for _, m := range old.Metrics {
+		oldMetrics[m] = true
+		names[m] = true
+	}
+	for _, m := range new.Metrics {
+		newMetrics[m] = true
+		names[m] = true
+	}
+	for _, m := range sortedNames(names) {
+		switch {
+		case !oldMetrics[m]:
+			dd.AddedMetrics = append(dd.AddedMetrics, m)
+		case !newMetrics[m]:
+			dd.RemovedMetrics = append(dd.RemovedMetrics, m)
+		}
+	}
+	return dd
+}
+
+// sortedNames returns the names (map keys) sorted.
+func sortedNames(names map[string]bool) []string {
+	s := make([]string, 0, len(names))
+	for name := range names {
+		s = append(s, name)
+	}
+	sort.Strings(s)
+	return s
+}
+
+// Empty returns true if the plans are the same.
+func (d PlanDiff) Empty() bool {
+	return len(d.AddedLevels) == 0 && len(d.RemovedLevels) == 0 && len(d.ChangedLevels) == 0
+}
+
+func (d LevelDiff) empty() bool {
+	return d.OldFreq == d.NewFreq && len(d.AddedDomains) == 0 && len(d.RemovedDomains) == 0 && len(d.ChangedDomains) == 0
+}
+
+func (d DomainDiff) empty() bool {
+	return len(d.AddedOptions) == 0 && len(d.RemovedOptions) == 0 && len(d.ChangedOptions) == 0 &&
+		len(d.AddedMetrics) == 0 && len(d.RemovedMetrics) == 0
+}
+
+// String returns the diff on one line for logging, like "added levels: kpi;
+// at troubleshoot: freq 10s -> 5s; at troubleshoot/repl.lag: changed options:
+// writer", or "no changes".
+func (d PlanDiff) String() string {
+	if d.Empty() {
+		return "no changes"
+	}
+	var s []string
+	add := func(at, what string, names []string) {
+		if len(names) > 0 {
+			s = append(s, at+what+": "+strings.Join(names, ", "))
+		}
+	}
+	add("", "added levels", d.AddedLevels)
+	add("", "removed levels", d.RemovedLevels)
+	for _, ld := range d.ChangedLevels {
+		at := "at " + ld.Name + ": "
+		if ld.OldFreq != ld.NewFreq {
+			s = append(s, at+"freq "+ld.OldFreq+" -> "+ld.NewFreq)
+		}
+		add(at, "added domains", ld.AddedDomains)
+		add(at, "removed domains", ld.RemovedDomains)
+		for _, dd := range ld.ChangedDomains {
+			at := "at " + ld.Name + "/" + dd.Name + ": "
+			add(at, "added options", dd.AddedOptions)
+			add(at, "removed options", dd.RemovedOptions)
+			add(at, "changed options", dd.ChangedOptions)
+			add(at, "added metrics", dd.AddedMetrics)
+			add(at, "removed metrics", dd.RemovedMetrics)
+		}
+	}
+	return strings.Join(s, "; ")
+}
+
+// PlanInventory is every domain collected by a plan, across all levels: see
+// Plan.Inventory. Like PlanDiff, option values are not included.
+type PlanInventory struct {
+	Domains []DomainInventory // sorted by name
+}
+
+// DomainInventory is the union of a domain's levels, option keys, and metrics
+// across all levels in a plan. All lists are sorted and deduplicated.
+type DomainInventory struct {
+	Name    string
+	Levels  []string
+	Options []string
+	Metrics []string
+}
+
+// Inventory returns the domains, option keys, and metrics referenced by the
+// plan. It only traverses the plan; it does not validate or load collectors.
+func (p *Plan) Inventory() PlanInventory {
+	type sets struct{ levels, options, metrics map[string]bool }
+	all := map[string]*sets{}
+	for levelName, level := range p.Levels {
+		for domainName, dom := range level.Collect {
+			s := all[domainName]
+			if s == nil {
+				s = &sets{map[string]bool{}, map[string]bool{}, map[string]bool{}}
+				all[domainName] = s
+			}
+			s.levels[levelName] = true
+			for k := range dom.Options {
+				s.options[k] = true
+			}
+			for _, m := range dom.Metrics {
+				s.metrics[m] = true
+			}
+		}
+	}
+	names := map[string]bool{}
+	for name := range all {
+		names[name] = true
+	}
+	inv := PlanInventory{Domains: make([]DomainInventory, 0, len(all))}
+	for _, name := range sortedNames(names) {
+		s := all[name]
+		inv.Domains = append(inv.Domains, DomainInventory{
+			Name:    name,
+			Levels:  sortedNames(s.levels),
+			Options: sortedNames(s.options),
+			Metrics: sortedNames(s.metrics),
+		})
+	}
+	return inv
+}
+
+// Plan lint warning types: see Plan.Lint.
+const (
+	LINT_FREQ      = "freq"               // level freq is not collected as expected
+	LINT_DUPLICATE = "duplicate-domain"   // domain repeats what the level inherits
+	LINT_CONFLICT  = "conflicting-option" // option value differs from an inherited domain
+)
+
+// LintWarning is a non-fatal problem in a plan: see Plan.Lint. Like PlanDiff,
+// option values are not included because they can be secrets.
+type LintWarning struct {
+	Type    string // LINT_ constant
+	Level   string
+	Domain  string // empty for LINT_FREQ
+	Message string
+}
+
+// String returns the warning like "at slow/repl.lag: duplicate-domain: ...".
+func (w LintWarning) String() string {
+	at := w.Level
+	if w.Domain != "" {
+		at += "/" + w.Domain
+	}
+	return "at " + at + ": " + w.Type + ": " + w.Message
+}
+
+// Lint returns warnings for valid but likely unintended plan patterns. Levels
+// are collected on 1s ticks, and a level whose freq is a multiple of a faster
+// level inherits (also collects) the domains of the faster level, with the
+// faster level's options for options it doesn't set. Lint warns about:
+//
+//   - LINT_FREQ: a freq that is not a whole number of seconds, or that is not
+//     a multiple of a faster level freq, so the faster level is not collected
+//     when both are due
+//   - LINT_DUPLICATE: a domain with the same options and metrics (or a subset)
+//     as at a faster level that it inherits, so it's collected twice
+//   - LINT_CONFLICT: a domain option set to a different value than at a faster
+//     level that it inherits, like repl.lag writer, so the faster level option
+//     is not used at the slower level
+//
+// Call it after plans are fully loaded (ApplyDefaults and ResolveIncludes).
+// Levels with an invalid freq are ignored: see Validate. Warnings are sorted
+// by level freq, level, and domain.
+func (p *Plan) Lint() []LintWarning {
+	type lintLevel struct {
+		name string
+		freq time.Duration
+	}
+	levels := make([]lintLevel, 0, len(p.Levels))
+	for levelName, level := range p.Levels {
+		d, err := time.ParseDuration(level.Freq)
+		if err != nil || d <= 0 {
+			continue
+		}
+		levels = append(levels, lintLevel{name: levelName, freq: d})
+	}
+	sort.Slice(levels, func(i, j int) bool {
+		if levels[i].freq == levels[j].freq {
+			return levels[i].name < levels[j].name
+		}
+		return levels[i].freq < levels[j].freq
+	})
+
+	var warnings []LintWarning
+	for i, hi := range levels {
+		if hi.freq%time.Second != 0 {
+			warnings = append(warnings, LintWarning{
+				Type:    LINT_FREQ,
+				Level:   hi.name,
+				Message: fmt.Sprintf("freq %s is not a whole number of seconds; levels are collected every 1s", hi.freq),
+			})
+		}
+		for _, lo := range levels[:i] {
+			if lo.freq == hi.freq {
+				continue // duplicate freq: see Validate
+			}
+			if hi.freq%lo.freq != 0 {
+				warnings = append(warnings, LintWarning{
+					Type:    LINT_FREQ,
+					Level:   hi.name,
+					Message: fmt.Sprintf("freq %s is not a multiple of level %s freq %s, so %s is not collected when both are due", hi.freq, lo.name, lo.freq, lo.name),
+				})
+			}
+		}
+		for _, domainName := range sortedDomains(p.Levels[hi.name].Collect) {
+			dom := p.Levels[hi.name].Collect[domainName]
+			var duplicate string
+			var conflicts []string
+			for _, lo := range levels[:i] {
+				if lo.freq == hi.freq || hi.freq%lo.freq != 0 {
+					continue // not inherited
+				}
+				inherited, ok := p.Levels[lo.name].Collect[domainName]
+				if !ok {
+					continue
+				}
+				c := conflictingOptions(dom, inherited)
+				if len(c) > 0 {
+					conflicts = append(conflicts, fmt.Sprintf("%s (level %s)", strings.Join(c, ", "), lo.name))
+				} else if duplicate == "" && subsetMetrics(dom.Metrics, inherited.Metrics) && subsetOptions(dom.Options, inherited.Options) {
+					duplicate = lo.name
+				}
+			}
+			if duplicate != "" {
+				warnings = append(warnings, LintWarning{
+					Type:    LINT_DUPLICATE,
+					Level:   hi.name,
+					Domain:  domainName,
+					Message: fmt.Sprintf("same options and metrics as level %s, which this level inherits, so it's collected twice", duplicate),
+				})
+			}
+			if len(conflicts) > 0 {
+				warnings = append(warnings, LintWarning{
+					Type:    LINT_CONFLICT,
+					Level:   hi.name,
+					Domain:  domainName,
+					Message: "options differ from inherited domain: " + strings.Join(conflicts, "; "),
+				})
+			}
+		}
+	}
+	return warnings
+}
+
+// sortedDomains returns the domain names sorted.
+func sortedDomains(collect map[string]Domain) []string {
+	names := map[string]bool{}
+	for domainName := range collect {
+		names[domainName] = true
+	}
+	return sortedNames(names)
+}
+
+// conflictingOptions returns the sorted keys of options set in both domains
+// with different values.
+func conflictingOptions(dom, inherited Domain) []string {
+	names := map[string]bool{}
+	for k, v := range dom.Options {
+		if iv, ok := inherited.Options[k]; ok && iv != v {
+			names[k] = true
+		}
+	}
+	if len(names) == 0 {
+		return nil
+	}
+	return sortedNames(names)
+}
+
+// subsetMetrics returns true if every metric in a is in b.
+func subsetMetrics(a, b []string) bool {
+	in := map[string]bool{}
+	for _, m := range b {
+		in[m] = true
+	}
+	for _, m := range a {
+		if !in[m] {
+			return false
+		}
+	}
+	return true
+}
+
+// subsetOptions returns true if every option in a is in b with the same value.
+func subsetOptions(a, b map[string]string) bool {
+	for k, v := range a {
+		if bv, ok := b[k]; !ok || bv != v {
+			return false
 		}
 	}
+	return true
 }
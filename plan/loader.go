@@ -11,7 +11,6 @@ import (
 	"path/filepath"
 	"strings"
 	"sync"
-	"time"
 
 	"gopkg.in/yaml.v2"
 
@@ -69,6 +68,9 @@ func (pl *Loader) LoadShared(cfg blip.ConfigPlans, dbMaker blip.DbFactory) error
 		if len(plans) == 0 {
 			return fmt.Errorf("LoadPlans plugin returned zero plans, expected at least one in strict mode")
 		}
+		if err := normalizePlans(plans); err != nil {
+			return err
+		}
 		if err := ValidatePlans(plans); err != nil {
 			return err
 		}
@@ -106,8 +108,8 @@ func (pl *Loader) LoadShared(cfg blip.ConfigPlans, dbMaker blip.DbFactory) error
 		}
 		defer db.Close()
 
-		// Last arg "" = no monitorId, read all rows
-		plans, err := ReadTable(cfg.Table, db, "")
+		// No MonitorId: read all rows
+		plans, err := TableLoader{Table: cfg.Table, DB: db}.Load(context.Background())
 		if err != nil {
 			return err
 		}
@@ -191,7 +193,7 @@ func (pl *Loader) LoadMonitor(mon blip.ConfigMonitor, dbMaker blip.DbFactory) er
 		}
 		defer db.Close()
 
-		plans, err := ReadTable(table, db, mon.MonitorId)
+		plans, err := TableLoader{Table: table, DB: db, MonitorId: mon.MonitorId}.Load(context.Background())
 		if err != nil {
 			return nil
 		}
@@ -430,9 +432,12 @@ func ReadFile(file string) (blip.Plan, error) {
 	levels := make(map[string]blip.Level, len(pf))
 	for k := range pf {
 		levels[k] = blip.Level{
-			Name:    k, // must have, levels are collected by name
-			Freq:    pf[k].Freq,
-			Collect: pf[k].Collect,
+			Name:     k, // must have, levels are collected by name
+			Freq:     pf[k].Freq,
+			From:     pf[k].From,
+			Collect:  pf[k].Collect,
+			Defaults: pf[k].Defaults,
+			Labels:   pf[k].Labels,
 		}
 	}
 
@@ -441,6 +446,10 @@ func ReadFile(file string) (blip.Plan, error) {
 		Levels: levels,
 		Source: file,
 	}
+	plan.ApplyDefaults()
+	if err := plan.ResolveIncludes(); err != nil {
+		return blip.Plan{}, fmt.Errorf("invalid plan in %s: %s", file, err)
+	}
 	return plan, nil
 }
 
@@ -453,9 +462,12 @@ func ReadVariable(strVal, planName string) (blip.Plan, error) {
 	levels := make(map[string]blip.Level, len(pf))
 	for k := range pf {
 		levels[k] = blip.Level{
-			Name:    k, // must have, levels are collected by name
-			Freq:    pf[k].Freq,
-			Collect: pf[k].Collect,
+			Name:     k, // must have, levels are collected by name
+			Freq:     pf[k].Freq,
+			From:     pf[k].From,
+			Collect:  pf[k].Collect,
+			Defaults: pf[k].Defaults,
+			Labels:   pf[k].Labels,
 		}
 	}
 
@@ -464,12 +476,18 @@ func ReadVariable(strVal, planName string) (blip.Plan, error) {
 		Levels: levels,
 		Source: "variable",
 	}
+	plan.ApplyDefaults()
+	if err := plan.ResolveIncludes(); err != nil {
+		return blip.Plan{}, fmt.Errorf("invalid plan: %s", err)
+	}
 	return plan, nil
 }
 
 func ReadTable(table string, db *sql.DB, monitorId string) ([]blip.Plan, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-	defer cancel()
+	return TableLoader{Table: table, DB: db, MonitorId: monitorId}.Load(context.Background())
+}
+
+func readTable(ctx context.Context, table string, db *sql.DB, monitorId string) ([]blip.Plan, error) {
 	table = sqlutil.SanitizeTable(table, blip.DEFAULT_DATABASE)
 	q := fmt.Sprintf("SELECT name, plan, COALESCE(monitorId, '') FROM `%s`", table)
 	if monitorId != "" {
@@ -493,6 +511,10 @@ func ReadTable(table string, db *sql.DB, monitorId string) ([]blip.Plan, error)
 		if err != nil {
 			return nil, err
 		}
+		plan.ApplyDefaults()
+		if err := plan.ResolveIncludes(); err != nil {
+			return nil, fmt.Errorf("invalid plan: %s: %s", plan.Name, err)
+		}
 		plan.Source = table
 		plans = append(plans, plan)
 	}
@@ -528,9 +550,12 @@ func ValidatePlans(plans []blip.Plan) error {
 
 					// Implicit domain check: if the domain in the plan causes
 					// a collectory factory error, then the domain is invalid/
-					// doesn't exist
+					// doesn't exist, unless a mock collector is registered
 					var err error
 					mc, err = metrics.Make(domainName, blip.CollectorFactoryArgs{Validate: true})
+					if mock, ok := blip.MockCollector(domainName); err != nil && ok {
+						mc, err = mock, nil
+					}
 					if err != nil {
 						errMsgs = append(errMsgs, fmt.Sprintf("invalid plan: %s: at %s/%s: %s",
 							plans[i].Name, levelName, domainName, err))
@@ -544,16 +569,27 @@ func ValidatePlans(plans []blip.Plan) error {
 				// a blip.CollectorHelp struct which knows how to validate
 				// the input options because it (the struct) contains all the
 				// valid options.
-				err := mc.Help().Validate(plans[i].Levels[levelName].Collect[domainName].Options)
+				help := mc.Help()
+				opts := plans[i].Levels[levelName].Collect[domainName].Options
+				err := help.Validate(opts)
 				if err != nil {
 					errMsgs = append(errMsgs, fmt.Sprintf("invalid plan: %s: at %s/%s: %s",
 						plans[i].Name, levelName, domainName, err))
+					continue DOMAINS
+				}
+
+				// Options that don't apply (like a repl.lag option for another
+				// writer) are ignored by the collector, so warn but don't error
+				for _, msg := range help.Inapplicable(opts) {
+					event.Sendf(event.PLAN_OPTION_IGNORED, "plan %s: at %s/%s: %s", plans[i].Name, levelName, domainName, msg)
 				}
 			}
 		}
 	}
 
-	// Third level validation is each collector Prepare, called by monitor/Engine.Prepare
+	// Third level validation is in monitor/Engine.Prepare: warnings for options
+	// that don't apply to the server (if the collector implements
+	// blip.CollectorDynamicHelp), then each collector Prepare
 
 	if len(errMsgs) > 0 {
 		return fmt.Errorf("%d plan validation errors:\n%s", len(errMsgs), strings.Join(errMsgs, "\n"))
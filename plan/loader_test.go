@@ -164,3 +164,99 @@ func TestPlanShouldReturnDeepCopyOfPlan(t *testing.T) {
 		}
 	}
 }
+
+// remoteLoader is a fake PlanLoader, like a plan loader for a config service.
+type remoteLoader struct {
+	plans []blip.Plan
+	err   error
+}
+
+func (l remoteLoader) Load(ctx context.Context) ([]blip.Plan, error) {
+	return l.plans, l.err
+}
+
+func TestLoadFrom(t *testing.T) {
+	// Plans built in Go: no level or domain names, level defaults not applied,
+	// and an include, so the Loader must normalize them
+	remote := remoteLoader{
+		plans: []blip.Plan{
+			{
+				Name:   "remote1",
+				Source: "config-service",
+				Levels: map[string]blip.Level{
+					"kpi": {
+						Freq:     "1s",
+						Collect:  map[string]blip.Domain{"var.global": {Metrics: []string{"version"}}},
+						Defaults: map[string]map[string]string{"var.global": {"source": "select"}},
+					},
+				},
+			},
+			{
+				Name: "remote2",
+				Levels: map[string]blip.Level{
+					"kpi": {
+						Freq:    "1s",
+						Collect: map[string]blip.Domain{"var.global": {Metrics: []string{"version"}}},
+					},
+					"slow": {
+						Freq: "5s",
+						From: "kpi",
+					},
+				},
+			},
+		},
+	}
+
+	pl := plan.NewLoader(nil)
+	if err := pl.LoadFrom(context.Background(), remote); err != nil {
+		t.Fatal(err)
+	}
+	gotPlans := pl.SharedPlans()
+	for i := range gotPlans {
+		gotPlans[i].YAML = ""
+	}
+	expectPlans := []plan.Meta{
+		{Name: "remote1", Source: "config-service", Shared: true},
+		{Name: "remote2", Source: "loader", Shared: true},
+	}
+	if diff := deep.Equal(gotPlans, expectPlans); diff != nil {
+		t.Error(diff)
+	}
+
+	got, err := pl.Plan("", "remote1", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "kpi", got.Levels["kpi"].Name)
+	assert.Equal(t, "var.global", got.Levels["kpi"].Collect["var.global"].Name)
+	assert.Equal(t, map[string]string{"source": "select"}, got.Levels["kpi"].Collect["var.global"].Options)
+
+	got, err = pl.Plan("", "remote2", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, []string{"version"}, got.Levels["slow"].Collect["var.global"].Metrics)
+
+	// Multiple loaders, in order
+	pl = plan.NewLoader(nil)
+	files := plan.FileLoader{Files: []string{"../test/plans/version.yaml"}}
+	if err := pl.LoadFrom(context.Background(), files, remote); err != nil {
+		t.Fatal(err)
+	}
+	names := []string{}
+	for _, pm := range pl.SharedPlans() {
+		names = append(names, pm.Name)
+	}
+	assert.Equal(t, []string{"../test/plans/version.yaml", "remote1", "remote2"}, names)
+
+	// Invalid plan: validation error
+	bad := remoteLoader{plans: []blip.Plan{{
+		Name:   "bad",
+		Levels: map[string]blip.Level{"kpi": {Freq: "1s", Collect: map[string]blip.Domain{"no.such.domain": {}}}},
+	}}}
+	assert.Error(t, plan.NewLoader(nil).LoadFrom(context.Background(), bad))
+
+	// Loader error and zero plans
+	assert.Error(t, plan.NewLoader(nil).LoadFrom(context.Background(), remoteLoader{err: fmt.Errorf("service unavailable")}))
+	assert.Error(t, plan.NewLoader(nil).LoadFrom(context.Background(), remoteLoader{}))
+}
@@ -0,0 +1,133 @@
+// Copyright 2024 Block, Inc.
+
+package plan
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"path/filepath"
+	"time"
+
+	"github.com/cashapp/blip"
+	"github.com/cashapp/blip/event"
+)
+
+// PlanLoader loads plans from a source. FileLoader and TableLoader load plans
+// from files and a table. To load plans from another source, like a remote
+// config service, implement PlanLoader and call Loader.LoadFrom. Plans do not
+// need to be normalized: the Loader normalizes and validates them.
+type PlanLoader interface {
+	// Load returns all plans from the source.
+	Load(ctx context.Context) ([]blip.Plan, error)
+}
+
+// LoadFunc is an adapter to use an ordinary function as a PlanLoader.
+type LoadFunc func(ctx context.Context) ([]blip.Plan, error)
+
+// Load calls f(ctx).
+func (f LoadFunc) Load(ctx context.Context) ([]blip.Plan, error) {
+	return f(ctx)
+}
+
+// FileLoader loads plans from YAML files. Files are glob patterns, like
+// config.plans.files. Each file is one plan named by the file.
+type FileLoader struct {
+	Files []string
+}
+
+var _ PlanLoader = FileLoader{}
+
+// Load returns a plan for each file that matches the patterns. Unlike
+// config.plans.files, it returns an error if a file cannot be read.
+func (l FileLoader) Load(ctx context.Context) ([]blip.Plan, error) {
+	plans := []blip.Plan{}
+	for _, pattern := range l.Files {
+		files, err := filepath.Glob(pattern)
+		if err != nil {
+			return nil, err
+		}
+		for _, file := range files {
+			plan, err := ReadFile(file)
+			if err != nil {
+				return nil, err
+			}
+			plans = append(plans, plan)
+		}
+	}
+	return plans, nil
+}
+
+// TableLoader loads plans from a table, like config.plans.table. If MonitorId
+// is set, it loads only plans for the monitor.
+type TableLoader struct {
+	Table     string
+	DB        *sql.DB
+	MonitorId string
+}
+
+var _ PlanLoader = TableLoader{}
+
+// Load returns all plans in the table, or the plans for the monitor.
+func (l TableLoader) Load(ctx context.Context) ([]blip.Plan, error) {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	return readTable(ctx, l.Table, l.DB, l.MonitorId)
+}
+
+// LoadFrom loads shared plans from the plan loaders, in order, replacing
+// all shared plans. Plans are normalized (see normalizePlans) and validated.
+// Like the LoadPlans plugin, it returns an error if the loaders return zero
+// plans. The plan source is Plan.Source, or "loader" if not set.
+func (pl *Loader) LoadFrom(ctx context.Context, loaders ...PlanLoader) error {
+	event.Send(event.PLANS_LOAD_SHARED)
+	plans := []blip.Plan{}
+	for _, l := range loaders {
+		p, err := l.Load(ctx)
+		if err != nil {
+			return err
+		}
+		plans = append(plans, p...)
+	}
+	if len(plans) == 0 {
+		return fmt.Errorf("plan loaders returned zero plans, expected at least one")
+	}
+	if err := normalizePlans(plans); err != nil {
+		return err
+	}
+	if err := ValidatePlans(plans); err != nil {
+		return err
+	}
+
+	sharedPlans := make([]Meta, len(plans))
+	for i, plan := range plans {
+		source := plan.Source
+		if source == "" {
+			source = "loader"
+		}
+		sharedPlans[i] = Meta{
+			Name:   plan.Name,
+			plan:   plan,
+			Source: source,
+			Shared: true,
+		}
+	}
+	pl.Lock()
+	pl.sharedPlans = sharedPlans
+	pl.Unlock()
+	return nil
+}
+
+// normalizePlans normalizes plans that might have been built in Go rather than
+// read from YAML: names are set from map keys, level defaults are applied, and
+// includes are resolved. It's safe to call on plans already normalized.
+func normalizePlans(plans []blip.Plan) error {
+	for i := range plans {
+		plans[i].Normalize()
+		plans[i].ApplyDefaults()
+		if err := plans[i].ResolveIncludes(); err != nil {
+			return fmt.Errorf("invalid plan: %s: %s", plans[i].Name, err)
+		}
+	}
+	return nil
+}
@@ -3,6 +3,7 @@
 package blip_test
 
 import (
+	"encoding/json"
 	"os"
 	"strings"
 	"testing"
@@ -63,6 +64,68 @@ func TestPlanInterpolation(t *testing.T) {
 	}
 }
 
+func TestPlanInterpolateMetrics(t *testing.T) {
+	// Variables in metrics lists expand to comma-separated lists of metrics
+	plan := test.ReadPlan(t, "./test/plans/interpolate_metrics.yaml")
+	mon := &blip.ConfigMonitor{
+		MonitorId: "mon1",
+		Meta: map[string]string{
+			"status": "threads_running, queries",
+		},
+	}
+	os.Setenv("BLIP_TEST_VARS", "max_connections,read_only")
+	defer os.Unsetenv("BLIP_TEST_VARS")
+
+	plan.InterpolateEnvVars()
+	plan.InterpolateMonitor(mon)
+
+	expect := map[string][]string{
+		"status.global": {"threads_running", "queries", "uptime"},
+		"var.global":    {"max_connections", "read_only"},
+		"innodb":        {"trx_rseg_history_len"}, // empty value removed
+	}
+	for domain, metrics := range expect {
+		got := plan.Levels["level1"].Collect[domain].Metrics
+		if diff := deep.Equal(got, metrics); diff != nil {
+			t.Errorf("%s: %v", domain, diff)
+		}
+	}
+}
+
+func TestPlanInterpolateFreq(t *testing.T) {
+	// Level freq can be an env var, with or without a default value
+	os.Setenv("BLIP_TEST_PERF_FREQ", "2s")
+	defer os.Unsetenv("BLIP_TEST_PERF_FREQ")
+	os.Unsetenv("BLIP_TEST_KPI_FREQ")
+
+	plan := test.ReadPlan(t, "./test/plans/interpolate_freq.yaml")
+	if err := plan.Validate(); err != nil {
+		t.Fatalf("Validate: %s", err)
+	}
+	plan.InterpolateEnvVars()
+	if got := plan.Levels["perf"].Freq; got != "2s" {
+		t.Errorf("perf freq = %s, expected 2s", got)
+	}
+	if got := plan.Levels["kpi"].Freq; got != "5s" {
+		t.Errorf("kpi freq = %s, expected 5s (default)", got)
+	}
+	min, _ := plan.Freq()
+	if min != 2*time.Second {
+		t.Errorf("min freq = %s, expected 2s", min)
+	}
+
+	// Env var not set and no default: freq is left as-is, which is invalid
+	os.Unsetenv("BLIP_TEST_PERF_FREQ")
+	plan = test.ReadPlan(t, "./test/plans/interpolate_freq.yaml")
+	if err := plan.Validate(); err == nil || !strings.Contains(err.Error(), "${BLIP_TEST_PERF_FREQ}") {
+		t.Errorf("Validate: got error %v, expected invalid freq ${BLIP_TEST_PERF_FREQ}", err)
+	}
+	plan.InterpolateEnvVars()
+	if got := plan.Levels["perf"].Freq; got != "${BLIP_TEST_PERF_FREQ}" {
+		t.Errorf("perf freq = %s, expected literal ${BLIP_TEST_PERF_FREQ}", got)
+	}
+}
+
 func TestValidateMetricName(t *testing.T) {
 	// Test plan.Validate catches invalid metric names.
 
@@ -129,3 +192,597 @@ func TestPlanFreq(t *testing.T) {
 		t.Error(diff)
 	}
 }
+
+func TestValidateMockCollector(t *testing.T) {
+	// Test plan.Validate validates options and metrics against the help
+	// of a mock collector
+	blip.RegisterMockCollector("domain1", blip.CollectorHelp{
+		Options: map[string]blip.CollectorHelpOption{
+			"opt1": {Name: "opt1"},
+			"opt3": {Name: "opt3"},
+		},
+		Metrics: []blip.CollectorMetric{
+			{Name: "metric1", Type: blip.GAUGE},
+		},
+	})
+	defer blip.RemoveMockCollector("domain1")
+
+	mc, ok := blip.MockCollector("domain1")
+	if !ok {
+		t.Fatal("MockCollector returned false, expected true after RegisterMockCollector")
+	}
+	if mc.Domain() != "domain1" {
+		t.Errorf("got domain %s, expected domain1", mc.Domain())
+	}
+
+	plan := test.ReadPlan(t, "./test/plans/interpolate1.yaml")
+	if err := plan.Validate(); err != nil {
+		t.Error(err)
+	}
+
+	// Unknown option
+	plan.Levels["level1"].Collect["domain1"].Options["bad-opt"] = "x"
+	err := plan.Validate()
+	if err == nil {
+		t.Fatal("Validate no error, expected error for unknown option")
+	}
+	if !strings.Contains(err.Error(), "bad-opt") {
+		t.Errorf("error message does not state unknown option, expected 'bad-opt': %s", err)
+	}
+	delete(plan.Levels["level1"].Collect["domain1"].Options, "bad-opt")
+
+	// Unknown metric
+	dom := plan.Levels["level2"].Collect["domain1"]
+	dom.Metrics = append(dom.Metrics, "metric9")
+	plan.Levels["level2"].Collect["domain1"] = dom
+	err = plan.Validate()
+	if err == nil {
+		t.Fatal("Validate no error, expected error for unknown metric")
+	}
+	if !strings.Contains(err.Error(), "metric9") {
+		t.Errorf("error message does not state unknown metric, expected 'metric9': %s", err)
+	}
+
+	// Not registered after remove
+	blip.RemoveMockCollector("domain1")
+	if _, ok := blip.MockCollector("domain1"); ok {
+		t.Error("MockCollector returned true after RemoveMockCollector, expected false")
+	}
+}
+
+func TestResolveIncludes(t *testing.T) {
+	// Test that levels inherit the collect map of the level given by from,
+	// and that domains in the level override inherited domains. See the plan
+	// file for the levels and domains.
+	plan := test.ReadPlan(t, "./test/plans/from.yaml") // calls ResolveIncludes
+
+	// Simple inherit: level2 gets status.global from level1
+	expect := blip.Domain{Metrics: []string{"threads_running", "queries"}}
+	if diff := deep.Equal(plan.Levels["level2"].Collect["status.global"], expect); diff != nil {
+		t.Error(diff)
+	}
+
+	// Override: level2 repl.lag replaces level1 repl.lag
+	got := plan.Levels["level2"].Collect["repl.lag"].Options["writer"]
+	if got != "blip" {
+		t.Errorf("level2 repl.lag writer = %s, expected blip", got)
+	}
+	got = plan.Levels["level1"].Collect["repl.lag"].Options["writer"]
+	if got != "pfs" {
+		t.Errorf("level1 repl.lag writer = %s, expected pfs (not modified)", got)
+	}
+
+	// Chained: level3 inherits from level2 which inherits from level1
+	if len(plan.Levels["level3"].Collect) != 3 {
+		t.Errorf("level3 collects %d domains, expected 3: %v", len(plan.Levels["level3"].Collect), plan.Levels["level3"].Collect)
+	}
+	got = plan.Levels["level3"].Collect["repl.lag"].Options["writer"]
+	if got != "blip" {
+		t.Errorf("level3 repl.lag writer = %s, expected blip", got)
+	}
+	for levelName := range plan.Levels {
+		if plan.Levels[levelName].From != "" {
+			t.Errorf("%s From = %s, expected empty after resolving", levelName, plan.Levels[levelName].From)
+		}
+	}
+
+	// Inherited domains are copies, not shared with the original level
+	plan.Levels["level2"].Collect["status.global"].Metrics[0] = "changed"
+	if plan.Levels["level1"].Collect["status.global"].Metrics[0] != "threads_running" {
+		t.Error("level1 metrics changed by level2, expected inherited domain to be a copy")
+	}
+}
+
+func TestResolveIncludesErrors(t *testing.T) {
+	// Cycle: a -> b -> a
+	plan := blip.Plan{
+		Name: "cycle",
+		Levels: map[string]blip.Level{
+			"a": {Name: "a", Freq: "1s", From: "b"},
+			"b": {Name: "b", Freq: "2s", From: "a"},
+		},
+	}
+	err := plan.ResolveIncludes()
+	if err == nil {
+		t.Fatal("ResolveIncludes no error, expected error for cycle")
+	}
+	if !strings.Contains(err.Error(), "cycle") {
+		t.Errorf("error message does not state cycle: %s", err)
+	}
+
+	// Self reference is a cycle, too
+	plan = blip.Plan{
+		Name: "self",
+		Levels: map[string]blip.Level{
+			"a": {Name: "a", Freq: "1s", From: "a"},
+		},
+	}
+	if err := plan.ResolveIncludes(); err == nil {
+		t.Error("ResolveIncludes no error, expected error for self reference")
+	}
+
+	// Unknown level
+	plan = blip.Plan{
+		Name: "unknown",
+		Levels: map[string]blip.Level{
+			"a": {Name: "a", Freq: "1s", From: "zzz"},
+		},
+	}
+	err = plan.ResolveIncludes()
+	if err == nil {
+		t.Fatal("ResolveIncludes no error, expected error for unknown level")
+	}
+	if !strings.Contains(err.Error(), "zzz") {
+		t.Errorf("error message does not state unknown level 'zzz': %s", err)
+	}
+}
+
+func TestApplyDefaults(t *testing.T) {
+	// See the plan file for the levels, domains, and defaults
+	plan := test.ReadPlan(t, "./test/plans/defaults.yaml") // calls ApplyDefaults
+
+	// Domain option overrides default; other defaults are merged
+	expect := map[string]string{
+		"table":      "hb.heartbeat",
+		"repl-check": "super_read_only",
+	}
+	if diff := deep.Equal(plan.Levels["level1"].Collect["repl.lag"].Options, expect); diff != nil {
+		t.Error(diff)
+	}
+
+	// Domains without defaults are not changed
+	if plan.Levels["level1"].Collect["status.global"].Options != nil {
+		t.Errorf("status.global options = %v, expected nil", plan.Levels["level1"].Collect["status.global"].Options)
+	}
+
+	// Defaults for domains not collected don't add the domain
+	if _, ok := plan.Levels["level1"].Collect["size.table"]; ok {
+		t.Error("size.table collected, expected only defaults (not collected)")
+	}
+
+	// Inherited domain is inherited with defaults applied
+	if diff := deep.Equal(plan.Levels["level2"].Collect["repl.lag"].Options, expect); diff != nil {
+		t.Error(diff)
+	}
+
+	// Idempotent
+	plan.ApplyDefaults()
+	if diff := deep.Equal(plan.Levels["level1"].Collect["repl.lag"].Options, expect); diff != nil {
+		t.Error(diff)
+	}
+}
+
+func TestDiffPlans(t *testing.T) {
+	old := blip.Plan{
+		Name: "old",
+		Levels: map[string]blip.Level{
+			"kpi": {
+				Freq: "5s",
+				Collect: map[string]blip.Domain{
+					"status.global": {Metrics: []string{"queries", "threads_running"}},
+					"repl.lag":      {Options: map[string]string{"writer": "blip", "table": "hb.heartbeat", "round": "ms"}},
+					"var.global":    {Metrics: []string{"max_connections"}},
+				},
+			},
+			"troubleshoot": {
+				Freq:    "30s",
+				Collect: map[string]blip.Domain{"innodb": {}},
+			},
+		},
+	}
+	new := blip.Plan{
+		Name: "new",
+		Levels: map[string]blip.Level{
+			"kpi": {
+				Freq: "5s",
+				Collect: map[string]blip.Domain{
+					"status.global": {Metrics: []string{"queries", "threads_connected"}},
+					"repl.lag":      {Options: map[string]string{"writer": "pfs", "table": "hb.heartbeat", "report-trend": "yes"}},
+				},
+			},
+			"troubleshoot": {
+				Freq:    "10s",
+				Collect: map[string]blip.Domain{"innodb": {}},
+			},
+			"sla": {
+				Freq:    "1s",
+				Collect: map[string]blip.Domain{"repl.lag": {}},
+			},
+		},
+	}
+
+	diff := blip.DiffPlans(old, new)
+	expect := blip.PlanDiff{
+		AddedLevels: []string{"sla"},
+		ChangedLevels: []blip.LevelDiff{
+			{
+				Name:           "kpi",
+				RemovedDomains: []string{"var.global"},
+				ChangedDomains: []blip.DomainDiff{
+					{
+						Name:           "repl.lag",
+						AddedOptions:   []string{"report-trend"},
+						RemovedOptions: []string{"round"},
+						ChangedOptions: []string{"writer"},
+					},
+					{
+						Name:           "status.global",
+						AddedMetrics:   []string{"threads_connected"},
+						RemovedMetrics: []string{"threads_running"},
+					},
+				},
+			},
+			{
+				Name:    "troubleshoot",
+				OldFreq: "30s",
+				NewFreq: "10s",
+			},
+		},
+	}
+	if d := deep.Equal(diff, expect); d != nil {
+		t.Error(d)
+	}
+	expectStr := "added levels: sla; at kpi: removed domains: var.global; " +
+		"at kpi/repl.lag: added options: report-trend; at kpi/repl.lag: removed options: round; at kpi/repl.lag: changed options: writer; " +
+		"at kpi/status.global: added metrics: threads_connected; at kpi/status.global: removed metrics: threads_running; " +
+		"at troubleshoot: freq 30s -> 10s"
+	if diff.String() != expectStr {
+		t.Errorf("got %q, expected %q", diff.String(), expectStr)
+	}
+
+	// Reverse: removed level
+	diff = blip.DiffPlans(new, old)
+	if diff.RemovedLevels == nil || diff.RemovedLevels[0] != "sla" {
+		t.Errorf("RemovedLevels = %v, expected [sla]", diff.RemovedLevels)
+	}
+
+	// Same plan (name is not compared)
+	diff = blip.DiffPlans(old, blip.Plan{Name: "other", Levels: old.Levels})
+	if !diff.Empty() {
+		t.Errorf("got diff %s, expected no changes", diff)
+	}
+	if diff.String() != "no changes" {
+		t.Errorf("got %q, expected \"no changes\"", diff.String())
+	}
+}
+
+func TestInventory(t *testing.T) {
+	plan := blip.Plan{
+		Name: "inv",
+		Levels: map[string]blip.Level{
+			"kpi": {
+				Freq: "5s",
+				Collect: map[string]blip.Domain{
+					"status.global": {Metrics: []string{"threads_running", "queries"}},
+					"repl.lag":      {Options: map[string]string{"writer": "blip", "round": "ms"}},
+				},
+			},
+			"troubleshoot": {
+				Freq: "30s",
+				Collect: map[string]blip.Domain{
+					"status.global": {Metrics: []string{"queries", "aborted_clients"}},
+					"repl.lag":      {Options: map[string]string{"writer": "pfs", "report-trend": "yes"}},
+					"innodb":        {},
+				},
+			},
+		},
+	}
+	expect := blip.PlanInventory{
+		Domains: []blip.DomainInventory{
+			{
+				Name:    "innodb",
+				Levels:  []string{"troubleshoot"},
+				Options: []string{},
+				Metrics: []string{},
+			},
+			{
+				Name:    "repl.lag",
+				Levels:  []string{"kpi", "troubleshoot"},
+				Options: []string{"report-trend", "round", "writer"},
+				Metrics: []string{},
+			},
+			{
+				Name:    "status.global",
+				Levels:  []string{"kpi", "troubleshoot"},
+				Options: []string{},
+				Metrics: []string{"aborted_clients", "queries", "threads_running"},
+			},
+		},
+	}
+	if d := deep.Equal(plan.Inventory(), expect); d != nil {
+		t.Error(d)
+	}
+
+	// Empty plan
+	empty := blip.Plan{}
+	if inv := empty.Inventory(); len(inv.Domains) != 0 {
+		t.Errorf("got %d domains, expected 0", len(inv.Domains))
+	}
+}
+
+func TestLint(t *testing.T) {
+	plan := blip.Plan{
+		Name: "lint",
+		Levels: map[string]blip.Level{
+			"kpi": {
+				Freq: "5s",
+				Collect: map[string]blip.Domain{
+					"status.global": {Metrics: []string{"threads_running", "queries"}},
+					"repl.lag":      {Options: map[string]string{"writer": "pfs", "round": "ms"}},
+				},
+			},
+			"standard": {
+				Freq: "20s",
+				Collect: map[string]blip.Domain{
+					"status.global": {Metrics: []string{"queries"}},                                // duplicate of kpi
+					"repl.lag":      {Options: map[string]string{"writer": "blip", "round": "ms"}}, // conflicts with kpi
+					"innodb":        {},
+				},
+			},
+			"odd": {
+				Freq: "7s", // not a multiple of 5s
+				Collect: map[string]blip.Domain{
+					"status.global": {Metrics: []string{"queries"}}, // not inherited: no warning
+				},
+			},
+			"fast": {
+				Freq: "1500ms", // not whole seconds
+				Collect: map[string]blip.Domain{
+					"var.global": {},
+				},
+			},
+		},
+	}
+	expect := []blip.LintWarning{
+		{
+			Type:    blip.LINT_FREQ,
+			Level:   "fast",
+			Message: "freq 1.5s is not a whole number of seconds; levels are collected every 1s",
+		},
+		{
+			Type:    blip.LINT_FREQ,
+			Level:   "kpi",
+			Message: "freq 5s is not a multiple of level fast freq 1.5s, so fast is not collected when both are due",
+		},
+		{
+			Type:    blip.LINT_FREQ,
+			Level:   "odd",
+			Message: "freq 7s is not a multiple of level fast freq 1.5s, so fast is not collected when both are due",
+		},
+		{
+			Type:    blip.LINT_FREQ,
+			Level:   "odd",
+			Message: "freq 7s is not a multiple of level kpi freq 5s, so kpi is not collected when both are due",
+		},
+		{
+			Type:    blip.LINT_FREQ,
+			Level:   "standard",
+			Message: "freq 20s is not a multiple of level fast freq 1.5s, so fast is not collected when both are due",
+		},
+		{
+			Type:    blip.LINT_FREQ,
+			Level:   "standard",
+			Message: "freq 20s is not a multiple of level odd freq 7s, so odd is not collected when both are due",
+		},
+		{
+			Type:    blip.LINT_CONFLICT,
+			Level:   "standard",
+			Domain:  "repl.lag",
+			Message: "options differ from inherited domain: writer (level kpi)",
+		},
+		{
+			Type:    blip.LINT_DUPLICATE,
+			Level:   "standard",
+			Domain:  "status.global",
+			Message: "same options and metrics as level kpi, which this level inherits, so it's collected twice",
+		},
+	}
+	got := plan.Lint()
+	if d := deep.Equal(got, expect); d != nil {
+		t.Error(d)
+	}
+
+	expectStr := "at standard/repl.lag: conflicting-option: options differ from inherited domain: writer (level kpi)"
+	if s := got[6].String(); s != expectStr {
+		t.Errorf("got %q, expected %q", s, expectStr)
+	}
+
+	// Default plans don't have lint warnings
+	for _, plan := range []blip.Plan{default_plan.MySQL(), default_plan.Exporter()} {
+		if warnings := plan.Lint(); len(warnings) != 0 {
+			t.Errorf("%s: got lint warnings: %v", plan.Name, warnings)
+		}
+	}
+}
+
+func TestUnmarshalPlanJSON(t *testing.T) {
+	data := []byte(`{
+  "name": "json-plan",
+  "levels": {
+    "kpi": {
+      "freq": "1s",
+      "collect": {
+        "status.global": {"metrics": ["threads_running"]},
+        "repl.lag": {"options": {"writer": "pfs"}}
+      }
+    },
+    "slow": {
+      "freq": "10s",
+      "from": "kpi",
+      "defaults": {"repl.lag": {"report-trend": "yes"}},
+      "collect": {
+        "repl.lag": {"options": {"writer": "blip"}}
+      }
+    }
+  }
+}`)
+	plan, err := blip.UnmarshalPlanJSON(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Name back-filled from map keys, defaults and includes applied
+	expect := blip.Plan{
+		Name: "json-plan",
+		Levels: map[string]blip.Level{
+			"kpi": {
+				Name: "kpi",
+				Freq: "1s",
+				Collect: map[string]blip.Domain{
+					"status.global": {Name: "status.global", Metrics: []string{"threads_running"}},
+					"repl.lag":      {Name: "repl.lag", Options: map[string]string{"writer": "pfs"}},
+				},
+			},
+			"slow": {
+				Name:     "slow",
+				Freq:     "10s",
+				Defaults: map[string]map[string]string{"repl.lag": {"report-trend": "yes"}},
+				Collect: map[string]blip.Domain{
+					"status.global": {Name: "status.global", Metrics: []string{"threads_running"}},
+					"repl.lag":      {Name: "repl.lag", Options: map[string]string{"writer": "blip", "report-trend": "yes"}},
+				},
+			},
+		},
+	}
+	if diff := deep.Equal(plan, expect); diff != nil {
+		t.Error(diff)
+	}
+
+	// Round trip: Name fields are not encoded but back-filled on decode
+	bytes, err := json.Marshal(plan)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(bytes), `"Name"`) {
+		t.Errorf("Name encoded in JSON: %s", bytes)
+	}
+	plan2, err := blip.UnmarshalPlanJSON(bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := deep.Equal(plan2, expect); diff != nil {
+		t.Error(diff)
+	}
+
+	// Invalid JSON and invalid plan
+	if _, err := blip.UnmarshalPlanJSON([]byte(`{"levels": [`)); err == nil {
+		t.Error("no error for invalid JSON")
+	}
+	if _, err := blip.UnmarshalPlanJSON([]byte(`{"levels": {"kpi": {"freq": "1s", "from": "nope"}}}`)); err == nil {
+		t.Error("no error for unknown from level")
+	}
+}
+
+func TestNormalize(t *testing.T) {
+	// Plan built in Go without some names: only empty names are set
+	plan := blip.Plan{
+		Name: "go-plan",
+		Levels: map[string]blip.Level{
+			"kpi": {
+				Freq: "1s",
+				Collect: map[string]blip.Domain{
+					"status.global": {Metrics: []string{"threads_running"}},
+					"repl.lag":      {Name: "repl.lag"},
+				},
+			},
+			"prom": {
+				Name: "prom",
+				Freq: "5s",
+				Collect: map[string]blip.Domain{
+					"var.global": {},
+				},
+			},
+		},
+	}
+	plan.Normalize()
+	expect := blip.Plan{
+		Name: "go-plan",
+		Levels: map[string]blip.Level{
+			"kpi": {
+				Name: "kpi",
+				Freq: "1s",
+				Collect: map[string]blip.Domain{
+					"status.global": {Name: "status.global", Metrics: []string{"threads_running"}},
+					"repl.lag":      {Name: "repl.lag"},
+				},
+			},
+			"prom": {
+				Name: "prom",
+				Freq: "5s",
+				Collect: map[string]blip.Domain{
+					"var.global": {Name: "var.global"},
+				},
+			},
+		},
+	}
+	if diff := deep.Equal(plan, expect); diff != nil {
+		t.Error(diff)
+	}
+
+	// No levels: no-op
+	plan = blip.Plan{Name: "empty"}
+	plan.Normalize()
+	if plan.Levels != nil {
+		t.Errorf("Levels = %v, expected nil", plan.Levels)
+	}
+}
+
+func TestLevelLabels(t *testing.T) {
+	plan := test.ReadPlan(t, "./test/plans/labels.yaml")
+
+	// Level labels only
+	expect := map[string]string{"team": "dba", "tier": "1"}
+	if diff := deep.Equal(plan.LevelLabels("level1"), expect); diff != nil {
+		t.Error(diff)
+	}
+	if labels := plan.LevelLabels("level2"); labels != nil {
+		t.Errorf("level2 labels = %v, expected nil", labels)
+	}
+
+	// Plan labels merged, level labels take precedence
+	plan.Labels = map[string]string{"env": "prod", "tier": "2"}
+	expect = map[string]string{"env": "prod", "team": "dba", "tier": "1"}
+	if diff := deep.Equal(plan.LevelLabels("level1"), expect); diff != nil {
+		t.Error(diff)
+	}
+	expect = map[string]string{"env": "prod", "tier": "2"}
+	if diff := deep.Equal(plan.LevelLabels("level2"), expect); diff != nil {
+		t.Error(diff)
+	}
+
+	// Copy: changing the returned map does not change the plan
+	plan.LevelLabels("level1")["team"] = "other"
+	if plan.Levels["level1"].Labels["team"] != "dba" {
+		t.Errorf("level1 labels changed: %v", plan.Levels["level1"].Labels)
+	}
+
+	// JSON plan labels
+	plan, err := blip.UnmarshalPlanJSON([]byte(`{"name": "p1", "labels": {"env": "prod"}, "levels": {"kpi": {"freq": "1s", "labels": {"team": "dba"}}}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect = map[string]string{"env": "prod", "team": "dba"}
+	if diff := deep.Equal(plan.LevelLabels("kpi"), expect); diff != nil {
+		t.Error(diff)
+	}
+}
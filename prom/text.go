@@ -0,0 +1,53 @@
+// Copyright 2024 Block, Inc.
+
+package prom
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/expfmt"
+
+	"github.com/cashapp/blip"
+)
+
+// Text returns the metric values of a domain, like repl.lag, in Prometheus text
+// exposition format. The domain must have a translator (see Translator), which
+// determines the Prometheus names, types, and labels. Metric families are sorted
+// by name.
+func Text(domain string, values []blip.MetricValue) (string, error) {
+	tr := Translator(domain)
+	if tr == nil {
+		return "", fmt.Errorf("no translator registered for %s", domain)
+	}
+	r := prometheus.NewRegistry()
+	if err := r.Register(textCollector{tr: tr, values: values}); err != nil {
+		return "", err
+	}
+	mfs, err := r.Gather()
+	if err != nil {
+		return "", fmt.Errorf("cannot convert %s metrics to Prometheus metrics: %s", domain, err)
+	}
+	var buf bytes.Buffer
+	for _, mf := range mfs {
+		if _, err := expfmt.MetricFamilyToText(&buf, mf); err != nil {
+			return "", err
+		}
+	}
+	return buf.String(), nil
+}
+
+// textCollector is an unchecked Prometheus collector for Text.
+type textCollector struct {
+	tr     DomainTranslator
+	values []blip.MetricValue
+}
+
+func (c textCollector) Describe(descs chan<- *prometheus.Desc) {
+	// Left empty intentionally to make the collector unchecked.
+}
+
+func (c textCollector) Collect(ch chan<- prometheus.Metric) {
+	c.tr.Translate(c.values, ch)
+}
@@ -0,0 +1,100 @@
+// Copyright 2024 Block, Inc.
+
+package prom_test
+
+import (
+	"testing"
+
+	"github.com/go-test/deep"
+
+	"github.com/cashapp/blip"
+	"github.com/cashapp/blip/prom"
+)
+
+func TestTextReplLag(t *testing.T) {
+	// Multi-channel repl.lag: current per channel (Group) with source (Meta),
+	// one channel stale, so the stale label is empty for the other channel
+	values := []blip.MetricValue{
+		{
+			Name:  "current",
+			Type:  blip.GAUGE,
+			Value: 1500,
+			Group: map[string]string{"channel": "ch1"},
+			Meta:  map[string]string{"source": "src1"},
+		},
+		{
+			Name:  "current",
+			Type:  blip.GAUGE,
+			Value: -1,
+			Group: map[string]string{"channel": "ch2"},
+			Meta:  map[string]string{"source": "src2", "stale": "yes"},
+		},
+		{
+			Name:  "disagreement",
+			Type:  blip.GAUGE,
+			Value: 250,
+			Group: map[string]string{"channel": "ch1"},
+		},
+		{
+			Name:  "reader_restarts",
+			Type:  blip.CUMULATIVE_COUNTER,
+			Value: 3,
+		},
+		{
+			Name:  "pos_backlog",
+			Type:  blip.GAUGE,
+			Value: 4096,
+			Group: map[string]string{"channel": "ch1"},
+		},
+	}
+	got, err := prom.Text("repl.lag", values)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect := `# HELP mysql_repl_lag_disagreement_seconds Replication lag gauge metric (repl.lag.disagreement).
+# TYPE mysql_repl_lag_disagreement_seconds gauge
+mysql_repl_lag_disagreement_seconds{channel="ch1"} 0.25
+# HELP mysql_repl_lag_pos_backlog_bytes Replication lag gauge metric (repl.lag.pos_backlog).
+# TYPE mysql_repl_lag_pos_backlog_bytes gauge
+mysql_repl_lag_pos_backlog_bytes{channel="ch1"} 4096
+# HELP mysql_repl_lag_reader_restarts_total Replication lag counter metric (repl.lag.reader_restarts).
+# TYPE mysql_repl_lag_reader_restarts_total counter
+mysql_repl_lag_reader_restarts_total 3
+# HELP mysql_repl_lag_seconds Replication lag gauge metric (repl.lag.current).
+# TYPE mysql_repl_lag_seconds gauge
+mysql_repl_lag_seconds{channel="ch1",source="src1",stale=""} 1.5
+mysql_repl_lag_seconds{channel="ch2",source="src2",stale="yes"} -1
+`
+	if diff := deep.Equal(got, expect); diff != nil {
+		t.Logf("got:\n%s", got)
+		t.Error(diff)
+	}
+
+	// unit=s: value is already seconds, and Meta unit isn't a label. Meta
+	// trace_id isn't a label either: it's unique per collection.
+	values = []blip.MetricValue{
+		{
+			Name:  "current",
+			Type:  blip.GAUGE,
+			Value: 1.5,
+			Meta:  map[string]string{"source": "src1", "unit": "s", "trace_id": "4bf92f3577b34da6a3ce929d0e0e4736"},
+		},
+	}
+	got, err = prom.Text("repl.lag", values)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect = `# HELP mysql_repl_lag_seconds Replication lag gauge metric (repl.lag.current).
+# TYPE mysql_repl_lag_seconds gauge
+mysql_repl_lag_seconds{source="src1"} 1.5
+`
+	if diff := deep.Equal(got, expect); diff != nil {
+		t.Logf("got:\n%s", got)
+		t.Error(diff)
+	}
+
+	// Domain without a translator
+	if _, err := prom.Text("foo", values); err == nil {
+		t.Error("no error for domain without translator, expected one")
+	}
+}
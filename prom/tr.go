@@ -36,4 +36,5 @@ var trRepo = map[string]DomainTranslator{
 	"status.global": tr.StatusGlobal{Domain: "global_status", ShortDomain: "status"},
 	"var.global":    tr.Generic{Domain: "global_variables", ShortDomain: "var"},
 	"innodb":        tr.InnoDBMetrics{Domain: "info_schema_innodb", ShortDomain: "innodb"},
+	"repl.lag":      tr.ReplLag{Domain: "repl_lag", ShortDomain: "repl_lag"},
 }
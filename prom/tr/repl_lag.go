@@ -0,0 +1,156 @@
+// Copyright 2024 Block, Inc.
+
+package tr
+
+import (
+	"math"
+	"sort"
+	"strings"
+	"sync"
+
+	prom "github.com/prometheus/client_golang/prometheus"
+
+	"github.com/cashapp/blip"
+	repllag "github.com/cashapp/blip/metrics/repl.lag"
+)
+
+// ReplLag translates repl.lag metrics. Unlike the mysqld_exporter domains, it
+// doesn't emulate an exporter metric: names follow Prometheus conventions, like
+// mysql_repl_lag_seconds for repl.lag.current. Time values are converted to
+// seconds (the Prometheus base unit) and the unit is the name suffix, like
+// _seconds and _bytes. Group and Meta are labels, except Meta unit (the name
+// has the unit) and trace_id (unique per collection, so a new time series each
+// time). Absent values (-1 and NaN) are not converted.
+type ReplLag struct {
+	Domain      string
+	ShortDomain string
+}
+
+func (tr ReplLag) Names() (string, string, string) {
+	return GENERIC_PREFIX, tr.Domain, tr.ShortDomain
+}
+
+var (
+	replLagUnitsOnce = &sync.Once{}
+	replLagUnits     map[string]string // metric name => repl.lag Help unit
+)
+
+func (tr ReplLag) Translate(values []blip.MetricValue, ch chan<- prom.Metric) {
+	replLagUnitsOnce.Do(func() {
+		replLagUnits = map[string]string{}
+		for _, m := range repllag.NewLag(nil).Help().Metrics {
+			replLagUnits[m.Name] = m.Unit
+		}
+	})
+
+	// Label names must be the same for all metrics with the same name (a
+	// family), but Meta varies, like stale only on stale lag, so each metric
+	// has the union of label names; missing labels are empty (not set)
+	labelNames := map[string][]string{}
+	for i := range values {
+		name := tr.name(values[i])
+		labelNames[name] = union(labelNames[name], labelKeys(values[i]))
+	}
+
+	for i := range values {
+		var promType prom.ValueType
+		var help string
+		switch values[i].Type {
+		case blip.CUMULATIVE_COUNTER:
+			promType = prom.CounterValue
+			help = "Replication lag counter metric (repl.lag." + values[i].Name + ")."
+		case blip.GAUGE:
+			promType = prom.GaugeValue
+			help = "Replication lag gauge metric (repl.lag." + values[i].Name + ")."
+		default:
+			// Prometheus doesn't have Delta counter or event types, skipping
+			continue
+		}
+
+		value := values[i].Value
+		if replLagUnit(values[i]) == blip.UNIT_MS && value != -1 && !math.IsNaN(value) {
+			value /= 1000
+		}
+
+		name := tr.name(values[i])
+		keys := labelNames[name]
+		labels := make([]string, len(keys))
+		promKeys := make([]string, len(keys))
+		for j, k := range keys {
+			promKeys[j] = validPrometheusName(k)
+			if v, ok := values[i].Group[k]; ok {
+				labels[j] = v
+			} else {
+				labels[j] = values[i].Meta[k]
+			}
+		}
+
+		ch <- prom.MustNewConstMetric(
+			prom.NewDesc(name, help, promKeys, nil),
+			promType,
+			value,
+			labels...,
+		)
+	}
+}
+
+// name returns the Prometheus name of the metric: mysql_repl_lag, the metric
+// name (none for current), the unit suffix, and _total for counters.
+func (tr ReplLag) name(m blip.MetricValue) string {
+	var parts []string
+	if m.Name != "current" {
+		parts = append(parts, validPrometheusName(m.Name))
+	}
+	switch replLagUnit(m) {
+	case blip.UNIT_MS, blip.UNIT_S:
+		parts = append(parts, "seconds")
+	case "bytes":
+		parts = append(parts, "bytes")
+	}
+	name := prom.BuildFQName(GENERIC_PREFIX, tr.Domain, strings.Join(parts, "_"))
+	if m.Type == blip.CUMULATIVE_COUNTER && !strings.HasSuffix(name, "_total") {
+		name += "_total"
+	}
+	return name
+}
+
+// replLagUnit returns the unit of the metric value: Meta unit (s if repl.lag
+// option unit=s), else the unit in repl.lag Help.
+func replLagUnit(m blip.MetricValue) string {
+	if u := m.Meta["unit"]; u != "" {
+		return u
+	}
+	return replLagUnits[m.Name]
+}
+
+// labelKeys returns the sorted Group and Meta keys, except Meta unit and trace_id.
+func labelKeys(m blip.MetricValue) []string {
+	keys := make([]string, 0, len(m.Group)+len(m.Meta))
+	for k := range m.Group {
+		keys = append(keys, k)
+	}
+	for k := range m.Meta {
+		if k == "unit" || k == "trace_id" {
+			continue
+		}
+		if _, ok := m.Group[k]; !ok {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// union returns the sorted union of a and b.
+func union(a, b []string) []string {
+	seen := make(map[string]bool, len(a)+len(b))
+	u := make([]string, 0, len(a)+len(b))
+	for _, s := range append(a, b...) {
+		if !seen[s] {
+			seen[s] = true
+			u = append(u, s)
+		}
+	}
+	sort.Strings(u)
+	return u
+}
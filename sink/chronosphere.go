@@ -233,3 +233,8 @@ func (s *Chronosphere) Send(ctx context.Context, m *blip.Metrics) (lerr error) {
 func (s *Chronosphere) Name() string {
 	return "chronosphere"
 }
+
+// PreferredUnit returns seconds, the Prometheus convention for time-based metrics.
+func (s *Chronosphere) PreferredUnit() string {
+	return blip.UNIT_S
+}
@@ -249,7 +249,7 @@ func (s *Datadog) Send(ctx context.Context, m *blip.Metrics) error {
 				}
 
 				for k, v := range metrics[i].Meta { // metric meta
-					if k == "ts" { // avoid time series explosion: ts is high cardinality
+					if k == "ts" || k == "trace_id" { // avoid time series explosion: ts and trace_id are high cardinality
 						continue
 					}
 					tags = append(tags, fmt.Sprintf("%s:%s", k, v))
@@ -478,3 +478,8 @@ func (s *Datadog) estimateSize(metrics []datadogV2.MetricSeries) (int, error) {
 func (s *Datadog) Name() string {
 	return "datadog"
 }
+
+// PreferredUnit returns milliseconds, the common Datadog convention for time-based metrics.
+func (s *Datadog) PreferredUnit() string {
+	return blip.UNIT_MS
+}
@@ -44,6 +44,11 @@ func (d *Delta) Name() string {
 	return "delta"
 }
 
+// PreferredUnit returns the unit preferred by the wrapped sink, if any.
+func (d *Delta) PreferredUnit() string {
+	return blip.PreferredUnit([]blip.Sink{d.sink})
+}
+
 // Calculates DELTA_COUNTER values from any CUMULATIVE_COUNTER values in
 // the passed metircs, and then replacees the CUMULATIVE_COUNTER values
 // with the new DELTA_COUNTER values. The updated metrics are forwarded
@@ -237,6 +237,16 @@ func TestDelta_NoDeltaSink(t *testing.T) {
 	}()
 }
 
+func TestDelta_PreferredUnit(t *testing.T) {
+	// Delta forwards the unit preferred by the wrapped sink, if any
+	if got := NewDelta(mock.UnitSink{Unit: blip.UNIT_MS}).PreferredUnit(); got != blip.UNIT_MS {
+		t.Errorf("got unit %q, expected ms", got)
+	}
+	if got := NewDelta(mock.Sink{}).PreferredUnit(); got != "" {
+		t.Errorf("got unit %q, expected empty string", got)
+	}
+}
+
 func TestDelta_NoNilSink(t *testing.T) {
 	func() {
 		defer func() {
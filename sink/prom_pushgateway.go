@@ -51,6 +51,11 @@ func (s *PromPushgateway) Name() string {
 	return "prom-pushgateway"
 }
 
+// PreferredUnit returns seconds, the Prometheus convention for time-based metrics.
+func (s *PromPushgateway) PreferredUnit() string {
+	return blip.UNIT_S
+}
+
 func (s *PromPushgateway) Send(ctx context.Context, m *blip.Metrics) error {
 	status.Monitor(s.monitorId, s.Name(), "sending metrics")
 	defer func() {
@@ -97,6 +97,11 @@ func (rb *Retry) Name() string {
 	return rb.sink.Name()
 }
 
+// PreferredUnit returns the unit preferred by the wrapped sink, if any.
+func (rb *Retry) PreferredUnit() string {
+	return blip.PreferredUnit([]blip.Sink{rb.sink})
+}
+
 // Send buffers, sends, and retries sending metrics on failure. It is safe to call
 // from multiple goroutines.
 func (rb *Retry) Send(ctx context.Context, m *blip.Metrics) error {
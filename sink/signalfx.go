@@ -124,7 +124,7 @@ func (s *SignalFx) Send(ctx context.Context, m *blip.Metrics) error {
 					dim[k] = v
 				}
 				for k, v := range metrics[i].Meta { // metric meta
-					if k == "ts" { // avoid time series explosion: ts is high cardinality
+					if k == "ts" || k == "trace_id" { // avoid time series explosion: ts and trace_id are high cardinality
 						continue
 					}
 					dim[k] = v
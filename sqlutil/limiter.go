@@ -0,0 +1,95 @@
+// Copyright 2024 Block, Inc.
+
+package sqlutil
+
+import (
+	"context"
+	"sync"
+)
+
+// Limiter is a semaphore that bounds the number of concurrent queries, like
+// heavy Performance Schema queries from different collectors that share one
+// connection pool. Acquire a slot before running a query and release it after.
+// It's safe for concurrent use.
+type Limiter struct {
+	sem chan struct{}
+}
+
+// NewLimiter returns a Limiter that allows n concurrent queries. If n is less
+// than 1, it allows 1.
+func NewLimiter(n int) *Limiter {
+	if n < 1 {
+		n = 1
+	}
+	return &Limiter{sem: make(chan struct{}, n)}
+}
+
+// Acquire waits for a slot. It returns the context error if the context is
+// done first, in which case the caller must not call Release.
+func (l *Limiter) Acquire(ctx context.Context) error {
+	select {
+	case l.sem <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Release releases a slot acquired by Acquire.
+func (l *Limiter) Release() {
+	<-l.sem
+}
+
+// Limit returns the number of concurrent queries allowed.
+func (l *Limiter) Limit() int {
+	return cap(l.sem)
+}
+
+// sharedLimiter is a Limiter returned by SharedLimiter and the number of
+// callers that haven't released it.
+type sharedLimiter struct {
+	l    *Limiter
+	refs int
+}
+
+var (
+	sharedMux      = &sync.Mutex{}
+	sharedLimiters = map[string]*sharedLimiter{}
+)
+
+// SharedLimiter returns the Limiter for key, like a monitor ID, which is shared
+// by all callers with the same key and limit n. If the Limiter for the key has
+// a different limit, it's replaced by a new Limiter with limit n and replaced
+// is true. Callers that have the old Limiter keep using it until they call
+// SharedLimiter again. Call ReleaseLimiter when done with the Limiter.
+func SharedLimiter(key string, n int) (l *Limiter, replaced bool) {
+	if n < 1 {
+		n = 1
+	}
+	sharedMux.Lock()
+	defer sharedMux.Unlock()
+	s, ok := sharedLimiters[key]
+	if ok && s.l.Limit() == n {
+		s.refs++
+		return s.l, false
+	}
+	s = &sharedLimiter{l: NewLimiter(n), refs: 1}
+	sharedLimiters[key] = s
+	return s.l, ok
+}
+
+// ReleaseLimiter releases a Limiter returned by SharedLimiter for key. When all
+// callers have released it, it's removed, so the next call to SharedLimiter for
+// the key makes a new Limiter. Releasing a Limiter that was replaced is a no-op.
+func ReleaseLimiter(key string, l *Limiter) {
+	sharedMux.Lock()
+	defer sharedMux.Unlock()
+	s, ok := sharedLimiters[key]
+	if !ok || s.l != l {
+		return // replaced or already removed
+	}
+	s.refs--
+	if s.refs < 1 {
+		delete(sharedLimiters, key)
+	}
+}
@@ -0,0 +1,85 @@
+// Copyright 2024 Block, Inc.
+
+package sqlutil_test
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/cashapp/blip/sqlutil"
+)
+
+func TestLimiter(t *testing.T) {
+	// 10 concurrent queries, limit 2: never more than 2 at once
+	l := sqlutil.NewLimiter(2)
+	var active, max int32
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := l.Acquire(context.Background()); err != nil {
+				t.Error(err)
+				return
+			}
+			defer l.Release()
+			n := atomic.AddInt32(&active, 1)
+			for {
+				m := atomic.LoadInt32(&max)
+				if n <= m || atomic.CompareAndSwapInt32(&max, m, n) {
+					break
+				}
+			}
+			time.Sleep(5 * time.Millisecond)
+			atomic.AddInt32(&active, -1)
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, int32(2), max)
+
+	// Full: Acquire returns the context error
+	l = sqlutil.NewLimiter(1)
+	assert.NoError(t, l.Acquire(context.Background()))
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	assert.ErrorIs(t, l.Acquire(ctx), context.DeadlineExceeded)
+	l.Release()
+	assert.NoError(t, l.Acquire(context.Background()))
+
+	// Less than 1 is 1
+	assert.Equal(t, 1, sqlutil.NewLimiter(0).Limit())
+}
+
+func TestSharedLimiter(t *testing.T) {
+	l1, replaced := sqlutil.SharedLimiter("TestSharedLimiter", 3)
+	assert.False(t, replaced)
+	l2, replaced := sqlutil.SharedLimiter("TestSharedLimiter", 3)
+	assert.False(t, replaced)
+	assert.Same(t, l1, l2)
+	other, _ := sqlutil.SharedLimiter("TestSharedLimiter-other", 3)
+	assert.NotSame(t, l1, other)
+
+	// Different limit replaces the limiter
+	l3, replaced := sqlutil.SharedLimiter("TestSharedLimiter", 5)
+	assert.True(t, replaced)
+	assert.NotSame(t, l1, l3)
+	assert.Equal(t, 5, l3.Limit())
+
+	// Releasing the replaced limiter doesn't remove the new one
+	sqlutil.ReleaseLimiter("TestSharedLimiter", l1)
+	sqlutil.ReleaseLimiter("TestSharedLimiter", l2)
+	l4, _ := sqlutil.SharedLimiter("TestSharedLimiter", 5)
+	assert.Same(t, l3, l4)
+
+	// Removed when all callers release it
+	sqlutil.ReleaseLimiter("TestSharedLimiter", l3)
+	sqlutil.ReleaseLimiter("TestSharedLimiter", l4)
+	l5, replaced := sqlutil.SharedLimiter("TestSharedLimiter", 5)
+	assert.False(t, replaced)
+	assert.NotSame(t, l3, l5)
+}
@@ -0,0 +1,164 @@
+// Copyright 2024 Block, Inc.
+
+package sqlutil
+
+import (
+	"context"
+	"database/sql"
+	"strconv"
+	"strings"
+)
+
+// This file parses SHOW REPLICA|SLAVE STATUS into ReplicaStatus. Column names
+// drifted across versions: MySQL 8.0.22 renamed Master to Source and Slave to
+// Replica (Read_Master_Log_Pos is Read_Source_Log_Pos, for example), and
+// MariaDB reports the channel as Connection_name instead of Channel_Name. The
+// ReplicaStatus fields and Column use the current (Source/Replica) names and
+// find whichever name the server returned, so there's one code path for MySQL
+// 5.7, 8.0, and MariaDB.
+
+// ReplicaStatus is one row (replication channel) of SHOW REPLICA STATUS (MySQL
+// 8.0.22 and newer), SHOW SLAVE STATUS, or MariaDB SHOW ALL SLAVES STATUS.
+// Fields are named like the current column names but are set from either naming
+// family. Numeric fields are not valid if the column is missing, NULL, or not a
+// number, like Seconds_Behind_Source when the SQL thread is not running. Columns
+// has all columns as returned; use Column to read other columns by name.
+type ReplicaStatus struct {
+	Channel             string        // Channel_Name (MariaDB Connection_name), "" for the default channel
+	SourceHost          string        // Source_Host
+	SourceUUID          string        // Source_UUID
+	IORunning           string        // Replica_IO_Running: Yes, No, or Connecting
+	SQLRunning          string        // Replica_SQL_Running: Yes or No
+	LastErrno           sql.NullInt64 // Last_Errno (alias of Last_SQL_Errno)
+	LastSQLErrno        sql.NullInt64 // Last_SQL_Errno
+	LastIOErrno         sql.NullInt64 // Last_IO_Errno
+	SourceLogFile       string        // Source_Log_File: source binary log read by the IO thread
+	ReadSourceLogPos    sql.NullInt64 // Read_Source_Log_Pos
+	RelaySourceLogFile  string        // Relay_Source_Log_File: source binary log executed by the SQL thread
+	ExecSourceLogPos    sql.NullInt64 // Exec_Source_Log_Pos
+	RelayLogSpace       sql.NullInt64 // Relay_Log_Space: bytes
+	SecondsBehindSource sql.NullInt64 // Seconds_Behind_Source
+	SQLDelay            sql.NullInt64 // SQL_Delay: seconds
+	ExecutedGtidSet     string        // Executed_Gtid_Set without newlines and spaces
+	AutoPosition        bool          // Auto_Position = 1
+
+	Columns map[string]string // all columns, keyed on name as returned
+}
+
+// ParseReplicaStatus returns the ReplicaStatus of a SHOW REPLICA|SLAVE STATUS
+// row from RowToMap or RowsToMaps. It never fails: missing or invalid values
+// are zero or not valid.
+func ParseReplicaStatus(status map[string]string) ReplicaStatus {
+	s := ReplicaStatus{Columns: status}
+	str := func(col string) string {
+		v, _ := s.Column(col)
+		return v
+	}
+	num := func(col string) sql.NullInt64 {
+		n, err := strconv.ParseInt(strings.TrimSpace(str(col)), 10, 64)
+		return sql.NullInt64{Int64: n, Valid: err == nil}
+	}
+	s.Channel = str("Channel_Name")
+	s.SourceHost = str("Source_Host")
+	s.SourceUUID = str("Source_UUID")
+	s.IORunning = str("Replica_IO_Running")
+	s.SQLRunning = str("Replica_SQL_Running")
+	s.LastErrno = num("Last_Errno")
+	s.LastSQLErrno = num("Last_SQL_Errno")
+	s.LastIOErrno = num("Last_IO_Errno")
+	s.SourceLogFile = str("Source_Log_File")
+	s.ReadSourceLogPos = num("Read_Source_Log_Pos")
+	s.RelaySourceLogFile = str("Relay_Source_Log_File")
+	s.ExecSourceLogPos = num("Exec_Source_Log_Pos")
+	s.RelayLogSpace = num("Relay_Log_Space")
+	s.SecondsBehindSource = num("Seconds_Behind_Source")
+	s.SQLDelay = num("SQL_Delay")
+	s.ExecutedGtidSet = strings.NewReplacer("\n", "", " ", "").Replace(str("Executed_Gtid_Set")) // MySQL wraps the set after each comma
+	s.AutoPosition = str("Auto_Position") == "1"
+	return s
+}
+
+// ScanReplicaStatus scans all rows of SHOW REPLICA|SLAVE STATUS, one per
+// replication channel. It returns nil if there are no rows: not a replica.
+// The caller must close rows.
+func ScanReplicaStatus(rows *sql.Rows) ([]ReplicaStatus, error) {
+	maps, err := scanMaps(rows)
+	if err != nil {
+		return nil, err
+	}
+	var status []ReplicaStatus
+	for _, m := range maps {
+		status = append(status, ParseReplicaStatus(m))
+	}
+	return status, nil
+}
+
+// ReplicaStatusRows runs query, like SHOW REPLICA STATUS, and returns the rows
+// from ScanReplicaStatus.
+func ReplicaStatusRows(ctx context.Context, db *sql.DB, query string) ([]ReplicaStatus, error) {
+	rows, err := db.QueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	return ScanReplicaStatus(rows)
+}
+
+// Column returns the value of a column by name in either naming family, and
+// true if the row has the column. Names are matched exactly first, then
+// case-insensitively.
+func (s ReplicaStatus) Column(col string) (string, bool) {
+	names := replicaStatusNames(col)
+	for _, name := range names {
+		if v, ok := s.Columns[name]; ok {
+			return v, true
+		}
+	}
+	for _, name := range names {
+		for k, v := range s.Columns {
+			if strings.EqualFold(k, name) {
+				return v, true
+			}
+		}
+	}
+	return "", false
+}
+
+// replicaStatusTerms maps current terms to the terms they replaced. Terms are
+// matched as whole parts of a column name split on "_", so "Replicate_Do_DB"
+// doesn't match "Replica".
+var replicaStatusTerms = map[string]string{
+	"Source":  "Master",
+	"Replica": "Slave",
+}
+
+// replicaStatusAliases maps a column name to other names for the same column
+// that aren't a term rename.
+var replicaStatusAliases = map[string][]string{
+	"Channel_Name": {"Connection_name"},
+}
+
+// replicaStatusNames returns the names of a SHOW REPLICA|SLAVE STATUS column:
+// the given name first, then the name with old terms (or new terms, if given
+// an old name), then any aliases.
+func replicaStatusNames(col string) []string {
+	names := []string{col}
+	parts := strings.Split(col, "_")
+	renamed := false
+	for i, p := range parts {
+		for cur, old := range replicaStatusTerms {
+			switch p {
+			case cur:
+				parts[i] = old
+				renamed = true
+			case old:
+				parts[i] = cur
+				renamed = true
+			}
+		}
+	}
+	if renamed {
+		names = append(names, strings.Join(parts, "_"))
+	}
+	return append(names, replicaStatusAliases[col]...)
+}
@@ -0,0 +1,179 @@
+// Copyright 2024 Block, Inc.
+
+package sqlutil
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"testing"
+
+	"github.com/go-test/deep"
+
+	"github.com/cashapp/blip/test/mock"
+)
+
+func TestScanReplicaStatus(t *testing.T) {
+	// MySQL 5.7 SHOW SLAVE STATUS (subset of columns), default channel, SQL
+	// thread not running (Seconds_Behind_Master is NULL)
+	mysql57 := mock.SQLResult{
+		Columns: []string{"Slave_IO_State", "Master_Host", "Master_Log_File", "Read_Master_Log_Pos", "Relay_Master_Log_File",
+			"Slave_IO_Running", "Slave_SQL_Running", "Last_Errno", "Exec_Master_Log_Pos", "Relay_Log_Space",
+			"Seconds_Behind_Master", "Last_IO_Errno", "Last_SQL_Errno", "Master_UUID", "SQL_Delay", "Executed_Gtid_Set", "Auto_Position", "Channel_Name"},
+		Rows: [][]driver.Value{{"Waiting for master to send event", "db1", "mysql-bin.000012", "5000", "mysql-bin.000011",
+			"Yes", "No", "1062", "1200", "4096",
+			nil, "0", "1062", "3e11fa47-71ca-11e1-9e33-c80aa9429562", "0", "", "0", ""}},
+	}
+	// MySQL 8.0 SHOW REPLICA STATUS, two channels
+	mysql80 := mock.SQLResult{
+		Columns: []string{"Replica_IO_State", "Source_Host", "Source_Log_File", "Read_Source_Log_Pos", "Relay_Source_Log_File",
+			"Replica_IO_Running", "Replica_SQL_Running", "Last_Errno", "Exec_Source_Log_Pos", "Relay_Log_Space",
+			"Seconds_Behind_Source", "Last_IO_Errno", "Last_SQL_Errno", "Source_UUID", "SQL_Delay", "Executed_Gtid_Set", "Auto_Position", "Channel_Name"},
+		Rows: [][]driver.Value{
+			{"Waiting for source to send event", "db1", "binlog.000003", "900", "binlog.000003",
+				"Yes", "Yes", "0", "800", "2048",
+				"1", "0", "0", "3e11fa47-71ca-11e1-9e33-c80aa9429562", "3600", "3e11fa47-71ca-11e1-9e33-c80aa9429562:1-10,\n3e11fa47-71ca-11e1-9e33-c80aa9429563:1-5", "1", "ch1"},
+			{"Connecting to source", "db2", "binlog.000007", "100", "binlog.000006",
+				"Connecting", "Yes", "0", "50", "1024",
+				"0", "2003", "0", "3e11fa47-71ca-11e1-9e33-c80aa9429563", "0", "3e11fa47-71ca-11e1-9e33-c80aa9429562:1-10,\n3e11fa47-71ca-11e1-9e33-c80aa9429563:1-5", "1", "ch2"},
+		},
+	}
+	gtids := "3e11fa47-71ca-11e1-9e33-c80aa9429562:1-10,3e11fa47-71ca-11e1-9e33-c80aa9429563:1-5"
+
+	tests := []struct {
+		name   string
+		result mock.SQLResult
+		expect []ReplicaStatus
+	}{
+		{
+			name:   "mysql57",
+			result: mysql57,
+			expect: []ReplicaStatus{{
+				SourceHost:          "db1",
+				SourceUUID:          "3e11fa47-71ca-11e1-9e33-c80aa9429562",
+				IORunning:           "Yes",
+				SQLRunning:          "No",
+				LastErrno:           sql.NullInt64{Int64: 1062, Valid: true},
+				LastSQLErrno:        sql.NullInt64{Int64: 1062, Valid: true},
+				LastIOErrno:         sql.NullInt64{Int64: 0, Valid: true},
+				SourceLogFile:       "mysql-bin.000012",
+				ReadSourceLogPos:    sql.NullInt64{Int64: 5000, Valid: true},
+				RelaySourceLogFile:  "mysql-bin.000011",
+				ExecSourceLogPos:    sql.NullInt64{Int64: 1200, Valid: true},
+				RelayLogSpace:       sql.NullInt64{Int64: 4096, Valid: true},
+				SecondsBehindSource: sql.NullInt64{}, // NULL
+				SQLDelay:            sql.NullInt64{Int64: 0, Valid: true},
+			}},
+		},
+		{
+			name:   "mysql80 multi-channel",
+			result: mysql80,
+			expect: []ReplicaStatus{
+				{
+					Channel:             "ch1",
+					SourceHost:          "db1",
+					SourceUUID:          "3e11fa47-71ca-11e1-9e33-c80aa9429562",
+					IORunning:           "Yes",
+					SQLRunning:          "Yes",
+					LastErrno:           sql.NullInt64{Int64: 0, Valid: true},
+					LastSQLErrno:        sql.NullInt64{Int64: 0, Valid: true},
+					LastIOErrno:         sql.NullInt64{Int64: 0, Valid: true},
+					SourceLogFile:       "binlog.000003",
+					ReadSourceLogPos:    sql.NullInt64{Int64: 900, Valid: true},
+					RelaySourceLogFile:  "binlog.000003",
+					ExecSourceLogPos:    sql.NullInt64{Int64: 800, Valid: true},
+					RelayLogSpace:       sql.NullInt64{Int64: 2048, Valid: true},
+					SecondsBehindSource: sql.NullInt64{Int64: 1, Valid: true},
+					SQLDelay:            sql.NullInt64{Int64: 3600, Valid: true},
+					ExecutedGtidSet:     gtids,
+					AutoPosition:        true,
+				},
+				{
+					Channel:             "ch2",
+					SourceHost:          "db2",
+					SourceUUID:          "3e11fa47-71ca-11e1-9e33-c80aa9429563",
+					IORunning:           "Connecting",
+					SQLRunning:          "Yes",
+					LastErrno:           sql.NullInt64{Int64: 0, Valid: true},
+					LastSQLErrno:        sql.NullInt64{Int64: 0, Valid: true},
+					LastIOErrno:         sql.NullInt64{Int64: 2003, Valid: true},
+					SourceLogFile:       "binlog.000007",
+					ReadSourceLogPos:    sql.NullInt64{Int64: 100, Valid: true},
+					RelaySourceLogFile:  "binlog.000006",
+					ExecSourceLogPos:    sql.NullInt64{Int64: 50, Valid: true},
+					RelayLogSpace:       sql.NullInt64{Int64: 1024, Valid: true},
+					SecondsBehindSource: sql.NullInt64{Int64: 0, Valid: true},
+					SQLDelay:            sql.NullInt64{Int64: 0, Valid: true},
+					ExecutedGtidSet:     gtids,
+					AutoPosition:        true,
+				},
+			},
+		},
+		{
+			name:   "not a replica",
+			result: mock.SQLResult{Columns: mysql80.Columns},
+			expect: nil,
+		},
+	}
+	for _, tc := range tests {
+		m := mock.NewSQL(map[string]mock.SQLResult{"STATUS": tc.result})
+		got, err := ReplicaStatusRows(context.Background(), m.DB(), "SHOW REPLICA STATUS")
+		if err != nil {
+			t.Fatalf("%s: %s", tc.name, err)
+		}
+		for i := range got {
+			if got[i].Columns == nil {
+				t.Errorf("%s: row %d: Columns not set", tc.name, i)
+			}
+			got[i].Columns = nil // tested below
+		}
+		if diff := deep.Equal(got, tc.expect); diff != nil {
+			t.Errorf("%s: %v", tc.name, diff)
+		}
+	}
+
+	// Error
+	m := mock.NewSQL(map[string]mock.SQLResult{"STATUS": {Err: driver.ErrBadConn}})
+	if _, err := ReplicaStatusRows(context.Background(), m.DB(), "SHOW REPLICA STATUS"); err == nil {
+		t.Error("no error, expected one")
+	}
+}
+
+func TestReplicaStatusColumn(t *testing.T) {
+	mysql57 := ParseReplicaStatus(map[string]string{
+		"Master_Host":     "db1",
+		"Replicate_Do_DB": "app",
+		"sql_delay":       "5",
+	})
+	mariadb := ParseReplicaStatus(map[string]string{
+		"Connection_name":  "conn1",
+		"Slave_IO_Running": "Yes",
+	})
+	tests := []struct {
+		status ReplicaStatus
+		col    string
+		val    string
+		ok     bool
+	}{
+		{mysql57, "Source_Host", "db1", true},     // new term finds old term
+		{mysql57, "Master_Host", "db1", true},     // old term
+		{mysql57, "Replicate_Do_DB", "app", true}, // Replicate isn't the term Replica
+		{mysql57, "Slavete_Do_DB", "", false},     // not renamed
+		{mysql57, "SQL_Delay", "5", true},         // case-insensitive
+		{mysql57, "Seconds_Behind_Source", "", false},
+		{mariadb, "Channel_Name", "conn1", true}, // alias
+		{mariadb, "Replica_IO_Running", "Yes", true},
+	}
+	for _, tc := range tests {
+		val, ok := tc.status.Column(tc.col)
+		if val != tc.val || ok != tc.ok {
+			t.Errorf("Column(%s) = %q, %t, expected %q, %t", tc.col, val, ok, tc.val, tc.ok)
+		}
+	}
+	if mariadb.Channel != "conn1" {
+		t.Errorf("Channel = %q, expected conn1", mariadb.Channel)
+	}
+	if !mysql57.SQLDelay.Valid || mysql57.SQLDelay.Int64 != 5 {
+		t.Errorf("SQLDelay = %+v, expected 5", mysql57.SQLDelay)
+	}
+}
@@ -17,8 +17,15 @@ import (
 )
 
 // Float64 converts string to float64. If successful, it returns the float64
-// value and true, else it returns 0, false.
+// value and true, else it returns 0, false. Leading and trailing whitespace is
+// ignored, and scientific notation like "1.5e3" is parsed. An empty string or
+// "NULL" (any case) returns 0, false, so a NULL value scanned into a string or
+// sql.NullString can be passed directly.
 func Float64(s string) (float64, bool) {
+	s = strings.TrimSpace(s)
+	if s == "" || strings.EqualFold(s, "NULL") {
+		return 0, false
+	}
 	f, err := strconv.ParseFloat(s, 64)
 	if err == nil {
 		return f, true
@@ -49,6 +56,87 @@ func CleanObjectName(o string) string {
 	return strings.TrimSpace(o) // must be last in case Replace make space
 }
 
+// QuoteIdentifier returns the identifier quoted with backticks, like "tbl" to
+// "`tbl`". Backticks in the identifier are escaped by doubling them, so the
+// return value is always a single, safe identifier, even for reserved words.
+func QuoteIdentifier(name string) string {
+	return "`" + strings.ReplaceAll(name, "`", "``") + "`"
+}
+
+// QuoteQualifiedName returns the dot-separated name with each part quoted by
+// QuoteIdentifier, like "db.tbl" to "`db`.`tbl`". Parts can already be quoted,
+// which is necessary only if a part contains a dot: "`my.db`.tbl" returns
+// "`my.db`.`tbl`". If the name has only one part and db is not empty, db is
+// prepended: QuoteQualifiedName("tbl", "db") returns "`db`.`tbl`".
+func QuoteQualifiedName(name, db string) string {
+	parts := splitQualifiedName(name)
+	if len(parts) == 1 && db != "" {
+		parts = append([]string{db}, parts...)
+	}
+	for i := range parts {
+		parts[i] = QuoteIdentifier(parts[i])
+	}
+	return strings.Join(parts, ".")
+}
+
+// SplitQualifiedName returns the unquoted parts of the dot-separated name, like
+// "`db`.tbl" to ["db", "tbl"]. Parts are split like QuoteQualifiedName.
+func SplitQualifiedName(name string) []string {
+	return splitQualifiedName(name)
+}
+
+// splitQualifiedName splits name on dots that are not inside backticks, and
+// unquotes backtick-quoted parts. Unquoted parts are trimmed of spaces.
+func splitQualifiedName(name string) []string {
+	var parts []string
+	var part strings.Builder
+	quoted := false // part is backtick-quoted
+	inQuote := false
+	for i := 0; i < len(name); i++ {
+		ch := name[i]
+		switch {
+		case inQuote && ch == '`' && i+1 < len(name) && name[i+1] == '`':
+			part.WriteByte('`') // escaped backtick
+			i++
+		case ch == '`' && (inQuote || strings.TrimSpace(part.String()) == ""):
+			if !inQuote {
+				part.Reset()
+				quoted = true
+			}
+			inQuote = !inQuote
+		case ch == '.' && !inQuote:
+			parts = append(parts, trimPart(part.String(), quoted))
+			part.Reset()
+			quoted = false
+		default:
+			part.WriteByte(ch)
+		}
+	}
+	return append(parts, trimPart(part.String(), quoted))
+}
+
+func trimPart(s string, quoted bool) string {
+	if quoted {
+		return s
+	}
+	return strings.TrimSpace(s)
+}
+
+// AndVars returns a SQL expression that's true (1) only if all the comma-separated
+// MySQL global variables are true, like "@@`read_only` AND @@`custom_var`". A single
+// variable returns only that variable, like "@@`read_only`". Variable names are
+// not validated but they are quoted by QuoteQualifiedName, so component variables
+// like "validate_password.length" work.
+func AndVars(csv string) string {
+	var vars []string
+	for _, v := range strings.Split(csv, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			vars = append(vars, "@@"+QuoteQualifiedName(v, ""))
+		}
+	}
+	return strings.Join(vars, " AND ")
+}
+
 func ObjectList(csv string, quoteChar string) []string {
 	objs := strings.Split(csv, ",")
 	for i := range objs {
@@ -124,7 +212,8 @@ func ReadOnly(err error) bool {
 // This is used for one-row command outputs like SHOW SLAVE|REPLICA STATUS
 // that have a mix of values and variaible columns (based on MySQL version)
 // but the caller only needs specific cols/vals, so it uses this generic map
-// rather than a specific struct.
+// rather than a specific struct. For replica status, ReplicaStatusRows returns
+// typed values (see ReplicaStatus).
 func RowToMap(ctx context.Context, db *sql.DB, query string) (map[string]string, error) {
 	rows, err := db.QueryContext(ctx, query)
 	if err != nil {
@@ -169,3 +258,44 @@ func RowToMap(ctx context.Context, db *sql.DB, query string) (map[string]string,
 
 	return m, nil
 }
+
+// RowsToMaps converts all rows from query to maps of strings keyed on column
+// name, like RowToMap. This is used for multi-row command outputs like
+// SHOW SLAVE|REPLICA STATUS with multiple replication channels (one row per
+// channel). It returns nil if query returns zero rows.
+func RowsToMaps(ctx context.Context, db *sql.DB, query string) ([]map[string]string, error) {
+	rows, err := db.QueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	return scanMaps(rows)
+}
+
+// scanMaps scans all rows to maps of strings keyed on column name, like
+// RowsToMaps. It returns nil if there are no rows.
+func scanMaps(rows *sql.Rows) ([]map[string]string, error) {
+	columns, err := rows.Columns()
+	if err != nil {
+		return nil, err
+	}
+	scanArgs := make([]interface{}, len(columns))
+	values := make([]sql.RawBytes, len(columns))
+	for i := range values {
+		scanArgs[i] = &values[i]
+	}
+
+	var maps []map[string]string
+	for rows.Next() {
+		if err = rows.Scan(scanArgs...); err != nil {
+			return nil, err
+		}
+		// Convert now: RawBytes are only valid until the next call to Next
+		m := make(map[string]string, len(columns))
+		for i, col := range columns {
+			m[col] = string(values[i])
+		}
+		maps = append(maps, m)
+	}
+	return maps, rows.Err()
+}
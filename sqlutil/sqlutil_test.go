@@ -16,14 +16,78 @@ func TestFloat64(t *testing.T) {
 		{s: "0.0", f: 0, ok: true},
 		{s: "1.0", f: 1.0, ok: true},
 		{s: "1", f: 1.0, ok: true},
+		{s: "1.5e3", f: 1500, ok: true},
+		{s: "1.7169222055e+09", f: 1716922205.5, ok: true},
+		{s: " 42 ", f: 42, ok: true},
+		{s: "\t42\n", f: 42, ok: true},
+		{s: "NULL", f: 0, ok: false},
+		{s: "null", f: 0, ok: false},
+		{s: "", f: 0, ok: false},
+		{s: "  ", f: 0, ok: false},
+		{s: "garbage", f: 0, ok: false},
+		{s: "1,5", f: 0, ok: false},
+		{s: "12abc", f: 0, ok: false},
 	}
 	for _, ft := range floatTests {
 		f, ok := Float64(ft.s)
 		if f != ft.f {
-			t.Errorf("Float64(\"%s\"): got %f, expected 1.0", ft.s, ft.f)
+			t.Errorf("Float64(\"%s\"): got %f, expected %f", ft.s, f, ft.f)
 		}
 		if ok != ft.ok {
 			t.Errorf("Float64(\"%s\"): conversion ok=%t, expected ok=%t", ft.s, ok, ft.ok)
 		}
 	}
 }
+
+func TestAndVars(t *testing.T) {
+	tests := map[string]string{
+		"read_only":                "@@`read_only`",
+		"read_only,is_replica":     "@@`read_only` AND @@`is_replica`",
+		" read_only , is_replica":  "@@`read_only` AND @@`is_replica`",
+		"validate_password.length": "@@`validate_password`.`length`",
+		"":                         "",
+	}
+	for csv, expect := range tests {
+		if got := AndVars(csv); got != expect {
+			t.Errorf("AndVars(%q) = %q, expected %q", csv, got, expect)
+		}
+	}
+}
+
+func TestQuoteIdentifier(t *testing.T) {
+	tests := map[string]string{
+		"tbl":      "`tbl`",
+		"select":   "`select`", // reserved word
+		"my`tbl":   "`my``tbl`",
+		"a.b":      "`a.b`", // one identifier, not qualified
+		"x`; DROP": "`x``; DROP`",
+		"":         "``",
+	}
+	for name, expect := range tests {
+		if got := QuoteIdentifier(name); got != expect {
+			t.Errorf("QuoteIdentifier(%q) = %q, expected %q", name, got, expect)
+		}
+	}
+}
+
+func TestQuoteQualifiedName(t *testing.T) {
+	tests := []struct {
+		name, db, expect string
+	}{
+		{"tbl", "", "`tbl`"},
+		{"tbl", "blip", "`blip`.`tbl`"},
+		{"db.tbl", "blip", "`db`.`tbl`"},
+		{" db . tbl ", "", "`db`.`tbl`"},
+		{"order.group", "", "`order`.`group`"}, // reserved words
+		{"`db`.`tbl`", "", "`db`.`tbl`"},       // already quoted
+		{"`my.db`.tbl", "", "`my.db`.`tbl`"},   // dot in quoted part
+		{"`my``db`.tbl", "", "`my``db`.`tbl`"}, // escaped backtick
+		{"my`db.tbl", "", "`my``db`.`tbl`"},    // unescaped backtick
+		{"db.`t`.x", "", "`db`.`t`.`x`"},
+	}
+	for _, tc := range tests {
+		if got := QuoteQualifiedName(tc.name, tc.db); got != tc.expect {
+			t.Errorf("QuoteQualifiedName(%q, %q) = %q, expected %q", tc.name, tc.db, got, tc.expect)
+		}
+	}
+}
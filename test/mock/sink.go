@@ -24,3 +24,15 @@ func (s Sink) Send(ctx context.Context, m *blip.Metrics) error {
 func (s Sink) Name() string {
 	return "mock.Sink"
 }
+
+// UnitSink is a Sink that prefers a unit for time-based metrics (blip.SinkUnit).
+type UnitSink struct {
+	Sink
+	Unit string
+}
+
+var _ blip.SinkUnit = UnitSink{}
+
+func (s UnitSink) PreferredUnit() string {
+	return s.Unit
+}
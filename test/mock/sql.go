@@ -0,0 +1,289 @@
+// Copyright 2024 Block, Inc.
+
+package mock
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// SQLResult is the result of one query: columns and rows, or an error.
+// More are additional result sets, like from a CALL that returns several.
+type SQLResult struct {
+	Columns []string
+	Rows    [][]driver.Value
+	Err     error
+	More    []SQLResult
+}
+
+// SQL is a mock database/sql driver. Use DB to make a *sql.DB that returns
+// results from Results or QueryFunc instead of querying MySQL. This is used
+// to test collectors with specific result sets without running MySQL.
+type SQL struct {
+	// Results are returned for queries that contain the key. If several keys
+	// match, the longest key is used. Query args are interpolated for matching,
+	// so a key can contain arg values, like "src_id='s1'" for "src_id=?".
+	Results map[string]SQLResult
+
+	// QueryFunc is optional. If set, it's called first (with the query as
+	// executed, not interpolated), and its result is returned if it returns true.
+	QueryFunc func(query string) (SQLResult, bool)
+
+	*sync.Mutex
+	queries []string
+	args    [][]interface{}
+}
+
+// NewSQL returns a mock SQL driver that returns the given results.
+func NewSQL(results map[string]SQLResult) *SQL {
+	if results == nil {
+		results = map[string]SQLResult{}
+	}
+	return &SQL{
+		Results: results,
+		Mutex:   &sync.Mutex{},
+	}
+}
+
+// DB returns a new *sql.DB that uses the mock driver.
+func (m *SQL) DB() *sql.DB {
+	return sql.OpenDB(sqlConnector{m: m})
+}
+
+// Set sets the result for queries that contain the key.
+func (m *SQL) Set(key string, r SQLResult) {
+	m.Lock()
+	defer m.Unlock()
+	m.Results[key] = r
+}
+
+// Queries returns all queries executed, in order.
+func (m *SQL) Queries() []string {
+	m.Lock()
+	defer m.Unlock()
+	q := make([]string, len(m.queries))
+	copy(q, m.queries)
+	return q
+}
+
+// Args returns the args of all queries executed, in order: Args()[i] are the
+// args of Queries()[i], or nil if the query had none.
+func (m *SQL) Args() [][]interface{} {
+	m.Lock()
+	defer m.Unlock()
+	a := make([][]interface{}, len(m.args))
+	copy(a, m.args)
+	return a
+}
+
+// Count returns the number of queries executed that contain the substring.
+func (m *SQL) Count(substr string) int {
+	m.Lock()
+	defer m.Unlock()
+	n := 0
+	for _, q := range m.queries {
+		if strings.Contains(q, substr) {
+			n++
+		}
+	}
+	return n
+}
+
+func (m *SQL) result(query string, args []driver.NamedValue) SQLResult {
+	var vals []interface{}
+	if len(args) > 0 {
+		vals = make([]interface{}, len(args))
+		for i := range args {
+			vals[i] = args[i].Value
+		}
+	}
+
+	m.Lock()
+	m.queries = append(m.queries, query)
+	m.args = append(m.args, vals)
+	f := m.QueryFunc
+	m.Unlock()
+
+	if f != nil {
+		if r, ok := f(query); ok {
+			return r
+		}
+	}
+
+	if vals != nil {
+		query = interpolate(query, vals) // match Results keys on arg values
+	}
+
+	m.Lock()
+	defer m.Unlock()
+	keys := make([]string, 0, len(m.Results))
+	for k := range m.Results {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool { return len(keys[i]) > len(keys[j]) })
+	for _, k := range keys {
+		if strings.Contains(query, k) {
+			return m.Results[k]
+		}
+	}
+	return SQLResult{Err: fmt.Errorf("mock: no result for query: %s", query)}
+}
+
+// interpolate replaces ? placeholders in the query with the args quoted as SQL
+// literals, like a client-side prepared statement, so results can be keyed on
+// arg values. It's only for matching: the driver never sees this query.
+func interpolate(query string, args []interface{}) string {
+	var b strings.Builder
+	n := 0
+	for _, c := range query {
+		if c != '?' || n >= len(args) {
+			b.WriteRune(c)
+			continue
+		}
+		switch v := args[n].(type) {
+		case string:
+			b.WriteString("'" + strings.ReplaceAll(v, "'", "''") + "'")
+		case []byte:
+			b.WriteString("'" + strings.ReplaceAll(string(v), "'", "''") + "'")
+		case nil:
+			b.WriteString("NULL")
+		default:
+			fmt.Fprintf(&b, "%v", v)
+		}
+		n++
+	}
+	return b.String()
+}
+
+// --------------------------------------------------------------------------
+
+type sqlConnector struct {
+	m *SQL
+}
+
+func (c sqlConnector) Connect(context.Context) (driver.Conn, error) {
+	return sqlConn{m: c.m}, nil
+}
+
+func (c sqlConnector) Driver() driver.Driver {
+	return sqlDriver{m: c.m}
+}
+
+type sqlDriver struct {
+	m *SQL
+}
+
+func (d sqlDriver) Open(string) (driver.Conn, error) {
+	return sqlConn{m: d.m}, nil
+}
+
+type sqlConn struct {
+	m *SQL
+}
+
+var _ driver.QueryerContext = sqlConn{}
+var _ driver.ExecerContext = sqlConn{}
+
+func (c sqlConn) Prepare(query string) (driver.Stmt, error) {
+	return sqlStmt{m: c.m, query: query}, nil
+}
+
+func (c sqlConn) Close() error {
+	return nil
+}
+
+func (c sqlConn) Begin() (driver.Tx, error) {
+	return sqlTx{}, nil
+}
+
+func (c sqlConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	r := c.m.result(query, args)
+	if r.Err != nil {
+		return nil, r.Err
+	}
+	return &sqlRows{columns: r.Columns, rows: r.Rows, more: r.More}, nil
+}
+
+func (c sqlConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	r := c.m.result(query, args)
+	if r.Err != nil {
+		return nil, r.Err
+	}
+	return driver.RowsAffected(len(r.Rows)), nil
+}
+
+type sqlStmt struct {
+	m     *SQL
+	query string
+}
+
+func (s sqlStmt) Close() error {
+	return nil
+}
+
+func (s sqlStmt) NumInput() int {
+	return -1
+}
+
+func (s sqlStmt) Exec(args []driver.Value) (driver.Result, error) {
+	return sqlConn{m: s.m}.ExecContext(context.Background(), s.query, nil)
+}
+
+func (s sqlStmt) Query(args []driver.Value) (driver.Rows, error) {
+	return sqlConn{m: s.m}.QueryContext(context.Background(), s.query, nil)
+}
+
+type sqlTx struct{}
+
+func (tx sqlTx) Commit() error {
+	return nil
+}
+
+func (tx sqlTx) Rollback() error {
+	return nil
+}
+
+type sqlRows struct {
+	columns []string
+	rows    [][]driver.Value
+	n       int
+	more    []SQLResult
+}
+
+var _ driver.RowsNextResultSet = &sqlRows{}
+
+func (r *sqlRows) Columns() []string {
+	return r.columns
+}
+
+func (r *sqlRows) Close() error {
+	return nil
+}
+
+func (r *sqlRows) Next(dest []driver.Value) error {
+	if r.n >= len(r.rows) {
+		return io.EOF
+	}
+	copy(dest, r.rows[r.n])
+	r.n++
+	return nil
+}
+
+func (r *sqlRows) HasNextResultSet() bool {
+	return len(r.more) > 0
+}
+
+func (r *sqlRows) NextResultSet() error {
+	if len(r.more) == 0 {
+		return io.EOF
+	}
+	next := r.more[0]
+	r.columns, r.rows, r.n, r.more = next.Columns, next.Rows, 0, r.more[1:]
+	return nil
+}
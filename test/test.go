@@ -83,14 +83,22 @@ func ReadPlan(t *testing.T, file string) blip.Plan {
 	levels := make(map[string]blip.Level, len(pf))
 	for k := range pf {
 		levels[k] = blip.Level{
-			Name:    k, // must have, levels are collected by name
-			Freq:    pf[k].Freq,
-			Collect: pf[k].Collect,
+			Name:     k, // must have, levels are collected by name
+			Freq:     pf[k].Freq,
+			From:     pf[k].From,
+			Collect:  pf[k].Collect,
+			Defaults: pf[k].Defaults,
+			Labels:   pf[k].Labels,
 		}
 	}
 
-	return blip.Plan{
+	plan := blip.Plan{
 		Name:   file,
 		Levels: levels,
 	}
+	plan.ApplyDefaults()
+	if err := plan.ResolveIncludes(); err != nil {
+		t.Fatal(err)
+	}
+	return plan
 }